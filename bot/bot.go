@@ -0,0 +1,356 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package bot
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/session_manager"
+	"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+服务端bot：IVR提示音、语音信箱的问候语、AI助手等以一个普通参与者的身份加入通话。
+1. Host在YCK侧是一个普通用户(config.Uid)，和SIP网关一样通过relay注册并收发信令
+2. 收到Invite时问Bot.Answer，接听则回Accept并向invite中的relay做turn reg加入session；
+   session manager代发的多方Invite（管理接口POST /sessions/bot）回给session manager，1-1的Invite回给主叫
+3. session里其他人的音频包交给Bot.OnAudio，Invite、Cancel、End以外的信令交给Bot.OnSignal；
+   Bot通过Call发音频、信令或挂断
+4. 对方挂断、bot自己挂断或Host停止时调用Bot.OnEnd
+Bot的回调都在Host的主循环里调用，不能阻塞；播放提示音等耗时的事放到自己的goroutine里，Call的方法可以在任何goroutine调用。
+*/
+
+type Bot interface {
+	Answer(call *Call) bool                         //收到Invite时调用，返回false为拒接
+	OnAudio(call *Call, from int64, payload []byte) //session里其他人的音频payload
+	OnSignal(call *Call, s *relay.Signal)
+	OnEnd(call *Call)
+}
+
+type Call struct {
+	Sid    int64
+	Caller int64                  //发起邀请的uid，session manager代发时取Info里的caller
+	Info   map[string]interface{} //Invite的Info
+	Relay  *net.UDPAddr           //媒体走的relay
+	multi  bool                   //session manager代发的多方Invite
+	ended  int32
+	host   *Host
+}
+
+func (c *Call) SendAudio(payload []byte) error {
+	msg := relay.NewMessage(relay.UdpMessageTypeAudioStream, c.host.config.Uid, c.Sid, 0, payload, nil)
+	_, err := c.host.relayConn.WriteToUDP(msg.ObfuscatedDataOfMessage(), c.Relay)
+	return err
+}
+
+//多方通话发给session manager，1-1发给主叫
+func (c *Call) SendSignal(signalType uint16, info map[string]interface{}) {
+	to := c.Caller
+	if c.multi {
+		to = session_manager.SessionManagerUserId
+	}
+	c.host.sendSignal(signalType, to, c.Sid, info)
+}
+
+//挂断并离开session，之后会调用Bot.OnEnd
+func (c *Call) Hangup() {
+	if !atomic.CompareAndSwapInt32(&c.ended, 0, 1) {
+		return
+	}
+	c.SendSignal(relay.YCKCallSignalTypeEnd, nil)
+	select {
+	case c.host.hangupCh <- c:
+	case <-c.host.stop:
+	}
+}
+
+type Host struct {
+	config    *Config
+	bot       Bot
+	relayConn *net.UDPConn
+	relayCh   chan *relay.ReceivedPacket
+	hangupCh  chan *Call
+	calls     map[int64]*Call
+	dedup     *utils.LRU
+	isRunning bool
+	lock      sync.RWMutex
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	ticker    *time.Ticker
+}
+
+func NewHost(config *Config, bot Bot) *Host {
+	h := &Host{
+		config:    config,
+		bot:       bot,
+		relayCh:   make(chan *relay.ReceivedPacket, 100),
+		hangupCh:  make(chan *Call, 100),
+		calls:     make(map[int64]*Call),
+		dedup:     utils.NewLRU(1000, nil),
+		isRunning: false,
+		stop:      make(chan struct{}),
+		ticker:    time.NewTicker(relay.ServerRegInterval),
+	}
+	return h
+}
+
+func (h *Host) Start() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.isRunning {
+		return nil
+	}
+
+	var err error
+	h.relayConn, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	logging.Logger.Info("bot ", h.config.Uid, " started, relays:", h.config.Relays)
+
+	h.isRunning = true
+	h.registerUserToRelays()
+
+	h.wg.Add(1)
+	go h.loop()
+	go h.readConn()
+	return nil
+}
+
+func (h *Host) Stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.isRunning {
+		h.isRunning = false
+		close(h.stop)
+	}
+}
+
+func (h *Host) WaitForShutdown() {
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigc)
+		<-sigc
+		h.Stop()
+	}()
+
+	h.wg.Wait()
+}
+
+func (h *Host) loop() {
+	defer h.wg.Done()
+
+	for {
+		select {
+		case <-h.stop:
+			for _, call := range h.calls {
+				if atomic.CompareAndSwapInt32(&call.ended, 0, 1) {
+					call.SendSignal(relay.YCKCallSignalTypeEnd, nil)
+				}
+				h.releaseCall(call)
+			}
+			h.relayConn.Close()
+			return
+		case packet := <-h.relayCh:
+			h.handleRelayPacket(packet)
+		case call := <-h.hangupCh:
+			if h.calls[call.Sid] == call {
+				h.releaseCall(call)
+			}
+		case <-h.ticker.C:
+			h.registerUserToRelays()
+		}
+	}
+}
+
+func (h *Host) readConn() {
+	var buf [65536]byte
+
+	for {
+		size, addr, err := h.relayConn.ReadFromUDP(buf[0:])
+		if err != nil {
+			if !h.isRunning {
+				return
+			}
+			logging.Logger.Error("error ReadFromUDP ", err)
+			continue
+		}
+
+		data := make([]byte, size)
+		copy(data, buf[0:size])
+		h.relayCh <- &relay.ReceivedPacket{
+			Body:        data,
+			FromUdpAddr: addr,
+			Time:        time.Now().UnixNano(),
+		}
+	}
+}
+
+func (h *Host) handleRelayPacket(packet *relay.ReceivedPacket) {
+	msg, err := relay.NewMessageFromObfuscatedData(packet.Body)
+	if err != nil {
+		logging.Logger.Warn("error:", err, " for packet received from <", packet.FromUdpAddr.String(), ">")
+		return
+	}
+
+	switch msg.MsgType {
+	case relay.UdpMessageTypeUserRegReceived:
+		if relay.LearnObfuscationKey(msg) {
+			logging.Logger.Info("obfuscation key ", relay.CurrentObfuscationKey().Id, " learned from relay ", packet.FromUdpAddr.String())
+		}
+	case relay.UdpMessageTypeTurnRegReceived:
+	case relay.UdpMessageTypeUserSignal:
+		h.handleUserSignal(msg, packet.FromUdpAddr)
+	case relay.UdpMessageTypeAudioStream:
+		call := h.calls[msg.To]
+		if call != nil && msg.From != h.config.Uid {
+			h.bot.OnAudio(call, msg.From, msg.Payload)
+		}
+	case relay.UdpMessageTypeTurnRegNoExist:
+		if call := h.calls[msg.To]; call != nil {
+			h.turnReg(call)
+		}
+	default:
+	}
+}
+
+func (h *Host) handleUserSignal(msg *relay.Message, from *net.UDPAddr) {
+	if h.dedup.Contains(string(msg.Payload)) {
+		return
+	}
+	h.dedup.Add(string(msg.Payload), true)
+
+	s := relay.NewSignalTemp()
+	err := s.Unmarshal(msg.Payload)
+	if err != nil {
+		logging.Logger.Warn("signal unmarshal error:", err)
+		return
+	}
+
+	call := h.calls[s.SessionId]
+	switch s.Signal {
+	case relay.YCKCallSignalTypeInvite:
+		if call != nil {
+			return
+		}
+		call = h.newCall(s, from)
+		if !h.bot.Answer(call) {
+			call.SendSignal(relay.YCKCallSignalTypeReject, nil)
+			return
+		}
+		h.calls[call.Sid] = call
+		call.SendSignal(relay.YCKCallSignalTypeAccept, nil)
+		h.turnReg(call)
+		logging.Logger.Info("bot ", h.config.Uid, " joined session ", call.Sid, " invited by ", call.Caller)
+	case relay.YCKCallSignalTypeCancel, relay.YCKCallSignalTypeEnd:
+		if call != nil && atomic.CompareAndSwapInt32(&call.ended, 0, 1) {
+			h.releaseCall(call)
+		}
+	default:
+		if call != nil {
+			h.bot.OnSignal(call, s)
+		}
+	}
+}
+
+func (h *Host) newCall(s *relay.Signal, from *net.UDPAddr) *Call {
+	call := &Call{
+		Sid:    s.SessionId,
+		Caller: s.From,
+		Info:   s.Info,
+		multi:  s.From == session_manager.SessionManagerUserId,
+		host:   h,
+	}
+	if call.multi {
+		if n, ok := s.Info["caller"].(json.Number); ok {
+			call.Caller, _ = n.Int64()
+		}
+	}
+
+	//媒体走invite中带的第一个relay，没有时用relay候选里的第一个，都没有时用送来invite的relay
+	for _, key := range []string{"relays", "relay_candidates"} {
+		rs, ok := s.Info[key].([]interface{})
+		if !ok || len(rs) == 0 {
+			continue
+		}
+		if r, ok := rs[0].(string); ok {
+			addr, err := net.ResolveUDPAddr("udp4", r)
+			if err != nil {
+				logging.Logger.Warn("incorrect relay addr in invite ", r)
+				continue
+			}
+			call.Relay = addr
+			break
+		}
+	}
+	if call.Relay == nil {
+		call.Relay = from
+	}
+	return call
+}
+
+func (h *Host) releaseCall(call *Call) {
+	msg := relay.NewMessage(relay.UdpMessageTypeTurnUnReg, h.config.Uid, call.Sid, 0, nil, nil)
+	h.relayConn.WriteToUDP(msg.ObfuscatedDataOfMessage(), call.Relay)
+	delete(h.calls, call.Sid)
+	h.bot.OnEnd(call)
+	logging.Logger.Info("bot ", h.config.Uid, " left session ", call.Sid)
+}
+
+func (h *Host) sendSignal(signalType uint16, to int64, sid int64, info map[string]interface{}) {
+	s := relay.NewSignal(signalType, h.config.Uid, to, sid)
+	s.Info = info
+	payload, err := s.Marshal()
+	if err != nil {
+		logging.Logger.Warn("signal marshal error:", err)
+		return
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, h.config.Uid, session_manager.SessionManagerUserId, 0, payload, nil)
+	h.sendByRelays(msg)
+}
+
+func (h *Host) registerUserToRelays() {
+	var token []byte
+	if h.config.AccessSecret != "" {
+		token = relay.IssueAccessToken(h.config.AccessSecret, h.config.Uid, time.Now().Add(relay.AccessTokenTTL))
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserReg, h.config.Uid, 0, 0, token, nil)
+	h.sendByRelays(msg)
+}
+
+func (h *Host) sendByRelays(msg *relay.Message) {
+	data := msg.ObfuscatedDataOfMessage()
+
+	for _, r := range h.config.Relays {
+		udpAddr, err := net.ResolveUDPAddr("udp4", r)
+		if err != nil {
+			logging.Logger.Error("incorrect addr ", err)
+			continue
+		}
+
+		_, err = h.relayConn.WriteToUDP(data, udpAddr)
+		if err != nil {
+			logging.Logger.Error("udp write error", err)
+		}
+	}
+}
+
+func (h *Host) turnReg(call *Call) {
+	msg := relay.NewMessage(relay.UdpMessageTypeTurnReg, h.config.Uid, call.Sid, 0, nil, nil)
+	h.relayConn.WriteToUDP(msg.ObfuscatedDataOfMessage(), call.Relay)
+}
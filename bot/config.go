@@ -0,0 +1,24 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package bot
+
+type Config struct {
+	Uid          int64    `toml:"uid"`           //bot在YCK侧的用户id，邀请这个uid即把bot加入通话
+	Relays       []string `toml:"relays"`        //注册信令用的relay
+	AccessSecret string   `toml:"access_secret"` //relay开启接入控制时，用于给bot自己签发access token
+}
+
+func GetDefaultConfig() *Config {
+	var config *Config
+
+	config = &Config{
+		Uid:    -4,
+		Relays: []string{"127.0.0.1:19001"},
+	}
+	return config
+}
@@ -0,0 +1,107 @@
+/*
+ * // Copyright (C) 2017 yeecall authors
+ * //
+ * // This file is part of the yeecall library.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xujiajundd/ycng/loadtest"
+)
+
+var app = cli.NewApp()
+
+func init() {
+	app.Name = filepath.Base(os.Args[0])
+	app.Author = ""
+	app.Email = ""
+	app.Version = ""
+	app.Usage = "Load test relay and session manager with simulated clients"
+	app.HideVersion = true
+	app.Copyright = "Copyright 2017-2018 The yeecall Authors"
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "relay",
+			Value: "127.0.0.1:19001",
+			Usage: "relay udp address",
+		},
+		cli.StringFlag{
+			Name:  "access_secret",
+			Value: "",
+			Usage: "secret used to issue access tokens for simulated clients",
+		},
+		cli.IntFlag{
+			Name:  "clients",
+			Value: 10,
+			Usage: "number of simulated clients, paired into calls",
+		},
+		cli.Int64Flag{
+			Name:  "start_uid",
+			Value: 9000000000,
+			Usage: "first uid of simulated clients",
+		},
+		cli.DurationFlag{
+			Name:  "duration",
+			Value: 30 * time.Second,
+			Usage: "media streaming duration of each call",
+		},
+		cli.IntFlag{
+			Name:  "bitrate",
+			Value: 32000,
+			Usage: "synthetic audio bitrate per client, bps",
+		},
+		cli.DurationFlag{
+			Name:  "ramp_up",
+			Value: 5 * time.Second,
+			Usage: "time over which calls are started",
+		},
+		cli.Float64Flag{
+			Name:  "loss",
+			Usage: "emulated packet loss ratio in each direction",
+		},
+		cli.DurationFlag{
+			Name:  "delay",
+			Usage: "emulated one way delay",
+		},
+		cli.DurationFlag{
+			Name:  "jitter",
+			Usage: "emulated random delay added on top of delay",
+		},
+		cli.Float64Flag{
+			Name:  "reorder",
+			Usage: "ratio of packets delayed past later ones",
+		},
+		cli.Float64Flag{
+			Name:  "duplicate",
+			Usage: "ratio of packets delivered twice",
+		},
+	}
+	app.Action = LoadTest
+}
+
+func main() {
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func LoadTest(ctx *cli.Context) error {
+	config := loadtest.GetConfig(ctx)
+	fmt.Println("load test:", config)
+	report, err := loadtest.Run(config)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	return nil
+}
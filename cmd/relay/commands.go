@@ -0,0 +1,254 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+  relay serve
+  relay --admin_addr 127.0.0.1:19080 status
+  relay --admin_addr 127.0.0.1:19080 drain [--off]      滚动发布前排空：不再接受新用户和新session
+  relay probe [--count 20] [--access_secret x] <addr>   部署时检查到另一个relay的RTT和丢包
+  relay netprobe [--pairs 50] <addr>                    模拟客户端通话前的网络探测，估计RTT、丢包和上行带宽
+  relay --capture_file x serve                          调试模式，把收到的包写入文件
+  relay replay [--speed 1] <file>                       在本地按原始节奏重放抓到的包
+*/
+
+var commands = []cli.Command{
+	{
+		Name:   "serve",
+		Usage:  "run the relay",
+		Action: Relay,
+	},
+	{
+		Name:   "status",
+		Usage:  "show registered users, sessions and traffic of a running relay via its admin api",
+		Action: status,
+	},
+	{
+		Name:  "drain",
+		Usage: "stop a running relay accepting new users and sessions via its admin api, existing calls keep going",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "off",
+				Usage: "leave draining mode",
+			},
+		},
+		Action: drain,
+	},
+	{
+		Name:      "probe",
+		Usage:     "send test registrations to a relay and report rtt and loss",
+		ArgsUsage: "<addr>",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "count",
+				Value: 20,
+				Usage: "number of probes",
+			},
+			cli.DurationFlag{
+				Name:  "interval",
+				Value: 100 * time.Millisecond,
+				Usage: "interval between probes",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Value: time.Second,
+				Usage: "how long to wait for replies after the last probe",
+			},
+		},
+		Action: probe,
+	},
+	{
+		Name:      "netprobe",
+		Usage:     "run a pre-call network probe against a relay and report rtt, loss and uplink bandwidth",
+		ArgsUsage: "<addr>",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "pairs",
+				Value: 50,
+				Usage: "number of probe packet pairs",
+			},
+			cli.DurationFlag{
+				Name:  "interval",
+				Value: 20 * time.Millisecond,
+				Usage: "interval between probe pairs",
+			},
+		},
+		Action: netprobe,
+	},
+	{
+		Name:      "natprobe",
+		Usage:     "probe how long the local NAT keeps a udp binding to a relay and suggest a keepalive interval",
+		ArgsUsage: "<addr>",
+		Action:    natprobe,
+	},
+	{
+		Name:      "replay",
+		Usage:     "feed captured packets into a local relay at their original pacing",
+		ArgsUsage: "<file>",
+		Flags: []cli.Flag{
+			cli.Float64Flag{
+				Name:  "speed",
+				Value: 1,
+				Usage: "replay speed factor, 0 for as fast as possible",
+			},
+		},
+		Action: replay,
+	},
+}
+
+func status(ctx *cli.Context) error {
+	addr := ctx.GlobalString("admin_addr")
+	if addr == "" {
+		return errors.New("--admin_addr is required to talk to a running relay")
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + addr + "/status")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	var s relay.ServiceStatus
+	if err := json.Unmarshal(body, &s); err != nil {
+		return err
+	}
+	fmt.Printf("users:        %d\n", s.Users)
+	fmt.Printf("sessions:     %d\n", s.Sessions)
+	fmt.Printf("participants: %d\n", s.Participants)
+	fmt.Printf("recv:         %.0f pps, %.2f Mbps\n", s.RecvPps, float64(s.RecvBandwidth)/1e6)
+	fmt.Printf("send:         %.0f pps, %.2f Mbps\n", s.SendPps, float64(s.SendBandwidth)/1e6)
+	if len(s.SocketPackets) > 1 {
+		fmt.Printf("per socket:   %v\n", s.SocketPackets)
+	}
+	if s.Draining {
+		fmt.Println("draining")
+	}
+	return nil
+}
+
+func drain(ctx *cli.Context) error {
+	addr := ctx.GlobalString("admin_addr")
+	if addr == "" {
+		return errors.New("--admin_addr is required to talk to a running relay")
+	}
+	url := "http://" + addr + "/drain"
+	if ctx.Bool("off") {
+		url += "?off=1"
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	if ctx.Bool("off") {
+		fmt.Println("relay accepting new sessions")
+	} else {
+		fmt.Println("relay draining, wait for sessions to drop to 0 before stopping it")
+	}
+	return nil
+}
+
+func probe(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("usage: probe <addr>")
+	}
+	addr := ctx.Args().First()
+	result, err := relay.Probe(addr, ctx.Int("count"), ctx.Duration("interval"), ctx.Duration("timeout"), ctx.GlobalString("access_secret"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: sent %d, received %d, loss %.1f%%\n", addr, result.Sent, result.Received, result.Loss()*100)
+	if result.Received > 0 {
+		fmt.Printf("rtt min/avg/max = %v/%v/%v\n", result.MinRtt, result.AvgRtt, result.MaxRtt)
+	}
+	return nil
+}
+
+func netprobe(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("usage: netprobe <addr>")
+	}
+	addr := ctx.Args().First()
+	e, err := relay.ProbeNetwork(addr, ctx.GlobalString("access_secret"), ctx.Int("pairs"), ctx.Duration("interval"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: sent %d, relay received %d, acked %d\n", addr, e.Sent, e.Received, e.Acked)
+	fmt.Printf("loss up/down = %.1f%%/%.1f%%\n", e.UplinkLoss()*100, e.DownlinkLoss()*100)
+	if e.Acked > 0 {
+		fmt.Printf("rtt min/avg = %v/%v\n", e.MinRtt, e.AvgRtt)
+	}
+	if e.Bandwidth >= 0 {
+		fmt.Printf("uplink bandwidth: %d kbps\n", e.Bandwidth)
+	}
+	if e.IsPoor() {
+		fmt.Println("network is poor")
+	}
+	return nil
+}
+
+func natprobe(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("usage: natprobe <addr>")
+	}
+	addr := ctx.Args().First()
+	lifetime, err := relay.ProbeNatBinding(addr, ctx.GlobalString("access_secret"), nil)
+	if err != nil {
+		return err
+	}
+	if lifetime == 0 {
+		fmt.Printf("%s: binding did not survive %v\n", addr, relay.DefaultKeepaliveProbeDelays[0])
+	} else {
+		fmt.Printf("%s: binding alive after %v\n", addr, lifetime)
+	}
+	fmt.Printf("keepalive interval: %v\n", relay.KeepaliveInterval(lifetime))
+	return nil
+}
+
+func replay(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("usage: replay <file>")
+	}
+	config := relay.GetConfig(ctx)
+	//只绑定在loopback上，回给抓包中那些客户端地址的包发不出去，不会打扰线上用户
+	config.UdpAddr = "127.0.0.1" + config.UdpAddr[strings.LastIndex(config.UdpAddr, ":"):]
+	config.CaptureFile = ""
+	config.AllowPlaintext = true //回放时没有抓包时的链路密钥，只有明文客户端的包能回放
+	service := relay.NewService(config)
+	service.Start()
+	defer service.Stop()
+
+	start := time.Now()
+	count, err := service.Replay(ctx.Args().First(), ctx.Float64("speed"))
+	fmt.Printf("replayed %d packets in %v\n", count, time.Since(start))
+	return err
+}
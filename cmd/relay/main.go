@@ -15,7 +15,9 @@ import (
 	"github.com/urfave/cli"
 	"github.com/xujiajundd/ycng/utils/logging"
 	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils/tracing"
 	"io/ioutil"
+	"time"
 )
 
 var app = cli.NewApp()
@@ -35,14 +37,99 @@ func init() {
 			Value: 19001,
 			Usage: "udp address port",
 		},
+		cli.IntFlag{
+			Name: "udp_sockets",
+			Value: 1,
+			Usage: "number of SO_REUSEPORT sockets receiving on the udp port",
+		},
+		cli.BoolTFlag{
+			Name: "udp_offload",
+			Usage: "batch udp sends and receives with sendmmsg, GSO and GRO on linux",
+		},
+		cli.IntFlag{
+			Name: "watchdog_timeout",
+			Value: relay.DefaultWatchdogTimeout,
+			Usage: "seconds the main loop or a receiving goroutine may spend on one item before goroutine stacks are dumped, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name: "watchdog_exit",
+			Usage: "exit when the watchdog finds a stalled loop, so that the supervisor restarts the relay",
+		},
+		cli.StringFlag{
+			Name: "access_secret",
+			Value: "",
+			Usage: "secret shared with session manager to verify access tokens",
+		},
+		cli.BoolFlag{
+			Name: "allow_plaintext",
+			Usage: "accept clients that register without a link key, e.g. bots, gateways and load test clients",
+		},
+		cli.StringFlag{
+			Name: "link_signing_key",
+			Value: "",
+			Usage: "base64 Ed25519 seed signing the link key in user reg replies; empty for unsigned",
+		},
+		cli.StringFlag{
+			Name: "admin_addr",
+			Value: "",
+			Usage: "admin api listen address, e.g. 127.0.0.1:19080",
+		},
+		cli.StringFlag{
+			Name: "log_format",
+			Value: "text",
+			Usage: "log format, text or json",
+		},
+		cli.StringFlag{
+			Name: "log_level",
+			Value: "info",
+			Usage: "log level",
+		},
+		cli.StringFlag{
+			Name: "store",
+			Value: "",
+			Usage: "store url for the blocklist: memory://, file://dir or redis://host:port/db",
+		},
+		cli.IntFlag{
+			Name: "max_datagram",
+			Value: relay.DefaultMaxDatagram,
+			Usage: "largest udp datagram sent or accepted, 0 for unlimited",
+		},
+		cli.StringFlag{
+			Name: "capture_file",
+			Value: "",
+			Usage: "debug: dump received packets to this file for later replay",
+		},
+		cli.StringFlag{
+			Name: "audit_file",
+			Value: "",
+			Usage: "append-only log of admin operations, empty to keep recent entries in memory only",
+		},
+		cli.StringFlag{
+			Name: "otlp_endpoint",
+			Value: "",
+			Usage: "OpenTelemetry collector address for trace export",
+		},
+		cli.StringSliceFlag{
+			Name: "obfuscation_keys",
+			Usage: "obfuscation key as id:secret, repeat to give the previous key first; empty for the built-in dictionary",
+		},
+		cli.IntFlag{
+			Name: "obfuscation_grace",
+			Usage: "seconds after start during which the previous obfuscation key is still accepted and used",
+		},
+		cli.StringFlag{
+			Name: "metrics_export",
+			Value: "",
+			Usage: "export per-stream media quality to influx://host:port/db or prom://host:port/api/v1/write",
+		},
 	}
-	app.Action = Relay
+	app.Commands = commands
+	app.Action = Relay //不带子命令时同serve
 }
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	logging.Logger.Out = ioutil.Discard //把日志只写到文件，然后stderr到nohup.out
-    logging.SetFileRotationHooker("./log", 30)
+	logging.SetOutput(ioutil.Discard) //把日志只写到文件，然后stderr到nohup.out
 	if err := app.Run(os.Args); err != nil {
 		logging.Logger.Fatal(err)
 	}
@@ -50,6 +137,18 @@ func main() {
 
 func Relay(ctx *cli.Context) error {
 	config := relay.GetConfig(ctx)
+	logging.SetFormat(config.LogFormat)
+	logging.SetFileRotation(config.LogDir, "relay", 30, 24*time.Hour, config.LogRotationSize)
+	for module, level := range config.LogLevels {
+		if err := logging.SetLevel(module, level); err != nil {
+			logging.Logger.Warn("log level config error:", err)
+		}
+	}
+	shutdown, err := tracing.Init("relay", config.OtlpEndpoint, config.TraceSampleRatio)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
     service := relay.NewService(config)
     service.Start()
     service.WaitForShutdown()
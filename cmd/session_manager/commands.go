@@ -0,0 +1,264 @@
+/*
+ * // Copyright (C) 2017 yeecall authors
+ * //
+ * // This file is part of the yeecall library.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xujiajundd/ycng/session_manager"
+)
+
+/*
+运维用的子命令，除serve和config check外都通过--admin_addr指定的管理接口操作正在运行的session manager：
+  session_manager serve
+  session_manager --admin_addr 127.0.0.1:20080 sessions list
+  session_manager --admin_addr 127.0.0.1:20080 sessions kill <sid>
+  session_manager --admin_addr 127.0.0.1:20080 relays status
+  session_manager --admin_addr 127.0.0.1:20080 guests create <sid>  为web访客生成绑定该session的临时uid
+  session_manager config check
+  session_manager replay [--speed 1] <file>   在本地按原始节奏重放--capture_file抓到的包，发出的包不出本进程
+*/
+
+var commands = []cli.Command{
+	{
+		Name:   "serve",
+		Usage:  "run the session manager",
+		Action: SessionManager,
+	},
+	{
+		Name:  "sessions",
+		Usage: "inspect or kill sessions of a running session manager",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "list current sessions",
+				Action: sessionsList,
+			},
+			{
+				Name:      "kill",
+				Usage:     "end a session and notify its participants",
+				ArgsUsage: "<sid>",
+				Action:    sessionsKill,
+			},
+		},
+	},
+	{
+		Name:  "relays",
+		Usage: "inspect relays of a running session manager",
+		Subcommands: []cli.Command{
+			{
+				Name:   "status",
+				Usage:  "show whether each relay acknowledged registration recently",
+				Action: relaysStatus,
+			},
+		},
+	},
+	{
+		Name:  "guests",
+		Usage: "manage guest participants of a running session manager",
+		Subcommands: []cli.Command{
+			{
+				Name:      "create",
+				Usage:     "mint a temporary uid bound to a session, for web guest links",
+				ArgsUsage: "<sid>",
+				Action:    guestsCreate,
+			},
+		},
+	},
+	{
+		Name:  "config",
+		Usage: "configuration helpers",
+		Subcommands: []cli.Command{
+			{
+				Name:   "check",
+				Usage:  "print the effective configuration and report problems",
+				Action: configCheck,
+			},
+		},
+	},
+	{
+		Name:      "replay",
+		Usage:     "feed captured packets into a local session manager at their original pacing",
+		ArgsUsage: "<file>",
+		Flags: []cli.Flag{
+			cli.Float64Flag{
+				Name:  "speed",
+				Value: 1,
+				Usage: "replay speed factor, 0 for as fast as possible",
+			},
+		},
+		Action: replay,
+	},
+}
+
+var adminClient = &http.Client{Timeout: 10 * time.Second}
+
+func adminUrl(ctx *cli.Context, path string) (string, error) {
+	addr := ctx.GlobalString("admin_addr")
+	if addr == "" {
+		return "", errors.New("--admin_addr is required to talk to a running session manager")
+	}
+	return "http://" + addr + path, nil
+}
+
+//调用管理接口，result不为nil时把返回的JSON解到result里
+func adminCall(ctx *cli.Context, method string, path string, result interface{}) error {
+	u, err := adminUrl(ctx, path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := adminClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	if result != nil {
+		return json.Unmarshal(body, result)
+	}
+	return nil
+}
+
+func sessionsList(ctx *cli.Context) error {
+	var sessions []session_manager.SessionInfo
+	if err := adminCall(ctx, http.MethodGet, "/sessions", &sessions); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SID\tMODE\tPARTICIPANTS\tRECORDING\tIDLE")
+	for _, s := range sessions {
+		participants := ""
+		for i, p := range s.Participants {
+			if i > 0 {
+				participants += ","
+			}
+			participants += fmt.Sprintf("%d(%d)", p.Uid, p.State)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%v\t%ds\n", s.Sid, s.Mode, participants, s.Recording, s.IdleSeconds)
+	}
+	return w.Flush()
+}
+
+func sessionsKill(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("usage: sessions kill <sid>")
+	}
+	sid, err := strconv.ParseInt(ctx.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad sid %q", ctx.Args().First())
+	}
+	err = adminCall(ctx, http.MethodPost, "/sessions/kill?sid="+url.QueryEscape(strconv.FormatInt(sid, 10)), nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println("session", sid, "killed")
+	return nil
+}
+
+func relaysStatus(ctx *cli.Context) error {
+	var relays []session_manager.RelayStatus
+	if err := adminCall(ctx, http.MethodGet, "/relays", &relays); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RELAY\tREACHABLE\tLAST REG ACK")
+	for _, r := range relays {
+		last := "never"
+		if r.LastRegAck > 0 {
+			last = time.Unix(r.LastRegAck, 0).Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%v\t%s\n", r.Addr, r.Reachable, last)
+	}
+	return w.Flush()
+}
+
+func guestsCreate(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("usage: guests create <sid>")
+	}
+	sid, err := strconv.ParseInt(ctx.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad sid %q", ctx.Args().First())
+	}
+	var guest session_manager.GuestInfo
+	err = adminCall(ctx, http.MethodPost, "/guests?sid="+url.QueryEscape(strconv.FormatInt(sid, 10)), &guest)
+	if err != nil {
+		return err
+	}
+	fmt.Println("uid:   ", guest.Uid)
+	if guest.Token != "" {
+		fmt.Println("token: ", guest.Token)
+		fmt.Println("expire:", time.Unix(guest.Expire, 0).Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+func configCheck(ctx *cli.Context) error {
+	config := session_manager.GetConfig(ctx)
+	printed := *config
+	if printed.AccessSecret != "" {
+		printed.AccessSecret = "******"
+	}
+	data, err := json.MarshalIndent(printed, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	if config.AccessSecret == "" {
+		fmt.Println("warning: access_secret is empty, relays with access control will reject all users")
+	}
+	errs := config.Check()
+	for _, e := range errs {
+		fmt.Println("problem:", e)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d problems found", len(errs))
+	}
+	fmt.Println("config ok")
+	return nil
+}
+
+func replay(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("usage: replay <file>")
+	}
+	config := session_manager.GetConfig(ctx)
+	config.AdminAddr = ""
+	config.CaptureFile = ""
+	mgr := session_manager.NewSessionManager(config)
+	transport := session_manager.NewMemTransport()
+	mgr.SetTransport(transport)
+	mgr.Start()
+	defer mgr.Stop()
+
+	start := time.Now()
+	count, err := mgr.Replay(ctx.Args().First(), ctx.Float64("speed"))
+	fmt.Printf("replayed %d packets in %v, %d packets sent\n", count, time.Since(start), len(transport.Sent()))
+	return err
+}
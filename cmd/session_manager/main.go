@@ -14,7 +14,9 @@ import (
 
 	"github.com/urfave/cli"
 	"github.com/xujiajundd/ycng/utils/logging"
+	"github.com/xujiajundd/ycng/relay"
 	"github.com/xujiajundd/ycng/session_manager"
+	"github.com/xujiajundd/ycng/utils/tracing"
 )
 
 var app = cli.NewApp()
@@ -28,14 +30,185 @@ func init() {
 	app.HideVersion = true
 	app.Copyright = "Copyright 2017-2018 The yeecall Authors"
 
-	//app.Flags = []cli.Flag{
-	//	cli.IntFlag{
-	//		Name:  "port",
-	//		Value: 19001,
-	//		Usage: "udp address port",
-	//	},
-	//}
-	app.Action = SessionManager
+	app.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "port",
+			Value: 20001,
+			Usage: "udp address port",
+		},
+		cli.StringFlag{
+			Name:  "access_secret",
+			Value: "",
+			Usage: "secret shared with relays to sign access tokens",
+		},
+		cli.StringFlag{
+			Name:  "admin_addr",
+			Value: "",
+			Usage: "admin api listen address for serve, or the address to talk to for other commands, e.g. 127.0.0.1:20080",
+		},
+		cli.StringFlag{
+			Name:  "otlp_endpoint",
+			Value: "",
+			Usage: "OpenTelemetry collector address for trace export",
+		},
+		cli.StringSliceFlag{
+			Name:  "obfuscation_keys",
+			Usage: "obfuscation key shared with relays as id:secret, repeat to give the previous key first",
+		},
+		cli.IntFlag{
+			Name:  "obfuscation_grace",
+			Usage: "seconds after start during which the previous obfuscation key is still accepted and used",
+		},
+		cli.StringSliceFlag{
+			Name:  "relays",
+			Usage: "relay addresses, overriding the built-in list",
+		},
+		cli.StringSliceFlag{
+			Name:  "relay_regions",
+			Usage: "region of a relay as addr=region, used to rank relay candidates for participants",
+		},
+		cli.StringFlag{
+			Name:  "geoip_file",
+			Value: "",
+			Usage: "MaxMind city database for ranking relay candidates by distance to the client",
+		},
+		cli.StringFlag{
+			Name:  "state_file",
+			Value: "",
+			Usage: "save active sessions here on shutdown and restore them on start, so a restart does not drop calls",
+		},
+		cli.StringFlag{
+			Name:  "store",
+			Value: "",
+			Usage: "store url for the relay list and user routing: memory://, file://dir or redis://host:port/db",
+		},
+		cli.StringSliceFlag{
+			Name:  "webhooks",
+			Usage: "urls receiving session events as signed json POSTs",
+		},
+		cli.StringFlag{
+			Name:  "webhook_secret",
+			Value: "",
+			Usage: "HMAC secret for signing webhook requests",
+		},
+		cli.StringSliceFlag{
+			Name:  "alert_rules",
+			Usage: "alert rule per relay as metric>threshold/window, e.g. loss>0.05/1m, mos<3.5/5m or setup_failures>10/1m",
+		},
+		cli.StringSliceFlag{
+			Name:  "event_bus",
+			Usage: "publish call events to nats://host:port/subject or kafka://host:port,host:port/topic",
+		},
+		cli.IntFlag{
+			Name:  "blackbox_size",
+			Value: 64,
+			Usage: "recent signals kept per session for the admin blackbox and replay, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "mesh_max",
+			Value: 2,
+			Usage: "use p2p mesh for calls of at most this many participants, 0 to always use the relay",
+		},
+		cli.IntFlag{
+			Name:  "mixer_min",
+			Value: 9,
+			Usage: "have the relay mix audio for calls of at least this many participants, 0 to never mix",
+		},
+		cli.StringFlag{
+			Name:  "capture_file",
+			Value: "",
+			Usage: "debug: dump received packets to this file for later replay",
+		},
+		cli.StringFlag{
+			Name:  "audit_file",
+			Value: "",
+			Usage: "append-only log of admin operations, empty to keep recent entries in memory only",
+		},
+		cli.IntFlag{
+			Name:  "inbox_size",
+			Value: 4096,
+			Usage: "packets queued between the udp reader and the main loop, excess non-critical packets are dropped",
+		},
+		cli.IntFlag{
+			Name:  "max_calls_per_user",
+			Value: 2,
+			Usage: "max simultaneous calls a uid may take part in, 0 for unlimited",
+		},
+		cli.StringSliceFlag{
+			Name:  "tenant_max_calls",
+			Usage: "max simultaneous calls per uid of a tenant as tenant=n, overriding max_calls_per_user",
+		},
+		cli.StringSliceFlag{
+			Name:  "tenant_relays",
+			Usage: "relay a tenant may use as tenant=addr, repeat for more relays; the relay must also be in relays",
+		},
+		cli.Int64Flag{
+			Name:  "quota_seconds",
+			Usage: "call seconds a uid may use per billing month before sid requests are rejected, 0 for unlimited",
+		},
+		cli.Int64Flag{
+			Name:  "max_duration",
+			Usage: "seconds after creation when a session is ended by the session manager, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "canary_interval",
+			Usage: "seconds between synthetic canary calls through each relay, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "max_voicemail",
+			Usage: "seconds a caller may leave a voicemail after a 1-1 call is rejected or unanswered, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "signal_max_age",
+			Value: session_manager.DefaultSignalMaxAge,
+			Usage: "seconds after which a delayed signal is dropped instead of handled, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "dedup_size",
+			Value: session_manager.DefaultDedupSize,
+			Usage: "number of recent signals remembered to drop duplicates arriving through several relays",
+		},
+		cli.StringFlag{
+			Name:  "dedup_key",
+			Value: session_manager.DedupKeyPayload,
+			Usage: "how duplicate signals are keyed: payload, or digest to keep a fixed size hash per signal",
+		},
+		cli.IntFlag{
+			Name:  "watchdog_timeout",
+			Value: relay.DefaultWatchdogTimeout,
+			Usage: "seconds the main loop or the receiving goroutine may spend on one item before goroutine stacks are dumped, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name:  "watchdog_exit",
+			Usage: "exit when the watchdog finds a stalled loop, so that the supervisor restarts the session manager",
+		},
+		cli.IntFlag{
+			Name:  "max_datagram",
+			Value: relay.DefaultMaxDatagram,
+			Usage: "largest udp datagram sent or accepted, signals are fragmented or refused to fit the receiver's path mtu, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "push_token_ttl",
+			Value: 30 * 24 * 3600,
+			Usage: "seconds a push token is kept without the client registering it again, 0 to never expire",
+		},
+		cli.Int64Flag{
+			Name:  "quota_bytes",
+			Usage: "relayed bytes a uid may use per billing month before sid requests are rejected, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "pace_rate",
+			Value: 2000,
+			Usage: "packets per second sent to each relay, bursts above are queued and smoothed, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "pace_global_rate",
+			Value: 8000,
+			Usage: "packets per second sent to all relays together, 0 for unlimited",
+		},
+	}
+	app.Commands = commands
+	app.Action = SessionManager //不带子命令时同serve
 }
 
 func main() {
@@ -47,11 +220,14 @@ func main() {
 }
 
 func SessionManager(ctx *cli.Context) error {
-	//config := relay.GetConfig(ctx)
-	//service := relay.NewService(config)
-	//service.Start()
-	//service.WaitForShutdown()
-	mgr := session_manager.NewSessionManager()
+	config := session_manager.GetConfig(ctx)
+	shutdown, err := tracing.Init("session_manager", config.OtlpEndpoint, config.TraceSampleRatio)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	mgr := session_manager.NewSessionManager(config)
 	mgr.Start()
 	mgr.WaitForShutdown()
 	return nil
@@ -0,0 +1,73 @@
+/*
+ * // Copyright (C) 2017 yeecall authors
+ * //
+ * // This file is part of the yeecall library.
+ *
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/urfave/cli"
+	"github.com/xujiajundd/ycng/sip_gateway"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+var app = cli.NewApp()
+
+func init() {
+	app.Name = filepath.Base(os.Args[0])
+	app.Author = ""
+	app.Email = ""
+	app.Version = ""
+	app.Usage = "SIP Gateway"
+	app.HideVersion = true
+	app.Copyright = "Copyright 2017-2018 The yeecall Authors"
+
+	app.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "sip_port",
+			Value: 5060,
+			Usage: "sip udp port",
+		},
+		cli.StringFlag{
+			Name:  "trunk",
+			Value: "127.0.0.1:5070",
+			Usage: "sip trunk address",
+		},
+		cli.StringFlag{
+			Name:  "relays",
+			Value: "127.0.0.1:19001",
+			Usage: "comma separated relay addresses",
+		},
+		cli.StringFlag{
+			Name:  "access_secret",
+			Value: "",
+			Usage: "secret shared with relays to sign access tokens",
+		},
+	}
+	app.Action = Gateway
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	if err := app.Run(os.Args); err != nil {
+		logging.Logger.Fatal(err)
+	}
+}
+
+func Gateway(ctx *cli.Context) error {
+	config := sip_gateway.GetConfig(ctx)
+	gw := sip_gateway.NewGateway(config)
+	err := gw.Start()
+	if err != nil {
+		return err
+	}
+	gw.WaitForShutdown()
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+ * // Copyright (C) 2017 yeecall authors
+ * //
+ * // This file is part of the yeecall library.
+ *
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/urfave/cli"
+	"github.com/xujiajundd/ycng/utils/logging"
+	"github.com/xujiajundd/ycng/webrtc_bridge"
+)
+
+var app = cli.NewApp()
+
+func init() {
+	app.Name = filepath.Base(os.Args[0])
+	app.Author = ""
+	app.Email = ""
+	app.Version = ""
+	app.Usage = "WebRTC Bridge"
+	app.HideVersion = true
+	app.Copyright = "Copyright 2017-2018 The yeecall Authors"
+
+	app.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "http_port",
+			Value: 18080,
+			Usage: "http port for webrtc offer/answer",
+		},
+		cli.StringFlag{
+			Name:  "relay",
+			Value: "127.0.0.1:19001",
+			Usage: "relay address",
+		},
+		cli.StringFlag{
+			Name:  "access_secret",
+			Value: "",
+			Usage: "secret shared with relays to sign access tokens",
+		},
+	}
+	app.Action = Bridge
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	if err := app.Run(os.Args); err != nil {
+		logging.Logger.Fatal(err)
+	}
+}
+
+func Bridge(ctx *cli.Context) error {
+	config := webrtc_bridge.GetConfig(ctx)
+	bridge, err := webrtc_bridge.NewBridge(config)
+	if err != nil {
+		return err
+	}
+	bridge.Start()
+	bridge.WaitForShutdown()
+	return nil
+}
@@ -0,0 +1,510 @@
+/*
+ * // Copyright (C) 2017 yeecall authors
+ * //
+ * // This file is part of the yeecall library.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/session_manager"
+	"github.com/xujiajundd/ycng/utils/logging"
+	"github.com/xujiajundd/ycng/utils/tracing"
+)
+
+/*
+合一的服务端程序，日志、trace和access secret等公共配置只设一次：
+  ycng relay [--port 19001]                         只跑relay
+  ycng sessions [--port 20001] [--relays x]         只跑session manager
+  ycng all                                          同一进程里跑relay和session manager，开发和小规模部署用，
+                                                    session manager默认只用本进程的relay
+运维子命令（status、probe、sessions list等）仍在relay和session_manager两个程序里。
+*/
+
+var app = cli.NewApp()
+
+func init() {
+	app.Name = filepath.Base(os.Args[0])
+	app.Author = ""
+	app.Email = ""
+	app.Version = ""
+	app.Usage = "Yeecall server"
+	app.HideVersion = true
+	app.Copyright = "Copyright 2017-2018 The yeecall Authors"
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "access_secret",
+			Value: "",
+			Usage: "secret shared between relays and session manager to sign access tokens",
+		},
+		cli.StringFlag{
+			Name:  "otlp_endpoint",
+			Value: "",
+			Usage: "OpenTelemetry collector address for trace export",
+		},
+		cli.StringSliceFlag{
+			Name:  "obfuscation_keys",
+			Usage: "obfuscation key shared by relays and session manager as id:secret, repeat to give the previous key first",
+		},
+		cli.IntFlag{
+			Name:  "obfuscation_grace",
+			Usage: "seconds after start during which the previous obfuscation key is still accepted and used",
+		},
+		cli.StringFlag{
+			Name:  "metrics_export",
+			Value: "",
+			Usage: "relays export per-stream media quality to influx://host:port/db or prom://host:port/api/v1/write",
+		},
+		cli.StringFlag{
+			Name:  "store",
+			Value: "",
+			Usage: "store url shared by relays and session managers: memory://, file://dir or redis://host:port/db",
+		},
+		cli.IntFlag{
+			Name:  "watchdog_timeout",
+			Value: relay.DefaultWatchdogTimeout,
+			Usage: "seconds a main loop or receiving goroutine may spend on one item before goroutine stacks are dumped, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name:  "watchdog_exit",
+			Usage: "exit when the watchdog finds a stalled loop, so that the supervisor restarts the process",
+		},
+		cli.IntFlag{
+			Name:  "max_datagram",
+			Value: relay.DefaultMaxDatagram,
+			Usage: "largest udp datagram relays and session managers send or accept, 0 for unlimited",
+		},
+		cli.StringFlag{
+			Name:  "log_dir",
+			Value: "./log",
+			Usage: "directory of rotated log files",
+		},
+		cli.StringFlag{
+			Name:  "log_format",
+			Value: "text",
+			Usage: "log format, text or json",
+		},
+		cli.StringFlag{
+			Name:  "log_level",
+			Value: "info",
+			Usage: "log level",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "relay",
+			Usage:  "run a relay",
+			Flags:  relayFlags,
+			Action: runRelay,
+		},
+		{
+			Name:   "sessions",
+			Usage:  "run a session manager",
+			Flags:  append(sessionsAddrFlags, sessionsFlags...),
+			Action: runSessions,
+		},
+		{
+			Name:   "all",
+			Usage:  "run a relay and a session manager in one process",
+			Flags:  append(allFlags, sessionsFlags...),
+			Action: runAll,
+		},
+	}
+}
+
+var relayFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "port",
+		Value: 19001,
+		Usage: "udp address port",
+	},
+	cli.StringFlag{
+		Name:  "admin_addr",
+		Value: "",
+		Usage: "admin api listen address, e.g. 127.0.0.1:19080",
+	},
+	cli.StringFlag{
+		Name:  "audit_file",
+		Value: "",
+		Usage: "append-only log of admin operations, empty to keep recent entries in memory only",
+	},
+	cli.IntFlag{
+		Name:  "udp_sockets",
+		Value: 1,
+		Usage: "number of SO_REUSEPORT sockets receiving on the udp port",
+	},
+	cli.BoolTFlag{
+		Name:  "udp_offload",
+		Usage: "batch udp sends and receives with sendmmsg, GSO and GRO on linux",
+	},
+	cli.BoolFlag{
+		Name:  "allow_plaintext",
+		Usage: "accept clients that register without a link key, e.g. bots, gateways and load test clients",
+	},
+	cli.StringFlag{
+		Name:  "link_signing_key",
+		Value: "",
+		Usage: "base64 Ed25519 seed signing the link key in user reg replies; empty for unsigned",
+	},
+}
+
+//all模式下port和admin_addr换成allFlags里带前缀的版本
+var sessionsAddrFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "port",
+		Value: 20001,
+		Usage: "udp address port",
+	},
+	cli.StringFlag{
+		Name:  "admin_addr",
+		Value: "",
+		Usage: "admin api listen address, e.g. 127.0.0.1:20080",
+	},
+	cli.StringFlag{
+		Name:  "audit_file",
+		Value: "",
+		Usage: "append-only log of admin operations, empty to keep recent entries in memory only",
+	},
+}
+
+var sessionsFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "relays",
+		Usage: "relay addresses, overriding the built-in list",
+	},
+	cli.StringSliceFlag{
+		Name:  "relay_regions",
+		Usage: "region of a relay as addr=region, used to rank relay candidates for participants",
+	},
+	cli.StringFlag{
+		Name:  "geoip_file",
+		Value: "",
+		Usage: "MaxMind city database for ranking relay candidates by distance to the client",
+	},
+	cli.IntFlag{
+		Name:  "max_calls_per_user",
+		Value: 2,
+		Usage: "max simultaneous calls a uid may take part in, 0 for unlimited",
+	},
+	cli.StringSliceFlag{
+		Name:  "tenant_max_calls",
+		Usage: "max simultaneous calls per uid of a tenant as tenant=n, overriding max_calls_per_user",
+	},
+	cli.StringSliceFlag{
+		Name:  "tenant_relays",
+		Usage: "relay a tenant may use as tenant=addr, repeat for more relays; the relay must also be in relays",
+	},
+	cli.Int64Flag{
+		Name:  "quota_seconds",
+		Usage: "call seconds a uid may use per billing month before sid requests are rejected, 0 for unlimited",
+	},
+	cli.Int64Flag{
+		Name:  "max_duration",
+		Usage: "seconds after creation when a session is ended by the session manager, 0 for unlimited",
+	},
+	cli.IntFlag{
+		Name:  "canary_interval",
+		Usage: "seconds between synthetic canary calls through each relay, 0 to disable",
+	},
+	cli.IntFlag{
+		Name:  "max_voicemail",
+		Usage: "seconds a caller may leave a voicemail after a 1-1 call is rejected or unanswered, 0 to disable",
+	},
+	cli.IntFlag{
+		Name:  "push_token_ttl",
+		Value: 30 * 24 * 3600,
+		Usage: "seconds a push token is kept without the client registering it again, 0 to never expire",
+	},
+	cli.IntFlag{
+		Name:  "signal_max_age",
+		Value: session_manager.DefaultSignalMaxAge,
+		Usage: "seconds after which a delayed signal is dropped instead of handled, 0 to disable",
+	},
+	cli.IntFlag{
+		Name:  "dedup_size",
+		Value: session_manager.DefaultDedupSize,
+		Usage: "number of recent signals remembered to drop duplicates arriving through several relays",
+	},
+	cli.StringFlag{
+		Name:  "dedup_key",
+		Value: session_manager.DedupKeyPayload,
+		Usage: "how duplicate signals are keyed: payload, or digest to keep a fixed size hash per signal",
+	},
+	cli.Int64Flag{
+		Name:  "quota_bytes",
+		Usage: "relayed bytes a uid may use per billing month before sid requests are rejected, 0 for unlimited",
+	},
+	cli.IntFlag{
+		Name:  "pace_rate",
+		Value: 2000,
+		Usage: "packets per second sent to each relay, bursts above are queued and smoothed, 0 for unlimited",
+	},
+	cli.IntFlag{
+		Name:  "pace_global_rate",
+		Value: 8000,
+		Usage: "packets per second sent to all relays together, 0 for unlimited",
+	},
+	cli.IntFlag{
+		Name:  "inbox_size",
+		Value: 4096,
+		Usage: "packets queued between the udp reader and the main loop, excess non-critical packets are dropped",
+	},
+	cli.StringSliceFlag{
+		Name:  "webhooks",
+		Usage: "urls receiving session events as signed json POSTs",
+	},
+	cli.StringSliceFlag{
+		Name:  "alert_rules",
+		Usage: "alert rule per relay as metric>threshold/window, e.g. loss>0.05/1m, mos<3.5/5m or setup_failures>10/1m",
+	},
+	cli.StringFlag{
+		Name:  "webhook_secret",
+		Value: "",
+		Usage: "HMAC secret for signing webhook requests",
+	},
+	cli.StringSliceFlag{
+		Name:  "event_bus",
+		Usage: "publish call events to nats://host:port/subject or kafka://host:port,host:port/topic",
+	},
+	cli.IntFlag{
+		Name:  "blackbox_size",
+		Value: 64,
+		Usage: "recent signals kept per session for the admin blackbox and replay, 0 to disable",
+	},
+	cli.IntFlag{
+		Name:  "mesh_max",
+		Value: 2,
+		Usage: "use p2p mesh for calls of at most this many participants, 0 to always use the relay",
+	},
+	cli.IntFlag{
+		Name:  "mixer_min",
+		Value: 9,
+		Usage: "have the relay mix audio for calls of at least this many participants, 0 to never mix",
+	},
+	cli.StringFlag{
+		Name:  "state_file",
+		Value: "",
+		Usage: "save active sessions here on shutdown and restore them on start, so a restart does not drop calls",
+	},
+}
+
+var allFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "relay_port",
+		Value: 19001,
+		Usage: "relay udp address port",
+	},
+	cli.StringFlag{
+		Name:  "relay_admin_addr",
+		Value: "",
+		Usage: "relay admin api listen address",
+	},
+	cli.StringFlag{
+		Name:  "relay_audit_file",
+		Value: "",
+		Usage: "relay append-only log of admin operations",
+	},
+	cli.BoolFlag{
+		Name:  "relay_allow_plaintext",
+		Usage: "relay accepts clients that register without a link key",
+	},
+	cli.IntFlag{
+		Name:  "sessions_port",
+		Value: 20001,
+		Usage: "session manager udp address port",
+	},
+	cli.StringFlag{
+		Name:  "sessions_admin_addr",
+		Value: "",
+		Usage: "session manager admin api listen address",
+	},
+	cli.StringFlag{
+		Name:  "sessions_audit_file",
+		Value: "",
+		Usage: "session manager append-only log of admin operations",
+	},
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	logging.SetOutput(ioutil.Discard) //把日志只写到文件，然后stderr到nohup.out
+	if err := app.Run(os.Args); err != nil {
+		logging.Logger.Fatal(err)
+	}
+}
+
+//公共的日志设置，name为日志文件名
+func setupLogging(ctx *cli.Context, name string) {
+	logging.SetFormat(ctx.GlobalString("log_format"))
+	logging.SetFileRotation(ctx.GlobalString("log_dir"), name, 30, 24*time.Hour, 0)
+	if err := logging.SetLevel("", ctx.GlobalString("log_level")); err != nil {
+		logging.Logger.Warn("log level config error:", err)
+	}
+}
+
+func relayConfig(ctx *cli.Context, port int, adminAddr string) *relay.Config {
+	config := relay.GetDefaultConfig()
+	config.UdpAddr = fmt.Sprintf(":%d", port)
+	config.AdminAddr = adminAddr
+	config.UdpSockets = ctx.Int("udp_sockets")
+	if config.UdpSockets < 1 {
+		config.UdpSockets = 1
+	}
+	config.UdpOffload = ctx.BoolT("udp_offload")
+	config.AllowPlaintext = ctx.Bool("allow_plaintext")
+	config.LinkSigningKey = ctx.String("link_signing_key")
+	config.AccessSecret = ctx.GlobalString("access_secret")
+	config.OtlpEndpoint = ctx.GlobalString("otlp_endpoint")
+	config.Store = ctx.GlobalString("store")
+	config.ObfuscationKeys = ctx.GlobalStringSlice("obfuscation_keys")
+	config.ObfuscationGrace = ctx.GlobalInt("obfuscation_grace")
+	config.MetricsExport = ctx.GlobalString("metrics_export")
+	config.MaxDatagram = ctx.GlobalInt("max_datagram")
+	config.WatchdogTimeout = ctx.GlobalInt("watchdog_timeout")
+	config.WatchdogExit = ctx.GlobalBool("watchdog_exit")
+	config.LogDir = ctx.GlobalString("log_dir")
+	config.LogFormat = ctx.GlobalString("log_format")
+	config.LogLevels[""] = ctx.GlobalString("log_level")
+	config.AuditFile = ctx.String("audit_file")
+	return config
+}
+
+func sessionsConfig(ctx *cli.Context, port int, adminAddr string) *session_manager.Config {
+	config := session_manager.GetDefaultConfig()
+	config.UdpAddr = fmt.Sprintf(":%d", port)
+	config.AdminAddr = adminAddr
+	config.AccessSecret = ctx.GlobalString("access_secret")
+	config.OtlpEndpoint = ctx.GlobalString("otlp_endpoint")
+	config.Relays = ctx.StringSlice("relays")
+	for _, s := range ctx.StringSlice("relay_regions") {
+		if i := strings.LastIndex(s, "="); i > 0 {
+			config.RelayRegions[s[:i]] = s[i+1:]
+		}
+	}
+	config.GeoipFile = ctx.String("geoip_file")
+	config.MaxCallsPerUser = ctx.Int("max_calls_per_user")
+	config.SetTenantFlags(ctx.StringSlice("tenant_max_calls"), ctx.StringSlice("tenant_relays"))
+	config.QuotaSeconds = ctx.Int64("quota_seconds")
+	config.QuotaBytes = ctx.Int64("quota_bytes")
+	config.MaxDuration = ctx.Int64("max_duration")
+	config.CanaryInterval = ctx.Int("canary_interval")
+	config.MaxVoicemail = ctx.Int("max_voicemail")
+	config.PushTokenTtl = ctx.Int("push_token_ttl")
+	config.SignalMaxAge = ctx.Int("signal_max_age")
+	config.DedupSize = ctx.Int("dedup_size")
+	config.DedupKey = ctx.String("dedup_key")
+	config.PaceRate = ctx.Int("pace_rate")
+	config.PaceGlobalRate = ctx.Int("pace_global_rate")
+	config.StateFile = ctx.String("state_file")
+	config.Store = ctx.GlobalString("store")
+	config.ObfuscationKeys = ctx.GlobalStringSlice("obfuscation_keys")
+	config.ObfuscationGrace = ctx.GlobalInt("obfuscation_grace")
+	config.MaxDatagram = ctx.GlobalInt("max_datagram")
+	config.WatchdogTimeout = ctx.GlobalInt("watchdog_timeout")
+	config.WatchdogExit = ctx.GlobalBool("watchdog_exit")
+	config.Webhooks = ctx.StringSlice("webhooks")
+	config.AlertRules = ctx.StringSlice("alert_rules")
+	config.WebhookSecret = ctx.String("webhook_secret")
+	config.EventBus = ctx.StringSlice("event_bus")
+	config.BlackboxSize = ctx.Int("blackbox_size")
+	config.MeshMax = ctx.Int("mesh_max")
+	config.MixerMin = ctx.Int("mixer_min")
+	config.InboxSize = ctx.Int("inbox_size")
+	config.AuditFile = ctx.String("audit_file")
+	return config
+}
+
+func checkSessionsConfig(config *session_manager.Config) error {
+	if errs := config.Check(); len(errs) > 0 {
+		for _, err := range errs {
+			logging.Logger.Error("config error:", err)
+		}
+		return errs[0]
+	}
+	return nil
+}
+
+func runRelay(ctx *cli.Context) error {
+	config := relayConfig(ctx, ctx.Int("port"), ctx.String("admin_addr"))
+	setupLogging(ctx, "relay")
+	shutdown, err := tracing.Init("relay", config.OtlpEndpoint, config.TraceSampleRatio)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	service := relay.NewService(config)
+	service.Start()
+	service.WaitForShutdown()
+	return nil
+}
+
+func runSessions(ctx *cli.Context) error {
+	config := sessionsConfig(ctx, ctx.Int("port"), ctx.String("admin_addr"))
+	if err := checkSessionsConfig(config); err != nil {
+		return err
+	}
+	setupLogging(ctx, "session_manager")
+	shutdown, err := tracing.Init("session_manager", config.OtlpEndpoint, config.TraceSampleRatio)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	mgr := session_manager.NewSessionManager(config)
+	mgr.Start()
+	mgr.WaitForShutdown()
+	return nil
+}
+
+func runAll(ctx *cli.Context) error {
+	relayPort := ctx.Int("relay_port")
+	rc := relayConfig(ctx, relayPort, ctx.String("relay_admin_addr"))
+	sc := sessionsConfig(ctx, ctx.Int("sessions_port"), ctx.String("sessions_admin_addr"))
+	rc.AuditFile = ctx.String("relay_audit_file")
+	rc.AllowPlaintext = ctx.Bool("relay_allow_plaintext")
+	sc.AuditFile = ctx.String("sessions_audit_file")
+	if len(sc.Relays) == 0 {
+		sc.Relays = []string{fmt.Sprintf("127.0.0.1:%d", relayPort)}
+	}
+	if err := checkSessionsConfig(sc); err != nil {
+		return err
+	}
+	setupLogging(ctx, "ycng")
+	shutdown, err := tracing.Init("ycng", rc.OtlpEndpoint, rc.TraceSampleRatio)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	service := relay.NewService(rc)
+	service.Start()
+	mgr := session_manager.NewSessionManager(sc)
+	mgr.Start()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	<-sigc
+	signal.Stop(sigc)
+
+	//先停session manager，它停服时的通知还要经过relay发出去
+	mgr.Stop()
+	mgr.WaitForShutdown()
+	service.Stop()
+	service.WaitForShutdown()
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package loadtest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+拨测：线上定期用两个虚拟客户端经指定的relay打一通真实的通话，和Run的一组通话步骤相同，
+记下建立通话的耗时和媒体丢包，session manager据此发指标和告警，见session_manager/canary.go。
+caller和callee的uid为config.StartUid和StartUid+1，推流config.Duration。
+*/
+
+type CanaryResult struct {
+	Relay         string    `json:"relay"`
+	Time          time.Time `json:"time"`
+	SetupMs       int64     `json:"setup_ms"` //从请求sid到双方TurnReg完成
+	MediaSent     int64     `json:"media_sent"`
+	MediaReceived int64     `json:"media_received"`
+	Loss          float64   `json:"loss"`
+	MediaP99Ms    int64     `json:"media_p99_ms"`
+	Error         string    `json:"error,omitempty"` //注册或建立通话失败时的原因，此时没有媒体的结果
+}
+
+func RunCanary(config *Config) *CanaryResult {
+	result := &CanaryResult{Relay: config.RelayAddr, Time: time.Now()}
+	stats := NewStats()
+
+	caller, err := NewClient(config.StartUid, config, stats)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer caller.Close()
+	callee, err := NewClient(config.StartUid+1, config, stats)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer callee.Close()
+
+	for _, c := range []*Client{caller, callee} {
+		if err = c.Register(config.Timeout); err != nil {
+			result.Error = fmt.Sprint("register ", c.uid, ": ", err)
+			return result
+		}
+	}
+
+	start := time.Now()
+	sid, err := setupCall(config, caller, callee)
+	if err != nil {
+		result.Error = fmt.Sprint("setup call: ", err)
+		return result
+	}
+	result.SetupMs = int64(time.Since(start) / time.Millisecond)
+
+	var wg sync.WaitGroup
+	for _, c := range []*Client{caller, callee} {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			stream(config, c, sid)
+		}(c)
+	}
+	wg.Wait()
+
+	end := relay.NewSignal(relay.YCKCallSignalTypeEnd, caller.uid, callee.uid, sid)
+	caller.Exchange(end, callee, relay.YCKCallSignalTypeEnd, config.Timeout)
+
+	report := stats.Report()
+	result.MediaSent = report.MediaSent
+	result.MediaReceived = report.MediaReceived
+	result.Loss = report.MediaLoss()
+	result.MediaP99Ms = int64(report.MediaP99 / time.Millisecond)
+	return result
+}
+
+//超出阈值的项，没有时为nil；maxSetup或maxLoss为0时不检查该项
+func (r *CanaryResult) Alerts(maxSetup time.Duration, maxLoss float64) []string {
+	if r.Error != "" {
+		return []string{r.Error}
+	}
+	var alerts []string
+	if maxSetup > 0 && time.Duration(r.SetupMs)*time.Millisecond > maxSetup {
+		alerts = append(alerts, fmt.Sprintf("setup %dms exceeds %v", r.SetupMs, maxSetup))
+	}
+	if maxLoss > 0 && r.Loss > maxLoss {
+		alerts = append(alerts, fmt.Sprintf("media loss %.2f%% exceeds %.2f%%", r.Loss*100, maxLoss*100))
+	}
+	return alerts
+}
@@ -0,0 +1,33 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package loadtest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCanaryAlerts(t *testing.T) {
+	ok := &CanaryResult{SetupMs: 200, MediaSent: 1000, MediaReceived: 995, Loss: 0.005}
+	if alerts := ok.Alerts(time.Second, 0.01); alerts != nil {
+		t.Errorf("healthy result alerts %v", alerts)
+	}
+
+	slow := &CanaryResult{SetupMs: 1500, Loss: 0.05}
+	if alerts := slow.Alerts(time.Second, 0.01); len(alerts) != 2 {
+		t.Errorf("slow lossy result alerts %v, want setup and loss", alerts)
+	}
+	if alerts := slow.Alerts(0, 0); alerts != nil {
+		t.Errorf("unchecked thresholds alert %v", alerts)
+	}
+
+	failed := &CanaryResult{Error: "setup call: timeout"}
+	if alerts := failed.Alerts(0, 0); len(alerts) != 1 || alerts[0] != failed.Error {
+		t.Errorf("failed call alerts %v, want the error", alerts)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package loadtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+合成音频payload：
+  [0:2]   seq低16位，relay按音频包的格式从这里取seqid
+  [2:6]   seq，接收方据此去重和统计丢包
+  [9:11]  esi，填0
+  [12:20] 发送时间，按relay时钟校正的unix纳秒（见relay/clock.go），多台机器上跑时也可直接算端到端延迟
+其余填充到按码率算出的大小。
+*/
+
+const (
+	mediaHeaderSize = 20
+	retryInterval   = 500 * time.Millisecond //注册和信令没等到回应时的重发间隔
+)
+
+//一个虚拟客户端，一个udp socket，收包goroutine把信令和媒体分别交给通话流程和统计
+type Client struct {
+	uid     int64
+	conn    PacketConn
+	secret  string
+	stats   *Stats
+	signals chan *relay.Signal
+	regAck  chan struct{}
+	turnAck chan struct{}
+	seen    map[uint32]bool  //已收到的媒体seq，只在收包goroutine里访问
+	clock   *relay.ClockSkew //与relay的时钟偏差，发送时间和延迟都按relay的时钟算，多台机器压测时也可比
+}
+
+func NewClient(uid int64, config *Config, stats *Stats) (*Client, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", config.RelayAddr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	var conn PacketConn = udpConn
+	if !config.Uplink.IsZero() || !config.Downlink.IsZero() {
+		conn = NewNetemConn(udpConn, config.Uplink, config.Downlink, uid)
+	}
+	c := &Client{
+		uid:     uid,
+		conn:    conn,
+		secret:  config.AccessSecret,
+		stats:   stats,
+		signals: make(chan *relay.Signal, 16),
+		regAck:  make(chan struct{}, 1),
+		turnAck: make(chan struct{}, 1),
+		seen:    make(map[uint32]bool),
+		clock:   relay.NewClockSkew(config.RelayAddr),
+	}
+	go c.receive()
+	return c, nil
+}
+
+func (c *Client) Close() {
+	c.conn.Close()
+}
+
+func (c *Client) send(msg *relay.Message) error {
+	_, err := c.conn.Write(msg.ObfuscatedDataOfMessage())
+	return err
+}
+
+func (c *Client) Register(timeout time.Duration) error {
+	var token []byte
+	if c.secret != "" {
+		token = relay.IssueAccessToken(c.secret, c.uid, time.Now().Add(relay.AccessTokenTTL))
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserReg, c.uid, 0, 0, token, nil)
+	send := func() error {
+		relay.SetClockExtra(msg, time.Now())
+		return c.send(msg)
+	}
+	return retry(timeout, send, func(wait time.Duration) error {
+		select {
+		case <-c.regAck:
+			return nil
+		case <-time.After(wait):
+			return errors.New("user reg timeout")
+		}
+	})
+}
+
+func (c *Client) TurnReg(sid int64, timeout time.Duration) error {
+	msg := relay.NewMessage(relay.UdpMessageTypeTurnReg, c.uid, sid, 0, nil, nil)
+	return retry(timeout, func() error { return c.send(msg) }, func(wait time.Duration) error {
+		select {
+		case <-c.turnAck:
+			return nil
+		case <-time.After(wait):
+			return errors.New("turn reg timeout")
+		}
+	})
+}
+
+//信令都经session manager转发，消息发给SessionManagerUid，信令里的To才是真正的接收方
+func (c *Client) SendSignal(signal *relay.Signal) error {
+	signal.Timestamp = c.timestamp()
+	msg, err := c.signalMessage(signal)
+	if err != nil {
+		return err
+	}
+	c.stats.signalSent()
+	return c.send(msg)
+}
+
+//校正到relay时钟的信令时间戳
+func (c *Client) timestamp() int64 {
+	return c.clock.Now().UnixNano() / int64(100*time.Microsecond)
+}
+
+//发出信令并等peer收到expect类型的信令，没等到就按retryInterval重发。
+//重发时更新时间戳，否则session manager按payload去重，经它转发后丢掉的信令就再也补不回来
+func (c *Client) Exchange(signal *relay.Signal, peer *Client, expect uint16, timeout time.Duration) (*relay.Signal, error) {
+	c.stats.signalSent()
+	var reply *relay.Signal
+	send := func() error {
+		signal.Timestamp = c.timestamp()
+		msg, err := c.signalMessage(signal)
+		if err != nil {
+			return err
+		}
+		return c.send(msg)
+	}
+	err := retry(timeout, send, func(wait time.Duration) error {
+		var err error
+		reply, err = peer.WaitSignal(expect, wait)
+		return err
+	})
+	return reply, err
+}
+
+func (c *Client) signalMessage(signal *relay.Signal) (*relay.Message, error) {
+	payload, err := signal.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return relay.NewMessage(relay.UdpMessageTypeUserSignal, c.uid, relay.SessionManagerUid, 0, payload, nil), nil
+}
+
+//等待指定类型的信令，其他信令丢弃
+func (c *Client) WaitSignal(signalType uint16, timeout time.Duration) (*relay.Signal, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case s := <-c.signals:
+			if s.Signal == signalType {
+				return s, nil
+			}
+		case <-deadline:
+			return nil, errors.New("wait signal timeout")
+		}
+	}
+}
+
+func (c *Client) SendMedia(sid int64, seq uint32, size int) error {
+	payload := make([]byte, size)
+	binary.BigEndian.PutUint16(payload[0:2], uint16(seq))
+	binary.BigEndian.PutUint32(payload[2:6], seq)
+	binary.BigEndian.PutUint64(payload[12:20], uint64(c.clock.Now().UnixNano()))
+	msg := relay.NewMessage(relay.UdpMessageTypeAudioStream, c.uid, sid, 0, payload, nil)
+	msg.Tseq = int16(seq)
+	c.stats.mediaSent()
+	return c.send(msg)
+}
+
+func (c *Client) receive() {
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		local := time.Now()
+		now := local.Add(c.clock.Offset())
+		msg, err := relay.NewMessageFromObfuscatedData(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch msg.MsgType {
+		case relay.UdpMessageTypeUserRegReceived:
+			c.clock.Update(msg, local)
+			relay.LearnObfuscationKey(msg)
+			notify(c.regAck)
+		case relay.UdpMessageTypeTurnRegReceived:
+			notify(c.turnAck)
+		case relay.UdpMessageTypeUserSignal:
+			signal := relay.NewSignalTemp()
+			if signal.UnmarshalMessage(msg) != nil {
+				continue
+			}
+			sentAt := time.Unix(0, signal.Timestamp*int64(100*time.Microsecond))
+			c.stats.signalReceived(now.Sub(sentAt))
+			select {
+			case c.signals <- signal:
+			default:
+			}
+		case relay.UdpMessageTypeAudioStream:
+			if len(msg.Payload) < mediaHeaderSize {
+				continue
+			}
+			seq := binary.BigEndian.Uint32(msg.Payload[2:6])
+			if c.seen[seq] {
+				continue //relay按repeat factor重发的
+			}
+			c.seen[seq] = true
+			sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Payload[12:20])))
+			c.stats.mediaReceived(now.Sub(sentAt))
+		}
+	}
+}
+
+//send之后用wait等回应，每次最多等retryInterval，没等到就重发，直到timeout
+func retry(timeout time.Duration, send func() error, wait func(time.Duration) error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := send(); err != nil {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining > retryInterval {
+			remaining = retryInterval
+		}
+		err := wait(remaining)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
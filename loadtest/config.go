@@ -0,0 +1,106 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package loadtest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+type Config struct {
+	RelayAddr     string        `toml:"relay_addr"`
+	AccessSecret  string        `toml:"access_secret"` //relay开了access控制时用来给虚拟客户端签token
+	Clients       int           `toml:"clients"`       //虚拟客户端数，两两一组通话
+	StartUid      int64         `toml:"start_uid"`     //虚拟客户端的uid从这里开始连续分配，避免和真实用户冲突
+	Duration      time.Duration `toml:"duration"`      //每个通话推流的时长
+	Bitrate       int           `toml:"bitrate"`       //每个客户端的合成音频码率，bps
+	FrameInterval time.Duration `toml:"frame_interval"`
+	RampUp        time.Duration `toml:"ramp_up"` //在这段时间内均匀地启动各组通话
+	Timeout       time.Duration `toml:"timeout"` //每一步信令等待回复的超时
+
+	Uplink   NetworkConditions `toml:"uplink"`   //客户端到relay方向模拟的网络条件
+	Downlink NetworkConditions `toml:"downlink"` //relay到客户端方向
+}
+
+func GetConfig(ctx *cli.Context) *Config {
+	config := GetDefaultConfig()
+	if ctx.GlobalIsSet("relay") {
+		config.RelayAddr = ctx.GlobalString("relay")
+	}
+	if ctx.GlobalIsSet("access_secret") {
+		config.AccessSecret = ctx.GlobalString("access_secret")
+	}
+	if ctx.GlobalIsSet("clients") {
+		config.Clients = ctx.GlobalInt("clients")
+	}
+	if ctx.GlobalIsSet("start_uid") {
+		config.StartUid = ctx.GlobalInt64("start_uid")
+	}
+	if ctx.GlobalIsSet("duration") {
+		config.Duration = ctx.GlobalDuration("duration")
+	}
+	if ctx.GlobalIsSet("bitrate") {
+		config.Bitrate = ctx.GlobalInt("bitrate")
+	}
+	if ctx.GlobalIsSet("ramp_up") {
+		config.RampUp = ctx.GlobalDuration("ramp_up")
+	}
+	//命令行上的网络条件同时作用于上下行
+	if ctx.GlobalIsSet("loss") {
+		config.Uplink.Loss = ctx.GlobalFloat64("loss")
+		config.Downlink.Loss = config.Uplink.Loss
+	}
+	if ctx.GlobalIsSet("delay") {
+		config.Uplink.Delay = ctx.GlobalDuration("delay")
+		config.Downlink.Delay = config.Uplink.Delay
+	}
+	if ctx.GlobalIsSet("jitter") {
+		config.Uplink.Jitter = ctx.GlobalDuration("jitter")
+		config.Downlink.Jitter = config.Uplink.Jitter
+	}
+	if ctx.GlobalIsSet("reorder") {
+		config.Uplink.Reorder = ctx.GlobalFloat64("reorder")
+		config.Downlink.Reorder = config.Uplink.Reorder
+	}
+	if ctx.GlobalIsSet("duplicate") {
+		config.Uplink.Duplicate = ctx.GlobalFloat64("duplicate")
+		config.Downlink.Duplicate = config.Uplink.Duplicate
+	}
+	return config
+}
+
+func GetDefaultConfig() *Config {
+	var config *Config
+
+	config = &Config{
+		RelayAddr:     "127.0.0.1:19001",
+		Clients:       10,
+		StartUid:      9000000000,
+		Duration:      30 * time.Second,
+		Bitrate:       32000,
+		FrameInterval: 20 * time.Millisecond,
+		RampUp:        5 * time.Second,
+		Timeout:       5 * time.Second,
+	}
+	return config
+}
+
+//每帧合成音频payload的字节数，不小于mediaHeaderSize
+func (c *Config) frameSize() int {
+	size := int(int64(c.Bitrate) * int64(c.FrameInterval) / int64(time.Second) / 8)
+	if size < mediaHeaderSize {
+		size = mediaHeaderSize
+	}
+	return size
+}
+
+func (c *Config) String() string {
+	return fmt.Sprintf("relay=%s clients=%d duration=%v bitrate=%d frame=%v", c.RelayAddr, c.Clients, c.Duration, c.Bitrate, c.FrameInterval)
+}
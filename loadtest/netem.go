@@ -0,0 +1,167 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package loadtest
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+网络条件模拟：包在虚拟客户端与relay之间的udp连接上，按配置丢包、延迟抖动、乱序和重复，
+用来在CI里对着接近真实的网络验证Metrics、NACK和FEC的逻辑。上下行分别配置。
+随机数用固定种子，同样的种子和发包顺序得到同样的丢包和重复选择，延迟带来的乱序则取决于调度。
+*/
+
+type NetworkConditions struct {
+	Loss         float64       `toml:"loss"`          //丢包率
+	Duplicate    float64       `toml:"duplicate"`     //重复发送的比例
+	Reorder      float64       `toml:"reorder"`       //被选中的包额外延迟ReorderDelay，落到后面的包之后
+	ReorderDelay time.Duration `toml:"reorder_delay"` //为0时取10ms
+	Delay        time.Duration `toml:"delay"`         //固定延迟
+	Jitter       time.Duration `toml:"jitter"`        //在Delay上叠加[0, Jitter)的均匀随机延迟
+}
+
+func (n *NetworkConditions) IsZero() bool {
+	return *n == NetworkConditions{}
+}
+
+//虚拟客户端用的连接，*net.UDPConn（Dial出来的）直接满足
+type PacketConn interface {
+	Write(b []byte) (int, error)
+	Read(b []byte) (int, error)
+	Close() error
+}
+
+var errNetemClosed = errors.New("netem conn closed")
+
+type NetemConn struct {
+	conn PacketConn
+	up   NetworkConditions
+	down NetworkConditions
+
+	lock sync.Mutex
+	rand *rand.Rand
+
+	inbound chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewNetemConn(conn PacketConn, up NetworkConditions, down NetworkConditions, seed int64) *NetemConn {
+	c := &NetemConn{
+		conn:    conn,
+		up:      up,
+		down:    down,
+		rand:    rand.New(rand.NewSource(seed)),
+		inbound: make(chan []byte, 1024),
+		done:    make(chan struct{}),
+	}
+	go c.receive()
+	return c
+}
+
+//按条件决定一个包要投递几份，以及每份的延迟
+func (c *NetemConn) schedule(cond *NetworkConditions) []time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.rand.Float64() < cond.Loss {
+		return nil
+	}
+	copies := 1
+	if c.rand.Float64() < cond.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		d := cond.Delay
+		if cond.Jitter > 0 {
+			d += time.Duration(c.rand.Int63n(int64(cond.Jitter)))
+		}
+		if c.rand.Float64() < cond.Reorder {
+			if cond.ReorderDelay > 0 {
+				d += cond.ReorderDelay
+			} else {
+				d += 10 * time.Millisecond
+			}
+		}
+		delays[i] = d
+	}
+	return delays
+}
+
+//丢掉的包也返回成功，和真实的udp一样发送方感知不到
+func (c *NetemConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, errNetemClosed
+	default:
+	}
+	for _, d := range c.schedule(&c.up) {
+		if d <= 0 {
+			if _, err := c.conn.Write(b); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		data := make([]byte, len(b))
+		copy(data, b)
+		time.AfterFunc(d, func() {
+			select {
+			case <-c.done:
+			default:
+				c.conn.Write(data)
+			}
+		})
+	}
+	return len(b), nil
+}
+
+func (c *NetemConn) Read(b []byte) (int, error) {
+	select {
+	case data := <-c.inbound:
+		return copy(b, data), nil
+	case <-c.done:
+		return 0, errNetemClosed
+	}
+}
+
+func (c *NetemConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.conn.Close()
+}
+
+func (c *NetemConn) receive() {
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.once.Do(func() { close(c.done) })
+			return
+		}
+		for _, d := range c.schedule(&c.down) {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if d <= 0 {
+				c.deliver(data)
+			} else {
+				time.AfterFunc(d, func() { c.deliver(data) })
+			}
+		}
+	}
+}
+
+//接收队列满时丢包，相当于socket缓冲区溢出
+func (c *NetemConn) deliver(data []byte) {
+	select {
+	case c.inbound <- data:
+	default:
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package loadtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+//内存中的一端连接，Write的包进入sent，Read从recv取
+type pipeConn struct {
+	sent   chan []byte
+	recv   chan []byte
+	closed chan struct{}
+}
+
+func newPipeConn() *pipeConn {
+	return &pipeConn{
+		sent:   make(chan []byte, 100000),
+		recv:   make(chan []byte, 100000),
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *pipeConn) Write(b []byte) (int, error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	p.sent <- data
+	return len(b), nil
+}
+
+func (p *pipeConn) Read(b []byte) (int, error) {
+	select {
+	case data := <-p.recv:
+		return copy(b, data), nil
+	case <-p.closed:
+		return 0, errors.New("closed")
+	}
+}
+
+func (p *pipeConn) Close() error {
+	close(p.closed)
+	return nil
+}
+
+func seqPacket(seq uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, seq)
+	return b
+}
+
+//发count个包，返回在wait时间内到达的序号
+func sendThrough(t *testing.T, cond NetworkConditions, count int, wait time.Duration) []uint32 {
+	pipe := newPipeConn()
+	conn := NewNetemConn(pipe, cond, NetworkConditions{}, 1)
+	defer conn.Close()
+	for i := 0; i < count; i++ {
+		conn.Write(seqPacket(uint32(i)))
+	}
+	var got []uint32
+	deadline := time.After(wait)
+	for {
+		select {
+		case data := <-pipe.sent:
+			got = append(got, binary.BigEndian.Uint32(data))
+		case <-deadline:
+			return got
+		}
+	}
+}
+
+func TestNetemConditions(t *testing.T) {
+	const count = 10000
+	tests := []struct {
+		name     string
+		cond     NetworkConditions
+		min, max int //到达包数的范围
+	}{
+		{"clean", NetworkConditions{}, count, count},
+		{"loss", NetworkConditions{Loss: 0.1}, 8700, 9300},
+		{"duplicate", NetworkConditions{Duplicate: 0.1}, 10700, 11300},
+		{"delay", NetworkConditions{Delay: time.Millisecond, Jitter: time.Millisecond}, count, count},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sendThrough(t, tt.cond, count, 200*time.Millisecond)
+			if len(got) < tt.min || len(got) > tt.max {
+				t.Errorf("received %d packets, want [%d, %d]", len(got), tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestNetemReorder(t *testing.T) {
+	cond := NetworkConditions{Reorder: 0.2, ReorderDelay: 20 * time.Millisecond}
+	pipe := newPipeConn()
+	conn := NewNetemConn(pipe, cond, NetworkConditions{}, 1)
+	defer conn.Close()
+	for i := 0; i < 1000; i++ {
+		conn.Write(seqPacket(uint32(i)))
+		if i%100 == 99 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	outOfOrder := 0
+	last := -1
+	for i := 0; i < 1000; i++ {
+		seq := int(binary.BigEndian.Uint32(<-pipe.sent))
+		if seq < last {
+			outOfOrder++
+		}
+		last = seq
+	}
+	if outOfOrder == 0 {
+		t.Error("expected reordered packets")
+	}
+}
+
+func TestNetemDownlink(t *testing.T) {
+	pipe := newPipeConn()
+	conn := NewNetemConn(pipe, NetworkConditions{}, NetworkConditions{Delay: 30 * time.Millisecond}, 1)
+	defer conn.Close()
+
+	start := time.Now()
+	pipe.recv <- seqPacket(7)
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || binary.BigEndian.Uint32(buf[:n]) != 7 {
+		t.Fatalf("read %v, %v", buf[:n], err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("downlink delay %v, want >= 30ms", elapsed)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package loadtest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+Run按配置启动虚拟客户端，两两一组完成一次完整通话：
+  1. 双方UserReg到relay
+  2. caller向session manager请求sid，然后invite callee，callee回accept
+  3. 双方TurnReg到该session，按码率互推合成音频Duration时长
+  4. caller发end
+各组在RampUp内均匀启动，全部结束后返回统计报告。
+*/
+func Run(config *Config) (*Report, error) {
+	if config.Clients < 2 {
+		return nil, errors.New("at least 2 clients required")
+	}
+	stats := NewStats()
+
+	pairs := config.Clients / 2
+	var interval time.Duration
+	if pairs > 1 {
+		interval = config.RampUp / time.Duration(pairs)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < pairs; i++ {
+		callerUid := config.StartUid + int64(2*i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runCall(config, stats, callerUid, callerUid+1)
+		}()
+		time.Sleep(interval)
+	}
+	wg.Wait()
+
+	return stats.Report(), nil
+}
+
+func runCall(config *Config, stats *Stats, callerUid int64, calleeUid int64) {
+	caller, err := NewClient(callerUid, config, stats)
+	if err != nil {
+		stats.registerResult(err)
+		return
+	}
+	defer caller.Close()
+	callee, err := NewClient(calleeUid, config, stats)
+	if err != nil {
+		stats.registerResult(err)
+		return
+	}
+	defer callee.Close()
+
+	err = caller.Register(config.Timeout)
+	stats.registerResult(err)
+	if err != nil {
+		return
+	}
+	err = callee.Register(config.Timeout)
+	stats.registerResult(err)
+	if err != nil {
+		return
+	}
+
+	sid, err := setupCall(config, caller, callee)
+	stats.callResult(err)
+	if err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range []*Client{caller, callee} {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			stream(config, c, sid)
+		}(c)
+	}
+	wg.Wait()
+
+	end := relay.NewSignal(relay.YCKCallSignalTypeEnd, caller.uid, callee.uid, sid)
+	caller.Exchange(end, callee, relay.YCKCallSignalTypeEnd, config.Timeout)
+}
+
+func setupCall(config *Config, caller *Client, callee *Client) (int64, error) {
+	request := relay.NewSignal(relay.YCKCallSignalTypeSidRequest, caller.uid, relay.SessionManagerUid, 0)
+	created, err := caller.Exchange(request, caller, relay.YCKCallSignalTypeSidCreated, config.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	sid := created.SessionId
+
+	invite := relay.NewSignal(relay.YCKCallSignalTypeInvite, caller.uid, callee.uid, sid)
+	if _, err = caller.Exchange(invite, callee, relay.YCKCallSignalTypeInvite, config.Timeout); err != nil {
+		return 0, err
+	}
+	accept := relay.NewSignal(relay.YCKCallSignalTypeAccept, callee.uid, caller.uid, sid)
+	if _, err = callee.Exchange(accept, caller, relay.YCKCallSignalTypeAccept, config.Timeout); err != nil {
+		return 0, err
+	}
+
+	if err = caller.TurnReg(sid, config.Timeout); err != nil {
+		return 0, err
+	}
+	if err = callee.TurnReg(sid, config.Timeout); err != nil {
+		return 0, err
+	}
+	return sid, nil
+}
+
+func stream(config *Config, c *Client, sid int64) {
+	size := config.frameSize()
+	ticker := time.NewTicker(config.FrameInterval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(config.Duration)
+	var seq uint32
+	for now := range ticker.C {
+		if now.After(deadline) {
+			return
+		}
+		seq++
+		c.SendMedia(sid, seq, size)
+	}
+}
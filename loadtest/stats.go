@@ -0,0 +1,167 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package loadtest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//为控制内存，每类延迟最多保留这么多个样本，超出后按蓄水池抽样替换
+const maxLatencySamples = 100000
+
+type latencySamples struct {
+	samples []time.Duration
+	count   int64
+	seed    uint64
+}
+
+func (l *latencySamples) add(d time.Duration) {
+	l.count++
+	if len(l.samples) < maxLatencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.seed = l.seed*6364136223846793005 + 1442695040888963407
+	if i := int64(l.seed>>33) % l.count; i < maxLatencySamples {
+		l.samples[i] = d
+	}
+}
+
+func (l *latencySamples) percentile(p float64) time.Duration {
+	if len(l.samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(l.samples))
+	copy(sorted, l.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+type Stats struct {
+	lock sync.Mutex
+
+	registered   int
+	regFailed    int
+	callsStarted int
+	callsFailed  int
+
+	signalsSent     int64
+	signalsReceived int64
+	signalLatency   latencySamples
+
+	mediaSentCount     int64
+	mediaReceivedCount int64
+	mediaLatency       latencySamples
+}
+
+func NewStats() *Stats {
+	return &Stats{}
+}
+
+func (s *Stats) registerResult(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err == nil {
+		s.registered++
+	} else {
+		s.regFailed++
+	}
+}
+
+func (s *Stats) callResult(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.callsStarted++
+	if err != nil {
+		s.callsFailed++
+	}
+}
+
+func (s *Stats) signalSent() {
+	s.lock.Lock()
+	s.signalsSent++
+	s.lock.Unlock()
+}
+
+func (s *Stats) signalReceived(latency time.Duration) {
+	s.lock.Lock()
+	s.signalsReceived++
+	s.signalLatency.add(latency)
+	s.lock.Unlock()
+}
+
+func (s *Stats) mediaSent() {
+	s.lock.Lock()
+	s.mediaSentCount++
+	s.lock.Unlock()
+}
+
+func (s *Stats) mediaReceived(latency time.Duration) {
+	s.lock.Lock()
+	s.mediaReceivedCount++
+	s.mediaLatency.add(latency)
+	s.lock.Unlock()
+}
+
+type Report struct {
+	Registered      int
+	RegFailed       int
+	Calls           int
+	CallsFailed     int
+	SignalsSent     int64
+	SignalsReceived int64
+	SignalP50       time.Duration
+	SignalP99       time.Duration
+	SignalMax       time.Duration
+	MediaSent       int64
+	MediaReceived   int64
+	MediaP50        time.Duration
+	MediaP99        time.Duration
+	MediaMax        time.Duration
+}
+
+func (s *Stats) Report() *Report {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &Report{
+		Registered:      s.registered,
+		RegFailed:       s.regFailed,
+		Calls:           s.callsStarted,
+		CallsFailed:     s.callsFailed,
+		SignalsSent:     s.signalsSent,
+		SignalsReceived: s.signalsReceived,
+		SignalP50:       s.signalLatency.percentile(0.5),
+		SignalP99:       s.signalLatency.percentile(0.99),
+		SignalMax:       s.signalLatency.percentile(1),
+		MediaSent:       s.mediaSentCount,
+		MediaReceived:   s.mediaReceivedCount,
+		MediaP50:        s.mediaLatency.percentile(0.5),
+		MediaP99:        s.mediaLatency.percentile(0.99),
+		MediaMax:        s.mediaLatency.percentile(1),
+	}
+}
+
+//每个通话里caller发的媒体只有callee收，反之亦然，所以收发数可以直接比较得出丢包
+func (r *Report) MediaLoss() float64 {
+	if r.MediaSent == 0 {
+		return 0
+	}
+	return 1 - float64(r.MediaReceived)/float64(r.MediaSent)
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("registered %d (failed %d), calls %d (failed %d)\n"+
+		"signals: sent %d, received %d, latency p50 %v p99 %v max %v\n"+
+		"media:   sent %d, received %d, loss %.2f%%, latency p50 %v p99 %v max %v",
+		r.Registered, r.RegFailed, r.Calls, r.CallsFailed,
+		r.SignalsSent, r.SignalsReceived, r.SignalP50, r.SignalP99, r.SignalMax,
+		r.MediaSent, r.MediaReceived, r.MediaLoss()*100, r.MediaP50, r.MediaP99, r.MediaMax)
+}
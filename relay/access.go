@@ -0,0 +1,63 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/*
+relay接入控制：
+session manager（或账号后台）用与relay共享的secret给用户签发短期token，客户端在UserReg的payload中带上token，
+relay校验通过才登记该用户；未登记的用户不能TurnReg，也不能发信令。secret为空时不做校验，兼容老的部署。
+token格式：uid(8) + 过期时间unix秒(8) + HMAC-SHA256(32)
+*/
+
+const (
+	AccessTokenSize = 48
+	AccessTokenTTL  = 2 * time.Hour
+)
+
+var (
+	errAccessTokenSize      = errors.New("incorrect access token size")
+	errAccessTokenSignature = errors.New("access token signature mismatch")
+	errAccessTokenUid       = errors.New("access token uid mismatch")
+	errAccessTokenExpired   = errors.New("access token expired")
+)
+
+func IssueAccessToken(secret string, uid int64, expire time.Time) []byte {
+	token := make([]byte, AccessTokenSize)
+	binary.BigEndian.PutUint64(token[0:8], uint64(uid))
+	binary.BigEndian.PutUint64(token[8:16], uint64(expire.Unix()))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(token[0:16])
+	copy(token[16:], mac.Sum(nil))
+	return token
+}
+
+func VerifyAccessToken(secret string, token []byte, uid int64, now time.Time) error {
+	if len(token) != AccessTokenSize {
+		return errAccessTokenSize
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(token[0:16])
+	if !hmac.Equal(mac.Sum(nil), token[16:]) {
+		return errAccessTokenSignature
+	}
+	if int64(binary.BigEndian.Uint64(token[0:8])) != uid {
+		return errAccessTokenUid
+	}
+	if now.Unix() > int64(binary.BigEndian.Uint64(token[8:16])) {
+		return errAccessTokenExpired
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessToken(t *testing.T) {
+	now := time.Now()
+	token := IssueAccessToken("secret", 1001, now.Add(time.Hour))
+	if err := VerifyAccessToken("secret", token, 1001, now); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+
+	bad := append([]byte(nil), token...)
+	bad[AccessTokenSize-1] ^= 1
+	if err := VerifyAccessToken("secret", bad, 1001, now); err != errAccessTokenSignature {
+		t.Errorf("bad mac: %v", err)
+	}
+	if err := VerifyAccessToken("other", token, 1001, now); err != errAccessTokenSignature {
+		t.Errorf("wrong secret: %v", err)
+	}
+	//改了uid或过期时间，签名就对不上
+	bad = append([]byte(nil), token...)
+	bad[7] ^= 1
+	if err := VerifyAccessToken("secret", bad, 1000, now); err != errAccessTokenSignature {
+		t.Errorf("changed uid: %v", err)
+	}
+	if err := VerifyAccessToken("secret", token, 1002, now); err != errAccessTokenUid {
+		t.Errorf("uid mismatch: %v", err)
+	}
+	if err := VerifyAccessToken("secret", token, 1001, now.Add(2*time.Hour)); err != errAccessTokenExpired {
+		t.Errorf("expired: %v", err)
+	}
+	for _, n := range []int{0, AccessTokenSize - 1, AccessTokenSize + 1} {
+		if err := VerifyAccessToken("secret", make([]byte, n), 1001, now); err != errAccessTokenSize {
+			t.Errorf("%d bytes: %v", n, err)
+		}
+	}
+}
+
+func TestServiceAccessSecret(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	now := time.Now()
+	register := func(s *Service, payload []byte) bool {
+		s.handleMessageUserReg(NewMessage(UdpMessageTypeUserReg, 1001, 0, 0, payload, nil), &ReceivedPacket{FromUdpAddr: addr, Time: now.UnixNano()})
+		registered := s.users[1001] != nil
+		delete(s.users, 1001)
+		return registered
+	}
+
+	//secret为空时不校验token
+	config := GetDefaultConfig()
+	config.AllowPlaintext = true
+	s := NewService(config)
+	if !register(s, nil) {
+		t.Error("user reg without token rejected when access control is off")
+	}
+
+	config.AccessSecret = "secret"
+	s = NewService(config)
+	if register(s, nil) {
+		t.Error("user reg without token accepted")
+	}
+	//用空secret签的token不能绕过校验
+	if register(s, IssueAccessToken("", 1001, now.Add(time.Hour))) {
+		t.Error("token signed with an empty secret accepted")
+	}
+	if register(s, IssueAccessToken(config.AccessSecret, 1002, now.Add(time.Hour))) {
+		t.Error("token of another uid accepted")
+	}
+	if !register(s, IssueAccessToken(config.AccessSecret, 1001, now.Add(time.Hour))) {
+		t.Error("valid token rejected")
+	}
+}
@@ -0,0 +1,295 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+relay的管理接口，只应监听在内网或本机地址上。config.AdminAddr为空时不启动。
+  GET  /blocklist                               当前黑名单
+  POST /blocklist/add?ip=x&uid=y&duration=10m   duration省略为永久
+  POST /blocklist/remove?ip=x&uid=y
+  GET  /loglevel                                各模块的日志级别
+  POST /loglevel?module=x&level=debug           module省略为全局
+  GET  /trace                                   开启了详细trace的sid
+  POST /trace?sid=x&duration=30m                对sid开启详细trace，duration省略为一直开启
+  POST /trace?sid=x&off=1                       关闭
+  GET  /sockets                                 各udp socket的收包数
+  GET  /status                                  用户数、session数、收发速率
+  GET  /route?uid=x                             用户当前的地址，不经过主循环，见routing.go
+  POST /drain                                   进入排空状态，见drain.go
+  POST /drain?off=1                             退出排空状态
+  GET  /audit?since=x&action=y&limit=n          审计日志，见audit.go
+  POST /obfuscation?id=x&secret=y&grace=1h      轮换混淆密钥，grace内仍接受并使用旧密钥，见obfkey.go
+封禁、改日志级别、trace、排空和轮换混淆密钥会记入审计日志，请求头X-Ycng-Operator为操作人。
+*/
+
+type AdminServer struct {
+	addr     string
+	service  *Service
+	server   *http.Server
+	listener net.Listener
+}
+
+func NewAdminServer(addr string, service *Service) *AdminServer {
+	a := &AdminServer{
+		addr:    addr,
+		service: service,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blocklist", a.handleBlocklist)
+	mux.HandleFunc("/blocklist/add", a.handleBlocklistAdd)
+	mux.HandleFunc("/blocklist/remove", a.handleBlocklistRemove)
+	mux.HandleFunc("/loglevel", a.handleLogLevel)
+	mux.HandleFunc("/trace", a.handleTrace)
+	mux.HandleFunc("/sockets", a.handleSockets)
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/route", a.handleRoute)
+	mux.HandleFunc("/drain", a.handleDrain)
+	mux.HandleFunc("/obfuscation", a.handleObfuscation)
+	mux.Handle("/audit", service.audit)
+	a.server = &http.Server{Handler: mux}
+	return a
+}
+
+func (a *AdminServer) Start() {
+	listener, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		logging.Logger.Error("admin listen error:", err)
+		return
+	}
+	a.listener = listener
+	logging.Logger.Info("admin api listen on:", a.addr)
+	go a.server.Serve(listener)
+}
+
+func (a *AdminServer) Stop() {
+	if a.listener != nil {
+		a.server.Close()
+	}
+}
+
+func (a *AdminServer) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	data, err := a.service.blocklist.Snapshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (a *AdminServer) handleBlocklistAdd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var duration time.Duration
+	if d := r.FormValue("duration"); d != "" {
+		var err error
+		duration, err = time.ParseDuration(d)
+		if err != nil {
+			http.Error(w, "incorrect duration", http.StatusBadRequest)
+			return
+		}
+	}
+	ip, uid, ok := a.parseTarget(w, r)
+	if !ok {
+		return
+	}
+	if ip != "" {
+		a.service.blocklist.BlockIp(ip, duration)
+		a.service.audit.Record(AuditOperator(r), AuditBlocklistAdd, "ip:"+ip, duration.String())
+	}
+	if uid != nil {
+		a.service.blocklist.BlockUid(*uid, duration)
+		a.service.audit.Record(AuditOperator(r), AuditBlocklistAdd, "uid:"+strconv.FormatInt(*uid, 10), duration.String())
+	}
+	logging.Logger.Info("admin block ip:", ip, " uid:", r.FormValue("uid"), " from ", r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *AdminServer) handleBlocklistRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip, uid, ok := a.parseTarget(w, r)
+	if !ok {
+		return
+	}
+	if ip != "" {
+		a.service.blocklist.UnblockIp(ip)
+		a.service.audit.Record(AuditOperator(r), AuditBlocklistRemove, "ip:"+ip, "")
+	}
+	if uid != nil {
+		a.service.blocklist.UnblockUid(*uid)
+		a.service.audit.Record(AuditOperator(r), AuditBlocklistRemove, "uid:"+strconv.FormatInt(*uid, 10), "")
+	}
+	logging.Logger.Info("admin unblock ip:", ip, " uid:", r.FormValue("uid"), " from ", r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *AdminServer) parseTarget(w http.ResponseWriter, r *http.Request) (ip string, uid *int64, ok bool) {
+	ip = r.FormValue("ip")
+	if ip != "" && net.ParseIP(ip) == nil {
+		http.Error(w, "incorrect ip", http.StatusBadRequest)
+		return "", nil, false
+	}
+	if u := r.FormValue("uid"); u != "" {
+		id, err := strconv.ParseInt(u, 10, 64)
+		if err != nil {
+			http.Error(w, "incorrect uid", http.StatusBadRequest)
+			return "", nil, false
+		}
+		uid = &id
+	}
+	if ip == "" && uid == nil {
+		http.Error(w, "ip or uid required", http.StatusBadRequest)
+		return "", nil, false
+	}
+	return ip, uid, true
+}
+
+func (a *AdminServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		module := r.FormValue("module")
+		level := r.FormValue("level")
+		if err := logging.SetLevel(module, level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.Logger.Info("admin set log level of module '", module, "' to ", level, " from ", r.RemoteAddr)
+		a.service.audit.Record(AuditOperator(r), AuditConfigLogLevel, module, level)
+	}
+	data, err := json.Marshal(logging.Levels())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (a *AdminServer) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		sid, err := strconv.ParseInt(r.FormValue("sid"), 10, 64)
+		if err != nil {
+			http.Error(w, "incorrect sid", http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("off") != "" {
+			logging.DisableTrace(sid)
+			logging.Logger.Info("admin disable trace for session ", sid, " from ", r.RemoteAddr)
+			a.service.audit.Record(AuditOperator(r), AuditConfigTrace, strconv.FormatInt(sid, 10), "off")
+		} else {
+			var duration time.Duration
+			if d := r.FormValue("duration"); d != "" {
+				duration, err = time.ParseDuration(d)
+				if err != nil {
+					http.Error(w, "incorrect duration", http.StatusBadRequest)
+					return
+				}
+			}
+			logging.EnableTrace(sid, duration)
+			logging.Logger.Info("admin enable trace for session ", sid, " duration ", duration, " from ", r.RemoteAddr)
+			a.service.audit.Record(AuditOperator(r), AuditConfigTrace, strconv.FormatInt(sid, 10), "on "+duration.String())
+		}
+	}
+	data, err := json.Marshal(logging.TracedSids())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (a *AdminServer) handleSockets(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(a.service.udp_server.PacketCounts())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (a *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := a.service.Status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (a *AdminServer) handleRoute(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.ParseInt(r.FormValue("uid"), 10, 64)
+	if err != nil {
+		http.Error(w, "incorrect uid", http.StatusBadRequest)
+		return
+	}
+	addr := a.service.routes.Lookup(uid)
+	if addr == nil {
+		http.Error(w, "no route", http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{"uid": uid, "addr": addr.String()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (a *AdminServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	draining := r.FormValue("off") == ""
+	if err := a.service.SetDraining(draining); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	logging.Logger.Info("admin set draining ", draining, " from ", r.RemoteAddr)
+	a.service.audit.Record(AuditOperator(r), AuditConfigDrain, "", strconv.FormatBool(draining))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *AdminServer) handleObfuscation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, grace, err := ObfuscationKeyFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	RotateObfuscationKey(key, grace)
+	logging.Logger.Warn("admin rotate obfuscation key to ", key.Id, " grace ", grace, " from ", r.RemoteAddr)
+	a.service.audit.Record(AuditOperator(r), AuditConfigObfKey, strconv.Itoa(int(key.Id)), "grace "+grace.String())
+	w.WriteHeader(http.StatusOK)
+}
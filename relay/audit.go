@@ -0,0 +1,207 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+审计日志：记录管理接口和信令里的管理性、破坏性操作（封禁、踢人、强制结束session、运行时改配置等），
+每条记录谁、什么时候、做了什么、对谁做的。
+文件只追加写，一行一条json，不做切分和删除，由运维归档。路径为空时只保留在内存里。
+最近AuditRecentSize条同时保留在内存里供GET /audit查询，启动时从文件末尾装回。
+操作人取管理请求的X-Ycng-Operator头，没有时为来源地址；信令触发的操作为"uid:发起者"。
+relay和session manager共用，各写各的文件。
+*/
+
+const AuditRecentSize = 10000
+
+const (
+	AuditBlocklistAdd    = "blocklist.add"
+	AuditBlocklistRemove = "blocklist.remove"
+	AuditConfigLogLevel  = "config.loglevel"
+	AuditConfigTrace     = "config.trace"
+	AuditConfigDrain     = "config.drain"
+	AuditConfigObfKey    = "config.obfuscation" //只记key id，不记secret
+	AuditSessionKill     = "session.kill"
+	AuditSessionKick     = "session.kick"
+	AuditSessionBot      = "session.bot"
+	AuditUserDnd         = "user.dnd"
+)
+
+type AuditEntry struct {
+	Time   int64  `json:"time"` //unix毫秒
+	Who    string `json:"who"`
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type AuditLog struct {
+	file   *os.File
+	recent []AuditEntry
+	lock   sync.Mutex
+}
+
+//path为空时只记在内存里
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{}
+	if path == "" {
+		return a, nil
+	}
+	if err := a.load(path); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	a.file = file
+	return a, nil
+}
+
+//打开失败时退回只记内存，不影响服务启动
+func OpenAuditLogOrMemory(path string) *AuditLog {
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		logging.Logger.Error("open audit log ", path, " error:", err, ", audit entries are kept in memory only")
+		a, _ = OpenAuditLog("")
+	}
+	return a
+}
+
+func (a *AuditLog) load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logging.Logger.Warn("skip broken audit entry:", err)
+			continue
+		}
+		a.append(entry)
+	}
+	return scanner.Err()
+}
+
+//调用方需持有锁
+func (a *AuditLog) append(entry AuditEntry) {
+	if len(a.recent) >= AuditRecentSize {
+		n := copy(a.recent, a.recent[len(a.recent)-AuditRecentSize/2:])
+		a.recent = a.recent[:n]
+	}
+	a.recent = append(a.recent, entry)
+}
+
+func (a *AuditLog) Record(who string, action string, target string, detail string) {
+	entry := AuditEntry{
+		Time:   time.Now().UnixNano() / int64(time.Millisecond),
+		Who:    who,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.append(entry)
+	if a.file != nil {
+		data, err := json.Marshal(entry)
+		if err == nil {
+			_, err = a.file.Write(append(data, '\n'))
+		}
+		if err != nil {
+			logging.Logger.Error("audit log write error:", err)
+		}
+	}
+}
+
+//按时间顺序返回since（unix毫秒）之后、action以给定前缀开头的最近limit条，limit为0时不限
+func (a *AuditLog) Query(since int64, action string, limit int) []AuditEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	entries := make([]AuditEntry, 0)
+	for i := len(a.recent) - 1; i >= 0; i-- {
+		entry := a.recent[i]
+		if entry.Time < since {
+			break
+		}
+		if !strings.HasPrefix(entry.Action, action) {
+			continue
+		}
+		entries = append(entries, entry)
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+func (a *AuditLog) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+//GET /audit?since=unix毫秒&action=前缀&limit=n
+func (a *AuditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	var limit int
+	var err error
+	if s := r.FormValue("since"); s != "" {
+		since, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "incorrect since", http.StatusBadRequest)
+			return
+		}
+	}
+	if l := r.FormValue("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			http.Error(w, "incorrect limit", http.StatusBadRequest)
+			return
+		}
+	}
+	data, err := json.Marshal(a.Query(since, r.FormValue("action"), limit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+//管理请求的操作人
+func AuditOperator(r *http.Request) string {
+	if operator := r.Header.Get("X-Ycng-Operator"); operator != "" {
+		return operator + "@" + r.RemoteAddr
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,100 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogAppendAndReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record("ops@10.0.0.1:5000", AuditBlocklistAdd, "ip:1.2.3.4", "1h0m0s")
+	a.Record("ops@10.0.0.1:5000", AuditConfigDrain, "", "true")
+	a.Close()
+
+	//重新打开后继续追加，之前的记录还在
+	a, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record("10.0.0.2:6000", AuditBlocklistRemove, "ip:1.2.3.4", "")
+	a.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("audit file has %d lines, want 3", lines)
+	}
+	a, _ = OpenAuditLog(path)
+	defer a.Close()
+	entries := a.Query(0, "", 0)
+	if len(entries) != 3 || entries[0].Action != AuditBlocklistAdd || entries[2].Who != "10.0.0.2:6000" {
+		t.Errorf("reloaded entries %+v", entries)
+	}
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	a, _ := OpenAuditLog("")
+	a.Record("a", AuditBlocklistAdd, "uid:1", "")
+	a.Record("b", AuditConfigLogLevel, "", "debug")
+	a.Record("c", AuditBlocklistRemove, "uid:1", "")
+
+	if entries := a.Query(0, "blocklist", 0); len(entries) != 2 || entries[0].Who != "a" || entries[1].Who != "c" {
+		t.Errorf("action prefix query %+v", entries)
+	}
+	if entries := a.Query(0, "", 1); len(entries) != 1 || entries[0].Who != "c" {
+		t.Errorf("limited query %+v", entries)
+	}
+	if entries := a.Query(a.recent[2].Time+1, "", 0); len(entries) != 0 {
+		t.Errorf("query since future %+v", entries)
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/audit?action=config", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"detail":"debug"`) {
+		t.Errorf("GET /audit %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/audit?limit=x", nil))
+	if w.Code != 400 {
+		t.Errorf("bad limit status %d", w.Code)
+	}
+}
+
+func TestAdminBlocklistAudited(t *testing.T) {
+	config := GetDefaultConfig()
+	config.Store = "memory://"
+	s := NewService(config)
+	a := NewAdminServer("", s)
+	r := httptest.NewRequest("POST", "/blocklist/add?uid=7&duration=10m", nil)
+	r.Header.Set("X-Ycng-Operator", "alice")
+	a.handleBlocklistAdd(httptest.NewRecorder(), r)
+
+	entries := s.audit.Query(0, "", 0)
+	if len(entries) != 1 || entries[0].Action != AuditBlocklistAdd || entries[0].Target != "uid:7" ||
+		entries[0].Detail != "10m0s" || !strings.HasPrefix(entries[0].Who, "alice@") {
+		t.Errorf("audit entries %+v", entries)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+黑名单：按ip和uid封禁，到期时间为零值表示永久。
+admin api在另一个goroutine里修改，所以自带锁。每次修改都写回store，重启后从store恢复，见storage.go。
+*/
+
+type Blocklist struct {
+	store Store
+	ips   map[string]time.Time
+	uids  map[int64]time.Time
+	lock  sync.RWMutex
+}
+
+func NewBlocklist(store Store) *Blocklist {
+	b := &Blocklist{
+		store: store,
+		ips:   make(map[string]time.Time),
+		uids:  make(map[int64]time.Time),
+	}
+	b.load()
+	return b
+}
+
+func (b *Blocklist) load() {
+	data, err := b.store.LoadBlocklist()
+	if err != nil {
+		logging.Logger.Warn("blocklist load error:", err)
+		return
+	}
+	if data.Ips != nil {
+		b.ips = data.Ips
+	}
+	if data.Uids != nil {
+		b.uids = data.Uids
+	}
+	logging.Logger.Info("blocklist loaded, ips:", len(b.ips), " uids:", len(b.uids))
+}
+
+//调用方需持有锁
+func (b *Blocklist) save() {
+	if err := b.store.SaveBlocklist(&BlocklistData{Ips: b.ips, Uids: b.uids}); err != nil {
+		logging.Logger.Warn("blocklist save error:", err)
+	}
+}
+
+//duration为0表示永久封禁
+func (b *Blocklist) BlockIp(ip string, duration time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ips[ip] = expireTime(duration)
+	b.save()
+	logging.Logger.Warn("block ip ", ip, " for ", duration)
+}
+
+func (b *Blocklist) UnblockIp(ip string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.ips, ip)
+	b.save()
+	logging.Logger.Info("unblock ip ", ip)
+}
+
+func (b *Blocklist) BlockUid(uid int64, duration time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.uids[uid] = expireTime(duration)
+	b.save()
+	logging.Logger.Warn("block uid ", uid, " for ", duration)
+}
+
+func (b *Blocklist) UnblockUid(uid int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.uids, uid)
+	b.save()
+	logging.Logger.Info("unblock uid ", uid)
+}
+
+func (b *Blocklist) IsIpBlocked(ip string, now time.Time) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	until, ok := b.ips[ip]
+	return ok && (until.IsZero() || now.Before(until))
+}
+
+func (b *Blocklist) IsUidBlocked(uid int64, now time.Time) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	until, ok := b.uids[uid]
+	return ok && (until.IsZero() || now.Before(until))
+}
+
+//清理已到期的临时封禁
+func (b *Blocklist) Expire(now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	changed := false
+	for ip, until := range b.ips {
+		if !until.IsZero() && now.After(until) {
+			delete(b.ips, ip)
+			changed = true
+		}
+	}
+	for uid, until := range b.uids {
+		if !until.IsZero() && now.After(until) {
+			delete(b.uids, uid)
+			changed = true
+		}
+	}
+	if changed {
+		b.save()
+	}
+}
+
+func (b *Blocklist) Snapshot() ([]byte, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return json.Marshal(&BlocklistData{Ips: b.ips, Uids: b.uids})
+}
+
+func expireTime(duration time.Duration) time.Time {
+	if duration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(duration)
+}
+
+/*
+按来源ip的简单限速：每秒超过limit个包算一次违规，1分钟内违规达到RateViolationsToBan次即临时封禁。
+只在service的loop里调用，不需要锁。
+*/
+
+const (
+	RateViolationsToBan = 3
+	RateViolationWindow = 1 * time.Minute
+	RateBanDuration     = 10 * time.Minute
+)
+
+type rateState struct {
+	windowStart   time.Time
+	count         int
+	violations    int
+	lastViolation time.Time
+}
+
+type RateLimiter struct {
+	limit   int
+	sources map[string]*rateState
+}
+
+func NewRateLimiter(limit int) *RateLimiter {
+	r := &RateLimiter{
+		limit:   limit,
+		sources: make(map[string]*rateState),
+	}
+	return r
+}
+
+//返回值: allow该包是否放行，ban是否应该封禁该来源
+func (r *RateLimiter) Hit(source string, now time.Time) (allow bool, ban bool) {
+	if r.limit <= 0 {
+		return true, false
+	}
+	state := r.sources[source]
+	if state == nil {
+		state = &rateState{windowStart: now}
+		r.sources[source] = state
+	}
+	if now.Sub(state.windowStart) >= time.Second {
+		state.windowStart = now
+		state.count = 0
+	}
+	state.count++
+	if state.count <= r.limit {
+		return true, false
+	}
+
+	if state.count == r.limit+1 { //每个窗口只记一次违规
+		if now.Sub(state.lastViolation) > RateViolationWindow {
+			state.violations = 0
+		}
+		state.violations++
+		state.lastViolation = now
+		if state.violations >= RateViolationsToBan {
+			state.violations = 0
+			return false, true
+		}
+	}
+	return false, false
+}
+
+func (r *RateLimiter) Expire(now time.Time) {
+	for source, state := range r.sources {
+		if now.Sub(state.windowStart) > RateViolationWindow {
+			delete(r.sources, source)
+		}
+	}
+}
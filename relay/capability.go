@@ -0,0 +1,87 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+/*
+协议版本和能力协商：
+  消息头的Version是格式版本，只有改动头部格式时才升级，收到比自己新的版本直接丢弃。
+  新功能不升版本，而是在能力位图里加一位。客户端在UserReg的extra里带上自己支持的能力，
+  relay回复UserRegReceived时带上relay支持的能力，双方按交集启用。没带能力位图的老客户端按0处理，
+  所有新功能都对它关闭。
+  relay把发送方协商后的能力位图附在转给session manager的信令上，session manager据此决定发什么。
+  同时附上发送方的公网ip，session manager据此做GeoIP，给他排relay候选。
+*/
+
+const (
+	ProtocolVersion = 1 //当前的消息头格式版本
+
+	CapabilityLinkEncryption = 1 << 0 //UserReg带公钥的链路加密，见crypto.go
+	CapabilityRtp            = 1 << 1 //媒体payload为标准RTP
+	CapabilityAudioLevel     = 1 << 2 //音频包带音量，能处理ActiveSpeaker信令
+	CapabilityTraceContext   = 1 << 3 //能识别extra中的trace上下文
+	CapabilityProtoSignal    = 1 << 4 //信令可用protobuf编码
+	CapabilityCompression    = 1 << 5 //能处理gzip压缩和分片的信令
+	CapabilitySignalNack     = 1 << 6 //能处理session manager丢弃信令时回的Nack
+	CapabilityMtuProbe       = 1 << 7 //能回复MtuProbe，见mtu.go
+
+	RelayCapabilities = CapabilityLinkEncryption | CapabilityRtp | CapabilityAudioLevel | CapabilityTraceContext |
+		CapabilityProtoSignal | CapabilityCompression | CapabilitySignalNack | CapabilityMtuProbe
+)
+
+//消息extra中的能力位图，没有时返回0
+func CapabilitiesFromMessage(msg *Message) uint32 {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return 0
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeCapabilities)
+	if len(value) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(value)
+}
+
+//relay附在信令上的发送方公网ip，没有时返回nil
+func ClientIpFromMessage(msg *Message) net.IP {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return nil
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeClientIp)
+	if len(value) != net.IPv4len && len(value) != net.IPv6len {
+		return nil
+	}
+	return net.IP(append([]byte(nil), value...))
+}
+
+func SetClientIp(msg *Message, ip net.IP) {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	var extra []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+	}
+	msg.Extra = ReplaceExtra(extra, UdpMessageExtraTypeClientIp, ip)
+	msg.SetFlag(UdpMessageFlagExtra)
+}
+
+func SetCapabilities(msg *Message, capabilities uint32) {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, capabilities)
+
+	var extra []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+	}
+	msg.Extra = ReplaceExtra(extra, UdpMessageExtraTypeCapabilities, value)
+	msg.SetFlag(UdpMessageFlagExtra)
+}
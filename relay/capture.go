@@ -0,0 +1,171 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+/*
+抓包与重放：调试线上问题时，relay或session manager开启capture_file后把收到的混淆包原样写入文件，
+连同接收时间和来源地址，之后在本地用ReplayCapture按原始节奏喂回handlePacket复现。
+文件由连续的记录组成：time(8，unix纳秒) + addr长度(1) + addr + body长度(2) + body。
+只记录udp进来的包。抓包文件里是客户端的原始流量，注意保管。
+*/
+
+type PacketCapture struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+func NewPacketCapture(path string) (*PacketCapture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &PacketCapture{
+		file: file,
+		w:    bufio.NewWriterSize(file, 64*1024),
+	}
+	return c, nil
+}
+
+//写入缓冲，由调用方定期Flush
+func (c *PacketCapture) Write(packet *ReceivedPacket) error {
+	if packet.FromUdpAddr == nil {
+		return nil
+	}
+	addr := packet.FromUdpAddr.String()
+	if len(addr) > 255 || len(packet.Body) > 65535 {
+		return errors.New("packet too large to capture")
+	}
+	var header [11]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(packet.Time))
+	header[8] = byte(len(addr))
+	c.w.Write(header[0:9])
+	c.w.WriteString(addr)
+	binary.BigEndian.PutUint16(header[9:11], uint16(len(packet.Body)))
+	c.w.Write(header[9:11])
+	_, err := c.w.Write(packet.Body)
+	return err
+}
+
+func (c *PacketCapture) Flush() error {
+	return c.w.Flush()
+}
+
+func (c *PacketCapture) Close() error {
+	c.w.Flush()
+	return c.file.Close()
+}
+
+type CaptureReader struct {
+	file *os.File
+	r    *bufio.Reader
+}
+
+func OpenCapture(path string) (*CaptureReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &CaptureReader{
+		file: file,
+		r:    bufio.NewReader(file),
+	}
+	return r, nil
+}
+
+//读下一个包，Time为抓包时的接收时间，读完时返回io.EOF
+func (r *CaptureReader) Next() (*ReceivedPacket, error) {
+	var header [9]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return nil, err
+	}
+	addr := make([]byte, header[8])
+	if _, err := io.ReadFull(r.r, addr); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(r.r, size[:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	packet := &ReceivedPacket{
+		Body:        body,
+		FromUdpAddr: udpAddr,
+		Time:        int64(binary.BigEndian.Uint64(header[0:8])),
+	}
+	return packet, nil
+}
+
+func (r *CaptureReader) Close() error {
+	return r.file.Close()
+}
+
+//按抓包时的间隔把包交给handle，speed为倍速，<=0时不等待。交出的包Time改为重放时的时间。返回重放的包数
+func ReplayCapture(path string, speed float64, handle func(*ReceivedPacket)) (int, error) {
+	reader, err := OpenCapture(path)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	count := 0
+	var first int64
+	start := time.Now()
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if count == 0 {
+			first = packet.Time
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(packet.Time-first) / speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		packet.Time = time.Now().UnixNano()
+		handle(packet)
+		count++
+	}
+}
+
+//把抓包文件按原始节奏交给主循环处理，与从socket收到的包走同样的流程，需先Start。
+//每个包处理完才投递下一个，返回时所有包都已处理
+func (s *Service) Replay(path string, speed float64) (int, error) {
+	var loopErr error
+	count, err := ReplayCapture(path, speed, func(packet *ReceivedPacket) {
+		if loopErr == nil {
+			loopErr = s.runInLoop(func() { s.handlePacket(packet) })
+		}
+	})
+	if err == nil {
+		err = loopErr
+	}
+	return count, err
+}
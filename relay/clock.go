@@ -0,0 +1,139 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+时钟偏差：信令的Timestamp、指标和延迟统计都默认各方时钟同步，但手机和没配ntp的服务器常常差出几秒甚至几分钟。
+1. 注册时在UserReg的extra里带上UdpMessageExtraTypeClock，值为本地发送时间t0；
+   relay回复UserRegReceived时在同一extra里回带t0和relay收到的时间t1，请求没带时不回
+2. 收到回复的时间为t2，按NTP的方法估算：rtt = t2 - t0，offset = t1 - (t0+t2)/2，即relay时钟减本地时钟
+3. ClockSkew保留最近ClockSkewSamples个样本，取rtt最小的样本的offset，个别排队严重的样本不影响结果
+4. 偏差超过ClockSkewWarn时打告警，回到阈值内后恢复；Now()返回校正到relay时钟的时间，用于信令时间戳和延迟统计
+老relay不回带时间，没有样本时Now()就是本地时间。
+*/
+
+const (
+	ClockSkewSamples = 8
+	ClockSkewWarn    = 2 * time.Second
+)
+
+type clockSample struct {
+	offset time.Duration
+	rtt    time.Duration
+}
+
+//可以在任意goroutine里调用
+type ClockSkew struct {
+	name    string //日志用，对端的名字
+	lock    sync.Mutex
+	samples []clockSample
+	warned  bool
+}
+
+func NewClockSkew(name string) *ClockSkew {
+	return &ClockSkew{name: name}
+}
+
+//在注册消息的extra里带上发送时间
+func SetClockExtra(msg *Message, now time.Time) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(now.UnixNano()))
+
+	var extra []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+	}
+	msg.Extra = ReplaceExtra(extra, UdpMessageExtraTypeClock, value)
+	msg.SetFlag(UdpMessageFlagExtra)
+}
+
+//relay侧：请求带了发送时间时，在回复（即同一条消息）里追加relay收到的时间
+func echoClockExtra(msg *Message, received time.Time) {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return
+	}
+	sent := FindExtra(msg.Extra, UdpMessageExtraTypeClock)
+	if len(sent) != 8 {
+		return
+	}
+	value := make([]byte, 16)
+	copy(value, sent)
+	binary.BigEndian.PutUint64(value[8:], uint64(received.UnixNano()))
+	msg.Extra = ReplaceExtra(msg.Extra, UdpMessageExtraTypeClock, value)
+}
+
+//客户端侧：从UserRegReceived里取出一个样本，relay没有回带时间时返回false
+func (c *ClockSkew) Update(msg *Message, now time.Time) bool {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return false
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeClock)
+	if len(value) != 16 {
+		return false
+	}
+	t0 := int64(binary.BigEndian.Uint64(value[0:8]))
+	t1 := int64(binary.BigEndian.Uint64(value[8:16]))
+	t2 := now.UnixNano()
+	if t2 < t0 {
+		return false //不是本进程发出的，或者本地时钟被往回调了
+	}
+	sample := clockSample{
+		offset: time.Duration(t1 - t0 - (t2-t0)/2),
+		rtt:    time.Duration(t2 - t0),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.samples = append(c.samples, sample)
+	if len(c.samples) > ClockSkewSamples {
+		c.samples = c.samples[len(c.samples)-ClockSkewSamples:]
+	}
+	offset := c.offset()
+	if (offset > ClockSkewWarn || offset < -ClockSkewWarn) && !c.warned {
+		logging.Logger.Warn("clock of ", c.name, " is ", offset, " ahead of local clock, exceeds ", ClockSkewWarn, ", check ntp")
+		c.warned = true
+	} else if offset <= ClockSkewWarn && offset >= -ClockSkewWarn && c.warned {
+		logging.Logger.Info("clock skew to ", c.name, " back to ", offset)
+		c.warned = false
+	}
+	return true
+}
+
+//对端时钟减本地时钟，没有样本时为0
+func (c *ClockSkew) Offset() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.offset()
+}
+
+//调用方需持有锁
+func (c *ClockSkew) offset() time.Duration {
+	var best *clockSample
+	for i := range c.samples {
+		if best == nil || c.samples[i].rtt < best.rtt {
+			best = &c.samples[i]
+		}
+	}
+	if best == nil {
+		return 0
+	}
+	return best.offset
+}
+
+//校正到对端时钟的当前时间
+func (c *ClockSkew) Now() time.Time {
+	return time.Now().Add(c.Offset())
+}
@@ -0,0 +1,62 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+//模拟一次注册：客户端t0发出，relay在t0+up收到（relay时钟快skew），客户端在t0+up+down收到回复
+func clockRoundTrip(t *testing.T, c *ClockSkew, t0 time.Time, skew, up, down time.Duration) {
+	msg := NewMessage(UdpMessageTypeUserReg, 1001, 0, 0, nil, nil)
+	SetCapabilities(msg, 0)
+	SetClockExtra(msg, t0)
+	data := msg.ObfuscatedDataOfMessage()
+	received, err := NewMessageFromObfuscatedData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received.MsgType = UdpMessageTypeUserRegReceived
+	echoClockExtra(received, t0.Add(up+skew))
+	reply, err := NewMessageFromObfuscatedData(received.ObfuscatedDataOfMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Update(reply, t0.Add(up+down)) {
+		t.Fatal("no clock sample in reply")
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	c := NewClockSkew("relay")
+	if c.Offset() != 0 {
+		t.Errorf("offset without samples %v", c.Offset())
+	}
+	now := time.Now()
+	skew := 3 * time.Second
+	clockRoundTrip(t, c, now, skew, 10*time.Millisecond, 10*time.Millisecond)
+	if c.Offset() != skew {
+		t.Errorf("offset %v, want %v", c.Offset(), skew)
+	}
+	//单向排队严重的样本rtt大，不采用
+	clockRoundTrip(t, c, now.Add(time.Second), skew, 500*time.Millisecond, 10*time.Millisecond)
+	if c.Offset() != skew {
+		t.Errorf("offset after queued sample %v, want %v", c.Offset(), skew)
+	}
+	if d := c.Now().Sub(time.Now().Add(skew)); d > time.Second || d < -time.Second {
+		t.Errorf("corrected now off by %v", d)
+	}
+
+	//老relay不回带时间
+	old := NewMessage(UdpMessageTypeUserRegReceived, 1001, 0, 0, nil, nil)
+	SetCapabilities(old, RelayCapabilities)
+	if c.Update(old, now) {
+		t.Error("sample from reply without clock")
+	}
+}
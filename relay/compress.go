@@ -0,0 +1,67 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/xujiajundd/ycng/utils/errs"
+)
+
+/*
+信令payload压缩：人数多时MemberState的Info很大，超过阈值就gzip压缩，消息带UdpMessageFlagGZip。
+接收方需有CapabilityCompression，由发送方判断。
+*/
+
+const CompressThreshold = 512
+
+//payload超过阈值且压缩后确实变小时才压缩，返回是否压缩了
+func CompressSignal(msg *Message) bool {
+	if msg.HasFlag(UdpMessageFlagGZip) || len(msg.Payload) <= CompressThreshold {
+		return false
+	}
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if _, err := w.Write(msg.Payload); err != nil {
+		return false
+	}
+	if err := w.Close(); err != nil {
+		return false
+	}
+	if buf.Len() >= len(msg.Payload) {
+		return false
+	}
+	msg.Payload = buf.Bytes()
+	msg.SetFlag(UdpMessageFlagGZip)
+	return true
+}
+
+func DecompressSignal(msg *Message) error {
+	if !msg.HasFlag(UdpMessageFlagGZip) {
+		return nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(msg.Payload))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	//防止小包解压出巨大的payload
+	payload, err := ioutil.ReadAll(io.LimitReader(r, MaxSignalSize+1))
+	if err != nil {
+		return err
+	}
+	if len(payload) > MaxSignalSize {
+		return errs.New(errs.TooLarge, "decompressed signal too large")
+	}
+	msg.Payload = payload
+	msg.UnSetFlag(UdpMessageFlagGZip)
+	return nil
+}
@@ -8,19 +8,100 @@
 package relay
 
 import (
-	"github.com/urfave/cli"
 	"fmt"
+	"github.com/urfave/cli"
 )
 
 type Config struct {
-	Dir string `toml:"dir"`
-	UdpAddr string `toml:"udp_addr"`
+	Dir              string            `toml:"dir"`
+	UdpAddr          string            `toml:"udp_addr"`
+	UdpSockets       int               `toml:"udp_sockets"` //>1时用SO_REUSEPORT开多个socket并行收包
+	RecordDir        string            `toml:"record_dir"`
+	MixThreshold     int               `toml:"mix_threshold"`    //session人数超过此值时服务端混音，0为不混音
+	AllowPlaintext   bool              `toml:"allow_plaintext"`  //是否接受未做密钥协商的老客户端，见crypto.go
+	LinkSigningKey   string            `toml:"link_signing_key"` //base64的Ed25519种子，签名注册回复里的链路公钥，为空时不签名
+	AccessSecret     string            `toml:"access_secret"`    //与session manager共享的token签名secret，为空时不校验
+	AdminAddr        string            `toml:"admin_addr"`       //管理接口监听地址，为空时不启动
+	BlocklistFile    string            `toml:"blocklist_file"`   //黑名单持久化文件，store为空时使用
+	Store            string            `toml:"store"`            //存储的url，见storage.go的OpenStore，为空时只把黑名单存到blocklist_file
+	RateLimit        int               `toml:"rate_limit"`       //每个来源ip每秒最多处理的包数，0为不限
+	LogDir           string            `toml:"log_dir"`
+	LogFormat        string            `toml:"log_format"`         //text或json
+	LogRotationSize  int64             `toml:"log_rotation_size"`  //单个日志文件的最大字节数，0为只按天切分
+	LogLevels        map[string]string `toml:"log_levels"`         //模块名->级别，""为全局
+	OtlpEndpoint     string            `toml:"otlp_endpoint"`      //OpenTelemetry collector地址，为空时不导出
+	TraceSampleRatio float64           `toml:"trace_sample_ratio"` //没有上游trace时的采样比例
+	CaptureFile      string            `toml:"capture_file"`       //调试用，不为空时把收到的包都写入此文件，见capture.go
+	AuditFile        string            `toml:"audit_file"`         //审计日志文件，为空时只保留在内存里，见audit.go
+	ObfuscationKeys  []string          `toml:"obfuscation_keys"`   //混淆密钥"id:secret"，最后一个为当前密钥，为空时用内置字典，见obfkey.go
+	ObfuscationGrace int               `toml:"obfuscation_grace"`  //启动后多少秒内仍接受并使用前一个密钥
+	MetricsExport    string            `toml:"metrics_export"`     //媒体质量指标导出的地址，influx://或prom://，为空时不导出，见metrics_export.go
+	MaxDatagram      int               `toml:"max_datagram"`       //收发的UDP包最大字节数，超过的丢弃，0为不限制，见mtu.go
+	UdpOffload       bool              `toml:"udp_offload"`        //Linux上用sendmmsg、GSO和GRO批量收发，见gso_linux.go
+	WatchdogTimeout  int               `toml:"watchdog_timeout"`   //主循环或收包goroutine处理一项超过这么多秒时打出所有goroutine的栈，0为不检查
+	WatchdogExit     bool              `toml:"watchdog_exit"`      //卡住时退出进程，由systemd等重启
 }
 
+const DefaultWatchdogTimeout = 30
+
 func GetConfig(ctx *cli.Context) *Config {
 	config := GetDefaultConfig()
-    if ctx.GlobalIsSet("port") {
-    	config.UdpAddr = fmt.Sprintf(":%d", ctx.GlobalInt("port"))
+	if ctx.GlobalIsSet("port") {
+		config.UdpAddr = fmt.Sprintf(":%d", ctx.GlobalInt("port"))
+	}
+	if ctx.GlobalIsSet("udp_sockets") {
+		config.UdpSockets = ctx.GlobalInt("udp_sockets")
+	}
+	if ctx.GlobalIsSet("admin_addr") {
+		config.AdminAddr = ctx.GlobalString("admin_addr")
+	}
+	if ctx.GlobalIsSet("log_format") {
+		config.LogFormat = ctx.GlobalString("log_format")
+	}
+	if ctx.GlobalIsSet("log_level") {
+		config.LogLevels[""] = ctx.GlobalString("log_level")
+	}
+	if ctx.GlobalIsSet("otlp_endpoint") {
+		config.OtlpEndpoint = ctx.GlobalString("otlp_endpoint")
+	}
+	if ctx.GlobalIsSet("access_secret") {
+		config.AccessSecret = ctx.GlobalString("access_secret")
+	}
+	if ctx.GlobalIsSet("allow_plaintext") {
+		config.AllowPlaintext = ctx.GlobalBool("allow_plaintext")
+	}
+	if ctx.GlobalIsSet("link_signing_key") {
+		config.LinkSigningKey = ctx.GlobalString("link_signing_key")
+	}
+	if ctx.GlobalIsSet("store") {
+		config.Store = ctx.GlobalString("store")
+	}
+	if ctx.GlobalIsSet("capture_file") {
+		config.CaptureFile = ctx.GlobalString("capture_file")
+	}
+	if ctx.GlobalIsSet("audit_file") {
+		config.AuditFile = ctx.GlobalString("audit_file")
+	}
+	if ctx.GlobalIsSet("obfuscation_keys") {
+		config.ObfuscationKeys = ctx.GlobalStringSlice("obfuscation_keys")
+	}
+	if ctx.GlobalIsSet("obfuscation_grace") {
+		config.ObfuscationGrace = ctx.GlobalInt("obfuscation_grace")
+	}
+	if ctx.GlobalIsSet("metrics_export") {
+		config.MetricsExport = ctx.GlobalString("metrics_export")
+	}
+	if ctx.GlobalIsSet("max_datagram") {
+		config.MaxDatagram = ctx.GlobalInt("max_datagram")
+	}
+	if ctx.GlobalIsSet("udp_offload") {
+		config.UdpOffload = ctx.GlobalBool("udp_offload")
+	}
+	if ctx.GlobalIsSet("watchdog_timeout") {
+		config.WatchdogTimeout = ctx.GlobalInt("watchdog_timeout")
+	}
+	if ctx.GlobalIsSet("watchdog_exit") {
+		config.WatchdogExit = ctx.GlobalBool("watchdog_exit")
 	}
 	return config
 }
@@ -29,8 +110,20 @@ func GetDefaultConfig() *Config {
 	var config *Config
 
 	config = &Config{
-		Dir: "",
-		UdpAddr:":19001",
+		Dir:              "",
+		UdpAddr:          ":19001",
+		UdpSockets:       1,
+		RecordDir:        "./record",
+		AllowPlaintext:   false,
+		BlocklistFile:    "./blocklist.json",
+		RateLimit:        3000,
+		LogDir:           "./log",
+		LogFormat:        "text",
+		LogLevels:        map[string]string{"": "info"},
+		TraceSampleRatio: 0.01,
+		MaxDatagram:      DefaultMaxDatagram,
+		UdpOffload:       true,
+		WatchdogTimeout:  DefaultWatchdogTimeout,
 	}
 	return config
 }
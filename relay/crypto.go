@@ -0,0 +1,261 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/errs"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+客户端与relay之间的链路加密，密钥协商在注册时进行，并和access token绑定：
+1. 客户端在UserReg的payload里access token（relay开了接入控制时才有）之后带上自己的X25519临时公钥。
+   relay先校验token，通过后才为这个链路生成一对临时密钥，UserRegReceived的payload为relay公钥，
+   配置了link_signing_key时后面再带Ed25519签名，签的是uid+客户端公钥+relay公钥。客户端用预先分发的
+   relay签名公钥验证（VerifyLinkAck），路径上的中间人不能冒充relay。双方用ECDH结果经HKDF得到链路密钥
+2. 链路密钥按udp地址保存并记下注册的uid，只有token校验通过的UserReg才会建立或替换链路，伪造来源地址的包
+   没有对方的token就换不掉他的密钥。secret为空时没有这个保证，只防被动窃听
+3. 之后客户端发出的消息置UdpMessageFlagEncrypted，payload和extra一起用XChaCha20-Poly1305加密，
+   消息类型、from、to作为附加数据参与认证，from必须是注册链路的uid；header本身仍然只做混淆，relay照常路由
+4. relay转发时用接收方链路的密钥重新加密。重新注册时带新的公钥即换新的链路密钥（rekey），不带公钥时保留原来的链路
+5. allow_plaintext默认关闭，此时只有UserReg、session manager的消息和ProbeUid的探测包可以是明文；
+   还没做链路加密的老客户端，以及bot、sip网关、webrtc桥和压测客户端，需要relay开启allow_plaintext
+6. 单独的KeyExchange消息已废弃（不认证身份，并且在注册前就按来源地址保存密钥），收到后丢弃
+*/
+
+const (
+	LinkKeySize       = 32
+	LinkSignatureSize = ed25519.SignatureSize
+	LinkIdleTimeout   = 5 * time.Minute
+
+	linkSignContext = "ycng relay link ack"
+)
+
+var (
+	errKeyExchangeDeprecated = errs.New(errs.Rejected, "standalone key exchange is deprecated, send the public key in user reg")
+	errLinkAckSize           = errs.New(errs.Crypto, "incorrect link ack size")
+	errLinkAckSignature      = errs.New(errs.Crypto, "link ack signature mismatch")
+)
+
+type Link struct {
+	aead           cipher.AEAD
+	Uid            int64 //注册这个链路的uid，加密消息的from必须是它
+	LastActiveTime time.Time
+}
+
+//allow_plaintext关闭时仍可以是明文的消息：session manager是服务端之间的通信，
+//UserReg用来协商链路密钥，拨测和NAT探测不带用户数据
+func plaintextAllowed(msg *Message) bool {
+	if msg.From == SessionManagerUid {
+		return true
+	}
+	switch msg.MsgType {
+	case UdpMessageTypeUserReg:
+		return true
+	case UdpMessageTypeNetProbe, UdpMessageTypeNetProbeEnd, UdpMessageTypeKeepaliveProbe:
+		return msg.From == ProbeUid
+	}
+	return false
+}
+
+//UserReg的payload为[access token][客户端公钥]，两者都可以没有，按长度区分
+func SplitUserRegPayload(payload []byte) (token []byte, pub []byte) {
+	switch len(payload) {
+	case LinkKeySize, AccessTokenSize + LinkKeySize:
+		n := len(payload) - LinkKeySize
+		return payload[:n], payload[n:]
+	}
+	return payload, nil
+}
+
+//客户端侧：token为nil时relay不做接入控制，pub为nil时不做链路加密
+func UserRegPayload(token []byte, pub []byte) []byte {
+	payload := make([]byte, 0, len(token)+len(pub))
+	payload = append(payload, token...)
+	return append(payload, pub...)
+}
+
+//link_signing_key为base64的32字节Ed25519种子，为空时返回nil，不签名
+func ParseLinkSigningKey(text string) (ed25519.PrivateKey, error) {
+	if text == "" {
+		return nil, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errs.New(errs.Crypto, "incorrect link signing key size")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func linkSignedData(uid int64, clientPub []byte, relayPub []byte) []byte {
+	data := make([]byte, 0, len(linkSignContext)+8+2*LinkKeySize)
+	data = append(data, linkSignContext...)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(uid))
+	data = append(data, b[:]...)
+	data = append(data, clientPub...)
+	return append(data, relayPub...)
+}
+
+//relay侧：UserRegReceived的payload，signKey为nil时只有relay公钥
+func LinkAckPayload(signKey ed25519.PrivateKey, uid int64, clientPub []byte, relayPub []byte) []byte {
+	if signKey == nil {
+		return relayPub
+	}
+	payload := make([]byte, 0, LinkKeySize+LinkSignatureSize)
+	payload = append(payload, relayPub...)
+	return append(payload, ed25519.Sign(signKey, linkSignedData(uid, clientPub, relayPub))...)
+}
+
+//客户端侧：从UserRegReceived的payload取出relay公钥。relayKey为relay的签名公钥，
+//为nil时不验证签名，只能防被动窃听
+func VerifyLinkAck(relayKey ed25519.PublicKey, uid int64, clientPub []byte, payload []byte) ([]byte, error) {
+	if len(payload) != LinkKeySize && len(payload) != LinkKeySize+LinkSignatureSize {
+		return nil, errLinkAckSize
+	}
+	relayPub := payload[:LinkKeySize]
+	if relayKey == nil {
+		return relayPub, nil
+	}
+	if len(payload) != LinkKeySize+LinkSignatureSize || !ed25519.Verify(relayKey, linkSignedData(uid, clientPub, relayPub), payload[LinkKeySize:]) {
+		return nil, errLinkAckSignature
+	}
+	return relayPub, nil
+}
+
+//relay侧：根据客户端公钥生成本链路的密钥，返回relay公钥用于回复
+func NewLinkFromPeerKey(peerPub []byte) (link *Link, pub []byte, err error) {
+	if len(peerPub) != LinkKeySize {
+		return nil, nil, errs.New(errs.Crypto, "incorrect public key size")
+	}
+	priv, pub, err := GenerateLinkKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	link, err = newLink(shared, peerPub, pub)
+	return link, pub, err
+}
+
+//客户端侧：收到UserRegReceived并用VerifyLinkAck取出relay公钥后，用自己的密钥对得到链路密钥
+func NewLinkFromAck(priv []byte, pub []byte, relayPub []byte) (*Link, error) {
+	if len(relayPub) != LinkKeySize {
+		return nil, errs.New(errs.Crypto, "incorrect public key size")
+	}
+	shared, err := curve25519.X25519(priv, relayPub)
+	if err != nil {
+		return nil, err
+	}
+	return newLink(shared, pub, relayPub)
+}
+
+func GenerateLinkKeyPair() (priv []byte, pub []byte, err error) {
+	priv = make([]byte, LinkKeySize)
+	if _, err = io.ReadFull(rand.Reader, priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+//salt为客户端公钥+relay公钥，双方顺序一致
+func newLink(shared []byte, clientPub []byte, relayPub []byte) (*Link, error) {
+	salt := make([]byte, 0, 2*LinkKeySize)
+	salt = append(salt, clientPub...)
+	salt = append(salt, relayPub...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("ycng relay link")), key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	link := &Link{
+		aead:           aead,
+		LastActiveTime: time.Now(),
+	}
+	return link, nil
+}
+
+func linkAdditionalData(msg *Message) []byte {
+	ad := make([]byte, 17)
+	ad[0] = msg.MsgType
+	binary.BigEndian.PutUint64(ad[1:9], uint64(msg.From))
+	binary.BigEndian.PutUint64(ad[9:17], uint64(msg.To))
+	return ad
+}
+
+//返回加密后的新消息，msg本身不变，因为同一个msg可能要发给多个接收方
+func (l *Link) Seal(msg *Message) (*Message, error) {
+	plain := make([]byte, 2+len(msg.Payload)+len(msg.Extra))
+	binary.BigEndian.PutUint16(plain[0:2], uint16(len(msg.Payload)))
+	copy(plain[2:], msg.Payload)
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		copy(plain[2+len(msg.Payload):], msg.Extra)
+	} else {
+		plain = plain[:2+len(msg.Payload)]
+	}
+
+	nonce := make([]byte, l.aead.NonceSize(), l.aead.NonceSize()+len(plain)+l.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := *msg
+	sealed.Payload = l.aead.Seal(nonce, nonce, plain, linkAdditionalData(msg))
+	sealed.Extra = nil
+	sealed.Flags = (msg.Flags &^ UdpMessageFlagExtra) | UdpMessageFlagEncrypted
+	return &sealed, nil
+}
+
+//原地解密msg
+func (l *Link) Open(msg *Message) error {
+	nonceSize := l.aead.NonceSize()
+	if len(msg.Payload) < nonceSize+l.aead.Overhead() {
+		return errs.New(errs.Crypto, "incorrect encrypted payload size")
+	}
+	plain, err := l.aead.Open(nil, msg.Payload[:nonceSize], msg.Payload[nonceSize:], linkAdditionalData(msg))
+	if err != nil {
+		return err
+	}
+	payloadLen := int(binary.BigEndian.Uint16(plain[0:2]))
+	if 2+payloadLen > len(plain) {
+		return errs.New(errs.Crypto, "incorrect encrypted payload len")
+	}
+
+	msg.Payload = plain[2 : 2+payloadLen]
+	msg.Flags &^= UdpMessageFlagEncrypted
+	if len(plain) > 2+payloadLen {
+		msg.Extra = plain[2+payloadLen:]
+		msg.Flags |= UdpMessageFlagExtra
+	}
+	l.LastActiveTime = time.Now()
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+)
+
+//客户端和relay各自得到的链路
+func newTestLinks(t *testing.T) (client *Link, relay *Link) {
+	priv, pub, err := GenerateLinkKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, relayPub, err := NewLinkFromPeerKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewLinkFromAck(priv, pub, relayPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, relay
+}
+
+func TestLinkRoundTrip(t *testing.T) {
+	client, relay := newTestLinks(t)
+	msg := NewMessage(UdpMessageTypeAudioStream, 1001, 42, 0, []byte("payload"), []byte("extra"))
+	sealed, err := client.Seal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sealed.HasFlag(UdpMessageFlagEncrypted) || string(sealed.Payload) == "payload" {
+		t.Fatalf("message not sealed: %v", sealed.Payload)
+	}
+	if err := relay.Open(sealed); err != nil {
+		t.Fatal(err)
+	}
+	if string(sealed.Payload) != "payload" || string(sealed.Extra) != "extra" || sealed.HasFlag(UdpMessageFlagEncrypted) {
+		t.Errorf("opened %q %q flags %d", sealed.Payload, sealed.Extra, sealed.Flags)
+	}
+}
+
+func TestLinkTamper(t *testing.T) {
+	client, relay := newTestLinks(t)
+	msg := NewMessage(UdpMessageTypeAudioStream, 1001, 42, 0, []byte("payload"), nil)
+
+	sealed, _ := client.Seal(msg)
+	sealed.Payload[len(sealed.Payload)-1] ^= 1
+	if err := relay.Open(sealed); err == nil {
+		t.Error("tampered payload opened")
+	}
+
+	//header作为附加数据参与认证
+	sealed, _ = client.Seal(msg)
+	sealed.From = 1002
+	if err := relay.Open(sealed); err == nil {
+		t.Error("message with changed from opened")
+	}
+
+	sealed, _ = client.Seal(msg)
+	sealed.Payload = sealed.Payload[:10]
+	if err := relay.Open(sealed); err == nil {
+		t.Error("truncated payload opened")
+	}
+}
+
+func TestLinkRekey(t *testing.T) {
+	client, relay := newTestLinks(t)
+	newClient, newRelay := newTestLinks(t)
+	msg := NewMessage(UdpMessageTypeAudioStream, 1001, 42, 0, []byte("payload"), nil)
+
+	sealed, _ := client.Seal(msg)
+	if err := newRelay.Open(sealed); err == nil {
+		t.Error("old link message opened with the new key")
+	}
+	sealed, _ = newClient.Seal(msg)
+	if err := relay.Open(sealed); err == nil {
+		t.Error("new link message opened with the old key")
+	}
+	if err := newRelay.Open(sealed); err != nil {
+		t.Errorf("new link: %v", err)
+	}
+}
+
+func TestLinkAckSignature(t *testing.T) {
+	signKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	relayKey := signKey.Public().(ed25519.PublicKey)
+	clientPub := make([]byte, LinkKeySize)
+	relayPub := make([]byte, LinkKeySize)
+	relayPub[0] = 1
+
+	payload := LinkAckPayload(signKey, 1001, clientPub, relayPub)
+	if got, err := VerifyLinkAck(relayKey, 1001, clientPub, payload); err != nil || got[0] != 1 {
+		t.Fatalf("verify %v %v", got, err)
+	}
+	if _, err := VerifyLinkAck(relayKey, 1002, clientPub, payload); err != errLinkAckSignature {
+		t.Errorf("ack for another uid: %v", err)
+	}
+	payload[0] ^= 1 //中间人换了relay公钥
+	if _, err := VerifyLinkAck(relayKey, 1001, clientPub, payload); err != errLinkAckSignature {
+		t.Errorf("replaced relay key: %v", err)
+	}
+	if _, err := VerifyLinkAck(relayKey, 1001, clientPub, relayPub); err != errLinkAckSignature {
+		t.Errorf("unsigned ack: %v", err)
+	}
+	if _, err := VerifyLinkAck(nil, 1001, clientPub, relayPub); err != nil {
+		t.Errorf("unsigned ack without relay key: %v", err)
+	}
+}
+
+func TestServiceLinkBoundToToken(t *testing.T) {
+	config := GetDefaultConfig()
+	config.AccessSecret = "secret"
+	s := NewService(config)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	now := time.Now()
+	token := IssueAccessToken(config.AccessSecret, 1001, now.Add(time.Hour))
+
+	register := func(uid int64, token []byte) (*Message, []byte) {
+		priv, pub, _ := GenerateLinkKeyPair()
+		reg := NewMessage(UdpMessageTypeUserReg, uid, 0, 0, UserRegPayload(token, pub), nil)
+		s.handleMessageUserReg(reg, &ReceivedPacket{FromUdpAddr: addr, Time: now.UnixNano()})
+		if reg.MsgType != UdpMessageTypeUserRegReceived {
+			return nil, nil
+		}
+		relayPub, err := VerifyLinkAck(nil, uid, pub, reg.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link, _ := NewLinkFromAck(priv, pub, relayPub)
+		sealed, _ := link.Seal(NewMessage(UdpMessageTypeAudioStream, uid, 42, 0, []byte("payload"), nil))
+		return sealed, pub
+	}
+
+	sealed, _ := register(1001, token)
+	if sealed == nil || s.links[addr.String()] == nil || s.links[addr.String()].Uid != 1001 {
+		t.Fatalf("link not set after user reg")
+	}
+	if !s.openMessage(sealed, &ReceivedPacket{FromUdpAddr: addr}) {
+		t.Fatal("message on registered link dropped")
+	}
+
+	//从同一地址伪造的注册没有受害者的token，换不掉链路
+	victim := s.links[addr.String()]
+	if forged, _ := register(1001, make([]byte, AccessTokenSize)); forged != nil || s.links[addr.String()] != victim {
+		t.Error("link replaced without a valid token")
+	}
+	if forged, _ := register(1002, IssueAccessToken(config.AccessSecret, 1002, now.Add(-time.Minute))); forged != nil || s.links[addr.String()] != victim {
+		t.Error("link replaced with an expired token")
+	}
+
+	//链路只认注册它的uid
+	other, _ := newTestLinks(t)
+	spoofed, _ := other.Seal(NewMessage(UdpMessageTypeAudioStream, 1002, 42, 0, nil, nil))
+	if s.openMessage(spoofed, &ReceivedPacket{FromUdpAddr: addr}) {
+		t.Error("message from another uid accepted on the link")
+	}
+
+	//带新公钥重新注册即换新的链路密钥
+	if rekeyed, _ := register(1001, token); rekeyed == nil || s.links[addr.String()] == victim {
+		t.Fatal("link not rekeyed")
+	} else if !s.openMessage(rekeyed, &ReceivedPacket{FromUdpAddr: addr}) {
+		t.Error("message after rekey dropped")
+	}
+}
+
+func TestServiceRejectsPlaintext(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+
+	reg := NewMessage(UdpMessageTypeUserReg, 1001, 0, 0, nil, nil)
+	s.handleMessageUserReg(reg, &ReceivedPacket{FromUdpAddr: addr, Time: time.Now().UnixNano()})
+	if reg.MsgType == UdpMessageTypeUserRegReceived || s.users[1001] != nil {
+		t.Error("plaintext user reg accepted")
+	}
+	if s.openMessage(NewMessage(UdpMessageTypeAudioStream, 1001, 42, 0, nil, nil), &ReceivedPacket{FromUdpAddr: addr}) {
+		t.Error("plaintext message accepted")
+	}
+	if !s.openMessage(NewMessage(UdpMessageTypeUserSignal, SessionManagerUid, 42, 0, nil, nil), &ReceivedPacket{FromUdpAddr: addr}) {
+		t.Error("plaintext session manager message dropped")
+	}
+	if !s.openMessage(NewMessage(UdpMessageTypeNetProbe, ProbeUid, 0, 0, nil, nil), &ReceivedPacket{FromUdpAddr: addr}) {
+		t.Error("plaintext net probe dropped")
+	}
+}
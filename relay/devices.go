@@ -0,0 +1,117 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"time"
+)
+
+/*
+多设备：同一uid可以同时在手机和电脑上登录。
+1. 客户端在UserReg和发出的信令的extra里带上设备id（UdpMessageExtraTypeDevice），老客户端不带，按设备id为""处理
+2. relay按设备记下地址。发给uid的信令默认送到他在本relay上的所有设备，所以Invite会让所有设备响铃
+3. session manager发出的信令可以在extra里指定设备，relay只送到该设备，设备不在本relay上就不送
+   （session manager经所有relay发送，总有一个relay有这个设备）。客户端发出的信令里的设备id是发送方的，不用于路由
+4. 设备和用户一样，不活跃DeviceIdleTimeout后删除；每个uid最多MaxUserDevices个设备，超出时删除最久不活跃的
+*/
+
+const (
+	MaxDeviceIdLen    = 64
+	MaxUserDevices    = 8
+	DeviceIdleTimeout = 600 * time.Second
+)
+
+type Device struct {
+	Id             string
+	UdpAddr        *net.UDPAddr
+	LastActiveTime time.Time
+	Network        NetworkInfo //最近一次注册带的设备和网络类型，见network.go
+}
+
+//消息extra中的设备id，没有时返回""
+func DeviceFromMessage(msg *Message) string {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return ""
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeDevice)
+	if len(value) > MaxDeviceIdLen {
+		return ""
+	}
+	return string(value)
+}
+
+func SetDevice(msg *Message, device string) {
+	var extra []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+	}
+	msg.Extra = ReplaceExtra(extra, UdpMessageExtraTypeDevice, []byte(device))
+	msg.SetFlag(UdpMessageFlagExtra)
+}
+
+//记下设备的最新地址
+func (u *User) updateDevice(id string, addr *net.UDPAddr, now time.Time) {
+	d := u.Devices[id]
+	if d == nil {
+		if len(u.Devices) >= MaxUserDevices {
+			u.removeIdlestDevice()
+		}
+		d = &Device{Id: id}
+		u.Devices[id] = d
+	}
+	d.UdpAddr = addr
+	d.LastActiveTime = now
+}
+
+func (u *User) removeIdlestDevice() {
+	var idlest *Device
+	for _, d := range u.Devices {
+		if idlest == nil || d.LastActiveTime.Before(idlest.LastActiveTime) {
+			idlest = d
+		}
+	}
+	if idlest != nil {
+		delete(u.Devices, idlest.Id)
+	}
+}
+
+//删除不活跃的设备，返回它们的地址
+func (u *User) expireDevices(now time.Time) []*net.UDPAddr {
+	var expired []*net.UDPAddr
+	for id, d := range u.Devices {
+		if now.Sub(d.LastActiveTime) > DeviceIdleTimeout {
+			delete(u.Devices, id)
+			expired = append(expired, d.UdpAddr)
+		}
+	}
+	return expired
+}
+
+//信令要送达的地址，device为""时送到所有设备
+func (u *User) signalAddrs(device string) []*net.UDPAddr {
+	if device != "" {
+		if d := u.Devices[device]; d != nil {
+			return []*net.UDPAddr{d.UdpAddr}
+		}
+		return nil
+	}
+	if len(u.Devices) == 0 {
+		return []*net.UDPAddr{u.UdpAddr}
+	}
+	addrs := make([]*net.UDPAddr, 0, len(u.Devices))
+	seen := make(map[string]bool, len(u.Devices))
+	for _, d := range u.Devices {
+		key := d.UdpAddr.String()
+		if !seen[key] {
+			seen[key] = true
+			addrs = append(addrs, d.UdpAddr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,67 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeviceExtra(t *testing.T) {
+	msg := NewMessage(UdpMessageTypeUserSignal, 1001, 1002, 0, []byte("{}"), nil)
+	if DeviceFromMessage(msg) != "" {
+		t.Error("device of message without extra")
+	}
+	SetDevice(msg, "phone")
+	SetDevice(msg, "desktop")
+	got, err := NewMessageFromObfuscatedData(msg.ObfuscatedDataOfMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device := DeviceFromMessage(got); device != "desktop" {
+		t.Errorf("device = %q, want desktop", device)
+	}
+}
+
+func TestUserDevices(t *testing.T) {
+	now := time.Now()
+	phone := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 20001}
+	desktop := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 20002}
+	user := NewUser(1001)
+	user.UdpAddr = desktop
+
+	//老客户端没有设备记录，送到最近的地址
+	if addrs := user.signalAddrs(""); len(addrs) != 1 || addrs[0] != desktop {
+		t.Errorf("legacy addrs = %v", addrs)
+	}
+
+	user.updateDevice("phone", phone, now.Add(-DeviceIdleTimeout))
+	user.updateDevice("desktop", desktop, now)
+	if addrs := user.signalAddrs(""); len(addrs) != 2 {
+		t.Errorf("ring addrs = %v, want both devices", addrs)
+	}
+	if addrs := user.signalAddrs("phone"); len(addrs) != 1 || addrs[0] != phone {
+		t.Errorf("targeted addrs = %v, want phone", addrs)
+	}
+	if addrs := user.signalAddrs("tablet"); len(addrs) != 0 {
+		t.Errorf("unknown device addrs = %v", addrs)
+	}
+
+	expired := user.expireDevices(now.Add(time.Second))
+	if len(expired) != 1 || expired[0] != phone || user.Devices["phone"] != nil {
+		t.Errorf("expired = %v, devices = %v", expired, user.Devices)
+	}
+
+	for i := 0; i < MaxUserDevices+2; i++ {
+		user.updateDevice(string(rune('a'+i)), phone, now.Add(time.Duration(i)*time.Second))
+	}
+	if len(user.Devices) != MaxUserDevices || user.Devices["desktop"] != nil || user.Devices["a"] != nil {
+		t.Errorf("idlest devices not removed: %d devices", len(user.Devices))
+	}
+}
@@ -0,0 +1,45 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+/*
+排空：滚动发布前通过管理接口POST /drain（或relay drain命令）让relay进入排空状态
+1. 不再接受新用户的UserReg和新session的TurnReg/setup，已有session的媒体照常转发，已注册用户照常续注册
+2. 通过UdpMessageTypeRelayDrain(payload 1字节，1排空/0恢复)通知session manager，它不再把这个relay下发给客户端；
+   排空期间session manager每次重新注册都会再收到一次，session manager重启后也能知道
+3. 状态里的sessions降到0即可安全停掉relay
+*/
+
+const (
+	RelayDrainOff = 0
+	RelayDrainOn  = 1
+)
+
+func (s *Service) SetDraining(draining bool) error {
+	return s.runInLoop(func() {
+		if s.draining == draining {
+			return
+		}
+		s.draining = draining
+		s.log().Warn("relay draining:", draining, " sessions:", len(s.sessions))
+		s.notifyDraining()
+	})
+}
+
+func (s *Service) notifyDraining() {
+	user := s.users[SessionManagerUid]
+	if user == nil || user.UdpAddr == nil {
+		return
+	}
+	state := byte(RelayDrainOff)
+	if s.draining {
+		state = RelayDrainOn
+	}
+	msg := NewMessage(UdpMessageTypeRelayDrain, SessionManagerUid, 0, 0, []byte{state}, nil)
+	s.sendMessage(msg, user.UdpAddr)
+}
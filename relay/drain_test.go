@@ -0,0 +1,44 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDrainRejectsNewUsersAndSessions(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	s.draining = true
+	packet := &ReceivedPacket{FromUdpAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}}
+
+	s.handleMessageUserReg(NewMessage(UdpMessageTypeUserReg, 1001, 0, 0, nil, nil), packet)
+	if s.users[1001] != nil {
+		t.Error("new user registered when draining")
+	}
+
+	s.handleMessageTurnReg(NewMessage(UdpMessageTypeTurnReg, 1001, 42, 0, nil, nil), packet)
+	if s.sessions[42] != nil {
+		t.Error("new session created when draining")
+	}
+
+	setup := &SessionControl{Op: SessionControlSetup, Media: MediaAll, Members: []int64{1001}}
+	s.handleMessageSessionControl(NewMessage(UdpMessageTypeSessionControl, SessionManagerUid, 43, 0, setup.Marshal(), nil), packet)
+	if s.sessions[43] != nil {
+		t.Error("new session setup when draining")
+	}
+
+	//已有session照常受控
+	session := NewSession(44)
+	session.Participants = make(map[int64]*Participant)
+	s.sessions[44] = session
+	s.handleMessageSessionControl(NewMessage(UdpMessageTypeSessionControl, SessionManagerUid, 44, 0, setup.Marshal(), nil), packet)
+	if !session.Controlled {
+		t.Error("existing session not setup when draining")
+	}
+}
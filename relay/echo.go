@@ -0,0 +1,96 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+回环测试：客户端开发时不用第二台设备，让relay把自己发的媒体原样发回来，抖动缓冲和带宽估计测的是真实的relay路径。
+1. 客户端发Echo，payload为2字节的秒数，relay回EchoAck，payload为实际生效的秒数，不超过EchoMaxDuration；
+   秒数为0时停止，回环的地址已满时回0
+2. 生效期间从这个地址收到的媒体包（音视频、数据、RTCP）不再按session转发，原样发回这个地址，
+   To可以是任意sid，不需要TurnReg
+3. 到时自动停止。开了access控制时和NetProbe一样，只接受已注册用户
+回环的包照常计入转发字节。
+*/
+
+const (
+	EchoMaxDuration = 60 * time.Second
+	EchoMaxClients  = 100 //同时回环的地址数
+)
+
+func (s *Service) handleMessageEcho(msg *Message, packet *ReceivedPacket) {
+	if s.config.AccessSecret != "" && s.users[msg.From] == nil {
+		return
+	}
+	if len(msg.Payload) != 2 {
+		return
+	}
+	key := packet.FromUdpAddr.String()
+	duration := s.startEcho(key, time.Duration(binary.BigEndian.Uint16(msg.Payload))*time.Second, time.Unix(0, packet.Time))
+	s.log().Info("echo for ", msg.From, "<", key, "> ", duration)
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(duration/time.Second))
+	ack := NewMessage(UdpMessageTypeEchoAck, msg.From, msg.To, 0, payload, nil)
+	ack.Tid = msg.Tid
+	s.sendMessage(ack, packet.FromUdpAddr)
+}
+
+//开始或停止key的回环，返回实际生效的时长
+func (s *Service) startEcho(key string, duration time.Duration, now time.Time) time.Duration {
+	if duration > EchoMaxDuration {
+		duration = EchoMaxDuration
+	}
+	if duration == 0 {
+		delete(s.echoes, key)
+		return 0
+	}
+	if _, ok := s.echoes[key]; !ok && len(s.echoes) >= EchoMaxClients {
+		s.log().Warn("too many echo clients, echo for <", key, "> rejected")
+		return 0
+	}
+	s.echoes[key] = now.Add(duration)
+	return duration
+}
+
+func (s *Service) echoing(key string, now time.Time) bool {
+	until, ok := s.echoes[key]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(s.echoes, key)
+		return false
+	}
+	return true
+}
+
+//回环中的地址发来的媒体包直接发回去，返回true表示已处理
+func (s *Service) echo(msg *Message, packet *ReceivedPacket) bool {
+	if len(s.echoes) == 0 || !isHoldableMessage(msg.MsgType) || packet.FromUdpAddr == nil {
+		return false
+	}
+	if !s.echoing(packet.FromUdpAddr.String(), time.Unix(0, packet.Time)) {
+		return false
+	}
+	s.countRelayedBytes(msg, packet)
+	s.sendMessage(msg, packet.FromUdpAddr)
+	return true
+}
+
+func (s *Service) expireEchoes(now time.Time) {
+	for key, until := range s.echoes {
+		if now.After(until) {
+			delete(s.echoes, key)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEcho(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	now := time.Now()
+	const key = "127.0.0.1:20001"
+
+	if got := s.startEcho(key, 10*time.Minute, now); got != EchoMaxDuration {
+		t.Errorf("echo duration = %v, want %v", got, EchoMaxDuration)
+	}
+	if !s.echoing(key, now.Add(EchoMaxDuration/2)) {
+		t.Error("not echoing within duration")
+	}
+	if s.echoing(key, now.Add(EchoMaxDuration+time.Second)) {
+		t.Error("still echoing after duration")
+	}
+	if len(s.echoes) != 0 {
+		t.Error("expired echo not removed")
+	}
+
+	s.startEcho(key, 5*time.Second, now)
+	if got := s.startEcho(key, 0, now); got != 0 || s.echoing(key, now) {
+		t.Error("echo not stopped")
+	}
+
+	for i := 0; i < EchoMaxClients; i++ {
+		s.startEcho(fmt.Sprintf("10.0.0.1:%d", 10000+i), 5*time.Second, now)
+	}
+	if got := s.startEcho(key, 5*time.Second, now); got != 0 {
+		t.Errorf("echo accepted beyond %d clients", EchoMaxClients)
+	}
+	s.expireEchoes(now.Add(10 * time.Second))
+	if len(s.echoes) != 0 {
+		t.Errorf("%d echoes left after expiry", len(s.echoes))
+	}
+}
@@ -0,0 +1,33 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"github.com/xujiajundd/ycng/utils/errs"
+)
+
+/*
+错误分类：原来处理收包时的错误都是直接打日志，测试只能比较错误字符串，也没法按类别统计。
+1. 解析、解混淆、信令、加解密、分片等返回的错误带上类别（见utils/errs），常用的是包级变量，测试可以用errors.Is或errs.Is判断
+2. 处理收包出错时用errs.Wrap加上在做什么、包的来源、消息类型和sid，交给reportError统一打日志并按类别计数
+3. 各类别的计数见status的errors，session manager的见管理接口/errors
+*/
+
+//打日志并按类别计数，err为nil时什么也不做
+func (s *Service) reportError(err *errs.Error) {
+	if err == nil {
+		return
+	}
+	s.errorCounts.Add(err)
+	s.log().Warn(err.Kind, " error: ", err)
+}
+
+//各类别的错误数
+func (s *Service) ErrorCounts() map[string]uint64 {
+	return s.errorCounts.Snapshot()
+}
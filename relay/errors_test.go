@@ -0,0 +1,41 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/errs"
+)
+
+func TestErrorKinds(t *testing.T) {
+	if _, err := NewMessageFromObfuscatedData(make([]byte, 10)); !errs.Is(err, errs.Malformed) {
+		t.Errorf("short packet: %v", err)
+	}
+	signal := NewSignalTemp()
+	if err := signal.Unmarshal([]byte("{")); !errs.Is(err, errs.Signal) {
+		t.Errorf("truncated json: %v", err)
+	}
+	if err := signal.Unmarshal([]byte(`{"i":{"members":["a"]}}`)); !errs.Is(err, errs.Signal) {
+		t.Errorf("incorrect members: %v", err)
+	}
+	if _, _, err := NewLinkFromPeerKey([]byte{1, 2, 3}); !errs.Is(err, errs.Crypto) {
+		t.Errorf("short public key: %v", err)
+	}
+}
+
+func TestServiceErrorCounts(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	s.handlePacket(&ReceivedPacket{Body: make([]byte, 10), FromUdpAddr: addr, Time: time.Now().UnixNano()})
+	if counts := s.ErrorCounts(); counts["malformed"] != 1 || len(counts) != 1 {
+		t.Errorf("error counts %v", counts)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils"
+)
+
+/*
+媒体包的快速转发：原来转发给每个接收方都要重新序列化（复制payload）再整包混淆一遍，混淆是逐字节查字典异或，
+多人会议里同一个包要做N次，占了主循环的大部分时间。
+1. 收到的明文（没有链路加密）媒体包（见hold.go的isHoldableMessage）解析后保留收到的整包，收包缓冲区的所有权交给消息，
+   不再归还缓冲池；带逐跳时间戳的包（见hoptrace.go）每跳都要改extra，不保留
+2. 转发时接收方相关的头部字段只有Tseq（每个接收方各自的序号）。如果消息除Tseq外都没有改过（没有加上延迟统计的extra、
+   没有注入或去掉trace），接收方没有链路加密，并且收到时用的混淆密钥就是现在发包用的密钥，就直接复制收到的整包，
+   只改其中的Tseq：混淆是按位置和字典异或，把密文异或上新旧值之差即可，不用解开也不用重新混淆
+3. 其他情况照常序列化和混淆。快速转发的包数见status的fast_forwarded
+每个接收方仍要一份自己的发送缓冲区（Tseq不同，发送队列取得缓冲区的所有权），省掉的是payload的复制和整包的重新混淆。
+*/
+
+type wireImage struct {
+	data   []byte          //收到的混淆后的整包
+	key    *ObfuscationKey //收到时的混淆密钥，nil为内置字典
+	header Message         //解析时的消息，Payload和Extra与原消息共用底层数组
+}
+
+//混淆头的字节数，带key id时多1字节
+func (w *wireImage) headerLen() int {
+	if w.key != nil {
+		return 3
+	}
+	return 2
+}
+
+//除Tseq外是否和收到时一样，Payload和Extra换了或改了长度都算改过
+func (w *wireImage) unchanged(msg *Message) bool {
+	h := &w.header
+	return msg.Tid == h.Tid && msg.Timestamp == h.Timestamp && msg.Version == h.Version && msg.Flags == h.Flags &&
+		msg.MsgType == h.MsgType && msg.From == h.From && msg.To == h.To && msg.Dest == h.Dest &&
+		sameBytes(msg.Payload, h.Payload) && sameBytes(msg.Extra, h.Extra)
+}
+
+func sameBytes(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+//可以快速转发的消息保留收到的整包body，返回true表示body已交给msg，调用方不能再归还缓冲池
+func keepWire(msg *Message, key *ObfuscationKey, body []byte) bool {
+	if !isHoldableMessage(msg.MsgType) || msg.HasFlag(UdpMessageFlagEncrypted) || msg.HasFlag(UdpMessageFlagHopTrace) {
+		return false
+	}
+	w := &wireImage{data: body, key: key, header: *msg}
+	if len(body) != w.headerLen()+msg.MarshalLen() { //后面带了多余的字节
+		return false
+	}
+	msg.wire = w
+	return true
+}
+
+//可以快速转发时返回复制出的整包，Tseq已改为msg的，否则返回nil
+func (s *Service) forwardWire(msg *Message, addr *net.UDPAddr) []byte {
+	w := msg.wire
+	if w == nil || s.traceCtx != nil || s.links[addr.String()] != nil || !w.unchanged(msg) {
+		return nil
+	}
+	if loadObfuscationKeys().sending(time.Now()) != w.key {
+		return nil
+	}
+	if msg.HasFlag(UdpMessageFlagExtra) && s.capabilities[addr.String()]&CapabilityTraceContext == 0 &&
+		FindExtra(msg.Extra, UdpMessageExtraTypeTrace) != nil {
+		return nil //要去掉trace
+	}
+
+	buf := utils.GetPacketBuffer(len(w.data))
+	copy(buf, w.data)
+	h := w.headerLen()
+	diff := uint16(w.header.Tseq) ^ uint16(msg.Tseq)
+	buf[h] ^= byte(diff >> 8)
+	buf[h+1] ^= byte(diff)
+	return buf
+}
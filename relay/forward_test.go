@@ -0,0 +1,106 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestForwardWire(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	received := func(msg *Message) *Message {
+		msg.Tseq = 3
+		body := msg.ObfuscatedDataOfMessage()
+		got, key, err := parseObfuscated(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !keepWire(got, key, body) {
+			t.Fatalf("message type %d not kept", got.MsgType)
+		}
+		return got
+	}
+
+	msg := received(NewMessage(UdpMessageTypeVideoStream, 1001, 42, 0, []byte("video payload"), nil))
+	msg.Tseq = 0x1234
+	data := s.forwardWire(msg, addr)
+	if data == nil {
+		t.Fatal("unchanged message not fast forwarded")
+	}
+	got, err := NewMessageFromObfuscatedData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := NewMessageFromObfuscatedData(msg.ObfuscatedDataOfMessage())
+	if !reflect.DeepEqual(got, want) || got.Tseq != 0x1234 {
+		t.Errorf("forwarded %+v, want %+v", got, want)
+	}
+
+	//加上了延迟统计的extra
+	msg.Extra = []byte{1, 0, 0}
+	msg.SetFlag(UdpMessageFlagExtra)
+	if s.forwardWire(msg, addr) != nil {
+		t.Error("message with added extra fast forwarded")
+	}
+	msg.Extra = nil
+	msg.UnSetFlag(UdpMessageFlagExtra)
+	if s.forwardWire(msg, addr) == nil {
+		t.Error("message with extra removed again not fast forwarded")
+	}
+
+	//接收方有链路加密
+	s.links[addr.String()] = &Link{}
+	if s.forwardWire(msg, addr) != nil {
+		t.Error("message to encrypted link fast forwarded")
+	}
+	delete(s.links, addr.String())
+
+	//信令不保留整包
+	signal := NewMessage(UdpMessageTypeUserSignal, 1001, SessionManagerUid, 0, []byte("{}"), nil)
+	body := signal.ObfuscatedDataOfMessage()
+	parsed, key, _ := parseObfuscated(body)
+	if keepWire(parsed, key, body) || s.forwardWire(parsed, addr) != nil {
+		t.Error("signal fast forwarded")
+	}
+
+	//经过sendMessage计数
+	s.sendMessage(msg, addr)
+	if s.traffic.fastForwarded != 1 || s.traffic.sentPackets != 1 {
+		t.Errorf("fast forwarded %d of %d", s.traffic.fastForwarded, s.traffic.sentPackets)
+	}
+}
+
+func TestForwardWireObfuscationKey(t *testing.T) {
+	defer obfKeys.Store(&obfuscationKeys{})
+	s := NewService(GetDefaultConfig())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	key, _ := NewObfuscationKey(7, "secret")
+	RotateObfuscationKey(key, 0)
+
+	audio := NewMessage(UdpMessageTypeAudioStream, 1001, 42, 0, make([]byte, 12), nil)
+	body := audio.ObfuscatedDataOfMessage()
+	msg, used, err := parseObfuscated(body)
+	if err != nil || used != key || !keepWire(msg, used, body) {
+		t.Fatalf("keyed packet %v %v", used, err)
+	}
+	msg.Tseq = 9
+	data := s.forwardWire(msg, addr)
+	if got, err := NewMessageFromObfuscatedData(data); err != nil || got.Tseq != 9 || data[0] != key.Id {
+		t.Fatalf("forwarded keyed packet %v %v", got, err)
+	}
+
+	//发包改用了另一个密钥
+	next, _ := NewObfuscationKey(8, "next")
+	RotateObfuscationKey(next, 0)
+	if s.forwardWire(msg, addr) != nil {
+		t.Error("packet fast forwarded with a stale obfuscation key")
+	}
+}
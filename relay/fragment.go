@@ -0,0 +1,230 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/errs"
+)
+
+/*
+信令分片：压缩后payload仍超过MaxSignalPayload的，拆成多个消息发送，每片带UdpMessageFlagFragment和
+Fragment extra：id(4)+index(1)+count(1)。接收方按(from, id)收齐后拼回原消息，超时未收齐的丢弃。
+其他extra（trace、能力位图等）每片都带一份，拼回时取第一片的。
+
+relay和session manager都在收到时先重组、解压，处理的总是完整信令；发出时用PrepareSignal按接收方的能力
+重新压缩、分片，或者退回不压缩的JSON。分片的大小还受接收方路径MTU的限制，见mtu.go。
+*/
+
+const (
+	MaxSignalPayload     = 1200 //留出头部和extra的空间，整包在IPv6最小MTU 1280以内
+	MaxFragments         = 64
+	FragmentTimeout      = 5 * time.Second
+	MaxPendingFragmented = 1024 //同时在重组的消息数上限，防止只发部分分片耗尽内存
+	MinFragmentPayload   = 256  //路径MTU很小时分片也不再小于这个大小
+
+	fragmentExtraSize = 6
+)
+
+var (
+	fragmentId = rand.Uint32()
+
+	errSignalTooLarge = errs.New(errs.TooLarge, "signal exceeds max datagram and receiver can't reassemble")
+)
+
+//payload不超过MaxSignalPayload时原样返回
+func FragmentMessage(msg *Message) ([]*Message, error) {
+	return fragmentMessage(msg, MaxSignalPayload)
+}
+
+//每片的payload不超过size
+func fragmentMessage(msg *Message, size int) ([]*Message, error) {
+	if len(msg.Payload) <= size {
+		return []*Message{msg}, nil
+	}
+	count := (len(msg.Payload) + size - 1) / size
+	if count > MaxFragments {
+		return nil, errs.New(errs.TooLarge, "signal payload too large to fragment")
+	}
+
+	var extra []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+	}
+	id := atomic.AddUint32(&fragmentId, 1)
+	fragments := make([]*Message, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(msg.Payload) {
+			end = len(msg.Payload)
+		}
+		value := make([]byte, fragmentExtraSize)
+		binary.BigEndian.PutUint32(value[0:4], id)
+		value[4] = byte(i)
+		value[5] = byte(count)
+
+		fragment := *msg
+		fragment.Payload = msg.Payload[i*size : end]
+		fragment.Extra = ReplaceExtra(extra, UdpMessageExtraTypeFragment, value)
+		fragment.SetFlag(UdpMessageFlagExtra)
+		fragment.SetFlag(UdpMessageFlagFragment)
+		fragments[i] = &fragment
+	}
+	return fragments, nil
+}
+
+type fragmentKey struct {
+	from int64
+	id   uint32
+}
+
+type partialMessage struct {
+	first    *Message
+	parts    [][]byte
+	received int
+	start    time.Time
+}
+
+//重组分片，只在服务的主循环中使用，不加锁
+type Reassembler struct {
+	timeout time.Duration
+	pending map[fragmentKey]*partialMessage
+}
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		timeout: timeout,
+		pending: make(map[fragmentKey]*partialMessage),
+	}
+}
+
+//收到一片，收齐时返回拼好的消息，否则返回nil
+func (r *Reassembler) Add(msg *Message, now time.Time) (*Message, error) {
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeFragment)
+	if len(value) != fragmentExtraSize {
+		return nil, errs.New(errs.Malformed, "fragment without fragment extra")
+	}
+	id := binary.BigEndian.Uint32(value[0:4])
+	index := int(value[4])
+	count := int(value[5])
+	if count == 0 || count > MaxFragments || index >= count {
+		return nil, errs.New(errs.Malformed, "incorrect fragment index")
+	}
+	if len(msg.Payload) > MaxSignalPayload {
+		return nil, errs.New(errs.TooLarge, "fragment too large")
+	}
+
+	key := fragmentKey{from: msg.From, id: id}
+	partial := r.pending[key]
+	if partial == nil && len(r.pending) >= MaxPendingFragmented {
+		return nil, errs.New(errs.Rejected, "too many pending fragmented messages")
+	}
+	if partial == nil || len(partial.parts) != count {
+		partial = &partialMessage{
+			parts: make([][]byte, count),
+			start: now,
+		}
+		r.pending[key] = partial
+	}
+	if partial.parts[index] != nil {
+		return nil, nil //重复的分片
+	}
+	partial.parts[index] = msg.Payload
+	partial.received++
+	if index == 0 {
+		partial.first = msg
+	}
+	if partial.received < count {
+		return nil, nil
+	}
+
+	delete(r.pending, key)
+	whole := *partial.first
+	whole.Payload = bytesJoin(partial.parts)
+	whole.Extra = RemoveExtra(partial.first.Extra, UdpMessageExtraTypeFragment)
+	whole.UnSetFlag(UdpMessageFlagFragment)
+	if len(whole.Extra) == 0 {
+		whole.Extra = nil
+		whole.UnSetFlag(UdpMessageFlagExtra)
+	}
+	return &whole, nil
+}
+
+//收到的信令如果是分片或压缩过的，还原成完整的信令，分片未收齐时返回nil
+func (r *Reassembler) Restore(msg *Message, now time.Time) (*Message, error) {
+	if msg.HasFlag(UdpMessageFlagFragment) {
+		whole, err := r.Add(msg, now)
+		if err != nil || whole == nil {
+			return nil, err
+		}
+		msg = whole
+	}
+	if err := DecompressSignal(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+//按接收方的能力准备要发出的信令：不支持protobuf的转回JSON，支持压缩的压缩并在需要时分片，不修改msg。
+//maxDatagram为发往接收方的整包最大字节数，0为不限制，不能重组的接收方放不下时返回错误
+func PrepareSignal(msg *Message, capabilities uint32, maxDatagram int) ([]*Message, error) {
+	prepared := *msg
+	if capabilities&CapabilityProtoSignal == 0 {
+		if err := TranscodeSignal(&prepared, false); err != nil {
+			return nil, err
+		}
+	}
+	if capabilities&CapabilityCompression == 0 {
+		if maxDatagram > 0 && DatagramLen(&prepared) > maxDatagram {
+			return nil, errSignalTooLarge
+		}
+		return []*Message{&prepared}, nil
+	}
+	CompressSignal(&prepared)
+	return fragmentMessage(&prepared, fragmentPayloadSize(&prepared, maxDatagram))
+}
+
+//使整包不超过maxDatagram的分片大小，按链路加密的情况留出空间
+func fragmentPayloadSize(msg *Message, maxDatagram int) int {
+	if maxDatagram <= 0 {
+		return MaxSignalPayload
+	}
+	size := maxDatagram - (DatagramLen(msg) - len(msg.Payload)) - 3 - fragmentExtraSize - linkSealOverhead
+	if size > MaxSignalPayload {
+		return MaxSignalPayload
+	}
+	if size < MinFragmentPayload {
+		return MinFragmentPayload
+	}
+	return size
+}
+
+//丢弃超时未收齐的
+func (r *Reassembler) Expire(now time.Time) {
+	for key, partial := range r.pending {
+		if now.Sub(partial.start) > r.timeout {
+			delete(r.pending, key)
+		}
+	}
+}
+
+func bytesJoin(parts [][]byte) []byte {
+	size := 0
+	for _, part := range parts {
+		size += len(part)
+	}
+	result := make([]byte, 0, size)
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+//go test -fuzz=FuzzNewMessageFromObfuscatedData ./relay
+//畸形的udp包只能返回错误，不能panic；能解析的包重新序列化后应解析出同样的消息
+func FuzzNewMessageFromObfuscatedData(f *testing.F) {
+	signal := NewSignal(YCKCallSignalTypeInvite, 1, 2, 3)
+	payload, _ := signal.Marshal()
+	msg := NewMessage(UdpMessageTypeUserSignal, 1, SessionManagerUid, 0, payload, nil)
+	SetCapabilities(msg, RelayCapabilities)
+	f.Add(msg.ObfuscatedDataOfMessage())
+	f.Add(NewMessage(UdpMessageTypeAudioStream, 1, 2, 3, make([]byte, 20), []byte{UdpMessageExtraTypeAudioLevel, 0, 1, 30}).ObfuscatedDataOfMessage())
+	big := NewMessage(UdpMessageTypeUserSignal, 1, 2, 0, make([]byte, 2*MaxSignalPayload), nil)
+	fragments, _ := FragmentMessage(big)
+	f.Add(fragments[0].ObfuscatedDataOfMessage())
+	f.Add([]byte{})
+	f.Add([]byte{0})
+	f.Add(make([]byte, 28))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := NewMessageFromObfuscatedData(data)
+		if err != nil {
+			return
+		}
+		CapabilitiesFromMessage(msg)
+		TraceContextFromMessage(msg)
+		ParseAudioLevel(msg.Extra)
+		if restored, err := NewReassembler(FragmentTimeout).Restore(msg, time.Now()); err == nil && restored != nil {
+			NewSignalTemp().UnmarshalMessage(restored)
+		}
+
+		again := &Message{}
+		if err := again.Unmarshal(msg.Marshal()); err != nil {
+			t.Fatalf("re-unmarshal: %v", err)
+		}
+		if again.MsgType != msg.MsgType || again.From != msg.From || again.To != msg.To || string(again.Payload) != string(msg.Payload) {
+			t.Fatalf("round trip mismatch: %+v != %+v", again, msg)
+		}
+	})
+}
+
+//go test -fuzz=FuzzSignalUnmarshal ./relay
+func FuzzSignalUnmarshal(f *testing.F) {
+	signal := NewSignal(YCKCallSignalTypeMemberOp, 1, SessionManagerUid, 3)
+	signal.Info = map[string]interface{}{"op": "invite", "members": []interface{}{2, 3}, "relays": []interface{}{"127.0.0.1:19001"}}
+	payload, _ := signal.Marshal()
+	f.Add(payload)
+	f.Add([]byte(`{"g":20,"i":{"op":"kick","members":["x"]}}`))
+	f.Add([]byte(`{"g":100,"i":{"token":1}}`))
+	f.Add([]byte(`null`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := NewSignalTemp()
+		if err := s.Unmarshal(data); err != nil {
+			return
+		}
+		//通过校验的信令在两种编码间转换都不应出错
+		pb, err := s.MarshalProto()
+		if err != nil {
+			t.Fatalf("marshal proto: %v", err)
+		}
+		if err := NewSignalTemp().UnmarshalProto(pb); err != nil {
+			t.Fatalf("unmarshal proto: %v", err)
+		}
+		if _, err := s.Marshal(); err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+	})
+}
+
+//go test -fuzz=FuzzSignalUnmarshalProto ./relay
+func FuzzSignalUnmarshalProto(f *testing.F) {
+	signal := NewSignal(YCKCallSignalTypeMemberState, SessionManagerUid, 1, 3)
+	signal.Info = map[string]interface{}{"states": map[string]interface{}{"1": map[string]interface{}{"state": 4}}}
+	pb, _ := signal.MarshalProto()
+	f.Add(pb)
+	f.Add([]byte{0x52, 0x02, 0x0a, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		NewSignalTemp().UnmarshalProto(data)
+	})
+}
@@ -0,0 +1,225 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+	"golang.org/x/sys/unix"
+)
+
+/*
+Linux上的UDP批量收发，大会议里relay要把同一个包转给很多人，逐个WriteToUDP的系统调用开销很大：
+1. 发：一批包用一次sendmmsg写出。连续发往同一地址、大小相同（最后一个可以更小）的包合成一个消息，
+   带UDP_SEGMENT(GSO)由内核或网卡切分，如一个视频帧的多个包。内核不支持GSO（4.18之前）时只用sendmmsg，
+   网卡不支持校验和卸载而返回EIO时关掉GSO重发
+2. 收：开UDP_GRO，内核把同一来源的多个包合成一个读出，按控制消息里的段大小拆开，内核不支持时照常逐个收
+config的udp_offload为false时都不开，和其他平台一样逐个收发（见gso_other.go）
+*/
+
+const (
+	gsoMaxSegments = 64    //内核的UDP_MAX_SEGMENTS
+	gsoMaxBytes    = 65000 //合成的消息不超过一个UDP包的最大长度
+)
+
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+	_   [unsafe.Sizeof(uintptr(0)) - 4]byte
+}
+
+type linuxBatchWriter struct {
+	conn  *net.UDPConn
+	raw   syscall.RawConn
+	inet6 bool //socket为AF_INET6（双栈），IPv4地址要写成v4-mapped
+	gso   bool
+
+	msgs   []mmsghdr
+	counts []int //每个消息合成的包数
+	iovs   []unix.Iovec
+	names  []unix.RawSockaddrInet6 //足够放下IPv4或IPv6地址
+	oobs   []byte
+}
+
+//offload为false或取不到fd时退回逐个写
+func newBatchWriter(conn *net.UDPConn, offload bool) batchWriter {
+	if !offload {
+		return &loopWriter{conn: conn}
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return &loopWriter{conn: conn}
+	}
+	w := &linuxBatchWriter{
+		conn:   conn,
+		raw:    raw,
+		msgs:   make([]mmsghdr, SendBatchSize),
+		counts: make([]int, SendBatchSize),
+		iovs:   make([]unix.Iovec, SendBatchSize),
+		names:  make([]unix.RawSockaddrInet6, SendBatchSize),
+		oobs:   make([]byte, SendBatchSize*unix.CmsgSpace(2)),
+	}
+	raw.Control(func(fd uintptr) {
+		if sa, err := unix.Getsockname(int(fd)); err == nil {
+			_, w.inet6 = sa.(*unix.SockaddrInet6)
+		}
+		_, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+		w.gso = err == nil
+	})
+	logging.Logger.Info("udp send with sendmmsg, gso:", w.gso)
+	return w
+}
+
+func (w *linuxBatchWriter) write(packets []outPacket) {
+	for len(packets) > 0 {
+		n := w.prepare(packets)
+		sent, err := w.sendmmsg(n)
+		if err == unix.EIO && w.gso {
+			logging.Logger.Warn("udp gso not supported by the device, disabled")
+			w.gso = false
+			continue
+		}
+		if err != nil {
+			logging.Logger.Debug("sendmmsg error:", err)
+			sent = 1 //跳过写不出去的那个消息
+		}
+		for i := 0; i < sent; i++ {
+			packets = packets[w.counts[i]:]
+		}
+	}
+}
+
+//从packets开头合成最多SendBatchSize个消息，返回消息数
+func (w *linuxBatchWriter) prepare(packets []outPacket) int {
+	n, iov, oob := 0, 0, 0
+	for len(packets) > 0 && n < len(w.msgs) && iov < len(w.iovs) {
+		count := 1
+		if w.gso {
+			count = gsoRun(packets, len(w.iovs)-iov)
+		}
+		msg := &w.msgs[n]
+		*msg = mmsghdr{}
+		for i := 0; i < count; i++ {
+			w.iovs[iov+i].Base = &packets[i].data[0]
+			w.iovs[iov+i].SetLen(len(packets[i].data))
+		}
+		msg.hdr.Iov = &w.iovs[iov]
+		msg.hdr.SetIovlen(count)
+		msg.hdr.Name = (*byte)(unsafe.Pointer(&w.names[n]))
+		msg.hdr.Namelen = w.setName(&w.names[n], packets[0].addr)
+		if count > 1 {
+			space := unix.CmsgSpace(2)
+			cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&w.oobs[oob]))
+			cmsg.Level = unix.SOL_UDP
+			cmsg.Type = unix.UDP_SEGMENT
+			cmsg.SetLen(unix.CmsgLen(2))
+			*(*uint16)(unsafe.Pointer(&w.oobs[oob+unix.CmsgLen(0)])) = uint16(len(packets[0].data))
+			msg.hdr.Control = &w.oobs[oob]
+			msg.hdr.SetControllen(space)
+			oob += space
+		}
+		w.counts[n] = count
+		packets = packets[count:]
+		iov += count
+		n++
+	}
+	return n
+}
+
+func (w *linuxBatchWriter) sendmmsg(n int) (int, error) {
+	var sent int
+	var serr error
+	err := w.raw.Write(func(fd uintptr) bool {
+		r, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&w.msgs[0])), uintptr(n), 0, 0, 0)
+		if errno == unix.EAGAIN {
+			return false
+		}
+		if errno != 0 {
+			serr = errno
+		} else {
+			sent = int(r)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sent, serr
+}
+
+func (w *linuxBatchWriter) setName(name *unix.RawSockaddrInet6, addr *net.UDPAddr) uint32 {
+	port := (*[2]byte)(unsafe.Pointer(&name.Port))
+	binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
+	if ip4 := addr.IP.To4(); ip4 != nil && !w.inet6 {
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		sa.Family = unix.AF_INET
+		copy(sa.Addr[:], ip4)
+		sa.Zero = [8]uint8{}
+		return unix.SizeofSockaddrInet4
+	}
+	*name = unix.RawSockaddrInet6{Family: unix.AF_INET6, Port: name.Port}
+	copy(name.Addr[:], addr.IP.To16())
+	return unix.SizeofSockaddrInet6
+}
+
+//packets开头可以用GSO合成一个消息的包数：同一地址，除最后一个外大小相同，最后一个不更大
+func gsoRun(packets []outPacket, max int) int {
+	if max > gsoMaxSegments {
+		max = gsoMaxSegments
+	}
+	first := packets[0]
+	size := len(first.data)
+	total := size
+	n := 1
+	for n < len(packets) && n < max {
+		p := packets[n]
+		if len(p.data) > size || total+len(p.data) > gsoMaxBytes || !p.addr.IP.Equal(first.addr.IP) || p.addr.Port != first.addr.Port {
+			break
+		}
+		total += len(p.data)
+		n++
+		if len(p.data) < size {
+			break
+		}
+	}
+	return n
+}
+
+//offload为true时尝试开UDP_GRO，返回是否开启
+func enableGro(conn *net.UDPConn, offload bool) bool {
+	if !offload {
+		return false
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1)
+	})
+	return err == nil && serr == nil
+}
+
+//控制消息里GRO的段大小，不是合成的包时返回0
+func groSegmentSize(oob []byte) int {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range messages {
+		if m.Header.Level == unix.SOL_UDP && m.Header.Type == unix.UDP_GRO && len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0]))) //内核放的是int
+		}
+	}
+	return 0
+}
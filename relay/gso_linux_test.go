@@ -0,0 +1,109 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGsoRun(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20002}
+	packet := func(size int, addr *net.UDPAddr) outPacket {
+		return outPacket{data: make([]byte, size), addr: addr}
+	}
+	cases := []struct {
+		packets []outPacket
+		max     int
+		want    int
+	}{
+		{[]outPacket{packet(100, a), packet(100, a), packet(60, a), packet(60, a)}, 64, 3}, //更小的一个结束
+		{[]outPacket{packet(100, a), packet(100, a), packet(100, b)}, 64, 2},               //换了地址
+		{[]outPacket{packet(60, a), packet(100, a)}, 64, 1},                                //后面的更大
+		{[]outPacket{packet(100, a), packet(100, a), packet(100, a)}, 2, 2},                //iovec不够
+		{[]outPacket{packet(40000, a), packet(40000, a)}, 64, 1},                           //超过一个UDP包
+	}
+	for i, c := range cases {
+		if got := gsoRun(c.packets, c.max); got != c.want {
+			t.Errorf("case %d: run %d, want %d", i, got, c.want)
+		}
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	//和单socket的relay一样是双栈socket，IPv4地址要用v4-mapped
+	server, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	var clients []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	addr0 := clients[0].LocalAddr().(*net.UDPAddr)
+	addr1 := clients[1].LocalAddr().(*net.UDPAddr)
+
+	//同一地址连续的包可以合成一个GSO消息，交错的只能各发各的
+	var packets []outPacket
+	var want [2][][]byte
+	add := func(i int, addr *net.UDPAddr, size int) {
+		data := bytes.Repeat([]byte{byte(len(packets))}, size)
+		packets = append(packets, outPacket{data: data, addr: addr})
+		want[i] = append(want[i], data)
+	}
+	for n := 0; n < 5; n++ {
+		add(0, addr0, 1200)
+	}
+	add(0, addr0, 300)
+	for n := 0; n < 4; n++ {
+		add(0, addr0, 500)
+		add(1, addr1, 500)
+	}
+
+	w := newBatchWriter(server, true)
+	if _, ok := w.(*linuxBatchWriter); !ok {
+		t.Fatalf("writer %T, want sendmmsg", w)
+	}
+	w.write(packets)
+
+	buf := make([]byte, 2048)
+	for i, client := range clients {
+		var got [][]byte
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		for len(got) < len(want[i]) {
+			n, _, err := client.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("client %d received %d of %d: %v", i, len(got), len(want[i]), err)
+			}
+			got = append(got, append([]byte(nil), buf[:n]...))
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("client %d received wrong packets", i)
+		}
+	}
+}
+
+func TestSplitSegments(t *testing.T) {
+	data := []byte("aaabbbcc")
+	if got := splitSegments(data, 3); !reflect.DeepEqual(got, [][]byte{[]byte("aaa"), []byte("bbb"), []byte("cc")}) {
+		t.Errorf("segments %q", got)
+	}
+	if got := splitSegments(data, 0); len(got) != 1 || !bytes.Equal(got[0], data) {
+		t.Errorf("segments %q without gro", got)
+	}
+}
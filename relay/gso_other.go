@@ -0,0 +1,26 @@
+//go:build !linux
+
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+)
+
+func newBatchWriter(conn *net.UDPConn, offload bool) batchWriter {
+	return &loopWriter{conn: conn}
+}
+
+func enableGro(conn *net.UDPConn, offload bool) bool {
+	return false
+}
+
+func groSegmentSize(oob []byte) int {
+	return 0
+}
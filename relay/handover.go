@@ -0,0 +1,63 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/*
+通话切换设备：参与者在session manager上把通话从一个设备切到另一个设备后，session manager通过
+UdpMessageTypeHandoverControl通知relay，payload为uid(8)+新设备id。
+1. 此后这个参与者只有带新设备id（extra）的TurnReg能注册，新设备TurnReg后媒体转到新设备的地址
+2. 地址和当前注册地址不同的媒体包直接丢弃，旧设备在收到End之前发的媒体不会把地址改回去
+3. 再次切换时用新的设备id覆盖
+*/
+
+func NewHandoverControlPayload(uid int64, device string) []byte {
+	payload := make([]byte, 8+len(device))
+	binary.BigEndian.PutUint64(payload[0:8], uint64(uid))
+	copy(payload[8:], device)
+	return payload
+}
+
+//切换过设备的参与者从旧地址发来的媒体返回true
+func (s *Service) isFromOldDevice(msg *Message, packet *ReceivedPacket) bool {
+	session := s.sessions[msg.To]
+	if session == nil || session.Devices[msg.From] == "" {
+		return false
+	}
+	participant := session.Participants[msg.From]
+	if participant == nil {
+		return false
+	}
+	return !bytes.Equal(participant.UdpAddr.IP, packet.FromUdpAddr.IP) || participant.UdpAddr.Port != packet.FromUdpAddr.Port
+}
+
+func (s *Service) handleMessageHandoverControl(msg *Message, packet *ReceivedPacket) {
+	if msg.From != SessionManagerUid {
+		s.log().Warn("handover control from non session manager ", msg.From, "<", packet.FromUdpAddr.String(), ">")
+		return
+	}
+	if len(msg.Payload) <= 8 || len(msg.Payload) > 8+MaxDeviceIdLen {
+		s.log().Warn("incorrect handover control message for session ", msg.To)
+		return
+	}
+	uid := int64(binary.BigEndian.Uint64(msg.Payload[0:8]))
+	device := string(msg.Payload[8:])
+
+	session := s.sessions[msg.To]
+	if session == nil {
+		session = NewSession(msg.To)
+		session.Participants = make(map[int64]*Participant)
+		s.sessions[msg.To] = session
+	}
+	session.Devices[uid] = device
+	s.log().Info("handover control for participant ", uid, " of session ", msg.To, " to device ", device)
+}
@@ -0,0 +1,61 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHandoverControl(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	phone := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 20001}
+	desktop := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 20002}
+	const sid = int64(42)
+	const uid = int64(1001)
+
+	control := func(from int64, payload []byte) {
+		msg := NewMessage(UdpMessageTypeHandoverControl, from, sid, 0, payload, nil)
+		s.handleMessageHandoverControl(msg, &ReceivedPacket{FromUdpAddr: phone})
+	}
+	turnReg := func(device string, addr *net.UDPAddr) {
+		msg := NewMessage(UdpMessageTypeTurnReg, uid, sid, 0, nil, nil)
+		SetDevice(msg, device)
+		s.handleMessageTurnReg(msg, &ReceivedPacket{FromUdpAddr: addr})
+	}
+	fromOld := func(addr *net.UDPAddr) bool {
+		msg := NewMessage(UdpMessageTypeAudioStream, uid, sid, 0, make([]byte, 12), nil)
+		return s.isFromOldDevice(msg, &ReceivedPacket{FromUdpAddr: addr})
+	}
+
+	turnReg("phone", phone)
+	session := s.sessions[sid]
+	if fromOld(desktop) {
+		t.Fatal("media filtered before handover")
+	}
+
+	control(uid, NewHandoverControlPayload(uid, "desktop")) //不是session manager发的，忽略
+	control(SessionManagerUid, NewHandoverControlPayload(uid, ""))
+	if len(session.Devices) != 0 {
+		t.Fatalf("incorrect handover control accepted: %v", session.Devices)
+	}
+
+	control(SessionManagerUid, NewHandoverControlPayload(uid, "desktop"))
+	if session.Devices[uid] != "desktop" {
+		t.Fatalf("devices = %v", session.Devices)
+	}
+
+	turnReg("desktop", desktop)
+	turnReg("phone", phone) //旧设备的TurnReg被拒绝
+	if addr := session.Participants[uid].UdpAddr; addr != desktop {
+		t.Errorf("participant addr = %v, want desktop", addr)
+	}
+	if !fromOld(phone) || fromOld(desktop) {
+		t.Error("media of old device not filtered")
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+保持：参与者在session manager上Hold后，session manager通过UdpMessageTypeHoldControl通知relay，
+payload为uid(8)+control(1)。被保持的参与者发的媒体直接丢弃，其他人的媒体也不再转给他，
+但他的包仍然刷新活跃时间，不会因为保持太久被当作掉线清掉。
+*/
+
+const (
+	HoldControlResume = 0
+	HoldControlHold   = 1
+)
+
+func isHoldableMessage(msgType uint8) bool {
+	switch msgType {
+	case UdpMessageTypeAudioStream, UdpMessageTypeVideoStream, UdpMessageTypeVideoStreamIFrame,
+		UdpMessageTypeVideoNack, UdpMessageTypeVideoAskForIFrame,
+		UdpMessageTypeThumbVideoStream, UdpMessageTypeThumbVideoStreamIFrame,
+		UdpMessageTypeThumbVideoNack, UdpMessageTypeThumbVideoAskForIFrame,
+		UdpMessageTypeData, UdpMessageTypeDataNack, UdpMessageTypeUnicastData, UdpMessageTypeUnicastDataNack,
+		UdpMessageTypeRtcp:
+		return true
+	}
+	return false
+}
+
+func NewHoldControlPayload(uid int64, control byte) []byte {
+	payload := make([]byte, 9)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(uid))
+	payload[8] = control
+	return payload
+}
+
+//发送方被保持时刷新其活跃时间并返回true
+func (s *Service) isHeld(msg *Message) bool {
+	session := s.sessions[msg.To]
+	if session == nil || !session.Held[msg.From] {
+		return false
+	}
+	if participant := session.Participants[msg.From]; participant != nil {
+		participant.LastActiveTime = time.Now()
+	}
+	return true
+}
+
+func (s *Service) handleMessageHoldControl(msg *Message, packet *ReceivedPacket) {
+	if msg.From != SessionManagerUid {
+		s.log().Warn("hold control from non session manager ", msg.From, "<", packet.FromUdpAddr.String(), ">")
+		return
+	}
+	if len(msg.Payload) < 9 {
+		s.log().Warn("incorrect hold control message for session ", msg.To)
+		return
+	}
+	uid := int64(binary.BigEndian.Uint64(msg.Payload[0:8]))
+
+	session := s.sessions[msg.To]
+	if session == nil {
+		session = NewSession(msg.To)
+		session.Participants = make(map[int64]*Participant)
+		s.sessions[msg.To] = session
+	}
+
+	if msg.Payload[8] == HoldControlHold {
+		session.Held[uid] = true
+		if session.Mixer != nil {
+			session.Mixer.Remove(uid)
+		}
+	} else {
+		delete(session.Held, uid)
+	}
+	s.log().Info("hold control for participant ", uid, " of session ", msg.To, " held:", session.Held[uid])
+}
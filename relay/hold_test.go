@@ -0,0 +1,58 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHoldControl(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	const sid, uid = int64(42), int64(1001)
+
+	control := func(from int64, c byte) {
+		msg := NewMessage(UdpMessageTypeHoldControl, from, sid, 0, NewHoldControlPayload(uid, c), nil)
+		s.handleMessageHoldControl(msg, &ReceivedPacket{FromUdpAddr: addr})
+	}
+	audio := NewMessage(UdpMessageTypeAudioStream, uid, sid, 0, make([]byte, 12), nil)
+
+	control(1001, HoldControlHold) //不是session manager发的，忽略
+	if s.isHeld(audio) {
+		t.Fatal("hold control accepted from non session manager")
+	}
+
+	control(SessionManagerUid, HoldControlHold)
+	if !s.isHeld(audio) {
+		t.Fatal("participant not held")
+	}
+	other := NewMessage(UdpMessageTypeAudioStream, uid+1, sid, 0, make([]byte, 12), nil)
+	if s.isHeld(other) {
+		t.Error("other participant held")
+	}
+
+	control(SessionManagerUid, HoldControlResume)
+	if s.isHeld(audio) {
+		t.Error("participant still held after resume")
+	}
+}
+
+func TestIsHoldableMessage(t *testing.T) {
+	for _, msgType := range []uint8{UdpMessageTypeAudioStream, UdpMessageTypeVideoStreamIFrame, UdpMessageTypeUnicastData, UdpMessageTypeRtcp} {
+		if !isHoldableMessage(msgType) {
+			t.Errorf("message type %d not holdable", msgType)
+		}
+	}
+	//保持期间仍要维持注册和信令
+	for _, msgType := range []uint8{UdpMessageTypeTurnReg, UdpMessageTypeUserReg, UdpMessageTypeUserSignal, UdpMessageTypeHoldControl} {
+		if isHoldableMessage(msgType) {
+			t.Errorf("message type %d holdable", msgType)
+		}
+	}
+}
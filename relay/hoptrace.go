@@ -0,0 +1,97 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+逐跳时间戳：不抓包测线上一个信令或媒体包在每一跳花了多少时间。
+1. 测试客户端发包时用SetHopTrace打上UdpMessageFlagHopTrace，并在extra的UdpMessageExtraTypeHops里记下发送时间
+2. relay收到带标志的包时追加收到的时间，每次发出时在发出的那份里追加发送时间；
+   session manager同样追加收到和发出的时间，处理这个信令时发出的信令都带上
+3. 对端收到后用HopsFromMessage取出每一跳，相邻时间相减就是各段延迟。各机器的时钟偏差见clock.go
+每一跳为kind(1)+unix纳秒(8)，最多MaxHops跳，超过后不再追加。
+*/
+
+const (
+	HopClientSend = 1
+	HopRelayIn    = 2
+	HopRelayOut   = 3
+	HopSessionIn  = 4 //session manager收到
+	HopSessionOut = 5
+	HopClientRecv = 6 //客户端自己记的收到时间，不在消息里传
+
+	MaxHops = 16
+
+	hopSize = 1 + 8
+)
+
+type Hop struct {
+	Kind uint8
+	Time time.Time
+}
+
+//客户端侧：打上逐跳时间戳标志并记下发送时间
+func SetHopTrace(msg *Message, now time.Time) {
+	msg.SetFlag(UdpMessageFlagHopTrace)
+	AppendHop(msg, HopClientSend, now)
+}
+
+//消息带了UdpMessageFlagHopTrace时追加一跳，否则不做修改
+func AppendHop(msg *Message, kind uint8, t time.Time) {
+	if !msg.HasFlag(UdpMessageFlagHopTrace) {
+		return
+	}
+	var extra, hops []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+		hops = FindExtra(extra, UdpMessageExtraTypeHops)
+	}
+	if len(hops)/hopSize >= MaxHops {
+		return
+	}
+	value := make([]byte, len(hops)+hopSize)
+	copy(value, hops)
+	value[len(hops)] = kind
+	binary.BigEndian.PutUint64(value[len(hops)+1:], uint64(t.UnixNano()))
+	msg.Extra = ReplaceExtra(extra, UdpMessageExtraTypeHops, value)
+	msg.SetFlag(UdpMessageFlagExtra)
+}
+
+//消息里记录的所有跳，按经过的顺序
+func HopsFromMessage(msg *Message) []Hop {
+	if !msg.HasFlag(UdpMessageFlagHopTrace) || !msg.HasFlag(UdpMessageFlagExtra) {
+		return nil
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeHops)
+	hops := make([]Hop, 0, len(value)/hopSize)
+	for p := 0; p+hopSize <= len(value); p += hopSize {
+		hops = append(hops, Hop{Kind: value[p], Time: time.Unix(0, int64(binary.BigEndian.Uint64(value[p+1:p+hopSize])))})
+	}
+	return hops
+}
+
+//把from里已有的跳带到另一个消息上，用于session manager处理信令后新发出的信令
+func CopyHops(msg *Message, from *Message) {
+	if !from.HasFlag(UdpMessageFlagHopTrace) || !from.HasFlag(UdpMessageFlagExtra) {
+		return
+	}
+	hops := FindExtra(from.Extra, UdpMessageExtraTypeHops)
+	if hops == nil {
+		return
+	}
+	var extra []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+	}
+	msg.Extra = ReplaceExtra(extra, UdpMessageExtraTypeHops, hops)
+	msg.SetFlag(UdpMessageFlagExtra | UdpMessageFlagHopTrace)
+}
@@ -0,0 +1,54 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHopTrace(t *testing.T) {
+	t0 := time.Unix(1500000000, 0)
+	msg := NewMessage(UdpMessageTypeUserSignal, 1001, SessionManagerUid, 0, []byte("{}"), nil)
+	AppendHop(msg, HopRelayIn, t0)
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		t.Fatal("hop appended without trace flag")
+	}
+
+	SetCapabilities(msg, CapabilityTraceContext)
+	SetHopTrace(msg, t0)
+	received, err := NewMessageFromObfuscatedData(msg.ObfuscatedDataOfMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	AppendHop(received, HopRelayIn, t0.Add(20*time.Millisecond))
+	AppendHop(received, HopRelayOut, t0.Add(21*time.Millisecond))
+
+	forwarded := NewMessage(UdpMessageTypeUserSignal, SessionManagerUid, 1002, 0, []byte("{}"), nil)
+	CopyHops(forwarded, received)
+	hops := HopsFromMessage(forwarded)
+	want := []Hop{{HopClientSend, t0}, {HopRelayIn, t0.Add(20 * time.Millisecond)}, {HopRelayOut, t0.Add(21 * time.Millisecond)}}
+	if len(hops) != len(want) {
+		t.Fatalf("hops = %v, want %v", hops, want)
+	}
+	for i := range hops {
+		if hops[i].Kind != want[i].Kind || !hops[i].Time.Equal(want[i].Time) {
+			t.Errorf("hop %d = %v, want %v", i, hops[i], want[i])
+		}
+	}
+	if CapabilitiesFromMessage(received) != CapabilityTraceContext {
+		t.Error("other extra lost")
+	}
+
+	for i := 0; i < 2*MaxHops; i++ {
+		AppendHop(forwarded, HopRelayIn, t0)
+	}
+	if n := len(HopsFromMessage(forwarded)); n != MaxHops {
+		t.Errorf("%d hops, want at most %d", n, MaxHops)
+	}
+}
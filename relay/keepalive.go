@@ -0,0 +1,195 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+注册保活间隔：relay上的用户注册10分钟过期，但客户端常在NAT后面，很多NAT的udp映射30秒左右没有流量就回收了，
+映射没了relay的下行信令就到不了。服务器和客户端分开处理：
+1. session manager、sip gateway、webrtc bridge等服务器有固定地址，按ServerRegInterval定期重新注册，不探测
+2. 客户端启动时用ProbeNatBinding探测映射的存活时间：每个候选时长开一个新socket注册后发KeepaliveProbe，
+   payload为2字节的秒数，relay等这么久后从原地址回KeepaliveProbeAck，收到说明映射活过了这段时间。
+   各候选并发进行，探测耗时为最大的候选时长
+3. KeepaliveInterval按探测结果留出余量，在[ClientKeepaliveMin, ClientKeepaliveMax]内取值，探测失败时用最小值
+开了access控制时和NetProbe一样，只接受已注册用户的探测；每个地址同时只有一个等待中的探测，总数也有上限。
+*/
+
+const (
+	ServerRegInterval = 60 * time.Second //服务器的重新注册间隔
+
+	ClientKeepaliveMin = 15 * time.Second
+	ClientKeepaliveMax = 240 * time.Second
+
+	KeepaliveProbeMaxDelay = 300 * time.Second
+	KeepaliveMaxPending    = 1000 //relay上等待回复的探测总数
+)
+
+//ProbeNatBinding默认探测的时长
+var DefaultKeepaliveProbeDelays = []time.Duration{
+	20 * time.Second, 30 * time.Second, 45 * time.Second, 60 * time.Second,
+	90 * time.Second, 120 * time.Second, 180 * time.Second, 240 * time.Second, 300 * time.Second,
+}
+
+//按探测到的映射存活时间给出客户端的保活间隔，lifetime为0表示探测失败
+func KeepaliveInterval(lifetime time.Duration) time.Duration {
+	interval := lifetime * 3 / 4
+	if interval < ClientKeepaliveMin {
+		return ClientKeepaliveMin
+	}
+	if interval > ClientKeepaliveMax {
+		return ClientKeepaliveMax
+	}
+	return interval
+}
+
+func (s *Service) handleMessageKeepaliveProbe(msg *Message, packet *ReceivedPacket) {
+	if s.config.AccessSecret != "" && s.users[msg.From] == nil {
+		return
+	}
+	if len(msg.Payload) != 2 {
+		return
+	}
+	delay := time.Duration(binary.BigEndian.Uint16(msg.Payload)) * time.Second
+	if delay > KeepaliveProbeMaxDelay {
+		return
+	}
+	key := packet.FromUdpAddr.String()
+	if s.keepaliveProbes[key] || len(s.keepaliveProbes) >= KeepaliveMaxPending {
+		return
+	}
+	s.keepaliveProbes[key] = true
+
+	payload := make([]byte, 2)
+	copy(payload, msg.Payload)
+	ack := NewMessage(UdpMessageTypeKeepaliveProbeAck, msg.From, msg.To, 0, payload, nil)
+	ack.Tid = msg.Tid
+	addr := packet.FromUdpAddr
+	time.AfterFunc(delay, func() {
+		select {
+		case s.adminCh <- func() {
+			delete(s.keepaliveProbes, key)
+			s.sendMessage(ack, addr)
+		}:
+		case <-s.stop:
+		}
+	})
+}
+
+//探测到relay的NAT映射存活时间：返回delays中最大的d，使不超过d的候选都收到了回复；最短的也没收到时返回0
+//secret为空时不带access token，delays为nil时用DefaultKeepaliveProbeDelays
+func ProbeNatBinding(addr string, secret string, delays []time.Duration) (time.Duration, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return 0, err
+	}
+	if delays == nil {
+		delays = DefaultKeepaliveProbeDelays
+	}
+	delays = append([]time.Duration(nil), delays...)
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+
+	alive := make([]bool, len(delays))
+	errs := make([]error, len(delays))
+	var wg sync.WaitGroup
+	for i := range delays {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			alive[i], errs[i] = probeNatBinding(raddr, secret, delays[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return natBindingLifetime(delays, alive), nil
+}
+
+//delays已排序，第一个没有回复的候选之前的最大值
+func natBindingLifetime(delays []time.Duration, alive []bool) time.Duration {
+	var lifetime time.Duration
+	for i, d := range delays {
+		if !alive[i] {
+			break
+		}
+		lifetime = d
+	}
+	return lifetime
+}
+
+//用一个新socket探测一个时长，返回是否收到了回复
+func probeNatBinding(raddr *net.UDPAddr, secret string, delay time.Duration) (bool, error) {
+	if delay > KeepaliveProbeMaxDelay {
+		return false, errors.New("keepalive probe delay too long")
+	}
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var token []byte
+	if secret != "" {
+		token = IssueAccessToken(secret, ProbeUid, time.Now().Add(AccessTokenTTL))
+	}
+	reg := NewMessage(UdpMessageTypeUserReg, ProbeUid, 0, 0, token, nil)
+	if _, err := conn.Write(reg.ObfuscatedDataOfMessage()); err != nil {
+		return false, err
+	}
+	msg, err := readMessage(conn, time.Now().Add(time.Second))
+	if err != nil {
+		return false, errors.New("no reply from relay")
+	}
+	if msg.MsgType == UdpMessageTypeUserRegRejected {
+		return false, errors.New("registration rejected, access_secret required")
+	}
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(delay/time.Second))
+	probe := NewMessage(UdpMessageTypeKeepaliveProbe, ProbeUid, 0, 0, payload, nil)
+	if _, err := conn.Write(probe.ObfuscatedDataOfMessage()); err != nil {
+		return false, err
+	}
+	deadline := time.Now().Add(delay + 2*time.Second)
+	for {
+		msg, err := readMessage(conn, deadline)
+		if err != nil {
+			return false, nil //超时，映射在这段时间内失效了
+		}
+		if msg.MsgType == UdpMessageTypeKeepaliveProbeAck {
+			return true, nil
+		}
+	}
+}
+
+//读一个能解析的消息，deadline之前没有时返回错误
+func readMessage(conn *net.UDPConn, deadline time.Time) (*Message, error) {
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := NewMessageFromObfuscatedData(buf[:n])
+		if err == nil {
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveInterval(t *testing.T) {
+	cases := []struct {
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{0, ClientKeepaliveMin},
+		{15 * time.Second, ClientKeepaliveMin},
+		{60 * time.Second, 45 * time.Second},
+		{300 * time.Second, 225 * time.Second},
+		{time.Hour, ClientKeepaliveMax},
+	}
+	for _, c := range cases {
+		if got := KeepaliveInterval(c.lifetime); got != c.want {
+			t.Errorf("KeepaliveInterval(%v) = %v, want %v", c.lifetime, got, c.want)
+		}
+	}
+}
+
+func TestNatBindingLifetime(t *testing.T) {
+	delays := []time.Duration{20 * time.Second, 30 * time.Second, 60 * time.Second, 120 * time.Second}
+	if got := natBindingLifetime(delays, []bool{true, true, false, true}); got != 30*time.Second {
+		t.Errorf("lifetime = %v, want 30s", got) //更长的候选偶然收到也不算
+	}
+	if got := natBindingLifetime(delays, []bool{false, true, true, true}); got != 0 {
+		t.Errorf("lifetime = %v, want 0", got)
+	}
+	if got := natBindingLifetime(delays, []bool{true, true, true, true}); got != 120*time.Second {
+		t.Errorf("lifetime = %v, want 120s", got)
+	}
+}
+
+func TestKeepaliveProbePending(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	packet := &ReceivedPacket{FromUdpAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}}
+	probe := func(seconds uint16) {
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, seconds)
+		s.handleMessageKeepaliveProbe(NewMessage(UdpMessageTypeKeepaliveProbe, ProbeUid, 0, 0, payload, nil), packet)
+	}
+
+	probe(uint16(KeepaliveProbeMaxDelay/time.Second) + 1)
+	if len(s.keepaliveProbes) != 0 {
+		t.Fatal("probe with too long delay accepted")
+	}
+
+	probe(0)
+	probe(0) //同一地址已有等待中的探测
+	if len(s.keepaliveProbes) != 1 {
+		t.Fatalf("pending probes = %d, want 1", len(s.keepaliveProbes))
+	}
+	select {
+	case <-s.adminCh:
+	case <-time.After(time.Second):
+		t.Fatal("probe reply not scheduled")
+	}
+	select {
+	case <-s.adminCh:
+		t.Error("duplicate probe scheduled")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -9,10 +9,11 @@ package relay
 
 import (
 	"encoding/binary"
-	"errors"
 	"net"
+	"time"
 
 	"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/errs"
 	"github.com/xujiajundd/ycng/utils/logging"
 )
 
@@ -30,6 +31,18 @@ const (
 	UdpMessageTypeTurnInfo          = 5  //1-1时，回复给各方的外网地址
 	UdpMessageTypeTurnProbe         = 6  //p2p探测包
 	UdpMessageTypeTurnProbeAck      = 7  //p2p探测回复包
+	UdpMessageTypeKeyExchange       = 8  //已废弃，公钥改在UserReg里带，见crypto.go
+	UdpMessageTypeKeyExchangeAck    = 9  //已废弃
+	UdpMessageTypeNetProbe          = 10 //通话前网络探测包，同一Tseq成对发送，见netprobe.go
+	UdpMessageTypeNetProbeAck       = 11 //relay对探测包的确认，不带payload，客户端据此算RTT
+	UdpMessageTypeNetProbeEnd       = 12 //探测结束，请求relay给出估计结果
+	UdpMessageTypeNetProbeResult    = 13 //relay回复的探测结果，见extra中的ProbeResult
+	UdpMessageTypeKeepaliveProbe    = 14 //NAT映射存活时间探测，payload为2字节的秒数，见keepalive.go
+	UdpMessageTypeKeepaliveProbeAck = 15 //relay等待payload中的秒数后回复
+	UdpMessageTypeEcho              = 16 //请求relay把自己发的媒体原样发回来，payload为2字节的秒数，见echo.go
+	UdpMessageTypeEchoAck           = 17 //payload为实际生效的秒数
+	UdpMessageTypeMtuProbe          = 18 //relay注册后发给客户端的路径MTU探测，payload开头2字节为整包大小，见mtu.go
+	UdpMessageTypeMtuProbeAck       = 19 //客户端对收到的探测的确认，payload为探测开头的2字节
 	UdpMessageTypeAudioStream       = 20 //音频包
 	UdpMessageTypeVideoStream       = 30 //视频包
 	UdpMessageTypeVideoStreamIFrame = 31 //视频i帧
@@ -38,6 +51,7 @@ const (
 	UdpMessageTypeVideoOnlyIFrame   = 34 //视频只收i帧
 	UdpMessageTypeVideoOnlyAudio    = 35 //视频只收音频
 	UdpMessageTypeMediaControl      = 40 //向relay提交所需媒体信息，如需要那些人的视频流，是需要大图还是小图，是否需要音频补偿，是否只要音频不要视频，是否只要视频i帧等。
+	UdpMessageTypeRtcp              = 41 //RTP模式下的RTCP反馈包，payload为RTCP compound packet
 
 	UdpMessageTypeThumbVideoStream       = 50 //缩略图视频包
 	UdpMessageTypeThumbVideoStreamIFrame = 51 //缩略图视频i帧
@@ -52,18 +66,53 @@ const (
 	UdpMessageTypeUserReg         = 200 //注册一个客户端
 	UdpMessageTypeUserRegReceived = 201
 	UdpMessageTypeUserSignal      = 202 //通过UDP来转发的信令，信令统一在push中定义
+	UdpMessageTypeUserRegRejected = 203 //access token校验失败
+
+	UdpMessageTypeRecordControl   = 210 //session manager通知relay开始/停止录制某个session的媒体
+	UdpMessageTypeHoldControl     = 211 //session manager通知relay暂停/恢复某个参与者的媒体转发，见hold.go
+	UdpMessageTypeSessionControl  = 212 //session manager通知relay通话建立(成员和允许的媒体)/拆除，见session_control.go
+	UdpMessageTypeRelayDrain      = 213 //relay通知session manager进入/退出排空状态，见drain.go
+	UdpMessageTypeHandoverControl = 214 //session manager通知relay参与者的通话已切换到另一个设备，见handover.go
+	UdpMessageTypeVoicemailDone   = 215 //relay通知session manager留言录制完成，见voicemail.go
+	UdpMessageTypeQualityReport   = 216 //relay通知session manager参与者的通话质量(MOS)，见mos.go
+	UdpMessageTypePresence        = 217 //relay通知session manager用户注册上线或过期下线，见presence.go
+	UdpMessageTypeSessionStats    = 218 //relay通知session manager session的转发包数、字节和服务的参与者数，见session_stats.go
 )
 
 const (
-	UdpMessageFlagExtra = 1 << 0
-	UdpMessageFlagDest  = 1 << 1
-	UdpMessageFlagGZip  = 1 << 2
+	SessionManagerUid = -2 //控制类消息只接受来自session manager的
+
+	MaxMessageSize = 65507 //udp单个包的最大payload，超过的不可能是合法消息
 )
 
 const (
-	UdpMessageExtraTypeMetrix = 1
+	UdpMessageFlagExtra       = 1 << 0
+	UdpMessageFlagDest        = 1 << 1
+	UdpMessageFlagGZip        = 1 << 2
+	UdpMessageFlagRtp         = 1 << 3 //媒体payload是标准RTP包
+	UdpMessageFlagEncrypted   = 1 << 4 //payload和extra已用链路密钥加密
+	UdpMessageFlagProtoSignal = 1 << 5 //信令payload为protobuf编码，见signal_proto.go
+	UdpMessageFlagFragment    = 1 << 6 //信令分片，见fragment.go
+	UdpMessageFlagHopTrace    = 1 << 7 //各跳在extra里追加时间戳，见hoptrace.go
+)
 
-	YCKMetrixDataTypeUp = 2
+const (
+	UdpMessageExtraTypeMetrix       = 1
+	UdpMessageExtraTypeAudioLevel   = 2  //音频包的音量，1字节，同RFC6464
+	UdpMessageExtraTypeTrace        = 3  //OpenTelemetry的trace上下文，trace id(16)+span id(8)+flags(1)
+	UdpMessageExtraTypeCapabilities = 4  //能力位图，4字节，见capability.go
+	UdpMessageExtraTypeFragment     = 5  //信令分片信息，id(4)+index(1)+count(1)
+	UdpMessageExtraTypeProbeResult  = 6  //通话前探测结果，received(2)+bandwidth(4)，见netprobe.go
+	UdpMessageExtraTypeClientIp     = 7  //relay转给session manager的信令上附带的发送方公网ip，4或16字节
+	UdpMessageExtraTypeDevice       = 8  //设备id，客户端带的是自己的，session manager带的是目标设备，见devices.go
+	UdpMessageExtraTypeClock        = 9  //UserReg带发送时间(8)，UserRegReceived回带发送时间(8)+relay收到的时间(8)，unix纳秒，见clock.go
+	UdpMessageExtraTypeHops         = 10 //逐跳时间戳，每跳kind(1)+unix纳秒(8)，见hoptrace.go
+	UdpMessageExtraTypeObfKey       = 11 //UserRegReceived带的当前混淆密钥，id(1)+剩余grace秒数(4)+secret，见obfkey.go
+	UdpMessageExtraTypeNetwork      = 12 //设备类型(1)+网络类型(1)，客户端在UserReg里带，relay附在转给session manager的信令上，见network.go
+	UdpMessageExtraTypeMtu          = 13 //relay附在转给session manager的信令上的发送方路径MTU，2字节，见mtu.go
+
+	YCKMetrixDataTypeUp  = 2
+	YCKMetrixDataTypeRtt = 3 //客户端在媒体包上报自己测得的RTT，rtt毫秒(2)，见metrics_export.go
 )
 
 type Message struct {
@@ -78,6 +127,8 @@ type Message struct {
 	Dest      int64
 	Payload   []byte
 	Extra     []byte
+
+	wire *wireImage //收到的整包，可以快速转发时才有，见forward.go
 }
 
 type ReceivedPacket struct {
@@ -113,23 +164,63 @@ func NewMessage(msgType uint8, from int64, to int64, dest int64, payload []byte,
 	return msg
 }
 
+//按key id选择混淆密钥，见obfkey.go
 func NewMessageFromObfuscatedData(obf []byte) (*Message, error) {
+	message, _, err := parseObfuscated(obf)
+	return message, err
+}
+
+//同NewMessageFromObfuscatedData，另外返回解混淆用的密钥，nil为内置字典
+func parseObfuscated(obf []byte) (*Message, *ObfuscationKey, error) {
+	keys := loadObfuscationKeys()
+	now := time.Now()
+	if key := keys.accepted(obf, now); key != nil {
+		message := &Message{}
+		if err := message.Unmarshal(utils.DataFromObfuscatedWithDict(obf[1:], key.dict)); err == nil {
+			return message, key, nil
+		}
+		//内置字典格式的混淆头碰巧和key id相同
+	}
+	if !keys.legacy(now) {
+		return nil, nil, errObfuscationKey
+	}
+
 	message := &Message{}
 	data := utils.DataFromObfuscated(obf)
 	err := message.Unmarshal(data)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return message, nil
+	return message, nil, nil
 }
 
 func (m *Message) ObfuscatedDataOfMessage() []byte {
-	data := m.Marshal()
-	obf := utils.ObfuscateData(data)
+	return m.ObfuscatedDataOfMessageTo(nil)
+}
 
-	return obf
+//同ObfuscatedDataOfMessage，但尽量写到buf里，buf容量不够时才分配
+func (m *Message) ObfuscatedDataOfMessageTo(buf []byte) []byte {
+	key := loadObfuscationKeys().sending(time.Now())
+	header := 2
+	if key != nil {
+		header = 3
+	}
+	size := header + m.MarshalLen()
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	m.MarshalTo(buf[header:])
+	if key != nil {
+		buf[0] = key.Id
+		utils.ObfuscateInPlaceWithDict(buf[1:], key.dict)
+	} else {
+		utils.ObfuscateInPlace(buf)
+	}
+
+	return buf
 }
 
 func (m *Message) Unmarshal(data []byte) error {
@@ -137,7 +228,10 @@ func (m *Message) Unmarshal(data []byte) error {
 	p := 0
 
 	if len < 26 {
-		return errors.New("incorrect packet, len < 26")
+		return errs.New(errs.Malformed, "incorrect packet, len < 26")
+	}
+	if len > MaxMessageSize {
+		return errs.New(errs.TooLarge, "incorrect packet, too large")
 	}
 	m.Tseq = int16(binary.BigEndian.Uint16(data[p : p+2]))
 	p += 2
@@ -166,17 +260,18 @@ func (m *Message) Unmarshal(data []byte) error {
 	}
 
 	if m.HasFlag(UdpMessageFlagDest) {
-		if len >= p+8 {
-			m.Dest = int64(binary.BigEndian.Uint64(data[p : p+8]))
-			p += 8
+		if len < p+8 {
+			return errs.New(errs.Malformed, "incorrect packet len for Dest")
 		}
+		m.Dest = int64(binary.BigEndian.Uint64(data[p : p+8]))
+		p += 8
 	}
 
-	var payloadLen uint16
-	if len >= p+2 {
-		payloadLen = binary.BigEndian.Uint16(data[p : p+2])
-		p += 2
+	if len < p+2 {
+		return errs.New(errs.Malformed, "incorrect packet len for Payload len")
 	}
+	payloadLen := binary.BigEndian.Uint16(data[p : p+2])
+	p += 2
 
 	if len >= p+int(payloadLen) {
 		//TODO; 这个地方是copy呢？还是直接这样呢? 貌似不copy也是可以的。
@@ -186,21 +281,21 @@ func (m *Message) Unmarshal(data []byte) error {
 		p += int(payloadLen)
 	} else {
 		logging.Logger.Warn("Message Unmarshal error from ", m.From, " type ", m.MsgType, " len ", len, " payloadLen ", payloadLen, " for data ", data)
-		return errors.New("incorrect packet len for Payload from ")
+		return errs.New(errs.Malformed, "incorrect packet len for Payload from ")
 	}
 
 	if m.HasFlag(UdpMessageFlagExtra) {
-		var extraLen uint16
-		if len >= p+2 {
-			extraLen = binary.BigEndian.Uint16(data[p : p+2])
-			p += 2
+		if len < p+2 {
+			return errs.New(errs.Malformed, "incorrect packet len for Extra len")
 		}
+		extraLen := binary.BigEndian.Uint16(data[p : p+2])
+		p += 2
 		if len >= p+int(extraLen) {
 			m.Extra = data[p : p+int(extraLen)]
 			p += int(extraLen)
 		} else {
 			logging.Logger.Warn("Message Unmarshal error from ", m.From, " type", m.MsgType, " len ", len, " extraLen ", extraLen, " for data ", data)
-			return errors.New("incorrect packet len for Extra")
+			return errs.New(errs.Malformed, "incorrect packet len for Extra")
 		}
 	}
 
@@ -208,6 +303,10 @@ func (m *Message) Unmarshal(data []byte) error {
 }
 
 func (m *Message) Marshal() []byte {
+	return m.MarshalTo(nil)
+}
+
+func (m *Message) MarshalLen() int {
 	messageLength := 2 + 1 + 2 + 2 + 1 + 8 + 8 + 2 + len(m.Payload)
 	if m.HasFlag(UdpMessageFlagDest) {
 		messageLength += 8
@@ -217,7 +316,16 @@ func (m *Message) Marshal() []byte {
 		messageLength += 2 + len(m.Extra)
 	}
 
-	buf := make([]byte, messageLength)
+	return messageLength
+}
+
+//序列化到buf中并返回结果，buf容量不够时才分配，收发热点路径上配合utils.GetPacketBuffer使用
+func (m *Message) MarshalTo(buf []byte) []byte {
+	messageLength := m.MarshalLen()
+	if cap(buf) < messageLength {
+		buf = make([]byte, messageLength)
+	}
+	buf = buf[:messageLength]
 	p := 0
 	binary.BigEndian.PutUint16(buf[p:p+2], uint16(m.Tseq))
 	p += 2
@@ -275,3 +383,57 @@ func (m *Message) NetTrafficSize() uint16 {
 
 	return uint16(size)
 }
+
+//extra由若干type(1)+len(2)+value组成，返回指定type的value，没有则返回nil
+func FindExtra(extra []byte, extraType uint8) []byte {
+	p := 0
+	for p+3 <= len(extra) {
+		t := extra[p]
+		l := int(binary.BigEndian.Uint16(extra[p+1 : p+3]))
+		p += 3
+		if p+l > len(extra) {
+			return nil
+		}
+		if t == extraType {
+			return extra[p : p+l]
+		}
+		p += l
+	}
+	return nil
+}
+
+//返回新的extra，其中指定type的项替换为value（原来没有则追加），不修改原extra
+func ReplaceExtra(extra []byte, extraType uint8, value []byte) []byte {
+	result := make([]byte, 0, len(extra)+3+len(value))
+	p := 0
+	for p+3 <= len(extra) {
+		l := int(binary.BigEndian.Uint16(extra[p+1 : p+3]))
+		if p+3+l > len(extra) {
+			break
+		}
+		if extra[p] != extraType {
+			result = append(result, extra[p:p+3+l]...)
+		}
+		p += 3 + l
+	}
+	result = append(result, extraType, byte(len(value)>>8), byte(len(value)))
+	result = append(result, value...)
+	return result
+}
+
+//返回去掉指定type的项后的extra，不修改原extra
+func RemoveExtra(extra []byte, extraType uint8) []byte {
+	result := make([]byte, 0, len(extra))
+	p := 0
+	for p+3 <= len(extra) {
+		l := int(binary.BigEndian.Uint16(extra[p+1 : p+3]))
+		if p+3+l > len(extra) {
+			break
+		}
+		if extra[p] != extraType {
+			result = append(result, extra[p:p+3+l]...)
+		}
+		p += 3 + l
+	}
+	return result
+}
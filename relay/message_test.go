@@ -0,0 +1,128 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/xujiajundd/ycng/utils"
+)
+
+func TestMessage_MarshalTo(t *testing.T) {
+	msg := NewMessage(UdpMessageTypeAudioStream, 1, 2, 3, []byte("payload"), []byte{1, 0, 1, 9})
+	want := msg.Marshal()
+
+	buf := utils.GetPacketBuffer(0)
+	got := msg.MarshalTo(buf)
+	if !bytes.Equal(got, want) || cap(got) != utils.PacketBufferSize {
+		t.Fatalf("MarshalTo should reuse buf and match Marshal")
+	}
+	utils.PutPacketBuffer(buf)
+
+	obf := msg.ObfuscatedDataOfMessageTo(make([]byte, 0, 4))
+	decoded, err := NewMessageFromObfuscatedData(obf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.From != 1 || decoded.To != 2 || decoded.Dest != 3 || string(decoded.Payload) != "payload" || !bytes.Equal(decoded.Extra, msg.Extra) {
+		t.Fatalf("bad decoded message: %+v", decoded)
+	}
+}
+
+//每次迭代模拟一秒50k pps的收发：复制收包、解析、序列化并混淆后发出
+const benchPacketsPerSecond = 50000
+
+func benchmarkPacketPath(b *testing.B, pooled bool) {
+	msg := NewMessage(UdpMessageTypeAudioStream, 1, 2, 0, make([]byte, 160), nil)
+	wire := msg.ObfuscatedDataOfMessage()
+	var sink int
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchPacketsPerSecond; j++ {
+			var body []byte
+			if pooled {
+				body = utils.GetPacketBuffer(len(wire))
+			} else {
+				body = make([]byte, len(wire))
+			}
+			copy(body, wire)
+
+			m, err := NewMessageFromObfuscatedData(body)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if pooled {
+				buf := utils.GetPacketBuffer(0)
+				sink += len(m.ObfuscatedDataOfMessageTo(buf))
+				utils.PutPacketBuffer(buf)
+				utils.PutPacketBuffer(body)
+			} else {
+				sink += len(m.ObfuscatedDataOfMessage())
+			}
+		}
+	}
+	_ = sink
+}
+
+func TestClientIpExtra(t *testing.T) {
+	for _, ip := range []net.IP{net.IPv4(203, 0, 113, 7), net.ParseIP("2001:db8::1")} {
+		msg := NewMessage(UdpMessageTypeUserSignal, 1001, SessionManagerUid, 0, []byte("{}"), nil)
+		SetCapabilities(msg, RelayCapabilities)
+		SetClientIp(msg, ip)
+		got, err := NewMessageFromObfuscatedData(msg.ObfuscatedDataOfMessage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed := ClientIpFromMessage(got); !parsed.Equal(ip) {
+			t.Errorf("client ip = %v, want %v", parsed, ip)
+		}
+		if CapabilitiesFromMessage(got) != RelayCapabilities {
+			t.Error("capabilities lost")
+		}
+	}
+	if ClientIpFromMessage(NewMessage(UdpMessageTypeUserSignal, 1001, SessionManagerUid, 0, nil, nil)) != nil {
+		t.Error("client ip parsed from message without extra")
+	}
+}
+
+func TestNetworkExtra(t *testing.T) {
+	msg := NewMessage(UdpMessageTypeUserSignal, 1001, SessionManagerUid, 0, []byte("{}"), nil)
+	SetClientIp(msg, net.IPv4(203, 0, 113, 7))
+	SetNetwork(msg, NetworkInfo{DeviceType: DeviceTypePhone, NetworkType: NetworkTypeWifi})
+	SetNetwork(msg, NetworkInfo{DeviceType: DeviceTypePhone, NetworkType: NetworkTypeCellular})
+	got, err := NewMessageFromObfuscatedData(msg.ObfuscatedDataOfMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, ok := NetworkFromMessage(got)
+	if !ok || n.DeviceName() != "phone" || n.NetworkName() != "cellular" {
+		t.Errorf("network = %+v %v", n, ok)
+	}
+	if ClientIpFromMessage(got) == nil {
+		t.Error("client ip lost")
+	}
+	if _, ok := NetworkFromMessage(NewMessage(UdpMessageTypeUserSignal, 1001, SessionManagerUid, 0, nil, nil)); ok {
+		t.Error("network parsed from message without extra")
+	}
+	if (NetworkInfo{DeviceType: 200}).DeviceName() != "" {
+		t.Error("unknown device type has a name")
+	}
+}
+
+func BenchmarkPacketPath_50kpps(b *testing.B) {
+	benchmarkPacketPath(b, false)
+}
+
+func BenchmarkPacketPath_50kpps_Pooled(b *testing.B) {
+	benchmarkPacketPath(b, true)
+}
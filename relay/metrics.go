@@ -10,6 +10,7 @@ package relay
 import (
 	"encoding/binary"
 	"github.com/xujiajundd/ycng/utils/logging"
+	"math"
 	"time"
 )
 
@@ -24,6 +25,8 @@ type MetrixDataUp struct {
 	PRecv             int16
 	LastSendTimestamp int16
 	Rdelay            uint8
+	Dup               int16 //Dup和Rtt不编码进extra，只用于导出，见metrics_export.go
+	Rtt               int16
 }
 
 func (md *MetrixDataUp) Marshal() []byte {
@@ -81,6 +84,12 @@ type Metrics struct {
 	sumDataNack2       int
 	sumDataNack3       int
 	sumDataPacketsNum  int
+	rtt                int16
+	jitter             float64 //音频包的到达间隔抖动（RFC 3550），毫秒，见mos.go
+	lastArrival        int64
+	lastSendTs         uint16
+	loss               float64 //各统计窗口丢包率的平滑值
+	lossWindows        int
 }
 
 func NewMetrics() *Metrics {
@@ -129,10 +138,16 @@ func (m *Metrics) Process(msg *Message, timestamp int64) (ok bool, data *MetrixD
 	m.stat[m.pos].bytes = msg.NetTrafficSize()
 	currentTimestamp := timestamp
 	m.stat[m.pos].timestamp = currentTimestamp
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		if v := FindExtra(msg.Extra, UdpMessageExtraTypeMetrix); len(v) == 3 && v[0] == YCKMetrixDataTypeRtt {
+			m.rtt = int16(binary.BigEndian.Uint16(v[1:3]))
+		}
+	}
 
 	switch msg.MsgType {
 	case UdpMessageTypeAudioStream:
 		m.sumPacketAudio++
+		m.updateJitter(msg.Timestamp, currentTimestamp)
 	case UdpMessageTypeVideoStream:
 		m.sumPacketVideo++
 	case UdpMessageTypeVideoStreamIFrame:
@@ -244,6 +259,9 @@ func (m *Metrics) Process(msg *Message, timestamp int64) (ok bool, data *MetrixD
 			dataUp.PRecv = int16(packetRecv)
 			dataUp.LastSendTimestamp = int16(msg.Timestamp)
 			dataUp.Rdelay = 0
+			dataUp.Dup = int16(packetDup)
+			dataUp.Rtt = m.rtt
+			m.updateLoss(packetShould, packetRecv)
 		}
 
 		//m.pos = 0  //上一批的最后5个，在下一批继续用于计算，在间隙性分批收包的情况下，有助于计算带宽
@@ -264,6 +282,34 @@ func (m *Metrics) Process(msg *Message, timestamp int64) (ok bool, data *MetrixD
 	}
 }
 
+//发送时间戳是客户端的毫秒数（uint16回绕），D为相邻两个包到达间隔和发送间隔的差
+func (m *Metrics) updateJitter(sendTs uint16, arrival int64) {
+	if m.lastArrival != 0 {
+		d := float64(arrival-m.lastArrival)/float64(time.Millisecond) - float64(int16(sendTs-m.lastSendTs))
+		m.jitter += (math.Abs(d) - m.jitter) / 16
+	}
+	m.lastArrival = arrival
+	m.lastSendTs = sendTs
+}
+
+func (m *Metrics) updateLoss(should int16, recv int) {
+	loss := 1 - float64(recv)/float64(should)
+	if loss < 0 {
+		loss = 0
+	}
+	if m.lossWindows == 0 {
+		m.loss = loss
+	} else {
+		m.loss += (loss - m.loss) / 8
+	}
+	m.lossWindows++
+}
+
+//还没有统计窗口时ok为false
+func (m *Metrics) Quality() (loss float64, jitter float64, rtt int16, ok bool) {
+	return m.loss, m.jitter, m.rtt, m.lossWindows > 0
+}
+
 func (m *Metrics) ProcessNack(msg *Message, seqid int16, n_tries uint8, packets_num int) {
 	if msg.MsgType == UdpMessageTypeThumbVideoNack {
 		m.sumThumbNack++
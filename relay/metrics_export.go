@@ -0,0 +1,383 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+媒体质量指标导出：每个上行流的窗口统计（Metrics.Process的结果）发到时序库，用来做全网的媒体质量看板。
+1. config.MetricsExport为导出地址，为空时不导出，https的用influxs://和proms://：
+     influx://host:port/db      InfluxDB 1.x的/write接口（2.x的v1兼容接口也可以），line protocol，measurement为ycng_stream
+     prom://host:port/path      Prometheus remote write，如prom://host:9090/api/v1/write，protobuf+snappy，
+                                自己编码，不引入客户端库；指标名为ycng_stream_加字段名
+2. 每个窗口一个样本，标签为relay（本机hostname）、sid、uid（发送方）和stream（audio、video、thumb或data），
+   字段为bandwidth（kbps，算不出时不带）、loss（丢包率）、dup（重复包数）、recv、should和rtt（毫秒，客户端上报了才有）
+3. RTT由客户端测：relay在下行包的metrix extra里回带上行包的发送时间戳，客户端据此算出RTT，
+   再在媒体包的metrix extra里带YCKMetrixDataTypeRtt(1)+rtt毫秒(2)上报，relay记下最近一次的值
+4. 样本进队列，后台goroutine每MetricsExportPeriod或攒够MetricsExportBatch个发一次；发送失败丢弃这一批不重试，
+   下个窗口又有新样本；队列满时丢弃新样本
+*/
+
+const (
+	MetricsExportQueueSize = 8192
+	MetricsExportBatch     = 500
+	MetricsExportPeriod    = 10 * time.Second
+	MetricsExportTimeout   = 5 * time.Second
+)
+
+type StreamSample struct {
+	Time      time.Time
+	Sid       int64
+	Uid       int64
+	Stream    string
+	Bandwidth int32 //kbps，-1为算不出
+	Should    int16
+	Recv      int16
+	Dup       int16
+	Rtt       int16 //毫秒，0为客户端没上报
+}
+
+func (sample *StreamSample) Loss() float64 {
+	if sample.Should <= 0 || sample.Recv >= sample.Should {
+		return 0
+	}
+	return 1 - float64(sample.Recv)/float64(sample.Should)
+}
+
+func streamOf(msgType uint8) string {
+	switch msgType {
+	case UdpMessageTypeAudioStream:
+		return "audio"
+	case UdpMessageTypeVideoStream, UdpMessageTypeVideoStreamIFrame:
+		return "video"
+	case UdpMessageTypeThumbVideoStream, UdpMessageTypeThumbVideoStreamIFrame:
+		return "thumb"
+	}
+	return "data"
+}
+
+//导出的连接，只在MetricsExporter的goroutine里调用
+type metricsSink interface {
+	send(host string, samples []*StreamSample) error
+	String() string
+}
+
+var errMetricsExportScheme = errors.New("unsupported metrics export url, want influx://host:port/db or prom://host:port/path")
+
+type MetricsExporter struct {
+	sink    metricsSink
+	host    string
+	queue   chan *StreamSample
+	dropped uint64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func OpenMetricsExporter(url string) (*MetricsExporter, error) {
+	var sink metricsSink
+	var err error
+	switch {
+	case strings.HasPrefix(url, "influx://"), strings.HasPrefix(url, "influxs://"):
+		sink, err = newInfluxSink(url)
+	case strings.HasPrefix(url, "prom://"), strings.HasPrefix(url, "proms://"):
+		sink, err = newPromSink(url)
+	default:
+		err = errMetricsExportScheme
+	}
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &MetricsExporter{
+		sink:  sink,
+		host:  host,
+		queue: make(chan *StreamSample, MetricsExportQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+func (e *MetricsExporter) Start() {
+	go e.run()
+}
+
+//发完队列里已有的样本再返回
+func (e *MetricsExporter) Stop() {
+	close(e.stop)
+	<-e.done
+}
+
+//不阻塞，可以在任意goroutine里调用
+func (e *MetricsExporter) Add(sample *StreamSample) {
+	select {
+	case e.queue <- sample:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+func (e *MetricsExporter) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+func (e *MetricsExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(MetricsExportPeriod)
+	defer ticker.Stop()
+
+	var batch []*StreamSample
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.sink.send(e.host, batch); err != nil {
+			logging.Logger.Warn("metrics export to ", e.sink, " drop ", len(batch), " samples:", err)
+			atomic.AddUint64(&e.dropped, uint64(len(batch)))
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case sample := <-e.queue:
+			batch = append(batch, sample)
+			if len(batch) >= MetricsExportBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case sample := <-e.queue:
+					batch = append(batch, sample)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+//Metrics.Process算出一个窗口后调用
+func (s *Service) exportStreamMetrics(sid int64, msg *Message, data *MetrixDataUp, packetTime int64) {
+	if s.exporter == nil {
+		return
+	}
+	s.exporter.Add(&StreamSample{
+		Time:      time.Unix(0, packetTime),
+		Sid:       sid,
+		Uid:       msg.From,
+		Stream:    streamOf(msg.MsgType),
+		Bandwidth: data.Bandwidth,
+		Should:    data.PShould,
+		Recv:      data.PRecv,
+		Dup:       data.Dup,
+		Rtt:       data.Rtt,
+	})
+}
+
+//url的scheme换成http或https，s结尾的为https
+func httpUrl(url string, scheme string) string {
+	if strings.HasPrefix(url, scheme+"s://") {
+		return "https://" + strings.TrimPrefix(url, scheme+"s://")
+	}
+	return "http://" + strings.TrimPrefix(url, scheme+"://")
+}
+
+func postMetrics(client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+type influxSink struct {
+	url    string //写入接口的完整地址
+	client *http.Client
+}
+
+func newInfluxSink(url string) (*influxSink, error) {
+	base := httpUrl(url, "influx")
+	i := strings.LastIndex(base, "/")
+	if i < len("https://") || i == len(base)-1 {
+		return nil, errMetricsExportScheme
+	}
+	return &influxSink{
+		url:    base[:i] + "/write?precision=ns&db=" + base[i+1:],
+		client: &http.Client{Timeout: MetricsExportTimeout},
+	}, nil
+}
+
+func (i *influxSink) String() string {
+	return i.url
+}
+
+func (i *influxSink) send(host string, samples []*StreamSample) error {
+	return postMetrics(i.client, i.url, influxLines(host, samples), map[string]string{"Content-Type": "text/plain; charset=utf-8"})
+}
+
+//line protocol，标签值里的逗号、空格和等号要转义
+func influxLines(host string, samples []*StreamSample) []byte {
+	escape := strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+	var buf bytes.Buffer
+	for _, sample := range samples {
+		fmt.Fprintf(&buf, "ycng_stream,relay=%s,sid=%d,stream=%s,uid=%d ", escape.Replace(host), sample.Sid, sample.Stream, sample.Uid)
+		fmt.Fprintf(&buf, "loss=%g,dup=%di,recv=%di,should=%di", sample.Loss(), sample.Dup, sample.Recv, sample.Should)
+		if sample.Bandwidth >= 0 {
+			fmt.Fprintf(&buf, ",bandwidth=%di", sample.Bandwidth)
+		}
+		if sample.Rtt > 0 {
+			fmt.Fprintf(&buf, ",rtt=%di", sample.Rtt)
+		}
+		fmt.Fprintf(&buf, " %d\n", sample.Time.UnixNano())
+	}
+	return buf.Bytes()
+}
+
+type promSink struct {
+	url    string
+	client *http.Client
+}
+
+func newPromSink(url string) (*promSink, error) {
+	base := httpUrl(url, "prom")
+	if !strings.Contains(strings.TrimPrefix(strings.TrimPrefix(base, "http://"), "https://"), "/") {
+		return nil, errMetricsExportScheme
+	}
+	return &promSink{url: base, client: &http.Client{Timeout: MetricsExportTimeout}}, nil
+}
+
+func (p *promSink) String() string {
+	return p.url
+}
+
+func (p *promSink) send(host string, samples []*StreamSample) error {
+	return postMetrics(p.client, p.url, snappyEncode(promWriteRequest(host, samples)), map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	})
+}
+
+//remote write的WriteRequest：每个样本的每个字段一条TimeSeries，标签按名字排序
+//  WriteRequest{timeseries=1}  TimeSeries{labels=1, samples=2}  Label{name=1, value=2}  Sample{value=1(double), timestamp=2(毫秒)}
+func promWriteRequest(host string, samples []*StreamSample) []byte {
+	var req []byte
+	for _, sample := range samples {
+		labels := [][2]string{
+			{"__name__", ""},
+			{"relay", host},
+			{"sid", strconv.FormatInt(sample.Sid, 10)},
+			{"stream", sample.Stream},
+			{"uid", strconv.FormatInt(sample.Uid, 10)},
+		}
+		fields := []struct {
+			name  string
+			value float64
+			ok    bool
+		}{
+			{"bandwidth_kbps", float64(sample.Bandwidth), sample.Bandwidth >= 0},
+			{"loss_ratio", sample.Loss(), true},
+			{"dup_packets", float64(sample.Dup), true},
+			{"recv_packets", float64(sample.Recv), true},
+			{"should_packets", float64(sample.Should), true},
+			{"rtt_ms", float64(sample.Rtt), sample.Rtt > 0},
+		}
+		for _, f := range fields {
+			if !f.ok {
+				continue
+			}
+			labels[0][1] = "ycng_stream_" + f.name
+			var series []byte
+			for _, l := range labels {
+				var label []byte
+				label = protoAppendBytes(label, 1, []byte(l[0]))
+				label = protoAppendBytes(label, 2, []byte(l[1]))
+				series = protoAppendBytes(series, 1, label)
+			}
+			var s []byte
+			var value [8]byte
+			binary.LittleEndian.PutUint64(value[:], math.Float64bits(f.value))
+			s = protoAppendTag(s, 1, 1)
+			s = append(s, value[:]...)
+			s = protoAppendTag(s, 2, 0)
+			s = appendUvarint(s, uint64(sample.Time.UnixNano()/int64(time.Millisecond)))
+			series = protoAppendBytes(series, 2, s)
+			req = protoAppendBytes(req, 1, series)
+		}
+	}
+	return req
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func protoAppendTag(b []byte, field int, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func protoAppendBytes(b []byte, field int, value []byte) []byte {
+	b = protoAppendTag(b, field, 2)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+//snappy的block格式，只用literal不做压缩，接收方照常解码
+func snappyEncode(data []byte) []byte {
+	out := appendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > 65536 {
+			n = 65536
+		}
+		switch {
+		case n <= 60:
+			out = append(out, byte(n-1)<<2)
+		case n <= 256:
+			out = append(out, 60<<2, byte(n-1))
+		default:
+			out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
@@ -0,0 +1,144 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type exportRequest struct {
+	path    string
+	headers http.Header
+	body    []byte
+}
+
+func exportServer(t *testing.T) (*httptest.Server, chan exportRequest) {
+	requests := make(chan exportRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- exportRequest{path: r.URL.RequestURI(), headers: r.Header, body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return server, requests
+}
+
+var testSample = &StreamSample{
+	Time:      time.Unix(1500000000, 0),
+	Sid:       42,
+	Uid:       1001,
+	Stream:    "audio",
+	Bandwidth: 64,
+	Should:    100,
+	Recv:      90,
+	Dup:       2,
+	Rtt:       120,
+}
+
+func TestMetricsExportInflux(t *testing.T) {
+	server, requests := exportServer(t)
+	defer server.Close()
+	exporter, err := OpenMetricsExporter("influx://" + strings.TrimPrefix(server.URL, "http://") + "/ycng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.host = "relay 1"
+	exporter.Start()
+	exporter.Add(testSample)
+	exporter.Stop()
+
+	req := <-requests
+	if req.path != "/write?precision=ns&db=ycng" {
+		t.Errorf("written to %s", req.path)
+	}
+	want := "ycng_stream,relay=relay\\ 1,sid=42,stream=audio,uid=1001 loss=0.09999999999999998,dup=2i,recv=90i,should=100i,bandwidth=64i,rtt=120i 1500000000000000000\n"
+	if string(req.body) != want {
+		t.Errorf("line protocol\n%s\nwant\n%s", req.body, want)
+	}
+}
+
+//只解literal，snappyEncode不产生其他元素
+func snappyDecodeLiterals(t *testing.T, data []byte) []byte {
+	n, i := binary.Uvarint(data)
+	var out []byte
+	for i < len(data) {
+		tag := data[i]
+		i++
+		length := int(tag>>2) + 1
+		switch tag >> 2 {
+		case 60:
+			length = int(data[i]) + 1
+			i++
+		case 61:
+			length = int(binary.LittleEndian.Uint16(data[i:])) + 1
+			i += 2
+		}
+		if tag&3 != 0 || i+length > len(data) {
+			t.Fatalf("incorrect snappy element at %d", i)
+		}
+		out = append(out, data[i:i+length]...)
+		i += length
+	}
+	if uint64(len(out)) != n {
+		t.Fatalf("snappy length %d, decoded %d", n, len(out))
+	}
+	return out
+}
+
+func TestMetricsExportPrometheus(t *testing.T) {
+	for _, size := range []int{0, 1, 60, 61, 256, 257, 65536, 70000} {
+		data := bytes.Repeat([]byte{7}, size)
+		if got := snappyDecodeLiterals(t, snappyEncode(data)); !bytes.Equal(got, data) {
+			t.Errorf("snappy round trip of %d bytes failed", size)
+		}
+	}
+
+	server, requests := exportServer(t)
+	defer server.Close()
+	exporter, err := OpenMetricsExporter("prom://" + strings.TrimPrefix(server.URL, "http://") + "/api/v1/write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.Start()
+	sample := *testSample
+	sample.Rtt = 0
+	exporter.Add(&sample)
+	exporter.Stop()
+
+	req := <-requests
+	if req.path != "/api/v1/write" || req.headers.Get("Content-Encoding") != "snappy" || req.headers.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("written to %s with %v", req.path, req.headers)
+	}
+	body := snappyDecodeLiterals(t, req.body)
+	for _, name := range []string{"ycng_stream_bandwidth_kbps", "ycng_stream_loss_ratio", "ycng_stream_dup_packets", "1001"} {
+		if !bytes.Contains(body, []byte(name)) {
+			t.Errorf("write request without %s", name)
+		}
+	}
+	if bytes.Contains(body, []byte("ycng_stream_rtt_ms")) {
+		t.Error("rtt exported without client report")
+	}
+}
+
+func TestOpenMetricsExporter(t *testing.T) {
+	for _, url := range []string{"", "http://host/write", "influx://host:8086", "influx://host:8086/", "prom://host:9090"} {
+		if _, err := OpenMetricsExporter(url); err == nil {
+			t.Errorf("%q accepted", url)
+		}
+	}
+	exporter, err := OpenMetricsExporter("influxs://host:8086/ycng")
+	if err != nil || exporter.sink.String() != "https://host:8086/write?precision=ns&db=ycng" {
+		t.Errorf("influxs url %v, err %v", exporter, err)
+	}
+}
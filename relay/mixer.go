@@ -0,0 +1,156 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+服务端混音：
+session人数超过config.MixThreshold且设置了音频codec时，该session的音频不再逐路转发，
+而是每个混音周期把各人最新一帧解码、对每个接收方混出"除自己以外所有人"的一路，再编码后发出，
+From为MixerUid。编解码器是有状态的，所以每路上行一个decoder，每个接收方一个encoder。
+*/
+
+const (
+	MixerUid = -4
+
+	MixIntervalMs = 20
+)
+
+type AudioCodec interface {
+	Decode(payload []byte) ([]int16, error)
+	Encode(pcm []int16) ([]byte, error)
+}
+
+type AudioCodecFactory func() AudioCodec
+
+// PcmCodec: payload就是16bit big endian的pcm，主要用于测试
+type PcmCodec struct{}
+
+func NewPcmCodec() AudioCodec {
+	return &PcmCodec{}
+}
+
+func (c *PcmCodec) Decode(payload []byte) ([]int16, error) {
+	if len(payload)%2 != 0 {
+		return nil, errors.New("incorrect pcm payload size")
+	}
+	pcm := make([]int16, len(payload)/2)
+	for i := range pcm {
+		pcm[i] = int16(binary.BigEndian.Uint16(payload[2*i : 2*i+2]))
+	}
+	return pcm, nil
+}
+
+func (c *PcmCodec) Encode(pcm []int16) ([]byte, error) {
+	payload := make([]byte, 2*len(pcm))
+	for i, v := range pcm {
+		binary.BigEndian.PutUint16(payload[2*i:2*i+2], uint16(v))
+	}
+	return payload, nil
+}
+
+type Mixer struct {
+	factory  AudioCodecFactory
+	decoders map[int64]AudioCodec
+	encoders map[int64]AudioCodec
+	frames   map[int64][]int16 //本周期各路的最新一帧
+}
+
+func NewMixer(factory AudioCodecFactory) *Mixer {
+	m := &Mixer{
+		factory:  factory,
+		decoders: make(map[int64]AudioCodec),
+		encoders: make(map[int64]AudioCodec),
+		frames:   make(map[int64][]int16),
+	}
+	return m
+}
+
+func (m *Mixer) Push(from int64, payload []byte) {
+	decoder := m.decoders[from]
+	if decoder == nil {
+		decoder = m.factory()
+		m.decoders[from] = decoder
+	}
+	pcm, err := decoder.Decode(payload)
+	if err != nil {
+		logging.Logger.Warn("mixer decode error from ", from, ":", err)
+		return
+	}
+	m.frames[from] = pcm
+}
+
+// receivers为当前session的所有参与者，返回每个接收方的编码后音频，没有可混的输入时不输出
+func (m *Mixer) Mix(receivers []int64) map[int64][]byte {
+	if len(m.frames) == 0 {
+		return nil
+	}
+
+	frameLen := 0
+	for _, pcm := range m.frames {
+		if len(pcm) > frameLen {
+			frameLen = len(pcm)
+		}
+	}
+
+	//先求总和，再对每个接收方减去自己，N路混音只需O(N)
+	sum := make([]int32, frameLen)
+	for _, pcm := range m.frames {
+		for i, v := range pcm {
+			sum[i] += int32(v)
+		}
+	}
+
+	out := make(map[int64][]byte)
+	for _, uid := range receivers {
+		own := m.frames[uid]
+		if own != nil && len(m.frames) == 1 {
+			continue //只有自己在说话
+		}
+		pcm := make([]int16, frameLen)
+		for i := range pcm {
+			v := sum[i]
+			if i < len(own) {
+				v -= int32(own[i])
+			}
+			if v > 32767 {
+				v = 32767
+			} else if v < -32768 {
+				v = -32768
+			}
+			pcm[i] = int16(v)
+		}
+
+		encoder := m.encoders[uid]
+		if encoder == nil {
+			encoder = m.factory()
+			m.encoders[uid] = encoder
+		}
+		payload, err := encoder.Encode(pcm)
+		if err != nil {
+			logging.Logger.Warn("mixer encode error for ", uid, ":", err)
+			continue
+		}
+		out[uid] = payload
+	}
+
+	m.frames = make(map[int64][]int16)
+	return out
+}
+
+func (m *Mixer) Remove(uid int64) {
+	delete(m.decoders, uid)
+	delete(m.encoders, uid)
+	delete(m.frames, uid)
+}
@@ -0,0 +1,128 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+/*
+通话质量MOS：按ITU-T G.107 E-model的简化算法，用relay测得的上行丢包率、音频抖动和客户端上报的RTT估算每个参与者的MOS。
+1. 丢包率取各统计窗口的平滑值（见metrics.go），抖动按RFC 3550用音频包的发送时间戳和到达时间算，RTT见metrics_export.go
+2. 有效时延 d = rtt/2 + 2*jitter + MosCodecDelay，时延损伤 Id = 0.024d + 0.11(d-177.3)H(d-177.3)
+3. 丢包损伤 Ie_eff = MosIe + (95-MosIe)*Ppl/(Ppl+MosBpl)，Ppl为丢包百分比，MosIe、MosBpl取带PLC的语音编码的典型值
+4. R = 93.2 - Id - Ie_eff，MOS = 1 + 0.035R + 7e-6*R(R-60)(100-R)，R<=0时为1，R>=100时为4.5
+5. relay每个定时器周期把有统计结果的参与者按session发给session manager，UdpMessageTypeQualityReport，
+   payload为每人uid(8)+mos*100(2)+丢包率万分之几(2)+jitter毫秒(2)+rtt毫秒(2)，见session_manager/quality.go
+*/
+
+const (
+	MosCodecDelay = 20.0 //毫秒，编解码和打包的时延
+	MosIe         = 0.0
+	MosBpl        = 25.1
+
+	QualityEntrySize = 16
+)
+
+func EstimateMos(loss float64, jitter float64, rtt float64) float64 {
+	d := rtt/2 + 2*jitter + MosCodecDelay
+	id := 0.024 * d
+	if d > 177.3 {
+		id += 0.11 * (d - 177.3)
+	}
+	ppl := loss * 100
+	ie := MosIe + (95-MosIe)*ppl/(ppl+MosBpl)
+	r := 93.2 - id - ie
+	if r <= 0 {
+		return 1
+	}
+	if r >= 100 {
+		return 4.5
+	}
+	return 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+}
+
+type QualityEntry struct {
+	Uid    int64
+	Mos    float64
+	Loss   float64
+	Jitter int
+	Rtt    int
+}
+
+func MarshalQualityReport(entries []QualityEntry) []byte {
+	data := make([]byte, QualityEntrySize*len(entries))
+	for i, e := range entries {
+		p := data[QualityEntrySize*i:]
+		binary.BigEndian.PutUint64(p[0:8], uint64(e.Uid))
+		binary.BigEndian.PutUint16(p[8:10], uint16(math.Round(e.Mos*100)))
+		binary.BigEndian.PutUint16(p[10:12], uint16(math.Round(e.Loss*10000)))
+		binary.BigEndian.PutUint16(p[12:14], clampUint16(e.Jitter))
+		binary.BigEndian.PutUint16(p[14:16], clampUint16(e.Rtt))
+	}
+	return data
+}
+
+func UnmarshalQualityReport(data []byte) ([]QualityEntry, bool) {
+	if len(data) == 0 || len(data)%QualityEntrySize != 0 {
+		return nil, false
+	}
+	entries := make([]QualityEntry, len(data)/QualityEntrySize)
+	for i := range entries {
+		p := data[QualityEntrySize*i:]
+		entries[i] = QualityEntry{
+			Uid:    int64(binary.BigEndian.Uint64(p[0:8])),
+			Mos:    float64(binary.BigEndian.Uint16(p[8:10])) / 100,
+			Loss:   float64(binary.BigEndian.Uint16(p[10:12])) / 10000,
+			Jitter: int(binary.BigEndian.Uint16(p[12:14])),
+			Rtt:    int(binary.BigEndian.Uint16(p[14:16])),
+		}
+	}
+	return entries, true
+}
+
+func clampUint16(v int) uint16 {
+	if v < 0 {
+		return 0
+	}
+	if v > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(v)
+}
+
+//在定时器里调用，session manager没有注册时不报
+func (s *Service) reportQuality() {
+	user := s.users[SessionManagerUid]
+	if user == nil || user.UdpAddr == nil {
+		return
+	}
+	for _, session := range s.sessions {
+		var entries []QualityEntry
+		for _, p := range session.Participants {
+			loss, jitter, rtt, ok := p.Metrics.Quality()
+			if !ok {
+				continue
+			}
+			entries = append(entries, QualityEntry{
+				Uid:    p.Id,
+				Mos:    EstimateMos(loss, jitter, float64(rtt)),
+				Loss:   loss,
+				Jitter: int(math.Round(jitter)),
+				Rtt:    int(rtt),
+			})
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		msg := NewMessage(UdpMessageTypeQualityReport, SessionManagerUid, session.Id, 0, MarshalQualityReport(entries), nil)
+		s.sendMessage(msg, user.UdpAddr)
+		s.log().Debug("quality of session ", session.Id, ":", entries)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEstimateMos(t *testing.T) {
+	if mos := EstimateMos(0, 0, 0); mos < 4.3 || mos > 4.5 {
+		t.Errorf("mos of a perfect call %v", mos)
+	}
+	//丢包、抖动、RTT任一变差MOS都不升
+	last := EstimateMos(0, 0, 0)
+	for _, c := range [][3]float64{{0.01, 0, 0}, {0.01, 20, 0}, {0.01, 20, 300}, {0.05, 20, 300}, {0.2, 60, 600}, {1, 200, 2000}} {
+		mos := EstimateMos(c[0], c[1], c[2])
+		if mos > last || mos < 1 {
+			t.Errorf("mos of %v is %v, previous %v", c, mos, last)
+		}
+		last = mos
+	}
+	if last != 1 {
+		t.Errorf("mos of a broken call %v", last)
+	}
+}
+
+func TestQualityReport(t *testing.T) {
+	m := NewMetrics()
+	now := time.Now().UnixNano()
+	for i := 0; i < 40; i++ { //每20毫秒发一个包，到达间隔交替为10和30毫秒
+		arrival := now + int64(i*20)*int64(time.Millisecond)
+		if i%2 == 1 {
+			arrival += int64(10 * time.Millisecond)
+		}
+		m.updateJitter(uint16(65000+i*20), arrival) //发送时间戳中途回绕
+	}
+	if _, jitter, _, ok := m.Quality(); ok || jitter < 9 || jitter > 10 {
+		t.Errorf("jitter %v, ok %v", jitter, ok)
+	}
+	m.updateLoss(100, 90)
+	m.updateLoss(100, 100)
+	if loss, _, _, ok := m.Quality(); !ok || math.Abs(loss-0.0875) > 1e-9 {
+		t.Errorf("loss %v", loss)
+	}
+
+	entries := []QualityEntry{{Uid: 1001, Mos: 4.12, Loss: 0.0875, Jitter: 8, Rtt: 120}, {Uid: 1002, Mos: 1, Jitter: 70000}}
+	got, ok := UnmarshalQualityReport(MarshalQualityReport(entries))
+	entries[1].Jitter = 65535
+	if !ok || !reflect.DeepEqual(got, entries) {
+		t.Errorf("quality report %+v", got)
+	}
+	if _, ok := UnmarshalQualityReport(make([]byte, QualityEntrySize+1)); ok {
+		t.Error("truncated quality report accepted")
+	}
+}
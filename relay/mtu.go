@@ -0,0 +1,112 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/*
+报文大小限制和路径MTU探测：超过路径MTU的UDP包会被IP分片，丢一片整包就没了，有的网络干脆丢弃分片，所以不依赖IP分片。
+1. config的max_datagram为relay收发的UDP包（含混淆头）的最大字节数，超过的丢弃并计数，0为不限制
+2. 客户端UserReg的能力位图带CapabilityMtuProbe时，relay回复注册后向他发一组MtuProbe，整包大小分别为MtuProbeSizes中
+   不超过max_datagram的值，payload开头2字节为整包大小，其余填充。客户端对收到的每个探测回MtuProbeAck，payload为探测开头的2字节，
+   relay取确认过的最大值为这个地址的路径MTU，重新注册时重新探测。Linux默认给UDP包设DF，路上放不下的探测被丢弃而不是分片
+3. 发往一个地址的包超过它的路径MTU（没有探测结果时为max_datagram）时丢弃；信令按这个大小分片，接收方不能重组
+   （没有CapabilityCompression）而信令放不下时拒绝发送，见fragment.go的PrepareSignal
+4. 转给session manager的信令上附带发送方的路径MTU（UdpMessageExtraTypeMtu，2字节），session manager发信令时同样分片或拒绝
+*/
+
+const (
+	DefaultMaxDatagram = 1472 //以太网MTU 1500减去IPv4和UDP头
+
+	linkSealOverhead = 2 + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead //链路加密增加的字节，见crypto.go
+)
+
+var MtuProbeSizes = []int{1472, 1400, 1280}
+
+//整包大小为size的探测，size放不下消息头时按消息头的大小
+func NewMtuProbe(to int64, size int) *Message {
+	probe := NewMessage(UdpMessageTypeMtuProbe, 0, to, 0, make([]byte, 2), nil)
+	if pad := size - len(probe.ObfuscatedDataOfMessage()); pad > 0 {
+		probe.Payload = make([]byte, 2+pad)
+	}
+	binary.BigEndian.PutUint16(probe.Payload[0:2], uint16(size))
+	return probe
+}
+
+//混淆后整包的字节数，混淆头按带密钥id的3字节算
+func DatagramLen(msg *Message) int {
+	return 3 + msg.MarshalLen()
+}
+
+//消息extra中的路径MTU，没有时返回0
+func MtuFromMessage(msg *Message) int {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return 0
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeMtu)
+	if len(value) != 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(value))
+}
+
+func SetMtu(msg *Message, mtu int) {
+	var extra []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+	}
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, uint16(mtu))
+	msg.Extra = ReplaceExtra(extra, UdpMessageExtraTypeMtu, value)
+	msg.SetFlag(UdpMessageFlagExtra)
+}
+
+//a和b中较小的，0为不限制
+func MinDatagram(a, b int) int {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+//发往addr的包的最大字节数，0为不限制
+func (s *Service) datagramLimit(addr *net.UDPAddr) int {
+	return MinDatagram(s.config.MaxDatagram, s.mtus[addr.String()])
+}
+
+func (s *Service) sendMtuProbes(to int64, addr *net.UDPAddr) {
+	delete(s.mtus, addr.String())
+	for _, size := range MtuProbeSizes {
+		if s.config.MaxDatagram > 0 && size > s.config.MaxDatagram {
+			continue
+		}
+		s.sendMessage(NewMtuProbe(to, size), addr)
+	}
+}
+
+func (s *Service) handleMessageMtuProbeAck(msg *Message, packet *ReceivedPacket) {
+	if len(msg.Payload) != 2 {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(msg.Payload))
+	known := false
+	for _, probed := range MtuProbeSizes {
+		known = known || size == probed
+	}
+	key := packet.FromUdpAddr.String()
+	if !known || s.capabilities[key]&CapabilityMtuProbe == 0 || size <= s.mtus[key] {
+		return
+	}
+	s.mtus[key] = size
+	s.log().Debug("path mtu of ", msg.From, "<", key, "> at least ", size)
+}
@@ -0,0 +1,75 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestMtuProbe(t *testing.T) {
+	for _, size := range MtuProbeSizes {
+		probe := NewMtuProbe(1001, size)
+		data := probe.ObfuscatedDataOfMessage()
+		if len(data) != size {
+			t.Errorf("probe of %d is %d bytes", size, len(data))
+		}
+		got, err := NewMessageFromObfuscatedData(data)
+		if err != nil || got.MsgType != UdpMessageTypeMtuProbe || int(got.Payload[0])<<8|int(got.Payload[1]) != size {
+			t.Errorf("probe of %d parsed as %v %v", size, got, err)
+		}
+	}
+
+	msg := NewMessage(UdpMessageTypeUserSignal, 1001, SessionManagerUid, 0, []byte("{}"), nil)
+	SetMtu(msg, 1400)
+	if got, _ := NewMessageFromObfuscatedData(msg.ObfuscatedDataOfMessage()); MtuFromMessage(got) != 1400 {
+		t.Errorf("mtu extra lost")
+	}
+	if MinDatagram(0, 1280) != 1280 || MinDatagram(1472, 0) != 1472 || MinDatagram(1472, 1280) != 1280 || MinDatagram(0, 0) != 0 {
+		t.Error("min datagram")
+	}
+}
+
+func TestPrepareSignalMaxDatagram(t *testing.T) {
+	payload := make([]byte, 3000)
+	rand.Read(payload) //不可压缩
+	msg := NewMessage(UdpMessageTypeUserSignal, SessionManagerUid, 1001, 0, payload, nil)
+	SetCapabilities(msg, RelayCapabilities)
+
+	fragments, err := PrepareSignal(msg, CapabilityProtoSignal|CapabilityCompression, 600)
+	if err != nil || len(fragments) < 6 {
+		t.Fatalf("fragments %d %v", len(fragments), err)
+	}
+	r := NewReassembler(FragmentTimeout)
+	var whole *Message
+	for _, f := range fragments {
+		if n := DatagramLen(f) + linkSealOverhead; n > 600 {
+			t.Errorf("fragment of %d bytes over limit", n)
+		}
+		if whole, err = r.Restore(f, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if whole == nil || string(whole.Payload) != string(payload) {
+		t.Error("fragments not reassembled")
+	}
+
+	//不限制时按MaxSignalPayload分片
+	if fragments, _ := PrepareSignal(msg, CapabilityProtoSignal|CapabilityCompression, 0); len(fragments) != 3 {
+		t.Errorf("fragments without limit %d", len(fragments))
+	}
+	//不能重组的接收方放不下时拒绝
+	if _, err := PrepareSignal(msg, CapabilityProtoSignal, DefaultMaxDatagram); err == nil {
+		t.Error("oversized signal prepared for receiver without reassembly")
+	}
+	small := NewMessage(UdpMessageTypeUserSignal, SessionManagerUid, 1001, 0, payload[:1000], nil)
+	if got, err := PrepareSignal(small, CapabilityProtoSignal, DefaultMaxDatagram); err != nil || len(got) != 1 {
+		t.Errorf("small signal %d %v", len(got), err)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+通话前网络探测：客户端发起呼叫前向relay发一串NetProbe，同一Tseq连发两个（和媒体包一样，Metrics靠成对的包估算上行带宽）。
+relay对每个探测包回一个不带payload的NetProbeAck，客户端据此算RTT和往返丢包；
+客户端发完后发NetProbeEnd，relay回NetProbeResult，extra里带relay实际收到的包数和Metrics估算的上行带宽。
+开了access控制时和TurnReg一样，只接受已注册用户的探测。
+*/
+
+const (
+	NetProbePayloadSize = 1000
+	NetProbeMaxPackets  = 400 //单次探测relay最多处理的包数，防止被当作流量放大
+	NetProbeTimeout     = 30 * time.Second
+
+	//低于这些指标时客户端应提示网络差
+	NetProbePoorRtt       = 400 * time.Millisecond
+	NetProbePoorLoss      = 0.1
+	NetProbePoorBandwidth = 64 //kbps
+)
+
+type NetProbeResult struct {
+	Received  uint16 //relay收到的探测包数
+	Bandwidth int32  //上行带宽kbps，-1表示无法估计
+}
+
+func (r *NetProbeResult) Marshal() []byte {
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint16(data[0:2], r.Received)
+	binary.BigEndian.PutUint32(data[2:6], uint32(r.Bandwidth))
+	return data
+}
+
+//消息extra中的探测结果，没有时返回nil
+func NetProbeResultFromMessage(msg *Message) *NetProbeResult {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return nil
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeProbeResult)
+	if len(value) != 6 {
+		return nil
+	}
+	return &NetProbeResult{
+		Received:  binary.BigEndian.Uint16(value[0:2]),
+		Bandwidth: int32(binary.BigEndian.Uint32(value[2:6])),
+	}
+}
+
+//relay上一个进行中的探测
+type netProbe struct {
+	metrics        *Metrics
+	received       int
+	bandwidthSum   int
+	bandwidthCount int
+	lastActiveTime time.Time
+}
+
+func newNetProbe() *netProbe {
+	return &netProbe{metrics: NewMetrics()}
+}
+
+func (p *netProbe) process(msg *Message, timestamp int64) {
+	p.received++
+	ok, data := p.metrics.Process(msg, timestamp)
+	if ok && data.Bandwidth > 0 {
+		p.bandwidthSum += int(data.Bandwidth)
+		p.bandwidthCount++
+	}
+}
+
+func (p *netProbe) result() *NetProbeResult {
+	result := &NetProbeResult{Received: uint16(p.received), Bandwidth: -1}
+	if p.bandwidthCount > 0 {
+		result.Bandwidth = int32(p.bandwidthSum / p.bandwidthCount)
+	}
+	return result
+}
+
+func (s *Service) handleMessageNetProbe(msg *Message, packet *ReceivedPacket) {
+	if s.config.AccessSecret != "" && s.users[msg.From] == nil {
+		return
+	}
+	key := packet.FromUdpAddr.String()
+	probe := s.netProbes[key]
+	if probe == nil {
+		probe = newNetProbe()
+		s.netProbes[key] = probe
+	}
+	if probe.received >= NetProbeMaxPackets {
+		return
+	}
+	probe.lastActiveTime = time.Now()
+	probe.process(msg, packet.Time)
+
+	ack := NewMessage(UdpMessageTypeNetProbeAck, msg.From, msg.To, 0, nil, nil)
+	ack.Tid = msg.Tid
+	ack.Tseq = msg.Tseq
+	ack.Timestamp = msg.Timestamp
+	s.sendMessage(ack, packet.FromUdpAddr)
+}
+
+func (s *Service) handleMessageNetProbeEnd(msg *Message, packet *ReceivedPacket) {
+	if s.config.AccessSecret != "" && s.users[msg.From] == nil {
+		return
+	}
+	key := packet.FromUdpAddr.String()
+	probe := s.netProbes[key]
+	if probe == nil {
+		probe = newNetProbe() //一个探测包都没收到
+	}
+	delete(s.netProbes, key)
+	result := probe.result()
+	s.log().Info("net probe from ", msg.From, "<", key, "> received:", result.Received, " bandwidth:", result.Bandwidth)
+
+	reply := NewMessage(UdpMessageTypeNetProbeResult, msg.From, msg.To, 0, nil, nil)
+	reply.Tid = msg.Tid
+	reply.Extra = ReplaceExtra(nil, UdpMessageExtraTypeProbeResult, result.Marshal())
+	reply.SetFlag(UdpMessageFlagExtra)
+	s.sendMessage(reply, packet.FromUdpAddr)
+}
+
+func (s *Service) expireNetProbes(now time.Time) {
+	for key, probe := range s.netProbes {
+		if now.Sub(probe.lastActiveTime) > NetProbeTimeout {
+			delete(s.netProbes, key)
+		}
+	}
+}
+
+//客户端侧的探测结果
+type NetworkEstimate struct {
+	Sent      int //发出的探测包数
+	Acked     int //收到确认的包数
+	Received  int //relay收到的包数
+	Bandwidth int //上行带宽kbps，-1表示无法估计
+	MinRtt    time.Duration
+	AvgRtt    time.Duration
+}
+
+func (e *NetworkEstimate) UplinkLoss() float64 {
+	if e.Sent == 0 {
+		return 0
+	}
+	return float64(e.Sent-e.Received) / float64(e.Sent)
+}
+
+func (e *NetworkEstimate) DownlinkLoss() float64 {
+	if e.Received == 0 {
+		return 0
+	}
+	return float64(e.Received-e.Acked) / float64(e.Received)
+}
+
+func (e *NetworkEstimate) IsPoor() bool {
+	if e.Acked == 0 {
+		return true
+	}
+	return e.AvgRtt > NetProbePoorRtt || e.UplinkLoss() > NetProbePoorLoss || e.DownlinkLoss() > NetProbePoorLoss ||
+		(e.Bandwidth >= 0 && e.Bandwidth < NetProbePoorBandwidth)
+}
+
+//向relay发pairs对探测包，secret为空时不带access token
+func ProbeNetwork(addr string, secret string, pairs int, interval time.Duration) (*NetworkEstimate, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var token []byte
+	if secret != "" {
+		token = IssueAccessToken(secret, ProbeUid, time.Now().Add(AccessTokenTTL))
+	}
+
+	estimate := &NetworkEstimate{Bandwidth: -1}
+	sentAt := make(map[int16]time.Time)
+	var sumRtt time.Duration
+	var rttCount int
+	var lock sync.Mutex
+	registered := make(chan uint8, 1)
+	resultCh := make(chan *NetProbeResult, 1)
+
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		buf := make([]byte, 2048)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			now := time.Now()
+			msg, err := NewMessageFromObfuscatedData(buf[:n])
+			if err != nil {
+				continue
+			}
+			switch msg.MsgType {
+			case UdpMessageTypeUserRegReceived, UdpMessageTypeUserRegRejected:
+				select {
+				case registered <- msg.MsgType:
+				default:
+				}
+			case UdpMessageTypeNetProbeAck:
+				lock.Lock()
+				estimate.Acked++
+				if start, ok := sentAt[msg.Tseq]; ok { //每对只用先回来的那个算RTT
+					delete(sentAt, msg.Tseq)
+					rtt := now.Sub(start)
+					if rttCount == 0 || rtt < estimate.MinRtt {
+						estimate.MinRtt = rtt
+					}
+					sumRtt += rtt
+					rttCount++
+				}
+				lock.Unlock()
+			case UdpMessageTypeNetProbeResult:
+				if result := NetProbeResultFromMessage(msg); result != nil {
+					select {
+					case resultCh <- result:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	stop := func() {
+		conn.Close()
+		<-recvDone
+	}
+
+	reg := NewMessage(UdpMessageTypeUserReg, ProbeUid, 0, 0, token, nil)
+	if _, err := conn.Write(reg.ObfuscatedDataOfMessage()); err != nil {
+		stop()
+		return nil, err
+	}
+	select {
+	case t := <-registered:
+		if t == UdpMessageTypeUserRegRejected {
+			stop()
+			return nil, errors.New("registration rejected, access_secret required")
+		}
+	case <-time.After(time.Second):
+		stop()
+		return nil, errors.New("no reply from relay")
+	}
+
+	payload := make([]byte, NetProbePayloadSize)
+	for i := 1; i <= pairs; i++ {
+		msg := NewMessage(UdpMessageTypeNetProbe, ProbeUid, 0, 0, payload, nil)
+		msg.Tid = 1
+		msg.Tseq = int16(i)
+		data := msg.ObfuscatedDataOfMessage()
+		lock.Lock()
+		sentAt[msg.Tseq] = time.Now()
+		lock.Unlock()
+		for j := 0; j < 2; j++ {
+			if _, err := conn.Write(data); err != nil {
+				stop()
+				return nil, err
+			}
+			lock.Lock()
+			estimate.Sent++
+			lock.Unlock()
+		}
+		time.Sleep(interval)
+	}
+
+	//结束请求可能丢，最多发3次
+	end := NewMessage(UdpMessageTypeNetProbeEnd, ProbeUid, 0, 0, nil, nil).ObfuscatedDataOfMessage()
+	var result *NetProbeResult
+	for i := 0; i < 3 && result == nil; i++ {
+		if _, err := conn.Write(end); err != nil {
+			stop()
+			return nil, err
+		}
+		select {
+		case result = <-resultCh:
+		case <-time.After(time.Second):
+		}
+	}
+	stop()
+	if result == nil {
+		return nil, errors.New("no probe result from relay")
+	}
+
+	estimate.Received = int(result.Received)
+	estimate.Bandwidth = int(result.Bandwidth)
+	if rttCount > 0 {
+		estimate.AvgRtt = sumRtt / time.Duration(rttCount)
+	}
+	return estimate, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNetProbeResultExtra(t *testing.T) {
+	result := &NetProbeResult{Received: 97, Bandwidth: -1}
+	msg := NewMessage(UdpMessageTypeNetProbeResult, ProbeUid, 0, 0, nil, nil)
+	msg.Extra = ReplaceExtra(nil, UdpMessageExtraTypeProbeResult, result.Marshal())
+	msg.SetFlag(UdpMessageFlagExtra)
+
+	got, err := NewMessageFromObfuscatedData(msg.ObfuscatedDataOfMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := NetProbeResultFromMessage(got)
+	if parsed == nil || *parsed != *result {
+		t.Fatalf("result = %+v, want %+v", parsed, result)
+	}
+
+	if NetProbeResultFromMessage(NewMessage(UdpMessageTypeNetProbeResult, ProbeUid, 0, 0, nil, nil)) != nil {
+		t.Error("result parsed from message without extra")
+	}
+}
+
+func TestNetProbeEstimatesBandwidth(t *testing.T) {
+	probe := newNetProbe()
+	payload := make([]byte, NetProbePayloadSize)
+	now := time.Now().UnixNano()
+	//每对间隔20ms，对内两个包间隔1ms
+	for i := 1; i <= 50; i++ {
+		msg := NewMessage(UdpMessageTypeNetProbe, ProbeUid, 0, 0, payload, nil)
+		msg.Tid = 1
+		msg.Tseq = int16(i)
+		probe.process(msg, now)
+		probe.process(msg, now+int64(time.Millisecond))
+		now += int64(20 * time.Millisecond)
+	}
+	result := probe.result()
+	if result.Received != 100 {
+		t.Errorf("received = %d, want 100", result.Received)
+	}
+	if result.Bandwidth <= 0 {
+		t.Errorf("bandwidth = %d, want > 0", result.Bandwidth)
+	}
+}
+
+func TestNetworkEstimateIsPoor(t *testing.T) {
+	good := &NetworkEstimate{Sent: 100, Received: 100, Acked: 100, Bandwidth: 800, AvgRtt: 50 * time.Millisecond}
+	if good.IsPoor() {
+		t.Error("good network reported as poor")
+	}
+	lossy := *good
+	lossy.Received = 80
+	lossy.Acked = 80
+	if !lossy.IsPoor() {
+		t.Errorf("uplink loss %.2f not reported as poor", lossy.UplinkLoss())
+	}
+	slow := *good
+	slow.AvgRtt = time.Second
+	if !slow.IsPoor() {
+		t.Error("high rtt not reported as poor")
+	}
+}
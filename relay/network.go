@@ -0,0 +1,72 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+/*
+设备类型和网络类型：让对方和应用知道参与者用什么设备、在wifi还是蜂窝网络上，比如蜂窝网络上默认不开视频。
+1. 客户端在UserReg的extra里带UdpMessageExtraTypeNetwork：设备类型(1)+网络类型(1)，网络切换后重新注册即更新，老客户端不带
+2. relay按设备记下，转给session manager的信令上附带发送方设备最近一次注册的值，session manager据此填MemberState，
+   见session_manager/participant_meta.go
+*/
+
+const (
+	DeviceTypeUnknown = 0
+	DeviceTypePhone   = 1
+	DeviceTypeTablet  = 2
+	DeviceTypeDesktop = 3
+	DeviceTypeWeb     = 4
+
+	NetworkTypeUnknown  = 0
+	NetworkTypeWifi     = 1
+	NetworkTypeCellular = 2
+	NetworkTypeEthernet = 3
+)
+
+var deviceTypeNames = []string{"", "phone", "tablet", "desktop", "web"}
+var networkTypeNames = []string{"", "wifi", "cellular", "ethernet"}
+
+type NetworkInfo struct {
+	DeviceType  uint8
+	NetworkType uint8
+}
+
+//不认识的值返回""
+func (n NetworkInfo) DeviceName() string {
+	if int(n.DeviceType) < len(deviceTypeNames) {
+		return deviceTypeNames[n.DeviceType]
+	}
+	return ""
+}
+
+func (n NetworkInfo) NetworkName() string {
+	if int(n.NetworkType) < len(networkTypeNames) {
+		return networkTypeNames[n.NetworkType]
+	}
+	return ""
+}
+
+//消息extra中的设备和网络类型，没有时ok为false
+func NetworkFromMessage(msg *Message) (n NetworkInfo, ok bool) {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return n, false
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeNetwork)
+	if len(value) != 2 {
+		return n, false
+	}
+	return NetworkInfo{DeviceType: value[0], NetworkType: value[1]}, true
+}
+
+func SetNetwork(msg *Message, n NetworkInfo) {
+	var extra []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+	}
+	msg.Extra = ReplaceExtra(extra, UdpMessageExtraTypeNetwork, []byte{n.DeviceType, n.NetworkType})
+	msg.SetFlag(UdpMessageFlagExtra)
+}
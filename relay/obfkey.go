@@ -0,0 +1,214 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/errs"
+)
+
+/*
+混淆密钥轮换：内置的混淆字典写死在客户端里，被识别后只能发版更换。可以改用由secret派生的字典，并且不停服轮换：
+1. 用密钥混淆的包为key id(1)+混淆头(2)+混淆后的数据，不带key id的原格式即内置字典，id为0
+2. 服务端（relay、session manager）用RotateObfuscationKey换上新密钥：grace内同时接受新旧两个密钥的包，
+   发包仍用旧密钥，让还不知道新密钥的客户端能解开；grace结束后只接受新密钥并用它发包
+3. relay回复UserRegReceived时在extra的UdpMessageExtraTypeObfKey带当前密钥和剩余的grace，
+   客户端用LearnObfuscationKey记下后马上改用新密钥发包，grace内仍接受旧密钥
+grace内没有重新注册过的客户端收不到新密钥，只能发版更新。所有relay和session manager应配置相同的密钥。
+*/
+
+const (
+	ObfuscationKeyGrace = time.Hour //管理接口轮换时grace的默认值
+
+	obfuscationKeyIdLegacy = 0 //内置字典
+)
+
+var errObfuscationKey = errs.New(errs.Rejected, "packet not obfuscated by an accepted key")
+
+type ObfuscationKey struct {
+	Id     byte
+	Secret string
+	dict   []byte
+}
+
+func NewObfuscationKey(id byte, secret string) (*ObfuscationKey, error) {
+	if id == obfuscationKeyIdLegacy || secret == "" {
+		return nil, fmt.Errorf("obfuscation key needs an id in 1-255 and a secret, got id %d", id)
+	}
+	return &ObfuscationKey{Id: id, Secret: secret, dict: utils.ObfuscationDict(secret)}, nil
+}
+
+//配置里的"id:secret"
+func ParseObfuscationKey(s string) (*ObfuscationKey, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("obfuscation key %q is not id:secret", s)
+	}
+	id, err := strconv.ParseUint(s[:i], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("obfuscation key id %q: %v", s[:i], err)
+	}
+	return NewObfuscationKey(byte(id), s[i+1:])
+}
+
+//创建后不再修改，整体替换，收发包的路径上不加锁
+type obfuscationKeys struct {
+	current      *ObfuscationKey //nil为内置字典
+	previous     *ObfuscationKey //grace内仍接受，nil为内置字典
+	until        time.Time       //grace结束的时间
+	sendPrevious bool            //服务端grace内用previous发包
+}
+
+var obfKeys atomic.Value
+
+func loadObfuscationKeys() *obfuscationKeys {
+	keys, _ := obfKeys.Load().(*obfuscationKeys)
+	if keys == nil {
+		return &obfuscationKeys{}
+	}
+	return keys
+}
+
+//服务端：换上新密钥，grace为0时立即只用新密钥
+func RotateObfuscationKey(key *ObfuscationKey, grace time.Duration) {
+	old := loadObfuscationKeys()
+	obfKeys.Store(&obfuscationKeys{
+		current:      key,
+		previous:     old.current,
+		until:        time.Now().Add(grace),
+		sendPrevious: true,
+	})
+}
+
+//服务端启动时按配置设置：keys为"id:secret"，最后一个为当前密钥，它前面的一个（没有时为内置字典）在grace内仍接受并用于发包
+func SetupObfuscationKeys(keys []string, grace time.Duration) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	current, err := ParseObfuscationKey(keys[len(keys)-1])
+	if err != nil {
+		return err
+	}
+	var previous *ObfuscationKey
+	if len(keys) > 1 {
+		if previous, err = ParseObfuscationKey(keys[len(keys)-2]); err != nil {
+			return err
+		}
+	}
+	obfKeys.Store(&obfuscationKeys{
+		current:      current,
+		previous:     previous,
+		until:        time.Now().Add(grace),
+		sendPrevious: true,
+	})
+	return nil
+}
+
+//管理接口的轮换请求：id、secret和可选的grace（如30m，省略为ObfuscationKeyGrace）
+func ObfuscationKeyFromRequest(r *http.Request) (*ObfuscationKey, time.Duration, error) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 8)
+	if err != nil {
+		return nil, 0, errors.New("incorrect id")
+	}
+	key, err := NewObfuscationKey(byte(id), r.FormValue("secret"))
+	if err != nil {
+		return nil, 0, err
+	}
+	grace := ObfuscationKeyGrace
+	if g := r.FormValue("grace"); g != "" {
+		if grace, err = time.ParseDuration(g); err != nil || grace < 0 {
+			return nil, 0, errors.New("incorrect grace")
+		}
+	}
+	return key, grace, nil
+}
+
+//当前密钥，使用内置字典时返回nil
+func CurrentObfuscationKey() *ObfuscationKey {
+	return loadObfuscationKeys().current
+}
+
+//发包用的密钥，nil为内置字典
+func (k *obfuscationKeys) sending(now time.Time) *ObfuscationKey {
+	if k.sendPrevious && now.Before(k.until) {
+		return k.previous
+	}
+	return k.current
+}
+
+//是否接受不带key id的内置字典格式
+func (k *obfuscationKeys) legacy(now time.Time) bool {
+	return k.current == nil || (k.previous == nil && now.Before(k.until))
+}
+
+//obf带的key id是否为接受的密钥，是时返回该密钥
+func (k *obfuscationKeys) accepted(obf []byte, now time.Time) *ObfuscationKey {
+	if len(obf) == 0 {
+		return nil
+	}
+	if k.current != nil && obf[0] == k.current.Id {
+		return k.current
+	}
+	if k.previous != nil && obf[0] == k.previous.Id && now.Before(k.until) {
+		return k.previous
+	}
+	return nil
+}
+
+//relay回复UserRegReceived时带上当前密钥：id(1)+剩余grace秒数(4)+secret，没有配置密钥时不带
+func SetObfuscationKeyExtra(msg *Message, now time.Time) {
+	keys := loadObfuscationKeys()
+	if keys.current == nil {
+		return
+	}
+	var grace uint32
+	if now.Before(keys.until) {
+		grace = uint32(keys.until.Sub(now) / time.Second)
+	}
+	value := make([]byte, 5+len(keys.current.Secret))
+	value[0] = keys.current.Id
+	binary.BigEndian.PutUint32(value[1:5], grace)
+	copy(value[5:], keys.current.Secret)
+	msg.Extra = ReplaceExtra(msg.Extra, UdpMessageExtraTypeObfKey, value)
+	msg.SetFlag(UdpMessageFlagExtra)
+}
+
+//客户端侧：从UserRegReceived里记下relay的当前密钥并马上用它发包，之前的密钥在剩余的grace内仍接受
+func LearnObfuscationKey(msg *Message) bool {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return false
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeObfKey)
+	if len(value) <= 5 {
+		return false
+	}
+	old := loadObfuscationKeys()
+	if old.current != nil && old.current.Id == value[0] && old.current.Secret == string(value[5:]) {
+		return false
+	}
+	key, err := NewObfuscationKey(value[0], string(value[5:]))
+	if err != nil {
+		return false
+	}
+	grace := time.Duration(binary.BigEndian.Uint32(value[1:5])) * time.Second
+	obfKeys.Store(&obfuscationKeys{
+		current:  key,
+		previous: old.current,
+		until:    time.Now().Add(grace),
+	})
+	return true
+}
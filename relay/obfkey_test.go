@@ -0,0 +1,70 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObfuscationKeyRotation(t *testing.T) {
+	defer obfKeys.Store(&obfuscationKeys{})
+	msg := NewMessage(UdpMessageTypeAudioStream, 1, 2, 0, []byte("payload"), nil)
+	legacy := msg.ObfuscatedDataOfMessage()
+
+	key1, err := ParseObfuscationKey("1:first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	RotateObfuscationKey(key1, time.Hour)
+	if _, err := NewMessageFromObfuscatedData(legacy); err != nil {
+		t.Fatalf("built-in dictionary rejected during grace: %v", err)
+	}
+	if data := msg.ObfuscatedDataOfMessage(); len(data) != len(legacy) {
+		t.Fatalf("sent with the new key during grace")
+	}
+
+	//客户端从UserRegReceived学到新密钥后马上用它发包
+	reg := NewMessage(UdpMessageTypeUserRegReceived, 1, 0, 0, nil, nil)
+	SetObfuscationKeyExtra(reg, time.Now())
+	obfKeys.Store(&obfuscationKeys{})
+	if !LearnObfuscationKey(reg) || CurrentObfuscationKey().Id != 1 {
+		t.Fatalf("key not learned from %v", reg.Extra)
+	}
+	keyed := msg.ObfuscatedDataOfMessage()
+	if len(keyed) != len(legacy)+1 || keyed[0] != 1 {
+		t.Fatalf("client did not send with the learned key")
+	}
+
+	//grace结束后服务端只接受新密钥
+	obfKeys.Store(&obfuscationKeys{current: key1})
+	decoded, err := NewMessageFromObfuscatedData(keyed)
+	if err != nil || string(decoded.Payload) != "payload" {
+		t.Fatalf("keyed packet not decoded: %v", err)
+	}
+	if _, err := NewMessageFromObfuscatedData(legacy); err != errObfuscationKey {
+		t.Fatalf("built-in dictionary accepted after grace: %v", err)
+	}
+
+	key2, _ := NewObfuscationKey(2, "second")
+	RotateObfuscationKey(key2, time.Hour)
+	if _, err := NewMessageFromObfuscatedData(keyed); err != nil {
+		t.Fatalf("previous key rejected during grace: %v", err)
+	}
+	if data := msg.ObfuscatedDataOfMessage(); data[0] != 1 {
+		t.Fatalf("server sent with key %d during grace, want the previous key", data[0])
+	}
+}
+
+func TestParseObfuscationKey(t *testing.T) {
+	for _, s := range []string{"secret", "0:secret", "256:secret", "1:", "x:secret"} {
+		if _, err := ParseObfuscationKey(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+用户在线状态的上报：session manager只看得到经过它的信令，看不到用户注册在哪个relay上。
+relay把用户的注册和过期报给session manager，UdpMessageTypePresence，payload为每个用户uid(8)+state(1)：
+1. 新用户注册（s.users里原来没有，包括未注册就发信令而被自动注册的）时报PresenceOnline，过期删除时报PresenceOffline，
+   已注册的用户重新注册不报
+2. 每PresenceSyncInterval把所有注册着的用户再报一遍online，session manager重启或丢了包也能恢复，
+   长时间没有被再次报online的记录由session manager过期（relay挂了的情况），见session_manager/presence.go
+3. 上报先记入待发的批次，和路由表一样在收包队列读空、批次满PresenceBatchSize或定时器到时发出，一个消息最多PresenceBatchSize个用户
+session manager自己不上报；还没有session manager注册时待发的批次丢弃，session manager新注册上来时在下个定时器全量同步。
+*/
+
+const (
+	PresenceOffline = 0
+	PresenceOnline  = 1
+
+	PresenceEntrySize    = 9
+	PresenceBatchSize    = 128 //一个消息最多带的用户数
+	PresenceSyncInterval = 5 * time.Minute
+)
+
+type PresenceEntry struct {
+	Uid    int64
+	Online bool
+}
+
+func MarshalPresence(entries []PresenceEntry) []byte {
+	data := make([]byte, PresenceEntrySize*len(entries))
+	for i, e := range entries {
+		p := data[PresenceEntrySize*i:]
+		binary.BigEndian.PutUint64(p[0:8], uint64(e.Uid))
+		if e.Online {
+			p[8] = PresenceOnline
+		} else {
+			p[8] = PresenceOffline
+		}
+	}
+	return data
+}
+
+func UnmarshalPresence(data []byte) ([]PresenceEntry, bool) {
+	if len(data) == 0 || len(data)%PresenceEntrySize != 0 {
+		return nil, false
+	}
+	entries := make([]PresenceEntry, len(data)/PresenceEntrySize)
+	for i := range entries {
+		p := data[PresenceEntrySize*i:]
+		entries[i] = PresenceEntry{
+			Uid:    int64(binary.BigEndian.Uint64(p[0:8])),
+			Online: p[8] == PresenceOnline,
+		}
+	}
+	return entries, true
+}
+
+//主循环里用户注册或过期后调用
+func (s *Service) presenceChanged(uid int64, online bool) {
+	if uid != SessionManagerUid {
+		s.presence = append(s.presence, PresenceEntry{Uid: uid, Online: online})
+	} else if online {
+		s.lastPresenceSync = time.Time{}
+	}
+}
+
+//收包队列读空或批次满时发出
+func (s *Service) flushPresence() {
+	if pending := len(s.presence); pending > 0 && (pending >= PresenceBatchSize || len(s.packetReceiveCh) == 0) {
+		s.sendPresence()
+	}
+}
+
+func (s *Service) sendPresence() {
+	entries := s.presence
+	s.presence = nil
+	user := s.users[SessionManagerUid]
+	if user == nil || user.UdpAddr == nil {
+		return
+	}
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > PresenceBatchSize {
+			n = PresenceBatchSize
+		}
+		msg := NewMessage(UdpMessageTypePresence, SessionManagerUid, 0, 0, MarshalPresence(entries[:n]), nil)
+		s.sendMessage(msg, user.UdpAddr)
+		entries = entries[n:]
+	}
+}
+
+//定时器里调用，到了全量同步的时间就把所有注册着的用户报一遍
+func (s *Service) syncPresence(now time.Time) {
+	if now.Sub(s.lastPresenceSync) >= PresenceSyncInterval {
+		s.lastPresenceSync = now
+		for uid := range s.users {
+			if uid != SessionManagerUid {
+				s.presence = append(s.presence, PresenceEntry{Uid: uid, Online: true})
+			}
+		}
+	}
+	s.sendPresence()
+}
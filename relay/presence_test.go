@@ -0,0 +1,65 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPresenceMarshal(t *testing.T) {
+	entries := []PresenceEntry{{Uid: 1001, Online: true}, {Uid: -2, Online: false}}
+	got, ok := UnmarshalPresence(MarshalPresence(entries))
+	if !ok || !reflect.DeepEqual(got, entries) {
+		t.Errorf("unmarshal %+v %v", got, ok)
+	}
+	if _, ok := UnmarshalPresence(make([]byte, PresenceEntrySize+1)); ok {
+		t.Error("truncated presence accepted")
+	}
+}
+
+func TestServicePresence(t *testing.T) {
+	config := GetDefaultConfig()
+	config.AllowPlaintext = true //测试客户端不做链路加密
+	s := NewService(config)
+	smAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 19001}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	now := time.Now()
+
+	//还没有session manager，丢弃
+	s.handleMessageUserReg(NewMessage(UdpMessageTypeUserReg, 1001, 0, 0, nil, nil), &ReceivedPacket{FromUdpAddr: addr})
+	if !reflect.DeepEqual(s.presence, []PresenceEntry{{Uid: 1001, Online: true}}) {
+		t.Fatalf("pending presence %+v", s.presence)
+	}
+	s.flushPresence()
+	if len(s.presence) != 0 || s.traffic.sentPackets != 1 { //只有UserRegReceived
+		t.Fatalf("pending %+v, sent %d", s.presence, s.traffic.sentPackets)
+	}
+
+	//session manager注册上来后全量同步，重新注册的用户不再报
+	s.lastPresenceSync = now
+	s.handleMessageUserReg(NewMessage(UdpMessageTypeUserReg, SessionManagerUid, 0, 0, nil, nil), &ReceivedPacket{FromUdpAddr: smAddr})
+	s.handleMessageUserReg(NewMessage(UdpMessageTypeUserReg, 1001, 0, 0, nil, nil), &ReceivedPacket{FromUdpAddr: addr})
+	if len(s.presence) != 0 || !s.lastPresenceSync.IsZero() {
+		t.Fatalf("pending %+v, last sync %v", s.presence, s.lastPresenceSync)
+	}
+	sent := s.traffic.sentPackets
+	s.syncPresence(now)
+	if s.traffic.sentPackets != sent+1 || s.lastPresenceSync != now {
+		t.Errorf("sync sent %d packets", s.traffic.sentPackets-sent)
+	}
+
+	s.users[1001].LastActiveTime = now.Add(-time.Hour)
+	s.presence = nil
+	s.handleTicker(now)
+	if s.users[1001] != nil || s.traffic.sentPackets != sent+2 {
+		t.Errorf("offline not sent, %d packets", s.traffic.sentPackets-sent)
+	}
+}
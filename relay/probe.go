@@ -0,0 +1,128 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+部署验证用的探测：向relay发若干个UserReg，按回来的UserRegReceived（relay原样带回Tseq）计算RTT和丢包。
+探测用ProbeUid注册，和普通用户一样10分钟不活跃后被relay清掉。
+*/
+
+const ProbeUid = -5
+
+type ProbeResult struct {
+	Sent     int
+	Received int
+	Rejected bool //relay开了access控制而没有给secret
+	MinRtt   time.Duration
+	MaxRtt   time.Duration
+	AvgRtt   time.Duration
+}
+
+func (r *ProbeResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Sent-r.Received) / float64(r.Sent)
+}
+
+//secret为空时不带access token
+func Probe(addr string, count int, interval time.Duration, timeout time.Duration, secret string) (*ProbeResult, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var token []byte
+	if secret != "" {
+		token = IssueAccessToken(secret, ProbeUid, time.Now().Add(AccessTokenTTL))
+	}
+
+	result := &ProbeResult{}
+	sentAt := make(map[int16]time.Time)
+	var sumRtt time.Duration
+	var lock sync.Mutex
+
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		buf := make([]byte, 2048)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			now := time.Now()
+			msg, err := NewMessageFromObfuscatedData(buf[:n])
+			if err != nil {
+				continue
+			}
+			lock.Lock()
+			if msg.MsgType == UdpMessageTypeUserRegRejected {
+				result.Rejected = true
+				lock.Unlock()
+				continue
+			}
+			start, ok := sentAt[msg.Tseq]
+			if msg.MsgType != UdpMessageTypeUserRegReceived || !ok {
+				lock.Unlock()
+				continue
+			}
+			delete(sentAt, msg.Tseq)
+			rtt := now.Sub(start)
+			if result.Received == 0 || rtt < result.MinRtt {
+				result.MinRtt = rtt
+			}
+			if rtt > result.MaxRtt {
+				result.MaxRtt = rtt
+			}
+			sumRtt += rtt
+			result.Received++
+			lock.Unlock()
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		msg := NewMessage(UdpMessageTypeUserReg, ProbeUid, 0, 0, token, nil)
+		msg.Tseq = int16(i)
+		data := msg.ObfuscatedDataOfMessage()
+		lock.Lock()
+		sentAt[msg.Tseq] = time.Now()
+		lock.Unlock()
+		_, err := conn.Write(data)
+		if err != nil {
+			conn.Close()
+			<-recvDone
+			return nil, err
+		}
+		result.Sent++
+		time.Sleep(interval)
+	}
+	time.Sleep(timeout)
+	conn.Close()
+	<-recvDone
+
+	if result.Received > 0 {
+		result.AvgRtt = sumRtt / time.Duration(result.Received)
+	}
+	if result.Rejected && result.Received == 0 {
+		return result, errors.New("registration rejected, access_secret required")
+	}
+	return result, nil
+}
@@ -0,0 +1,130 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+录制：session manager通过UdpMessageTypeRecordControl通知relay开始/停止录制某个session，
+relay把该session各participant上行的媒体包tee给Recorder。
+PcapRecorder按 <dir>/<sid>/<uid>.pcap 每人一个文件，linktype为USER0，每个包的数据为 1字节msgType + payload。
+*/
+
+const (
+	RecordControlStop      = 0
+	RecordControlStart     = 1
+	RecordControlVoicemail = 2 //只录一个参与者的音频，见voicemail.go
+
+	pcapLinkTypeUser0 = 147
+)
+
+func isRecordableMessage(msgType uint8) bool {
+	switch msgType {
+	case UdpMessageTypeAudioStream, UdpMessageTypeVideoStream, UdpMessageTypeVideoStreamIFrame:
+		return true
+	}
+	return false
+}
+
+type Recorder interface {
+	Record(sid int64, uid int64, msgType uint8, payload []byte, timestamp int64)
+	Close(sid int64)
+	Location(sid int64, uid int64) string //录制文件的位置，留言录完时告诉session manager
+}
+
+type PcapRecorder struct {
+	dir   string
+	files map[int64]map[int64]*os.File
+	lock  sync.Mutex
+}
+
+func NewPcapRecorder(dir string) *PcapRecorder {
+	r := &PcapRecorder{
+		dir:   dir,
+		files: make(map[int64]map[int64]*os.File),
+	}
+	return r
+}
+
+func (r *PcapRecorder) Record(sid int64, uid int64, msgType uint8, payload []byte, timestamp int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f, err := r.fileOf(sid, uid)
+	if err != nil {
+		logging.Logger.Warn("record file error for session ", sid, " uid ", uid, ":", err)
+		return
+	}
+
+	length := 1 + len(payload)
+	header := make([]byte, 16, 16+length)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(timestamp/1000000000))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(timestamp%1000000000/1000))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(length))
+	binary.LittleEndian.PutUint32(header[12:16], uint32(length))
+	header = append(header, msgType)
+	header = append(header, payload...)
+	f.Write(header)
+}
+
+func (r *PcapRecorder) fileOf(sid int64, uid int64) (*os.File, error) {
+	files := r.files[sid]
+	if files == nil {
+		files = make(map[int64]*os.File)
+		r.files[sid] = files
+	}
+	if f := files[uid]; f != nil {
+		return f, nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(r.dir, fmt.Sprint(sid)), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(r.Location(sid, uid))
+	if err != nil {
+		return nil, err
+	}
+
+	//pcap global header
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkTypeUser0)
+	if _, err = f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	files[uid] = f
+	logging.Logger.Info("start recording session ", sid, " uid ", uid, " to ", f.Name())
+	return f, nil
+}
+
+func (r *PcapRecorder) Close(sid int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, f := range r.files[sid] {
+		f.Close()
+	}
+	delete(r.files, sid)
+}
+
+func (r *PcapRecorder) Location(sid int64, uid int64) string {
+	return filepath.Join(r.dir, fmt.Sprint(sid), fmt.Sprintf("%d.pcap", uid))
+}
@@ -0,0 +1,197 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"time"
+)
+
+/*
+信令防重放：
+1. 信令的Timestamp（单位0.1ms）超出[now-window, now+window]的视为过期或伪造直接拒绝
+2. 带Seq的信令按发送方和session用滑动窗口记录见过的序号：比窗口内最大的序号小ReplaySeqWindow以上的、
+   或者窗口内已经见过的即为重放。Seq是发送方在session内的序号（见session_manager/sequence.go），所以按session分开
+3. 不带Seq的信令（老客户端、sid请求等session之外的信令）按发送方记住最近ReplayRecent个(timestamp, to, signal)，
+   重复出现的、或者记满以后比记住的都旧的即为重放
+4. 每个发送方最多跟踪ReplaySessionsPerSender个session，满了淘汰最久没有信令的，并记下它最后的时间戳，
+   之后新建窗口的session里不比它新的信令都拒绝。时间窗口之外的由Expire定期清掉，两次清理之间发送方超过
+   ReplayMaxSenders个时随便淘汰一个，被淘汰的发送方在时间窗口内截获的信令可能重放成功，只有被刷满时才会发生
+这样截获的End、MemberOp(kick)等信令无论何时重发都不会再生效，而且记录的总量有上限，不会被从外面刷爆内存。
+媒体包的tseq本来就会成对重复发送（用于带宽估计），不在此过滤。
+*/
+
+const (
+	ReplayWindow            = 10 * time.Minute //兼顾手机时钟误差
+	ReplaySeqWindow         = 64               //每个session记住的序号范围，即位图的位数
+	ReplayRecent            = 32               //不带Seq的信令每个发送方记住这么多条
+	ReplaySessionsPerSender = 8
+	ReplayMaxSenders        = 65536
+
+	signalTimestampUnit = int64(100 * time.Microsecond)
+)
+
+type replayKey struct {
+	timestamp int64
+	to        int64
+	signal    uint16
+}
+
+//一个发送方在一个session内的序号窗口
+type seqWindow struct {
+	highest uint32
+	seen    uint64 //第i位表示highest-i已见过
+	last    int64  //最近一次信令的时间戳
+}
+
+type replaySender struct {
+	sessions map[int64]*seqWindow
+	evicted  int64       //被淘汰的session窗口最后的时间戳
+	recent   []replayKey //不带Seq的信令
+	last     int64
+}
+
+type ReplayFilter struct {
+	window     int64
+	maxSenders int
+	senders    map[int64]*replaySender
+}
+
+func NewReplayFilter(window time.Duration) *ReplayFilter {
+	f := &ReplayFilter{
+		window:     int64(window) / signalTimestampUnit,
+		maxSenders: ReplayMaxSenders,
+		senders:    make(map[int64]*replaySender),
+	}
+	return f
+}
+
+//返回false表示是重放或者过期的信令
+func (f *ReplayFilter) Check(from int64, signal *Signal, now time.Time) bool {
+	current := now.UnixNano() / signalTimestampUnit
+	if signal.Timestamp < current-f.window || signal.Timestamp > current+f.window {
+		return false
+	}
+
+	sender := f.senders[from]
+	if sender == nil {
+		for evict := range f.senders {
+			if len(f.senders) < f.maxSenders {
+				break
+			}
+			delete(f.senders, evict)
+		}
+		sender = &replaySender{sessions: make(map[int64]*seqWindow)}
+		f.senders[from] = sender
+	}
+
+	var ok bool
+	if signal.Seq == 0 {
+		ok = sender.checkRecent(replayKey{timestamp: signal.Timestamp, to: signal.To, signal: signal.Signal})
+	} else {
+		ok = sender.checkSeq(signal.SessionId, signal.Seq, signal.Timestamp)
+	}
+	if ok && signal.Timestamp > sender.last {
+		sender.last = signal.Timestamp
+	}
+	return ok
+}
+
+func (s *replaySender) checkRecent(key replayKey) bool {
+	oldest := 0
+	for i, k := range s.recent {
+		if k == key {
+			return false
+		}
+		if k.timestamp < s.recent[oldest].timestamp {
+			oldest = i
+		}
+	}
+	if len(s.recent) < ReplayRecent {
+		s.recent = append(s.recent, key)
+		return true
+	}
+	if key.timestamp < s.recent[oldest].timestamp {
+		return false //比记住的都旧，分不清是不是见过
+	}
+	s.recent[oldest] = key
+	return true
+}
+
+func (s *replaySender) checkSeq(sid int64, seq uint32, timestamp int64) bool {
+	w := s.sessions[sid]
+	if w == nil {
+		if timestamp <= s.evicted {
+			return false
+		}
+		if len(s.sessions) >= ReplaySessionsPerSender {
+			s.evictSession()
+		}
+		w = &seqWindow{}
+		s.sessions[sid] = w
+	}
+	if !w.check(seq) {
+		return false
+	}
+	if timestamp > w.last {
+		w.last = timestamp
+	}
+	return true
+}
+
+func (s *replaySender) evictSession() {
+	var oldest int64
+	var window *seqWindow
+	for sid, w := range s.sessions {
+		if window == nil || w.last < window.last {
+			oldest, window = sid, w
+		}
+	}
+	delete(s.sessions, oldest)
+	if window.last > s.evicted {
+		s.evicted = window.last
+	}
+}
+
+func (w *seqWindow) check(seq uint32) bool {
+	if seq > w.highest {
+		if shift := seq - w.highest; shift >= ReplaySeqWindow {
+			w.seen = 1
+		} else {
+			w.seen = w.seen<<shift | 1
+		}
+		w.highest = seq
+		return true
+	}
+	diff := w.highest - seq
+	if diff >= ReplaySeqWindow || w.seen&(1<<diff) != 0 {
+		return false
+	}
+	w.seen |= 1 << diff
+	return true
+}
+
+//信令的Timestamp对应的时间
+func SignalTime(timestamp int64) time.Time {
+	return time.Unix(0, timestamp*signalTimestampUnit)
+}
+
+//定期清理时间窗口之外的记录：最近的信令都过期了的发送方和session，之后截获的信令会被时间窗口挡住
+func (f *ReplayFilter) Expire(now time.Time) {
+	current := now.UnixNano() / signalTimestampUnit
+	for from, sender := range f.senders {
+		if sender.last < current-f.window {
+			delete(f.senders, from)
+			continue
+		}
+		for sid, w := range sender.sessions {
+			if w.last < current-f.window {
+				delete(sender.sessions, sid)
+			}
+		}
+	}
+}
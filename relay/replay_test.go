@@ -0,0 +1,118 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func replaySignal(sid int64, seq uint32, timestamp int64) *Signal {
+	signal := NewSignal(YCKCallSignalTypeInvite, 1001, 1002, sid)
+	signal.Seq = seq
+	signal.Timestamp = timestamp
+	return signal
+}
+
+func TestReplayFilterTimestamp(t *testing.T) {
+	f := NewReplayFilter(ReplayWindow)
+	now := time.Now()
+	current := now.UnixNano() / signalTimestampUnit
+	window := int64(ReplayWindow) / signalTimestampUnit
+	if f.Check(1001, replaySignal(7, 1, current-window-1), now) {
+		t.Error("stale signal accepted")
+	}
+	if f.Check(1001, replaySignal(7, 1, current+window+1), now) {
+		t.Error("signal from the future accepted")
+	}
+	if len(f.senders) != 0 {
+		t.Errorf("rejected signals tracked %d senders", len(f.senders))
+	}
+}
+
+func TestReplayFilterSeqWindow(t *testing.T) {
+	f := NewReplayFilter(ReplayWindow)
+	now := time.Now()
+	ts := now.UnixNano() / signalTimestampUnit
+
+	for _, seq := range []uint32{1, 3, 2} { //窗口内乱序的都收
+		if !f.Check(1001, replaySignal(7, seq, ts), now) {
+			t.Fatalf("seq %d rejected", seq)
+		}
+	}
+	//同一序号换个时间戳也是重放
+	if f.Check(1001, replaySignal(7, 2, ts+1), now) {
+		t.Error("replayed seq accepted")
+	}
+	if !f.Check(1001, replaySignal(7, ReplaySeqWindow+2, ts), now) {
+		t.Fatal("seq ahead of the window rejected")
+	}
+	if f.Check(1001, replaySignal(7, 1, ts), now) || f.Check(1001, replaySignal(7, 2, ts), now) {
+		t.Error("seq behind the window accepted")
+	}
+	if !f.Check(1001, replaySignal(7, 4, ts), now) {
+		t.Error("unseen seq inside the window rejected")
+	}
+	//序号是session内的
+	if !f.Check(1001, replaySignal(8, 1, ts), now) || !f.Check(1002, replaySignal(7, 1, ts), now) {
+		t.Error("seq of another session or sender rejected")
+	}
+}
+
+func TestReplayFilterRecent(t *testing.T) {
+	f := NewReplayFilter(ReplayWindow)
+	now := time.Now()
+	ts := now.UnixNano() / signalTimestampUnit
+
+	if !f.Check(1001, replaySignal(0, 0, ts), now) || f.Check(1001, replaySignal(0, 0, ts), now) {
+		t.Fatal("signal without seq not deduplicated")
+	}
+	for i := int64(1); i <= ReplayRecent; i++ {
+		if !f.Check(1001, replaySignal(0, 0, ts+i), now) {
+			t.Fatalf("signal %d rejected", i)
+		}
+	}
+	//第一条已经被挤出，比记住的都旧
+	if f.Check(1001, replaySignal(0, 0, ts), now) {
+		t.Error("replay older than the remembered signals accepted")
+	}
+	if n := len(f.senders[1001].recent); n != ReplayRecent {
+		t.Errorf("remembered %d signals", n)
+	}
+}
+
+func TestReplayFilterBounded(t *testing.T) {
+	f := NewReplayFilter(ReplayWindow)
+	f.maxSenders = 4
+	now := time.Now()
+	ts := now.UnixNano() / signalTimestampUnit
+
+	for uid := int64(1); uid <= 10; uid++ {
+		f.Check(uid, replaySignal(7, 1, ts), now)
+	}
+	if len(f.senders) != f.maxSenders {
+		t.Errorf("tracking %d senders, max %d", len(f.senders), f.maxSenders)
+	}
+
+	for sid := int64(1); sid <= ReplaySessionsPerSender+1; sid++ {
+		f.Check(1001, replaySignal(sid, 1, ts+sid), now)
+	}
+	sender := f.senders[1001]
+	if len(sender.sessions) != ReplaySessionsPerSender || sender.sessions[1] != nil || sender.evicted != ts+1 {
+		t.Fatalf("sessions %d, evicted %d", len(sender.sessions), sender.evicted-ts)
+	}
+	//被淘汰的session窗口没了，重放里面的信令要靠淘汰时记下的时间戳挡住
+	if f.Check(1001, replaySignal(1, 1, ts+1), now) {
+		t.Error("replay in an evicted session accepted")
+	}
+
+	f.Expire(now.Add(ReplayWindow + time.Minute))
+	if len(f.senders) != 0 {
+		t.Errorf("%d senders after expire", len(f.senders))
+	}
+}
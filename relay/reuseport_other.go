@@ -0,0 +1,19 @@
+//go:build !linux
+
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+func listenUdpReusePort(addr string) (*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT not supported on this platform")
+}
@@ -0,0 +1,150 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+uid到地址的路由表：主循环之外（如管理接口的/route）要查用户地址时，原来只能投递到主循环里查，
+注册的用户多了以后这些查询和收包抢主循环。路由表按uid分片，每片是一个不再修改的map，改动时整体替换（RCU）：
+1. 读不加锁：原子地取出分片当前的map再查，读到的是某次刷新后的快照
+2. 写只发生在注册、地址变化和用户过期时，先记入待写的批次，Flush时每个改到的分片复制一次map，改完整体换上，
+   同一分片的多次写合并成一次复制。主循环在收包队列读空或批次满RouteBatchSize时刷新，每个ticker也刷新一次
+3. 分片数为不小于CPU数的2的幂，uid散列到分片，一次刷新只复制改到的分片，分片之间隔开cache line
+主循环仍以s.users为准（它要改User的其他字段），路由表是发布给其他goroutine的只读视图，最多落后一个批次。
+*/
+
+const RouteBatchSize = 256 //待写的批次满了就刷新
+
+type routeShard struct {
+	routes atomic.Value //map[int64]*net.UDPAddr，换上后不再修改
+	_      [48]byte
+}
+
+type routeWrite struct {
+	uid  int64
+	addr *net.UDPAddr //nil为删除
+}
+
+type RoutingTable struct {
+	shards []routeShard
+	mask   uint64
+
+	lock    sync.Mutex //只保护pending，读不用
+	pending []routeWrite
+}
+
+//shards不大于0时按CPU数
+func NewRoutingTable(shards int) *RoutingTable {
+	if shards <= 0 {
+		shards = runtime.NumCPU()
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	t := &RoutingTable{
+		shards: make([]routeShard, n),
+		mask:   uint64(n - 1),
+	}
+	for i := range t.shards {
+		t.shards[i].routes.Store(map[int64]*net.UDPAddr{})
+	}
+	return t
+}
+
+func (t *RoutingTable) shardIndex(uid int64) uint64 {
+	h := uint64(uid) * 0x9e3779b97f4a7c15 //连续的uid也均匀分散
+	return (h >> 32) & t.mask
+}
+
+//不加锁，返回最近一次刷新后的地址，没有时返回nil
+func (t *RoutingTable) Lookup(uid int64) *net.UDPAddr {
+	routes := t.shards[t.shardIndex(uid)].routes.Load().(map[int64]*net.UDPAddr)
+	return routes[uid]
+}
+
+//最近一次刷新后的路由数
+func (t *RoutingTable) Len() int {
+	n := 0
+	for i := range t.shards {
+		n += len(t.shards[i].routes.Load().(map[int64]*net.UDPAddr))
+	}
+	return n
+}
+
+//记入待写的批次，Flush后才能读到，返回待写的数目
+func (t *RoutingTable) Set(uid int64, addr *net.UDPAddr) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = append(t.pending, routeWrite{uid: uid, addr: addr})
+	return len(t.pending)
+}
+
+func (t *RoutingTable) Delete(uid int64) int {
+	return t.Set(uid, nil)
+}
+
+func (t *RoutingTable) Pending() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.pending)
+}
+
+//应用待写的批次，返回应用的写数。只能在一个goroutine里调用（relay的主循环）
+func (t *RoutingTable) Flush() int {
+	t.lock.Lock()
+	writes := t.pending
+	t.pending = nil
+	t.lock.Unlock()
+	if len(writes) == 0 {
+		return 0
+	}
+
+	byShard := make(map[uint64][]routeWrite)
+	for _, w := range writes {
+		i := t.shardIndex(w.uid)
+		byShard[i] = append(byShard[i], w)
+	}
+	for i, ws := range byShard {
+		shard := &t.shards[i]
+		old := shard.routes.Load().(map[int64]*net.UDPAddr)
+		routes := make(map[int64]*net.UDPAddr, len(old)+len(ws))
+		for uid, addr := range old {
+			routes[uid] = addr
+		}
+		for _, w := range ws { //按写入的顺序，后写的覆盖先写的
+			if w.addr == nil {
+				delete(routes, w.uid)
+			} else {
+				routes[w.uid] = w.addr
+			}
+		}
+		shard.routes.Store(routes)
+	}
+	return len(writes)
+}
+
+//主循环里用户地址变化后调用
+func (s *Service) updateRoute(user *User) {
+	if user.UdpAddr != nil {
+		s.routes.Set(user.Uid, user.UdpAddr)
+	}
+}
+
+//收包队列读空或批次满时刷新，攒够一批再复制
+func (s *Service) flushRoutes() {
+	if pending := s.routes.Pending(); pending > 0 && (pending >= RouteBatchSize || len(s.packetReceiveCh) == 0) {
+		s.routes.Flush()
+	}
+}
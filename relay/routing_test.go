@@ -0,0 +1,194 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoutingTable(t *testing.T) {
+	rt := NewRoutingTable(3)
+	if len(rt.shards) != 4 {
+		t.Errorf("%d shards, want 4", len(rt.shards))
+	}
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20002}
+
+	rt.Set(1001, a)
+	rt.Set(1002, a)
+	if rt.Lookup(1001) != nil || rt.Pending() != 2 {
+		t.Fatal("write visible before flush")
+	}
+	if n := rt.Flush(); n != 2 || rt.Lookup(1001) != a || rt.Lookup(1002) != a || rt.Len() != 2 {
+		t.Fatalf("flushed %d, len %d", n, rt.Len())
+	}
+
+	//同一批里后写的覆盖先写的
+	rt.Set(1001, b)
+	rt.Delete(1002)
+	rt.Set(1002, b)
+	rt.Delete(1001)
+	rt.Flush()
+	if rt.Lookup(1001) != nil || rt.Lookup(1002) != b || rt.Len() != 1 {
+		t.Errorf("after batch 1001:%v 1002:%v", rt.Lookup(1001), rt.Lookup(1002))
+	}
+	if rt.Flush() != 0 {
+		t.Error("empty batch flushed")
+	}
+}
+
+func TestServiceRoutes(t *testing.T) {
+	config := GetDefaultConfig()
+	config.AllowPlaintext = true //测试客户端不做链路加密
+	s := NewService(config)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	reg := NewMessage(UdpMessageTypeUserReg, 1001, 0, 0, nil, nil)
+	s.handleMessageUserReg(reg, &ReceivedPacket{FromUdpAddr: addr, Time: time.Now().UnixNano()})
+	s.flushRoutes() //收包队列是空的
+	if got := s.routes.Lookup(1001); got == nil || got.String() != addr.String() {
+		t.Fatalf("route %v after user reg", got)
+	}
+
+	s.users[1001].LastActiveTime = time.Now().Add(-time.Hour)
+	s.handleTicker(time.Now())
+	if got := s.routes.Lookup(1001); got != nil {
+		t.Errorf("route %v after user expired", got)
+	}
+}
+
+//读的同时主循环不停地写和刷新
+func TestRoutingTableConcurrent(t *testing.T) {
+	rt := NewRoutingTable(0)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uid := int64(0); ; uid = (uid + 1) % 1000 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if got := rt.Lookup(uid); got != nil && got != addr {
+					t.Errorf("route of %d is %v", uid, got)
+					return
+				}
+			}
+		}()
+	}
+	for round := 0; round < 100; round++ {
+		for uid := int64(0); uid < 1000; uid++ {
+			if (uid+int64(round))%3 == 0 {
+				rt.Delete(uid)
+			} else {
+				rt.Set(uid, addr)
+			}
+		}
+		rt.Flush()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+const benchmarkRoutes = 100000
+
+func newBenchmarkRoutes() *RoutingTable {
+	rt := NewRoutingTable(0)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	for uid := int64(0); uid < benchmarkRoutes; uid++ {
+		rt.Set(uid, addr)
+	}
+	rt.Flush()
+	return rt
+}
+
+func BenchmarkRoutingTableLookup_Parallel(b *testing.B) {
+	rt := newBenchmarkRoutes()
+	var worker int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		uid := atomic.AddInt64(&worker, 7919)
+		for pb.Next() {
+			uid = (uid + 1) % benchmarkRoutes
+			rt.Lookup(uid)
+		}
+	})
+}
+
+//对比：一个读写锁保护的map
+func BenchmarkRWMutexMapLookup_Parallel(b *testing.B) {
+	var lock sync.RWMutex
+	routes := make(map[int64]*net.UDPAddr)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	for uid := int64(0); uid < benchmarkRoutes; uid++ {
+		routes[uid] = addr
+	}
+	var worker int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		uid := atomic.AddInt64(&worker, 7919)
+		for pb.Next() {
+			uid = (uid + 1) % benchmarkRoutes
+			lock.RLock()
+			_ = routes[uid]
+			lock.RUnlock()
+		}
+	})
+}
+
+//注册不停地来，每RouteBatchSize个写刷新一次
+func BenchmarkRoutingTableLookupWhileWriting_Parallel(b *testing.B) {
+	rt := newBenchmarkRoutes()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 20001}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for uid := int64(0); ; uid = (uid + 1) % benchmarkRoutes {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if rt.Set(uid, addr) >= RouteBatchSize {
+				rt.Flush()
+			}
+		}
+	}()
+	var worker int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		uid := atomic.AddInt64(&worker, 7919)
+		for pb.Next() {
+			uid = (uid + 1) % benchmarkRoutes
+			rt.Lookup(uid)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func BenchmarkRoutingTableFlush(b *testing.B) {
+	rt := newBenchmarkRoutes()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 20001}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < RouteBatchSize; j++ {
+			rt.Set(int64(i*RouteBatchSize+j)%benchmarkRoutes, addr)
+		}
+		rt.Flush()
+	}
+}
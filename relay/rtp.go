@@ -0,0 +1,146 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+RTP封装模式：
+消息带UdpMessageFlagRtp时，音视频包的payload是一个完整的RTP包(RFC 3550)，
+丢包反馈走UdpMessageTypeRtcp，payload为RTCP compound packet，relay只解析其中的Generic NACK(RFC 4585)
+用于从QueueOut中直接重发，其他RTCP包原样转给Dest。
+*/
+
+const (
+	RtpHeaderSize = 12
+
+	RtcpTypeSR         = 200
+	RtcpTypeRR         = 201
+	RtcpTypeRTPFB      = 205
+	RtcpFmtGenericNack = 1
+)
+
+type RtpHeader struct {
+	Marker         bool
+	PayloadType    uint8
+	SequenceNumber uint16
+	Timestamp      uint32
+	Ssrc           uint32
+	PayloadOffset  int
+}
+
+func ParseRtpHeader(data []byte) (*RtpHeader, error) {
+	if len(data) < RtpHeaderSize {
+		return nil, errors.New("incorrect rtp packet, len < 12")
+	}
+	if data[0]>>6 != 2 {
+		return nil, errors.New("incorrect rtp version")
+	}
+
+	h := &RtpHeader{
+		Marker:         data[1]&0x80 != 0,
+		PayloadType:    data[1] & 0x7f,
+		SequenceNumber: binary.BigEndian.Uint16(data[2:4]),
+		Timestamp:      binary.BigEndian.Uint32(data[4:8]),
+		Ssrc:           binary.BigEndian.Uint32(data[8:12]),
+	}
+
+	p := RtpHeaderSize + 4*int(data[0]&0x0f)
+	if data[0]&0x10 != 0 { //header extension
+		if len(data) < p+4 {
+			return nil, errors.New("incorrect rtp header extension")
+		}
+		p += 4 + 4*int(binary.BigEndian.Uint16(data[p+2:p+4]))
+	}
+	if p > len(data) {
+		return nil, errors.New("incorrect rtp header length")
+	}
+	h.PayloadOffset = p
+
+	return h, nil
+}
+
+type RtcpNack struct {
+	SenderSsrc uint32
+	MediaSsrc  uint32
+	Seqs       []uint16
+}
+
+// 从RTCP compound packet中取出所有Generic NACK，other为NACK以外的RTCP包
+func ParseRtcpNacks(data []byte) (nacks []*RtcpNack, other []byte, err error) {
+	p := 0
+	for p+4 <= len(data) {
+		if data[p]>>6 != 2 {
+			return nil, nil, errors.New("incorrect rtcp version")
+		}
+		format := data[p] & 0x1f
+		pt := data[p+1]
+		length := 4 * (int(binary.BigEndian.Uint16(data[p+2:p+4])) + 1)
+		if p+length > len(data) {
+			return nil, nil, errors.New("incorrect rtcp packet length")
+		}
+		packet := data[p : p+length]
+
+		if pt == RtcpTypeRTPFB && format == RtcpFmtGenericNack && length >= 12 {
+			nack := &RtcpNack{
+				SenderSsrc: binary.BigEndian.Uint32(packet[4:8]),
+				MediaSsrc:  binary.BigEndian.Uint32(packet[8:12]),
+			}
+			for q := 12; q+4 <= length; q += 4 {
+				pid := binary.BigEndian.Uint16(packet[q : q+2])
+				blp := binary.BigEndian.Uint16(packet[q+2 : q+4])
+				nack.Seqs = append(nack.Seqs, pid)
+				for i := uint16(0); i < 16; i++ {
+					if blp&(1<<i) != 0 {
+						nack.Seqs = append(nack.Seqs, pid+i+1)
+					}
+				}
+			}
+			nacks = append(nacks, nack)
+		} else {
+			other = append(other, packet...)
+		}
+		p += length
+	}
+
+	return nacks, other, nil
+}
+
+//把序号列表重新编码成Generic NACK，PID+BLP每项覆盖17个连续序号
+func BuildRtcpNack(senderSsrc uint32, mediaSsrc uint32, seqs []uint16) []byte {
+	fci := make([]byte, 0)
+	for i := 0; i < len(seqs); {
+		pid := seqs[i]
+		blp := uint16(0)
+		j := i + 1
+		for ; j < len(seqs); j++ {
+			diff := seqs[j] - pid
+			if diff == 0 || diff > 16 {
+				break
+			}
+			blp |= 1 << (diff - 1)
+		}
+		item := make([]byte, 4)
+		binary.BigEndian.PutUint16(item[0:2], pid)
+		binary.BigEndian.PutUint16(item[2:4], blp)
+		fci = append(fci, item...)
+		i = j
+	}
+
+	data := make([]byte, 12+len(fci))
+	data[0] = 2<<6 | RtcpFmtGenericNack
+	data[1] = RtcpTypeRTPFB
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)/4-1))
+	binary.BigEndian.PutUint32(data[4:8], senderSsrc)
+	binary.BigEndian.PutUint32(data[8:12], mediaSsrc)
+	copy(data[12:], fci)
+	return data
+}
@@ -0,0 +1,142 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/xujiajundd/ycng/utils/errs"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/*
+信令Info的字段级加密：Invite等信令的Info里有显示名、头像、app payload这些个人数据，经udp明文传输，
+客户端可以用session key把它们加密后放进Info["sealed"]，session manager和relay只看其他字段，原样转发。
+1. 请求sid时session manager生成session key，base64放在SidCreated的Info["session_key"]里；
+   被叫在session manager转发（1-1）或代发（多方）的Invite里收到同一个key，换设备时在Handover的回复里收到
+2. SealInfo把指定字段从Info移出，json编码后用XChaCha20-Poly1305加密，nonce在前，base64放入Info["sealed"]；
+   sid作为附加数据，sealed挪到别的session里解不开
+3. OpenInfo解密后把字段合并回Info，没有sealed时什么也不做，老客户端照常收发明文
+session key由session manager下发，防的是客户端和relay之间网络上的窃听，不防session manager本身。
+*/
+
+const (
+	SessionKeySize = chacha20poly1305.KeySize
+
+	InfoSessionKey = "session_key"
+	InfoSealed     = "sealed"
+)
+
+//SealInfo不指定字段时加密这些
+var SensitiveInfoFields = []string{"name", "avatar", "nickname", "payload"}
+
+var errSealedInfo = errs.New(errs.Crypto, "incorrect sealed info")
+
+//返回base64编码的新session key
+func NewSessionKey() (string, error) {
+	key := make([]byte, SessionKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+//把Info里的fields加密到Info["sealed"]，key为NewSessionKey返回的base64；Info里没有这些字段时不改动
+func (s *Signal) SealInfo(key string, fields ...string) error {
+	aead, err := sealedInfoAead(key)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		fields = SensitiveInfoFields
+	}
+	plain := make(map[string]interface{})
+	for _, f := range fields {
+		if v, ok := s.Info[f]; ok && f != InfoSealed {
+			plain[f] = v
+		}
+	}
+	if len(plain) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(plain)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, data, sealedInfoAd(s.SessionId))
+	for f := range plain {
+		delete(s.Info, f)
+	}
+	s.Info[InfoSealed] = base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+//解密Info["sealed"]并合并回Info
+func (s *Signal) OpenInfo(key string) error {
+	value, ok := s.Info[InfoSealed]
+	if !ok {
+		return nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return errSealedInfo
+	}
+	sealed, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return err
+	}
+	aead, err := sealedInfoAead(key)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return errSealedInfo
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], sealedInfoAd(s.SessionId))
+	if err != nil {
+		return err
+	}
+	plain := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&plain); err != nil {
+		return err
+	}
+	delete(s.Info, InfoSealed)
+	for k, v := range plain {
+		s.Info[k] = v
+	}
+	return s.validate()
+}
+
+func sealedInfoAead(key string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != SessionKeySize {
+		return nil, errs.New(errs.Crypto, "incorrect session key size")
+	}
+	return chacha20poly1305.NewX(raw)
+}
+
+func sealedInfoAd(sid int64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(sid))
+	return ad
+}
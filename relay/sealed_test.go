@@ -0,0 +1,65 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"testing"
+)
+
+func TestSealInfo(t *testing.T) {
+	key, err := NewSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSignal(YCKCallSignalTypeInvite, 1001, 1002, 42)
+	s.Info = map[string]interface{}{"name": "Alice", "avatar": "https://example.com/a.png", "call_type": "video"}
+	if err = s.SealInfo(key); err != nil {
+		t.Fatal(err)
+	}
+	if s.Info["name"] != nil || s.Info["avatar"] != nil || s.Info["call_type"] != "video" || s.Info[InfoSealed] == nil {
+		t.Fatalf("sealed info %v", s.Info)
+	}
+
+	data, err := s.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := NewSignalTemp()
+	if err = received.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = received.OpenInfo(key); err != nil {
+		t.Fatal(err)
+	}
+	if received.Info["name"] != "Alice" || received.Info["avatar"] != "https://example.com/a.png" || received.Info[InfoSealed] != nil {
+		t.Errorf("opened info %v", received.Info)
+	}
+
+	//换了session或key都解不开
+	other := NewSignalTemp()
+	other.Unmarshal(data)
+	other.SessionId = 43
+	if err = other.OpenInfo(key); err == nil {
+		t.Error("sealed info opened in another session")
+	}
+	otherKey, _ := NewSessionKey()
+	other.Unmarshal(data)
+	if err = other.OpenInfo(otherKey); err == nil {
+		t.Error("sealed info opened with another key")
+	}
+
+	//没有sealed时不变
+	plain := NewSignal(YCKCallSignalTypeInvite, 1001, 1002, 42)
+	plain.Info = map[string]interface{}{"call_type": "audio"}
+	if err = plain.SealInfo(key); err != nil || plain.Info[InfoSealed] != nil {
+		t.Errorf("seal without sensitive fields %v %v", plain.Info, err)
+	}
+	if err = plain.OpenInfo(key); err != nil || plain.Info["call_type"] != "audio" {
+		t.Errorf("open plain info %v %v", plain.Info, err)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/xujiajundd/ycng/utils"
+)
+
+/*
+发送队列：主循环只把要发的包按类型放进各优先级队列，由单独的发送goroutine写socket，总是先发高优先级的。
+负载高时信令和注册不会排在大量视频包后面：
+  SendPrioritySignal  信令、注册、打洞、探测和session manager的控制消息，以及未知类型
+  SendPriorityAudio   音频和各种重传/i帧请求、RTCP等小的反馈包
+  SendPriorityBulk    视频、缩略图和数据
+每个队列有界，满了丢新来的包并计数，不阻塞主循环。同一优先级内保持顺序。
+发送goroutine每次取出已排队的最多SendBatchSize个包交给batchWriter一起写，Linux上用一次sendmmsg和UDP GSO，见gso_linux.go。
+*/
+
+const (
+	SendPrioritySignal = 0
+	SendPriorityAudio  = 1
+	SendPriorityBulk   = 2
+	sendPriorities     = 3
+
+	SendQueueSize = 4096 //每个优先级的队列长度
+	SendBatchSize = 64   //发送goroutine一次最多写出的包数
+)
+
+func sendPriorityOf(msgType uint8) int {
+	switch msgType {
+	case UdpMessageTypeAudioStream, UdpMessageTypeRtcp,
+		UdpMessageTypeVideoNack, UdpMessageTypeVideoAskForIFrame,
+		UdpMessageTypeThumbVideoNack, UdpMessageTypeThumbVideoAskForIFrame,
+		UdpMessageTypeDataNack, UdpMessageTypeUnicastDataNack:
+		return SendPriorityAudio
+	case UdpMessageTypeVideoStream, UdpMessageTypeVideoStreamIFrame,
+		UdpMessageTypeThumbVideoStream, UdpMessageTypeThumbVideoStreamIFrame,
+		UdpMessageTypeData, UdpMessageTypeUnicastData:
+		return SendPriorityBulk
+	}
+	return SendPrioritySignal
+}
+
+type outPacket struct {
+	buf  []byte //从utils.GetPacketBuffer取的缓冲区，发完归还
+	data []byte //buf里实际要发的部分
+	addr *net.UDPAddr
+}
+
+type SendQueue struct {
+	queues  [sendPriorities]chan outPacket
+	ready   chan struct{} //每入队一个包放一个令牌，容量为所有队列之和，不会阻塞
+	dropped [sendPriorities]uint64
+}
+
+func NewSendQueue(size int) *SendQueue {
+	q := &SendQueue{
+		ready: make(chan struct{}, size*sendPriorities),
+	}
+	for i := range q.queues {
+		q.queues[i] = make(chan outPacket, size)
+	}
+	return q
+}
+
+//入队，取得buf的所有权，队列满时丢弃并返回false
+func (q *SendQueue) Push(buf []byte, data []byte, addr *net.UDPAddr, priority int) bool {
+	select {
+	case q.queues[priority] <- outPacket{buf: buf, data: data, addr: addr}:
+		q.ready <- struct{}{}
+		return true
+	default:
+		atomic.AddUint64(&q.dropped[priority], 1)
+		utils.PutPacketBuffer(buf)
+		return false
+	}
+}
+
+//按优先级取一个包，stop关闭时返回false
+func (q *SendQueue) pop(stop <-chan struct{}) (outPacket, bool) {
+	select {
+	case <-q.ready:
+	case <-stop:
+		return outPacket{}, false
+	}
+	return q.take(), true
+}
+
+//拿到令牌后取一个包，令牌是包入队后才放的，所以至少有一个包可取
+func (q *SendQueue) take() outPacket {
+	for {
+		for _, queue := range q.queues {
+			select {
+			case p := <-queue:
+				return p
+			default:
+			}
+		}
+	}
+}
+
+//等到至少一个包后，再取出已排队的包直到batch满，stop关闭时返回空的batch
+func (q *SendQueue) popBatch(stop <-chan struct{}, batch []outPacket) []outPacket {
+	p, ok := q.pop(stop)
+	if !ok {
+		return batch
+	}
+	batch = append(batch, p)
+	for len(batch) < cap(batch) {
+		select {
+		case <-q.ready:
+			batch = append(batch, q.take())
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+//各优先级丢弃的包数
+func (q *SendQueue) Dropped() []uint64 {
+	dropped := make([]uint64, sendPriorities)
+	for i := range dropped {
+		dropped[i] = atomic.LoadUint64(&q.dropped[i])
+	}
+	return dropped
+}
+
+func (q *SendQueue) run(w batchWriter, stop <-chan struct{}) {
+	batch := make([]outPacket, 0, SendBatchSize)
+	for {
+		batch = q.popBatch(stop, batch[:0])
+		if len(batch) == 0 {
+			return
+		}
+		w.write(batch)
+		for i := range batch {
+			utils.PutPacketBuffer(batch[i].buf)
+			batch[i] = outPacket{}
+		}
+	}
+}
+
+//一次写出一批包，不支持批量的平台逐个写
+type batchWriter interface {
+	write(packets []outPacket)
+}
+
+type loopWriter struct {
+	conn *net.UDPConn
+}
+
+func (w *loopWriter) write(packets []outPacket) {
+	for _, p := range packets {
+		w.conn.WriteToUDP(p.data, p.addr)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendQueuePriority(t *testing.T) {
+	q := NewSendQueue(4)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	push := func(b byte, priority int) {
+		q.Push(nil, []byte{b}, addr, priority)
+	}
+	push(1, SendPriorityBulk)
+	push(2, SendPriorityAudio)
+	push(3, SendPriorityBulk)
+	push(4, SendPrioritySignal)
+	push(5, SendPriorityAudio)
+
+	stop := make(chan struct{})
+	var got []byte
+	for i := 0; i < 5; i++ {
+		p, ok := q.pop(stop)
+		if !ok {
+			t.Fatal("pop stopped")
+		}
+		got = append(got, p.data[0])
+	}
+	if string(got) != string([]byte{4, 2, 5, 1, 3}) {
+		t.Errorf("sent order %v, want [4 2 5 1 3]", got)
+	}
+
+	close(stop)
+	if _, ok := q.pop(stop); ok {
+		t.Error("pop after stop")
+	}
+}
+
+func TestSendQueueDropsWhenFull(t *testing.T) {
+	q := NewSendQueue(2)
+	for i := 0; i < 3; i++ {
+		q.Push(nil, []byte{0}, nil, SendPriorityBulk)
+	}
+	if !q.Push(nil, []byte{0}, nil, SendPrioritySignal) {
+		t.Error("signal dropped when only bulk queue full")
+	}
+	if dropped := q.Dropped(); dropped[SendPriorityBulk] != 1 || dropped[SendPrioritySignal] != 0 {
+		t.Errorf("dropped = %v", dropped)
+	}
+}
+
+func TestSendQueueRun(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	q := NewSendQueue(4)
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(newBatchWriter(server, true), stop)
+	q.Push(nil, []byte("hello"), client.LocalAddr().(*net.UDPAddr), SendPrioritySignal)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("received %q, %v", buf[:n], err)
+	}
+}
+
+func TestSendPriorityOf(t *testing.T) {
+	cases := map[uint8]int{
+		UdpMessageTypeUserSignal:       SendPrioritySignal,
+		UdpMessageTypeTurnReg:          SendPrioritySignal,
+		UdpMessageTypeSessionControl:   SendPrioritySignal,
+		UdpMessageTypeAudioStream:      SendPriorityAudio,
+		UdpMessageTypeVideoNack:        SendPriorityAudio,
+		UdpMessageTypeVideoStream:      SendPriorityBulk,
+		UdpMessageTypeThumbVideoStream: SendPriorityBulk,
+		UdpMessageTypeData:             SendPriorityBulk,
+	}
+	for msgType, want := range cases {
+		if got := sendPriorityOf(msgType); got != want {
+			t.Errorf("priority of %d = %d, want %d", msgType, got, want)
+		}
+	}
+}
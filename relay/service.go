@@ -15,11 +15,19 @@ import (
 
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/xujiajundd/ycng/utils/logging"
-	//"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/errs"
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/json"
+	"net"
 	"reflect"
 )
 
@@ -27,7 +35,8 @@ type Service struct {
 	config          *Config
 	sessions        map[int64]*Session
 	users           map[int64]*User
-	storage         *Storage
+	routes          *RoutingTable //users中各用户地址的只读视图，给主循环之外读，见routing.go
+	store           Store
 	udp_server      *UdpServer
 	tcp_server      *TcpServer
 	packetReceiveCh chan *ReceivedPacket //通过udp或者tcp进来的包
@@ -39,6 +48,51 @@ type Service struct {
 	ticker    *time.Ticker
 
 	acc_msg map[uint8]int
+
+	recorder Recorder
+
+	audioCodec AudioCodecFactory
+	mixTicker  *time.Ticker
+
+	links        map[string]*Link  //udp地址 -> 链路密钥
+	capabilities map[string]uint32 //udp地址 -> UserReg时协商的能力位图
+	mtus         map[string]int    //udp地址 -> 探测到的路径MTU，见mtu.go
+	reassembler  *Reassembler      //信令分片重组
+	linkSignKey  ed25519.PrivateKey
+
+	replay *ReplayFilter
+	trace  *logging.Trace
+
+	blocklist   *Blocklist
+	rateLimiter *RateLimiter
+	admin       *AdminServer
+	audit       *AuditLog //管理操作的审计日志，见audit.go
+
+	traceCtx context.Context //正在处理的包的trace上下文，没有trace时为nil
+
+	traffic     trafficCounter
+	errorCounts errs.Counter //按类别的错误数，见errors.go
+	adminCh     chan func()  //管理接口投递到主循环执行的操作
+
+	watchdog *utils.Watchdog  //检查主循环和收包goroutine是否卡住，未开启时为nil
+	loopBeat *utils.Heartbeat //主循环处理一项时为busy
+
+	capture *PacketCapture //调试抓包，未开启时为nil
+
+	netProbes       map[string]*netProbe //udp地址 -> 进行中的通话前探测
+	keepaliveProbes map[string]bool      //udp地址 -> 有等待回复的NAT映射探测，见keepalive.go
+	echoes          map[string]time.Time //udp地址 -> 媒体回环的截止时间，见echo.go
+
+	draining bool //排空中，不接受新用户和新session，见drain.go
+
+	usage          *UsageAggregator //计费用量，见usage.go
+	relayedBytes   map[int64]int64  //uid -> 上次flush之后转发的媒体字节
+	lastUsageFlush time.Time
+
+	presence         []PresenceEntry //待发给session manager的用户上下线，见presence.go
+	lastPresenceSync time.Time
+
+	exporter *MetricsExporter //媒体质量指标导出，未配置时为nil，见metrics_export.go
 }
 
 func NewService(config *Config) *Service {
@@ -46,26 +100,100 @@ func NewService(config *Config) *Service {
 		config:          config,
 		sessions:        make(map[int64]*Session),
 		users:           make(map[int64]*User),
-		storage:         NewStorage(),
+		routes:          NewRoutingTable(0),
+		store:           openStore(config),
 		packetReceiveCh: make(chan *ReceivedPacket, 10),
 		isRunning:       false,
 		stop:            make(chan struct{}),
 		ticker:          time.NewTicker(30 * time.Second),
 		acc_msg:         make(map[uint8]int),
+		recorder:        NewPcapRecorder(config.RecordDir),
+		mixTicker:       time.NewTicker(MixIntervalMs * time.Millisecond),
+		links:           make(map[string]*Link),
+		capabilities:    make(map[string]uint32),
+		mtus:            make(map[string]int),
+		reassembler:     NewReassembler(FragmentTimeout),
+		adminCh:         make(chan func()),
+		replay:          NewReplayFilter(ReplayWindow),
+		trace:           logging.NewTrace(logging.Logger),
+		rateLimiter:     NewRateLimiter(config.RateLimit),
+		netProbes:       make(map[string]*netProbe),
+		keepaliveProbes: make(map[string]bool),
+		echoes:          make(map[string]time.Time),
+		relayedBytes:    make(map[int64]int64),
+		lastUsageFlush:  time.Now(),
 	}
 
+	if err := SetupObfuscationKeys(config.ObfuscationKeys, time.Duration(config.ObfuscationGrace)*time.Second); err != nil {
+		logging.Logger.Error("obfuscation keys error:", err)
+	}
+	if key, err := ParseLinkSigningKey(config.LinkSigningKey); err != nil {
+		logging.Logger.Error("link signing key error:", err)
+	} else {
+		service.linkSignKey = key
+	}
+	service.blocklist = NewBlocklist(service.store)
+	if config.Store != "" {
+		service.usage = NewUsageAggregator(service.store)
+	} else {
+		service.usage = NewUsageAggregator(nil)
+	}
+	service.audit = OpenAuditLogOrMemory(config.AuditFile)
 	service.udp_server = NewUdpServer(config, service.packetReceiveCh)
+	if config.WatchdogTimeout > 0 {
+		var onStall func(string, time.Duration)
+		if config.WatchdogExit {
+			onStall = utils.ExitOnStall
+		}
+		service.watchdog = utils.NewWatchdog(time.Duration(config.WatchdogTimeout)*time.Second, onStall)
+		service.loopBeat = service.watchdog.Watch("relay main loop")
+		service.udp_server.watchdog = service.watchdog
+	}
 	service.tcp_server = NewTcpServer(config, service.packetReceiveCh)
+	if config.AdminAddr != "" {
+		service.admin = NewAdminServer(config.AdminAddr, service)
+	}
+	if config.MetricsExport != "" {
+		exporter, err := OpenMetricsExporter(config.MetricsExport)
+		if err != nil {
+			logging.Logger.Error("metrics export error:", err)
+		} else {
+			service.exporter = exporter
+		}
+	}
+	if config.CaptureFile != "" {
+		capture, err := NewPacketCapture(config.CaptureFile)
+		if err != nil {
+			logging.Logger.Error("open capture file error:", err)
+		} else {
+			logging.Logger.Warn("capturing received packets to ", config.CaptureFile)
+			service.capture = capture
+		}
+	}
 
 	return service
 }
 
+//设置服务端混音用的codec，未设置时不做混音
+func (s *Service) SetAudioCodec(factory AudioCodecFactory) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.audioCodec = factory
+}
+
 func (s *Service) Start() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	if !s.isRunning {
 		s.udp_server.Start()
 		s.tcp_server.Start()
+		s.watchdog.Start()
+		if s.admin != nil {
+			s.admin.Start()
+		}
+		if s.exporter != nil {
+			s.exporter.Start()
+		}
 		s.isRunning = true
 
 		s.wg.Add(1)
@@ -79,6 +207,16 @@ func (s *Service) Stop() {
 	if s.isRunning {
 		s.udp_server.Stop()
 		s.tcp_server.Stop()
+		s.watchdog.Stop()
+		if s.admin != nil {
+			s.admin.Stop()
+		}
+		if s.exporter != nil {
+			s.exporter.Stop()
+		}
+		s.usage.Flush(time.Now())
+		s.store.Close()
+		s.audit.Close()
 		s.isRunning = false
 	}
 	close(s.stop)
@@ -103,26 +241,131 @@ func (s *Service) loop() {
 	for {
 		select {
 		case <-s.stop:
+			if s.capture != nil {
+				s.capture.Close()
+			}
 			return
 		case packet := <-s.packetReceiveCh:
+			s.loopBeat.Busy()
 			s.handlePacket(packet)
+			s.flushRoutes()
+			s.flushPresence()
 		case time := <-s.ticker.C:
+			s.loopBeat.Busy()
 			s.handleTicker(time)
+		case <-s.mixTicker.C:
+			s.loopBeat.Busy()
+			s.handleMixTicker()
+		case fn := <-s.adminCh:
+			s.loopBeat.Busy()
+			fn()
 		}
+		s.loopBeat.Idle()
 	}
 }
 
 func (s *Service) handlePacket(packet *ReceivedPacket) {
 	//TODO：这个可以做性能优化，分配到多个线程去处理
 	//其实单线程也可以，如果server的资源有富余，可以起多个relay实例。
-	msg, err := NewMessageFromObfuscatedData(packet.Body)
+	//解混淆时已经复制出一份，处理完收包缓冲区就可以归还，留给快速转发的除外（见forward.go）
+	kept := false
+	defer func() {
+		if !kept {
+			utils.PutPacketBuffer(packet.Body)
+		}
+	}()
+	if s.capture != nil {
+		if err := s.capture.Write(packet); err != nil {
+			s.log().Warn("capture packet error:", err)
+		}
+	}
+	s.traffic.recvPackets++
+	s.traffic.recvBytes += uint64(len(packet.Body))
+	if s.config.MaxDatagram > 0 && len(packet.Body) > s.config.MaxDatagram {
+		s.traffic.oversized++
+		return
+	}
+	now := time.Unix(0, packet.Time)
+	if packet.FromUdpAddr != nil {
+		ip := packet.FromUdpAddr.IP.String()
+		if s.blocklist.IsIpBlocked(ip, now) {
+			return
+		}
+		allow, ban := s.rateLimiter.Hit(ip, now)
+		if ban {
+			s.log().Warn("ip ", ip, " exceeded rate limit repeatedly, ban for ", RateBanDuration)
+			s.blocklist.BlockIp(ip, RateBanDuration)
+		}
+		if !allow {
+			return
+		}
+	}
+
+	msg, key, err := parseObfuscated(packet.Body)
 	if err != nil {
-		logging.Logger.Warn("error:", err, " for packet received from <", packet.FromUdpAddr.String(), ">")
+		s.reportError(errs.Wrap(err, "parse packet").From(packet.FromUdpAddr.String()))
 		return
 	}
+	kept = keepWire(msg, key, packet.Body)
+
+	if s.blocklist.IsUidBlocked(msg.From, now) {
+		return
+	}
+
+	if msg.Version > ProtocolVersion {
+		s.log().Warn("drop packet with unsupported protocol version ", msg.Version, " from <", packet.FromUdpAddr.String(), ">")
+		return
+	}
+
+	s.setTrace(msg, packet)
+	defer s.trace.Clear()
 
 	s.acc_msg[msg.MsgType]++
 
+	if msg.MsgType == UdpMessageTypeKeyExchange {
+		s.reportError(errs.Wrap(errKeyExchangeDeprecated, "key exchange").From(packet.FromUdpAddr.String()))
+		return
+	}
+	if !s.openMessage(msg, packet) {
+		return
+	}
+	if crossesTenant(msg) {
+		return
+	}
+	AppendHop(msg, HopRelayIn, now)
+
+	if span := s.startPacketSpan(msg); span != nil {
+		defer func() {
+			span.End()
+			s.traceCtx = nil
+		}()
+	}
+
+	if s.echo(msg, packet) {
+		return
+	}
+
+	if isHoldableMessage(msg.MsgType) && s.isHeld(msg) {
+		return
+	}
+
+	if isHoldableMessage(msg.MsgType) && s.isFromOldDevice(msg, packet) {
+		return
+	}
+
+	if !s.mediaAllowed(msg) {
+		return
+	}
+	s.countRelayedBytes(msg, packet)
+
+	if isRecordableMessage(msg.MsgType) {
+		if session := s.sessions[msg.To]; session != nil && session.Recording && session.Participants[msg.From] != nil {
+			s.recorder.Record(session.Id, msg.From, msg.MsgType, msg.Payload, packet.Time)
+		} else if session != nil && session.Voicemail.records(msg, packet.Time) {
+			s.recorder.Record(session.Id, msg.From, msg.MsgType, msg.Payload, packet.Time)
+		}
+	}
+
 	switch msg.MsgType {
 	case UdpMessageTypeNoop:
 		s.handleMessageNoop(msg, packet)
@@ -188,26 +431,73 @@ func (s *Service) handlePacket(packet *ReceivedPacket) {
 	case UdpMessageTypeMediaControl:
 		s.handleMessageMediaControl(msg, packet)
 
+	case UdpMessageTypeRtcp:
+		s.handleMessageRtcp(msg, packet)
+
+	case UdpMessageTypeRecordControl:
+		s.handleMessageRecordControl(msg, packet)
+
+	case UdpMessageTypeHoldControl:
+		s.handleMessageHoldControl(msg, packet)
+
+	case UdpMessageTypeSessionControl:
+		s.handleMessageSessionControl(msg, packet)
+
+	case UdpMessageTypeHandoverControl:
+		s.handleMessageHandoverControl(msg, packet)
+
+	case UdpMessageTypeNetProbe:
+		s.handleMessageNetProbe(msg, packet)
+
+	case UdpMessageTypeNetProbeEnd:
+		s.handleMessageNetProbeEnd(msg, packet)
+
+	case UdpMessageTypeKeepaliveProbe:
+		s.handleMessageKeepaliveProbe(msg, packet)
+
+	case UdpMessageTypeEcho:
+		s.handleMessageEcho(msg, packet)
+
+	case UdpMessageTypeMtuProbeAck:
+		s.handleMessageMtuProbeAck(msg, packet)
+
 	default:
-		logging.Logger.Warn("unrecognized message type ", msg.MsgType, " from ", msg.From)
+		s.log().Warn("unrecognized message type ", msg.MsgType, " from ", msg.From)
 	}
 }
 
 func (s *Service) handleMessageNoop(msg *Message, packet *ReceivedPacket) {
-	//logging.Logger.Info("received noop"), 收到noop，原样回复, 这个目前只在rtt测试的时候用到
-	s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), packet.FromUdpAddr)
+	//s.log().Info("received noop"), 收到noop，原样回复, 这个目前只在rtt测试的时候用到
+	s.sendMessage(msg, packet.FromUdpAddr)
 }
 
 func (s *Service) handleMessageTurnReg(msg *Message, packet *ReceivedPacket) {
-	logging.Logger.Info("received turn reg From ", msg.From, "<", packet.FromUdpAddr.String(), ">", " for session ", msg.To)
+	s.log().Info("received turn reg From ", msg.From, "<", packet.FromUdpAddr.String(), ">", " for session ", msg.To)
+
+	if s.config.AccessSecret != "" && s.users[msg.From] == nil {
+		s.log().Warn("reject turn reg from unregistered user ", msg.From, "<", packet.FromUdpAddr.String(), ">")
+		return
+	}
 
 	//检查当前session是否存在
 	session := s.sessions[msg.To]
+	if session == nil && s.draining {
+		s.log().Warn("reject turn reg for new session ", msg.To, " from ", msg.From, " when draining")
+		return
+	}
 	if session == nil {
 		session = NewSession(msg.To)
 		session.Participants = make(map[int64]*Participant)
 		s.sessions[msg.To] = session
 	}
+	if session.Controlled && !session.Members[msg.From] {
+		s.log().Warn("reject turn reg from non member ", msg.From, "<", packet.FromUdpAddr.String(), ">", " for session ", msg.To)
+		return
+	}
+	if device := session.Devices[msg.From]; device != "" && DeviceFromMessage(msg) != device {
+		s.log().Warn("reject turn reg from handed over device of ", msg.From, "<", packet.FromUdpAddr.String(), ">", " for session ", msg.To)
+		return
+	}
 
 	//当前用户注册到session
 	participant := session.Participants[msg.From]
@@ -225,7 +515,7 @@ func (s *Service) handleMessageTurnReg(msg *Message, packet *ReceivedPacket) {
 
 	//回复
 	msg.MsgType = UdpMessageTypeTurnRegReceived
-	s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), participant.UdpAddr)
+	s.sendMessage(msg, participant.UdpAddr)
 
 	//Turn info支持P2P隧道
 	if len(session.Participants) == 2 {
@@ -245,12 +535,11 @@ func (s *Service) handleMessageTurnReg(msg *Message, packet *ReceivedPacket) {
 		data, err := json.Marshal(turnInfo)
 
 		if err != nil {
-			logging.Logger.Warn("turn info err", err)
+			s.log().Warn("turn info err", err)
 		} else {
 			msg.Payload = data
-			packet := msg.ObfuscatedDataOfMessage()
 			for _, p := range session.Participants {
-				s.udp_server.SendPacket(packet, p.UdpAddr)
+				s.sendMessage(msg, p.UdpAddr)
 			}
 		}
 	}
@@ -280,8 +569,8 @@ func (s *Service) handleMessageTurnUnReg(msg *Message, packet *ReceivedPacket) {
 		return
 	}
 	//客户端会重复几次发这条消息，只有必要log一次
-	logging.Logger.Info("received turn unreg From ", msg.From, " for session ", msg.To)
-	delete(session.Participants, participant.Id)
+	s.log().Info("received turn unreg From ", msg.From, " for session ", msg.To)
+	s.removeParticipant(session, participant.Id)
 
 	////如果剩下的参与方只有两个，也尝试发TurnInfo？
 	//if len(session.Participants) == 2 {
@@ -290,9 +579,9 @@ func (s *Service) handleMessageTurnUnReg(msg *Message, packet *ReceivedPacket) {
 }
 
 func (s *Service) handleMessageAudioStream(msg *Message, packet *ReceivedPacket) {
-	//logging.Logger.Info("received audio From ", msg.From, " To ", msg.To)
+	//s.log().Info("received audio From ", msg.From, " To ", msg.To)
 	if len(msg.Payload) < 12 {
-		logging.Logger.Error("error audio packet from:", msg.From, " to:", msg.To, " payload:", msg.Payload)
+		s.log().Error("error audio packet from:", msg.From, " to:", msg.To, " payload:", msg.Payload)
 		return
 	}
 
@@ -303,7 +592,7 @@ func (s *Service) handleMessageAudioStream(msg *Message, packet *ReceivedPacket)
 			participant.LastActiveTime = time.Now()
 			//如果客户端的外网地址有变化了，要更新。
 			if !bytes.Equal(participant.UdpAddr.IP, packet.FromUdpAddr.IP) || participant.UdpAddr.Port != packet.FromUdpAddr.Port {
-				logging.Logger.Warn("received packet from participant ", msg.From, " with changed udp address:", packet.FromUdpAddr.String(), " origin:", participant.UdpAddr.String())
+				s.log().Warn("received packet from participant ", msg.From, " with changed udp address:", packet.FromUdpAddr.String(), " origin:", participant.UdpAddr.String())
 				participant.UdpAddr = packet.FromUdpAddr
 			}
 
@@ -311,12 +600,29 @@ func (s *Service) handleMessageAudioStream(msg *Message, packet *ReceivedPacket)
 			if ok {
 				participant.PendingExtra = data
 				participant.PendingTime = time.Now()
+				s.exportStreamMetrics(session.Id, msg, data, packet.Time)
+			}
+			if level, ok := ParseAudioLevel(msg.Extra); ok {
+				session.Speaker.Update(participant.Id, level, time.Unix(0, packet.Time))
+				if speaker, changed := session.Speaker.Check(time.Unix(0, packet.Time)); changed {
+					s.reportActiveSpeaker(session, speaker)
+				}
+			}
+			if s.shouldMix(session) {
+				session.Mixer.Push(participant.Id, msg.Payload)
+				return
 			}
 			for _, p := range session.Participants {
+				if session.notReceivingFrom(p.Id, msg.From) {
+					continue
+				}
 				if p.Id != msg.From || (p.Id == 0 && msg.From == 0) { //后一个条件是为了本地回环测试，非登录用户的id为0
 					//如果p要求了participant发的音频需要有repeat, 则看这个包是否属于重发范围
 					//重发范围界定：1）src包，2）src包的esi小于repeat factor.
 					repeatFactor := p.AudioRepeatFactor[participant.Id]
+					if msg.HasFlag(UdpMessageFlagRtp) {
+						repeatFactor = 0 //RTP模式下payload里没有FEC的esi，不做重发
+					}
 					needRepeat := false
 					seqid := int16(0)
 					seqid = seqid + 1 //这是个废语句，为log中没引用的时候了不报错
@@ -340,15 +646,15 @@ func (s *Service) handleMessageAudioStream(msg *Message, packet *ReceivedPacket)
 							//p针对participant的audio没有重发要求
 						}
 					} else {
-						logging.Logger.Warn("incorrect audio repeatFactor:", repeatFactor, " for ", participant.Id, " of receiver ", p.Id)
+						s.log().Warn("incorrect audio repeatFactor:", repeatFactor, " for ", participant.Id, " of receiver ", p.Id)
 						delete(p.AudioRepeatFactor, participant.Id) //清除为0防止无休止打日志
 					}
 					if needRepeat {
 						msg.Tseq = p.Tseq
 						p.Tseq++
-						s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
-						s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
-						//logging.Logger.Info("repeat audio packet ", seqid, esi, " from ", participant.Id, " to ", p.Id)
+						s.sendMessage(msg, p.UdpAddr)
+						s.sendMessage(msg, p.UdpAddr)
+						//s.log().Info("repeat audio packet ", seqid, esi, " from ", participant.Id, " to ", p.Id)
 					} else {
 						if p.PendingMsg == nil {
 							p.PendingMsg = msg
@@ -373,8 +679,8 @@ func (s *Service) handleMessageAudioStream(msg *Message, packet *ReceivedPacket)
 									p.PendingExtra = nil
 								}
 							}
-							s.udp_server.SendPacket(p.PendingMsg.ObfuscatedDataOfMessage(), p.UdpAddr)
-							s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
+							s.sendMessage(p.PendingMsg, p.UdpAddr)
+							s.sendMessage(msg, p.UdpAddr)
 							if extraAdded {
 								msg.Extra = nil
 								msg.UnSetFlag(UdpMessageFlagExtra)
@@ -385,17 +691,76 @@ func (s *Service) handleMessageAudioStream(msg *Message, packet *ReceivedPacket)
 				}
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " send audio packet")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " send audio packet")
 			s.askForReTurnReg(msg, packet)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for audio packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for audio packet from ", msg.From)
 		s.askForReTurnReg(msg, packet)
 	}
 }
 
+//主讲人变化时通知session manager，由它转发给session的参与者
+func (s *Service) reportActiveSpeaker(session *Session, speaker int64) {
+	sm := s.users[SessionManagerUid]
+	if sm == nil {
+		return
+	}
+	signal := NewSignal(YCKCallSignalTypeActiveSpeaker, speaker, SessionManagerUid, session.Id)
+	signal.Info = make(map[string]interface{})
+	signal.Info["speaker"] = speaker
+	payload, err := signal.Marshal()
+	if err != nil {
+		s.log().Warn("signal marshal error:", err)
+		return
+	}
+	msg := NewMessage(UdpMessageTypeUserSignal, speaker, SessionManagerUid, 0, payload, nil)
+	s.sendMessage(msg, sm.UdpAddr)
+}
+
+//人数超过阈值时启用混音，回落到阈值以下则恢复逐路转发
+func (s *Service) shouldMix(session *Session) bool {
+	if s.audioCodec == nil || s.config.MixThreshold <= 0 {
+		return false
+	}
+	if session.senders() > s.config.MixThreshold && len(session.Rooms) == 0 {
+		if session.Mixer == nil {
+			session.Mixer = NewMixer(s.audioCodec)
+			s.log().Info("start audio mixing for session ", session.Id, " participants:", len(session.Participants))
+		}
+		return true
+	}
+	if session.Mixer != nil {
+		session.Mixer = nil
+		s.log().Info("stop audio mixing for session ", session.Id, " participants:", len(session.Participants))
+	}
+	return false
+}
+
+func (s *Service) handleMixTicker() {
+	for _, session := range s.sessions {
+		if session.Mixer == nil {
+			continue
+		}
+		receivers := make([]int64, 0, len(session.Participants))
+		for uid := range session.Participants {
+			if !session.notReceiving(uid) {
+				receivers = append(receivers, uid)
+			}
+		}
+		out := session.Mixer.Mix(receivers)
+		for uid, payload := range out {
+			p := session.Participants[uid]
+			msg := NewMessage(UdpMessageTypeAudioStream, MixerUid, session.Id, 0, payload, nil)
+			msg.Tseq = p.Tseq
+			p.Tseq++
+			s.sendMessage(msg, p.UdpAddr)
+		}
+	}
+}
+
 func (s *Service) handleMessageVideoStream(msg *Message, packet *ReceivedPacket) {
-	//logging.Logger.Info("received video From ", msg.From, " To ", msg.To)
+	//s.log().Info("received video From ", msg.From, " To ", msg.To)
 
 	session := s.sessions[msg.To]
 	if session != nil {
@@ -406,17 +771,18 @@ func (s *Service) handleMessageVideoStream(msg *Message, packet *ReceivedPacket)
 			if ok {
 				participant.PendingExtra = data
 				participant.PendingTime = time.Now()
+				s.exportStreamMetrics(session.Id, msg, data, packet.Time)
 			}
 			if msg.MsgType == UdpMessageTypeVideoStream {
-				participant.VideoQueueOut.AddItem(false, msg.Payload, msg.From)
+				participant.VideoQueueOut.AddMessageItem(false, msg)
 			} else if msg.MsgType == UdpMessageTypeThumbVideoStream {
-				participant.ThumbVideoQueueOut.AddItem(false, msg.Payload, msg.From)
+				participant.ThumbVideoQueueOut.AddMessageItem(false, msg)
 			} else {
-				logging.Logger.Warn("incorrect message type for video stream")
+				s.log().Warn("incorrect message type for video stream")
 			}
 
 			for _, p := range session.Participants {
-				if msg.Dest != 0 && p.Id != msg.Dest {
+				if msg.Dest != 0 && p.Id != msg.Dest || session.notReceivingFrom(p.Id, msg.From) {
 					continue
 				}
 				if p.OnlyAcceptAudio {
@@ -425,7 +791,7 @@ func (s *Service) handleMessageVideoStream(msg *Message, packet *ReceivedPacket)
 				//如果没有列表请求数据，那么为兼容老版本，9方以下还发视频。如果已经有这个列表，则按列表规则发
 				if msg.MsgType == UdpMessageTypeVideoStream {
 					if p.VideoList == nil {
-						if len(session.Participants) > 12 { //TODO:这个在客户端都升级后，需要改
+						if session.senders() > 12 { //TODO:这个在客户端都升级后，需要改
 							continue
 						}
 					} else {
@@ -467,8 +833,8 @@ func (s *Service) handleMessageVideoStream(msg *Message, packet *ReceivedPacket)
 								p.PendingExtra = nil
 							}
 						}
-						s.udp_server.SendPacket(p.PendingMsg.ObfuscatedDataOfMessage(), p.UdpAddr)
-						s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
+						s.sendMessage(p.PendingMsg, p.UdpAddr)
+						s.sendMessage(msg, p.UdpAddr)
 						if extraAdded {
 							msg.Extra = nil
 							msg.UnSetFlag(UdpMessageFlagExtra)
@@ -478,17 +844,17 @@ func (s *Service) handleMessageVideoStream(msg *Message, packet *ReceivedPacket)
 				}
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " send video packet")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " send video packet")
 			s.askForReTurnReg(msg, packet)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for video packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for video packet from ", msg.From)
 		s.askForReTurnReg(msg, packet)
 	}
 }
 
 func (s *Service) handleMessageVideoStreamIFrame(msg *Message, packet *ReceivedPacket) {
-	//logging.Logger.Info("received video iframe From ", msg.From, " To ", msg.To)
+	//s.log().Info("received video iframe From ", msg.From, " To ", msg.To)
 
 	session := s.sessions[msg.To]
 	if session != nil {
@@ -499,17 +865,18 @@ func (s *Service) handleMessageVideoStreamIFrame(msg *Message, packet *ReceivedP
 			if ok {
 				participant.PendingExtra = data
 				participant.PendingTime = time.Now()
+				s.exportStreamMetrics(session.Id, msg, data, packet.Time)
 			}
 			if msg.MsgType == UdpMessageTypeVideoStreamIFrame {
-				participant.VideoQueueOut.AddItem(true, msg.Payload, msg.From)
+				participant.VideoQueueOut.AddMessageItem(true, msg)
 			} else if msg.MsgType == UdpMessageTypeThumbVideoStreamIFrame {
-				participant.ThumbVideoQueueOut.AddItem(true, msg.Payload, msg.From)
+				participant.ThumbVideoQueueOut.AddMessageItem(true, msg)
 			} else {
-				logging.Logger.Warn("incorrect message type for video stream iframe")
+				s.log().Warn("incorrect message type for video stream iframe")
 			}
 
 			for _, p := range session.Participants {
-				if msg.Dest != 0 && p.Id != msg.Dest {
+				if msg.Dest != 0 && p.Id != msg.Dest || session.notReceivingFrom(p.Id, msg.From) {
 					continue
 				}
 				if p.OnlyAcceptAudio {
@@ -517,7 +884,7 @@ func (s *Service) handleMessageVideoStreamIFrame(msg *Message, packet *ReceivedP
 				}
 				if msg.MsgType == UdpMessageTypeVideoStreamIFrame {
 					if p.VideoList == nil {
-						if len(session.Participants) > 12 { //TODO:这个在客户端都升级后，需要改
+						if session.senders() > 12 { //TODO:这个在客户端都升级后，需要改
 							continue
 						}
 					} else {
@@ -558,8 +925,8 @@ func (s *Service) handleMessageVideoStreamIFrame(msg *Message, packet *ReceivedP
 								p.PendingExtra = nil
 							}
 						}
-						s.udp_server.SendPacket(p.PendingMsg.ObfuscatedDataOfMessage(), p.UdpAddr)
-						s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
+						s.sendMessage(p.PendingMsg, p.UdpAddr)
+						s.sendMessage(msg, p.UdpAddr)
 						if extraAdded {
 							msg.Extra = nil
 							msg.UnSetFlag(UdpMessageFlagExtra)
@@ -569,11 +936,11 @@ func (s *Service) handleMessageVideoStreamIFrame(msg *Message, packet *ReceivedP
 				}
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " send video packet")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " send video packet")
 			s.askForReTurnReg(msg, packet)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for video packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for video packet from ", msg.From)
 		s.askForReTurnReg(msg, packet)
 	}
 }
@@ -583,7 +950,7 @@ func (s *Service) handleMessageVideoASkForIFrame(msg *Message, packet *ReceivedP
 	if msg.MsgType == UdpMessageTypeThumbVideoAskForIFrame {
 		isThumb = " for thumb"
 	}
-	logging.Logger.Info("received ask for iframe From ", msg.From, " To ", msg.To, " Dest ", msg.Dest, isThumb)
+	s.log().Info("received ask for iframe From ", msg.From, " To ", msg.To, " Dest ", msg.Dest, isThumb)
 
 	session := s.sessions[msg.To]
 
@@ -592,11 +959,11 @@ func (s *Service) handleMessageVideoASkForIFrame(msg *Message, packet *ReceivedP
 		if participant != nil {
 			//participant.LastActiveTime = time.Now()
 			for _, p := range session.Participants {
-				if msg.Dest != 0 && p.Id != msg.Dest {
+				if msg.Dest != 0 && p.Id != msg.Dest || session.Held[p.Id] {
 					continue
 				}
 				if p.Id != msg.From || (p.Id == 0 && msg.From == 0) {
-					s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
+					s.sendMessage(msg, p.UdpAddr)
 					////如果a向b请求i帧了，那么a的可接收视频列表里也要立即把b列进去，之后客户端会来再刷新的。//这个导致混乱，取消之！
 					//if msg.MsgType == UdpMessageTypeVideoAskForIFrame {
 					//	if participant.VideoList != nil {
@@ -607,22 +974,22 @@ func (s *Service) handleMessageVideoASkForIFrame(msg *Message, packet *ReceivedP
 					//		participant.ThumbVideoList[p.Id] = 2
 					//	}
 					//} else {
-					//	logging.Logger.Warn("incorrect message type for ask for iframe")
+					//	s.log().Warn("incorrect message type for ask for iframe")
 					//}
 				}
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " ask iframe")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " ask iframe")
 			s.askForReTurnReg(msg, packet)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for ask iframe packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for ask iframe packet from ", msg.From)
 		s.askForReTurnReg(msg, packet)
 	}
 }
 
 func (s *Service) handleMessageVideoNack(msg *Message, packet *ReceivedPacket) {
-	//logging.Logger.Info("received nack From ", msg.From, " To ", msg.To, " Dest ", msg.Dest)
+	//s.log().Info("received nack From ", msg.From, " To ", msg.To, " Dest ", msg.Dest)
 
 	session := s.sessions[msg.To]
 
@@ -642,10 +1009,10 @@ func (s *Service) handleMessageVideoNack(msg *Message, packet *ReceivedPacket) {
 			} else if msg.MsgType == UdpMessageTypeThumbVideoNack {
 				queue = dest.ThumbVideoQueueOut
 			} else {
-				logging.Logger.Warn("incorrect message type for video nack")
+				s.log().Warn("incorrect message type for video nack")
 			}
 			seqid, n_tries, isIFrame, packets := queue.ProcessNack(nack, msg.From)
-			//logging.Logger.Info("process nack from ", msg.From, " to sid ", msg.To, " dest ", msg.Dest, " seq ", seqid, " n_tries ", n_tries, " packets ", len(packets))
+			//s.log().Info("process nack from ", msg.From, " to sid ", msg.To, " dest ", msg.Dest, " seq ", seqid, " n_tries ", n_tries, " packets ", len(packets))
 
 			//报告给metrix汇总打日志
 			participant.Metrics.ProcessNack(msg, seqid, n_tries, len(packets))
@@ -674,8 +1041,8 @@ func (s *Service) handleMessageVideoNack(msg *Message, packet *ReceivedPacket) {
 						participant.PendingMsg.Tseq = participant.Tseq
 						nmsg.Tseq = participant.Tseq
 						participant.Tseq++
-						s.udp_server.SendPacket(participant.PendingMsg.ObfuscatedDataOfMessage(), participant.UdpAddr)
-						s.udp_server.SendPacket(nmsg.ObfuscatedDataOfMessage(), participant.UdpAddr)
+						s.sendMessage(participant.PendingMsg, participant.UdpAddr)
+						s.sendMessage(nmsg, participant.UdpAddr)
 						participant.PendingMsg = nil
 					}
 				}
@@ -684,26 +1051,90 @@ func (s *Service) handleMessageVideoNack(msg *Message, packet *ReceivedPacket) {
 			//如果是tries>0且QueueOut中无响应，则发给Dest处理
 			if n_tries > 1 && len(packets) == 0 {
 				for _, p := range session.Participants {
-					if msg.Dest != 0 && p.Id != msg.Dest {
+					if msg.Dest != 0 && p.Id != msg.Dest || session.Held[p.Id] {
 						continue
 					}
 					if p.Id != msg.From || (p.Id == 0 && msg.From == 0) {
-						s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
+						s.sendMessage(msg, p.UdpAddr)
+					}
+				}
+			}
+		} else {
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " send nack")
+			s.askForReTurnReg(msg, packet)
+		}
+	} else {
+		s.log().Info("session ", msg.To, " not existed for nack packet from ", msg.From)
+		s.askForReTurnReg(msg, packet)
+	}
+}
+
+func (s *Service) handleMessageRtcp(msg *Message, packet *ReceivedPacket) {
+	session := s.sessions[msg.To]
+
+	if session != nil {
+		participant := session.Participants[msg.From]
+		if participant != nil {
+			nacks, other, err := ParseRtcpNacks(msg.Payload)
+			if err != nil {
+				s.log().Warn("incorrect rtcp from ", msg.From, ":", err)
+				return
+			}
+
+			//Generic NACK先从Dest的QueueOut中找，找不到的再转给Dest
+			forward := other
+			dest := session.Participants[msg.Dest]
+			for _, nack := range nacks {
+				var missing []uint16
+				if dest != nil {
+					var packets [][]byte
+					var iframes []bool
+					packets, iframes, missing = dest.VideoQueueOut.ProcessRtpNack(nack.Seqs)
+					for i := 0; i < len(packets); i++ {
+						nmsgType := UdpMessageTypeVideoStream
+						if iframes[i] {
+							nmsgType = UdpMessageTypeVideoStreamIFrame
+						}
+						nmsg := NewMessage(uint8(nmsgType), msg.Dest, session.Id, msg.From, packets[i], nil)
+						nmsg.Tid = msg.Tid
+						nmsg.SetFlag(UdpMessageFlagRtp)
+						nmsg.Tseq = participant.Tseq
+						participant.Tseq++
+						s.sendMessage(nmsg, participant.UdpAddr)
 					}
+				} else {
+					missing = nack.Seqs
+				}
+				if len(missing) > 0 {
+					forward = append(forward, BuildRtcpNack(nack.SenderSsrc, nack.MediaSsrc, missing)...)
+				}
+			}
+
+			if len(forward) == 0 {
+				return
+			}
+			fmsg := NewMessage(UdpMessageTypeRtcp, msg.From, msg.To, msg.Dest, forward, nil)
+			fmsg.Tid = msg.Tid
+			for _, p := range session.Participants {
+				if msg.Dest != 0 && p.Id != msg.Dest || session.Held[p.Id] {
+					continue
+				}
+				if p.Id != msg.From || (p.Id == 0 && msg.From == 0) {
+					s.sendMessage(fmsg, p.UdpAddr)
 				}
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " send nack")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " send rtcp")
 			s.askForReTurnReg(msg, packet)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for nack packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for rtcp packet from ", msg.From)
 		s.askForReTurnReg(msg, packet)
 	}
 }
 
 func (s *Service) handleMessageData(msg *Message, packet *ReceivedPacket) {
-	//logging.Logger.Info("received data From ", msg.From, " To ", msg.To)
+	//s.log().Info("received data From ", msg.From, " To ", msg.To)
 
 	session := s.sessions[msg.To]
 	if session != nil {
@@ -714,12 +1145,13 @@ func (s *Service) handleMessageData(msg *Message, packet *ReceivedPacket) {
 			if ok {
 				participant.PendingExtra = data
 				participant.PendingTime = time.Now()
+				s.exportStreamMetrics(session.Id, msg, data, packet.Time)
 			}
 
 			participant.DataQueueOut.AddItem(false, msg.Payload, msg.From)
 
 			for _, p := range session.Participants {
-				if msg.Dest != 0 && p.Id != msg.Dest {
+				if msg.Dest != 0 && p.Id != msg.Dest || session.notReceivingFrom(p.Id, msg.From) {
 					continue
 				}
 
@@ -747,8 +1179,8 @@ func (s *Service) handleMessageData(msg *Message, packet *ReceivedPacket) {
 								p.PendingExtra = nil
 							}
 						}
-						s.udp_server.SendPacket(p.PendingMsg.ObfuscatedDataOfMessage(), p.UdpAddr)
-						s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
+						s.sendMessage(p.PendingMsg, p.UdpAddr)
+						s.sendMessage(msg, p.UdpAddr)
 						if extraAdded {
 							msg.Extra = nil
 							msg.UnSetFlag(UdpMessageFlagExtra)
@@ -758,17 +1190,17 @@ func (s *Service) handleMessageData(msg *Message, packet *ReceivedPacket) {
 				}
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " send data packet")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " send data packet")
 			s.askForReTurnReg(msg, packet)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for data packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for data packet from ", msg.From)
 		s.askForReTurnReg(msg, packet)
 	}
 }
 
 func (s *Service) handleMessageDataNack(msg *Message, packet *ReceivedPacket) {
-	//logging.Logger.Info("received data nack From ", msg.From, " To ", msg.To, " Dest ", msg.Dest)
+	//s.log().Info("received data nack From ", msg.From, " To ", msg.To, " Dest ", msg.Dest)
 
 	session := s.sessions[msg.To]
 
@@ -783,7 +1215,7 @@ func (s *Service) handleMessageDataNack(msg *Message, packet *ReceivedPacket) {
 			queue := dest.DataQueueOut
 
 			seqid, n_tries, _, packets := queue.ProcessNack(nack, msg.From)
-			//logging.Logger.Info("process nack from ", msg.From, " to sid ", msg.To, " dest ", msg.Dest, " seq ", seqid, " n_tries ", n_tries, " packets ", len(packets))
+			//s.log().Info("process nack from ", msg.From, " to sid ", msg.To, " dest ", msg.Dest, " seq ", seqid, " n_tries ", n_tries, " packets ", len(packets))
 
 			//报告给metrix汇总打日志
 			participant.Metrics.ProcessNack(msg, seqid, n_tries, len(packets))
@@ -800,8 +1232,8 @@ func (s *Service) handleMessageDataNack(msg *Message, packet *ReceivedPacket) {
 						participant.PendingMsg.Tseq = participant.Tseq
 						nmsg.Tseq = participant.Tseq
 						participant.Tseq++
-						s.udp_server.SendPacket(participant.PendingMsg.ObfuscatedDataOfMessage(), participant.UdpAddr)
-						s.udp_server.SendPacket(nmsg.ObfuscatedDataOfMessage(), participant.UdpAddr)
+						s.sendMessage(participant.PendingMsg, participant.UdpAddr)
+						s.sendMessage(nmsg, participant.UdpAddr)
 						participant.PendingMsg = nil
 					}
 				}
@@ -810,26 +1242,26 @@ func (s *Service) handleMessageDataNack(msg *Message, packet *ReceivedPacket) {
 			//如果是tries>0且QueueOut中无响应，则发给Dest处理
 			if n_tries > 1 && len(packets) == 0 {
 				for _, p := range session.Participants {
-					if msg.Dest != 0 && p.Id != msg.Dest {
+					if msg.Dest != 0 && p.Id != msg.Dest || session.Held[p.Id] {
 						continue
 					}
 					if p.Id != msg.From || (p.Id == 0 && msg.From == 0) {
-						s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
+						s.sendMessage(msg, p.UdpAddr)
 					}
 				}
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " send data nack")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " send data nack")
 			s.askForReTurnReg(msg, packet)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for data nack packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for data nack packet from ", msg.From)
 		s.askForReTurnReg(msg, packet)
 	}
 }
 
 func (s *Service) handleMessageUnicastData(msg *Message, packet *ReceivedPacket) {
-	//logging.Logger.Info("received unicast data From ", msg.From, " To ", msg.To)
+	//s.log().Info("received unicast data From ", msg.From, " To ", msg.To)
 
 	session := s.sessions[msg.To]
 	if session != nil {
@@ -840,16 +1272,17 @@ func (s *Service) handleMessageUnicastData(msg *Message, packet *ReceivedPacket)
 			if ok {
 				participant.PendingExtra = data
 				participant.PendingTime = time.Now()
+				s.exportStreamMetrics(session.Id, msg, data, packet.Time)
 			}
 
 			//participant.DataQueueOut.AddItem(false, msg.Payload, msg.From)
 			if msg.Dest == 0 {
-				logging.Logger.Warn("Incorrect unicast data without dest from ", msg.From)
+				s.log().Warn("Incorrect unicast data without dest from ", msg.From)
 				return
 			}
 
 			for _, p := range session.Participants {
-				if msg.Dest != 0 && p.Id != msg.Dest {
+				if msg.Dest != 0 && p.Id != msg.Dest || session.notReceivingFrom(p.Id, msg.From) {
 					continue
 				}
 
@@ -877,8 +1310,8 @@ func (s *Service) handleMessageUnicastData(msg *Message, packet *ReceivedPacket)
 								p.PendingExtra = nil
 							}
 						}
-						s.udp_server.SendPacket(p.PendingMsg.ObfuscatedDataOfMessage(), p.UdpAddr)
-						s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
+						s.sendMessage(p.PendingMsg, p.UdpAddr)
+						s.sendMessage(msg, p.UdpAddr)
 						if extraAdded {
 							msg.Extra = nil
 							msg.UnSetFlag(UdpMessageFlagExtra)
@@ -888,17 +1321,17 @@ func (s *Service) handleMessageUnicastData(msg *Message, packet *ReceivedPacket)
 				}
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " send unicast data packet")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " send unicast data packet")
 			s.askForReTurnReg(msg, packet)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for unicast data packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for unicast data packet from ", msg.From)
 		s.askForReTurnReg(msg, packet)
 	}
 }
 
 func (s *Service) handleMessageUnicastDataNack(msg *Message, packet *ReceivedPacket) {
-	//logging.Logger.Info("received unicast data nack From ", msg.From, " To ", msg.To, " Dest ", msg.Dest)
+	//s.log().Info("received unicast data nack From ", msg.From, " To ", msg.To, " Dest ", msg.Dest)
 
 	session := s.sessions[msg.To]
 
@@ -913,7 +1346,7 @@ func (s *Service) handleMessageUnicastDataNack(msg *Message, packet *ReceivedPac
 			//queue := dest.DataQueueOut
 			//
 			//seqid, n_tries, _, packets := queue.ProcessNack(nack, msg.From)
-			////logging.Logger.Info("process nack from ", msg.From, " to sid ", msg.To, " dest ", msg.Dest, " seq ", seqid, " n_tries ", n_tries, " packets ", len(packets))
+			////s.log().Info("process nack from ", msg.From, " to sid ", msg.To, " dest ", msg.Dest, " seq ", seqid, " n_tries ", n_tries, " packets ", len(packets))
 			//
 			////报告给metrix汇总打日志
 			//participant.Metrics.ProcessNack(msg, seqid, n_tries, len(packets))
@@ -940,28 +1373,61 @@ func (s *Service) handleMessageUnicastDataNack(msg *Message, packet *ReceivedPac
 			//如果是tries>0且QueueOut中无响应，则发给Dest处理
 
 			for _, p := range session.Participants {
-				if msg.Dest != 0 && p.Id != msg.Dest {
+				if msg.Dest != 0 && p.Id != msg.Dest || session.Held[p.Id] {
 					continue
 				}
 				if p.Id != msg.From || (p.Id == 0 && msg.From == 0) {
-					s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), p.UdpAddr)
+					s.sendMessage(msg, p.UdpAddr)
 				}
 			}
 
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " send data nack")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " send data nack")
 			s.askForReTurnReg(msg, packet)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for data nack packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for data nack packet from ", msg.From)
 		s.askForReTurnReg(msg, packet)
 	}
 }
 
+func (s *Service) handleMessageRecordControl(msg *Message, packet *ReceivedPacket) {
+	if msg.From != SessionManagerUid {
+		s.log().Warn("record control from non session manager ", msg.From, "<", packet.FromUdpAddr.String(), ">")
+		return
+	}
+	if len(msg.Payload) < 1 {
+		s.log().Warn("incorrect record control message for session ", msg.To)
+		return
+	}
+
+	session := s.sessions[msg.To]
+	if session == nil {
+		session = NewSession(msg.To)
+		session.Participants = make(map[int64]*Participant)
+		s.sessions[msg.To] = session
+	}
+
+	if msg.Payload[0] == RecordControlVoicemail {
+		s.startVoicemail(session, msg.Payload[1:], time.Unix(0, packet.Time))
+		return
+	}
+	if msg.Payload[0] == RecordControlStart {
+		session.Recording = true
+	} else {
+		if session.Recording {
+			s.recorder.Close(session.Id)
+		}
+		session.Recording = false
+		s.finishVoicemail(session)
+	}
+	s.log().Info("record control for session ", msg.To, " recording:", session.Recording)
+}
+
 func (s *Service) askForReTurnReg(msg *Message, packet *ReceivedPacket) {
 	newMsg := NewMessage(UdpMessageTypeTurnRegNoExist, msg.From, msg.To, msg.Dest, nil, nil)
 	newMsg.Tid = msg.Tid
-	s.udp_server.SendPacket(newMsg.ObfuscatedDataOfMessage(), packet.FromUdpAddr)
+	s.sendMessage(newMsg, packet.FromUdpAddr)
 }
 
 func (s *Service) handleMessageVideoOnlyAudio(msg *Message) {
@@ -979,43 +1445,129 @@ func (s *Service) handleMessageVideoOnlyAudio(msg *Message) {
 					participant.OnlyAcceptAudio = true
 				}
 			} else {
-				logging.Logger.Warn("participant ", msg.From, " incorrect audio only request")
+				s.log().Warn("participant ", msg.From, " incorrect audio only request")
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To)
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To)
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for audio only packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for audio only packet from ", msg.From)
 	}
 }
 
 func (s *Service) handleMessageUserReg(msg *Message, packet *ReceivedPacket) {
-	logging.Logger.Info("received user reg From ", msg.From, "<", packet.FromUdpAddr.String(), ">", " To ", msg.To)
+	s.log().Info("received user reg From ", msg.From, "<", packet.FromUdpAddr.String(), ">", " To ", msg.To)
+
+	token, pub := SplitUserRegPayload(msg.Payload)
+	if s.config.AccessSecret != "" {
+		err := VerifyAccessToken(s.config.AccessSecret, token, msg.From, time.Now())
+		if err != nil {
+			s.log().Warn("reject user reg From ", msg.From, "<", packet.FromUdpAddr.String(), ">:", err)
+			reject := NewMessage(UdpMessageTypeUserRegRejected, msg.From, msg.To, 0, nil, nil)
+			s.sendMessage(reject, packet.FromUdpAddr)
+			return
+		}
+	}
+	//不带公钥的重新注册保留原来的链路，第一次注册必须带公钥；session manager和拨测不做链路加密
+	old := s.links[packet.FromUdpAddr.String()]
+	if pub == nil && !s.config.AllowPlaintext && msg.From != SessionManagerUid && msg.From != ProbeUid && (old == nil || old.Uid != msg.From) {
+		s.log().Warn("reject plaintext user reg From ", msg.From, "<", packet.FromUdpAddr.String(), ">")
+		reject := NewMessage(UdpMessageTypeUserRegRejected, msg.From, msg.To, 0, nil, nil)
+		s.sendMessage(reject, packet.FromUdpAddr)
+		return
+	}
+	var link *Link
+	if pub != nil {
+		var relayPub []byte
+		var err error
+		link, relayPub, err = NewLinkFromPeerKey(pub)
+		if err != nil {
+			s.reportError(errs.Wrap(err, "link key").From(packet.FromUdpAddr.String()).OfType(msg.MsgType))
+			return
+		}
+		link.Uid = msg.From
+		msg.Payload = LinkAckPayload(s.linkSignKey, msg.From, pub, relayPub)
+	}
 
 	user := s.users[msg.From]
+	if user == nil && s.draining && msg.From != SessionManagerUid {
+		s.log().Warn("reject user reg From ", msg.From, "<", packet.FromUdpAddr.String(), "> when draining")
+		return
+	}
 	if user == nil {
 		user = NewUser(msg.From)
 		s.users[msg.From] = user
+		s.presenceChanged(msg.From, true)
 	}
 
 	user.UdpAddr = packet.FromUdpAddr
 	user.LastActiveTime = time.Now()
+	user.updateDevice(DeviceFromMessage(msg), user.UdpAddr, user.LastActiveTime)
+	s.updateRoute(user)
+	if n, ok := NetworkFromMessage(msg); ok {
+		user.Devices[DeviceFromMessage(msg)].Network = n
+	}
+
+	capabilities := CapabilitiesFromMessage(msg) & RelayCapabilities
+	s.capabilities[user.UdpAddr.String()] = capabilities
+
+	if link != nil {
+		//回复本身用明文发，客户端这时还没有新的链路密钥
+		delete(s.links, user.UdpAddr.String())
+	}
 	msg.MsgType = UdpMessageTypeUserRegReceived
-	s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), user.UdpAddr)
+	if msg.HasFlag(UdpMessageFlagExtra) { //老客户端不带extra，也就不回能力位图
+		SetCapabilities(msg, RelayCapabilities)
+		echoClockExtra(msg, time.Unix(0, packet.Time))
+		SetObfuscationKeyExtra(msg, time.Now())
+	}
+	s.sendMessage(msg, user.UdpAddr)
+	if link != nil {
+		s.links[user.UdpAddr.String()] = link
+		s.log().Info("link key set with ", msg.From, "<", user.UdpAddr.String(), ">")
+	}
+	if capabilities&CapabilityMtuProbe != 0 {
+		s.sendMtuProbes(msg.From, user.UdpAddr)
+	}
+
+	if s.draining && msg.From == SessionManagerUid {
+		s.notifyDraining()
+	}
 }
 
 func (s *Service) handleMessageUserSignal(msg *Message, packet *ReceivedPacket) {
+	whole, err := s.reassembler.Restore(msg, time.Now())
+	if err != nil {
+		s.reportError(errs.Wrap(err, "restore signal").From(packet.FromUdpAddr.String()).OfType(msg.MsgType))
+		return
+	}
+	if whole == nil {
+		return //分片还没收齐
+	}
+	msg = whole
+
 	signal := NewSignalTemp()
 
 	if !msg.HasFlag(UdpMessageFlagGZip) {
-		err := signal.Unmarshal(msg.Payload)
+		err := signal.UnmarshalMessage(msg)
 		if err != nil {
-			logging.Logger.Warn("signal unmarshal error:", err, " payload(", len(msg.Payload), "):", string(msg.Payload), " from ", msg.From)
+			s.reportError(errs.Wrap(err, "unmarshal signal").From(packet.FromUdpAddr.String()).OfType(msg.MsgType))
+		} else {
+			s.trace.Add("sid", signal.SessionId)
+			s.trace.Add("signal", signal.Signal)
+			if logging.IsTraced(signal.SessionId) {
+				logging.TraceLogger.Info("signal ", signal.String(), " from <", packet.FromUdpAddr.String(), ">")
+			}
+			//session manager发的量大，还会原样转发双方客户端带Seq的信令，客户端的信令它自己已经过滤过
+			if msg.From != SessionManagerUid && !s.replay.Check(msg.From, signal, time.Now()) {
+				s.log().Warn("drop replayed or stale signal ", signal.Signal, " from ", msg.From, "<", packet.FromUdpAddr.String(), ">", " ts ", signal.Timestamp)
+				return
+			}
 		}
 
 		//State sync和state info两个信令太多，不打在日志之中了。
 		if signal.Signal != YCKCallSignalTypeStateSync && signal.Signal != YCKCallSignalTypeStateInfo {
-			logging.Logger.Info("received user signal From ", msg.From, "<", packet.FromUdpAddr.String(), ">", " To ", msg.To)
+			s.log().Info("received user signal From ", msg.From, "<", packet.FromUdpAddr.String(), ">", " To ", msg.To)
 		}
 	}
 
@@ -1024,29 +1576,72 @@ func (s *Service) handleMessageUserSignal(msg *Message, packet *ReceivedPacket)
 		user.LastActiveTime = time.Now()
 		if !bytes.Equal(user.UdpAddr.IP, packet.FromUdpAddr.IP) || user.UdpAddr.Port != packet.FromUdpAddr.Port {
 			if msg.From != -1 { //session manager可能有多个ip地址，所以这里不予考虑
-				logging.Logger.Warn("received signal from user ", msg.From, " with changed udp address:", packet.FromUdpAddr.String(), " origin:", user.UdpAddr.String())
+				s.log().Warn("received signal from user ", msg.From, " with changed udp address:", packet.FromUdpAddr.String(), " origin:", user.UdpAddr.String())
 				user.UdpAddr = packet.FromUdpAddr
+				s.updateRoute(user)
 			}
 		}
+		if msg.From != SessionManagerUid {
+			user.updateDevice(DeviceFromMessage(msg), packet.FromUdpAddr, user.LastActiveTime)
+		}
 	} else {
-		logging.Logger.Warn("user ", msg.From, " not existed in signal msg.from， register the user ", "<", packet.FromUdpAddr.String(), ">")
+		if s.config.AccessSecret != "" {
+			s.log().Warn("drop signal from unregistered user ", msg.From, "<", packet.FromUdpAddr.String(), ">")
+			return
+		}
+		s.log().Warn("user ", msg.From, " not existed in signal msg.from， register the user ", "<", packet.FromUdpAddr.String(), ">")
 		user = NewUser(msg.From)
 		s.users[msg.From] = user
 		user.UdpAddr = packet.FromUdpAddr
 		user.LastActiveTime = time.Now()
+		user.updateDevice(DeviceFromMessage(msg), user.UdpAddr, user.LastActiveTime)
+		s.updateRoute(user)
+		s.presenceChanged(msg.From, true)
 	}
 
 	user = s.users[msg.To]
 
 	if user != nil {
-		s.udp_server.SendPacket(msg.ObfuscatedDataOfMessage(), user.UdpAddr)
+		if msg.To == SessionManagerUid {
+			//告诉session manager发送方支持哪些功能，以及他的公网ip
+			SetCapabilities(msg, s.capabilities[packet.FromUdpAddr.String()])
+			SetClientIp(msg, packet.FromUdpAddr.IP)
+			if d := s.users[msg.From].Devices[DeviceFromMessage(msg)]; d != nil && d.Network != (NetworkInfo{}) {
+				SetNetwork(msg, d.Network)
+			}
+			if mtu := s.mtus[packet.FromUdpAddr.String()]; mtu > 0 {
+				SetMtu(msg, mtu)
+			}
+		}
+		//只有session manager指定的才是目标设备
+		device := ""
+		if msg.From == SessionManagerUid {
+			device = DeviceFromMessage(msg)
+		}
+		addrs := user.signalAddrs(device)
+		for _, addr := range addrs {
+			s.sendUserSignal(msg, addr)
+		}
 		if !msg.HasFlag(UdpMessageFlagGZip) {
 			if signal.Signal != YCKCallSignalTypeStateSync && signal.Signal != YCKCallSignalTypeStateInfo {
-				logging.Logger.Info("route user signal", signal.String(), " From ", msg.From, " To ", msg.To, "<", user.UdpAddr.String(), ">")
+				s.log().Info("route user signal", signal.String(), " From ", msg.From, " To ", msg.To, " devices:", len(addrs))
 			}
 		}
 	} else {
-		logging.Logger.Warn("user ", msg.To, " not existed in signal msg.to", signal.String())
+		s.log().Warn("user ", msg.To, " not existed in signal msg.to", signal.String())
+	}
+}
+
+//按接收方的能力转码、压缩、分片后发出
+func (s *Service) sendUserSignal(msg *Message, addr *net.UDPAddr) {
+	capabilities := s.capabilities[addr.String()]
+	messages, err := PrepareSignal(msg, capabilities, s.datagramLimit(addr))
+	if err != nil {
+		s.reportError(errs.Wrap(err, "prepare signal").OfType(msg.MsgType))
+		return
+	}
+	for _, m := range messages {
+		s.sendMessage(m, addr)
 	}
 }
 
@@ -1059,7 +1654,7 @@ func (s *Service) handleMessageMediaControl(msg *Message, packet *ReceivedPacket
 			payload := msg.Payload
 			len := len(payload)
 			if len < 3 {
-				logging.Logger.Info("participant ", msg.From, " incorrect media control message ", payload)
+				s.log().Info("participant ", msg.From, " incorrect media control message ", payload)
 				return
 			}
 			p := 0
@@ -1069,14 +1664,14 @@ func (s *Service) handleMessageMediaControl(msg *Message, packet *ReceivedPacket
 				key := payload[p]
 				p += 1
 				if p+int(size) > len {
-					logging.Logger.Info("participant ", msg.From, " incorrect media control message ", payload)
+					s.log().Info("participant ", msg.From, " incorrect media control message ", payload)
 					return
 				}
 
 				value := payload[p : p+int(size)]
 				if key == 1 { //视频请求列表uid
 					if size%8 != 0 {
-						logging.Logger.Info("participant ", msg.From, "error value size for key ", key, " for media control message ", payload)
+						s.log().Info("participant ", msg.From, "error value size for key ", key, " for media control message ", payload)
 					}
 					num := int(size) / 8
 					uids := make(map[int64]int)
@@ -1086,13 +1681,13 @@ func (s *Service) handleMessageMediaControl(msg *Message, packet *ReceivedPacket
 					}
 
 					if !reflect.DeepEqual(uids, participant.VideoList) {
-						logging.Logger.Info(msg.From, " media control video: ", uids)
+						s.log().Info(msg.From, " media control video: ", uids)
 					}
 					participant.VideoList = uids
 
 				} else if key == 2 { //缩略视频请求列表uid
 					if size%8 != 0 {
-						logging.Logger.Info("participant ", msg.From, "error value size for key ", key, " for media control message ", payload)
+						s.log().Info("participant ", msg.From, "error value size for key ", key, " for media control message ", payload)
 					}
 					num := int(size) / 8
 					uids := make(map[int64]int)
@@ -1102,13 +1697,13 @@ func (s *Service) handleMessageMediaControl(msg *Message, packet *ReceivedPacket
 					}
 
 					if !reflect.DeepEqual(uids, participant.ThumbVideoList) {
-						logging.Logger.Info(msg.From, " media control thumb video: ", uids)
+						s.log().Info(msg.From, " media control thumb video: ", uids)
 					}
 					participant.ThumbVideoList = uids
 
 				} else if key == 3 { //音频补偿系数，0-8，
 					if size%9 != 0 {
-						logging.Logger.Info("participant ", msg.From, "error value size for key ", key, " for media control message ", payload)
+						s.log().Info("participant ", msg.From, "error value size for key ", key, " for media control message ", payload)
 					}
 					num := int(size) / 9
 					uids := make(map[int64]int)
@@ -1119,27 +1714,150 @@ func (s *Service) handleMessageMediaControl(msg *Message, packet *ReceivedPacket
 					}
 
 					if !reflect.DeepEqual(uids, participant.AudioRepeatFactor) {
-						logging.Logger.Info(msg.From, " media control audio repeat: ", uids)
+						s.log().Info(msg.From, " media control audio repeat: ", uids)
 					}
 					participant.AudioRepeatFactor = uids
 
 				} else {
-					logging.Logger.Info("participant ", msg.From, "unknown key ", key, " for media control message ", payload)
+					s.log().Info("participant ", msg.From, "unknown key ", key, " for media control message ", payload)
 				}
 
 				p += int(size)
 			}
 		} else {
-			logging.Logger.Info("participant ", msg.From, " not existed in session ", msg.To, " for media control message")
+			s.log().Info("participant ", msg.From, " not existed in session ", msg.To, " for media control message")
 		}
 	} else {
-		logging.Logger.Info("session ", msg.To, " not existed for media control packet from ", msg.From)
+		s.log().Info("session ", msg.To, " not existed for media control packet from ", msg.From)
 	}
 }
 
 //清理过期的session和user
 var tickCount = 0
 
+//除了注册和信令，其他消息的To都是sid
+func (s *Service) setTrace(msg *Message, packet *ReceivedPacket) {
+	fields := logrus.Fields{"from": msg.From, "to": msg.To, "type": msg.MsgType}
+	switch msg.MsgType {
+	case UdpMessageTypeUserReg, UdpMessageTypeUserSignal, UdpMessageTypeKeyExchange:
+	default:
+		fields["sid"] = msg.To
+		if logging.IsTraced(msg.To) {
+			logging.TraceLogger.Info("packet type ", msg.MsgType, " tseq ", msg.Tseq, " tid ", msg.Tid, " ts ", msg.Timestamp, " flags ", msg.Flags, " size ", len(packet.Body), " from <", packet.FromUdpAddr.String(), ">")
+		}
+	}
+	s.trace.Set(fields)
+}
+
+//带着当前包的trace字段的日志，见utils/logging/trace.go
+func (s *Service) log() *logrus.Entry {
+	return s.trace.Logger()
+}
+
+//解密收到的消息，返回false表示该消息应丢弃
+func (s *Service) openMessage(msg *Message, packet *ReceivedPacket) bool {
+	if !msg.HasFlag(UdpMessageFlagEncrypted) {
+		if !s.config.AllowPlaintext && !plaintextAllowed(msg) {
+			s.log().Warn("drop plaintext message type ", msg.MsgType, " from ", msg.From)
+			return false
+		}
+		return true
+	}
+
+	var link *Link
+	if packet.FromUdpAddr != nil {
+		link = s.links[packet.FromUdpAddr.String()]
+	}
+	if link == nil {
+		s.log().Warn("encrypted message without link key from ", msg.From)
+		return false
+	}
+	if link.Uid != msg.From {
+		s.log().Warn("drop encrypted message from ", msg.From, " on link of ", link.Uid)
+		return false
+	}
+	if err := link.Open(msg); err != nil {
+		s.reportError(errs.Wrap(err, "decrypt message").From(packet.FromUdpAddr.String()).OfType(msg.MsgType))
+		return false
+	}
+	return true
+}
+
+//媒体包只有带了上游trace上下文才建span，信令总是建span（是否采样由sampler决定）
+func (s *Service) startPacketSpan(msg *Message) trace.Span {
+	parent, ok := ContextFromMessage(msg)
+	if !ok && msg.MsgType != UdpMessageTypeUserSignal {
+		return nil
+	}
+	ctx, span := tracing.Tracer().Start(parent, "relay.receive", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.Int64("from", msg.From), attribute.Int64("to", msg.To), attribute.Int("type", int(msg.MsgType))))
+	s.traceCtx = ctx
+	return span
+}
+
+//所有发给客户端的消息都走这里，做过密钥协商的链路自动加密
+func (s *Service) sendMessage(msg *Message, addr *net.UDPAddr) {
+	if data := s.forwardWire(msg, addr); data != nil {
+		if s.enqueue(msg.MsgType, data, data, addr) {
+			s.traffic.fastForwarded++
+			s.countForwarded(msg, len(data))
+		}
+		return
+	}
+	forwarded := msg
+
+	capabilities := s.capabilities[addr.String()]
+	if capabilities&CapabilityTraceContext == 0 {
+		if msg.HasFlag(UdpMessageFlagExtra) && FindExtra(msg.Extra, UdpMessageExtraTypeTrace) != nil {
+			stripped := *msg
+			stripped.Extra = RemoveExtra(msg.Extra, UdpMessageExtraTypeTrace)
+			msg = &stripped
+		}
+	} else if s.traceCtx != nil {
+		ctx, span := tracing.Tracer().Start(s.traceCtx, "relay.send", trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(attribute.String("addr", addr.String())))
+		defer span.End()
+		traced := *msg //同一个msg可能发给多个接收方，不能改原来的
+		InjectTraceContext(ctx, &traced)
+		msg = &traced
+	}
+
+	if msg.HasFlag(UdpMessageFlagHopTrace) {
+		hopped := *msg
+		AppendHop(&hopped, HopRelayOut, time.Now())
+		msg = &hopped
+	}
+
+	link := s.links[addr.String()]
+	if link != nil {
+		sealed, err := link.Seal(msg)
+		if err != nil {
+			s.log().Error("encrypt message error:", err)
+			return
+		}
+		msg = sealed
+	}
+	buf := utils.GetPacketBuffer(0)
+	data := msg.ObfuscatedDataOfMessageTo(buf)
+	if s.enqueue(msg.MsgType, buf, data, addr) {
+		s.countForwarded(forwarded, len(data))
+	}
+}
+
+//缓冲区交给发送队列，发完由它归还，超过大小限制丢弃时返回false
+func (s *Service) enqueue(msgType uint8, buf []byte, data []byte, addr *net.UDPAddr) bool {
+	if limit := s.datagramLimit(addr); limit > 0 && len(data) > limit && msgType != UdpMessageTypeMtuProbe {
+		utils.PutPacketBuffer(buf)
+		s.traffic.oversized++
+		s.log().Debug("drop message ", msgType, " of ", len(data), " bytes to <", addr.String(), "> over limit ", limit)
+		return false
+	}
+	s.udp_server.Send(buf, data, addr, sendPriorityOf(msgType))
+	s.traffic.sentPackets++
+	s.traffic.sentBytes += uint64(len(data))
+	return true
+}
+
 func (s *Service) handleTicker(now time.Time) {
 	numSessions := 0
 	numParticipants := 0
@@ -1147,15 +1865,15 @@ func (s *Service) handleTicker(now time.Time) {
 	for skey, session := range s.sessions {
 		for pkey, participant := range session.Participants {
 			if now.Sub(participant.LastActiveTime) > 45*time.Second { //因为给非活跃relay客户端也会定期发小包，所以这儿超时可以缩短
-				delete(session.Participants, pkey)
-				logging.Logger.Info("delete participant ", pkey, " From session ", skey, " for inactive 45s")
+				s.removeParticipant(session, pkey)
+				s.log().Info("delete participant ", pkey, " From session ", skey, " for inactive 45s")
 			} else {
 				numParticipants++
 			}
 		}
-		if len(session.Participants) == 0 {
-			delete(s.sessions, skey)
-			logging.Logger.Info("delete session ", skey, " for all participants quit")
+		if len(session.Participants) == 0 && !session.awaitingMembers(now) {
+			s.removeSession(session)
+			s.log().Info("delete session ", skey, " for all participants quit")
 		} else {
 			numSessions++
 		}
@@ -1164,47 +1882,88 @@ func (s *Service) handleTicker(now time.Time) {
 	for ukey, user := range s.users {
 		if now.Sub(user.LastActiveTime) > 600*time.Second {
 			delete(s.users, ukey)
-			logging.Logger.Info("delete user ", ukey, " for inactive 10 minutes")
+			s.routes.Delete(ukey)
+			s.presenceChanged(ukey, false)
+			if user.UdpAddr != nil {
+				delete(s.capabilities, user.UdpAddr.String())
+				delete(s.mtus, user.UdpAddr.String())
+			}
+			s.log().Info("delete user ", ukey, " for inactive 10 minutes")
 		} else {
+			for _, addr := range user.expireDevices(now) {
+				if addr.String() != user.UdpAddr.String() {
+					delete(s.capabilities, addr.String())
+					delete(s.mtus, addr.String())
+				}
+			}
 			numRegUsers++
 		}
 	}
 
+	s.routes.Flush()
+	s.replay.Expire(now)
+	s.reassembler.Expire(now)
+	s.rateLimiter.Expire(now)
+	s.blocklist.Expire(now)
+	s.expireNetProbes(now)
+	s.expireEchoes(now)
+
+	for addr, link := range s.links {
+		if now.Sub(link.LastActiveTime) > LinkIdleTimeout {
+			delete(s.links, addr)
+		}
+	}
+
+	s.traffic.updateRates(now)
+	s.reportQuality()
+	s.reportSessionStats(now)
+	s.syncPresence(now)
+	if now.Sub(s.lastUsageFlush) >= UsageFlushPeriod {
+		s.lastUsageFlush = now
+		s.flushUsage(now)
+	}
+	if s.capture != nil {
+		s.capture.Flush()
+	}
+
 	tickCount++
 	if tickCount%2 == 0 {
-		logging.Logger.Info("<<< current active sessions:", numSessions, " participants:", numParticipants, " reg users:", numRegUsers, " >>>")
+		s.log().Info("<<< current active sessions:", numSessions, " participants:", numParticipants, " reg users:", numRegUsers, " >>>")
+		if counts := s.udp_server.PacketCounts(); len(counts) > 1 {
+			s.log().Info("<<< packets received per socket:", counts, " >>>")
+		}
 	}
 	if tickCount%20 == 0 { //每十分钟打印一次
 		if len(s.sessions) > 0 || len(s.users) > 0 {
-			logging.Logger.Infoln("details:")
+			s.log().Infoln("details:")
 			for skey, session := range s.sessions {
-				logging.Logger.Info("    session: ", skey)
+				s.log().Info("    session: ", skey)
 				for pkey, p := range session.Participants {
-					logging.Logger.Info("       participant:", pkey, "<", p.UdpAddr.String(), ">")
+					s.log().Info("       participant:", pkey, "<", p.UdpAddr.String(), ">")
 				}
 			}
 
 			for ukey, u := range s.users {
-				logging.Logger.Info("    reg user:", ukey, "<", u.UdpAddr.String(), ">")
+				s.log().Info("    reg user:", ukey, "<", u.UdpAddr.String(), ">")
 			}
 		}
 
-		logging.Logger.Info("    messages sum:")
-		logging.Logger.Info("        sum noop:          ", s.acc_msg[UdpMessageTypeNoop])
-		logging.Logger.Info("        sum turn reg:      ", s.acc_msg[UdpMessageTypeTurnReg])
-		logging.Logger.Info("        sum turn unreg:    ", s.acc_msg[UdpMessageTypeTurnUnReg])
-		logging.Logger.Info("        sum audio:         ", s.acc_msg[UdpMessageTypeAudioStream])
-		logging.Logger.Info("        sum video:         ", s.acc_msg[UdpMessageTypeVideoStream])
-		logging.Logger.Info("        sum video iframe:  ", s.acc_msg[UdpMessageTypeVideoStreamIFrame])
-		logging.Logger.Info("        sum video nack:    ", s.acc_msg[UdpMessageTypeVideoNack])
-		logging.Logger.Info("        sum video ask i:   ", s.acc_msg[UdpMessageTypeVideoAskForIFrame])
-		logging.Logger.Info("        sum thumb video:   ", s.acc_msg[UdpMessageTypeThumbVideoStream])
-		logging.Logger.Info("        sum thumb video i: ", s.acc_msg[UdpMessageTypeThumbVideoStreamIFrame])
-		logging.Logger.Info("        sum thumb video n: ", s.acc_msg[UdpMessageTypeThumbVideoNack])
-		logging.Logger.Info("        sum thumb video a: ", s.acc_msg[UdpMessageTypeThumbVideoAskForIFrame])
-		logging.Logger.Info("        sum user reg:      ", s.acc_msg[UdpMessageTypeUserReg])
-		logging.Logger.Info("        sum user signal:   ", s.acc_msg[UdpMessageTypeUserSignal])
-		logging.Logger.Info("        sum media control: ", s.acc_msg[UdpMessageTypeMediaControl])
+		s.log().Info("    messages sum:")
+		s.log().Info("        sum noop:          ", s.acc_msg[UdpMessageTypeNoop])
+		s.log().Info("        sum turn reg:      ", s.acc_msg[UdpMessageTypeTurnReg])
+		s.log().Info("        sum turn unreg:    ", s.acc_msg[UdpMessageTypeTurnUnReg])
+		s.log().Info("        sum audio:         ", s.acc_msg[UdpMessageTypeAudioStream])
+		s.log().Info("        sum video:         ", s.acc_msg[UdpMessageTypeVideoStream])
+		s.log().Info("        sum video iframe:  ", s.acc_msg[UdpMessageTypeVideoStreamIFrame])
+		s.log().Info("        sum video nack:    ", s.acc_msg[UdpMessageTypeVideoNack])
+		s.log().Info("        sum video ask i:   ", s.acc_msg[UdpMessageTypeVideoAskForIFrame])
+		s.log().Info("        sum thumb video:   ", s.acc_msg[UdpMessageTypeThumbVideoStream])
+		s.log().Info("        sum thumb video i: ", s.acc_msg[UdpMessageTypeThumbVideoStreamIFrame])
+		s.log().Info("        sum thumb video n: ", s.acc_msg[UdpMessageTypeThumbVideoNack])
+		s.log().Info("        sum thumb video a: ", s.acc_msg[UdpMessageTypeThumbVideoAskForIFrame])
+		s.log().Info("        sum user reg:      ", s.acc_msg[UdpMessageTypeUserReg])
+		s.log().Info("        sum user signal:   ", s.acc_msg[UdpMessageTypeUserSignal])
+		s.log().Info("        sum media control: ", s.acc_msg[UdpMessageTypeMediaControl])
 
 		for k, _ := range s.acc_msg {
 			s.acc_msg[k] = 0
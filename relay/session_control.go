@@ -0,0 +1,248 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/*
+session manager到relay的session控制：呼叫建立和成员变化时，session manager发UdpMessageTypeSessionControl，
+payload为op(1)+media(1)+count(2)+uid(8)*count，有成员被限制了媒体权限时后面再跟restrict(1)*count，和uid一一对应；
+有成员在分组讨论房间时再跟room(1)*count（这时restrict即使都为0也要带上）。
+  setup     relay记下成员和允许的媒体，此后只有成员能TurnReg，成员也只能发允许的媒体；不在成员里的参与者立即移除；
+            restrict为MemberNoSendAudio时不转发他发的音频，MemberNoSendVideo时不转发他发的视频，
+            MemberNoReceive时不给他转发别人的音视频和数据（NACK、RTCP等反馈照常），如研讨会的只听众；
+            MemberSubscriber为广播模式的订阅者，只收不发：他发的音视频和数据都不转发，只转发NACK、请求I帧等反馈，
+            混音和老客户端视频的人数上限只算能发的人，订阅者再多也按一对多逐路转发；
+            room为成员所在的房间，0为主会场，音视频和数据只在同一房间的成员之间转发，有房间时不混音
+  teardown  通话结束，relay删除该session
+没收到过setup的session（如老版本的session manager）不做限制，和以前一样谁TurnReg都可以加入。
+*/
+
+const (
+	SessionControlTeardown = 0
+	SessionControlSetup    = 1
+
+	MediaAudio = 1 << 0
+	MediaVideo = 1 << 1
+	MediaData  = 1 << 2
+	MediaAll   = MediaAudio | MediaVideo | MediaData
+
+	MaxSessionMembers = 256
+
+	SessionControlGrace = 60 * time.Second //setup后成员还没TurnReg时，空session保留的时间
+)
+
+//成员的媒体权限限制，0为不限
+const (
+	MemberNoSendAudio = 1 << 0
+	MemberNoSendVideo = 1 << 1
+	MemberNoReceive   = 1 << 2
+	MemberSubscriber  = 1 << 3 //广播模式的订阅者，见session_manager/broadcast.go
+)
+
+type SessionControl struct {
+	Op        uint8
+	Media     uint8
+	Members   []int64
+	Restricts []uint8 //和Members一一对应，nil为都不限制
+	Rooms     []uint8 //和Members一一对应，nil为都在主会场
+}
+
+func (c *SessionControl) Marshal() []byte {
+	data := make([]byte, 4+8*len(c.Members))
+	data[0] = c.Op
+	data[1] = c.Media
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(c.Members)))
+	for i, uid := range c.Members {
+		binary.BigEndian.PutUint64(data[4+8*i:], uint64(uid))
+	}
+	if anySet(c.Rooms) {
+		restricts := c.Restricts
+		if restricts == nil {
+			restricts = make([]uint8, len(c.Members))
+		}
+		data = append(data, restricts...)
+		return append(data, c.Rooms...)
+	}
+	if anySet(c.Restricts) {
+		return append(data, c.Restricts...)
+	}
+	return data
+}
+
+func anySet(values []uint8) bool {
+	for _, v := range values {
+		if v != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func UnmarshalSessionControl(data []byte) (*SessionControl, error) {
+	if len(data) < 4 {
+		return nil, errors.New("session control too short")
+	}
+	count := int(binary.BigEndian.Uint16(data[2:4]))
+	if count > MaxSessionMembers || (len(data) != 4+8*count && len(data) != 4+9*count && len(data) != 4+10*count) {
+		return nil, errors.New("session control members incorrect")
+	}
+	c := &SessionControl{Op: data[0], Media: data[1], Members: make([]int64, count)}
+	for i := range c.Members {
+		c.Members[i] = int64(binary.BigEndian.Uint64(data[4+8*i:]))
+	}
+	if len(data) >= 4+9*count && count > 0 {
+		c.Restricts = append([]uint8(nil), data[4+8*count:4+9*count]...)
+	}
+	if len(data) == 4+10*count && count > 0 {
+		c.Rooms = append([]uint8(nil), data[4+9*count:]...)
+	}
+	return c, nil
+}
+
+//消息属于哪类媒体，不是媒体消息时返回0
+func mediaOf(msgType uint8) uint8 {
+	switch msgType {
+	case UdpMessageTypeAudioStream:
+		return MediaAudio
+	case UdpMessageTypeVideoStream, UdpMessageTypeVideoStreamIFrame, UdpMessageTypeVideoNack, UdpMessageTypeVideoAskForIFrame,
+		UdpMessageTypeThumbVideoStream, UdpMessageTypeThumbVideoStreamIFrame, UdpMessageTypeThumbVideoNack, UdpMessageTypeThumbVideoAskForIFrame:
+		return MediaVideo
+	case UdpMessageTypeData, UdpMessageTypeDataNack, UdpMessageTypeUnicastData, UdpMessageTypeUnicastDataNack:
+		return MediaData
+	case UdpMessageTypeRtcp:
+		return MediaAudio | MediaVideo
+	}
+	return 0
+}
+
+//受session manager控制的session里，只转发成员发的、允许的媒体
+func (s *Service) mediaAllowed(msg *Message) bool {
+	media := mediaOf(msg.MsgType)
+	if media == 0 {
+		return true
+	}
+	session := s.sessions[msg.To]
+	if session == nil || !session.Controlled {
+		return true
+	}
+	return session.Members[msg.From] && session.Media&media != 0 && session.Restricts[msg.From]&sendRestrictionOf(msg.MsgType) == 0
+}
+
+//发这类消息被哪些限制禁止，NACK、请求I帧等反馈不受限
+func sendRestrictionOf(msgType uint8) uint8 {
+	switch msgType {
+	case UdpMessageTypeAudioStream:
+		return MemberNoSendAudio | MemberSubscriber
+	case UdpMessageTypeVideoStream, UdpMessageTypeVideoStreamIFrame, UdpMessageTypeThumbVideoStream, UdpMessageTypeThumbVideoStreamIFrame:
+		return MemberNoSendVideo | MemberSubscriber
+	case UdpMessageTypeData, UdpMessageTypeUnicastData:
+		return MemberSubscriber
+	}
+	return 0
+}
+
+//能发媒体的参与者数，不算广播模式的订阅者
+func (session *Session) senders() int {
+	n := len(session.Participants)
+	for uid, restrict := range session.Restricts {
+		if restrict&MemberSubscriber != 0 && session.Participants[uid] != nil {
+			n--
+		}
+	}
+	return n
+}
+
+//不给uid转发媒体：被保持或没有接收权限
+func (session *Session) notReceiving(uid int64) bool {
+	return session.Held[uid] || session.Restricts[uid]&MemberNoReceive != 0
+}
+
+//不给uid转发from发的媒体：uid不接收，或两人不在同一个分组讨论房间
+func (session *Session) notReceivingFrom(uid int64, from int64) bool {
+	return session.notReceiving(uid) || session.Rooms[uid] != session.Rooms[from]
+}
+
+func (s *Service) handleMessageSessionControl(msg *Message, packet *ReceivedPacket) {
+	if msg.From != SessionManagerUid {
+		s.log().Warn("session control from non session manager ", msg.From, "<", packet.FromUdpAddr.String(), ">")
+		return
+	}
+	control, err := UnmarshalSessionControl(msg.Payload)
+	if err != nil {
+		s.log().Warn("incorrect session control message for session ", msg.To, ":", err)
+		return
+	}
+
+	session := s.sessions[msg.To]
+	if control.Op == SessionControlTeardown {
+		if session != nil {
+			s.removeSession(session)
+			s.log().Info("session ", msg.To, " torn down by session manager")
+		}
+		return
+	}
+
+	if session == nil && s.draining {
+		s.log().Warn("ignore setup of new session ", msg.To, " when draining")
+		return
+	}
+	if session == nil {
+		session = NewSession(msg.To)
+		session.Participants = make(map[int64]*Participant)
+		s.sessions[msg.To] = session
+	}
+	session.Controlled = true
+	session.ControlTime = time.Now()
+	session.Media = control.Media
+	session.Members = make(map[int64]bool, len(control.Members))
+	session.Restricts = make(map[int64]uint8)
+	session.Rooms = make(map[int64]uint8)
+	for i, uid := range control.Members {
+		session.Members[uid] = true
+		if control.Restricts != nil && control.Restricts[i] != 0 {
+			session.Restricts[uid] = control.Restricts[i]
+		}
+		if control.Rooms != nil && control.Rooms[i] != 0 {
+			session.Rooms[uid] = control.Rooms[i]
+		}
+	}
+	for uid := range session.Participants {
+		if !session.Members[uid] {
+			s.removeParticipant(session, uid)
+			s.log().Info("remove participant ", uid, " not in members of session ", msg.To)
+		}
+	}
+	s.log().Info("session ", msg.To, " setup by session manager, members:", control.Members, " media:", control.Media, " restricts:", control.Restricts, " rooms:", control.Rooms)
+}
+
+//setup之后成员还没来得及TurnReg，空session先不删
+func (session *Session) awaitingMembers(now time.Time) bool {
+	return session.Controlled && now.Sub(session.ControlTime) < SessionControlGrace
+}
+
+func (s *Service) removeParticipant(session *Session, uid int64) {
+	delete(session.Participants, uid)
+	delete(session.Held, uid)
+	session.Speaker.Remove(uid)
+	if session.Mixer != nil {
+		session.Mixer.Remove(uid)
+	}
+}
+
+func (s *Service) removeSession(session *Session) {
+	s.finishVoicemail(session)
+	if session.Recording {
+		s.recorder.Close(session.Id)
+	}
+	delete(s.sessions, session.Id)
+}
@@ -0,0 +1,214 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSessionControlMarshal(t *testing.T) {
+	c := &SessionControl{Op: SessionControlSetup, Media: MediaAudio | MediaData, Members: []int64{1001, 1002, -1}}
+	got, err := UnmarshalSessionControl(c.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Op != c.Op || got.Media != c.Media || len(got.Members) != 3 || got.Members[2] != -1 {
+		t.Errorf("unmarshal got %+v", got)
+	}
+
+	data := c.Marshal()
+	for _, bad := range [][]byte{nil, data[:3], data[:len(data)-1], append(data, 0)} {
+		if _, err := UnmarshalSessionControl(bad); err == nil {
+			t.Errorf("accepted incorrect session control of %d bytes", len(bad))
+		}
+	}
+}
+
+func TestSessionControlSetup(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	const sid = int64(42)
+
+	control := func(from int64, c *SessionControl) {
+		msg := NewMessage(UdpMessageTypeSessionControl, from, sid, 0, c.Marshal(), nil)
+		s.handleMessageSessionControl(msg, &ReceivedPacket{FromUdpAddr: addr})
+	}
+	media := func(msgType uint8, from int64) *Message {
+		return NewMessage(msgType, from, sid, 0, make([]byte, 12), nil)
+	}
+
+	//未受控的session不做限制
+	if !s.mediaAllowed(media(UdpMessageTypeVideoStream, 1003)) {
+		t.Fatal("media rejected for uncontrolled session")
+	}
+
+	session := NewSession(sid)
+	session.Participants = map[int64]*Participant{1001: {Id: 1001}, 1003: {Id: 1003}}
+	session.Held[1003] = true
+	s.sessions[sid] = session
+
+	setup := &SessionControl{Op: SessionControlSetup, Media: MediaAudio | MediaData, Members: []int64{1001, 1002}}
+	control(1001, setup) //不是session manager发的，忽略
+	if session.Controlled {
+		t.Fatal("session control accepted from non session manager")
+	}
+
+	control(SessionManagerUid, setup)
+	if !session.Controlled || !session.Members[1002] {
+		t.Fatal("session not controlled after setup")
+	}
+	if session.Participants[1003] != nil || session.Held[1003] {
+		t.Error("non member participant not removed")
+	}
+	if session.Participants[1001] == nil {
+		t.Error("member participant removed")
+	}
+
+	if !s.mediaAllowed(media(UdpMessageTypeAudioStream, 1001)) || !s.mediaAllowed(media(UdpMessageTypeRtcp, 1001)) {
+		t.Error("allowed media rejected")
+	}
+	if s.mediaAllowed(media(UdpMessageTypeVideoStream, 1001)) {
+		t.Error("video forwarded in audio only session")
+	}
+	if s.mediaAllowed(media(UdpMessageTypeAudioStream, 1003)) {
+		t.Error("media from non member forwarded")
+	}
+	if !s.mediaAllowed(media(UdpMessageTypeTurnReg, 1003)) {
+		t.Error("non media message rejected")
+	}
+
+	control(SessionManagerUid, &SessionControl{Op: SessionControlTeardown})
+	if s.sessions[sid] != nil {
+		t.Error("session not removed after teardown")
+	}
+}
+
+func TestSessionControlRestricts(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	const sid = int64(42)
+
+	//都不限制时和老格式相同
+	open := &SessionControl{Op: SessionControlSetup, Media: MediaAll, Members: []int64{1001, 1002}, Restricts: []uint8{0, 0}}
+	if len(open.Marshal()) != 4+8*2 {
+		t.Errorf("unrestricted control marshalled to %d bytes", len(open.Marshal()))
+	}
+
+	setup := &SessionControl{Op: SessionControlSetup, Media: MediaAll, Members: []int64{1001, 1002},
+		Restricts: []uint8{0, MemberNoSendAudio | MemberNoSendVideo | MemberNoReceive}}
+	got, err := UnmarshalSessionControl(setup.Marshal())
+	if err != nil || len(got.Restricts) != 2 || got.Restricts[1] != setup.Restricts[1] {
+		t.Fatalf("unmarshal got %+v, err %v", got, err)
+	}
+	msg := NewMessage(UdpMessageTypeSessionControl, SessionManagerUid, sid, 0, setup.Marshal(), nil)
+	s.handleMessageSessionControl(msg, &ReceivedPacket{FromUdpAddr: addr})
+	session := s.sessions[sid]
+
+	media := func(msgType uint8, from int64) *Message {
+		return NewMessage(msgType, from, sid, 0, make([]byte, 12), nil)
+	}
+	if !s.mediaAllowed(media(UdpMessageTypeAudioStream, 1001)) || !s.mediaAllowed(media(UdpMessageTypeVideoStream, 1001)) {
+		t.Error("unrestricted member's media rejected")
+	}
+	if s.mediaAllowed(media(UdpMessageTypeAudioStream, 1002)) || s.mediaAllowed(media(UdpMessageTypeVideoStreamIFrame, 1002)) {
+		t.Error("listen-only member's media forwarded")
+	}
+	if !s.mediaAllowed(media(UdpMessageTypeVideoNack, 1002)) {
+		t.Error("listen-only member's nack rejected")
+	}
+	if session.notReceiving(1001) || !session.notReceiving(1002) {
+		t.Error("receive restriction not applied")
+	}
+}
+
+func TestSessionControlRooms(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	const sid = int64(42)
+
+	setup := &SessionControl{Op: SessionControlSetup, Media: MediaAll, Members: []int64{1001, 1002, 1003}, Rooms: []uint8{0, 1, 1}}
+	data := setup.Marshal()
+	if len(data) != 4+10*3 {
+		t.Fatalf("control with rooms marshalled to %d bytes", len(data))
+	}
+	got, err := UnmarshalSessionControl(data)
+	if err != nil || len(got.Restricts) != 3 || got.Restricts[1] != 0 || len(got.Rooms) != 3 || got.Rooms[2] != 1 {
+		t.Fatalf("unmarshal got %+v, err %v", got, err)
+	}
+	msg := NewMessage(UdpMessageTypeSessionControl, SessionManagerUid, sid, 0, data, nil)
+	s.handleMessageSessionControl(msg, &ReceivedPacket{FromUdpAddr: addr})
+	session := s.sessions[sid]
+
+	if session.notReceivingFrom(1003, 1002) {
+		t.Error("media not forwarded inside a room")
+	}
+	if !session.notReceivingFrom(1001, 1002) || !session.notReceivingFrom(1002, 1001) {
+		t.Error("media forwarded between the main room and a breakout room")
+	}
+
+	session.Participants = map[int64]*Participant{1001: {Id: 1001}, 1002: {Id: 1002}, 1003: {Id: 1003}}
+	session.Mixer = NewMixer(NewPcmCodec)
+	s.audioCodec = NewPcmCodec
+	s.config.MixThreshold = 2
+	if s.shouldMix(session) || session.Mixer != nil {
+		t.Error("audio mixed across rooms")
+	}
+}
+
+func TestSessionControlSubscribers(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	const sid = int64(42)
+
+	subscriber := uint8(MemberSubscriber | MemberNoSendAudio | MemberNoSendVideo)
+	setup := &SessionControl{Op: SessionControlSetup, Media: MediaAll, Members: []int64{1001, 1002, 1003, 1004},
+		Restricts: []uint8{0, subscriber, subscriber, MemberSubscriber}}
+	msg := NewMessage(UdpMessageTypeSessionControl, SessionManagerUid, sid, 0, setup.Marshal(), nil)
+	s.handleMessageSessionControl(msg, &ReceivedPacket{FromUdpAddr: addr})
+	session := s.sessions[sid]
+
+	media := func(msgType uint8, from int64) *Message {
+		return NewMessage(msgType, from, sid, 0, make([]byte, 12), nil)
+	}
+	//permit放开了音频也还是订阅者
+	for _, msgType := range []uint8{UdpMessageTypeAudioStream, UdpMessageTypeVideoStream, UdpMessageTypeData} {
+		if s.mediaAllowed(media(msgType, 1004)) {
+			t.Errorf("subscriber's message %d forwarded", msgType)
+		}
+	}
+	if !s.mediaAllowed(media(UdpMessageTypeVideoAskForIFrame, 1002)) || !s.mediaAllowed(media(UdpMessageTypeData, 1001)) {
+		t.Error("feedback or publisher data rejected")
+	}
+	if session.notReceivingFrom(1002, 1001) {
+		t.Error("subscriber not receiving from the publisher")
+	}
+
+	//订阅者不算混音人数
+	session.Participants = map[int64]*Participant{1001: {Id: 1001}, 1002: {Id: 1002}, 1003: {Id: 1003}, 1004: {Id: 1004}}
+	s.audioCodec = NewPcmCodec
+	s.config.MixThreshold = 2
+	if session.senders() != 1 || s.shouldMix(session) {
+		t.Errorf("senders %d, mixing with one publisher", session.senders())
+	}
+}
+
+func TestSessionControlGrace(t *testing.T) {
+	session := NewSession(42)
+	if session.awaitingMembers(session.ControlTime) {
+		t.Error("uncontrolled session awaiting members")
+	}
+	session.Controlled = true
+	session.ControlTime = session.ControlTime.Add(SessionControlGrace)
+	if !session.awaitingMembers(session.ControlTime) {
+		t.Error("session not awaiting members right after setup")
+	}
+	if session.awaitingMembers(session.ControlTime.Add(SessionControlGrace)) {
+		t.Error("session awaiting members after grace")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+session的转发统计：relay按session汇总转发的媒体，报给session manager写进CDR，得到每次通话完整的资源用量。
+1. 发给客户端的媒体包（见hold.go的isHoldableMessage，To为sid）发出时按session累计包数和字节，
+   从第一个转发的包开始计时；服务过的参与者按uid去重，包括发过媒体的和上报时在session里的，中途离开的也算
+2. relay每个定时器周期把有转发的session的累计值发给session manager，UdpMessageTypeSessionStats，To为sid，
+   payload为participants(4)+packets(8)+bytes(8)+seconds(4)，seconds为从第一个转发的包到上报时的秒数
+3. 报的是session在这个relay上开始以来的累计值，丢了一次下次会补上；统计放在Session上，session删除时一起删除
+4. session manager按relay保留最近一次上报，session结束时写进CDR，见session_manager/session_stats.go
+*/
+
+const SessionStatsSize = 24
+
+type SessionStats struct {
+	Participants int
+	Packets      int64
+	Bytes        int64
+	Seconds      int
+}
+
+//平均带宽，bit/s，Seconds为0时为0
+func (st SessionStats) Bandwidth() int64 {
+	if st.Seconds <= 0 {
+		return 0
+	}
+	return st.Bytes * 8 / int64(st.Seconds)
+}
+
+func MarshalSessionStats(st SessionStats) []byte {
+	data := make([]byte, SessionStatsSize)
+	binary.BigEndian.PutUint32(data[0:4], uint32(st.Participants))
+	binary.BigEndian.PutUint64(data[4:12], uint64(st.Packets))
+	binary.BigEndian.PutUint64(data[12:20], uint64(st.Bytes))
+	binary.BigEndian.PutUint32(data[20:24], uint32(st.Seconds))
+	return data
+}
+
+func UnmarshalSessionStats(data []byte) (SessionStats, bool) {
+	if len(data) != SessionStatsSize {
+		return SessionStats{}, false
+	}
+	return SessionStats{
+		Participants: int(binary.BigEndian.Uint32(data[0:4])),
+		Packets:      int64(binary.BigEndian.Uint64(data[4:12])),
+		Bytes:        int64(binary.BigEndian.Uint64(data[12:20])),
+		Seconds:      int(binary.BigEndian.Uint32(data[20:24])),
+	}, true
+}
+
+//Session上的累计值，只在主循环里访问
+type forwardStats struct {
+	served  map[int64]bool
+	packets int64
+	bytes   int64
+	start   time.Time
+}
+
+func (f *forwardStats) snapshot(now time.Time) SessionStats {
+	return SessionStats{
+		Participants: len(f.served),
+		Packets:      f.packets,
+		Bytes:        f.bytes,
+		Seconds:      int(now.Sub(f.start) / time.Second),
+	}
+}
+
+//媒体包交给发送队列后调用，size为发出的字节
+func (s *Service) countForwarded(msg *Message, size int) {
+	if !isHoldableMessage(msg.MsgType) {
+		return
+	}
+	session := s.sessions[msg.To]
+	if session == nil {
+		return
+	}
+	f := session.Forwarded
+	if f == nil {
+		f = &forwardStats{served: make(map[int64]bool), start: time.Now()}
+		session.Forwarded = f
+	}
+	f.packets++
+	f.bytes += int64(size)
+	if msg.From > 0 {
+		f.served[msg.From] = true
+	}
+}
+
+//在定时器里调用，session manager没有注册时不报
+func (s *Service) reportSessionStats(now time.Time) {
+	user := s.users[SessionManagerUid]
+	if user == nil || user.UdpAddr == nil {
+		return
+	}
+	for _, session := range s.sessions {
+		f := session.Forwarded
+		if f == nil {
+			continue
+		}
+		for uid := range session.Participants {
+			if uid > 0 {
+				f.served[uid] = true
+			}
+		}
+		stats := f.snapshot(now)
+		msg := NewMessage(UdpMessageTypeSessionStats, SessionManagerUid, session.Id, 0, MarshalSessionStats(stats), nil)
+		s.sendMessage(msg, user.UdpAddr)
+		s.log().Debug("stats of session ", session.Id, ":", stats)
+	}
+}
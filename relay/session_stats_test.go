@@ -0,0 +1,63 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionStatsMarshal(t *testing.T) {
+	st := SessionStats{Participants: 3, Packets: 1 << 40, Bytes: 1 << 50, Seconds: 90}
+	got, ok := UnmarshalSessionStats(MarshalSessionStats(st))
+	if !ok || got != st {
+		t.Errorf("unmarshal %+v %v", got, ok)
+	}
+	if _, ok := UnmarshalSessionStats(make([]byte, SessionStatsSize-1)); ok {
+		t.Error("truncated session stats accepted")
+	}
+	if bw := (SessionStats{Bytes: 1000, Seconds: 4}).Bandwidth(); bw != 2000 {
+		t.Errorf("bandwidth %d", bw)
+	}
+}
+
+func TestServiceSessionStats(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	smAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 19001}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	session := NewSession(7)
+	session.Participants = map[int64]*Participant{1001: {Id: 1001}, 1002: {Id: 1002}}
+	s.sessions[session.Id] = session
+	s.sessions[8] = NewSession(8)
+
+	audio := NewMessage(UdpMessageTypeAudioStream, 1001, session.Id, 0, make([]byte, 100), nil)
+	s.sendMessage(audio, addr)
+	s.sendMessage(audio, addr)
+	s.sendMessage(NewMessage(UdpMessageTypeUserSignal, 1001, session.Id, 0, make([]byte, 100), nil), addr)
+	f := session.Forwarded
+	if f == nil || f.packets != 2 || f.bytes < 200 || len(f.served) != 1 {
+		t.Fatalf("forwarded %+v", f)
+	}
+
+	//还没有session manager时不报
+	sent := s.traffic.sentPackets
+	s.reportSessionStats(time.Now())
+	if s.traffic.sentPackets != sent {
+		t.Fatalf("stats sent without session manager")
+	}
+	s.handleMessageUserReg(NewMessage(UdpMessageTypeUserReg, SessionManagerUid, 0, 0, nil, nil), &ReceivedPacket{FromUdpAddr: smAddr})
+	sent = s.traffic.sentPackets
+	s.reportSessionStats(f.start.Add(10 * time.Second))
+	if s.traffic.sentPackets != sent+1 { //没有转发过的session 8不报
+		t.Errorf("sent %d stats", s.traffic.sentPackets-sent)
+	}
+	if st := f.snapshot(f.start.Add(10 * time.Second)); st.Participants != 2 || st.Packets != 2 || st.Seconds != 10 {
+		t.Errorf("stats %+v", st)
+	}
+}
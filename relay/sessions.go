@@ -84,6 +84,54 @@ func (qo *QueueOut) AddItem(isIFrame bool, payload []byte, from int64) {
 	packet.Esi = binary.BigEndian.Uint16(payload[9:11])
 }
 
+func (qo *QueueOut) AddMessageItem(isIFrame bool, msg *Message) {
+	if msg.HasFlag(UdpMessageFlagRtp) {
+		qo.AddRtpItem(isIFrame, msg.Payload, msg.From)
+	} else {
+		qo.AddItem(isIFrame, msg.Payload, msg.From)
+	}
+}
+
+//RTP模式下按RTP序号缓存，sbn/esi不使用
+func (qo *QueueOut) AddRtpItem(isIFrame bool, payload []byte, from int64) {
+	header, err := ParseRtpHeader(payload)
+	if err != nil {
+		logging.Logger.Warn("incorrect rtp packet from ", from, ":", err)
+		return
+	}
+
+	packet := &OutPacket{
+		Seqid:  int16(header.SequenceNumber),
+		Iframe: isIFrame,
+		Data:   payload,
+	}
+	qo.Queue[qo.Idx] = packet
+	qo.Idx++
+	if qo.Idx >= QueueSize {
+		qo.Idx = 0
+	}
+}
+
+//返回缓存中能找到的包，以及找不到的序号
+func (qo *QueueOut) ProcessRtpNack(seqs []uint16) (packets [][]byte, iframes []bool, missing []uint16) {
+	for _, seq := range seqs {
+		found := false
+		for i := 0; i < QueueSize; i++ {
+			packet := qo.Queue[i]
+			if packet != nil && uint16(packet.Seqid) == seq {
+				packets = append(packets, packet.Data)
+				iframes = append(iframes, packet.Iframe)
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, seq)
+		}
+	}
+	return
+}
+
 func (qo *QueueOut) ProcessNack(nack []byte, from int64) (seqid int16, n_tries uint8, isIframe bool, packets [][]byte) {
 	packets = nil
 	if len(nack) < 4 {
@@ -154,11 +202,27 @@ type Session struct {
 	Id           int64
 	Type         int
 	Participants map[int64]*Participant
+	Recording    bool           //session manager通知开始录制后，上行媒体tee给recorder
+	Held         map[int64]bool //被保持的参与者，既不转发他发的媒体，也不给他转发
+	Mixer        *Mixer
+	Speaker      *SpeakerDetector
+	Controlled   bool //收到过session manager的setup，只允许Members加入，见session_control.go
+	Members      map[int64]bool
+	Restricts    map[int64]uint8  //成员被限制的媒体权限，MemberNo*位，见session_control.go
+	Rooms        map[int64]uint8  //成员所在的分组讨论房间，没有的在主会场，见session_control.go
+	Media        uint8            //允许转发的媒体，MediaAudio|MediaVideo|MediaData
+	ControlTime  time.Time        //最近一次setup的时间
+	Devices      map[int64]string //通话切换过设备的参与者当前所用的设备，见handover.go
+	Voicemail    *Voicemail       //正在录留言的主叫，见voicemail.go
+	Forwarded    *forwardStats    //转发统计，还没转发过媒体时为nil，见session_stats.go
 }
 
 func NewSession(id int64) *Session {
 	session := &Session{
-		Id: id,
+		Id:      id,
+		Held:    make(map[int64]bool),
+		Devices: make(map[int64]string),
+		Speaker: NewSpeakerDetector(),
 	}
 
 	return session
@@ -12,6 +12,7 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/xujiajundd/ycng/utils/errs"
 	"github.com/xujiajundd/ycng/utils/logging"
 	"fmt"
 )
@@ -29,14 +30,72 @@ const (
 	YCKCallSignalTypeCancel             = 8
 	YCKCallSignalTypeEnd                = 9
 	YCKCallSignalTypeBusy               = 10
+	YCKCallSignalTypePolicyReject       = 11 //session manager按策略拒绝sid请求或呼叫，Info带reason、uid、limit
+	YCKCallSignalTypeHold               = 12 //通话中的参与者保持自己这一路，如接听另一个来电时
+	YCKCallSignalTypeResume             = 13 //恢复保持
+	YCKCallSignalTypeServerMaintenance  = 14 //session manager停服交接，Info带retry_after(秒)，客户端保持通话，稍后重连
+	YCKCallSignalTypeCancelOtherDevices = 15 //被叫在一个设备上接听后发给他的所有设备，Info带接听的device，其他设备停止响铃
+	YCKCallSignalTypeHandover           = 16 //新设备发给session manager把进行中的通话切过来，回复同一信令，Info带relays
+	YCKCallSignalTypeMissedCall         = 17 //被叫没有接听呼叫就结束了，session manager发给被叫（也走push），Info带caller、time、call_type、group
+	YCKCallSignalTypeMediaCaps          = 18 //session的公共媒体能力变化，session manager发给参与者，Info["media_caps"]
+	YCKCallSignalTypeTopology           = 19 //session的媒体拓扑变化，session manager发给参与者，Info带topology和participants
 	YCKCallSignalTypeMemberOp           = 20
 	YCKCallSignalTypeMemberState        = 21
 	YCKCallSignalTypeMemberStateRequest = 22
+	YCKCallSignalTypeMemberOpResult     = 23 //带op_id的member_op的结果，session manager发给操作者，Info带op_id、op和results，见session_manager/member_op.go
 	YCKCallSignalTypeExtensionOp        = 24
+	YCKCallSignalTypeQueuePosition      = 25 //主叫在呼叫队列中的位置变化，session manager发给主叫，Info带queue(目标uid)和position(从1开始)
+	YCKCallSignalTypeVoicemail          = 26 //1-1呼叫被拒接或无应答后session manager发给主叫，开始留言，Info带callee和duration(秒)
+	YCKCallSignalTypeBreakout           = 27 //多方通话的成员被移到分组讨论房间，session manager发给被移动的成员，Info带room、room_id和members
+	YCKCallSignalTypeRelaySwitch        = 28 //session在用的relay不健康，session manager让参与者切到新relay，Info带from、to和relays；切换完回给session manager，Info带to
+	YCKCallSignalTypeNack               = 29 //session manager丢弃了发送方的信令，Info带signal、ts和reason，只发给带CapabilitySignalNack的客户端，见session_manager/drops.go
 	YCKCallSignalTypeStateSync          = 30
 	YCKCallSignalTypeStateInfo          = 31
+	YCKCallSignalTypeTerminate          = 32 //管理员强制结束session，发给session manager，只接受其admin_uids里的uid，Info可带note，见session_manager/terminate.go
+	YCKCallSignalTypePresence           = 33 //拨号前查询用户是否在线，发给session manager，Info带uids；回复同一信令，Info带online，见session_manager/presence.go
+	YCKCallSignalTypeAdmitRequest       = 34 //有人进了锁定的多方通话的等候室，session manager发给主持人，Info带uid，主持人用member_op的admit或deny处理，见session_manager/lobby.go
+	YCKCallSignalTypePunchRequest       = 40
+	YCKCallSignalTypePunchReady         = 41
+	YCKCallSignalTypePunchResult        = 42
+	YCKCallSignalTypeRecordStart        = 50
+	YCKCallSignalTypeRecordStop         = 51
+	YCKCallSignalTypeRecordConsent      = 52
+	YCKCallSignalTypeRecordState        = 53
+	YCKCallSignalTypeActiveSpeaker      = 60
 
-	YCKCallSignalTypeVoipTokenReg = 100 //严格来讲，这个不是一个call信令，姑且用之。。。
+	YCKCallSignalTypeVoipTokenReg       = 100 //严格来讲，这个不是一个call信令，姑且用之。。。
+	YCKCallSignalTypeAccessTokenRequest = 101 //向session manager续期relay的access token
+	YCKCallSignalTypeAccessToken        = 102
+	YCKCallSignalTypeVoipTokenAck       = 103 //VoipTokenReg的回复，带token的过期时间，见session_manager/token.go
+)
+
+//PolicyReject的Info["reason"]
+const (
+	YCKPolicyRejectTooManyCalls = 1 //uid同时参与的通话数已达上限
+	YCKPolicyRejectDoNotDisturb = 2 //被叫开启了免打扰
+	YCKPolicyRejectScreened     = 3 //被叫的来电过滤（黑名单等）拒绝了主叫
+	YCKPolicyRejectOverQuota    = 4 //发起方或其租户本计费周期的用量已超配额
+)
+
+//End、Cancel信令和MemberState中携带的结束原因，放在Info["reason"]，老客户端不带时按挂断处理
+const (
+	YCKCallEndReasonUnknown           = 0
+	YCKCallEndReasonHangup            = 1  //用户主动挂断或取消
+	YCKCallEndReasonTimeout           = 2  //被叫无应答，或session空闲超时
+	YCKCallEndReasonKicked            = 3  //被其他成员移出多方通话
+	YCKCallEndReasonNetworkFailure    = 4  //客户端检测到网络中断
+	YCKCallEndReasonServerShutdown    = 5  //服务端关闭或运维强制结束
+	YCKCallEndReasonHandover          = 6  //通话切换到了同一用户的另一个设备，发给旧设备
+	YCKCallEndReasonAnsweredElsewhere = 7  //振铃组里其他成员先接听了，见session_manager/ringgroup.go
+	YCKCallEndReasonMaxDuration       = 8  //session超过了最长时长，被session manager强制结束
+	YCKCallEndReasonAdmin             = 9  //被管理员强制结束，如滥用处理，见session_manager/terminate.go
+	YCKCallEndReasonDenied            = 10 //在等候室里被拒绝加入，或等候超时，见session_manager/lobby.go
+)
+
+const (
+	MaxSignalSize    = MaxFragments * MaxSignalPayload //分片能承载的最大信令
+	MaxSignalMembers = 64                              //一次member_op最多操作的人数
+	MaxSignalRelays  = 16
 )
 
 type Signal struct {
@@ -47,9 +106,11 @@ type Signal struct {
 	From      int64                  `json:"f"`
 	To        int64                  `json:"t"`
 	Ttl       uint32                 `json:"l"`
+	Seq       uint32                 `json:"q,omitempty"` //发送方在这个session内的序号，从1开始，0为不排序，见session_manager/sequence.go
 	Uuid      string                 `json:"id"`
 	Option    map[string]interface{} `json:"o,omitempty"`
 	Info      map[string]interface{} `json:"i,omitempty"`
+	Device    string                 `json:"-"` //发送方设备，UnmarshalMessage从消息extra中取，见devices.go
 }
 
 func NewSignalTemp() *Signal {
@@ -72,15 +133,59 @@ func NewSignal(signal uint16, from int64, to int64, sid int64) *Signal {
 }
 
 func (s *Signal) Unmarshal(data []byte) error {
+	if len(data) > MaxSignalSize {
+		return errs.New(errs.TooLarge, "signal too large")
+	}
 	decoder := json.NewDecoder(bytes.NewReader(data))
 	decoder.UseNumber()
 	err := decoder.Decode(s)
 	if err != nil {
-		return err
+		return errs.Mark(errs.Signal, err)
 	}
 	//logging.Logger.Info(string(data))
 	//logging.Logger.Info("receive:", s)
 
+	return s.validate()
+}
+
+//session manager对members、relays等字段直接做类型断言，格式不对的信令在解码时就拒掉
+func (s *Signal) validate() error {
+	if op, ok := s.Info["op"]; ok {
+		if _, ok := op.(string); !ok {
+			return errs.New(errs.Signal, "signal op is not a string")
+		}
+	}
+	if members, ok := s.Info["members"]; ok {
+		list, ok := members.([]interface{})
+		if !ok || len(list) > MaxSignalMembers {
+			return errs.New(errs.Signal, "signal members incorrect")
+		}
+		for _, m := range list {
+			n, ok := m.(json.Number)
+			if !ok {
+				return errs.New(errs.Signal, "signal member is not a number")
+			}
+			if _, err := n.Int64(); err != nil {
+				return errs.Mark(errs.Signal, err)
+			}
+		}
+	}
+	if sealed, ok := s.Info[InfoSealed]; ok {
+		if _, ok := sealed.(string); !ok {
+			return errs.New(errs.Signal, "signal sealed info is not a string")
+		}
+	}
+	if relays, ok := s.Info["relays"]; ok && relays != nil {
+		list, ok := relays.([]interface{})
+		if !ok || len(list) > MaxSignalRelays {
+			return errs.New(errs.Signal, "signal relays incorrect")
+		}
+		for _, r := range list {
+			if _, ok := r.(string); !ok {
+				return errs.New(errs.Signal, "signal relay is not a string")
+			}
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,466 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/xujiajundd/ycng/utils/errs"
+)
+
+/*
+信令的protobuf编码，schema见signal.proto。量不大，不值得为此引入protobuf的依赖和代码生成，直接按wire format手写。
+发送方确认对方有CapabilityProtoSignal时才用，payload为protobuf时消息带UdpMessageFlagProtoSignal。
+relay转发时如果接收方不支持，负责转回JSON。
+*/
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+
+	maxProtoDepth = 32 //Info里嵌套的map和list层数上限
+)
+
+var errProtoTruncated = errs.New(errs.Signal, "signal proto truncated")
+
+func (s *Signal) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendUintField(b, 1, uint64(s.Category))
+	b = appendUintField(b, 2, uint64(s.Signal))
+	b = appendUintField(b, 3, uint64(s.Timestamp))
+	b = appendUintField(b, 4, uint64(s.SessionId))
+	b = appendUintField(b, 5, uint64(s.From))
+	b = appendUintField(b, 6, uint64(s.To))
+	b = appendUintField(b, 7, uint64(s.Ttl))
+	if s.Uuid != "" {
+		b = appendBytesField(b, 8, []byte(s.Uuid))
+	}
+	var err error
+	if b, err = appendMapEntries(b, 9, s.Option); err != nil {
+		return nil, err
+	}
+	if b, err = appendMapEntries(b, 10, s.Info); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *Signal) UnmarshalProto(data []byte) error {
+	if len(data) > MaxSignalSize {
+		return errs.New(errs.TooLarge, "signal too large")
+	}
+	err := walkProto(data, func(field int, wt int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			s.Category = uint16(v)
+		case 2:
+			s.Signal = uint16(v)
+		case 3:
+			s.Timestamp = int64(v)
+		case 4:
+			s.SessionId = int64(v)
+		case 5:
+			s.From = int64(v)
+		case 6:
+			s.To = int64(v)
+		case 7:
+			s.Ttl = uint32(v)
+		case 8:
+			s.Uuid = string(data)
+		case 9, 10:
+			if wt != wireBytes {
+				return errs.New(errs.Signal, "signal proto bad map entry")
+			}
+			key, value, err := decodeMapEntry(data, 0)
+			if err != nil {
+				return err
+			}
+			if field == 9 {
+				if s.Option == nil {
+					s.Option = make(map[string]interface{})
+				}
+				s.Option[key] = value
+			} else {
+				if s.Info == nil {
+					s.Info = make(map[string]interface{})
+				}
+				s.Info[key] = value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.validate()
+}
+
+//按消息的flag选择JSON或protobuf解码
+func (s *Signal) UnmarshalMessage(msg *Message) error {
+	s.Device = DeviceFromMessage(msg)
+	if msg.HasFlag(UdpMessageFlagProtoSignal) {
+		return s.UnmarshalProto(msg.Payload)
+	}
+	return s.Unmarshal(msg.Payload)
+}
+
+//把信令消息的payload转成指定编码，已经是该编码时不做处理
+func TranscodeSignal(msg *Message, proto bool) error {
+	if msg.HasFlag(UdpMessageFlagGZip) || msg.HasFlag(UdpMessageFlagFragment) || msg.HasFlag(UdpMessageFlagProtoSignal) == proto {
+		return nil
+	}
+	signal := NewSignalTemp()
+	err := signal.UnmarshalMessage(msg)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	if proto {
+		payload, err = signal.MarshalProto()
+	} else {
+		payload, err = signal.Marshal()
+	}
+	if err != nil {
+		return err
+	}
+	msg.Payload = payload
+	if proto {
+		msg.SetFlag(UdpMessageFlagProtoSignal)
+	} else {
+		msg.UnSetFlag(UdpMessageFlagProtoSignal)
+	}
+	return nil
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, field int, wt int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wt))
+}
+
+//proto3的标量字段为0时不编码
+func appendUintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+//map<string, Value>在wire上是重复的entry消息{1: key, 2: value}，按key排序使编码结果确定
+func appendMapEntries(b []byte, field int, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value, err := encodeValue(m[k])
+		if err != nil {
+			return nil, err
+		}
+		var entry []byte
+		entry = appendBytesField(entry, 1, []byte(k))
+		entry = appendBytesField(entry, 2, value)
+		b = appendBytesField(b, field, entry)
+	}
+	return b, nil
+}
+
+//编码一个JSON值为Value消息。Info里也会直接放Go的结构（如map[int64]map[string]uint16），
+//规则与encoding/json一致：整数key转成字符串，[]byte转成base64字符串，其他类型先过一遍JSON
+func encodeValue(v interface{}) ([]byte, error) {
+	var b []byte
+	switch x := v.(type) {
+	case nil:
+		b = appendTag(b, 1, wireVarint)
+		return appendVarint(b, 1), nil
+	case bool:
+		b = appendTag(b, 5, wireVarint)
+		if x {
+			return appendVarint(b, 1), nil
+		}
+		return appendVarint(b, 0), nil
+	case string:
+		return appendBytesField(b, 4, []byte(x)), nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return encodeInt(i), nil
+		}
+		if f, err := x.Float64(); err == nil {
+			return encodeFloat(f), nil
+		}
+		return appendBytesField(b, 4, []byte(x)), nil
+	case map[string]interface{}:
+		m, err := appendMapEntries(nil, 1, x)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytesField(b, 6, m), nil
+	case []interface{}:
+		l, err := appendList(x)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytesField(b, 7, l), nil
+	case []byte:
+		return appendBytesField(b, 4, []byte(base64.StdEncoding.EncodeToString(x))), nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeInt(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() <= math.MaxInt64 {
+			return encodeInt(int64(rv.Uint())), nil
+		}
+		return encodeFloat(float64(rv.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return encodeFloat(rv.Float()), nil
+	case reflect.String:
+		return appendBytesField(b, 4, []byte(rv.String())), nil
+	case reflect.Bool:
+		return encodeValue(rv.Bool())
+	case reflect.Map:
+		if rv.IsNil() {
+			return encodeValue(nil)
+		}
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, err := mapKeyString(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			m[key] = iter.Value().Interface()
+		}
+		return encodeValue(m)
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return encodeValue(nil)
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = rv.Index(i).Interface()
+		}
+		return encodeValue(list)
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return encodeValue(nil)
+		}
+	}
+
+	//结构体等其他类型，按JSON的规则转成通用值
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return encodeValue(generic)
+}
+
+func encodeInt(i int64) []byte {
+	b := appendTag(nil, 2, wireVarint)
+	return appendVarint(b, uint64(i<<1)^uint64(i>>63)) //sint64用zigzag编码
+}
+
+func encodeFloat(f float64) []byte {
+	b := appendTag(nil, 3, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+}
+
+func appendList(list []interface{}) ([]byte, error) {
+	var b []byte
+	for _, item := range list {
+		value, err := encodeValue(item)
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytesField(b, 1, value)
+	}
+	return b, nil
+}
+
+func mapKeyString(key reflect.Value) (string, error) {
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	}
+	return "", errs.New(errs.Signal, "signal proto unsupported map key type " + key.Type().String())
+}
+
+func readVarint(data []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		v |= uint64(data[i]&0x7f) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errProtoTruncated
+}
+
+//逐个字段回调，varint和fixed字段的值在v中，length-delimited字段的内容在data中，不认识的字段由调用方忽略
+func walkProto(data []byte, fn func(field int, wt int, v uint64, data []byte) error) error {
+	p := 0
+	for p < len(data) {
+		tag, n, err := readVarint(data[p:])
+		if err != nil {
+			return err
+		}
+		p += n
+		field := int(tag >> 3)
+		wt := int(tag & 7)
+
+		var v uint64
+		var value []byte
+		switch wt {
+		case wireVarint:
+			v, n, err = readVarint(data[p:])
+			if err != nil {
+				return err
+			}
+			p += n
+		case wireFixed64:
+			if p+8 > len(data) {
+				return errProtoTruncated
+			}
+			v = binary.LittleEndian.Uint64(data[p : p+8])
+			p += 8
+		case wireFixed32:
+			if p+4 > len(data) {
+				return errProtoTruncated
+			}
+			v = uint64(binary.LittleEndian.Uint32(data[p : p+4]))
+			p += 4
+		case wireBytes:
+			l, n, err := readVarint(data[p:])
+			if err != nil {
+				return err
+			}
+			p += n
+			if l > uint64(len(data)-p) {
+				return errProtoTruncated
+			}
+			value = data[p : p+int(l)]
+			p += int(l)
+		default:
+			return errs.New(errs.Signal, "signal proto unsupported wire type " + strconv.Itoa(wt))
+		}
+
+		if err := fn(field, wt, v, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeMapEntry(data []byte, depth int) (key string, value interface{}, err error) {
+	err = walkProto(data, func(field int, wt int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			key = string(data)
+		case 2:
+			var err error
+			value, err = decodeValue(data, depth+1)
+			return err
+		}
+		return nil
+	})
+	return key, value, err
+}
+
+//解码为与json.Decoder.UseNumber()一致的类型：数字为json.Number，对象为map[string]interface{}，数组为[]interface{}
+func decodeValue(data []byte, depth int) (interface{}, error) {
+	if depth > maxProtoDepth {
+		return nil, errs.New(errs.Signal, "signal proto nested too deep")
+	}
+	var value interface{}
+	err := walkProto(data, func(field int, wt int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			value = nil
+		case 2:
+			i := int64(v>>1) ^ -int64(v&1)
+			value = json.Number(strconv.FormatInt(i, 10))
+		case 3:
+			value = json.Number(strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64))
+		case 4:
+			value = string(data)
+		case 5:
+			value = v != 0
+		case 6:
+			m := make(map[string]interface{})
+			err := walkProto(data, func(field int, wt int, v uint64, data []byte) error {
+				if field != 1 {
+					return nil
+				}
+				key, item, err := decodeMapEntry(data, depth)
+				if err != nil {
+					return err
+				}
+				m[key] = item
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			value = m
+		case 7:
+			list := make([]interface{}, 0)
+			err := walkProto(data, func(field int, wt int, v uint64, data []byte) error {
+				if field != 1 {
+					return nil
+				}
+				item, err := decodeValue(data, depth+1)
+				if err != nil {
+					return err
+				}
+				list = append(list, item)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			value = list
+		}
+		return nil
+	})
+	return value, err
+}
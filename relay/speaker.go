@@ -0,0 +1,102 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"time"
+)
+
+/*
+主讲人检测：
+客户端在音频包的extra里带一个audio level（UdpMessageExtraTypeAudioLevel，1字节，含义同RFC6464，
+0为最响，127为静音），relay按人做平滑，定期选出最响的人，有变化时通过session manager通知所有参与者，
+客户端据此切换主画面。
+*/
+
+const (
+	SpeakerReportInterval = 1 * time.Second
+	SpeakerSilentLevel    = 127
+	SpeakerSwitchMargin   = 6 //新人需比当前主讲人响这么多(dB)才切换，避免来回抖动
+	SpeakerActiveTimeout  = 1 * time.Second
+)
+
+// 在extra的TLV中找audio level
+func ParseAudioLevel(extra []byte) (level uint8, ok bool) {
+	value := FindExtra(extra, UdpMessageExtraTypeAudioLevel)
+	if len(value) < 1 {
+		return 0, false
+	}
+	return value[0] & 0x7f, true
+}
+
+type speakerLevel struct {
+	loudness   float64 //127-level的平滑值，越大越响
+	lastUpdate time.Time
+}
+
+type SpeakerDetector struct {
+	levels     map[int64]*speakerLevel
+	current    int64
+	hasCurrent bool
+	lastReport time.Time
+}
+
+func NewSpeakerDetector() *SpeakerDetector {
+	d := &SpeakerDetector{
+		levels: make(map[int64]*speakerLevel),
+	}
+	return d
+}
+
+func (d *SpeakerDetector) Update(uid int64, level uint8, now time.Time) {
+	l := d.levels[uid]
+	if l == nil {
+		l = &speakerLevel{}
+		d.levels[uid] = l
+	}
+	l.loudness = 0.7*l.loudness + 0.3*float64(SpeakerSilentLevel-int(level))
+	l.lastUpdate = now
+}
+
+func (d *SpeakerDetector) Remove(uid int64) {
+	delete(d.levels, uid)
+}
+
+// 到了上报周期且主讲人有变化时返回true
+func (d *SpeakerDetector) Check(now time.Time) (speaker int64, changed bool) {
+	if now.Sub(d.lastReport) < SpeakerReportInterval {
+		return 0, false
+	}
+	d.lastReport = now
+
+	var best int64
+	bestLoudness := 0.0
+	for uid, l := range d.levels {
+		if now.Sub(l.lastUpdate) > SpeakerActiveTimeout {
+			continue
+		}
+		if l.loudness > bestLoudness {
+			best = uid
+			bestLoudness = l.loudness
+		}
+	}
+	if bestLoudness == 0 || (d.hasCurrent && best == d.current) {
+		return 0, false
+	}
+
+	if d.hasCurrent {
+		cur := d.levels[d.current]
+		if cur != nil && now.Sub(cur.lastUpdate) <= SpeakerActiveTimeout && bestLoudness-cur.loudness < SpeakerSwitchMargin {
+			return 0, false
+		}
+	}
+
+	d.current = best
+	d.hasCurrent = true
+	return best, true
+}
@@ -0,0 +1,119 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"errors"
+	"time"
+)
+
+const adminTimeout = 5 * time.Second
+
+//relay的运行状态，速率为上一个ticker周期内的平均值
+type ServiceStatus struct {
+	Users         int                      `json:"users"`
+	Sessions      int                      `json:"sessions"`
+	Participants  int                      `json:"participants"`
+	RecvPps       float64                  `json:"recv_pps"`
+	SendPps       float64                  `json:"send_pps"`
+	RecvBandwidth int64                    `json:"recv_bps"`
+	SendBandwidth int64                    `json:"send_bps"`
+	SocketPackets []uint64                 `json:"socket_packets"`
+	Draining      bool                     `json:"draining"`
+	SendDropped   []uint64                 `json:"send_dropped"`   //各优先级发送队列满丢弃的包数：信令、音频、视频和数据
+	Oversized     uint64                   `json:"oversized"`      //超过max_datagram或路径MTU而丢弃的收发包数，见mtu.go
+	FastForwarded uint64                   `json:"fast_forwarded"` //直接复制收到的整包转发的包数，见forward.go
+	Tenants       map[uint16]*TenantStatus `json:"tenants"`        //租户 -> 用户和session数，见tenant.go
+	Errors        map[string]uint64        `json:"errors"`         //按类别的错误数，见errors.go
+}
+
+//收发计数，只在主循环中访问
+type trafficCounter struct {
+	recvPackets   uint64
+	recvBytes     uint64
+	sentPackets   uint64
+	sentBytes     uint64
+	oversized     uint64 //超过大小限制丢弃的收发包数
+	fastForwarded uint64 //快速转发的包数
+
+	lastAt    time.Time
+	lastCount trafficSample
+	rates     trafficSample //每秒
+}
+
+type trafficSample struct {
+	recvPackets float64
+	recvBytes   float64
+	sentPackets float64
+	sentBytes   float64
+}
+
+func (c *trafficCounter) snapshot() trafficSample {
+	return trafficSample{
+		recvPackets: float64(c.recvPackets),
+		recvBytes:   float64(c.recvBytes),
+		sentPackets: float64(c.sentPackets),
+		sentBytes:   float64(c.sentBytes),
+	}
+}
+
+func (c *trafficCounter) updateRates(now time.Time) {
+	current := c.snapshot()
+	if !c.lastAt.IsZero() {
+		seconds := now.Sub(c.lastAt).Seconds()
+		if seconds > 0 {
+			c.rates = trafficSample{
+				recvPackets: (current.recvPackets - c.lastCount.recvPackets) / seconds,
+				recvBytes:   (current.recvBytes - c.lastCount.recvBytes) / seconds,
+				sentPackets: (current.sentPackets - c.lastCount.sentPackets) / seconds,
+				sentBytes:   (current.sentBytes - c.lastCount.sentBytes) / seconds,
+			}
+		}
+	}
+	c.lastAt = now
+	c.lastCount = current
+}
+
+func (s *Service) Status() (*ServiceStatus, error) {
+	status := &ServiceStatus{}
+	err := s.runInLoop(func() {
+		status.Users = len(s.users)
+		status.Sessions = len(s.sessions)
+		status.Draining = s.draining
+		status.Oversized = s.traffic.oversized
+		status.FastForwarded = s.traffic.fastForwarded
+		status.Tenants = s.tenantStatus()
+		for _, session := range s.sessions {
+			status.Participants += len(session.Participants)
+		}
+		rates := s.traffic.rates
+		status.RecvPps = rates.recvPackets
+		status.SendPps = rates.sentPackets
+		status.RecvBandwidth = int64(rates.recvBytes * 8)
+		status.SendBandwidth = int64(rates.sentBytes * 8)
+	})
+	if err != nil {
+		return nil, err
+	}
+	status.SocketPackets = s.udp_server.PacketCounts()
+	status.SendDropped = s.udp_server.SendDropped()
+	status.Errors = s.ErrorCounts()
+	return status, nil
+}
+
+//在主循环里执行fn并等待完成，用于管理接口访问只属于主循环的状态
+func (s *Service) runInLoop(fn func()) error {
+	done := make(chan struct{})
+	select {
+	case s.adminCh <- func() { fn(); close(done) }:
+	case <-time.After(adminTimeout):
+		return errors.New("relay busy")
+	}
+	<-done
+	return nil
+}
@@ -7,10 +7,388 @@
 
 package relay
 
-type Storage struct {
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+可替换的存储，relay和session manager按部署选择，不需要改代码：
+  relay列表          session manager下发给客户端的relay
+  用户路由           uid -> 最近一次信令经过的relay，session manager重启或多实例时可以查到
+  黑名单             relay的ip/uid封禁
+  计费用量           每个计费周期里各uid和租户的通话秒数、转发字节，只做累加，见usage.go
+  推送token          uid -> 各设备注册的推送token，session manager呼叫离线用户时用，见session_manager/token.go
+三种实现，由store配置的url选择（见OpenStore）：
+  ""或memory://      进程内，重启即丢失，测试和单机开发用
+  file://dir         dir下的relays.json、user_relays.json、blocklist.json、usage.json、push_tokens.json，小规模单机部署用
+  redis://[:password@]host:port[/db]   多个relay和session manager共享，见storage_redis.go
+实现都自带锁，可以在任意goroutine里调用；但redis是网络调用，调用方应避免在热路径上频繁访问。
+*/
+
+type Store interface {
+	GetRelays() ([]string, error)
+	SetRelays(relays []string) error
+	GetUserRelay(uid int64) (string, error) //没有记录时返回""
+	SetUserRelay(uid int64, relay string) error
+	LoadBlocklist() (*BlocklistData, error) //没有记录时返回空的BlocklistData
+	SaveBlocklist(data *BlocklistData) error
+	AddUsage(period string, deltas map[string]*Usage) error //把增量累加到period的用量上，出错时deltas里只留下没写入的
+	GetUsage(period string, key string) (Usage, error)      //没有记录时返回零值
+	GetPushTokens(uid int64) ([]*PushToken, error)          //没有记录时返回nil
+	SetPushTokens(uid int64, tokens []*PushToken) error     //tokens为空时删除uid的记录
+	Close() error
+}
+
+type BlocklistData struct {
+	Ips  map[string]time.Time `json:"ips"`
+	Uids map[int64]time.Time  `json:"uids"`
+}
+
+type PushToken struct {
+	Token    string    `json:"token"`
+	Platform string    `json:"platform"`
+	Device   string    `json:"device,omitempty"`
+	Expires  time.Time `json:"expires"` //零值为不过期
+}
+
+var errStoreScheme = errors.New("unsupported store url, want memory://, file://dir or redis://host:port")
+
+func OpenStore(url string) (Store, error) {
+	switch {
+	case url == "" || url == "memory://":
+		return NewMemoryStore(), nil
+	case strings.HasPrefix(url, "file://"):
+		return NewFileStore(strings.TrimPrefix(url, "file://")), nil
+	case strings.HasPrefix(url, "redis://"):
+		return NewRedisStore(url)
+	}
+	return nil, errStoreScheme
+}
+
+//relay目前只用store存黑名单
+func openStore(config *Config) Store {
+	if config.Store == "" {
+		return NewBlocklistFileStore(config.BlocklistFile)
+	}
+	store, err := OpenStore(config.Store)
+	if err != nil {
+		logging.Logger.Error("open store ", config.Store, " error:", err, ", fallback to ", config.BlocklistFile)
+		return NewBlocklistFileStore(config.BlocklistFile)
+	}
+	return store
+}
+
+type MemoryStore struct {
+	lock       sync.RWMutex
+	relays     []string
+	userRelays map[int64]string
+	blocklist  *BlocklistData
+	usage      map[string]map[string]*Usage //周期 -> key -> 用量
+	pushTokens map[int64][]*PushToken
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		userRelays: make(map[int64]string),
+		blocklist:  &BlocklistData{},
+		usage:      make(map[string]map[string]*Usage),
+		pushTokens: make(map[int64][]*PushToken),
+	}
+}
+
+func (m *MemoryStore) GetRelays() ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return append([]string(nil), m.relays...), nil
+}
+
+func (m *MemoryStore) SetRelays(relays []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.relays = append([]string(nil), relays...)
+	return nil
+}
+
+func (m *MemoryStore) GetUserRelay(uid int64) (string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.userRelays[uid], nil
+}
+
+func (m *MemoryStore) SetUserRelay(uid int64, relay string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.userRelays[uid] = relay
+	return nil
+}
+
+func (m *MemoryStore) LoadBlocklist() (*BlocklistData, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return copyBlocklist(m.blocklist), nil
+}
+
+func (m *MemoryStore) SaveBlocklist(data *BlocklistData) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.blocklist = copyBlocklist(data)
+	return nil
+}
+
+func (m *MemoryStore) AddUsage(period string, deltas map[string]*Usage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	addUsage(m.usage, period, deltas)
+	return nil
+}
+
+func (m *MemoryStore) GetUsage(period string, key string) (Usage, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if u := m.usage[period][key]; u != nil {
+		return *u, nil
+	}
+	return Usage{}, nil
+}
+
+func addUsage(usage map[string]map[string]*Usage, period string, deltas map[string]*Usage) {
+	if usage[period] == nil {
+		usage[period] = make(map[string]*Usage)
+	}
+	for key, delta := range deltas {
+		u := usage[period][key]
+		if u == nil {
+			u = &Usage{}
+			usage[period][key] = u
+		}
+		u.Add(delta)
+	}
+}
+
+func (m *MemoryStore) GetPushTokens(uid int64) ([]*PushToken, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return copyPushTokens(m.pushTokens[uid]), nil
+}
+
+func (m *MemoryStore) SetPushTokens(uid int64, tokens []*PushToken) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(tokens) == 0 {
+		delete(m.pushTokens, uid)
+	} else {
+		m.pushTokens[uid] = copyPushTokens(tokens)
+	}
+	return nil
+}
+
+//调用方拿到的和存进来的都是副本，之后修改不影响存储
+func copyPushTokens(tokens []*PushToken) []*PushToken {
+	if len(tokens) == 0 {
+		return nil
+	}
+	c := make([]*PushToken, len(tokens))
+	for i, t := range tokens {
+		copied := *t
+		c[i] = &copied
+	}
+	return c
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func copyBlocklist(data *BlocklistData) *BlocklistData {
+	c := &BlocklistData{
+		Ips:  make(map[string]time.Time, len(data.Ips)),
+		Uids: make(map[int64]time.Time, len(data.Uids)),
+	}
+	for ip, until := range data.Ips {
+		c.Ips[ip] = until
+	}
+	for uid, until := range data.Uids {
+		c.Uids[uid] = until
+	}
+	return c
+}
+
+//每类数据一个json文件，路径为空的不持久化
+type FileStore struct {
+	lock          sync.Mutex
+	relaysFile    string
+	userFile      string
+	blocklistFile string
+	usageFile     string
+	tokensFile    string
+	userRelays    map[int64]string //用户路由在内存里也留一份，避免每次读文件
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{
+		relaysFile:    filepath.Join(dir, "relays.json"),
+		userFile:      filepath.Join(dir, "user_relays.json"),
+		blocklistFile: filepath.Join(dir, "blocklist.json"),
+		usageFile:     filepath.Join(dir, "usage.json"),
+		tokensFile:    filepath.Join(dir, "push_tokens.json"),
+	}
+}
+
+//只持久化黑名单，兼容原来单独配置的blocklist_file
+func NewBlocklistFileStore(path string) *FileStore {
+	return &FileStore{blocklistFile: path}
+}
+
+func (f *FileStore) GetRelays() ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var relays []string
+	err := readJsonFile(f.relaysFile, &relays)
+	return relays, err
+}
+
+func (f *FileStore) SetRelays(relays []string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return writeJsonFile(f.relaysFile, relays)
+}
+
+func (f *FileStore) GetUserRelay(uid int64) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.loadUserRelays(); err != nil {
+		return "", err
+	}
+	return f.userRelays[uid], nil
+}
+
+func (f *FileStore) SetUserRelay(uid int64, relay string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.loadUserRelays(); err != nil {
+		return err
+	}
+	if f.userRelays[uid] == relay {
+		return nil
+	}
+	f.userRelays[uid] = relay
+	return writeJsonFile(f.userFile, f.userRelays)
 }
 
-func NewStorage() *Storage {
+//调用方需持有锁
+func (f *FileStore) loadUserRelays() error {
+	if f.userRelays != nil {
+		return nil
+	}
+	userRelays := make(map[int64]string)
+	if err := readJsonFile(f.userFile, &userRelays); err != nil {
+		return err
+	}
+	f.userRelays = userRelays
 	return nil
-}
\ No newline at end of file
+}
+
+func (f *FileStore) LoadBlocklist() (*BlocklistData, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data := &BlocklistData{}
+	err := readJsonFile(f.blocklistFile, data)
+	return data, err
+}
+
+func (f *FileStore) SaveBlocklist(data *BlocklistData) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return writeJsonFile(f.blocklistFile, data)
+}
+
+func (f *FileStore) AddUsage(period string, deltas map[string]*Usage) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	usage := make(map[string]map[string]*Usage)
+	if err := readJsonFile(f.usageFile, &usage); err != nil {
+		return err
+	}
+	addUsage(usage, period, deltas)
+	return writeJsonFile(f.usageFile, usage)
+}
+
+func (f *FileStore) GetUsage(period string, key string) (Usage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	usage := make(map[string]map[string]*Usage)
+	if err := readJsonFile(f.usageFile, &usage); err != nil {
+		return Usage{}, err
+	}
+	if u := usage[period][key]; u != nil {
+		return *u, nil
+	}
+	return Usage{}, nil
+}
+
+func (f *FileStore) GetPushTokens(uid int64) ([]*PushToken, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	tokens := make(map[int64][]*PushToken)
+	err := readJsonFile(f.tokensFile, &tokens)
+	return tokens[uid], err
+}
+
+func (f *FileStore) SetPushTokens(uid int64, tokens []*PushToken) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	all := make(map[int64][]*PushToken)
+	if err := readJsonFile(f.tokensFile, &all); err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		delete(all, uid)
+	} else {
+		all[uid] = tokens
+	}
+	return writeJsonFile(f.tokensFile, all)
+}
+
+func (f *FileStore) Close() error {
+	return nil
+}
+
+//文件不存在不算错误，v保持原样
+func readJsonFile(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+//先写临时文件再rename，避免写一半时重启把数据弄丢
+func writeJsonFile(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
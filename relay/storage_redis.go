@@ -0,0 +1,335 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+redis存储，只用到几个命令，自己实现RESP协议，不引入客户端库：
+  ycng:relays        string  relay列表的json
+  ycng:user_relays   hash    uid -> relay地址
+  ycng:blocklist     string  黑名单的json
+  ycng:usage:周期    hash    key:seconds和key:bytes -> 累计值，用HINCRBY累加
+  ycng:push_tokens   hash    uid -> 推送token列表的json
+一个连接串行执行命令，出错即关闭，下次命令时重连。
+*/
+
+const (
+	RedisTimeout   = 500 * time.Millisecond
+	redisKeyPrefix = "ycng:"
+)
+
+var errRedisNil = errors.New("redis nil")
+
+type RedisStore struct {
+	addr     string
+	password string
+	db       int
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisStore(rawurl string) (*RedisStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, errStoreScheme
+	}
+	r := &RedisStore{addr: u.Host}
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("incorrect redis db %q", db)
+		}
+	}
+	return r, nil
+}
+
+func (r *RedisStore) GetRelays() ([]string, error) {
+	var relays []string
+	err := r.getJson(redisKeyPrefix+"relays", &relays)
+	return relays, err
+}
+
+func (r *RedisStore) SetRelays(relays []string) error {
+	return r.setJson(redisKeyPrefix+"relays", relays)
+}
+
+func (r *RedisStore) GetUserRelay(uid int64) (string, error) {
+	reply, err := r.do("HGET", redisKeyPrefix+"user_relays", strconv.FormatInt(uid, 10))
+	if err == errRedisNil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return reply.(string), nil
+}
+
+func (r *RedisStore) SetUserRelay(uid int64, relay string) error {
+	_, err := r.do("HSET", redisKeyPrefix+"user_relays", strconv.FormatInt(uid, 10), relay)
+	return err
+}
+
+func (r *RedisStore) LoadBlocklist() (*BlocklistData, error) {
+	data := &BlocklistData{}
+	err := r.getJson(redisKeyPrefix+"blocklist", data)
+	return data, err
+}
+
+func (r *RedisStore) SaveBlocklist(data *BlocklistData) error {
+	return r.setJson(redisKeyPrefix+"blocklist", data)
+}
+
+//中途出错时把已经写入的部分从deltas里去掉，重试时不会重复累加
+func (r *RedisStore) AddUsage(period string, deltas map[string]*Usage) error {
+	hash := redisKeyPrefix + "usage:" + period
+	var written []string
+	for key, delta := range deltas {
+		if delta.CallSeconds != 0 {
+			if _, err := r.do("HINCRBY", hash, key+":seconds", strconv.FormatInt(delta.CallSeconds, 10)); err != nil {
+				dropWrittenUsage(deltas, written)
+				return err
+			}
+			delta.CallSeconds = 0
+		}
+		if delta.RelayedBytes != 0 {
+			if _, err := r.do("HINCRBY", hash, key+":bytes", strconv.FormatInt(delta.RelayedBytes, 10)); err != nil {
+				dropWrittenUsage(deltas, written)
+				return err
+			}
+		}
+		written = append(written, key)
+	}
+	return nil
+}
+
+func dropWrittenUsage(deltas map[string]*Usage, written []string) {
+	for _, key := range written {
+		delete(deltas, key)
+	}
+}
+
+func (r *RedisStore) GetUsage(period string, key string) (Usage, error) {
+	var usage Usage
+	hash := redisKeyPrefix + "usage:" + period
+	for field, v := range map[string]*int64{key + ":seconds": &usage.CallSeconds, key + ":bytes": &usage.RelayedBytes} {
+		reply, err := r.do("HGET", hash, field)
+		if err == errRedisNil {
+			continue
+		}
+		if err != nil {
+			return usage, err
+		}
+		if *v, err = strconv.ParseInt(reply.(string), 10, 64); err != nil {
+			return usage, err
+		}
+	}
+	return usage, nil
+}
+
+func (r *RedisStore) GetPushTokens(uid int64) ([]*PushToken, error) {
+	reply, err := r.do("HGET", redisKeyPrefix+"push_tokens", strconv.FormatInt(uid, 10))
+	if err == errRedisNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*PushToken
+	err = json.Unmarshal([]byte(reply.(string)), &tokens)
+	return tokens, err
+}
+
+func (r *RedisStore) SetPushTokens(uid int64, tokens []*PushToken) error {
+	field := strconv.FormatInt(uid, 10)
+	if len(tokens) == 0 {
+		_, err := r.do("HDEL", redisKeyPrefix+"push_tokens", field)
+		return err
+	}
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	_, err = r.do("HSET", redisKeyPrefix+"push_tokens", field, string(data))
+	return err
+}
+
+func (r *RedisStore) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closeConn()
+	return nil
+}
+
+func (r *RedisStore) getJson(key string, v interface{}) error {
+	reply, err := r.do("GET", key)
+	if err == errRedisNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(reply.(string)), v)
+}
+
+func (r *RedisStore) setJson(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = r.do("SET", key, string(data))
+	return err
+}
+
+//执行一个命令，返回string、int64或[]interface{}，key不存在时返回errRedisNil
+func (r *RedisStore) do(args ...string) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.conn == nil {
+		if err := r.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.roundTrip(args)
+	if err != nil && err != errRedisNil {
+		if _, ok := err.(redisError); !ok {
+			r.closeConn() //网络或协议错误，连接状态未知
+		}
+	}
+	return reply, err
+}
+
+//调用方需持有锁
+func (r *RedisStore) connect() error {
+	conn, err := net.DialTimeout("tcp", r.addr, RedisTimeout)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+	if r.password != "" {
+		if _, err := r.roundTrip([]string{"AUTH", r.password}); err != nil {
+			r.closeConn()
+			return err
+		}
+	}
+	if r.db != 0 {
+		if _, err := r.roundTrip([]string{"SELECT", strconv.Itoa(r.db)}); err != nil {
+			r.closeConn()
+			return err
+		}
+	}
+	return nil
+}
+
+//调用方需持有锁
+func (r *RedisStore) closeConn() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+		r.reader = nil
+	}
+}
+
+//调用方需持有锁
+func (r *RedisStore) roundTrip(args []string) (interface{}, error) {
+	r.conn.SetDeadline(time.Now().Add(RedisTimeout))
+	if _, err := r.conn.Write(encodeRedisCommand(args)); err != nil {
+		return nil, err
+	}
+	return readRedisReply(r.reader)
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func encodeRedisCommand(args []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
+
+const maxRedisBulk = 16 << 20
+
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: incorrect reply line")
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		if n > maxRedisBulk {
+			return nil, errors.New("redis: bulk reply too large")
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := readRedisReply(reader)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
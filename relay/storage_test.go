@@ -0,0 +1,201 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, store Store) {
+	relays, err := store.GetRelays()
+	if err != nil || len(relays) != 0 {
+		t.Fatalf("empty store relays %v %v", relays, err)
+	}
+	if err = store.SetRelays([]string{"10.0.0.1:19001", "10.0.0.2:19001"}); err != nil {
+		t.Fatal(err)
+	}
+	relays, err = store.GetRelays()
+	if err != nil || len(relays) != 2 || relays[1] != "10.0.0.2:19001" {
+		t.Errorf("relays %v %v", relays, err)
+	}
+
+	if relay, err := store.GetUserRelay(1001); err != nil || relay != "" {
+		t.Errorf("unknown user relay %q %v", relay, err)
+	}
+	if err = store.SetUserRelay(1001, "10.0.0.1:19001"); err != nil {
+		t.Fatal(err)
+	}
+	if relay, err := store.GetUserRelay(1001); err != nil || relay != "10.0.0.1:19001" {
+		t.Errorf("user relay %q %v", relay, err)
+	}
+
+	now := time.Now()
+	b := NewBlocklist(store)
+	b.BlockIp("1.2.3.4", 0)
+	b.BlockUid(7, time.Hour)
+	data, err := store.LoadBlocklist()
+	if err != nil || !data.Ips["1.2.3.4"].IsZero() || data.Uids[7].Sub(now) < 59*time.Minute {
+		t.Errorf("blocklist %v %v", data, err)
+	}
+	if !NewBlocklist(store).IsUidBlocked(7, now) {
+		t.Error("blocklist not restored from store")
+	}
+
+	if u, err := store.GetUsage("201701", "uid:1001"); err != nil || u != (Usage{}) {
+		t.Errorf("empty usage %v %v", u, err)
+	}
+	for i := 0; i < 2; i++ {
+		err = store.AddUsage("201701", map[string]*Usage{"uid:1001": {CallSeconds: 60, RelayedBytes: 1000}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u, err := store.GetUsage("201701", "uid:1001"); err != nil || u.CallSeconds != 120 || u.RelayedBytes != 2000 {
+		t.Errorf("usage %v %v", u, err)
+	}
+	if u, _ := store.GetUsage("201702", "uid:1001"); u != (Usage{}) {
+		t.Errorf("usage of another period %v", u)
+	}
+
+	if tokens, err := store.GetPushTokens(1001); err != nil || len(tokens) != 0 {
+		t.Errorf("empty push tokens %v %v", tokens, err)
+	}
+	expires := now.Add(time.Hour).Truncate(time.Second)
+	tokens := []*PushToken{{Token: "a1", Platform: "ios", Device: "phone", Expires: expires}, {Token: "b2", Platform: "android"}}
+	if err = store.SetPushTokens(1001, tokens); err != nil {
+		t.Fatal(err)
+	}
+	tokens[0].Token = "changed"
+	got, err := store.GetPushTokens(1001)
+	if err != nil || len(got) != 2 || got[0].Token != "a1" || got[0].Device != "phone" || !got[0].Expires.Equal(expires) || got[1].Platform != "android" {
+		t.Errorf("push tokens %v %v", got, err)
+	}
+	if err = store.SetPushTokens(1001, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.GetPushTokens(1001); err != nil || len(got) != 0 {
+		t.Errorf("push tokens after delete %v %v", got, err)
+	}
+	store.Close()
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testStore(t, NewFileStore(dir))
+
+	//重新打开能读到之前写的
+	store, err := OpenStore("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay, _ := store.GetUserRelay(1001); relay != "10.0.0.1:19001" {
+		t.Errorf("user relay after reopen %q", relay)
+	}
+}
+
+//只实现RedisStore用到的命令
+func fakeRedis(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := make(map[string]string)
+	hashes := make(map[string]map[string]string)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			for {
+				reply, err := readRedisReply(reader)
+				if err != nil {
+					conn.Close()
+					break
+				}
+				var args []string
+				for _, item := range reply.([]interface{}) {
+					args = append(args, item.(string))
+				}
+				var resp string
+				switch args[0] {
+				case "SELECT":
+					resp = "+OK\r\n"
+				case "SET":
+					strs[args[1]] = args[2]
+					resp = "+OK\r\n"
+				case "GET":
+					resp = bulkString(strs, args[1])
+				case "HSET":
+					if hashes[args[1]] == nil {
+						hashes[args[1]] = make(map[string]string)
+					}
+					hashes[args[1]][args[2]] = args[3]
+					resp = ":1\r\n"
+				case "HGET":
+					resp = bulkString(hashes[args[1]], args[2])
+				case "HDEL":
+					delete(hashes[args[1]], args[2])
+					resp = ":1\r\n"
+				case "HINCRBY":
+					if hashes[args[1]] == nil {
+						hashes[args[1]] = make(map[string]string)
+					}
+					old, _ := strconv.ParseInt(hashes[args[1]][args[2]], 10, 64)
+					delta, _ := strconv.ParseInt(args[3], 10, 64)
+					hashes[args[1]][args[2]] = strconv.FormatInt(old+delta, 10)
+					resp = ":" + hashes[args[1]][args[2]] + "\r\n"
+				default:
+					resp = "-ERR unknown command\r\n"
+				}
+				conn.Write([]byte(resp))
+			}
+		}
+	}()
+	return l
+}
+
+func bulkString(m map[string]string, key string) string {
+	v, ok := m[key]
+	if !ok {
+		return "$-1\r\n"
+	}
+	return string(encodeRedisCommand([]string{v})[len("*1\r\n"):])
+}
+
+func TestRedisStore(t *testing.T) {
+	l := fakeRedis(t)
+	defer l.Close()
+	store, err := OpenStore("redis://" + l.Addr().String() + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+
+	if _, err := OpenStore("redis://host:6379/x"); err == nil {
+		t.Error("incorrect db accepted")
+	}
+	if _, err := OpenStore("mysql://host"); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+}
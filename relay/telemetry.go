@@ -0,0 +1,73 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+跨组件的trace上下文放在Message的extra里（UdpMessageExtraTypeTrace），
+每一跳发送时把自己的span id写进去，下一跳以此为parent，这样客户端->relay->session manager->relay->客户端
+可以串成一条trace。
+*/
+
+const traceContextSize = 16 + 8 + 1
+
+func TraceContextFromMessage(msg *Message) (trace.SpanContext, bool) {
+	if !msg.HasFlag(UdpMessageFlagExtra) {
+		return trace.SpanContext{}, false
+	}
+	value := FindExtra(msg.Extra, UdpMessageExtraTypeTrace)
+	if len(value) != traceContextSize {
+		return trace.SpanContext{}, false
+	}
+	var traceId trace.TraceID
+	var spanId trace.SpanID
+	copy(traceId[:], value[0:16])
+	copy(spanId[:], value[16:24])
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: trace.TraceFlags(value[24]),
+		Remote:     true,
+	})
+	return sc, sc.IsValid()
+}
+
+//ctx中没有有效span时不做任何修改
+func InjectTraceContext(ctx context.Context, msg *Message) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	value := make([]byte, traceContextSize)
+	traceId := sc.TraceID()
+	spanId := sc.SpanID()
+	copy(value[0:16], traceId[:])
+	copy(value[16:24], spanId[:])
+	value[24] = byte(sc.TraceFlags())
+
+	var extra []byte
+	if msg.HasFlag(UdpMessageFlagExtra) {
+		extra = msg.Extra
+	}
+	msg.Extra = ReplaceExtra(extra, UdpMessageExtraTypeTrace, value)
+	msg.SetFlag(UdpMessageFlagExtra)
+}
+
+//有上游trace上下文时返回以它为parent的ctx，否则ok为false
+func ContextFromMessage(msg *Message) (ctx context.Context, ok bool) {
+	sc, ok := TraceContextFromMessage(msg)
+	if !ok {
+		return context.Background(), false
+	}
+	return trace.ContextWithRemoteSpanContext(context.Background(), sc), true
+}
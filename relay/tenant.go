@@ -0,0 +1,85 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+多租户：一套relay和session manager服务多个应用，各应用的uid空间互相隔离。
+1. 租户id放在uid和sid的第48~61位，低48位是应用自己的uid或随机sid；第62位是访客，第63位（负数）是系统id如session manager
+2. 租户0就是原来的单应用部署，原有uid都小于2^48，不需要任何改动
+3. 客户端注册时用带租户的uid，账号后台签发的access token绑定的也是这个uid，所以不能冒用其他租户的uid
+4. session manager生成sid时带上请求方的租户，见TenantId
+5. relay丢弃跨租户的包：用户发给其他租户的用户，或者发给其他租户的session；系统id不受限制
+每个租户的通话数上限和可用relay在session manager上配置，见session_manager/tenant.go。
+*/
+
+const (
+	TenantShift = 48
+	TenantBits  = 14
+	MaxTenant   = 1<<TenantBits - 1
+
+	tenantLocalMask = int64(1)<<TenantShift - 1
+)
+
+//uid或sid所属的租户，系统id（负数）返回0
+func TenantOf(id int64) uint16 {
+	if id < 0 {
+		return 0
+	}
+	return uint16(id >> TenantShift & MaxTenant)
+}
+
+//把应用内的uid或随机数放进租户的空间，只保留低48位
+func TenantId(tenant uint16, local int64) int64 {
+	return int64(tenant&MaxTenant)<<TenantShift | local&tenantLocalMask
+}
+
+//跨租户的包，只检查用户发出的、目标是uid或sid的包
+func crossesTenant(msg *Message) bool {
+	if msg.From <= 0 || msg.To <= 0 {
+		return false
+	}
+	if TenantOf(msg.From) == TenantOf(msg.To) {
+		return false
+	}
+	logging.Logger.Warn("drop message ", msg.MsgType, " from ", msg.From, " of tenant ", TenantOf(msg.From), " to ", msg.To, " of tenant ", TenantOf(msg.To))
+	return true
+}
+
+type TenantStatus struct {
+	Users        int `json:"users"`
+	Sessions     int `json:"sessions"`
+	Participants int `json:"participants"`
+}
+
+//各租户的用户和session数，只在主循环里调用
+func (s *Service) tenantStatus() map[uint16]*TenantStatus {
+	tenants := make(map[uint16]*TenantStatus)
+	of := func(id int64) *TenantStatus {
+		t := tenants[TenantOf(id)]
+		if t == nil {
+			t = &TenantStatus{}
+			tenants[TenantOf(id)] = t
+		}
+		return t
+	}
+	for uid := range s.users {
+		if uid > 0 {
+			of(uid).Users++
+		}
+	}
+	for sid, session := range s.sessions {
+		t := of(sid)
+		t.Sessions++
+		t.Participants += len(session.Participants)
+	}
+	return tenants
+}
@@ -0,0 +1,62 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"testing"
+)
+
+func TestTenantId(t *testing.T) {
+	uid := TenantId(7, 1001)
+	if TenantOf(uid) != 7 || uid&(1<<TenantShift-1) != 1001 {
+		t.Errorf("tenant id %x", uid)
+	}
+	if TenantOf(1001) != 0 || TenantOf(SessionManagerUid) != 0 {
+		t.Error("default and system ids not in tenant 0")
+	}
+	if TenantOf(1<<62|TenantId(MaxTenant, 5)) != MaxTenant {
+		t.Error("guest bit leaked into tenant")
+	}
+	//随机sid超出低48位的部分被丢弃
+	if sid := TenantId(3, 1<<62|1<<50|9); TenantOf(sid) != 3 || sid&(1<<TenantShift-1) != 9 {
+		t.Errorf("random sid %x", sid)
+	}
+}
+
+func TestCrossTenantMessages(t *testing.T) {
+	alice := TenantId(1, 1001)
+	bob := TenantId(2, 1001)
+	tests := []struct {
+		name  string
+		msg   *Message
+		cross bool
+	}{
+		{"same tenant signal", NewMessage(UdpMessageTypeUserSignal, alice, TenantId(1, 1002), 0, nil, nil), false},
+		{"cross tenant signal", NewMessage(UdpMessageTypeUserSignal, alice, bob, 0, nil, nil), true},
+		{"cross tenant session", NewMessage(UdpMessageTypeAudioStream, alice, TenantId(2, 42), 0, nil, nil), true},
+		{"to session manager", NewMessage(UdpMessageTypeUserSignal, alice, SessionManagerUid, 0, nil, nil), false},
+		{"from session manager", NewMessage(UdpMessageTypeUserSignal, SessionManagerUid, bob, 0, nil, nil), false},
+		{"user reg", NewMessage(UdpMessageTypeUserReg, bob, 0, 0, nil, nil), false},
+	}
+	for _, tt := range tests {
+		if cross := crossesTenant(tt.msg); cross != tt.cross {
+			t.Errorf("%s: crossesTenant = %v", tt.name, cross)
+		}
+	}
+}
+
+func TestTenantStatus(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	s.users[1001] = NewUser(1001)
+	s.users[TenantId(2, 1001)] = NewUser(TenantId(2, 1001))
+	s.sessions[TenantId(2, 42)] = NewSession(TenantId(2, 42))
+	tenants := s.tenantStatus()
+	if tenants[0].Users != 1 || tenants[2].Users != 1 || tenants[2].Sessions != 1 || tenants[0].Sessions != 0 {
+		t.Errorf("tenant status %+v %+v", tenants[0], tenants[2])
+	}
+}
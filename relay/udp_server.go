@@ -8,82 +8,178 @@
 package relay
 
 import (
+	"fmt"
 	"net"
+	"sync/atomic"
 
 	"time"
+	"github.com/xujiajundd/ycng/utils"
 	"github.com/xujiajundd/ycng/utils/logging"
 )
 
 type UdpServer struct {
 	saddr        string
-	conn         *net.UDPConn
+	conn         *net.UDPConn   //发送用，即conns[0]
+	conns        []*net.UDPConn //SO_REUSEPORT下的多个接收socket，由内核按四元组分流到各个核
+	received     []uint64       //每个socket收到的包数，原子操作
+	numSockets   int
+	offload      bool //见gso_linux.go
+	gro          []bool
 	subscriberCh chan *ReceivedPacket
+	sendQueue    *SendQueue //见sendqueue.go
+	stopSend     chan struct{}
+	watchdog     *utils.Watchdog //由Service设置，nil为不检查
 }
 
 func NewUdpServer(config *Config, subscriber chan *ReceivedPacket) *UdpServer {
 	server := &UdpServer{
 		saddr:        config.UdpAddr,
+		numSockets:   config.UdpSockets,
+		offload:      config.UdpOffload,
 		subscriberCh: subscriber,
+		sendQueue:    NewSendQueue(SendQueueSize),
+		stopSend:     make(chan struct{}),
+	}
+	if server.numSockets < 1 {
+		server.numSockets = 1
 	}
 
 	return server
 }
 
 func (u *UdpServer) Start() {
-	addr, err := net.ResolveUDPAddr("udp4", u.saddr)
-	if err != nil {
-		logging.Logger.Error("error ResolveUDPAddr")
+	if u.numSockets > 1 {
+		for i := 0; i < u.numSockets; i++ {
+			conn, err := listenUdpReusePort(u.saddr)
+			if err != nil {
+				logging.Logger.Error("error listen with SO_REUSEPORT:", err, ", fallback to single socket")
+				for _, c := range u.conns {
+					c.Close()
+				}
+				u.conns = nil
+				break
+			}
+			u.conns = append(u.conns, conn)
+		}
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		logging.Logger.Error("error ListenUDP")
+	if len(u.conns) == 0 {
+		addr, err := net.ResolveUDPAddr("udp4", u.saddr)
+		if err != nil {
+			logging.Logger.Error("error ResolveUDPAddr")
+		}
+
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			logging.Logger.Error("error ListenUDP")
+		}
+		u.conns = []*net.UDPConn{conn}
+	}
+	logging.Logger.Info("listen on port:", u.saddr, " with ", len(u.conns), " sockets")
+
+	u.conn = u.conns[0]
+	u.received = make([]uint64, len(u.conns))
+	u.gro = make([]bool, len(u.conns))
+	for i, conn := range u.conns {
+		u.gro[i] = enableGro(conn, u.offload)
 	}
-	logging.Logger.Info("listen on port:", u.saddr)
+	logging.Logger.Info("udp offload:", u.offload, " gro:", u.gro[0])
 
-	u.conn = conn
+	for i, conn := range u.conns {
+		go u.handleClient(i, conn, u.watchdog.Watch(fmt.Sprintf("relay udp socket %d", i)))
+	}
+	go u.sendQueue.run(newBatchWriter(u.conn, u.offload), u.stopSend)
+}
 
-	go u.handleClient()
+//各socket的收包数，用于确认内核分流是否均衡
+func (u *UdpServer) PacketCounts() []uint64 {
+	counts := make([]uint64, len(u.received))
+	for i := range u.received {
+		counts[i] = atomic.LoadUint64(&u.received[i])
+	}
+	return counts
 }
 
-func (u *UdpServer) handleClient() {
+//beat在收到包到交给Service之间为busy，Service处理不过来时会卡在这里
+func (u *UdpServer) handleClient(index int, conn *net.UDPConn, beat *utils.Heartbeat) {
 	var buf [65536]byte
+	var oob [64]byte
+	gro := u.gro[index]
 
 	for {
-		size, addr, err := u.conn.ReadFromUDP(buf[0:])
+		beat.Idle()
+		size, oobn, _, addr, err := conn.ReadMsgUDP(buf[0:], oob[0:])
+		beat.Busy()
 		if err != nil {
 			logging.Logger.Error("error ReadFromUDP ", err)
 			continue
 		}
 
-		if size <= 2 {
-			logging.Logger.Error("error udp packet with size <= 2")
-			continue
+		segmentSize := 0
+		if gro {
+			segmentSize = groSegmentSize(oob[0:oobn])
 		}
-
-		data := make([]byte, size)
-		copy(data, buf[0:size])
-		packet := &ReceivedPacket{
-			Body:        data,
-			FromUdpAddr: addr,
-			Time:        time.Now().UnixNano(),
+		now := time.Now().UnixNano()
+		for _, segment := range splitSegments(buf[0:size], segmentSize) {
+			if len(segment) <= 2 {
+				logging.Logger.Error("error udp packet with size <= 2")
+				continue
+			}
+			atomic.AddUint64(&u.received[index], 1)
+
+			data := utils.GetPacketBuffer(len(segment)) //由Service处理完后归还
+			copy(data, segment)
+			packet := &ReceivedPacket{
+				Body:        data,
+				FromUdpAddr: addr,
+				Time:        now,
+			}
+			//go func() { //模拟一下延迟
+			//	time.Sleep(200 * time.Millisecond)
+			//	u.subscriberCh <- packet
+			//}()
+
+			u.subscriberCh <- packet
 		}
-		//go func() { //模拟一下延迟
-		//	time.Sleep(200 * time.Millisecond)
-		//	u.subscriberCh <- packet
-		//}()
+	}
+}
 
-		u.subscriberCh <- packet
+//GRO合并的包按段大小拆开，size为0时data为一个包
+func splitSegments(data []byte, size int) [][]byte {
+	if size <= 0 || size >= len(data) {
+		return [][]byte{data}
+	}
+	segments := make([][]byte, 0, (len(data)+size-1)/size)
+	for len(data) > size {
+		segments = append(segments, data[:size])
+		data = data[size:]
 	}
+	return append(segments, data)
 }
 
+//按优先级排队发送，取得buf的所有权，data为buf中要发的部分
+func (u *UdpServer) Send(buf []byte, data []byte, addr *net.UDPAddr, priority int) {
+	u.sendQueue.Push(buf, data, addr, priority)
+}
+
+//发送不属于缓冲池的包，复制一份后按信令优先级发送
 func (u *UdpServer) SendPacket(packet []byte, addr *net.UDPAddr) {
-	//TODO: 这个线程安全么？
-	u.conn.WriteToUDP(packet, addr)
+	buf := utils.GetPacketBuffer(len(packet))
+	copy(buf, packet)
+	u.Send(buf, buf, addr, SendPrioritySignal)
+}
+
+//各优先级发送队列满而丢弃的包数
+func (u *UdpServer) SendDropped() []uint64 {
+	return u.sendQueue.Dropped()
 }
 
 func (u *UdpServer) Stop() {
-	u.conn.Close()
+	close(u.stopSend)
+	for _, conn := range u.conns {
+		conn.Close()
+	}
+	u.conns = nil
 	u.conn = nil
 	u.saddr = ""
 	u.subscriberCh = nil
@@ -0,0 +1,159 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+计费用量：按计费周期（自然月，UTC）统计每个uid和每个租户的通话时长和relay转发的字节数。
+1. relay按发送方uid累计转发的媒体字节，session manager在session结束时按CDR累计每个参与者的通话秒数
+2. 先在内存里聚合，每UsageFlushPeriod把增量累加到store，多个relay和session manager的增量在store里汇总；
+   没有配置store时relay的用量不保存，session manager只在内存里保留
+3. 写store失败时增量放回内存，下次一起写；增量按flush时的周期入账，跨月时最多有一个flush周期的误差
+4. session manager在flush时另外发usage事件，见session_manager/quota.go
+*/
+
+const UsageFlushPeriod = time.Minute
+
+type Usage struct {
+	CallSeconds  int64 `json:"call_seconds"`
+	RelayedBytes int64 `json:"relayed_bytes"`
+}
+
+func (u *Usage) Add(o *Usage) {
+	u.CallSeconds += o.CallSeconds
+	u.RelayedBytes += o.RelayedBytes
+}
+
+//t所在的计费周期
+func UsagePeriod(t time.Time) string {
+	return t.UTC().Format("200601")
+}
+
+func UserUsageKey(uid int64) string {
+	return fmt.Sprintf("uid:%d", uid)
+}
+
+func TenantUsageKey(tenant uint16) string {
+	return fmt.Sprintf("tenant:%d", tenant)
+}
+
+//可以在任意goroutine里调用
+type UsageAggregator struct {
+	store   Store //为nil时flush只返回增量
+	lock    sync.Mutex
+	pending map[string]*Usage
+}
+
+func NewUsageAggregator(store Store) *UsageAggregator {
+	return &UsageAggregator{
+		store:   store,
+		pending: make(map[string]*Usage),
+	}
+}
+
+//同时累计到uid和它所在的租户
+func (a *UsageAggregator) Add(uid int64, usage Usage) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.add(UserUsageKey(uid), &usage)
+	a.add(TenantUsageKey(TenantOf(uid)), &usage)
+}
+
+//调用方需持有锁
+func (a *UsageAggregator) add(key string, usage *Usage) {
+	u := a.pending[key]
+	if u == nil {
+		u = &Usage{}
+		a.pending[key] = u
+	}
+	u.Add(usage)
+}
+
+//还没有flush的部分
+func (a *UsageAggregator) Pending(key string) Usage {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if u := a.pending[key]; u != nil {
+		return *u
+	}
+	return Usage{}
+}
+
+//把增量写入store，返回写入的周期和增量，没有增量时返回nil
+func (a *UsageAggregator) Flush(now time.Time) (string, map[string]*Usage) {
+	a.lock.Lock()
+	deltas := a.pending
+	a.pending = make(map[string]*Usage)
+	a.lock.Unlock()
+
+	if len(deltas) == 0 {
+		return "", nil
+	}
+	period := UsagePeriod(now)
+	if a.store != nil {
+		//store出错时可能去掉已写入的部分，交给store的是副本
+		unwritten := make(map[string]*Usage, len(deltas))
+		for key, u := range deltas {
+			c := *u
+			unwritten[key] = &c
+		}
+		if err := a.store.AddUsage(period, unwritten); err != nil {
+			logging.Logger.Warn("usage flush error:", err, ", keep ", len(unwritten), " entries for next flush")
+			a.lock.Lock()
+			for key, u := range unwritten {
+				a.add(key, u)
+			}
+			a.lock.Unlock()
+			return "", nil
+		}
+	}
+	return period, deltas
+}
+
+//本周期已入账的，没有store时为零值
+func (a *UsageAggregator) Stored(now time.Time, key string) (Usage, error) {
+	if a.store == nil {
+		return Usage{}, nil
+	}
+	return a.store.GetUsage(UsagePeriod(now), key)
+}
+
+//本周期已入账的加上还没有flush的
+func (a *UsageAggregator) Total(now time.Time, key string) (Usage, error) {
+	total, err := a.Stored(now, key)
+	if err != nil {
+		return total, err
+	}
+	pending := a.Pending(key)
+	total.Add(&pending)
+	return total, nil
+}
+
+//relay按发送方累计转发的媒体字节，只在主循环里调用
+func (s *Service) countRelayedBytes(msg *Message, packet *ReceivedPacket) {
+	if msg.From <= 0 || !isHoldableMessage(msg.MsgType) {
+		return
+	}
+	s.relayedBytes[msg.From] += int64(len(packet.Body))
+}
+
+//把主循环里累计的字节交给聚合器，在goroutine里写store，避免卡住主循环
+func (s *Service) flushUsage(now time.Time) {
+	for uid, bytes := range s.relayedBytes {
+		s.usage.Add(uid, Usage{RelayedBytes: bytes})
+	}
+	s.relayedBytes = make(map[int64]int64)
+	go s.usage.Flush(now)
+}
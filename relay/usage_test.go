@@ -0,0 +1,67 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type failingUsageStore struct {
+	*MemoryStore
+	fail bool
+}
+
+func (f *failingUsageStore) AddUsage(period string, deltas map[string]*Usage) error {
+	if f.fail {
+		return errors.New("store down")
+	}
+	return f.MemoryStore.AddUsage(period, deltas)
+}
+
+func TestUsageAggregator(t *testing.T) {
+	store := &failingUsageStore{MemoryStore: NewMemoryStore()}
+	a := NewUsageAggregator(store)
+	now := time.Date(2017, 3, 31, 23, 0, 0, 0, time.UTC)
+	uid := TenantId(5, 1001)
+
+	a.Add(uid, Usage{CallSeconds: 30})
+	a.Add(uid, Usage{RelayedBytes: 500})
+	a.Add(TenantId(5, 1002), Usage{CallSeconds: 10})
+	if u := a.Pending(TenantUsageKey(5)); u.CallSeconds != 40 || u.RelayedBytes != 500 {
+		t.Errorf("tenant pending %v", u)
+	}
+
+	//store出错时增量留到下次
+	store.fail = true
+	if period, deltas := a.Flush(now); deltas != nil {
+		t.Errorf("flush succeeded with failing store %s %v", period, deltas)
+	}
+	if u := a.Pending(UserUsageKey(uid)); u.CallSeconds != 30 {
+		t.Errorf("pending after failed flush %v", u)
+	}
+
+	store.fail = false
+	period, deltas := a.Flush(now)
+	if period != "201703" || deltas[UserUsageKey(uid)].RelayedBytes != 500 {
+		t.Errorf("flush %s %v", period, deltas)
+	}
+	if u := a.Pending(UserUsageKey(uid)); u != (Usage{}) {
+		t.Errorf("pending after flush %v", u)
+	}
+
+	a.Add(uid, Usage{CallSeconds: 5})
+	if total, err := a.Total(now, UserUsageKey(uid)); err != nil || total.CallSeconds != 35 || total.RelayedBytes != 500 {
+		t.Errorf("total %v %v", total, err)
+	}
+	//下个周期重新计
+	if total, _ := a.Total(now.Add(2*time.Hour), UserUsageKey(uid)); total.CallSeconds != 5 {
+		t.Errorf("total of next period %v", total)
+	}
+}
@@ -14,13 +14,15 @@ import (
 
 type User struct {
 	Uid                int64
-	UdpAddr           *net.UDPAddr
+	UdpAddr           *net.UDPAddr       //最近活跃的设备的地址
 	LastActiveTime     time.Time
+	Devices            map[string]*Device //同一uid登录的多个设备，见devices.go
 }
 
 func NewUser(id int64) *User {
 	user := &User{
-		Uid: id,
+		Uid:     id,
+		Devices: make(map[string]*Device),
 	}
 
 	return user
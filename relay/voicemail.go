@@ -0,0 +1,87 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+语音信箱：1-1呼叫被拒接或无应答时，session manager让主叫留言，relay把主叫的音频录下来。
+1. session manager发UdpMessageTypeRecordControl，payload为RecordControlVoicemail(1)+主叫uid(8)+最长秒数(2)，
+   relay此后只把这个uid发到该session的音频包tee给Recorder，超过时长的不再录，最长VoicemailMaxDuration
+2. session manager发RecordControlStop或teardown时结束录制，录到过音频时回UdpMessageTypeVoicemailDone，
+   payload为uid(8)+留言时长毫秒(4)+文件位置(Recorder.Location)，没录到的不回
+*/
+
+const VoicemailMaxDuration = 5 * time.Minute
+
+type Voicemail struct {
+	Uid   int64
+	Until time.Time
+	First int64 //第一个和最后一个录下的包的接收时间，unix纳秒
+	Last  int64
+}
+
+func (s *Service) startVoicemail(session *Session, payload []byte, now time.Time) {
+	if len(payload) != 10 {
+		s.log().Warn("incorrect voicemail control for session ", session.Id)
+		return
+	}
+	duration := time.Duration(binary.BigEndian.Uint16(payload[8:10])) * time.Second
+	if duration > VoicemailMaxDuration {
+		duration = VoicemailMaxDuration
+	}
+	s.finishVoicemail(session)
+	session.Voicemail = &Voicemail{
+		Uid:   int64(binary.BigEndian.Uint64(payload[0:8])),
+		Until: now.Add(duration),
+	}
+	s.log().Info("voicemail of ", session.Voicemail.Uid, " in session ", session.Id, " for ", duration)
+}
+
+//是否要录下这个包
+func (v *Voicemail) records(msg *Message, packetTime int64) bool {
+	if v == nil || msg.From != v.Uid || msg.MsgType != UdpMessageTypeAudioStream || time.Unix(0, packetTime).After(v.Until) {
+		return false
+	}
+	if v.First == 0 {
+		v.First = packetTime
+	}
+	v.Last = packetTime
+	return true
+}
+
+func (s *Service) finishVoicemail(session *Session) {
+	v := session.Voicemail
+	if v == nil {
+		return
+	}
+	session.Voicemail = nil
+	s.recorder.Close(session.Id)
+	if v.First == 0 {
+		s.log().Info("voicemail of ", v.Uid, " in session ", session.Id, " recorded nothing")
+		return
+	}
+
+	location := s.recorder.Location(session.Id, v.Uid)
+	payload := make([]byte, 12, 12+len(location))
+	binary.BigEndian.PutUint64(payload[0:8], uint64(v.Uid))
+	binary.BigEndian.PutUint32(payload[8:12], uint32((v.Last-v.First)/int64(time.Millisecond)))
+	payload = append(payload, location...)
+	s.log().Info("voicemail of ", v.Uid, " in session ", session.Id, " recorded to ", location)
+
+	user := s.users[SessionManagerUid]
+	if user == nil || user.UdpAddr == nil {
+		s.log().Warn("no session manager to report voicemail of session ", session.Id)
+		return
+	}
+	msg := NewMessage(UdpMessageTypeVoicemailDone, SessionManagerUid, session.Id, 0, payload, nil)
+	s.sendMessage(msg, user.UdpAddr)
+}
@@ -0,0 +1,77 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package relay
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+type memRecorder struct {
+	closed int
+}
+
+func (r *memRecorder) Record(sid int64, uid int64, msgType uint8, payload []byte, timestamp int64) {
+}
+
+func (r *memRecorder) Close(sid int64) {
+	r.closed++
+}
+
+func (r *memRecorder) Location(sid int64, uid int64) string {
+	return "mem"
+}
+
+func TestVoicemail(t *testing.T) {
+	s := NewService(GetDefaultConfig())
+	recorder := &memRecorder{}
+	s.recorder = recorder
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20001}
+	const sid, caller, callee = int64(42), int64(1001), int64(1002)
+	now := time.Now()
+
+	payload := make([]byte, 11)
+	payload[0] = RecordControlVoicemail
+	binary.BigEndian.PutUint64(payload[1:9], uint64(caller))
+	binary.BigEndian.PutUint16(payload[9:11], 2)
+	control := NewMessage(UdpMessageTypeRecordControl, SessionManagerUid, sid, 0, payload, nil)
+	s.handleMessageRecordControl(control, &ReceivedPacket{FromUdpAddr: addr, Time: now.UnixNano()})
+	session := s.sessions[sid]
+	if session == nil || session.Voicemail == nil || session.Voicemail.Uid != caller {
+		t.Fatal("voicemail not started")
+	}
+
+	for _, c := range []struct {
+		from    int64
+		msgType uint8
+		after   time.Duration
+		records bool
+	}{
+		{caller, UdpMessageTypeAudioStream, 0, true},
+		{caller, UdpMessageTypeAudioStream, time.Second, true},
+		{callee, UdpMessageTypeAudioStream, time.Second, false},
+		{caller, UdpMessageTypeVideoStream, time.Second, false},
+		{caller, UdpMessageTypeAudioStream, 3 * time.Second, false}, //超过时长
+	} {
+		msg := NewMessage(c.msgType, c.from, sid, 0, make([]byte, 12), nil)
+		if got := session.Voicemail.records(msg, now.Add(c.after).UnixNano()); got != c.records {
+			t.Errorf("records(%d, type %d, +%v) = %v", c.from, c.msgType, c.after, got)
+		}
+	}
+	if session.Voicemail.Last-session.Voicemail.First != int64(time.Second) {
+		t.Errorf("voicemail duration %v", time.Duration(session.Voicemail.Last-session.Voicemail.First))
+	}
+
+	stop := NewMessage(UdpMessageTypeRecordControl, SessionManagerUid, sid, 0, []byte{RecordControlStop}, nil)
+	s.handleMessageRecordControl(stop, &ReceivedPacket{FromUdpAddr: addr, Time: now.UnixNano()})
+	if session.Voicemail != nil || recorder.closed != 1 {
+		t.Errorf("voicemail not finished, closed %d", recorder.closed)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+relay的access token：首次登录的token由账号后台签发，之后客户端在过期前通过session manager续期。
+能把信令送到这里，说明该用户已经用有效token在relay上注册过了。
+*/
+
+//设置与relay共享的secret，需在Start之前调用
+func (sm *SessionManager) SetAccessSecret(secret string) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.accessSecret = secret
+}
+
+func (sm *SessionManager) handleAccessTokenRequest(signal *Signal) {
+	if sm.accessSecret == "" {
+		sm.log().Warn("access token requested by ", signal.From, " but access control is disabled")
+		return
+	}
+
+	expire := time.Now().Add(relay.AccessTokenTTL)
+	token := relay.IssueAccessToken(sm.accessSecret, signal.From, expire)
+
+	reply := NewSignal(YCKCallSignalTypeAccessToken, SessionManagerUserId, signal.From, 0)
+	reply.Info = make(map[string]interface{})
+	reply.Info["token"] = base64.StdEncoding.EncodeToString(token)
+	reply.Info["expire"] = expire.Unix()
+	sm.sendSignal(reply, false)
+	sm.log().Info("access token issued for user:", signal.From)
+}
@@ -0,0 +1,491 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xujiajundd/ycng/loadtest"
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+session manager的管理接口，只应监听在内网或本机地址上。config.AdminAddr为空时不启动。
+  GET  /sessions                当前所有session，参与者带relay最近上报的通话质量（见quality.go）
+  POST /sessions/kill?sid=x     强制结束session，可带note记入审计日志，见terminate.go
+  GET  /relays                  各relay最近一次确认注册的时间
+  POST /guests?sid=x            为session生成访客临时uid和access token，见guest.go
+  GET  /inbox                   收包队列长度和过载丢包数，见inbox.go
+  GET  /dedup                   信令去重缓存的条数和命中、挤出计数，见dedup.go
+  GET  /pacer                   发送限速排队中的包数和丢包数，见pacer.go
+  GET  /errors                  按类别的错误数，见errors.go
+  GET  /presence?uid=x&uid=y    用户是否在线和所在的relay，见presence.go
+  GET  /queues                  呼叫队列里等待和正在邀请坐席的呼叫，见queue.go
+  GET  /canary                  经各relay最近一次拨测的结果，见canary.go
+  POST /calls?caller=x&callee=y 代为发起caller和callee的通话，可带call_type、name、max_duration，返回sid，见click_to_call.go
+  GET  /sessions/blackbox?sid=x session最近收到的信令（含已结束的session），见blackbox.go
+  POST /sessions/replay?sid=x   把黑匣子里的信令重放到新的内存session manager，返回每步发出的信令和最终状态
+  POST /users/dnd?uid=x&seconds=n uid开启免打扰n秒，n为0时取消，见screening.go
+  GET  /audit?since=x&action=y  审计日志，强制结束session、免打扰和信令里的踢人都会记入，见relay/audit.go
+  POST /obfuscation?id=x&secret=y&grace=1h 轮换混淆密钥，应和所有relay一起轮换，见relay/obfkey.go
+session的状态只在主循环里访问，所以handler把操作投递到主循环执行。
+*/
+
+const adminTimeout = 5 * time.Second
+
+type ParticipantInfo struct {
+	Uid     int64    `json:"uid"`
+	State   uint16   `json:"state"`
+	Guest   bool     `json:"guest,omitempty"`
+	Device  string   `json:"device,omitempty"`
+	Quality *Quality `json:"quality,omitempty"`
+}
+
+type SessionInfo struct {
+	Sid          int64             `json:"sid"`
+	Mode         int               `json:"mode"`
+	Participants []ParticipantInfo `json:"participants"`
+	Relays       []string          `json:"relays,omitempty"`
+	Recording    bool              `json:"recording"`
+	IdleSeconds  int64             `json:"idle_seconds"`
+}
+
+type RelayStatus struct {
+	Addr       string `json:"addr"`
+	LastRegAck int64  `json:"last_reg_ack"` //unix秒，0为还没收到过
+	Reachable  bool   `json:"reachable"`
+	Draining   bool   `json:"draining"`
+	ClockSkew  *int64 `json:"clock_skew_ms,omitempty"` //relay时钟减本机时钟，还没估算出来时不带，见clock.go
+}
+
+type AdminServer struct {
+	addr     string
+	sm       *SessionManager
+	server   *http.Server
+	listener net.Listener
+}
+
+func NewAdminServer(addr string, sm *SessionManager) *AdminServer {
+	a := &AdminServer{
+		addr: addr,
+		sm:   sm,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", a.handleSessions)
+	mux.HandleFunc("/sessions/kill", a.handleSessionKill)
+	mux.HandleFunc("/sessions/bot", a.handleSessionBot)
+	mux.HandleFunc("/relays", a.handleRelays)
+	mux.HandleFunc("/guests", a.handleGuests)
+	mux.HandleFunc("/inbox", a.handleInbox)
+	mux.HandleFunc("/dedup", a.handleDedup)
+	mux.HandleFunc("/pacer", a.handlePacer)
+	mux.HandleFunc("/errors", a.handleErrors)
+	mux.HandleFunc("/presence", a.handlePresence)
+	mux.HandleFunc("/queues", a.handleQueues)
+	mux.HandleFunc("/canary", a.handleCanary)
+	mux.HandleFunc("/calls", a.handleCalls)
+	mux.HandleFunc("/obfuscation", a.handleObfuscation)
+	mux.HandleFunc("/sessions/blackbox", a.handleBlackbox)
+	mux.HandleFunc("/sessions/replay", a.handleReplay)
+	mux.HandleFunc("/users/dnd", a.handleDnd)
+	mux.Handle("/audit", sm.audit)
+	a.server = &http.Server{Handler: mux}
+	return a
+}
+
+func (a *AdminServer) Start() {
+	listener, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		logging.Logger.Error("admin listen error:", err)
+		return
+	}
+	a.listener = listener
+	logging.Logger.Info("admin api listen on:", a.addr)
+	go a.server.Serve(listener)
+}
+
+func (a *AdminServer) Stop() {
+	if a.listener != nil {
+		a.server.Close()
+	}
+}
+
+func (a *AdminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	var sessions []SessionInfo
+	err := a.sm.runInLoop(func() {
+		now := time.Now()
+		sessions = make([]SessionInfo, 0, len(a.sm.sessions))
+		for _, session := range a.sm.sessions {
+			sessions = append(sessions, sessionInfoOf(session, now))
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, sessions)
+}
+
+func (a *AdminServer) handleSessionKill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	sid, err := strconv.ParseInt(r.URL.Query().Get("sid"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad sid", http.StatusBadRequest)
+		return
+	}
+	found := false
+	err = a.sm.runInLoop(func() {
+		found = a.sm.killSession(sid, relay.AuditOperator(r), r.URL.Query().Get("note"))
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !found {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) handleSessionBot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	sid, err := strconv.ParseInt(query.Get("sid"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad sid", http.StatusBadRequest)
+		return
+	}
+	uid, err := strconv.ParseInt(query.Get("uid"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad uid", http.StatusBadRequest)
+		return
+	}
+	var attachErr error
+	err = a.sm.runInLoop(func() {
+		attachErr = a.sm.attachBot(sid, uid, query.Get("name"))
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if attachErr == errSessionNotFound {
+		http.Error(w, attachErr.Error(), http.StatusNotFound)
+		return
+	}
+	if attachErr != nil {
+		http.Error(w, attachErr.Error(), http.StatusConflict)
+		return
+	}
+	a.sm.audit.Record(relay.AuditOperator(r), relay.AuditSessionBot, strconv.FormatInt(sid, 10), strconv.FormatInt(uid, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) handleRelays(w http.ResponseWriter, r *http.Request) {
+	var relays []RelayStatus
+	err := a.sm.runInLoop(func() {
+		now := time.Now()
+		for _, addr := range a.sm.relays {
+			status := RelayStatus{Addr: addr}
+			if t, ok := a.sm.relayAcks[addr]; ok {
+				status.LastRegAck = t.Unix()
+				status.Reachable = a.sm.relayReachable(addr, now)
+			}
+			status.Draining = a.sm.relayDraining(addr, now)
+			if skew, ok := a.sm.relayClockSkew(addr); ok {
+				ms := int64(skew / time.Millisecond)
+				status.ClockSkew = &ms
+			}
+			relays = append(relays, status)
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, relays)
+}
+
+func (a *AdminServer) handleGuests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	sid, err := strconv.ParseInt(r.URL.Query().Get("sid"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad sid", http.StatusBadRequest)
+		return
+	}
+	var info *GuestInfo
+	err = a.sm.runInLoop(func() {
+		if guest, token := a.sm.createGuest(sid); guest != nil {
+			info = newGuestInfo(guest, token)
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if info == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeJson(w, info)
+}
+
+func (a *AdminServer) handleCalls(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	req := &ClickToCallRequest{CallType: query.Get("call_type"), Name: query.Get("name")}
+	var err error
+	if req.Caller, err = strconv.ParseInt(query.Get("caller"), 10, 64); err != nil {
+		http.Error(w, "bad caller", http.StatusBadRequest)
+		return
+	}
+	if req.Callee, err = strconv.ParseInt(query.Get("callee"), 10, 64); err != nil {
+		http.Error(w, "bad callee", http.StatusBadRequest)
+		return
+	}
+	if d := query.Get("max_duration"); d != "" {
+		if req.MaxDuration, err = strconv.ParseInt(d, 10, 64); err != nil || req.MaxDuration < 0 {
+			http.Error(w, "bad max_duration", http.StatusBadRequest)
+			return
+		}
+	}
+	var session *Session
+	var callErr error
+	err = a.sm.runInLoop(func() {
+		session, callErr = a.sm.originateCall(req)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if callErr != nil {
+		http.Error(w, callErr.Error(), http.StatusConflict)
+		return
+	}
+	writeJson(w, map[string]int64{"sid": session.Sid})
+}
+
+func (a *AdminServer) handleDnd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	uid, err := strconv.ParseInt(r.URL.Query().Get("uid"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad uid", http.StatusBadRequest)
+		return
+	}
+	seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil || seconds < 0 {
+		http.Error(w, "bad seconds", http.StatusBadRequest)
+		return
+	}
+	var until time.Time
+	if seconds > 0 {
+		until = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	err = a.sm.runInLoop(func() {
+		a.sm.dnd.Set(uid, until)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	a.sm.audit.Record(relay.AuditOperator(r), relay.AuditUserDnd, strconv.FormatInt(uid, 10), strconv.Itoa(seconds)+"s")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//读出黑匣子，没有时返回nil
+func (a *AdminServer) loadBlackbox(w http.ResponseWriter, r *http.Request) (int64, []BlackboxEntry) {
+	sid, err := strconv.ParseInt(r.URL.Query().Get("sid"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad sid", http.StatusBadRequest)
+		return 0, nil
+	}
+	var entries []BlackboxEntry
+	err = a.sm.runInLoop(func() {
+		entries = a.sm.blackboxOf(sid)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return 0, nil
+	}
+	if entries == nil {
+		http.Error(w, "blackbox not found", http.StatusNotFound)
+		return 0, nil
+	}
+	return sid, entries
+}
+
+func (a *AdminServer) handleBlackbox(w http.ResponseWriter, r *http.Request) {
+	if _, entries := a.loadBlackbox(w, r); entries != nil {
+		writeJson(w, entries)
+	}
+}
+
+func (a *AdminServer) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	sid, entries := a.loadBlackbox(w, r)
+	if entries == nil {
+		return
+	}
+	var config *Config
+	if err := a.sm.runInLoop(func() { config = a.sm.replayConfig() }); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, replayBlackbox(config, sid, entries))
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func sessionInfoOf(session *Session, now time.Time) SessionInfo {
+	snapshot := session.Snapshot()
+	info := SessionInfo{
+		Sid:         snapshot.Sid,
+		Mode:        snapshot.Mode,
+		Relays:      snapshot.Relays,
+		Recording:   snapshot.Recording,
+		IdleSeconds: int64(now.Sub(session.LastActiveTime) / time.Second),
+	}
+	for _, p := range snapshot.Participants {
+		info.Participants = append(info.Participants, ParticipantInfo{Uid: p.Uid, State: p.State, Guest: IsGuestUid(p.Uid), Device: p.Device, Quality: p.Quality})
+	}
+	return info
+}
+
+//在主循环里执行fn并等待完成
+func (sm *SessionManager) runInLoop(fn func()) error {
+	done := make(chan struct{})
+	select {
+	case sm.adminCh <- func() { fn(); close(done) }:
+	case <-time.After(adminTimeout):
+		return errors.New("session manager busy")
+	}
+	<-done
+	return nil
+}
+
+//队列有自己的锁，不需要投递到主循环，主循环卡住时也能查看
+func (a *AdminServer) handleInbox(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, a.sm.inbox.Stats())
+}
+
+func (a *AdminServer) handleDedup(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, a.sm.dedup.Stats())
+}
+
+func (a *AdminServer) handlePacer(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, a.sm.pacer.Stats())
+}
+
+//计数是原子的，不需要投递到主循环
+func (a *AdminServer) handleErrors(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, a.sm.ErrorCounts())
+}
+
+func (a *AdminServer) handlePresence(w http.ResponseWriter, r *http.Request) {
+	var uids []int64
+	for _, value := range r.URL.Query()["uid"] {
+		uid, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "bad uid", http.StatusBadRequest)
+			return
+		}
+		uids = append(uids, uid)
+	}
+	if len(uids) == 0 {
+		http.Error(w, "uid required", http.StatusBadRequest)
+		return
+	}
+	presence := make([]*PresenceInfo, 0, len(uids))
+	err := a.sm.runInLoop(func() {
+		for _, uid := range uids {
+			presence = append(presence, a.sm.presenceOf(uid))
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, presence)
+}
+
+func (a *AdminServer) handleQueues(w http.ResponseWriter, r *http.Request) {
+	var queues []*QueueInfo
+	err := a.sm.runInLoop(func() {
+		for _, q := range a.sm.queues {
+			queues = append(queues, newQueueInfo(q))
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, queues)
+}
+
+func (a *AdminServer) handleCanary(w http.ResponseWriter, r *http.Request) {
+	results := make(map[string]*loadtest.CanaryResult)
+	err := a.sm.runInLoop(func() {
+		for addr, result := range a.sm.canaryResults {
+			results[addr] = result
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, results)
+}
+
+//密钥是进程内全局的，不需要投递到主循环
+func (a *AdminServer) handleObfuscation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	key, grace, err := relay.ObfuscationKeyFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	relay.RotateObfuscationKey(key, grace)
+	logging.Logger.Warn("admin rotate obfuscation key to ", key.Id, " grace ", grace, " from ", r.RemoteAddr)
+	a.sm.audit.Record(relay.AuditOperator(r), relay.AuditConfigObfKey, strconv.Itoa(int(key.Id)), "grace "+grace.String())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,224 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+/*
+告警规则：按relay统计滑动窗口内的质量指标，超出阈值时发告警事件，在用户投诉之前发现某个区域的劣化。
+1. config的alert_rules每条一个规则，格式为"指标 比较 阈值/窗口"，如"loss>0.05/1m"、"mos<3.5/5m"、"setup_failures>10/1m"
+2. 指标：
+     loss、mos、jitter（毫秒）、rtt（毫秒） relay上报的每个参与者的通话质量（见quality.go），取窗口内的平均值，
+                                          样本少于AlertMinSamples时不判断；rtt只算客户端上报了的
+     setup_failures                       窗口内没接通就结束的session数，有参与者没进过incall就以网络中断结束即算，
+                                          算在session的每个relay上
+3. 每AlertCheckPeriod检查一次，某个relay从正常变为超出阈值时发alert事件，恢复时发alert.resolved事件，
+   Relay为relay地址，Alert为规则、当前值和开始时间；持续超出阈值期间不重复发
+*/
+
+const (
+	AlertCheckPeriod = 10 * time.Second
+	AlertMinSamples  = 3
+
+	AlertMetricLoss          = "loss"
+	AlertMetricMos           = "mos"
+	AlertMetricJitter        = "jitter"
+	AlertMetricRtt           = "rtt"
+	AlertMetricSetupFailures = "setup_failures"
+)
+
+var alertRulePattern = regexp.MustCompile(`^\s*([a-z_]+)\s*([<>])\s*([0-9.]+)\s*/\s*([0-9a-z.]+)\s*$`)
+
+type AlertRule struct {
+	Text      string
+	Metric    string
+	Above     bool //>为true，<为false
+	Threshold float64
+	Window    time.Duration
+}
+
+func ParseAlertRule(text string) (*AlertRule, error) {
+	m := alertRulePattern.FindStringSubmatch(text)
+	if m == nil {
+		return nil, fmt.Errorf("alert rule %q, want metric>threshold/window like loss>0.05/1m", text)
+	}
+	switch m[1] {
+	case AlertMetricLoss, AlertMetricMos, AlertMetricJitter, AlertMetricRtt, AlertMetricSetupFailures:
+	default:
+		return nil, fmt.Errorf("alert rule %q: unknown metric %s", text, m[1])
+	}
+	threshold, err := strconv.ParseFloat(m[3], 64)
+	if err != nil {
+		return nil, fmt.Errorf("alert rule %q: %v", text, err)
+	}
+	window, err := time.ParseDuration(m[4])
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("alert rule %q: incorrect window %s", text, m[4])
+	}
+	return &AlertRule{Text: text, Metric: m[1], Above: m[2] == ">", Threshold: threshold, Window: window}, nil
+}
+
+type Alert struct {
+	Rule    string    `json:"rule"`
+	Value   float64   `json:"value"` //窗口内的平均值，setup_failures为次数
+	Samples int       `json:"samples"`
+	Since   time.Time `json:"since"`
+}
+
+type AlertChange struct {
+	Relay    string
+	Alert    *Alert
+	Resolved bool
+}
+
+type alertSample struct {
+	time  time.Time
+	value float64
+}
+
+type AlertEngine struct {
+	rules   []*AlertRule
+	windows map[string]time.Duration            //指标 -> 用到它的规则里最长的窗口
+	samples map[string]map[string][]alertSample //指标 -> relay地址 -> 按时间排列的样本
+	firing  map[alertKey]*Alert                 //正在告警的
+}
+
+type alertKey struct {
+	rule  string
+	relay string
+}
+
+func NewAlertEngine(rules []*AlertRule) *AlertEngine {
+	e := &AlertEngine{
+		rules:   rules,
+		windows: make(map[string]time.Duration),
+		samples: make(map[string]map[string][]alertSample),
+		firing:  make(map[alertKey]*Alert),
+	}
+	for _, r := range rules {
+		if r.Window > e.windows[r.Metric] {
+			e.windows[r.Metric] = r.Window
+		}
+	}
+	return e
+}
+
+//没有规则用到的指标不记
+func (e *AlertEngine) Add(metric string, relay string, value float64, now time.Time) {
+	if _, ok := e.windows[metric]; !ok {
+		return
+	}
+	if e.samples[metric] == nil {
+		e.samples[metric] = make(map[string][]alertSample)
+	}
+	e.samples[metric][relay] = append(e.samples[metric][relay], alertSample{time: now, value: value})
+}
+
+//丢掉所有窗口之外的样本，返回告警状态有变化的规则和relay
+func (e *AlertEngine) Evaluate(now time.Time) []AlertChange {
+	for metric, relays := range e.samples {
+		for relay, samples := range relays {
+			i := 0
+			for i < len(samples) && now.Sub(samples[i].time) > e.windows[metric] {
+				i++
+			}
+			if i == len(samples) {
+				delete(relays, relay)
+			} else {
+				relays[relay] = samples[i:]
+			}
+		}
+	}
+
+	var changes []AlertChange
+	for _, r := range e.rules {
+		relays := make(map[string]bool)
+		for relay := range e.samples[r.Metric] {
+			relays[relay] = true
+		}
+		for key := range e.firing {
+			if key.rule == r.Text {
+				relays[key.relay] = true
+			}
+		}
+		for relay := range relays {
+			key := alertKey{rule: r.Text, relay: relay}
+			value, n, ok := e.aggregate(r, relay, now)
+			breached := ok && (r.Above && value > r.Threshold || !r.Above && value < r.Threshold)
+			if a := e.firing[key]; a != nil {
+				a.Value, a.Samples = value, n
+				if !breached {
+					delete(e.firing, key)
+					changes = append(changes, AlertChange{Relay: relay, Alert: a, Resolved: true})
+				}
+			} else if breached {
+				a := &Alert{Rule: r.Text, Value: value, Samples: n, Since: now}
+				e.firing[key] = a
+				changes = append(changes, AlertChange{Relay: relay, Alert: a})
+			}
+		}
+	}
+	return changes
+}
+
+//规则窗口内的值和样本数，样本不够时ok为false
+func (e *AlertEngine) aggregate(r *AlertRule, relay string, now time.Time) (value float64, n int, ok bool) {
+	var sum float64
+	for _, s := range e.samples[r.Metric][relay] {
+		if now.Sub(s.time) <= r.Window {
+			sum += s.value
+			n++
+		}
+	}
+	if r.Metric == AlertMetricSetupFailures {
+		return sum, n, true
+	}
+	if n < AlertMinSamples {
+		return 0, n, false
+	}
+	return sum / float64(n), n, true
+}
+
+func (sm *SessionManager) addAlertSample(metric string, relay string, value float64) {
+	if sm.alerts != nil {
+		sm.alerts.Add(metric, relay, value, time.Now())
+	}
+}
+
+//有参与者没进过incall就以网络中断结束
+func setupFailed(session *Session) bool {
+	for _, p := range session.Participants {
+		if p.JoinTime.IsZero() && p.EndReason == YCKCallEndReasonNetworkFailure {
+			return true
+		}
+	}
+	return false
+}
+
+func (sm *SessionManager) checkAlerts() {
+	for _, c := range sm.alerts.Evaluate(time.Now()) {
+		eventType := EventAlert
+		if c.Resolved {
+			eventType = EventAlertResolved
+			sm.log().Info("alert ", c.Alert.Rule, " of relay ", c.Relay, " resolved, value:", c.Alert.Value)
+		} else {
+			sm.log().Warn("alert ", c.Alert.Rule, " of relay ", c.Relay, ", value:", c.Alert.Value, " samples:", c.Alert.Samples)
+		}
+		alert := *c.Alert
+		event := NewEvent(eventType, 0)
+		event.Relay = c.Relay
+		event.Alert = &alert
+		sm.emitEvent(event)
+	}
+	sm.wheel.Schedule(AlertCheckPeriod, sm.checkAlerts)
+}
@@ -0,0 +1,182 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+信令黑匣子：排查状态机问题用。
+1. 每个session用环形缓冲保留最近config.BlackboxSize条收到的信令（解码后重新编码的json，以及收到时间），
+   在找到session之后、处理之前记录，被策略拒绝的信令也在内
+2. session删除后黑匣子再保留BlackboxRetention，最多BlackboxEndedSessions个
+3. 管理接口GET /sessions/blackbox?sid=x导出；POST /sessions/replay?sid=x把这些信令按顺序重放到一个新的内存session manager
+   （MemTransport，不发任何网络包），返回每条信令引起的发出信令和最终状态。重放用的配置在主循环里复制，重放本身在admin的
+   goroutine里进行，重放实例只有内存状态，日志丢弃。重放时信令的时间戳整体平移到当前时间，相对先后不变；
+   重放从已有同sid的空session开始，请求sid那一步不在黑匣子里
+*/
+
+const (
+	BlackboxRetention     = time.Hour
+	BlackboxEndedSessions = 1000
+)
+
+type BlackboxEntry struct {
+	Time   time.Time       `json:"time"`
+	From   int64           `json:"from"`
+	Signal uint16          `json:"signal"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type Blackbox struct {
+	entries []BlackboxEntry
+	next    int
+	full    bool
+}
+
+func NewBlackbox(size int) *Blackbox {
+	return &Blackbox{entries: make([]BlackboxEntry, size)}
+}
+
+func (b *Blackbox) Add(entry BlackboxEntry) {
+	b.entries[b.next] = entry
+	b.next++
+	if b.next == len(b.entries) {
+		b.next = 0
+		b.full = true
+	}
+}
+
+//按收到的先后顺序返回
+func (b *Blackbox) Entries() []BlackboxEntry {
+	if !b.full {
+		return append([]BlackboxEntry(nil), b.entries[:b.next]...)
+	}
+	entries := make([]BlackboxEntry, 0, len(b.entries))
+	entries = append(entries, b.entries[b.next:]...)
+	return append(entries, b.entries[:b.next]...)
+}
+
+func (sm *SessionManager) recordSignal(session *Session, signal *Signal) {
+	if sm.blackboxSize <= 0 {
+		return
+	}
+	data, err := signal.Marshal()
+	if err != nil {
+		return
+	}
+	if session.Blackbox == nil {
+		session.Blackbox = NewBlackbox(sm.blackboxSize)
+	}
+	session.Blackbox.Add(BlackboxEntry{Time: time.Now(), From: signal.From, Signal: signal.Signal, Data: data})
+}
+
+//session删除时调用
+func (sm *SessionManager) keepBlackbox(session *Session) {
+	if session.Blackbox != nil {
+		sm.endedBlackboxes.Add(session.Sid, session.Blackbox)
+	}
+}
+
+//进行中或已结束的session的黑匣子，没有时返回nil，在主循环里调用
+func (sm *SessionManager) blackboxOf(sid int64) []BlackboxEntry {
+	if session := sm.sessions[sid]; session != nil && session.Blackbox != nil {
+		return session.Blackbox.Entries()
+	}
+	if value, ok := sm.endedBlackboxes.Get(sid); ok {
+		return value.(*Blackbox).Entries()
+	}
+	return nil
+}
+
+type ReplayStep struct {
+	Signal uint16       `json:"signal"`
+	From   int64        `json:"from"`
+	Sent   []ReplaySent `json:"sent"`
+}
+
+type ReplaySent struct {
+	To     int64  `json:"to"`
+	Signal uint16 `json:"signal"`
+}
+
+type ReplayResult struct {
+	Steps   []ReplayStep `json:"steps"`
+	Session *SessionInfo `json:"session"` //重放后session已被删除时为nil
+}
+
+//重放用的配置，从sm复制重放需要的部分，在主循环里调用
+func (sm *SessionManager) replayConfig() *Config {
+	config := GetDefaultConfig()
+	config.MaxCallsPerUser = sm.maxCallsPerUser
+	config.Tenants = make(map[uint16]*TenantConfig, len(sm.tenants))
+	for id, t := range sm.tenants {
+		config.Tenants[id] = t
+	}
+	config.Relays = append([]string(nil), sm.relays...)
+	config.AuditFile = ""
+	config.BlackboxSize = 0
+	return config
+}
+
+//重放实例的日志都丢掉，不和线上的混在一起
+var replayLogger = &logrus.Logger{Out: ioutil.Discard, Formatter: new(logrus.TextFormatter), Hooks: make(logrus.LevelHooks), Level: logrus.PanicLevel}
+
+//在一个只有内存状态的session manager里重放（见newSessionManager），不碰sm，也不改混淆密钥、日志等进程全局的状态，
+//在admin的goroutine里调用，config由replayConfig在主循环里复制
+func replayBlackbox(config *Config, sid int64, entries []BlackboxEntry) *ReplayResult {
+	replay := newSessionManager(config, nil)
+	replay.trace = logging.NewTrace(replayLogger)
+	transport := NewMemTransport()
+	replay.SetTransport(transport)
+	replay.sessions[sid] = NewSession(sid)
+
+	result := &ReplayResult{}
+	var shift int64
+	for i, entry := range entries {
+		signal := NewSignalTemp()
+		if err := signal.Unmarshal(entry.Data); err != nil {
+			logging.Logger.Warn("blackbox entry unmarshal error:", err)
+			continue
+		}
+		if i == 0 {
+			shift = time.Now().UnixNano()/int64(100*time.Microsecond) - signal.Timestamp
+		}
+		signal.Timestamp += shift
+		payload, err := signal.Marshal()
+		if err != nil {
+			continue
+		}
+		replay.handleMessageUserSignal(relay.NewMessage(relay.UdpMessageTypeUserSignal, signal.From, SessionManagerUserId, 0, payload, nil))
+
+		step := ReplayStep{Signal: entry.Signal, From: entry.From}
+		for _, p := range transport.Sent() {
+			msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+			if err != nil || msg.MsgType != relay.UdpMessageTypeUserSignal {
+				continue //发给relay的控制消息
+			}
+			sent := NewSignalTemp()
+			if sent.UnmarshalMessage(msg) == nil {
+				step.Sent = append(step.Sent, ReplaySent{To: msg.To, Signal: sent.Signal})
+			}
+		}
+		result.Steps = append(result.Steps, step)
+	}
+	if session := replay.sessions[sid]; session != nil {
+		info := sessionInfoOf(session, time.Now())
+		result.Session = &info
+	}
+	return result
+}
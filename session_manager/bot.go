@@ -0,0 +1,52 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+把服务端bot（IVR、语音信箱问候语、AI助手，见bot包）加入进行中的session：
+1. 业务后台调管理接口POST /sessions/bot?sid=&uid=[&name=]，uid为bot Host注册的用户id
+2. session manager用多方的member invite邀请bot，Info里caller为SessionManagerUserId，bot为true，
+   name为其他参与者看到的bot名称；1-1的session先转为多方模式，和member_op邀请第三方时相同
+3. bot用多方模式的Accept/Reject/End应答，之后和普通参与者一样出现在MemberState里，turn reg后收发媒体
+客户端也可以直接用member_op邀请bot的uid，或者1-1呼叫它（如拨打语音信箱）。
+*/
+
+var errSessionNotFound = errors.New("session not found")
+
+func (sm *SessionManager) attachBot(sid int64, uid int64, name string) error {
+	session := sm.sessions[sid]
+	if session == nil {
+		return errSessionNotFound
+	}
+	if p := session.Participant(uid); p != nil && !p.InState(YCKParticipantStateIdle) {
+		return fmt.Errorf("bot %d already in session %d", uid, sid)
+	}
+	if session.Mode != YCKCallModeMultiple {
+		session.Mode = YCKCallModeMultiple
+		sm.log().Info("change to multipart mode for bot")
+	}
+
+	invite := NewSignal(YCKCallSignalTypeInvite, SessionManagerUserId, SessionManagerUserId, sid)
+	invite.Info = map[string]interface{}{}
+	if name != "" {
+		invite.Info["name"] = name
+	}
+	info := newInviteInfo(invite, session)
+	info["bot"] = true
+	if !sm.inviteMember(session, SessionManagerUserId, uid, info) {
+		return fmt.Errorf("invite to bot %d failed", uid)
+	}
+	sm.notifyMemberStateChange(session)
+	sm.log().Info("bot ", uid, " invited to session ", sid)
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+relay写路径的熔断：某个relay的地址写socket连续失败（没有路由、被防火墙拒绝等）时，继续往它发只是浪费，
+失败日志还会刷屏：
+1. 每个relay地址记连续写失败次数，成功一次清零；达到BreakerFailures次后熔断，之后发往它的包直接丢弃，
+   发relay.down事件
+2. 熔断BreakerCooldown后在主循环里单独给它发一次注册作为探测，写成功就恢复并发relay.up事件，
+   失败则再熔断一个周期后重试
+写结果由Pacer回调（见pacer.go），可能在主循环也可能在Pacer的goroutine里，所以RelayBreakers有自己的锁，
+事件投递到主循环发出。
+*/
+
+const (
+	BreakerFailures = 5
+	BreakerCooldown = 30 * time.Second
+)
+
+const (
+	breakerUnchanged = iota
+	breakerOpened    //刚熔断
+	breakerReopened  //探测失败，继续熔断
+	breakerClosed    //恢复
+)
+
+type relayBreaker struct {
+	failures int
+	open     bool
+	probing  bool //熔断中，探测的写结果还没回来
+}
+
+type RelayBreakers struct {
+	lock   sync.Mutex
+	relays map[string]*relayBreaker //udp地址 -> 熔断状态
+}
+
+func NewRelayBreakers() *RelayBreakers {
+	return &RelayBreakers{relays: make(map[string]*relayBreaker)}
+}
+
+//熔断中时返回false
+func (b *RelayBreakers) Allow(addr string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	r := b.relays[addr]
+	return r == nil || !r.open
+}
+
+//记录一次写结果，返回状态变化
+func (b *RelayBreakers) Record(addr string, err error) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	r := b.relays[addr]
+	if r == nil {
+		if err == nil {
+			return breakerUnchanged
+		}
+		r = &relayBreaker{}
+		b.relays[addr] = r
+	}
+	if err == nil {
+		wasOpen := r.open
+		delete(b.relays, addr)
+		if wasOpen {
+			return breakerClosed
+		}
+		return breakerUnchanged
+	}
+	r.failures++
+	if r.open {
+		//熔断前已排队的包写失败不算探测结果
+		if r.probing {
+			r.probing = false
+			return breakerReopened
+		}
+		return breakerUnchanged
+	}
+	if r.failures >= BreakerFailures {
+		r.open = true
+		return breakerOpened
+	}
+	return breakerUnchanged
+}
+
+//熔断中且没有进行中的探测时标记开始探测并返回true
+func (b *RelayBreakers) StartProbe(addr string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	r := b.relays[addr]
+	if r == nil || !r.open || r.probing {
+		return false
+	}
+	r.probing = true
+	return true
+}
+
+//熔断中的relay地址
+func (b *RelayBreakers) Open() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var open []string
+	for addr, r := range b.relays {
+		if r.open {
+			open = append(open, addr)
+		}
+	}
+	return open
+}
+
+//发往relay的包都从这里经过熔断和限速
+func (sm *SessionManager) writeToRelay(data []byte, addr *net.UDPAddr) {
+	if !sm.breakers.Allow(addr.String()) {
+		return
+	}
+	sm.pacer.Send(sm.conn, data, addr)
+}
+
+//Pacer的写结果回调，可能不在主循环里
+func (sm *SessionManager) recordRelayWrite(addr *net.UDPAddr, err error) {
+	key := addr.String()
+	state := sm.breakers.Record(key, err)
+	if err != nil && state == breakerUnchanged && sm.breakers.Allow(key) {
+		sm.log().Error("udp write error", err)
+	}
+	switch state {
+	case breakerOpened:
+		sm.log().Warn("relay ", key, " write failed ", BreakerFailures, " times, stop sending for ", BreakerCooldown, ":", err)
+		sm.emitRelayHealth(EventRelayDown, key)
+		sm.scheduleRelayProbe(addr)
+		go sm.runInLoop(func() { sm.checkSessionRelays(time.Now()) }) //迁移在用它的通话，见migration.go
+	case breakerReopened:
+		sm.scheduleRelayProbe(addr)
+	case breakerClosed:
+		sm.log().Info("relay ", key, " writable again")
+		sm.emitRelayHealth(EventRelayUp, key)
+	}
+}
+
+func (sm *SessionManager) emitRelayHealth(eventType string, addr string) {
+	go sm.runInLoop(func() {
+		event := NewEvent(eventType, 0)
+		event.Relay = addr
+		sm.emitEvent(event)
+	})
+}
+
+func (sm *SessionManager) scheduleRelayProbe(addr *net.UDPAddr) {
+	time.AfterFunc(BreakerCooldown, func() {
+		select {
+		case <-sm.stop:
+			return
+		default:
+		}
+		if sm.runInLoop(func() { sm.probeRelay(addr) }) != nil {
+			sm.scheduleRelayProbe(addr) //主循环忙，下个周期再探测
+		}
+	})
+}
+
+//绕过熔断单独给relay发一次注册，写结果决定是否恢复
+func (sm *SessionManager) probeRelay(addr *net.UDPAddr) {
+	if !sm.breakers.StartProbe(addr.String()) {
+		return
+	}
+	sm.pacer.Send(sm.conn, sm.registrationMessage().ObfuscatedDataOfMessage(), addr)
+}
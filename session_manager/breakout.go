@@ -0,0 +1,106 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+/*
+分组讨论：多方通话中把成员分到几个有名字的房间里各自讨论。房间是原session的子会场，不另建session，
+信令、relay session、CDR、录制和时长限制都还是原来的sid。
+1. 通话中没有被限制权限的成员用member_op移动成员，Info为op="breakout"、members和room（房间名），room为空即回到主会场。
+   只能移动响铃或通话中的成员；房间在第一次有人移入时创建，按创建顺序编号1..MaxBreakoutRooms，主会场为0，
+   房间号在session结束前不变。成员离开通话（回到idle）即回到主会场
+2. 被移动的成员收到Breakout信令，Info为room、room_id和同一房间里响铃或通话中的成员members；
+   MemberState里不在主会场的成员带room（房间号），Info带rooms（房间名，下标+1为房间号）
+3. 房间号随session control下发给relay，relay只在同一房间的成员之间转发媒体，有人在房间里时不混音，
+   见relay/session_control.go；拓扑也按sfu下发，见topology.go
+*/
+
+const MaxBreakoutRooms = 50
+
+func (sm *SessionManager) processBreakoutOp(signal *Signal, session *Session, members []interface{}) {
+	if by := session.Participant(signal.From); by == nil || !by.InState(YCKParticipantStateIncall) || by.Restrict != 0 {
+		sm.log().Warn("member ", signal.From, " not allowed to move members in session ", session.Sid)
+		return
+	}
+	name, _ := signal.Info["room"].(string)
+	room, ok := session.roomId(name)
+	if !ok {
+		sm.log().Warn("too many breakout rooms in session ", session.Sid, ", cannot open ", name)
+		return
+	}
+	var moved []*Participant
+	for _, value := range members {
+		mem, err := value.(json.Number).Int64()
+		if err != nil {
+			sm.log().Warn("parseUint error ", err)
+			continue
+		}
+		p := session.Participant(mem)
+		if p == nil || p.InState(YCKParticipantStateIdle) {
+			sm.log().Warn("member ", mem, " not in call, cannot move to room ", name)
+			continue
+		}
+		if p.Room != room {
+			p.Room = room
+			moved = append(moved, p)
+			sm.log().Info("member ", mem, " of session ", session.Sid, " moved to room ", room, "(", name, ") by ", signal.From)
+		}
+	}
+	for _, p := range moved {
+		sm.sendBreakout(session, p)
+	}
+}
+
+//房间名对应的房间号，没有时新建，房间数已满时返回false
+func (s *Session) roomId(name string) (uint8, bool) {
+	if name == "" {
+		return 0, true
+	}
+	for i, room := range s.Rooms {
+		if room == name {
+			return uint8(i + 1), true
+		}
+	}
+	if len(s.Rooms) >= MaxBreakoutRooms {
+		return 0, false
+	}
+	s.Rooms = append(s.Rooms, name)
+	return uint8(len(s.Rooms)), true
+}
+
+//有响铃或通话中的成员不在主会场
+func (s *Session) inBreakout() bool {
+	for _, p := range s.Participants {
+		if p.Room != 0 && !p.InState(YCKParticipantStateIdle) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sm *SessionManager) sendBreakout(session *Session, p *Participant) {
+	var name string
+	if p.Room != 0 {
+		name = session.Rooms[p.Room-1]
+	}
+	var together []int64
+	for _, other := range session.Participants {
+		if other.Room == p.Room && !other.InState(YCKParticipantStateIdle) {
+			together = append(together, other.Uid)
+		}
+	}
+	sort.Slice(together, func(i, j int) bool { return together[i] < together[j] })
+
+	signal := NewSignal(YCKCallSignalTypeBreakout, SessionManagerUserId, p.Uid, session.Sid)
+	signal.Info = map[string]interface{}{"room": name, "room_id": p.Room, "members": together}
+	sm.sendSignal(signal, false)
+}
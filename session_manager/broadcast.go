@@ -0,0 +1,92 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+广播（研讨会）模式：一个或几个发布者对大量订阅者的一对多直播，订阅者只收不发。
+1. 请求sid时Info["mode"]="broadcast"，Info["publishers"]为其他发布者，请求者总是发布者。
+   广播session一开始就是多方模式，1-1信令按模式不符丢弃
+2. 其他人成为参与者时即为订阅者，Participant.Restrict带上subscriberRestrict，和被限制了权限的成员一样
+   不能邀请以外的member_op（踢人、改权限、分组等）
+3. 通话中的发布者用member_op改角色，Info为op="publish"或"unpublish"和members，如让听众上台提问；
+   上台时去掉发音视频的限制（包括之前permit设的）
+4. 角色随session control下发给relay执行，relay不转发订阅者发的媒体，混音只算发布者，见relay/session_control.go
+5. MemberState只列发布者，Info["subscribers"]为响铃或通话中的订阅者人数，订阅者多时信令不会太大，
+   也不会每有一个人进出就给所有人发一遍长列表
+*/
+
+const (
+	SessionModeBroadcast = "broadcast"
+
+	subscriberRestrict = relay.MemberSubscriber | relay.MemberNoSendAudio | relay.MemberNoSendVideo
+)
+
+//sid请求要求广播模式时设置发布者
+func setupBroadcast(session *Session, signal *Signal) {
+	if mode, _ := signal.Info["mode"].(string); mode != SessionModeBroadcast {
+		return
+	}
+	session.Mode = YCKCallModeMultiple
+	session.Publishers = map[int64]bool{signal.From: true}
+	if list, ok := signal.Info["publishers"].([]interface{}); ok {
+		for _, value := range list {
+			if uid, err := memberUid(value); err == nil {
+				session.Publishers[uid] = true
+			}
+		}
+	}
+	logging.Logger.Info("broadcast session ", session.Sid, " publishers:", len(session.Publishers))
+}
+
+func (s *Session) broadcasting() bool {
+	return s.Publishers != nil
+}
+
+//广播模式的订阅者
+func (s *Session) subscriber(uid int64) bool {
+	return s.broadcasting() && !s.Publishers[uid]
+}
+
+func (sm *SessionManager) processPublishOp(signal *Signal, session *Session, members []interface{}, publish bool) {
+	if by := session.Participant(signal.From); !session.broadcasting() || by == nil || !by.InState(YCKParticipantStateIncall) || session.subscriber(signal.From) {
+		sm.log().Warn("member ", signal.From, " not allowed to change publishers in session ", session.Sid)
+		return
+	}
+	for _, value := range members {
+		mem, err := memberUid(value)
+		if err != nil {
+			sm.log().Warn("parseUint error ", err)
+			continue
+		}
+		p := session.participant(mem)
+		if publish {
+			session.Publishers[mem] = true
+			p.Restrict &^= subscriberRestrict
+		} else {
+			delete(session.Publishers, mem)
+			p.Restrict |= subscriberRestrict
+		}
+		sm.log().Info("member ", mem, " of session ", session.Sid, " publishing:", publish, " by ", signal.From)
+	}
+}
+
+//响铃或通话中的订阅者人数
+func (s *Session) subscriberCount() int {
+	n := 0
+	for _, p := range s.Participants {
+		if s.subscriber(p.Uid) && !p.InState(YCKParticipantStateIdle) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,139 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+批量member_op：一次调整多个成员（邀请几个、踢几个、静音一个），减少信令往返和MemberState的广播次数。
+1. Info为op="bulk"和ops，ops的每项为{op, member}，op为invite、kick、permit、mute或unmute：
+   permit的项和permit op一样带send_audio、send_video、receive；mute即send_audio为false，unmute即send_audio为true
+2. 全部成功或全部不做：先按当前状态逐项检查，有一项不行就都不执行，不行的项在结果里带原因，其他项为skipped、reason为aborted。
+   检查包括成员重复、租户、邀请的成员不在idle、踢的成员不在通话中、改权限的操作者不在通话中或自己被限制了权限；
+   只有被邀请者的来电过滤在执行时才知道，被拦下的项为skipped、reason为screened，不影响其他项
+3. 执行完只广播一次MemberState。不论带不带op_id都回MemberOpResult，邀请、踢、改权限成功的result为invited、kicked、permitted，
+   op_id的去重见member_op.go
+*/
+
+const (
+	MemberOpBulk      = "bulk"
+	MemberOpPermitted = "permitted"
+
+	MemberSkipDuplicate  = "duplicate"   //同一成员在ops里出现了多次
+	MemberSkipUnknownOp  = "unknown_op"  //不认识的op
+	MemberSkipNotAllowed = "not_allowed" //操作者不能改权限，见permissions.go
+	MemberSkipAborted    = "aborted"     //其他项检查没通过，这一项没有执行
+)
+
+type bulkEntry struct {
+	op     string
+	member int64
+	set    uint8 //permit要加上的限制位
+	clear  uint8 //permit要去掉的限制位
+	reason string
+}
+
+func hasMemberOp(signal *Signal) bool {
+	return signal.Info["op"] != nil && (signal.Info["members"] != nil || signal.Info["ops"] != nil)
+}
+
+func (sm *SessionManager) processBulkOp(signal *Signal, session *Session, result *MemberOpResult) {
+	list, _ := signal.Info["ops"].([]interface{})
+	entries := make([]*bulkEntry, 0, len(list))
+	seen := make(map[int64]bool)
+	failed := false
+	for _, value := range list {
+		item, _ := value.(map[string]interface{})
+		e := &bulkEntry{}
+		entries = append(entries, e)
+		e.op, _ = item["op"].(string)
+		mem, err := memberUid(item["member"])
+		if err != nil {
+			e.reason = MemberSkipInvalid
+		} else {
+			e.member = mem
+			e.reason = sm.checkBulkEntry(signal, session, e, item, seen)
+			seen[mem] = true
+		}
+		if e.reason != "" {
+			failed = true
+		}
+	}
+
+	if failed {
+		sm.log().Warn("bulk member op from ", signal.From, " aborted in session ", session.Sid)
+		for _, e := range entries {
+			if e.reason == "" {
+				e.reason = MemberSkipAborted
+			}
+			result.add(e.member, MemberOpSkipped, e.reason)
+		}
+		return
+	}
+
+	inviteInfo := newInviteInfo(signal, session)
+	for _, e := range entries {
+		switch e.op {
+		case "invite":
+			if sm.inviteMember(session, signal.From, e.member, inviteInfo) {
+				result.add(e.member, MemberOpInvited, "")
+			} else {
+				result.add(e.member, MemberOpSkipped, MemberSkipScreened)
+			}
+		case "kick":
+			sm.kickMember(session, signal.From, e.member)
+			result.add(e.member, MemberOpKicked, "")
+		default:
+			p := session.participant(e.member)
+			p.Restrict = p.Restrict&^e.clear | e.set
+			result.add(e.member, MemberOpPermitted, "")
+		}
+	}
+	sm.log().Info("bulk member op from ", signal.From, " applied in session ", session.Sid, ", ops:", len(entries))
+}
+
+//不改任何状态，可以执行时返回""，否则返回原因
+func (sm *SessionManager) checkBulkEntry(signal *Signal, session *Session, e *bulkEntry, item map[string]interface{}, seen map[int64]bool) string {
+	if seen[e.member] {
+		return MemberSkipDuplicate
+	}
+	p := session.Participant(e.member)
+	switch e.op {
+	case "invite":
+		if relay.TenantOf(e.member) != relay.TenantOf(session.Sid) {
+			return MemberSkipTenant
+		}
+		if p != nil && !p.InState(YCKParticipantStateIdle) {
+			return MemberSkipNotIdle
+		}
+		if session.inviteLocked(signal.From) {
+			return MemberSkipLocked
+		}
+	case "kick":
+		if p == nil || !p.InState(YCKParticipantStateIncall) {
+			return MemberSkipNotInCall
+		}
+	case "permit", "mute", "unmute":
+		if by := session.Participant(signal.From); by == nil || !by.InState(YCKParticipantStateIncall) || by.Restrict != 0 {
+			return MemberSkipNotAllowed
+		}
+		switch e.op {
+		case "permit":
+			e.set, e.clear = permitChanges(item)
+		case "mute":
+			e.set = relay.MemberNoSendAudio
+		case "unmute":
+			e.clear = relay.MemberNoSendAudio
+		}
+	default:
+		return MemberSkipUnknownOp
+	}
+	return ""
+}
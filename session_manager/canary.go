@@ -0,0 +1,82 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"time"
+
+	"github.com/xujiajundd/ycng/loadtest"
+)
+
+/*
+拨测：用户投诉之前发现relay或session manager的故障。
+1. config的canary_interval（秒）不为0时，每个周期依次经每个relay打一通通话：两个内置的虚拟参与者
+   CanaryUid和CanaryUid+1注册到这个relay，请求sid、invite、accept、TurnReg后互推CanaryDuration的媒体，见loadtest/canary.go
+2. 每通的结果发canary事件，建立耗时超过canary_max_setup（毫秒）、丢包率超过canary_max_loss或失败时再发canary.alert事件，
+   Alerts为原因；最近一次的结果可以从管理接口GET /canary查看
+3. 拨测走和真实用户一样的信令，session、CDR和participant事件照常产生，按uid过滤
+拨测在后台goroutine里进行，只在取relay列表和发事件时进主循环。
+*/
+
+const (
+	CanaryUid      = 9900000000 //拨测的caller，callee为CanaryUid+1，不要分配给真实用户
+	CanaryDuration = 5 * time.Second
+)
+
+func (sm *SessionManager) startCanary() {
+	if sm.canaryInterval == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(sm.canaryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sm.stop:
+				return
+			case <-ticker.C:
+				sm.runCanary()
+			}
+		}
+	}()
+}
+
+func (sm *SessionManager) runCanary() {
+	var relays []string
+	if err := sm.runInLoop(func() { relays = append(relays, sm.relays...) }); err != nil {
+		sm.log().Warn("canary skipped: ", err)
+		return
+	}
+	for _, addr := range relays {
+		config := loadtest.GetDefaultConfig()
+		config.RelayAddr = addr
+		config.AccessSecret = sm.accessSecret
+		config.Clients = 2
+		config.StartUid = CanaryUid
+		config.Duration = CanaryDuration
+		result := loadtest.RunCanary(config)
+		alerts := result.Alerts(sm.canaryMaxSetup, sm.canaryMaxLoss)
+		if alerts != nil {
+			sm.log().Warn("canary through relay ", addr, " alerts: ", alerts)
+		}
+		sm.runInLoop(func() {
+			sm.canaryResults[addr] = result
+			event := NewEvent(EventCanary, 0)
+			event.Relay = addr
+			event.Canary = result
+			sm.emitEvent(event)
+			if alerts != nil {
+				alert := NewEvent(EventCanaryAlert, 0)
+				alert.Relay = addr
+				alert.Canary = result
+				alert.Alerts = alerts
+				sm.emitEvent(alert)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+呼叫建立时给每个参与者下发排好序的relay候选列表（Invite/Accept的Info["relay_candidates"]），客户端不再需要内置relay列表：
+1. 最近确认过注册的relay排在前面，没确认过的排最后但仍保留，防止session manager自己的网络抖动把所有relay都排除
+2. 同等健康状况下，和参与者同区域的relay优先，再按GeoIP算出的距离由近到远（见geoip.go）
+3. 参与者的区域优先取他信令Info["region"]上报的；没上报时取他信令最近经过的relay的区域（config.RelayRegions）
+4. 排空中的relay不下发（见drain.go）
+*/
+
+const MaxRelayCandidates = 5
+
+//记下uid的信令是经哪个relay到达的
+func (sm *SessionManager) updateIngress(uid int64, addr *net.UDPAddr) {
+	if addr == nil {
+		return
+	}
+	relayAddr := addr.String()
+	if value, ok := sm.ingress.Get(uid); !ok || value.(string) != relayAddr {
+		sm.saveUserRelay(uid, relayAddr)
+	}
+	sm.ingress.Add(uid, relayAddr)
+}
+
+func (sm *SessionManager) updateRegion(signal *Signal) {
+	if region, ok := signal.Info["region"].(string); ok && region != "" {
+		sm.regions.Add(signal.From, region)
+	}
+}
+
+func (sm *SessionManager) regionOf(uid int64) string {
+	if value, ok := sm.regions.Get(uid); ok {
+		return value.(string)
+	}
+	if relayAddr := sm.relayOf(uid); relayAddr != "" {
+		return sm.relayRegions[relayAddr]
+	}
+	return ""
+}
+
+//每个ServerRegInterval都会重新注册，连着几个周期没确认就认为不可达
+func (sm *SessionManager) relayReachable(addr string, now time.Time) bool {
+	t, ok := sm.relayAcks[addr]
+	return ok && now.Sub(t) < 3*relay.ServerRegInterval
+}
+
+func (sm *SessionManager) relayCandidates(uid int64) []string {
+	type candidate struct {
+		addr      string
+		reachable bool
+		local     bool    //和参与者同区域
+		distance  float64 //km，不知道时为+Inf
+	}
+
+	now := time.Now()
+	region := sm.regionOf(uid)
+	client, located := sm.clientLocation(uid)
+	list := make([]candidate, 0, len(sm.relays))
+	for _, addr := range sm.tenantRelays(uid, sm.advertisedRelays(now)) {
+		c := candidate{
+			addr:      addr,
+			reachable: sm.relayReachable(addr, now),
+			local:     region != "" && sm.relayRegions[addr] == region,
+			distance:  math.Inf(1),
+		}
+		if located {
+			if l, ok := sm.relayLocation(addr); ok {
+				c.distance = client.Distance(l)
+			}
+		}
+		list = append(list, c)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.reachable != b.reachable {
+			return a.reachable
+		}
+		if a.local != b.local {
+			return a.local
+		}
+		return a.distance < b.distance
+	})
+
+	if len(list) > MaxRelayCandidates {
+		list = list[:MaxRelayCandidates]
+	}
+	candidates := make([]string, len(list))
+	for i, c := range list {
+		candidates[i] = c.addr
+	}
+	return candidates
+}
+
+//返回加上uid的relay候选后的Info，不修改原来的info
+func (sm *SessionManager) withRelayCandidates(info map[string]interface{}, uid int64) map[string]interface{} {
+	result := make(map[string]interface{}, len(info)+1)
+	for k, v := range info {
+		result[k] = v
+	}
+	result["relay_candidates"] = sm.relayCandidates(uid)
+	return result
+}
@@ -0,0 +1,35 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+relay在转来的信令上附带发送方的能力位图，这里按uid记下来，给这个uid发信令时据此决定用哪些新功能。
+没有记录的uid按老客户端处理。
+*/
+
+const SessionManagerCapabilities = relay.CapabilityTraceContext | relay.CapabilityProtoSignal | relay.CapabilityCompression
+
+func (sm *SessionManager) updateCapabilities(uid int64, msg *relay.Message) {
+	sm.capabilities.Add(uid, relay.CapabilitiesFromMessage(msg))
+}
+
+func (sm *SessionManager) capabilitiesOf(uid int64) uint32 {
+	value, ok := sm.capabilities.Get(uid)
+	if !ok {
+		return 0
+	}
+	return value.(uint32)
+}
+
+func (sm *SessionManager) supports(uid int64, capability uint32) bool {
+	return sm.capabilitiesOf(uid)&capability == capability
+}
@@ -0,0 +1,27 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+)
+
+//把relay.PacketCapture抓到的包按原始节奏交给主循环处理，需先Start。
+//每个包处理完才投递下一个，返回时所有包都已处理
+func (sm *SessionManager) Replay(path string, speed float64) (int, error) {
+	var loopErr error
+	count, err := relay.ReplayCapture(path, speed, func(packet *relay.ReceivedPacket) {
+		if loopErr == nil {
+			loopErr = sm.runInLoop(func() { sm.handlePacket(packet) })
+		}
+	})
+	if err == nil {
+		err = loopErr
+	}
+	return count, err
+}
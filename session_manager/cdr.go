@@ -0,0 +1,123 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+//通话记录（CDR），session删除时生成，写入cdr模块日志
+type CallRecord struct {
+	Sid       int64         `json:"sid"`
+	Mode      int           `json:"mode"`
+	StartTime time.Time     `json:"start"`
+	EndTime   time.Time     `json:"end"`
+	Legs      []CallLeg     `json:"legs"`
+	Relays    []*RelayStats `json:"relays,omitempty"`  //各relay最近一次上报的转发统计，见session_stats.go
+	Packets   int64         `json:"packets,omitempty"` //各relay转发的包数之和
+	Bytes     int64         `json:"bytes,omitempty"`
+}
+
+type CallLeg struct {
+	Uid       int64     `json:"uid"`
+	JoinTime  time.Time `json:"join"`  //从未接通时为零值
+	LeaveTime time.Time `json:"leave"` //从未接通时为零值
+	EndReason uint16    `json:"end_reason"`
+	Mos       float64   `json:"mos,omitempty"` //通话期间relay上报的平均MOS，没有上报过时不带，见quality.go
+}
+
+func NewCallRecord(session *Session) *CallRecord {
+	r := &CallRecord{
+		Sid:       session.Sid,
+		Mode:      session.Mode,
+		StartTime: session.CreateTime,
+		EndTime:   session.CreateTime,
+	}
+	for _, p := range session.Participants {
+		leg := CallLeg{
+			Uid:       p.Uid,
+			JoinTime:  p.JoinTime,
+			LeaveTime: p.LeaveTime,
+			EndReason: p.EndReason,
+		}
+		if p.Quality != nil {
+			leg.Mos = p.Quality.AvgMos
+		}
+		r.Legs = append(r.Legs, leg)
+		if p.LeaveTime.After(r.EndTime) {
+			r.EndTime = p.LeaveTime
+		}
+	}
+	if len(session.RelayStats) > 0 {
+		r.Relays = session.relayStats()
+		for _, st := range r.Relays {
+			r.Packets += st.Packets
+			r.Bytes += st.Bytes
+		}
+	}
+	return r
+}
+
+//信令里带的结束原因，老客户端不带时按挂断处理
+func endReasonOf(signal *Signal) uint16 {
+	if n, ok := signal.Info["reason"].(json.Number); ok {
+		if r, err := n.Int64(); err == nil && r > 0 && r <= 0xffff {
+			return uint16(r)
+		}
+	}
+	return YCKCallEndReasonHangup
+}
+
+func newEndSignal(to int64, sid int64, reason uint16) *Signal {
+	end := NewSignal(YCKCallSignalTypeEnd, SessionManagerUserId, to, sid)
+	end.Info = map[string]interface{}{"reason": reason}
+	return end
+}
+
+//结束session里还没结束的参与者并通知他们，写CDR后删除session
+func (sm *SessionManager) removeSession(session *Session, reason uint16) {
+	for _, p := range session.Participants {
+		if !p.InState(YCKParticipantStateIdle) {
+			if p.InState(YCKParticipantStateCalled) {
+				sm.reportMissedCall(session, p)
+			}
+			p.End(reason)
+			sm.sendSignal(newEndSignal(p.Uid, session.Sid, reason), false)
+		}
+	}
+	sm.reportParticipants(session)
+	sm.teardownRelaySession(session)
+	sm.recordCall(session)
+	if setupFailed(session) {
+		for _, r := range session.Relays {
+			sm.addAlertSample(AlertMetricSetupFailures, r, 1)
+		}
+	}
+	sm.countCallSeconds(session)
+	sm.keepBlackbox(session)
+	event := NewEvent(EventSessionEnded, session.Sid)
+	event.Record = NewCallRecord(session)
+	sm.emitEvent(event)
+	sm.removeGuests(session.Sid)
+	delete(sm.sessions, session.Sid)
+}
+
+func (sm *SessionManager) recordCall(session *Session) {
+	if len(session.Participants) == 0 {
+		return //只请求了sid，没有真正发起呼叫
+	}
+	data, err := json.Marshal(NewCallRecord(session))
+	if err != nil {
+		sm.log().Warn("cdr marshal error:", err)
+		return
+	}
+	logging.Module("cdr").Info("cdr ", string(data))
+}
@@ -0,0 +1,117 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+点击呼叫：业务后台（客服系统、预约回拨）通过管理接口POST /calls让session manager代为发起通话，双方都是被叫。
+1. session按caller请求sid的方式创建，租户、通话数上限、配额和最长时长都按caller算，callee必须在同一租户
+2. session manager作为虚拟主叫，用多方的member invite同时邀请双方，Invite的Info里caller为SessionManagerUserId，
+   peer为另一方，click_to_call为true；双方用多方模式的Accept/Reject/End应答，MemberState和普通多方通话相同
+3. 通话中仍可以用member_op邀请其他人；还在响铃或通话中的不到两方时（有人拒绝、超时或挂断），session结束，其他人收到End
+检查不通过时管理接口返回错误，不给双方发PolicyReject。
+*/
+
+type ClickToCallRequest struct {
+	Caller      int64
+	Callee      int64
+	CallType    string //"audio"或"video"，见invite.go
+	Name        string //来电显示的名称，如业务方的名字
+	MaxDuration int64  //秒，0为按config的上限
+}
+
+func (sm *SessionManager) originateCall(req *ClickToCallRequest) (*Session, error) {
+	if req.Caller <= 0 || req.Callee <= 0 || req.Caller == req.Callee {
+		return nil, errors.New("caller and callee must be two different uids")
+	}
+	if relay.TenantOf(req.Caller) != relay.TenantOf(req.Callee) {
+		return nil, fmt.Errorf("callee %d is not in the tenant of caller %d", req.Callee, req.Caller)
+	}
+	now := time.Now()
+	for _, checker := range sm.quotaCheckers {
+		if reason := checker.CheckQuota(req.Caller, now); reason != 0 {
+			return nil, fmt.Errorf("caller %d over quota, reason %d", req.Caller, reason)
+		}
+	}
+	for _, uid := range []int64{req.Caller, req.Callee} {
+		if limit := sm.callLimit(uid); limit > 0 && sm.activeCalls(uid, 0) >= limit {
+			return nil, fmt.Errorf("uid %d already in %d calls", uid, limit)
+		}
+	}
+	if reason := sm.checkCall(&CallRequest{Caller: req.Caller, Callee: req.Callee, CallType: req.CallType, Group: true}); reason != 0 {
+		return nil, fmt.Errorf("call to %d screened, reason %d", req.Callee, reason)
+	}
+	if reason := sm.checkCall(&CallRequest{Caller: req.Callee, Callee: req.Caller, CallType: req.CallType, Group: true}); reason != 0 {
+		return nil, fmt.Errorf("call to %d screened, reason %d", req.Caller, reason)
+	}
+
+	request := NewSignal(YCKCallSignalTypeSidRequest, req.Caller, SessionManagerUserId, 0)
+	request.Info = map[string]interface{}{}
+	if req.MaxDuration > 0 {
+		request.Info["max_duration"] = json.Number(strconv.FormatInt(req.MaxDuration, 10))
+	}
+	session := sm.newSession(request)
+	session.Mode = YCKCallModeMultiple
+	session.ClickToCall = true
+
+	invite := NewSignal(YCKCallSignalTypeInvite, SessionManagerUserId, SessionManagerUserId, session.Sid)
+	invite.Info = map[string]interface{}{"call_type": req.CallType}
+	if req.Name != "" {
+		invite.Info["name"] = req.Name
+	}
+	info := newInviteInfo(invite, session)
+	for _, uid := range []int64{req.Caller, req.Callee} {
+		peer := req.Callee
+		if uid == req.Callee {
+			peer = req.Caller
+		}
+		memberInfo := make(map[string]interface{}, len(info)+2)
+		for k, v := range info {
+			memberInfo[k] = v
+		}
+		memberInfo["peer"] = peer
+		memberInfo["click_to_call"] = true
+		if !sm.inviteMember(session, SessionManagerUserId, uid, memberInfo) {
+			sm.removeSession(session, YCKCallEndReasonHangup)
+			return nil, fmt.Errorf("invite to %d failed", uid)
+		}
+	}
+	sm.notifyMemberStateChange(session)
+	sm.log().Info("click to call from ", req.Caller, " to ", req.Callee, " in session ", session.Sid)
+	return session, nil
+}
+
+//点击呼叫的session里还在响铃或通话中的不到两方时结束session，在参与者状态变化之后调用
+func (sm *SessionManager) checkClickToCall(session *Session) {
+	if !session.ClickToCall || sm.sessions[session.Sid] != session {
+		return
+	}
+	var active int
+	reason := uint16(YCKCallEndReasonHangup)
+	for _, p := range session.Participants {
+		if !p.InState(YCKParticipantStateIdle) {
+			active++
+		} else if p.EndReason != YCKCallEndReasonUnknown {
+			reason = p.EndReason
+		}
+	}
+	if active >= 2 {
+		return
+	}
+	sm.log().Info("click to call session ", session.Sid, " ended, reason:", reason)
+	sm.removeSession(session, reason)
+}
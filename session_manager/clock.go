@@ -0,0 +1,54 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+与relay的时钟偏差，估算方法见relay/clock.go：每个housekeeping周期向relay注册时带上发送时间，
+收到UserRegReceived时按relay回带的时间估算。偏差超过relay.ClockSkewWarn时打告警，
+metrics事件和管理接口的relay状态里带上每个relay的偏差（毫秒，relay时钟减本机时钟）。
+客户端按relay的时钟校正信令时间戳，本机与relay差得太多时防重放的时间窗口会误判，排查时先看这里。
+*/
+
+func (sm *SessionManager) updateRelayClock(addr string, msg *relay.Message, received time.Time) {
+	clock := sm.relayClocks[addr]
+	if clock == nil {
+		clock = relay.NewClockSkew("relay " + addr)
+		if !clock.Update(msg, received) {
+			return //老relay不回带时间
+		}
+		sm.relayClocks[addr] = clock
+		return
+	}
+	clock.Update(msg, received)
+}
+
+//relay的时钟偏差，还没有样本时ok为false
+func (sm *SessionManager) relayClockSkew(addr string) (time.Duration, bool) {
+	clock := sm.relayClocks[addr]
+	if clock == nil {
+		return 0, false
+	}
+	return clock.Offset(), true
+}
+
+//relay地址 -> 偏差毫秒，用于metrics事件
+func (sm *SessionManager) relayClockSkews() map[string]int64 {
+	skews := make(map[string]int64)
+	for _, addr := range sm.relays {
+		if skew, ok := sm.relayClockSkew(addr); ok {
+			skews[addr] = int64(skew / time.Millisecond)
+		}
+	}
+	return skews
+}
@@ -0,0 +1,343 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+	"github.com/xujiajundd/ycng/relay"
+)
+
+type Config struct {
+	UdpAddr          string                   `toml:"udp_addr"`
+	AdminAddr        string                   `toml:"admin_addr"`    //管理接口监听地址，为空时不启动
+	AccessSecret     string                   `toml:"access_secret"` //与relay共享的token签名secret
+	OtlpEndpoint     string                   `toml:"otlp_endpoint"`
+	TraceSampleRatio float64                  `toml:"trace_sample_ratio"`
+	Relays           []string                 `toml:"relays"`             //为空时用内置的relay列表
+	CaptureFile      string                   `toml:"capture_file"`       //调试用，不为空时把收到的包都写入此文件
+	MaxCallsPerUser  int                      `toml:"max_calls_per_user"` //每个uid同时参与的通话数上限（如1个进行中+1个保持），0为不限制
+	RelayRegions     map[string]string        `toml:"relay_regions"`      //relay地址 -> 区域，用于给参与者排relay候选，见candidates.go
+	GeoipFile        string                   `toml:"geoip_file"`         //MaxMind City库文件，为空时不按地理位置排relay候选
+	StateFile        string                   `toml:"state_file"`         //停服时保存活跃session、启动时恢复，为空时停服即结束所有通话，见handoff.go
+	InboxSize        int                      `toml:"inbox_size"`         //收包队列长度，主循环处理不过来时超出的普通包被丢弃，见inbox.go
+	Store            string                   `toml:"store"`              //relay列表和用户路由的存储url，为空时不使用，见store.go
+	Webhooks         []string                 `toml:"webhooks"`           //session事件POST到这些url，见webhook.go
+	WebhookSecret    string                   `toml:"webhook_secret"`     //webhook的HMAC签名secret，为空时不签名
+	EventBus         []string                 `toml:"event_bus"`          //通话事件发布到这些nats或kafka的url，见events.go
+	AlertRules       []string                 `toml:"alert_rules"`        //按relay的质量告警规则，如"loss>0.05/1m"，见alerts.go
+	BlackboxSize     int                      `toml:"blackbox_size"`      //每个session保留最近多少条信令用于排查，0为不保留，见blackbox.go
+	MeshMax          int                      `toml:"mesh_max"`           //通话人数不超过此值时用p2p mesh，0为不用mesh，见topology.go
+	MixerMin         int                      `toml:"mixer_min"`          //通话人数达到此值时由relay混音，0为不混音
+	AuditFile        string                   `toml:"audit_file"`         //审计日志文件，为空时只保留在内存里，见relay/audit.go
+	Tenants          map[uint16]*TenantConfig `toml:"tenants"`            //租户 -> 单独的通话数上限、relay和配额，见tenant.go
+	QuotaSeconds     int64                    `toml:"quota_seconds"`      //每个uid每个计费周期的通话秒数上限，0为不限制，见quota.go
+	QuotaBytes       int64                    `toml:"quota_bytes"`        //每个uid每个计费周期的relay转发字节上限，0为不限制
+	PaceRate         int                      `toml:"pace_rate"`          //发往每个relay每秒最多的包数，超出的排队平滑发出，0为不限，见pacer.go
+	PaceGlobalRate   int                      `toml:"pace_global_rate"`   //发往所有relay合计每秒最多的包数，0为不限
+	Hotlines         map[int64][]int64        `toml:"hotlines"`           //热线uid -> 坐席uid，呼叫热线的主叫排队等空闲坐席，见queue.go
+	AdminUids        []int64                  `toml:"admin_uids"`         //可以发terminate信令强制结束session的uid，如内容审核的后台账号，见terminate.go
+	MaxDuration      int64                    `toml:"max_duration"`       //session从创建起最长的秒数，到时强制结束，0为不限制，见max_duration.go
+	CanaryInterval   int                      `toml:"canary_interval"`    //拨测的间隔秒数，0为不拨测，见canary.go
+	CanaryMaxSetup   int                      `toml:"canary_max_setup"`   //拨测建立通话超过这么多毫秒时告警，0为不检查
+	CanaryMaxLoss    float64                  `toml:"canary_max_loss"`    //拨测的媒体丢包率超过此值时告警，0为不检查
+	ObfuscationKeys  []string                 `toml:"obfuscation_keys"`   //混淆密钥"id:secret"，最后一个为当前密钥，应与relay相同，见relay/obfkey.go
+	ObfuscationGrace int                      `toml:"obfuscation_grace"`  //启动后多少秒内仍接受并使用前一个密钥
+	MaxVoicemail     int                      `toml:"max_voicemail"`      //1-1呼叫被拒接或无应答后主叫留言的最长秒数，0为不开启，见voicemail.go
+	PushTokenTtl     int                      `toml:"push_token_ttl"`     //推送token不重新登记时保留的最长秒数，0为不过期，见token.go
+	SignalMaxAge     int                      `toml:"signal_max_age"`     //信令从发出到处理的最长秒数，超过的丢弃，0为不检查，见signal_age.go
+	DedupSize        int                      `toml:"dedup_size"`         //信令去重缓存的条数，见dedup.go
+	DedupKey         string                   `toml:"dedup_key"`          //信令去重的key，payload或digest
+	MaxDatagram      int                      `toml:"max_datagram"`       //收发的UDP包最大字节数，0为不限制，见mtu.go
+	WatchdogTimeout  int                      `toml:"watchdog_timeout"`   //主循环或收包goroutine处理一项超过这么多秒时打出所有goroutine的栈，0为不检查
+	WatchdogExit     bool                     `toml:"watchdog_exit"`      //卡住时退出进程，由systemd等重启
+}
+
+func GetConfig(ctx *cli.Context) *Config {
+	config := GetDefaultConfig()
+	if ctx.GlobalIsSet("port") {
+		config.UdpAddr = fmt.Sprintf(":%d", ctx.GlobalInt("port"))
+	}
+	if ctx.GlobalIsSet("admin_addr") {
+		config.AdminAddr = ctx.GlobalString("admin_addr")
+	}
+	if ctx.GlobalIsSet("access_secret") {
+		config.AccessSecret = ctx.GlobalString("access_secret")
+	}
+	if ctx.GlobalIsSet("otlp_endpoint") {
+		config.OtlpEndpoint = ctx.GlobalString("otlp_endpoint")
+	}
+	if ctx.GlobalIsSet("obfuscation_keys") {
+		config.ObfuscationKeys = ctx.GlobalStringSlice("obfuscation_keys")
+	}
+	if ctx.GlobalIsSet("obfuscation_grace") {
+		config.ObfuscationGrace = ctx.GlobalInt("obfuscation_grace")
+	}
+	if ctx.GlobalIsSet("relays") {
+		config.Relays = ctx.GlobalStringSlice("relays")
+	}
+	if ctx.GlobalIsSet("capture_file") {
+		config.CaptureFile = ctx.GlobalString("capture_file")
+	}
+	if ctx.GlobalIsSet("audit_file") {
+		config.AuditFile = ctx.GlobalString("audit_file")
+	}
+	if ctx.GlobalIsSet("relay_regions") {
+		for _, s := range ctx.GlobalStringSlice("relay_regions") {
+			if i := strings.LastIndex(s, "="); i > 0 {
+				config.RelayRegions[s[:i]] = s[i+1:]
+			}
+		}
+	}
+	if ctx.GlobalIsSet("geoip_file") {
+		config.GeoipFile = ctx.GlobalString("geoip_file")
+	}
+	if ctx.GlobalIsSet("state_file") {
+		config.StateFile = ctx.GlobalString("state_file")
+	}
+	if ctx.GlobalIsSet("store") {
+		config.Store = ctx.GlobalString("store")
+	}
+	if ctx.GlobalIsSet("webhooks") {
+		config.Webhooks = ctx.GlobalStringSlice("webhooks")
+	}
+	if ctx.GlobalIsSet("alert_rules") {
+		config.AlertRules = ctx.GlobalStringSlice("alert_rules")
+	}
+	if ctx.GlobalIsSet("webhook_secret") {
+		config.WebhookSecret = ctx.GlobalString("webhook_secret")
+	}
+	if ctx.GlobalIsSet("event_bus") {
+		config.EventBus = ctx.GlobalStringSlice("event_bus")
+	}
+	if ctx.GlobalIsSet("blackbox_size") {
+		config.BlackboxSize = ctx.GlobalInt("blackbox_size")
+	}
+	if ctx.GlobalIsSet("mesh_max") {
+		config.MeshMax = ctx.GlobalInt("mesh_max")
+	}
+	if ctx.GlobalIsSet("mixer_min") {
+		config.MixerMin = ctx.GlobalInt("mixer_min")
+	}
+	if ctx.GlobalIsSet("inbox_size") {
+		config.InboxSize = ctx.GlobalInt("inbox_size")
+	}
+	if ctx.GlobalIsSet("max_calls_per_user") {
+		config.MaxCallsPerUser = ctx.GlobalInt("max_calls_per_user")
+	}
+	if ctx.GlobalIsSet("quota_seconds") {
+		config.QuotaSeconds = ctx.GlobalInt64("quota_seconds")
+	}
+	if ctx.GlobalIsSet("quota_bytes") {
+		config.QuotaBytes = ctx.GlobalInt64("quota_bytes")
+	}
+	if ctx.GlobalIsSet("max_duration") {
+		config.MaxDuration = ctx.GlobalInt64("max_duration")
+	}
+	if ctx.GlobalIsSet("canary_interval") {
+		config.CanaryInterval = ctx.GlobalInt("canary_interval")
+	}
+	if ctx.GlobalIsSet("max_voicemail") {
+		config.MaxVoicemail = ctx.GlobalInt("max_voicemail")
+	}
+	if ctx.GlobalIsSet("push_token_ttl") {
+		config.PushTokenTtl = ctx.GlobalInt("push_token_ttl")
+	}
+	if ctx.GlobalIsSet("signal_max_age") {
+		config.SignalMaxAge = ctx.GlobalInt("signal_max_age")
+	}
+	if ctx.GlobalIsSet("dedup_size") {
+		config.DedupSize = ctx.GlobalInt("dedup_size")
+	}
+	if ctx.GlobalIsSet("dedup_key") {
+		config.DedupKey = ctx.GlobalString("dedup_key")
+	}
+	if ctx.GlobalIsSet("max_datagram") {
+		config.MaxDatagram = ctx.GlobalInt("max_datagram")
+	}
+	if ctx.GlobalIsSet("watchdog_timeout") {
+		config.WatchdogTimeout = ctx.GlobalInt("watchdog_timeout")
+	}
+	if ctx.GlobalIsSet("watchdog_exit") {
+		config.WatchdogExit = ctx.GlobalBool("watchdog_exit")
+	}
+	if ctx.GlobalIsSet("pace_rate") {
+		config.PaceRate = ctx.GlobalInt("pace_rate")
+	}
+	if ctx.GlobalIsSet("pace_global_rate") {
+		config.PaceGlobalRate = ctx.GlobalInt("pace_global_rate")
+	}
+	config.SetTenantFlags(ctx.GlobalStringSlice("tenant_max_calls"), ctx.GlobalStringSlice("tenant_relays"))
+	return config
+}
+
+func GetDefaultConfig() *Config {
+	var config *Config
+
+	config = &Config{
+		UdpAddr:          ":20001",
+		TraceSampleRatio: 0.01,
+		MaxCallsPerUser:  2,
+		InboxSize:        4096,
+		PaceRate:         2000, //低于relay默认的每ip 3000包/秒
+		PaceGlobalRate:   8000,
+		BlackboxSize:     64,
+		MeshMax:          2,
+		MixerMin:         9,
+		CanaryMaxSetup:   3000,
+		CanaryMaxLoss:    0.05,
+		PushTokenTtl:     30 * 24 * 3600,
+		SignalMaxAge:     DefaultSignalMaxAge,
+		DedupSize:        DefaultDedupSize,
+		DedupKey:         DedupKeyPayload,
+		MaxDatagram:      relay.DefaultMaxDatagram,
+		WatchdogTimeout:  relay.DefaultWatchdogTimeout,
+		RelayRegions:     make(map[string]string),
+		Tenants:          make(map[uint16]*TenantConfig),
+	}
+	return config
+}
+
+//检查配置，返回发现的所有问题
+func (c *Config) Check() []error {
+	var errs []error
+	if _, err := net.ResolveUDPAddr("udp4", c.UdpAddr); err != nil {
+		errs = append(errs, fmt.Errorf("udp_addr %q: %v", c.UdpAddr, err))
+	}
+	if c.AdminAddr != "" {
+		if _, err := net.ResolveTCPAddr("tcp", c.AdminAddr); err != nil {
+			errs = append(errs, fmt.Errorf("admin_addr %q: %v", c.AdminAddr, err))
+		}
+	}
+	for _, r := range c.Relays {
+		if _, err := net.ResolveUDPAddr("udp4", r); err != nil {
+			errs = append(errs, fmt.Errorf("relay %q: %v", r, err))
+		}
+	}
+	for _, w := range c.Webhooks {
+		if u, err := url.Parse(w); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook %q is not an http(s) url", w))
+		}
+	}
+	for _, u := range c.EventBus {
+		if _, err := OpenEventPublisher(u); err != nil {
+			errs = append(errs, fmt.Errorf("event_bus %q: %v", u, err))
+		}
+	}
+	if c.GeoipFile != "" {
+		if _, err := os.Stat(c.GeoipFile); err != nil {
+			errs = append(errs, fmt.Errorf("geoip_file: %v", err))
+		}
+	}
+	if c.StateFile != "" {
+		if _, err := os.Stat(filepath.Dir(c.StateFile)); err != nil {
+			errs = append(errs, fmt.Errorf("state_file: %v", err))
+		}
+	}
+	for r := range c.RelayRegions {
+		if _, err := net.ResolveUDPAddr("udp4", r); err != nil {
+			errs = append(errs, fmt.Errorf("relay_regions %q: %v", r, err))
+		}
+	}
+	if c.MaxCallsPerUser < 0 {
+		errs = append(errs, fmt.Errorf("max_calls_per_user %d is negative", c.MaxCallsPerUser))
+	}
+	for id, t := range c.Tenants {
+		if id > relay.MaxTenant {
+			errs = append(errs, fmt.Errorf("tenant %d exceeds %d", id, relay.MaxTenant))
+		}
+		if t.MaxCallsPerUser < -1 {
+			errs = append(errs, fmt.Errorf("tenant %d max_calls_per_user %d is negative", id, t.MaxCallsPerUser))
+		}
+		for _, r := range t.Relays {
+			if _, err := net.ResolveUDPAddr("udp4", r); err != nil {
+				errs = append(errs, fmt.Errorf("tenant %d relay %q: %v", id, r, err))
+			}
+		}
+		if t.QuotaSeconds < 0 || t.QuotaBytes < 0 {
+			errs = append(errs, fmt.Errorf("tenant %d quota_seconds %d or quota_bytes %d is negative", id, t.QuotaSeconds, t.QuotaBytes))
+		}
+	}
+	if c.QuotaSeconds < 0 || c.QuotaBytes < 0 {
+		errs = append(errs, fmt.Errorf("quota_seconds %d or quota_bytes %d is negative", c.QuotaSeconds, c.QuotaBytes))
+	}
+	if c.MaxDuration < 0 {
+		errs = append(errs, fmt.Errorf("max_duration %d is negative", c.MaxDuration))
+	}
+	for _, key := range c.ObfuscationKeys {
+		if _, err := relay.ParseObfuscationKey(key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.ObfuscationGrace < 0 {
+		errs = append(errs, fmt.Errorf("obfuscation_grace %d is negative", c.ObfuscationGrace))
+	}
+	if c.CanaryInterval < 0 || c.CanaryMaxSetup < 0 || c.CanaryMaxLoss < 0 || c.CanaryMaxLoss > 1 {
+		errs = append(errs, fmt.Errorf("canary_interval %d, canary_max_setup %d or canary_max_loss %v out of range", c.CanaryInterval, c.CanaryMaxSetup, c.CanaryMaxLoss))
+	}
+	for _, rule := range c.AlertRules {
+		if _, err := ParseAlertRule(rule); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.MaxVoicemail < 0 || float64(c.MaxVoicemail) > relay.VoicemailMaxDuration.Seconds() {
+		errs = append(errs, fmt.Errorf("max_voicemail %d out of range, at most %v", c.MaxVoicemail, relay.VoicemailMaxDuration))
+	}
+	if c.PushTokenTtl < 0 {
+		errs = append(errs, fmt.Errorf("push_token_ttl %d is negative", c.PushTokenTtl))
+	}
+	if c.SignalMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("signal_max_age %d is negative", c.SignalMaxAge))
+	}
+	if c.DedupSize < 1 {
+		errs = append(errs, fmt.Errorf("dedup_size %d must be positive", c.DedupSize))
+	}
+	if err := checkDedupKey(c.DedupKey); err != nil {
+		errs = append(errs, err)
+	}
+	if c.MaxDatagram < 0 || (c.MaxDatagram > 0 && c.MaxDatagram < relay.MaxSignalPayload) {
+		errs = append(errs, fmt.Errorf("max_datagram %d out of range, at least %d or 0 for unlimited", c.MaxDatagram, relay.MaxSignalPayload))
+	}
+	if c.WatchdogTimeout < 0 {
+		errs = append(errs, fmt.Errorf("watchdog_timeout %d is negative", c.WatchdogTimeout))
+	}
+	if c.BlackboxSize < 0 {
+		errs = append(errs, fmt.Errorf("blackbox_size %d is negative", c.BlackboxSize))
+	}
+	if c.MeshMax < 0 || c.MixerMin < 0 {
+		errs = append(errs, fmt.Errorf("mesh_max %d or mixer_min %d is negative", c.MeshMax, c.MixerMin))
+	} else if c.MixerMin > 0 && c.MixerMin <= c.MeshMax {
+		errs = append(errs, fmt.Errorf("mixer_min %d must be greater than mesh_max %d", c.MixerMin, c.MeshMax))
+	}
+	if c.PaceRate < 0 || c.PaceGlobalRate < 0 {
+		errs = append(errs, fmt.Errorf("pace_rate %d or pace_global_rate %d is negative", c.PaceRate, c.PaceGlobalRate))
+	}
+	for hotline, agents := range c.Hotlines {
+		if len(agents) == 0 {
+			errs = append(errs, fmt.Errorf("hotline %d has no agents", hotline))
+		}
+		for _, agent := range agents {
+			if agent == hotline || relay.TenantOf(agent) != relay.TenantOf(hotline) {
+				errs = append(errs, fmt.Errorf("hotline %d agent %d must be another uid in the same tenant", hotline, agent))
+			}
+		}
+	}
+	if c.InboxSize < 1 {
+		errs = append(errs, fmt.Errorf("inbox_size %d must be positive", c.InboxSize))
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("trace_sample_ratio %v not in [0, 1]", c.TraceSampleRatio))
+	}
+	return errs
+}
@@ -0,0 +1,108 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils"
+)
+
+/*
+信令去重：同一信令会经多个relay到达（客户端多路径发送、relay重发），收到时先按key去重，见过的直接丢弃。
+1. 缓存条数为Config.DedupSize，条目DedupTtl后过期，只需覆盖同一信令经不同relay到达的时间差。
+   条数不够时未过期的条目被挤出，同一信令再到达就会被重复处理
+2. key由Config.DedupKey决定：
+   payload：整个信令payload，准确，但每条占用和信令一样大的内存，信令大时内存多
+   digest：payload的sha256的前16字节，每条占用的内存固定，同样的内存可以存更多条，碰撞的概率可忽略
+3. 命中（重复的信令）、未命中、挤出和过期的计数见metrics事件的dedup和管理接口GET /dedup。
+   evictions持续增长说明条目没过期就被挤出了，应调大dedup_size
+*/
+
+const (
+	DefaultDedupSize = 10000
+	DedupTtl         = time.Minute
+
+	DedupKeyPayload = "payload"
+	DedupKeyDigest  = "digest"
+)
+
+type DedupStats struct {
+	Size        int    `json:"size"`
+	Len         int    `json:"len"`
+	Key         string `json:"key"`
+	Hits        uint64 `json:"hits"` //重复的信令数
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"` //未过期就被挤出的条数
+	Expirations uint64 `json:"expirations"`
+}
+
+type SignalDedup struct {
+	cache *utils.LRU
+	size  int
+	key   string
+}
+
+//size不大于0时用DefaultDedupSize，key为空时用DedupKeyPayload
+func NewSignalDedup(size int, key string) *SignalDedup {
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+	if key == "" {
+		key = DedupKeyPayload
+	}
+	return &SignalDedup{
+		cache: utils.NewLRUWithTTL(size, DedupTtl, nil),
+		size:  size,
+		key:   key,
+	}
+}
+
+func checkDedupKey(key string) error {
+	switch key {
+	case "", DedupKeyPayload, DedupKeyDigest:
+		return nil
+	}
+	return fmt.Errorf("dedup_key %q must be %s or %s", key, DedupKeyPayload, DedupKeyDigest)
+}
+
+func (d *SignalDedup) keyOf(payload []byte) interface{} {
+	if d.key == DedupKeyDigest {
+		sum := sha256.Sum256(payload)
+		var digest [16]byte
+		copy(digest[:], sum[:])
+		return digest
+	}
+	return string(payload)
+}
+
+//payload见过时返回true，没见过的记下来
+func (d *SignalDedup) Seen(payload []byte) bool {
+	key := d.keyOf(payload)
+	if _, ok := d.cache.Get(key); ok {
+		return true
+	}
+	d.cache.Add(key, true)
+	return false
+}
+
+//缓存有自己的锁，可以在主循环外调用
+func (d *SignalDedup) Stats() DedupStats {
+	stats := d.cache.Stats()
+	return DedupStats{
+		Size:        d.size,
+		Len:         d.cache.Len(),
+		Key:         d.key,
+		Hits:        stats.Hits,
+		Misses:      stats.Misses,
+		Evictions:   stats.Evictions,
+		Expirations: stats.Expirations,
+	}
+}
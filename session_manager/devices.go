@@ -0,0 +1,49 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+多设备响铃，relay端见relay/devices.go：
+1. 发给参与者的信令，在他还没确定设备时（被叫响铃阶段）不指定设备，relay送到他的所有设备，所以Invite会让所有设备响铃
+2. 参与者发起Invite或Accept时记下所用的设备（信令消息extra里的设备id），之后发给他的信令都指定这个设备
+3. 在一个设备上Accept后，给他不指定设备地发CancelOtherDevices，Info["device"]为接听的设备，其他设备停止响铃，
+   接听的设备收到后忽略
+4. 老客户端不带设备id，Device为""，行为和以前一样
+5. 通话中切换设备见handover.go
+*/
+
+//参与者接听，记下设备并让他的其他设备停止响铃
+func (sm *SessionManager) acceptOnDevice(session *Session, p *Participant, device string) {
+	p.Device = device
+	if device == "" {
+		return
+	}
+	cancel := NewSignal(YCKCallSignalTypeCancelOtherDevices, SessionManagerUserId, p.Uid, session.Sid)
+	cancel.Info = map[string]interface{}{"device": device}
+	sm.sendSignal(cancel, false)
+}
+
+//发给msg.To的信令要送到的设备，""表示所有设备
+func (sm *SessionManager) deviceOf(msg *relay.Message) string {
+	signal := NewSignalTemp()
+	if signal.Unmarshal(msg.Payload) != nil || signal.Signal == YCKCallSignalTypeCancelOtherDevices {
+		return ""
+	}
+	session := sm.sessions[signal.SessionId]
+	if session == nil {
+		return ""
+	}
+	if p := session.Participants[msg.To]; p != nil {
+		return p.Device
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"net"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+relay排空（见relay/drain.go）：
+1. relay进入排空时、以及排空期间每次回复重新注册时，发来UdpMessageTypeRelayDrain，session manager记下时间
+2. 排空中的relay不再出现在下发给客户端的relay候选里，已经在用它的通话不受影响
+3. 收到恢复通知，或连着几个周期没再收到排空通知（relay已重启），就重新下发
+4. 所有relay都在排空时仍然照常下发，总比客户端没有relay可用好
+*/
+
+func (sm *SessionManager) handleRelayDrain(msg *relay.Message, addr *net.UDPAddr) {
+	if addr == nil || len(msg.Payload) < 1 {
+		return
+	}
+	key := addr.String()
+	if msg.Payload[0] == relay.RelayDrainOn {
+		if _, ok := sm.relayDrains[key]; !ok {
+			sm.log().Warn("relay ", key, " draining, stop advertising it")
+		}
+		sm.relayDrains[key] = time.Now()
+	} else {
+		delete(sm.relayDrains, key)
+		sm.log().Info("relay ", key, " leaves draining")
+	}
+}
+
+func (sm *SessionManager) relayDraining(addr string, now time.Time) bool {
+	t, ok := sm.relayDrains[addr]
+	return ok && now.Sub(t) < 3*relay.ServerRegInterval
+}
+
+//可以下发给客户端的relay
+func (sm *SessionManager) advertisedRelays(now time.Time) []string {
+	relays := make([]string, 0, len(sm.relays))
+	for _, addr := range sm.relays {
+		if !sm.relayDraining(addr, now) {
+			relays = append(relays, addr)
+		}
+	}
+	if len(relays) == 0 {
+		return sm.relays
+	}
+	return relays
+}
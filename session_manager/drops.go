@@ -0,0 +1,69 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+被丢弃的信令：session manager不处理一个信令时记下原因，方便客户端排查信令为什么没有效果。
+1. 按原因累计次数（重启清零），随metrics事件的signal_drops发出
+2. 发送方的能力位图带relay.CapabilitySignalNack时，回他一个Nack信令，Info带signal（被丢弃的信令类型）、
+   ts（被丢弃信令的ts）和reason（下面的原因码）。解析失败和重放的信令不回，前者不知道发送方，后者不应该让重放者得到回应
+3. 重复的信令（同一信令经多个relay到达）是正常情况，不算丢弃
+*/
+
+const (
+	SignalDropUnmarshal    = 1  //解析失败
+	SignalDropReplayed     = 2  //重放或时间戳过旧，见relay/replay.go
+	SignalDropForbidden    = 3  //访客或租户不允许，见guest.go、tenant.go
+	SignalDropIncorrect    = 4  //缺少必需的Info
+	SignalDropNoSid        = 5  //除了sid请求都必须带sid
+	SignalDropNoSession    = 6  //session不存在或已结束
+	SignalDropModeMismatch = 7  //多方session收到1-1信令，或1-1 session收到member_op以外的多方信令
+	SignalDropUnsupported  = 8  //这种session不处理这个信令
+	SignalDropState        = 9  //发送方当前的状态不允许这个信令，如不在响铃时accept
+	SignalDropExpired      = 10 //迟到的信令超过了时效，见signal_age.go
+	SignalDropLate         = 11 //序号已经处理过或被跳过，见sequence.go
+)
+
+var signalDropNames = map[uint16]string{
+	SignalDropUnmarshal:    "unmarshal",
+	SignalDropReplayed:     "replayed",
+	SignalDropForbidden:    "forbidden",
+	SignalDropIncorrect:    "incorrect",
+	SignalDropNoSid:        "no_sid",
+	SignalDropNoSession:    "no_session",
+	SignalDropModeMismatch: "mode_mismatch",
+	SignalDropUnsupported:  "unsupported",
+	SignalDropState:        "state",
+	SignalDropExpired:      "expired",
+	SignalDropLate:         "late",
+}
+
+//signal为nil时只计数
+func (sm *SessionManager) dropSignal(signal *Signal, reason uint16) {
+	sm.signalDrops[reason]++
+	if signal == nil || reason == SignalDropReplayed || signal.From <= 0 || !sm.supports(signal.From, relay.CapabilitySignalNack) {
+		return
+	}
+	nack := NewSignal(YCKCallSignalTypeNack, SessionManagerUserId, signal.From, signal.SessionId)
+	nack.Info = map[string]interface{}{"signal": signal.Signal, "ts": signal.Timestamp, "reason": reason}
+	sm.sendSignal(nack, false)
+	sm.log().Debug("nack signal ", signal.Signal, " from ", signal.From, " reason:", signalDropNames[reason])
+}
+
+//原因名 -> 累计次数
+func (sm *SessionManager) signalDropCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	for reason, n := range sm.signalDrops {
+		counts[signalDropNames[reason]] = n
+	}
+	return counts
+}
@@ -0,0 +1,31 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/utils/errs"
+)
+
+/*
+错误分类，同relay/errors.go：处理收包和发信令出错时用errs.Wrap加上上下文，交给reportError打日志并按类别计数，
+计数见管理接口/errors。收包goroutine也会调用，计数是原子的。
+*/
+
+//打日志并按类别计数，err为nil时什么也不做
+func (sm *SessionManager) reportError(err *errs.Error) {
+	if err == nil {
+		return
+	}
+	sm.errorCounts.Add(err)
+	sm.log().Warn(err.Kind, " error: ", err)
+}
+
+//各类别的错误数
+func (sm *SessionManager) ErrorCounts() map[string]uint64 {
+	return sm.errorCounts.Snapshot()
+}
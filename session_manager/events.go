@@ -0,0 +1,333 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/loadtest"
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+通话事件：外部系统（CRM、统计、计费）通过事件集成，不再扫日志。
+1. 事件：session.created、participant.joined（进入incall，离开后再进入会再发）、participant.left、
+   session.ended（带CDR，停服交接的session不算结束，见handoff.go）、call.missed（未接来电，见missed.go）、
+   metrics（每个housekeeping周期一次的运行指标）、usage（计费用量的增量，见quota.go）、
+   relay.down/relay.up（relay写失败熔断和恢复，见breaker.go）、canary/canary.alert（拨测结果和告警，见canary.go）、
+   session.relay_switched（通话中迁移relay，见migration.go）、alert/alert.resolved（relay的质量告警和恢复，见alerts.go）、
+   presence.online/presence.offline（用户上线和下线，见presence.go）
+2. 发布方实现EventPublisher，主循环里调用Publish，必须不阻塞：
+   webhook（见webhook.go）适合少量事件；量大时用消息总线，由config.EventBus的url选择：
+     nats://[user:password@]host:port[/subject]      subject默认ycng.events，实际发到subject.事件类型，见events_nats.go
+     kafka://host:port[,host:port...]/topic          按sid分区，同一session的事件有序，见events_kafka.go
+3. 消息总线的事件先进队列，后台goroutine按批发送，失败重连并按EventBusRetryDelay指数退避重试，
+   重试EventBusRetries次仍失败则丢弃这一批；队列满时丢弃新事件。可能重复投递，消费方按事件id去重
+*/
+
+const (
+	EventSessionCreated    = "session.created"
+	EventParticipantJoined = "participant.joined"
+	EventParticipantLeft   = "participant.left"
+	EventSessionEnded      = "session.ended"
+	EventMissedCall        = "call.missed"
+	EventMetrics           = "metrics"
+	EventUsage             = "usage"
+	EventRelayDown         = "relay.down" //写relay连续失败而熔断，见breaker.go
+	EventRelayUp           = "relay.up"   //熔断的relay探测成功
+	EventCanary            = "canary"
+	EventCanaryAlert       = "canary.alert"
+	EventVoicemailRecorded = "voicemail.recorded"
+	EventRelaySwitched     = "session.relay_switched" //通话中的session迁移到了新relay，见migration.go
+	EventAlert             = "alert"                  //relay的质量指标超出告警规则的阈值，见alerts.go
+	EventAlertResolved     = "alert.resolved"
+	EventPresenceOnline    = "presence.online" //用户在第一个relay上注册，见presence.go
+	EventPresenceOffline   = "presence.offline"
+
+	EventBusQueueSize   = 4096
+	EventBusBatchSize   = 100
+	EventBusTimeout     = 5 * time.Second
+	EventBusRetries     = 3
+	EventBusRetryDelay  = time.Second
+	EventBusStopTimeout = 5 * time.Second
+)
+
+type Event struct {
+	Id       string                  `json:"id"`
+	Type     string                  `json:"type"`
+	Time     time.Time               `json:"time"`
+	Sid      int64                   `json:"sid,omitempty"`
+	Uid      int64                   `json:"uid,omitempty"`       //participant事件的参与者，call.missed的被叫，presence事件的用户
+	Reason   uint16                  `json:"reason,omitempty"`    //participant.left的结束原因
+	Record   *CallRecord             `json:"cdr,omitempty"`       //session.ended的通话记录
+	Metrics  *Metrics                `json:"metrics,omitempty"`   //metrics事件的指标
+	Caller   int64                   `json:"caller,omitempty"`    //call.missed的主叫
+	CallType string                  `json:"call_type,omitempty"` //call.missed的通话类型，见invite.go
+	Group    bool                    `json:"group,omitempty"`     //call.missed是否多方通话
+	Period   string                  `json:"period,omitempty"`    //usage事件的计费周期
+	Usage    map[string]*relay.Usage `json:"usage,omitempty"`     //usage事件的uid和租户 -> 增量
+	Relay    string                  `json:"relay,omitempty"`     //relay.down/up、canary和alert事件的relay地址，session.relay_switched的新relay，presence事件的relay
+	Canary   *loadtest.CanaryResult  `json:"canary,omitempty"`    //canary事件的拨测结果
+	Alerts   []string                `json:"alerts,omitempty"`    //canary.alert事件超出阈值的项
+	File     string                  `json:"file,omitempty"`      //voicemail.recorded的留言在relay上的文件位置
+	Duration int64                   `json:"duration,omitempty"`  //voicemail.recorded的留言时长，毫秒
+	Alert    *Alert                  `json:"alert,omitempty"`     //alert和alert.resolved事件的规则和当前值
+}
+
+type Metrics struct {
+	Sessions        int                       `json:"sessions"`
+	InCall          int                       `json:"in_call"` //incall的参与者数
+	Guests          int                       `json:"guests"`
+	RelaysReachable int                       `json:"relays_reachable"`
+	Relays          int                       `json:"relays"`
+	PunchAttempts   int                       `json:"punch_attempts"`
+	PunchSuccesses  int                       `json:"punch_successes"`
+	Inbox           InboxStats                `json:"inbox"`
+	Dedup           DedupStats                `json:"dedup"`          //见dedup.go
+	Tenants         map[uint16]*TenantMetrics `json:"tenants"`        //租户 -> session和通话人数，见tenant.go
+	ClockSkews      map[string]int64          `json:"clock_skews_ms"` //relay地址 -> relay时钟减本机时钟的毫秒数，见clock.go
+	SignalDrops     map[string]int64          `json:"signal_drops"`   //丢弃信令的原因 -> 累计次数，见drops.go
+}
+
+func NewEvent(eventType string, sid int64) *Event {
+	return &Event{
+		Id:   fmt.Sprintf("%016x", rand.Int63()),
+		Type: eventType,
+		Time: time.Now(),
+		Sid:  sid,
+	}
+}
+
+type EventPublisher interface {
+	Start()
+	Publish(event *Event) //不阻塞
+	Stop()                //尽量把已发布的事件发完
+}
+
+var errEventBusScheme = errors.New("unsupported event bus url, want nats://host:port/subject or kafka://host:port/topic")
+
+func OpenEventPublisher(url string) (EventPublisher, error) {
+	var sink eventSink
+	var err error
+	switch {
+	case strings.HasPrefix(url, "nats://"):
+		sink, err = newNatsSink(url)
+	case strings.HasPrefix(url, "kafka://"):
+		sink, err = newKafkaSink(url)
+	default:
+		err = errEventBusScheme
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newBusPublisher(sink), nil
+}
+
+func (sm *SessionManager) emitEvent(event *Event) {
+	for _, publisher := range sm.publishers {
+		publisher.Publish(event)
+	}
+}
+
+//参与者进出incall时发participant.joined/left并调用状态回调（见hooks.go），在参与者状态变化之后调用。
+//没有订阅者和回调时也要记下Joined，之后才加的订阅者和回调仍能收到这些参与者的离开
+func (sm *SessionManager) reportParticipants(session *Session) {
+	notify := len(sm.publishers) > 0 || len(sm.stateHooks) > 0
+	for _, p := range session.Participants {
+		inCall := p.InState(YCKParticipantStateIncall)
+		if inCall == p.Joined {
+			continue
+		}
+		p.Joined = inCall
+		if !notify {
+			continue
+		}
+		if inCall {
+			event := NewEvent(EventParticipantJoined, session.Sid)
+			event.Uid = p.Uid
+			sm.emitEvent(event)
+			sm.hookAccepted(session, p.Uid)
+		} else {
+			event := NewEvent(EventParticipantLeft, session.Sid)
+			event.Uid = p.Uid
+			event.Reason = p.EndReason
+			sm.emitEvent(event)
+			sm.hookEnded(session, p.Uid, p.EndReason)
+		}
+	}
+}
+
+func (sm *SessionManager) reportMetrics() {
+	if len(sm.publishers) == 0 {
+		return
+	}
+	now := time.Now()
+	metrics := &Metrics{
+		Sessions:       len(sm.sessions),
+		Guests:         len(sm.guests),
+		Relays:         len(sm.relays),
+		PunchAttempts:  sm.punchAttempts,
+		PunchSuccesses: sm.punchSuccesses,
+		Inbox:          sm.inbox.Stats(),
+		Dedup:          sm.dedup.Stats(),
+		Tenants:        sm.tenantMetrics(),
+		ClockSkews:     sm.relayClockSkews(),
+		SignalDrops:    sm.signalDropCounts(),
+	}
+	for _, session := range sm.sessions {
+		for _, p := range session.Participants {
+			if p.InState(YCKParticipantStateIncall) {
+				metrics.InCall++
+			}
+		}
+	}
+	for _, addr := range sm.relays {
+		if sm.relayReachable(addr, now) {
+			metrics.RelaysReachable++
+		}
+	}
+	event := NewEvent(EventMetrics, 0)
+	event.Metrics = metrics
+	sm.emitEvent(event)
+}
+
+//编码好的事件，key用于kafka分区
+type encodedEvent struct {
+	key     int64
+	subject string //事件类型，nats拼在subject后面
+	body    []byte
+}
+
+//消息总线的连接，只在busPublisher的goroutine里调用
+type eventSink interface {
+	send(events []encodedEvent) error //出错后sink自己断开，下次send时重连
+	close()
+	String() string //日志用，不含密码
+}
+
+type busPublisher struct {
+	sink       eventSink
+	queue      chan encodedEvent
+	retryDelay time.Duration
+
+	lock    sync.Mutex
+	closed  bool
+	dropped uint64
+
+	stop chan struct{} //停服超时后中止重试
+	done chan struct{}
+}
+
+func newBusPublisher(sink eventSink) *busPublisher {
+	return &busPublisher{
+		sink:       sink,
+		queue:      make(chan encodedEvent, EventBusQueueSize),
+		retryDelay: EventBusRetryDelay,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (b *busPublisher) Start() {
+	go b.run()
+}
+
+func (b *busPublisher) Stop() {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.queue)
+	b.lock.Unlock()
+
+	select {
+	case <-b.done:
+	case <-time.After(EventBusStopTimeout):
+		logging.Logger.Warn("event bus ", b.sink, " not drained in ", EventBusStopTimeout)
+		close(b.stop)
+		<-b.done
+	}
+}
+
+func (b *busPublisher) Publish(event *Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logging.Logger.Warn("event marshal error:", err)
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- encodedEvent{key: event.Sid, subject: event.Type, body: body}:
+	default:
+		b.dropped++
+		logging.Logger.Warn("event bus queue full, drop ", event.Type, " of session ", event.Sid)
+	}
+}
+
+func (b *busPublisher) Dropped() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.dropped
+}
+
+func (b *busPublisher) run() {
+	defer close(b.done)
+	defer b.sink.close()
+	for event := range b.queue {
+		batch := []encodedEvent{event}
+	fill:
+		for len(batch) < EventBusBatchSize {
+			select {
+			case e, ok := <-b.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+		b.deliver(batch)
+	}
+}
+
+func (b *busPublisher) deliver(batch []encodedEvent) {
+	delay := b.retryDelay
+	for attempt := 0; ; attempt++ {
+		err := b.sink.send(batch)
+		if err == nil {
+			return
+		}
+		if attempt >= EventBusRetries {
+			logging.Logger.Warn("event bus ", b.sink, " drop ", len(batch), " events after ", attempt+1, " attempts:", err)
+			b.lock.Lock()
+			b.dropped += uint64(len(batch))
+			b.lock.Unlock()
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-b.stop:
+			return
+		}
+		delay *= 2
+	}
+}
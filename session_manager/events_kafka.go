@@ -0,0 +1,413 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+kafka发布，只用到Metadata(v4)和Produce(v3)两个请求，自己实现，不引入客户端库，要求broker为kafka 1.0及以上：
+1. 第一次发送或出错后，依次向url里的broker请求topic的metadata，得到各分区的leader
+2. 事件按sid取模选分区，同一session的事件进同一分区保持有序；一批里同一leader的分区合成一个Produce请求，acks=1
+3. 每个分区一个RecordBatch(magic 2)，不压缩，key为sid的十进制串
+4. 任何错误都断开所有连接并丢弃metadata，由busPublisher重试，重试时重新取metadata（leader切换等）。
+   一批里已成功的分区也会重发，消费方按事件id去重
+*/
+
+const (
+	kafkaApiProduce      = 0
+	kafkaApiMetadata     = 3
+	kafkaProduceVersion  = 3
+	kafkaMetadataVersion = 4
+	kafkaClientId        = "ycng-session-manager"
+	kafkaMaxResponse     = 16 << 20
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaSink struct {
+	brokers     []string
+	topic       string
+	correlation int32
+
+	partitions []int32          //按分区号排序，为nil表示需要重新取metadata
+	leaders    map[int32]string //分区 -> leader地址
+	conns      map[string]net.Conn
+	readers    map[string]*bufio.Reader
+}
+
+func newKafkaSink(rawurl string) (*kafkaSink, error) {
+	rest := strings.TrimPrefix(rawurl, "kafka://")
+	i := strings.Index(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return nil, errEventBusScheme
+	}
+	k := &kafkaSink{
+		topic:   rest[i+1:],
+		conns:   make(map[string]net.Conn),
+		readers: make(map[string]*bufio.Reader),
+	}
+	for _, broker := range strings.Split(rest[:i], ",") {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			return nil, fmt.Errorf("incorrect kafka broker %q: %v", broker, err)
+		}
+		k.brokers = append(k.brokers, broker)
+	}
+	return k, nil
+}
+
+func (k *kafkaSink) String() string {
+	return "kafka://" + strings.Join(k.brokers, ",") + "/" + k.topic
+}
+
+func (k *kafkaSink) send(events []encodedEvent) error {
+	if k.partitions == nil {
+		if err := k.refreshMetadata(); err != nil {
+			k.close()
+			return err
+		}
+	}
+	byLeader := make(map[string]map[int32][]encodedEvent)
+	for _, e := range events {
+		partition := k.partitions[uint64(e.key)%uint64(len(k.partitions))]
+		leader := k.leaders[partition]
+		if byLeader[leader] == nil {
+			byLeader[leader] = make(map[int32][]encodedEvent)
+		}
+		byLeader[leader][partition] = append(byLeader[leader][partition], e)
+	}
+	for leader, partitions := range byLeader {
+		if err := k.produce(leader, partitions); err != nil {
+			k.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *kafkaSink) close() {
+	for addr, conn := range k.conns {
+		conn.Close()
+		delete(k.conns, addr)
+		delete(k.readers, addr)
+	}
+	k.partitions = nil
+	k.leaders = nil
+}
+
+func (k *kafkaSink) refreshMetadata() error {
+	e := &kafkaEncoder{}
+	e.int32(1)
+	e.string(k.topic)
+	e.int8(1) //allow_auto_topic_creation
+	var lastErr error
+	for _, broker := range k.brokers {
+		resp, err := k.roundTrip(broker, kafkaApiMetadata, kafkaMetadataVersion, e.Bytes())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err = k.parseMetadata(resp); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func (k *kafkaSink) parseMetadata(resp []byte) error {
+	d := &kafkaDecoder{data: resp}
+	d.int32() //throttle_time_ms
+	nodes := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() //rack
+		nodes[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() //cluster_id
+	d.int32()  //controller_id
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code := d.int16()
+		name := d.string()
+		d.int8() //is_internal
+		var partitions []int32
+		leaders := make(map[int32]string)
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			d.int16() //分区的error_code，以leader是否可用为准
+			partition := d.int32()
+			leader := d.int32()
+			d.int32Array() //replica_nodes
+			d.int32Array() //isr_nodes
+			if addr, ok := nodes[leader]; ok {
+				partitions = append(partitions, partition)
+				leaders[partition] = addr
+			}
+		}
+		if d.err != nil || name != k.topic {
+			continue
+		}
+		if code != 0 {
+			return fmt.Errorf("kafka: topic %s error %d", k.topic, code)
+		}
+		if len(partitions) == 0 {
+			return fmt.Errorf("kafka: topic %s has no available leader", k.topic)
+		}
+		sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+		k.partitions = partitions
+		k.leaders = leaders
+		return nil
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return fmt.Errorf("kafka: topic %s not in metadata", k.topic)
+}
+
+func (k *kafkaSink) produce(addr string, partitions map[int32][]encodedEvent) error {
+	now := time.Now()
+	e := &kafkaEncoder{}
+	e.int16(-1) //transactional_id为null
+	e.int16(1)  //acks
+	e.int32(int32(EventBusTimeout / time.Millisecond))
+	e.int32(1)
+	e.string(k.topic)
+	e.int32(int32(len(partitions)))
+	for partition, events := range partitions {
+		e.int32(partition)
+		batch := kafkaRecordBatch(events, now)
+		e.int32(int32(len(batch)))
+		e.Write(batch)
+	}
+	resp, err := k.roundTrip(addr, kafkaApiProduce, kafkaProduceVersion, e.Bytes())
+	if err != nil {
+		return err
+	}
+	d := &kafkaDecoder{data: resp}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			partition := d.int32()
+			code := d.int16()
+			d.int64() //base_offset
+			d.int64() //log_append_time
+			if code != 0 && d.err == nil {
+				return fmt.Errorf("kafka: produce to %s/%d error %d", k.topic, partition, code)
+			}
+		}
+	}
+	return d.err
+}
+
+func (k *kafkaSink) roundTrip(addr string, apiKey, version int16, body []byte) ([]byte, error) {
+	conn := k.conns[addr]
+	if conn == nil {
+		var err error
+		if conn, err = net.DialTimeout("tcp", addr, EventBusTimeout); err != nil {
+			return nil, err
+		}
+		k.conns[addr] = conn
+		k.readers[addr] = bufio.NewReader(conn)
+	}
+	k.correlation++
+	e := &kafkaEncoder{}
+	e.int32(0) //长度，最后填
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(k.correlation)
+	e.string(kafkaClientId)
+	e.Write(body)
+	req := e.Bytes()
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+
+	conn.SetDeadline(time.Now().Add(EventBusTimeout))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(k.readers[addr], header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > kafkaMaxResponse {
+		return nil, fmt.Errorf("kafka: incorrect response size %d", size)
+	}
+	if correlation := int32(binary.BigEndian.Uint32(header[4:])); correlation != k.correlation {
+		return nil, fmt.Errorf("kafka: correlation id %d, want %d", correlation, k.correlation)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(k.readers[addr], resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+//RecordBatch v2，事件时间都用now
+func kafkaRecordBatch(events []encodedEvent, now time.Time) []byte {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	records := &kafkaEncoder{}
+	for i, event := range events {
+		key := strconv.FormatInt(event.key, 10)
+		r := &kafkaEncoder{}
+		r.int8(0)   //attributes
+		r.varint(0) //timestamp_delta
+		r.varint(int64(i))
+		r.varint(int64(len(key)))
+		r.WriteString(key)
+		r.varint(int64(len(event.body)))
+		r.Write(event.body)
+		r.varint(0) //headers
+		records.varint(int64(r.Len()))
+		records.Write(r.Bytes())
+	}
+
+	//crc覆盖attributes到结尾
+	c := &kafkaEncoder{}
+	c.int16(0) //attributes，不压缩
+	c.int32(int32(len(events) - 1))
+	c.int64(timestamp)
+	c.int64(timestamp)
+	c.int64(-1) //producer_id
+	c.int16(-1) //producer_epoch
+	c.int32(-1) //base_sequence
+	c.int32(int32(len(events)))
+	c.Write(records.Bytes())
+
+	b := &kafkaEncoder{}
+	b.int64(0) //base_offset，由broker分配
+	b.int32(int32(4 + 1 + 4 + c.Len()))
+	b.int32(-1) //partition_leader_epoch
+	b.int8(2)   //magic
+	b.int32(int32(crc32.Checksum(c.Bytes(), crc32c)))
+	b.Write(c.Bytes())
+	return b.Bytes()
+}
+
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+//zigzag varint，和kafka的一致
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+var errKafkaShort = errors.New("kafka: response too short")
+
+//出错后err不再变化，后续读取都返回零值
+type kafkaDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = errKafkaShort
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+//null返回""
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) int32Array() []int32 {
+	n := d.int32()
+	if n < 0 || int(n) > len(d.data)/4 {
+		if n > 0 {
+			d.err = errKafkaShort
+		}
+		return nil
+	}
+	values := make([]int32, n)
+	for i := range values {
+		values[i] = d.int32()
+	}
+	return values
+}
@@ -0,0 +1,158 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+nats发布，只用到协议里的INFO/CONNECT/PUB/PING/PONG，自己实现，不引入客户端库：
+1. 连接后读INFO，发CONNECT（url里的用户名密码，或只有用户名时作为token）
+2. 一批事件逐个PUB到subject.事件类型，最后发PING并等到PONG，确认服务端都收到了
+3. 批之间不读连接，服务端的PING在下一批时回PONG；空闲太久被服务端断开时，下一批发送失败后重连
+*/
+
+const DefaultNatsSubject = "ycng.events"
+
+type natsSink struct {
+	addr     string
+	subject  string
+	user     string
+	password string
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newNatsSink(rawurl string) (*natsSink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errEventBusScheme
+	}
+	n := &natsSink{addr: u.Host, subject: strings.Trim(u.Path, "/")}
+	if n.subject == "" {
+		n.subject = DefaultNatsSubject
+	}
+	if strings.ContainsAny(n.subject, " \t\r\n") {
+		return nil, fmt.Errorf("incorrect nats subject %q", n.subject)
+	}
+	if u.User != nil {
+		n.user = u.User.Username()
+		n.password, _ = u.User.Password()
+	}
+	return n, nil
+}
+
+func (n *natsSink) String() string {
+	return "nats://" + n.addr + "/" + n.subject
+}
+
+func (n *natsSink) send(events []encodedEvent) error {
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+	if err := n.publish(events); err != nil {
+		n.close()
+		return err
+	}
+	return nil
+}
+
+func (n *natsSink) publish(events []encodedEvent) error {
+	n.conn.SetDeadline(time.Now().Add(EventBusTimeout))
+	w := bufio.NewWriter(n.conn)
+	for _, e := range events {
+		fmt.Fprintf(w, "PUB %s.%s %d\r\n", n.subject, e.subject, len(e.body))
+		w.Write(e.body)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return n.waitPong()
+}
+
+func (n *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", n.addr, EventBusTimeout)
+	if err != nil {
+		return err
+	}
+	n.conn = conn
+	n.reader = bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(EventBusTimeout))
+	line, err := n.reader.ReadString('\n')
+	if err != nil {
+		n.close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		n.close()
+		return fmt.Errorf("nats: expect INFO, got %q", strings.TrimSpace(line))
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "ycng-session-manager", "lang": "go"}
+	if n.password != "" {
+		options["user"] = n.user
+		options["pass"] = n.password
+	} else if n.user != "" {
+		options["auth_token"] = n.user
+	}
+	data, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", data); err != nil {
+		n.close()
+		return err
+	}
+	//认证失败时服务端回-ERR而不是PONG
+	if err := n.waitPong(); err != nil {
+		n.close()
+		return err
+	}
+	return nil
+}
+
+func (n *natsSink) waitPong() error {
+	for {
+		line, err := n.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + line)
+		}
+		//+OK、INFO等忽略
+	}
+}
+
+func (n *natsSink) close() {
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+		n.reader = nil
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"math"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+GeoIP：relay在转来的信令上附带发送方的公网ip，session manager查出经纬度，给他排relay候选时按距离由近到远。
+relay的位置用同一个库按relay地址查。GeoLocator可替换，默认用MaxMind的GeoLite2/GeoIP2 City库（config.GeoipFile）。
+*/
+
+type GeoLocator interface {
+	Locate(ip net.IP) (Location, bool)
+}
+
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+const earthRadiusKm = 6371
+
+//两点间的大圆距离，km
+func (l Location) Distance(o Location) float64 {
+	lat1 := l.Latitude * math.Pi / 180
+	lat2 := o.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (o.Longitude - l.Longitude) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+type MaxMindLocator struct {
+	reader *geoip2.Reader
+}
+
+func NewMaxMindLocator(path string) (*MaxMindLocator, error) {
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindLocator{reader: reader}, nil
+}
+
+func (m *MaxMindLocator) Locate(ip net.IP) (Location, bool) {
+	city, err := m.reader.City(ip)
+	if err != nil || (city.Location.Latitude == 0 && city.Location.Longitude == 0) {
+		return Location{}, false //内网地址等查不到的，库里是0,0
+	}
+	return Location{Latitude: city.Location.Latitude, Longitude: city.Location.Longitude}, true
+}
+
+func (m *MaxMindLocator) Close() error {
+	return m.reader.Close()
+}
+
+//替换GeoIP实现，需在Start之前调用，nil为关闭
+func (sm *SessionManager) SetGeoLocator(locator GeoLocator) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.geo = locator
+	sm.relayLocations = make(map[string]*Location)
+}
+
+func (sm *SessionManager) updateClientIp(uid int64, msg *relay.Message) {
+	if ip := relay.ClientIpFromMessage(msg); ip != nil {
+		sm.clientIps.Add(uid, ip)
+	}
+}
+
+func (sm *SessionManager) clientLocation(uid int64) (Location, bool) {
+	if sm.geo == nil {
+		return Location{}, false
+	}
+	value, ok := sm.clientIps.Get(uid)
+	if !ok {
+		return Location{}, false
+	}
+	return sm.geo.Locate(value.(net.IP))
+}
+
+//relay地址是固定的，查过一次就记下来，查不到的记nil
+func (sm *SessionManager) relayLocation(addr string) (Location, bool) {
+	if sm.geo == nil {
+		return Location{}, false
+	}
+	location, ok := sm.relayLocations[addr]
+	if !ok {
+		if udpAddr, err := net.ResolveUDPAddr("udp4", addr); err == nil {
+			if l, found := sm.geo.Locate(udpAddr.IP); found {
+				location = &l
+			}
+		}
+		sm.relayLocations[addr] = location
+	}
+	if location == nil {
+		return Location{}, false
+	}
+	return *location, true
+}
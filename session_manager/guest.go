@@ -0,0 +1,102 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/base64"
+	"math/rand"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+访客：web访客链接由业务后台通过管理接口为某个session申请临时uid，访客不需要账号即可入会。
+1. 临时uid取GuestUidBase以上的区间，不会和正式账号冲突，租户与session相同
+2. 临时uid只能发所属sid的信令（以及续期access token），不能请求sid，也不能注册push token
+3. session结束时（过期、被kill、停服）一起失效；relay的access token按正常TTL过期
+*/
+
+const GuestUidBase = int64(1) << 62
+
+type Guest struct {
+	Uid        int64
+	Sid        int64
+	CreateTime time.Time
+}
+
+func IsGuestUid(uid int64) bool {
+	return uid >= GuestUidBase
+}
+
+//为sid生成一个临时uid，开了access控制时同时签发relay的access token，session不存在时返回nil
+func (sm *SessionManager) createGuest(sid int64) (*Guest, []byte) {
+	if sm.sessions[sid] == nil {
+		return nil, nil
+	}
+	var uid int64
+	for {
+		uid = GuestUidBase | relay.TenantId(relay.TenantOf(sid), rand.Int63())
+		if sm.guests[uid] == nil {
+			break
+		}
+	}
+	guest := &Guest{Uid: uid, Sid: sid, CreateTime: time.Now()}
+	sm.guests[uid] = guest
+
+	var token []byte
+	if sm.accessSecret != "" {
+		token = relay.IssueAccessToken(sm.accessSecret, uid, time.Now().Add(relay.AccessTokenTTL))
+	}
+	sm.log().Info("guest ", uid, " created for session ", sid)
+	return guest, token
+}
+
+//访客只能在自己的session里活动，非访客总是放行
+func (sm *SessionManager) checkGuest(signal *Signal) bool {
+	if !IsGuestUid(signal.From) {
+		return true
+	}
+	guest := sm.guests[signal.From]
+	if guest == nil {
+		sm.log().Warn("drop signal ", signal.Signal, " from unknown or expired guest ", signal.From)
+		return false
+	}
+	if signal.Signal == YCKCallSignalTypeAccessTokenRequest {
+		return true
+	}
+	if signal.SessionId != guest.Sid {
+		sm.log().Warn("drop signal ", signal.Signal, " from guest ", signal.From, " for session ", signal.SessionId, " bound to ", guest.Sid)
+		return false
+	}
+	return true
+}
+
+func (sm *SessionManager) removeGuests(sid int64) {
+	for uid, guest := range sm.guests {
+		if guest.Sid == sid {
+			delete(sm.guests, uid)
+		}
+	}
+}
+
+type GuestInfo struct {
+	Uid    int64  `json:"uid"`
+	Sid    int64  `json:"sid"`
+	Token  string `json:"token,omitempty"` //base64，relay未开access控制时为空
+	Expire int64  `json:"expire,omitempty"`
+}
+
+func newGuestInfo(guest *Guest, token []byte) *GuestInfo {
+	info := &GuestInfo{Uid: guest.Uid, Sid: guest.Sid}
+	if token != nil {
+		info.Token = base64.StdEncoding.EncodeToString(token)
+		info.Expire = guest.CreateTime.Add(relay.AccessTokenTTL).Unix()
+	}
+	return info
+}
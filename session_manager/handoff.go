@@ -0,0 +1,275 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+停服交接：session manager目前没有集群，交接给的是接替它的下一个实例（重启或滚动发布），通过config.StateFile：
+1. 停服时把活跃session（参与者状态、relay、录制、访客等）写入StateFile，给非idle的参与者发ServerMaintenance，
+   Info["retry_after"]为建议的重连等待秒数。relay上的session不受影响，媒体照常转发，客户端不要挂断，
+   等待后重新注册、发MemberStateRequest对齐状态
+2. 新实例启动时读回StateFile，超过MaxHandoffAge的视为过期丢弃；读完即删除，防止再次启动时重复恢复
+3. 呼叫中(called)参与者的无应答定时不恢复，由session空闲超时兜底
+4. 没配StateFile或写入失败时，和以前一样以ServerShutdown结束所有通话
+*/
+
+const (
+	MaintenanceRetryAfter = 5 * time.Second
+	MaxHandoffAge         = 2 * time.Minute
+)
+
+type handoffState struct {
+	SavedAt  time.Time          `json:"saved_at"`
+	Sessions []*SessionSnapshot `json:"sessions"`
+	Guests   []*Guest           `json:"guests"`
+}
+
+type SessionSnapshot struct {
+	Sid           int64                  `json:"sid"`
+	Mode          int                    `json:"mode"`
+	Relays        []string               `json:"relays"`
+	Nickname      string                 `json:"nickname,omitempty"`
+	CallType      string                 `json:"call_type,omitempty"`
+	Recording     bool                   `json:"recording,omitempty"`
+	RecordBy      int64                  `json:"record_by,omitempty"`
+	ActiveSpeaker int64                  `json:"active_speaker,omitempty"`
+	RelayControl  string                 `json:"relay_control,omitempty"`
+	Key           string                 `json:"key,omitempty"`
+	RingGroup     bool                   `json:"ring_group,omitempty"`
+	ClickToCall   bool                   `json:"click_to_call,omitempty"`
+	MaxDuration   time.Duration          `json:"max_duration,omitempty"`
+	CreateTime    time.Time              `json:"create_time"`
+	Rooms         []string               `json:"rooms,omitempty"`
+	Publishers    []int64                `json:"publishers,omitempty"`
+	Owner         int64                  `json:"owner,omitempty"`
+	Locked        bool                   `json:"locked,omitempty"`
+	Moderators    []int64                `json:"moderators,omitempty"`
+	RelayStats    []*RelayStats          `json:"relay_stats,omitempty"`
+	Participants  []*ParticipantSnapshot `json:"participants"`
+}
+
+type ParticipantSnapshot struct {
+	Uid       int64      `json:"uid"`
+	State     uint16     `json:"state"`
+	Event     uint16     `json:"event"`
+	EndReason uint16     `json:"end_reason,omitempty"`
+	JoinTime  time.Time  `json:"join_time"`
+	LeaveTime time.Time  `json:"leave_time"`
+	Held      bool       `json:"held,omitempty"`
+	Device    string     `json:"device,omitempty"`
+	Caller    int64      `json:"caller,omitempty"`
+	MediaCaps *MediaCaps `json:"media_caps,omitempty"`
+	Restrict  uint8      `json:"restrict,omitempty"`
+	Room      uint8      `json:"room,omitempty"`
+	Quality   *Quality   `json:"quality,omitempty"`
+}
+
+func NewSessionSnapshot(session *Session) *SessionSnapshot {
+	s := &SessionSnapshot{
+		Sid:           session.Sid,
+		Mode:          session.Mode,
+		Relays:        append([]string(nil), session.Relays...),
+		Nickname:      session.Nickname,
+		CallType:      session.CallType,
+		Recording:     session.Recording,
+		RecordBy:      session.RecordBy,
+		ActiveSpeaker: session.ActiveSpeaker,
+		RelayControl:  session.RelayControl,
+		Key:           session.Key,
+		RingGroup:     session.RingGroup,
+		ClickToCall:   session.ClickToCall,
+		MaxDuration:   session.MaxDuration,
+		CreateTime:    session.CreateTime,
+		Rooms:         append([]string(nil), session.Rooms...),
+		Owner:         session.Owner,
+		Locked:        session.Locked,
+	}
+	for uid := range session.Publishers {
+		s.Publishers = append(s.Publishers, uid)
+	}
+	sort.Slice(s.Publishers, func(i, j int) bool { return s.Publishers[i] < s.Publishers[j] })
+	for uid := range session.Moderators {
+		s.Moderators = append(s.Moderators, uid)
+	}
+	sort.Slice(s.Moderators, func(i, j int) bool { return s.Moderators[i] < s.Moderators[j] })
+	if len(session.RelayStats) > 0 {
+		s.RelayStats = session.relayStats()
+	}
+	for _, p := range session.Participants {
+		s.Participants = append(s.Participants, &ParticipantSnapshot{
+			Uid:       p.Uid,
+			State:     p.State,
+			Event:     p.Event,
+			EndReason: p.EndReason,
+			JoinTime:  p.JoinTime,
+			LeaveTime: p.LeaveTime,
+			Held:      p.Held,
+			Device:    p.Device,
+			Caller:    p.Caller,
+			MediaCaps: p.MediaCaps,
+			Restrict:  p.Restrict,
+			Room:      p.Room,
+			Quality:   p.Quality,
+		})
+	}
+	sort.Slice(s.Participants, func(i, j int) bool { return s.Participants[i].Uid < s.Participants[j].Uid })
+	return s
+}
+
+func (s *SessionSnapshot) Restore(now time.Time) *Session {
+	session := NewSession(s.Sid)
+	session.Mode = s.Mode
+	session.Relays = s.Relays
+	session.Nickname = s.Nickname
+	session.CallType = s.CallType
+	session.Recording = s.Recording
+	session.RecordBy = s.RecordBy
+	session.ActiveSpeaker = s.ActiveSpeaker
+	session.RelayControl = s.RelayControl
+	session.Key = s.Key
+	session.RingGroup = s.RingGroup
+	session.ClickToCall = s.ClickToCall
+	session.MaxDuration = s.MaxDuration
+	session.CreateTime = s.CreateTime
+	session.Rooms = s.Rooms
+	session.Owner = s.Owner
+	session.Locked = s.Locked
+	for _, uid := range s.Moderators {
+		if session.Moderators == nil {
+			session.Moderators = make(map[int64]bool)
+		}
+		session.Moderators[uid] = true
+	}
+	for _, st := range s.RelayStats {
+		if session.RelayStats == nil {
+			session.RelayStats = make(map[string]*RelayStats)
+		}
+		session.RelayStats[st.Relay] = st
+	}
+	if s.Publishers != nil {
+		session.Publishers = make(map[int64]bool, len(s.Publishers))
+		for _, uid := range s.Publishers {
+			session.Publishers[uid] = true
+		}
+	}
+	session.LastActiveTime = now
+	for _, ps := range s.Participants {
+		p := NewParticipant(ps.Uid)
+		p.State = ps.State
+		p.Event = ps.Event
+		p.EndReason = ps.EndReason
+		p.JoinTime = ps.JoinTime
+		p.LeaveTime = ps.LeaveTime
+		p.Held = ps.Held
+		p.Device = ps.Device
+		p.Caller = ps.Caller
+		p.MediaCaps = ps.MediaCaps
+		p.Restrict = ps.Restrict
+		p.Room = ps.Room
+		p.Quality = ps.Quality
+		p.Joined = p.InState(YCKParticipantStateIncall) //停服前已经报过加入
+		p.LastStateTime = now
+		session.Participants[p.Uid] = p
+	}
+	return session
+}
+
+//停服时调用：能交接就保存并通知参与者稍后重连，否则结束所有通话
+func (sm *SessionManager) shutdownSessions() {
+	if sm.stateFile != "" && len(sm.sessions) > 0 {
+		if err := sm.saveSessions(sm.stateFile); err != nil {
+			sm.log().Error("save sessions for handoff error:", err)
+		} else {
+			sm.log().Info("saved ", len(sm.sessions), " sessions to ", sm.stateFile, " for handoff")
+			for _, session := range sm.sessions {
+				sm.notifyMaintenance(session)
+			}
+			return
+		}
+	}
+	for _, session := range sm.sessions {
+		sm.removeSession(session, YCKCallEndReasonServerShutdown)
+	}
+}
+
+func (sm *SessionManager) notifyMaintenance(session *Session) {
+	for _, p := range session.Participants {
+		if !p.InState(YCKParticipantStateIdle) {
+			signal := NewSignal(YCKCallSignalTypeServerMaintenance, SessionManagerUserId, p.Uid, session.Sid)
+			signal.Info = make(map[string]interface{})
+			signal.Info["retry_after"] = int(MaintenanceRetryAfter / time.Second)
+			sm.sendSignal(signal, false)
+		}
+	}
+}
+
+func (sm *SessionManager) saveSessions(path string) error {
+	state := &handoffState{SavedAt: time.Now()}
+	for _, session := range sm.sessions {
+		state.Sessions = append(state.Sessions, NewSessionSnapshot(session))
+	}
+	for _, guest := range sm.guests {
+		state.Guests = append(state.Guests, guest)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	//先写临时文件再改名，停服中途被杀也不会留下半个文件
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//启动时恢复上一个实例交接的session，返回恢复的个数
+func (sm *SessionManager) restoreSessions(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			sm.log().Error("read handoff state error:", err)
+		}
+		return 0
+	}
+	if err := os.Remove(path); err != nil {
+		sm.log().Error("remove handoff state error:", err)
+	}
+
+	var state handoffState
+	if err := json.Unmarshal(data, &state); err != nil {
+		sm.log().Error("handoff state unmarshal error:", err)
+		return 0
+	}
+	now := time.Now()
+	if now.Sub(state.SavedAt) > MaxHandoffAge {
+		sm.log().Warn("drop handoff state saved at ", state.SavedAt, ", too old")
+		return 0
+	}
+
+	for _, s := range state.Sessions {
+		session := s.Restore(now)
+		sm.sessions[session.Sid] = session
+		sm.scheduleSessionExpiry(session, SessionIdleTimeout)
+		sm.scheduleMaxDuration(session)
+	}
+	for _, guest := range state.Guests {
+		if sm.sessions[guest.Sid] != nil {
+			sm.guests[guest.Uid] = guest
+		}
+	}
+	sm.log().Info("restored ", len(state.Sessions), " sessions handed off at ", state.SavedAt)
+	return len(state.Sessions)
+}
@@ -0,0 +1,61 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+通话切换设备，设备见devices.go：
+1. 用户在新设备上（同一uid）发Handover给session manager，信令extra带新设备id，要求他正在通话中，且通话所在的设备已知
+2. session manager把参与者的设备改为新设备，通过UdpMessageTypeHandoverControl通知session的relay，
+   relay此后只接受新设备的TurnReg，并丢弃旧地址来的媒体，见relay/handover.go
+3. 回复Handover给新设备，Info带relays和relay候选，新设备TurnReg后开始收发媒体
+4. 给旧设备发End，reason=handover。参与者状态不变，不发participant事件，对方不感知
+*/
+
+func (sm *SessionManager) handleHandover(signal *Signal, session *Session) {
+	p := session.Participants[signal.From]
+	if p == nil || !p.InState(YCKParticipantStateIncall) {
+		sm.log().Warn("handover from ", signal.From, " not in call of session ", session.Sid)
+		return
+	}
+	if signal.Device == "" || p.Device == "" {
+		sm.log().Warn("handover of ", signal.From, " in session ", session.Sid, " without device, from ", p.Device, " to ", signal.Device)
+		return
+	}
+	old := p.Device
+	if signal.Device != old {
+		p.Device = signal.Device
+		p.HasChange = true
+		sm.log().Info("participant ", p.Uid, " of session ", session.Sid, " handover from ", old, " to ", p.Device)
+		sm.sendHandoverControl(session, p)
+
+		end := newEndSignal(p.Uid, session.Sid, YCKCallEndReasonHandover)
+		payload, err := end.Marshal()
+		if err == nil {
+			msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, p.Uid, 0, payload, nil)
+			sm.sendSignalMessageToDevice(msg, old, false)
+		} else {
+			sm.log().Warn("signal marshal error:", err)
+		}
+	}
+
+	//重发的Handover也回复，新设备可能没收到上一次的回复
+	reply := NewSignal(YCKCallSignalTypeHandover, SessionManagerUserId, p.Uid, session.Sid)
+	reply.Info = sm.withRelayCandidates(nil, p.Uid)
+	reply.Info["relays"] = session.Relays
+	reply.Info = withSessionKey(reply.Info, session)
+	sm.sendSignal(reply, false)
+}
+
+func (sm *SessionManager) sendHandoverControl(session *Session, p *Participant) {
+	msg := relay.NewMessage(relay.UdpMessageTypeHandoverControl, SessionManagerUserId, session.Sid, 0, relay.NewHandoverControlPayload(p.Uid, p.Device), nil)
+	sm.sendMessageToSessionRelays(msg, session)
+}
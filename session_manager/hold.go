@@ -0,0 +1,52 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+保持/恢复：
+1. 通话中的参与者发Hold/Resume，保持的是自己这一路（呼叫等待时接听新来电前先保持原通话）
+2. session manager记录参与者的Held，通过UdpMessageTypeHoldControl通知session的relay暂停/恢复他的媒体转发
+3. 1-1模式下把信令转给对方；多方模式下发MemberState，其中held=1表示被保持
+4. 重发的Hold/Resume照常处理，保证对方和relay最终一致
+*/
+
+func (sm *SessionManager) handleHoldSignal(signal *Signal, session *Session) {
+	p := session.Participants[signal.From]
+	if p == nil || !p.InState(YCKParticipantStateIncall) {
+		sm.log().Warn("hold signal from ", signal.From, " not in call of session ", session.Sid)
+		sm.dropSignal(signal, SignalDropState)
+		return
+	}
+
+	p.Held = signal.Signal == YCKCallSignalTypeHold
+	p.HasChange = true
+	sm.log().Info("participant ", p.Uid, " of session ", session.Sid, " held:", p.Held)
+	sm.sendHoldControl(session, p)
+
+	if session.Mode == YCKCallModeOneToOne && signal.To != SessionManagerUserId {
+		if session.Participants[signal.To] == nil {
+			return
+		}
+		sm.sendSignal(signal, false)
+	} else {
+		sm.notifyMemberStateChange(session)
+	}
+}
+
+func (sm *SessionManager) sendHoldControl(session *Session, p *Participant) {
+	control := byte(relay.HoldControlResume)
+	if p.Held {
+		control = relay.HoldControlHold
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeHoldControl, SessionManagerUserId, session.Sid, 0, relay.NewHoldControlPayload(p.Uid, control), nil)
+	sm.sendMessageToSessionRelays(msg, session)
+}
@@ -0,0 +1,52 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+/*
+参与者状态变化的回调：嵌入session manager的应用（计费、日志、反欺诈）在Start之前用AddStateHooks注册，
+不需要改handleMessageUserSignal。
+1. OnAccepted：参与者进入incall，1-1双方各一次，多方的发起人和每个接听的成员各一次
+2. OnEnded：参与者离开incall，reason见YCKCallEndReason*，session结束时还在通话中的也会收到
+3. OnKicked：多方通话中by用member_op踢出uid，之后uid还会收到OnEnded
+回调在主循环里、状态改完之后调用，session只读，不能阻塞；不需要的回调留nil。
+与participant.joined/left事件同时触发，事件发给外部系统，回调给进程内的代码。
+*/
+
+type StateHooks struct {
+	OnAccepted func(session *Session, uid int64)
+	OnEnded    func(session *Session, uid int64, reason uint16)
+	OnKicked   func(session *Session, by int64, uid int64)
+}
+
+func (sm *SessionManager) AddStateHooks(hooks *StateHooks) {
+	sm.stateHooks = append(sm.stateHooks, hooks)
+}
+
+func (sm *SessionManager) hookAccepted(session *Session, uid int64) {
+	for _, h := range sm.stateHooks {
+		if h.OnAccepted != nil {
+			h.OnAccepted(session, uid)
+		}
+	}
+}
+
+func (sm *SessionManager) hookEnded(session *Session, uid int64, reason uint16) {
+	for _, h := range sm.stateHooks {
+		if h.OnEnded != nil {
+			h.OnEnded(session, uid, reason)
+		}
+	}
+}
+
+func (sm *SessionManager) hookKicked(session *Session, by int64, uid int64) {
+	for _, h := range sm.stateHooks {
+		if h.OnKicked != nil {
+			h.OnKicked(session, by, uid)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+收包队列：收包goroutine和主循环之间的有界FIFO，主循环处理不过来时收包不再阻塞（阻塞会让socket缓冲区溢出，丢包不可控）。
+1. 队列满时丢最老的普通包，保持先后顺序不变（同一session的信令不能乱序）
+2. 关键包不因为普通包而被丢：Accept/End/Cancel/Reject/Busy这些决定通话结果的信令，以及relay的注册回复、排空通知。
+   关键包最多占到两倍容量，再多就只能丢新来的了
+3. 分片的信令在收包时不知道类型，按普通包处理
+4. 丢包计数通过管理接口GET /inbox查看，发生丢包时最多每InboxDropLogInterval打一次日志
+*/
+
+const InboxDropLogInterval = 10 * time.Second
+
+type InboxStats struct {
+	Length          int    `json:"length"`
+	Capacity        int    `json:"capacity"`
+	MaxLength       int    `json:"max_length"` //启动以来的最大长度
+	Dropped         uint64 `json:"dropped"`
+	DroppedCritical uint64 `json:"dropped_critical"`
+}
+
+type inboxPacket struct {
+	packet   *relay.ReceivedPacket
+	critical bool
+}
+
+type Inbox struct {
+	lock    sync.Mutex
+	packets []inboxPacket
+	ready   chan struct{} //有包可取，容量1
+
+	stats       InboxStats
+	lastDropLog time.Time
+	loggedDrops uint64
+}
+
+func NewInbox(capacity int) *Inbox {
+	return &Inbox{
+		packets: make([]inboxPacket, 0, capacity),
+		ready:   make(chan struct{}, 1),
+		stats:   InboxStats{Capacity: capacity},
+	}
+}
+
+func (q *Inbox) Ready() <-chan struct{} {
+	return q.ready
+}
+
+func (q *Inbox) Push(packet *relay.ReceivedPacket, critical bool) {
+	q.lock.Lock()
+	if len(q.packets) >= q.stats.Capacity && !q.dropOldestNormal() {
+		if !critical || len(q.packets) >= 2*q.stats.Capacity {
+			q.countDrop(critical)
+			q.lock.Unlock()
+			utils.PutPacketBuffer(packet.Body)
+			return
+		}
+	}
+	q.packets = append(q.packets, inboxPacket{packet: packet, critical: critical})
+	if len(q.packets) > q.stats.MaxLength {
+		q.stats.MaxLength = len(q.packets)
+	}
+	q.lock.Unlock()
+	q.notify()
+}
+
+//取一个包，没有时返回nil
+func (q *Inbox) Pop() *relay.ReceivedPacket {
+	q.lock.Lock()
+	if len(q.packets) == 0 {
+		q.lock.Unlock()
+		return nil
+	}
+	packet := q.packets[0].packet
+	q.packets[0] = inboxPacket{}
+	q.packets = q.packets[1:]
+	if len(q.packets) == 0 {
+		q.packets = q.packets[:0:0] //底层数组只会往后移，空了就重新分配
+	}
+	more := len(q.packets) > 0
+	q.lock.Unlock()
+	if more {
+		q.notify()
+	}
+	return packet
+}
+
+func (q *Inbox) Stats() InboxStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := q.stats
+	stats.Length = len(q.packets)
+	return stats
+}
+
+func (q *Inbox) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+//调用时持有锁
+func (q *Inbox) dropOldestNormal() bool {
+	for i, p := range q.packets {
+		if !p.critical {
+			utils.PutPacketBuffer(p.packet.Body)
+			copy(q.packets[i:], q.packets[i+1:])
+			q.packets[len(q.packets)-1] = inboxPacket{}
+			q.packets = q.packets[:len(q.packets)-1]
+			q.countDrop(false)
+			return true
+		}
+	}
+	return false
+}
+
+//调用时持有锁
+func (q *Inbox) countDrop(critical bool) {
+	q.stats.Dropped++
+	if critical {
+		q.stats.DroppedCritical++
+	}
+	now := time.Now()
+	if now.Sub(q.lastDropLog) >= InboxDropLogInterval {
+		logging.Logger.Warn("session manager overloaded, dropped ", q.stats.Dropped-q.loggedDrops, " packets in ", now.Sub(q.lastDropLog).Round(time.Second),
+			", total ", q.stats.Dropped, " (critical ", q.stats.DroppedCritical, ")")
+		q.lastDropLog = now
+		q.loggedDrops = q.stats.Dropped
+	}
+}
+
+//收包时判断是否关键包，只解混淆和解析信令头，不做其他处理
+func isCriticalPacket(data []byte) bool {
+	msg, err := relay.NewMessageFromObfuscatedData(data)
+	if err != nil {
+		return false
+	}
+	switch msg.MsgType {
+	case relay.UdpMessageTypeUserRegReceived, relay.UdpMessageTypeRelayDrain, relay.UdpMessageTypeVoicemailDone:
+		return true
+	case relay.UdpMessageTypeUserSignal:
+		if msg.HasFlag(relay.UdpMessageFlagFragment) || msg.HasFlag(relay.UdpMessageFlagGZip) {
+			return false
+		}
+		signal := NewSignalTemp()
+		if signal.UnmarshalMessage(msg) != nil {
+			return false
+		}
+		switch signal.Signal {
+		case YCKCallSignalTypeAccept, YCKCallSignalTypeEnd, YCKCallSignalTypeCancel, YCKCallSignalTypeReject, YCKCallSignalTypeBusy:
+			return true
+		}
+	}
+	return false
+}
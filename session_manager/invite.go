@@ -0,0 +1,96 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+多方邀请时session manager代发给被叫的Invite，Info里带被叫展示来电界面需要的信息：
+  relays     session使用的relay
+  caller     发起邀请的uid
+  name       发起方的显示名，取自发起方信令的Info["name"]
+  avatar     发起方头像URL，取自Info["avatar"]
+  call_type  "audio"或"video"，取自Info["call_type"]，之后的邀请沿用session上记下的
+  nickname   多方通话的昵称，取自Info["nickname"]，之后的邀请沿用
+  payload    app自定义的数据，session manager不解析，原样转给被叫
+  sealed     发起方用session key加密的上面这些字段，原样转给被叫，见relay/sealed.go
+1-1的Invite是透明转发的，发起方带的这些字段被叫直接就能收到。
+两种Invite都由session manager加上session_key，被叫用它解开sealed。
+*/
+
+const (
+	YCKCallTypeAudio = "audio"
+	YCKCallTypeVideo = "video"
+
+	MaxInvitePayload = 1024 //app自定义payload的上限，超过的不转发
+)
+
+//Invite带了合法的call_type就记到session上
+func updateCallType(signal *Signal, session *Session) {
+	if t := callTypeOf(signal); t != "" {
+		session.CallType = t
+	}
+}
+
+//信令Info里的call_type，没有或不认识时返回""
+func callTypeOf(signal *Signal) string {
+	if t, ok := signal.Info["call_type"].(string); ok && (t == YCKCallTypeAudio || t == YCKCallTypeVideo) {
+		return t
+	}
+	return ""
+}
+
+//生成发给被邀请者的Invite Info，同时把call_type和nickname记到session上
+func newInviteInfo(signal *Signal, session *Session) map[string]interface{} {
+	updateCallType(signal, session)
+	if nickname, ok := signal.Info["nickname"].(string); ok && nickname != "" {
+		session.Nickname = nickname
+	}
+
+	info := make(map[string]interface{})
+	info["relays"] = session.Relays
+	info["caller"] = signal.From
+	if name, ok := signal.Info["name"].(string); ok {
+		info["name"] = name
+	}
+	if avatar, ok := signal.Info["avatar"].(string); ok {
+		info["avatar"] = avatar
+	}
+	if session.CallType != "" {
+		info["call_type"] = session.CallType
+	}
+	if session.Nickname != "" {
+		info["nickname"] = session.Nickname
+	}
+	if sealed, ok := signal.Info[relay.InfoSealed].(string); ok {
+		info[relay.InfoSealed] = sealed
+	}
+	if payload, ok := signal.Info["payload"].(string); ok {
+		if len(payload) <= MaxInvitePayload {
+			info["payload"] = payload
+		} else {
+			logging.Logger.Warn("drop invite payload of ", len(payload), " bytes from ", signal.From)
+		}
+	}
+	return withSessionKey(info, session)
+}
+
+//给发往参与者的信令加上session key，session没有key时不加
+func withSessionKey(info map[string]interface{}, session *Session) map[string]interface{} {
+	if session.Key == "" {
+		return info
+	}
+	if info == nil {
+		info = make(map[string]interface{})
+	}
+	info[relay.InfoSessionKey] = session.Key
+	return info
+}
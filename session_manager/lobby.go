@@ -0,0 +1,153 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"time"
+)
+
+/*
+等候室：锁定的多方通话里（见lock.go），自己加入（给session manager发Invite）的人不直接进通话，先在等候室等主持人准入。
+1. 主持人自己加入不用等；被成员用member_op邀请的人不经过等候室
+2. 加入的人进YCKParticipantStateLobby，收到Ring；通话中的主持人（都不在通话中时为owner）收到AdmitRequest信令，Info带uid。
+   等候室里的人不是relay session的成员（见session_control.go），收不到也发不了媒体
+3. 主持人用member_op处理，Info为op="admit"或"deny"和members：admit的进incall并收到Accept（带relays），
+   deny的回到idle并收到End，reason为YCKCallEndReasonDenied；results里为admitted、denied，不在等候室的为skipped
+4. 等候室里的人可以Cancel或End离开，LobbyTimeout内没有被处理的按deny结束
+5. MemberState里等候室的人state为YCKParticipantStateLobby，所有参与者都能看到有谁在等
+*/
+
+const (
+	LobbyTimeout = 5 * time.Minute
+
+	MemberOpAdmitted = "admitted"
+	MemberOpDenied   = "denied"
+
+	MemberSkipNotInLobby = "not_in_lobby" //不在等候室里，不能admit或deny
+)
+
+//锁定的session里自己加入的人进等候室，返回true表示已处理
+func (sm *SessionManager) holdInLobby(session *Session, signal *Signal) bool {
+	if !session.Locked || session.moderator(signal.From) {
+		return false
+	}
+	if !session.Wait(signal.From, signal.Device) {
+		sm.dropSignal(signal, SignalDropState)
+		return true
+	}
+	sm.log().Info("member ", signal.From, " waiting in lobby of session ", session.Sid)
+	sm.sendSignal(NewSignal(YCKCallSignalTypeRing, SessionManagerUserId, signal.From, session.Sid), false)
+	for _, uid := range session.admitters() {
+		request := NewSignal(YCKCallSignalTypeAdmitRequest, SessionManagerUserId, uid, session.Sid)
+		request.Info = map[string]interface{}{"uid": signal.From}
+		sm.sendSignal(request, false)
+	}
+
+	p := session.Participant(signal.From)
+	since := p.LastStateTime
+	sm.wheel.Schedule(LobbyTimeout, func() {
+		if sm.sessions[session.Sid] != session || session.Participant(p.Uid) != p || !p.LastStateTime.Equal(since) {
+			return
+		}
+		sm.log().Info("member ", p.Uid, " not admitted to session ", session.Sid, " in time")
+		sm.denyMember(session, p.Uid)
+		sm.notifyMemberStateChange(session)
+	})
+	return true
+}
+
+func (sm *SessionManager) processAdmitOp(signal *Signal, session *Session, members []interface{}, admit bool, result *MemberOpResult) {
+	if !session.moderator(signal.From) {
+		sm.log().Warn("member ", signal.From, " not allowed to admit members to session ", session.Sid)
+		return
+	}
+	for _, value := range members {
+		mem, err := memberUid(value)
+		if err != nil {
+			sm.log().Warn("parseUint error ", err)
+			result.add(0, MemberOpSkipped, MemberSkipInvalid)
+		} else if !admit && sm.denyMember(session, mem) {
+			result.add(mem, MemberOpDenied, "")
+		} else if admit && sm.admitMember(session, mem) {
+			result.add(mem, MemberOpAdmitted, "")
+		} else {
+			result.add(mem, MemberOpSkipped, MemberSkipNotInLobby)
+		}
+	}
+}
+
+//准入等候室里的uid并通知他，不在等候室时返回false
+func (sm *SessionManager) admitMember(session *Session, uid int64) bool {
+	if !session.Admit(uid) {
+		return false
+	}
+	sm.log().Info("member ", uid, " admitted to session ", session.Sid)
+	accept := NewSignal(YCKCallSignalTypeAccept, SessionManagerUserId, uid, session.Sid)
+	accept.Info = sm.withRelayCandidates(nil, uid)
+	accept.Info["relays"] = session.Relays
+	sm.sendSignal(accept, false)
+	return true
+}
+
+//把等候室里的uid拒掉并通知他，不在等候室时返回false
+func (sm *SessionManager) denyMember(session *Session, uid int64) bool {
+	if !session.Deny(uid) {
+		return false
+	}
+	sm.log().Info("member ", uid, " denied joining session ", session.Sid)
+	sm.sendSignal(newEndSignal(uid, session.Sid, YCKCallEndReasonDenied), false)
+	return true
+}
+
+//收AdmitRequest的人：通话中的主持人，都不在时为owner
+func (s *Session) admitters() []int64 {
+	var uids []int64
+	for uid, p := range s.Participants {
+		if s.moderator(uid) && p.InState(YCKParticipantStateIncall) {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		uids = append(uids, s.Owner)
+	}
+	return uids
+}
+
+//from自己加入，进等候室，from已在响铃或通话中时返回false
+func (s *Session) Wait(from int64, device string) bool {
+	p := s.participant(from)
+	if !p.InState(YCKParticipantStateIdle) {
+		return false
+	}
+	p.SetState(YCKParticipantStateLobby)
+	p.SetEvent(YCKParticipantEventWait)
+	p.Device = device
+	return true
+}
+
+//准入等候室里的uid，uid不在等候室时返回false
+func (s *Session) Admit(uid int64) bool {
+	p := s.Participants[uid]
+	if p == nil || !p.InState(YCKParticipantStateLobby) {
+		return false
+	}
+	p.SetState(YCKParticipantStateIncall)
+	p.SetEvent(YCKParticipantEventAdmitted)
+	return true
+}
+
+//拒绝等候室里的uid，uid不在等候室时返回false
+func (s *Session) Deny(uid int64) bool {
+	p := s.Participants[uid]
+	if p == nil || !p.InState(YCKParticipantStateLobby) {
+		return false
+	}
+	p.End(YCKCallEndReasonDenied)
+	p.SetEvent(YCKParticipantEventDenied)
+	return true
+}
@@ -0,0 +1,65 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+/*
+多方通话的锁定：会开始后不再让人进来，主持人（moderator）除外。
+1. 主持人为owner（请求sid的人）和请求sid时Info["moderators"]里的人
+2. 通话中的主持人用member_op锁定和解锁，Info为op="lock"或"unlock"，members为空列表；
+   请求sid时Info["locked"]为true即一开始就锁定
+3. 锁定后：
+   - 邀请：不是主持人的成员用member_op（包括bulk）邀请的人跳过，reason为locked；主持人照常邀请
+   - 加入和重新加入：不是主持人的人自己发Invite加入（包括之前在通话里、离开后再回来的）进等候室，
+     由主持人准入，见lobby.go；已经在响铃的人接听不受影响
+4. 解锁时等候室里的人全部准入
+5. MemberState的Info带locked为1，主持人的state里带moderator为1
+*/
+
+const MemberSkipLocked = "locked" //session已锁定，只有主持人能邀请
+
+//请求sid时的主持人
+func setupModerators(session *Session, signal *Signal) {
+	list, _ := signal.Info["moderators"].([]interface{})
+	for _, value := range list {
+		if uid, err := memberUid(value); err == nil && uid != session.Owner {
+			if session.Moderators == nil {
+				session.Moderators = make(map[int64]bool)
+			}
+			session.Moderators[uid] = true
+		}
+	}
+}
+
+func (s *Session) moderator(uid int64) bool {
+	return uid == s.Owner || s.Moderators[uid]
+}
+
+//锁定时uid不能邀请别人
+func (s *Session) inviteLocked(uid int64) bool {
+	return s.Locked && !s.moderator(uid)
+}
+
+func (sm *SessionManager) processLockOp(signal *Signal, session *Session, lock bool) {
+	if by := session.Participant(signal.From); by == nil || !by.InState(YCKParticipantStateIncall) || !session.moderator(signal.From) {
+		sm.log().Warn("member ", signal.From, " not allowed to lock session ", session.Sid)
+		return
+	}
+	if session.Locked == lock {
+		return
+	}
+	session.Locked = lock
+	sm.log().Info("session ", session.Sid, " locked:", lock, " by ", signal.From)
+	if lock {
+		return
+	}
+	for _, p := range session.Participants {
+		if p.InState(YCKParticipantStateLobby) {
+			sm.admitMember(session, p.Uid)
+		}
+	}
+}
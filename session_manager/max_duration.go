@@ -0,0 +1,59 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"time"
+)
+
+/*
+session最长时长：客户端崩溃没发End、脚本反复呼叫之类被遗弃或失控的session，会一直占着relay的转发和用量。
+1. config的max_duration（秒）为所有session的上限；请求sid时Info["max_duration"]（秒）可以给这个session设更短的时长，
+   SidCreated的Info带生效的max_duration，客户端可以据此倒计时
+2. 从session创建起到时后，给还没结束的参与者发End，reason为YCKCallEndReasonMaxDuration，让relay teardown停止转发，
+   然后删除session，和管理接口的强制结束一样写CDR、发session.ended事件
+3. 停服交接时时长随session保存，恢复后按创建时间算剩余时长
+*/
+
+//config的上限和sid请求里的时长取较短的，0为不限
+func (sm *SessionManager) maxDurationOf(signal *Signal) time.Duration {
+	limit := sm.maxDuration
+	if n, ok := signal.Info["max_duration"].(json.Number); ok {
+		if secs, err := n.Int64(); err == nil && secs > 0 {
+			if d := time.Duration(secs) * time.Second; limit == 0 || d < limit {
+				limit = d
+			}
+		}
+	}
+	return limit
+}
+
+func withMaxDuration(info map[string]interface{}, session *Session) map[string]interface{} {
+	if session.MaxDuration == 0 {
+		return info
+	}
+	if info == nil {
+		info = make(map[string]interface{})
+	}
+	info["max_duration"] = int64(session.MaxDuration / time.Second)
+	return info
+}
+
+func (sm *SessionManager) scheduleMaxDuration(session *Session) {
+	if session.MaxDuration == 0 {
+		return
+	}
+	sm.wheel.Schedule(time.Until(session.CreateTime.Add(session.MaxDuration)), func() {
+		if sm.sessions[session.Sid] != session {
+			return
+		}
+		sm.log().Info("session ", session.Sid, " ended after max duration ", session.MaxDuration)
+		sm.removeSession(session, YCKCallEndReasonMaxDuration)
+	})
+}
@@ -0,0 +1,125 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+媒体能力协商，和relay的能力位图（见capability.go）不同，这里是编解码、分辨率等通话双方要一致的东西：
+1. 客户端在Invite/Accept（1-1和多方）的Info["media_caps"]里带上自己的媒体能力：
+     {"codecs": ["opus", "h264", "vp8"], "max_width": 1280, "max_height": 720, "fec": true}
+   codecs按偏好排序，max_width/max_height为0表示不收发视频。1-1的Invite原样转给被叫，被叫也能直接看到
+2. session manager记在参与者上，按未结束且带了能力的参与者算公共能力：codecs取交集（按uid最小者的偏好排序），
+   分辨率取最小，fec要所有人都支持。不带media_caps的老客户端不参与计算，按它自己的默认值收发
+3. 公共能力变化时给这些参与者发MediaCaps信令，Info["media_caps"]为公共能力；少于两人时不发
+*/
+
+type MediaCaps struct {
+	Codecs    []string `json:"codecs"`
+	MaxWidth  int      `json:"max_width"`
+	MaxHeight int      `json:"max_height"`
+	Fec       bool     `json:"fec"`
+}
+
+//信令Info里的media_caps，没有或格式不对时返回nil
+func mediaCapsOf(signal *Signal) *MediaCaps {
+	value, ok := signal.Info["media_caps"]
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	caps := &MediaCaps{}
+	if err := json.Unmarshal(data, caps); err != nil || caps.MaxWidth < 0 || caps.MaxHeight < 0 {
+		logging.Logger.Warn("incorrect media caps from ", signal.From, ":", err)
+		return nil
+	}
+	return caps
+}
+
+//按顺序求公共能力
+func commonMediaCaps(all []*MediaCaps) *MediaCaps {
+	common := &MediaCaps{
+		Codecs:    append([]string{}, all[0].Codecs...),
+		MaxWidth:  all[0].MaxWidth,
+		MaxHeight: all[0].MaxHeight,
+		Fec:       all[0].Fec,
+	}
+	for _, caps := range all[1:] {
+		supported := make(map[string]bool, len(caps.Codecs))
+		for _, codec := range caps.Codecs {
+			supported[codec] = true
+		}
+		codecs := common.Codecs[:0]
+		for _, codec := range common.Codecs {
+			if supported[codec] {
+				codecs = append(codecs, codec)
+			}
+		}
+		common.Codecs = codecs
+		if caps.MaxWidth < common.MaxWidth {
+			common.MaxWidth = caps.MaxWidth
+		}
+		if caps.MaxHeight < common.MaxHeight {
+			common.MaxHeight = caps.MaxHeight
+		}
+		common.Fec = common.Fec && caps.Fec
+	}
+	return common
+}
+
+//Invite/Accept处理完后记下发送方的媒体能力
+func (sm *SessionManager) updateMediaCaps(session *Session, signal *Signal) {
+	if signal.Signal != YCKCallSignalTypeInvite && signal.Signal != YCKCallSignalTypeAccept {
+		return
+	}
+	p := session.Participants[signal.From]
+	if p == nil {
+		return
+	}
+	if caps := mediaCapsOf(signal); caps != nil {
+		p.MediaCaps = caps
+	}
+}
+
+//公共能力有变化时下发，在参与者状态变化之后调用
+func (sm *SessionManager) syncMediaCaps(session *Session) {
+	var uids []int64
+	for _, p := range session.Participants {
+		if !p.InState(YCKParticipantStateIdle) && p.MediaCaps != nil {
+			uids = append(uids, p.Uid)
+		}
+	}
+	if len(uids) < 2 {
+		return
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	all := make([]*MediaCaps, len(uids))
+	for i, uid := range uids {
+		all[i] = session.Participants[uid].MediaCaps
+	}
+	common := commonMediaCaps(all)
+	data, _ := json.Marshal(common)
+	if string(data) == session.MediaCaps {
+		return
+	}
+	session.MediaCaps = string(data)
+	sm.log().Info("media caps of session ", session.Sid, ":", session.MediaCaps)
+	for _, uid := range uids {
+		signal := NewSignal(YCKCallSignalTypeMediaCaps, SessionManagerUserId, uid, session.Sid)
+		signal.Info = map[string]interface{}{"media_caps": common}
+		sm.sendSignal(signal, false)
+	}
+}
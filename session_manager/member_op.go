@@ -0,0 +1,123 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+/*
+member_op的结果和去重：操作者需要知道邀请和踢人的结果，网络不好重发时也不能重复执行。
+1. member_op的Info带op_id（操作者生成的字符串）时，处理完回MemberOpResult信令给操作者，Info带op_id、op和results，
+   results为每个成员的{member, result, reason}：result为invited、kicked、admitted、denied或skipped，skipped时reason为跳过的原因。
+   只有invite、ring、kick、admit、deny（见lobby.go）和bulk（见bulk_op.go）有每个成员的结果，其他op的results为空
+2. session记住最近MaxMemberOps个带op_id的操作（按操作者和op_id），同一操作者重发同一op_id时不再执行，
+   直接重发上次的结果。不带op_id的老客户端照旧处理，不回结果
+3. 记录只在内存里，停服交接后不保留
+*/
+
+const (
+	MaxMemberOps = 64
+
+	MemberOpInvited = "invited"
+	MemberOpKicked  = "kicked"
+	MemberOpSkipped = "skipped"
+
+	MemberSkipInvalid   = "invalid"     //members里不是uid
+	MemberSkipTenant    = "tenant"      //不是session所在租户的uid
+	MemberSkipNotIdle   = "not_idle"    //已经在响铃或通话中，不能邀请
+	MemberSkipScreened  = "screened"    //被叫的来电过滤拦下，见screening.go
+	MemberSkipNotInCall = "not_in_call" //不在通话中，不能踢
+)
+
+var errMemberNotNumber = errors.New("member is not a number")
+
+type MemberResult struct {
+	Member int64  `json:"member"`
+	Result string `json:"result"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type MemberOpResult struct {
+	By      int64
+	OpId    string
+	Op      string
+	Results []MemberResult
+}
+
+func (r *MemberOpResult) add(member int64, result string, reason string) {
+	r.Results = append(r.Results, MemberResult{Member: member, Result: result, Reason: reason})
+}
+
+//session最近处理过的带op_id的操作，按处理顺序
+type MemberOps struct {
+	results []*MemberOpResult
+}
+
+func (m *MemberOps) find(by int64, opId string) *MemberOpResult {
+	for _, r := range m.results {
+		if r.By == by && r.OpId == opId {
+			return r
+		}
+	}
+	return nil
+}
+
+func (m *MemberOps) add(r *MemberOpResult) {
+	if len(m.results) >= MaxMemberOps {
+		m.results = m.results[1:]
+	}
+	m.results = append(m.results, r)
+}
+
+func memberUid(value interface{}) (int64, error) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, errMemberNotNumber
+	}
+	return n.Int64()
+}
+
+//同一操作者重发的op_id，重发上次的结果并返回true
+func (sm *SessionManager) resendMemberOpResult(signal *Signal, session *Session, opId string) bool {
+	if opId == "" || session.MemberOps == nil {
+		return false
+	}
+	r := session.MemberOps.find(signal.From, opId)
+	if r == nil {
+		return false
+	}
+	sm.log().Info("member op ", opId, " from ", signal.From, " already handled in session ", session.Sid)
+	sm.sendMemberOpResult(session, r)
+	return true
+}
+
+func (sm *SessionManager) finishMemberOp(session *Session, r *MemberOpResult) {
+	if r.OpId == "" {
+		if r.Op == MemberOpBulk {
+			sm.sendMemberOpResult(session, r) //批量操作总是回结果，见bulk_op.go
+		}
+		return
+	}
+	if session.MemberOps == nil {
+		session.MemberOps = &MemberOps{}
+	}
+	session.MemberOps.add(r)
+	sm.sendMemberOpResult(session, r)
+}
+
+func (sm *SessionManager) sendMemberOpResult(session *Session, r *MemberOpResult) {
+	results := r.Results
+	if results == nil {
+		results = []MemberResult{}
+	}
+	signal := NewSignal(YCKCallSignalTypeMemberOpResult, SessionManagerUserId, r.By, session.Sid)
+	signal.Info = map[string]interface{}{"op_id": r.OpId, "op": r.Op, "results": results}
+	sm.sendSignal(signal, false)
+}
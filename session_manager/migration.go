@@ -0,0 +1,162 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"net"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+通话中的relay迁移：session在用的relay（session.Relays）不健康时，先把通话接到新relay再断开旧的（make-before-break）。
+1. 不健康：写relay熔断（见breaker.go），或确认过注册的relay连着几个周期不再确认（见candidates.go）。
+   熔断时和每次重新注册relay时检查所有session，一个session同时只做一次迁移
+2. 新relay取session里uid最小的响铃或通话中参与者的relay候选（已排除排空的），再排除不可达、熔断和session已经在用的；
+   没有可用的就不迁移，下次检查再试
+3. make：session.Relays里把旧relay换成新relay，马上给新relay发session setup，再给响铃和通话中的参与者发RelaySwitch，
+   Info带from（旧relay）、to（新relay）和relays（新的列表）。客户端向新relay TurnReg，在新relay上收到媒体后
+   才停止向旧relay发送，切换期间两边并行收发，媒体不中断
+4. 客户端切换完回RelaySwitch给session manager，Info带to；所有参与者都确认（或已离开）、或者过了RelaySwitchTimeout后break：
+   给旧relay发teardown，发session.relay_switched事件，Relay为新relay
+迁移中新加入的参与者拿到的已经是新列表（invite里的relays），不需要确认。
+*/
+
+const RelaySwitchTimeout = 10 * time.Second
+
+type RelaySwitch struct {
+	From    string
+	To      string
+	Pending map[int64]bool //还没确认切换的参与者
+	Start   time.Time
+}
+
+//确认过注册的relay不再确认，或写relay熔断
+func (sm *SessionManager) relayUnhealthy(addr string, now time.Time) bool {
+	if !sm.breakers.Allow(addr) {
+		return true
+	}
+	_, acked := sm.relayAcks[addr]
+	return acked && !sm.relayReachable(addr, now)
+}
+
+func (sm *SessionManager) checkSessionRelays(now time.Time) {
+	for _, session := range sm.sessions {
+		if session.Migration != nil {
+			continue
+		}
+		for _, addr := range session.Relays {
+			if sm.relayUnhealthy(addr, now) {
+				sm.migrateRelay(session, addr, now)
+				break
+			}
+		}
+	}
+}
+
+func (sm *SessionManager) migrateRelay(session *Session, from string, now time.Time) {
+	var first *Participant
+	for _, p := range session.Participants {
+		if !p.InState(YCKParticipantStateIdle) && (first == nil || p.Uid < first.Uid) {
+			first = p
+		}
+	}
+	if first == nil {
+		return
+	}
+	to := ""
+	for _, addr := range sm.relayCandidates(first.Uid) {
+		if sm.relayReachable(addr, now) && sm.breakers.Allow(addr) && !containsString(session.Relays, addr) {
+			to = addr
+			break
+		}
+	}
+	if to == "" {
+		sm.log().Warn("relay ", from, " of session ", session.Sid, " unhealthy, but no relay to switch to")
+		return
+	}
+
+	relays := make([]string, len(session.Relays))
+	for i, r := range session.Relays {
+		if r == from {
+			r = to
+		}
+		relays[i] = r
+	}
+	session.Relays = relays
+	session.RelayControl = "" //新relay还没有这个session，重发setup
+	sm.syncRelaySession(session)
+
+	m := &RelaySwitch{From: from, To: to, Pending: make(map[int64]bool), Start: now}
+	session.Migration = m
+	for _, p := range session.Participants {
+		if p.InState(YCKParticipantStateIdle) {
+			continue
+		}
+		m.Pending[p.Uid] = true
+		signal := NewSignal(YCKCallSignalTypeRelaySwitch, SessionManagerUserId, p.Uid, session.Sid)
+		signal.Info = map[string]interface{}{"from": from, "to": to, "relays": session.Relays}
+		sm.sendSignal(signal, false)
+	}
+	sm.log().Info("session ", session.Sid, " switching relay from ", from, " to ", to, ", participants:", len(m.Pending))
+
+	sm.wheel.Schedule(RelaySwitchTimeout, func() {
+		if session.Migration == m {
+			sm.finishMigration(session)
+		}
+	})
+}
+
+//参与者切换完成的确认
+func (sm *SessionManager) handleRelaySwitch(signal *Signal, session *Session) {
+	m := session.Migration
+	to, _ := signal.Info["to"].(string)
+	if m == nil || to != m.To {
+		sm.log().Warn("relay switch to ", to, " from ", signal.From, " not expected in session ", session.Sid)
+		return
+	}
+	delete(m.Pending, signal.From)
+	for uid := range m.Pending {
+		if p := session.Participant(uid); p != nil && !p.InState(YCKParticipantStateIdle) {
+			return
+		}
+	}
+	sm.finishMigration(session)
+}
+
+func (sm *SessionManager) finishMigration(session *Session) {
+	m := session.Migration
+	session.Migration = nil
+	if len(m.Pending) > 0 {
+		sm.log().Warn("relay switch of session ", session.Sid, " to ", m.To, " not confirmed by ", len(m.Pending), " participants")
+	}
+	sm.log().Info("session ", session.Sid, " switched relay from ", m.From, " to ", m.To, " in ", time.Since(m.Start))
+
+	addr, err := net.ResolveUDPAddr("udp4", m.From)
+	if err == nil {
+		teardown := &relay.SessionControl{Op: relay.SessionControlTeardown}
+		msg := relay.NewMessage(relay.UdpMessageTypeSessionControl, SessionManagerUserId, session.Sid, 0, teardown.Marshal(), nil)
+		sm.writeToRelay(msg.ObfuscatedDataOfMessage(), addr)
+	} else {
+		sm.log().Error("incorrect addr ", err)
+	}
+
+	event := NewEvent(EventRelaySwitched, session.Sid)
+	event.Relay = m.To
+	sm.emitEvent(event)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
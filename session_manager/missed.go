@@ -0,0 +1,43 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"time"
+)
+
+/*
+未接来电：被叫还在响铃（called）呼叫就结束了，包括主叫取消或挂断、被叫超时、session被删除，被叫自己拒接或忙不算。
+1. 给被叫发MissedCall信令，经relay送到他的所有设备，同时走push，app据此显示未接来电角标
+   Info: caller主叫uid，time(unix秒)，call_type(audio/video，可能为空)，group是否多方通话
+2. 发call.missed事件（见events.go），Uid为被叫，带Caller、CallType、Group
+*/
+
+//被叫p没接听呼叫就结束了，在p回到idle之前调用
+func (sm *SessionManager) reportMissedCall(session *Session, p *Participant) {
+	now := time.Now()
+	group := session.Mode == YCKCallModeMultiple
+	sm.log().Info("missed call of ", p.Uid, " from ", p.Caller, " in session ", session.Sid)
+
+	missed := NewSignal(YCKCallSignalTypeMissedCall, SessionManagerUserId, p.Uid, session.Sid)
+	missed.Info = map[string]interface{}{
+		"caller":    p.Caller,
+		"time":      now.Unix(),
+		"call_type": session.CallType,
+		"group":     group,
+	}
+	sm.sendSignal(missed, true)
+
+	event := NewEvent(EventMissedCall, session.Sid)
+	event.Time = now
+	event.Uid = p.Uid
+	event.Caller = p.Caller
+	event.CallType = session.CallType
+	event.Group = group
+	sm.emitEvent(event)
+}
@@ -0,0 +1,33 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+报文大小限制：relay在转来的信令上附带发送方探测到的路径MTU（见relay/mtu.go），这里按uid记下来。
+给这个uid发信令时整包不超过路径MTU和config的max_datagram中较小的：能重组的客户端按此分片，
+不能重组的放不下时不发，不依赖IP分片。没有探测结果的uid只受max_datagram限制。
+*/
+
+func (sm *SessionManager) updateMtu(uid int64, msg *relay.Message) {
+	if mtu := relay.MtuFromMessage(msg); mtu > 0 {
+		sm.mtus.Add(uid, mtu)
+	}
+}
+
+//发给uid的整包最大字节数，0为不限制
+func (sm *SessionManager) datagramLimit(uid int64) int {
+	mtu := 0
+	if value, ok := sm.mtus.Get(uid); ok {
+		mtu = value.(int)
+	}
+	return relay.MinDatagram(sm.maxDatagram, mtu)
+}
@@ -0,0 +1,237 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+发送限速：大session的MemberState广播、停服时的批量End会一下子发出几十上百个包，
+relay按来源ip限速（relay的rate_limit），突发的包被丢掉。发往relay的包都经过Pacer：
+1. 每个目的地址和全局各一个令牌桶，速率为config的pace_rate和pace_global_rate，桶容量为PaceBurst秒的量
+2. 两个桶都有令牌且该地址没有排队的包时在调用方直接写，平时不增加任何延迟
+3. 否则放进该地址的队列，由单独的goroutine在令牌补上后按地址轮流发出，同一地址保持顺序；
+   队列清空后goroutine退出，下次排队时再起
+4. 排队总数超过PaceMaxQueued时丢弃新包并计数
+速率为0时不限速。
+*/
+
+const (
+	PaceBurst     = 100 * time.Millisecond //桶容量对应的时长
+	PaceMaxQueued = 8192
+)
+
+type tokenBucket struct {
+	rate   float64 //每秒补充的令牌数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	burst := float64(rate) * PaceBurst.Seconds()
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate == 0 {
+		return
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) ready(now time.Time) bool {
+	if b.rate == 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+//调用前需确认ready
+func (b *tokenBucket) take() {
+	if b.rate > 0 {
+		b.tokens--
+	}
+}
+
+//补满一个令牌还要等多久
+func (b *tokenBucket) wait() time.Duration {
+	if b.rate == 0 || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+type pacedPacket struct {
+	conn Transport
+	data []byte
+	addr *net.UDPAddr
+}
+
+type paceDest struct {
+	bucket *tokenBucket
+	queue  []pacedPacket
+}
+
+type Pacer struct {
+	lock     sync.Mutex
+	rate     int
+	global   *tokenBucket
+	dests    map[string]*paceDest
+	order    []string //有排队的地址，按此顺序轮流发
+	queued   int
+	draining bool
+	dropped  uint64
+	onWrite  func(addr *net.UDPAddr, err error)
+}
+
+//rate为每个目的地址每秒最多发的包数，globalRate为所有地址合计，为0时不限
+//onWrite不为nil时每个包写完后调用，可能在Pacer自己的goroutine里，不能调用Pacer
+func NewPacer(rate int, globalRate int, onWrite func(addr *net.UDPAddr, err error)) *Pacer {
+	return &Pacer{
+		rate:    rate,
+		global:  newTokenBucket(globalRate, time.Now()),
+		dests:   make(map[string]*paceDest),
+		onWrite: onWrite,
+	}
+}
+
+//发送或排队，data的所有权交给Pacer
+func (p *Pacer) Send(conn Transport, data []byte, addr *net.UDPAddr) {
+	key := addr.String()
+	now := time.Now()
+
+	p.lock.Lock()
+	dest := p.dests[key]
+	if dest == nil {
+		dest = &paceDest{bucket: newTokenBucket(p.rate, now)}
+		p.dests[key] = dest
+	}
+	if len(dest.queue) == 0 && dest.bucket.ready(now) && p.global.ready(now) {
+		dest.bucket.take()
+		p.global.take()
+		p.lock.Unlock()
+		p.write(pacedPacket{conn: conn, data: data, addr: addr})
+		return
+	}
+	if p.queued >= PaceMaxQueued {
+		p.lock.Unlock()
+		if atomic.AddUint64(&p.dropped, 1)%1000 == 1 {
+			logging.Logger.Warn("pacer queue full, signal to ", key, " dropped")
+		}
+		return
+	}
+	if len(dest.queue) == 0 {
+		p.order = append(p.order, key)
+	}
+	dest.queue = append(dest.queue, pacedPacket{conn: conn, data: data, addr: addr})
+	p.queued++
+	if !p.draining {
+		p.draining = true
+		go p.drain()
+	}
+	p.lock.Unlock()
+}
+
+type PacerStats struct {
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"` //排队总数超过PaceMaxQueued时丢弃的包数
+}
+
+func (p *Pacer) Stats() PacerStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return PacerStats{Queued: p.queued, Dropped: atomic.LoadUint64(&p.dropped)}
+}
+
+func (p *Pacer) drain() {
+	for {
+		//持锁写，写完之前Send不会越过排队的包直接发，同一地址保持顺序
+		p.lock.Lock()
+		ready, wait := p.popReady(time.Now())
+		for _, packet := range ready {
+			p.write(packet)
+		}
+		if p.queued == 0 {
+			p.draining = false
+		}
+		draining := p.draining
+		p.lock.Unlock()
+
+		if !draining {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+//按地址轮流取出令牌允许的包，返回这些包和下次有令牌要等的时长，调用方需持有锁
+func (p *Pacer) popReady(now time.Time) ([]pacedPacket, time.Duration) {
+	var ready []pacedPacket
+	for progress := true; progress && len(p.order) > 0; {
+		progress = false
+		for i := 0; i < len(p.order); {
+			dest := p.dests[p.order[i]]
+			if !dest.bucket.ready(now) || !p.global.ready(now) {
+				i++
+				continue
+			}
+			dest.bucket.take()
+			p.global.take()
+			ready = append(ready, dest.queue[0])
+			dest.queue[0] = pacedPacket{}
+			dest.queue = dest.queue[1:]
+			p.queued--
+			progress = true
+			if len(dest.queue) == 0 {
+				p.order = append(p.order[:i], p.order[i+1:]...)
+				continue
+			}
+			i++
+		}
+	}
+
+	wait := time.Duration(-1)
+	for _, key := range p.order {
+		if w := p.dests[key].bucket.wait(); wait < 0 || w < wait {
+			wait = w
+		}
+	}
+	if w := p.global.wait(); w > wait {
+		wait = w
+	}
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return ready, wait
+}
+
+func (p *Pacer) write(packet pacedPacket) {
+	_, err := packet.conn.WriteToUDP(packet.data, packet.addr)
+	if p.onWrite != nil {
+		p.onWrite(packet.addr, err)
+	} else if err != nil {
+		logging.Logger.Error("udp write error", err)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+参与者的附加信息：客户端据此显示更丰富的成员列表，应用可以对蜂窝网络上的参与者调整行为。
+1. relay在转来的信令上附带发送方注册时上报的设备类型和网络类型（见relay/network.go），这里按uid记下来，
+   发MemberState时刷新到Participant.DeviceType、NetworkType
+2. MemberState的Info带meta：uid -> {joined_at, device, network}，joined_at为第一次进入incall的unix毫秒，
+   device为phone、tablet、desktop或web，network为wifi、cellular或ethernet，不知道的项不带，都不知道的参与者不在meta里。
+   states的值只能是数字，所以单独放一个map
+*/
+
+func (sm *SessionManager) updateNetwork(uid int64, msg *relay.Message) {
+	if n, ok := relay.NetworkFromMessage(msg); ok {
+		sm.networks.Add(uid, n)
+	}
+}
+
+func (sm *SessionManager) refreshNetwork(p *Participant) {
+	value, ok := sm.networks.Get(p.Uid)
+	if !ok {
+		return
+	}
+	n := value.(relay.NetworkInfo)
+	p.DeviceType = n.DeviceType
+	p.NetworkType = n.NetworkType
+}
+
+//参与者在MemberState里的meta，没有可带的信息时返回nil
+func (sm *SessionManager) participantMeta(p *Participant) map[string]interface{} {
+	sm.refreshNetwork(p)
+	meta := make(map[string]interface{})
+	if !p.JoinTime.IsZero() {
+		meta["joined_at"] = p.JoinTime.UnixNano() / 1e6
+	}
+	n := relay.NetworkInfo{DeviceType: p.DeviceType, NetworkType: p.NetworkType}
+	if name := n.DeviceName(); name != "" {
+		meta["device"] = name
+	}
+	if name := n.NetworkName(); name != "" {
+		meta["network"] = name
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
@@ -0,0 +1,79 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+成员的媒体权限：研讨会之类的场景里让部分参与者只听不说，或者只能发音频。
+1. 多方通话中用member_op设置，Info为op="permit"、members和要改的权限，省略的不变：
+     send_audio  是否可以发音频
+     send_video  是否可以发视频
+     receive     是否接收别人的媒体
+   可以在邀请之前设置，被邀请者加入时即生效；权限跟着成员直到session结束，离开再加入不会恢复。
+   自己被限制了任何一项的成员不能修改权限
+2. 权限记在Participant.Restrict，随session control下发给relay执行，见relay/session_control.go
+3. MemberState里被限制的成员带no_send_audio、no_send_video、no_receive为1
+*/
+
+var permitFlags = map[string]uint8{
+	"send_audio": relay.MemberNoSendAudio,
+	"send_video": relay.MemberNoSendVideo,
+	"receive":    relay.MemberNoReceive,
+}
+
+func (sm *SessionManager) processPermitOp(signal *Signal, session *Session, members []interface{}) {
+	if by := session.Participant(signal.From); by == nil || !by.InState(YCKParticipantStateIncall) || by.Restrict != 0 {
+		sm.log().Warn("member ", signal.From, " not allowed to change permissions in session ", session.Sid)
+		return
+	}
+	set, clear := permitChanges(signal.Info)
+	for _, value := range members {
+		mem, err := value.(json.Number).Int64()
+		if err != nil {
+			sm.log().Warn("parseUint error ", err)
+			continue
+		}
+		p := session.participant(mem)
+		p.Restrict = p.Restrict&^clear | set
+		sm.log().Info("member ", mem, " of session ", session.Sid, " restricted to ", p.Restrict, " by ", signal.From)
+	}
+}
+
+//info里要加上和去掉的限制位
+func permitChanges(info map[string]interface{}) (set uint8, clear uint8) {
+	for key, flag := range permitFlags {
+		allowed, ok := info[key].(bool)
+		if !ok {
+			continue
+		}
+		if allowed {
+			clear |= flag
+		} else {
+			set |= flag
+		}
+	}
+	return set, clear
+}
+
+//MemberState里成员的权限
+func addRestrictState(value map[string]uint16, p *Participant) {
+	if p.Restrict&relay.MemberNoSendAudio != 0 {
+		value["no_send_audio"] = 1
+	}
+	if p.Restrict&relay.MemberNoSendVideo != 0 {
+		value["no_send_video"] = 1
+	}
+	if p.Restrict&relay.MemberNoReceive != 0 {
+		value["no_receive"] = 1
+	}
+}
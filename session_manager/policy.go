@@ -0,0 +1,52 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+// uid在除except外的session中未结束的通话数
+func (sm *SessionManager) activeCalls(uid int64, except int64) int {
+	n := 0
+	for sid, session := range sm.sessions {
+		if sid == except {
+			continue
+		}
+		if p := session.Participants[uid]; p != nil && !p.InState(YCKParticipantStateIdle) {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+sid请求和Invite时检查同时通话数：发起方和1-1的被叫都不能超过上限，超过时给发起方回PolicyReject，信令不再处理。
+同一session里重发的Invite不算新通话。上限按uid所在租户取，见tenant.go。
+*/
+func (sm *SessionManager) checkCallPolicy(signal *Signal, sid int64) bool {
+	uids := []int64{signal.From}
+	if signal.Signal == YCKCallSignalTypeInvite && signal.To != SessionManagerUserId {
+		uids = append(uids, signal.To)
+	}
+	for _, uid := range uids {
+		limit := sm.callLimit(uid)
+		if limit > 0 && sm.activeCalls(uid, sid) >= limit {
+			sm.log().Info("policy reject signal ", signal.Signal, " from ", signal.From, ": uid ", uid, " already in ", limit, " calls")
+			sm.sendPolicyReject(signal.From, signal.SessionId, map[string]interface{}{
+				"reason": YCKPolicyRejectTooManyCalls,
+				"uid":    uid,
+				"limit":  limit,
+			})
+			return false
+		}
+	}
+	return true
+}
+
+func (sm *SessionManager) sendPolicyReject(to int64, sid int64, info map[string]interface{}) {
+	reject := NewSignal(YCKCallSignalTypePolicyReject, SessionManagerUserId, to, sid)
+	reject.Info = info
+	sm.sendSignal(reject, false)
+}
@@ -0,0 +1,124 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+用户在线状态（presence），由relay上报的注册和过期得出：
+1. relay在用户注册和过期时上报，并每relay.PresenceSyncInterval全量同步一次，见relay/presence.go。
+   记录uid -> relay地址 -> 最近一次报online的时间，在任一relay上有记录即在线，多设备时同一uid可以在几个relay上
+2. 超过PresenceTtl没有再被报online的记录在housekeeping时删除，覆盖relay挂了或失联、下线的上报丢了的情况
+3. uid从离线变在线、从在线变离线时发presence.online/presence.offline事件，Event.Relay为引起变化的relay
+4. 查询：管理接口GET /presence?uid=x（可多个uid），返回是否在线和所在的relay；
+   客户端拨号前给session manager发presence信令，sid为0，Info["uids"]为要查的uid（最多relay.MaxSignalMembers个），
+   回复同一信令，Info["online"]为其中在线的uid，不告诉客户端在哪个relay
+*/
+
+const PresenceTtl = 3 * relay.PresenceSyncInterval
+
+type PresenceInfo struct {
+	Uid    int64    `json:"uid"`
+	Online bool     `json:"online"`
+	Relays []string `json:"relays,omitempty"`
+}
+
+func (sm *SessionManager) handlePresence(msg *relay.Message, addr *net.UDPAddr) {
+	entries, ok := relay.UnmarshalPresence(msg.Payload)
+	if !ok || addr == nil {
+		sm.log().Warn("incorrect presence from ", addr)
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.Online {
+			sm.setOnline(e.Uid, addr.String(), now)
+		} else {
+			sm.setOffline(e.Uid, addr.String())
+		}
+	}
+}
+
+func (sm *SessionManager) setOnline(uid int64, relayAddr string, now time.Time) {
+	relays := sm.presence[uid]
+	if relays == nil {
+		relays = make(map[string]time.Time)
+		sm.presence[uid] = relays
+		sm.emitPresence(EventPresenceOnline, uid, relayAddr)
+	}
+	relays[relayAddr] = now
+}
+
+func (sm *SessionManager) setOffline(uid int64, relayAddr string) {
+	relays := sm.presence[uid]
+	if _, ok := relays[relayAddr]; !ok {
+		return
+	}
+	delete(relays, relayAddr)
+	if len(relays) == 0 {
+		delete(sm.presence, uid)
+		sm.emitPresence(EventPresenceOffline, uid, relayAddr)
+	}
+}
+
+func (sm *SessionManager) emitPresence(eventType string, uid int64, relayAddr string) {
+	event := NewEvent(eventType, 0)
+	event.Uid = uid
+	event.Relay = relayAddr
+	sm.emitEvent(event)
+}
+
+//housekeeping时调用
+func (sm *SessionManager) expirePresence(now time.Time) {
+	for uid, relays := range sm.presence {
+		for relayAddr, t := range relays {
+			if now.Sub(t) > PresenceTtl {
+				sm.setOffline(uid, relayAddr)
+			}
+		}
+	}
+}
+
+func (sm *SessionManager) presenceOf(uid int64) *PresenceInfo {
+	info := &PresenceInfo{Uid: uid}
+	for relayAddr := range sm.presence[uid] {
+		info.Relays = append(info.Relays, relayAddr)
+	}
+	sort.Strings(info.Relays)
+	info.Online = len(info.Relays) > 0
+	return info
+}
+
+func (sm *SessionManager) handlePresenceQuery(signal *Signal) {
+	list, ok := signal.Info["uids"].([]interface{})
+	if !ok || len(list) > relay.MaxSignalMembers {
+		sm.log().Warn("incorrect presence query from ", signal.From)
+		sm.dropSignal(signal, SignalDropIncorrect)
+		return
+	}
+	online := make([]int64, 0, len(list))
+	for _, value := range list {
+		uid, err := memberUid(value)
+		if err != nil {
+			sm.dropSignal(signal, SignalDropIncorrect)
+			return
+		}
+		if sm.presence[uid] != nil {
+			online = append(online, uid)
+		}
+	}
+	reply := NewSignal(YCKCallSignalTypePresence, SessionManagerUserId, signal.From, 0)
+	reply.Info = map[string]interface{}{"online": online}
+	sm.sendSignal(reply, false)
+}
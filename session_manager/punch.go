@@ -0,0 +1,106 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"time"
+)
+
+/*
+P2P打洞协调：
+1. 1-1通话双方各自把从relay turn info中得到的外网地址通过PunchRequest发给session manager
+2. 双方地址都到齐后，session manager给双方发PunchReady，带上对方地址和一个统一的开始时间
+3. 双方在开始时间同时向对方地址发TurnProbe，直连成功与否通过PunchResult上报，用于统计
+*/
+
+const (
+	punchStartDelay = 300 * time.Millisecond //给双方留出收到PunchReady的时间，再同时开始发probe
+)
+
+type PunchState struct {
+	ReadyTime  time.Time
+	Results    map[int64]bool
+	Succeeded  bool
+	ReportTime time.Time
+}
+
+func NewPunchState() *PunchState {
+	ps := &PunchState{
+		Results: make(map[int64]bool),
+	}
+	return ps
+}
+
+func (sm *SessionManager) handlePunchSignal(signal *Signal, session *Session) {
+	if session.Mode == YCKCallModeMultiple {
+		sm.log().Warn("punch signal ignored in multipart mode from ", signal.From, " for session ", session.Sid)
+		return
+	}
+
+	pf := session.Participants[signal.From]
+	if pf == nil {
+		sm.log().Warn("punch signal from ", signal.From, " not in session ", session.Sid)
+		return
+	}
+
+	switch signal.Signal {
+	case YCKCallSignalTypePunchRequest:
+		addr, ok := signal.Info["addr"].(string)
+		if !ok || len(addr) == 0 {
+			sm.log().Warn("punch request without addr from ", signal.From)
+			return
+		}
+		pf.PunchAddr = addr
+
+		var peer *Participant
+		for _, p := range session.Participants {
+			if p.Uid != pf.Uid {
+				peer = p
+			}
+		}
+		if peer == nil || len(peer.PunchAddr) == 0 {
+			return
+		}
+
+		session.Punch = NewPunchState()
+		session.Punch.ReadyTime = time.Now()
+		sm.punchAttempts++
+
+		startAt := time.Now().Add(punchStartDelay).UnixNano() / int64(time.Millisecond)
+		sm.sendPunchReady(session, pf, peer, startAt)
+		sm.sendPunchReady(session, peer, pf, startAt)
+		sm.log().Info("punch ready for session ", session.Sid, " between ", pf.Uid, "<", pf.PunchAddr, "> and ", peer.Uid, "<", peer.PunchAddr, ">")
+
+	case YCKCallSignalTypePunchResult:
+		if session.Punch == nil {
+			sm.log().Warn("punch result from ", signal.From, " without punch ready for session ", session.Sid)
+			return
+		}
+		ok, _ := signal.Info["ok"].(bool)
+		if _, reported := session.Punch.Results[signal.From]; reported {
+			return
+		}
+		session.Punch.Results[signal.From] = ok
+		if ok && !session.Punch.Succeeded {
+			session.Punch.Succeeded = true
+			session.Punch.ReportTime = time.Now()
+			sm.punchSuccesses++
+		}
+		sm.log().Info("punch result from ", signal.From, " for session ", session.Sid, " ok:", ok, " elapsed:", time.Now().Sub(session.Punch.ReadyTime))
+		sm.syncTopology(session)
+	}
+}
+
+func (sm *SessionManager) sendPunchReady(session *Session, to *Participant, peer *Participant, startAt int64) {
+	ready := NewSignal(YCKCallSignalTypePunchReady, SessionManagerUserId, to.Uid, session.Sid)
+	ready.Info = make(map[string]interface{})
+	ready.Info["peer"] = peer.Uid
+	ready.Info["addr"] = peer.PunchAddr
+	ready.Info["at"] = startAt
+	sm.sendSignal(ready, false)
+}
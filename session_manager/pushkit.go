@@ -35,7 +35,8 @@ func NewPushkit() *Pushkit {
 	return pk
 }
 
-func (pk *Pushkit) Push(token string, payload []byte) {
+//APNs回复token已失效时返回false，其他情况都返回true
+func (pk *Pushkit) Push(token string, payload []byte) bool {
 	notification := &apns2.Notification{}
 	notification.Topic = "com.yeecall.YCKitDemo.voip"
 
@@ -46,8 +47,10 @@ func (pk *Pushkit) Push(token string, payload []byte) {
 	res, err := pk.Client.Push(notification)
 
 	if err != nil {
-		logging.Logger.Fatal("Error:", err)
+		logging.Logger.Error("Error:", err)
+		return true
 	}
 
 	fmt.Printf("pushkit ret: %v %v %v %v\n", res.StatusCode, res.ApnsID, res.Reason, notification.PushType)
+	return res.StatusCode != 410 && res.Reason != apns2.ReasonBadDeviceToken && res.Reason != apns2.ReasonUnregistered
 }
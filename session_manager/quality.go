@@ -0,0 +1,67 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"net"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+通话质量：relay每个定时器周期上报session里每个参与者的MOS、丢包率、抖动和RTT（估算方法见relay/mos.go）。
+1. 只记响铃或通话中的参与者，Participant.Quality为最近一次的值，管理接口GET /sessions的参与者带quality
+2. AvgMos为通话期间各次上报的平均值，session结束时写进CDR每个leg的mos，没有上报过的leg不带
+3. 多relay的session里同一参与者可能由几个relay上报，都算一次上报，以最近的为准
+4. 每次上报换一个新的Quality，不改旧的，快照和管理接口可以直接引用
+5. 上报的值同时作为上报relay的告警样本，见alerts.go
+*/
+
+type Quality struct {
+	Mos     float64   `json:"mos"`
+	Loss    float64   `json:"loss"`
+	Jitter  int       `json:"jitter_ms"`
+	Rtt     int       `json:"rtt_ms"` //客户端没有上报RTT时为0
+	Time    time.Time `json:"time"`
+	AvgMos  float64   `json:"avg_mos"`
+	Reports int       `json:"reports"`
+}
+
+func (sm *SessionManager) handleQualityReport(msg *relay.Message, addr *net.UDPAddr) {
+	entries, ok := relay.UnmarshalQualityReport(msg.Payload)
+	if !ok {
+		sm.log().Warn("incorrect quality report for session ", msg.To, " from ", addr)
+		return
+	}
+	session := sm.sessions[msg.To]
+	if session == nil {
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		p := session.Participant(e.Uid)
+		if p == nil || p.InState(YCKParticipantStateIdle) {
+			continue
+		}
+		q := &Quality{Mos: e.Mos, Loss: e.Loss, Jitter: e.Jitter, Rtt: e.Rtt, Time: now, AvgMos: e.Mos, Reports: 1}
+		if last := p.Quality; last != nil {
+			q.Reports = last.Reports + 1
+			q.AvgMos = last.AvgMos + (e.Mos-last.AvgMos)/float64(q.Reports)
+		}
+		p.Quality = q
+		if addr != nil {
+			sm.addAlertSample(AlertMetricLoss, addr.String(), e.Loss)
+			sm.addAlertSample(AlertMetricMos, addr.String(), e.Mos)
+			sm.addAlertSample(AlertMetricJitter, addr.String(), float64(e.Jitter))
+			if e.Rtt > 0 {
+				sm.addAlertSample(AlertMetricRtt, addr.String(), float64(e.Rtt))
+			}
+		}
+	}
+}
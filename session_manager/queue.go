@@ -0,0 +1,198 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+呼叫排队：要找的人正忙，或者打的是客服热线时，主叫不直接失败，而是排队等人空出来。
+在多方模式的member_op上实现，主叫发op为"queue"、members为[目标uid]的Invite或MemberOp：
+1. 目标是config的hotlines里的热线uid时，坐席为对应的uid列表，否则坐席就是目标自己
+2. 每个目标一个FIFO队列。轮到主叫且有空闲坐席（不在任何未结束的通话里）时，按member invite邀请坐席；
+   等待中的主叫收到QueuePosition信令，Info带queue和position（从1开始），位置变化时再发
+3. 每条信令处理完和housekeeping时检查队列：坐席接听后这通呼叫出队；坐席拒绝或超时，呼叫留在原位置继续等，
+   QueueRetryDelay内不再邀请这个坐席；主叫挂断或session结束的出队
+同一个session同时只能在一个队列里。队列只在内存里，停服交接后不保留。
+*/
+
+const (
+	QueueRetryDelay = 30 * time.Second //坐席拒绝或超时后多久再邀请他接同一通呼叫
+	QueueMaxLength  = 1000             //每个队列最多排队的呼叫数
+)
+
+type queuedCall struct {
+	sid      int64
+	caller   int64
+	info     map[string]interface{} //发给坐席的Invite的Info，入队时生成
+	agent    int64                  //已邀请、还没接听的坐席，0表示在排队
+	declined map[int64]time.Time    //坐席 -> 拒绝或超时的时间
+	position int                    //最近一次通知主叫的位置
+	enqueued time.Time
+}
+
+type CallQueue struct {
+	target int64
+	agents []int64
+	calls  []*queuedCall //按入队顺序，包括已经在邀请坐席的
+}
+
+func (sm *SessionManager) processQueueOp(signal *Signal, session *Session, members []interface{}) {
+	if len(members) != 1 {
+		sm.log().Warn("queue op needs exactly one target, got ", members)
+		return
+	}
+	target, err := members[0].(json.Number).Int64()
+	if err != nil {
+		sm.log().Warn("parseUint error ", err)
+		return
+	}
+	if relay.TenantOf(target) != relay.TenantOf(session.Sid) {
+		sm.log().Warn("queue target ", target, " is not in the tenant of session ", session.Sid)
+		return
+	}
+	if q, _ := sm.queueOf(session.Sid); q != nil {
+		sm.log().Warn("session ", session.Sid, " already queued for ", q.target)
+		return
+	}
+
+	q := sm.queues[target]
+	if q == nil {
+		agents := sm.hotlines[target]
+		if len(agents) == 0 {
+			agents = []int64{target}
+		}
+		q = &CallQueue{target: target, agents: agents}
+		sm.queues[target] = q
+	}
+	if len(q.calls) >= QueueMaxLength {
+		sm.log().Warn("queue of ", target, " full, call from ", signal.From, " dropped")
+		return
+	}
+	q.calls = append(q.calls, &queuedCall{
+		sid:      session.Sid,
+		caller:   signal.From,
+		info:     newInviteInfo(signal, session),
+		declined: make(map[int64]time.Time),
+		enqueued: time.Now(),
+	})
+	sm.log().Info("call from ", signal.From, " in session ", session.Sid, " queued for ", target)
+	//由处理完信令后的dispatchQueues邀请坐席或通知位置
+}
+
+func (sm *SessionManager) queueOf(sid int64) (*CallQueue, *queuedCall) {
+	for _, q := range sm.queues {
+		for _, c := range q.calls {
+			if c.sid == sid {
+				return q, c
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (sm *SessionManager) dispatchQueues() {
+	for target, q := range sm.queues {
+		sm.dispatchQueue(q, time.Now())
+		if len(q.calls) == 0 {
+			delete(sm.queues, target)
+		}
+	}
+}
+
+func (sm *SessionManager) dispatchQueue(q *CallQueue, now time.Time) {
+	calls := q.calls[:0]
+	for _, c := range q.calls {
+		session := sm.sessions[c.sid]
+		if session == nil || session.Participant(c.caller) == nil || session.Participant(c.caller).InState(YCKParticipantStateIdle) {
+			sm.log().Info("call from ", c.caller, " abandoned in queue of ", q.target, " after ", now.Sub(c.enqueued))
+			continue
+		}
+		if c.agent != 0 {
+			p := session.Participant(c.agent)
+			if p != nil && p.InState(YCKParticipantStateIncall) {
+				sm.log().Info("call from ", c.caller, " answered by ", c.agent, " after queueing ", now.Sub(c.enqueued))
+				continue
+			}
+			if p == nil || p.InState(YCKParticipantStateIdle) {
+				c.declined[c.agent] = now
+				c.agent = 0
+			}
+		}
+		calls = append(calls, c)
+	}
+	for i := len(calls); i < len(q.calls); i++ {
+		q.calls[i] = nil
+	}
+	q.calls = calls
+
+	position := 0
+	for _, c := range q.calls {
+		if c.agent != 0 {
+			continue
+		}
+		session := sm.sessions[c.sid]
+		if agent := sm.idleAgent(q, c, now); agent != 0 {
+			if sm.inviteMember(session, c.caller, agent, c.info) {
+				c.agent = agent
+				c.position = 0 //坐席没接听、回到队列时重新通知位置
+				sm.notifyMemberStateChange(session)
+				continue
+			}
+			c.declined[agent] = now //被来电过滤拦下
+		}
+		position++
+		if c.position != position {
+			c.position = position
+			notify := NewSignal(YCKCallSignalTypeQueuePosition, SessionManagerUserId, c.caller, c.sid)
+			notify.Info = map[string]interface{}{"queue": q.target, "position": position}
+			sm.sendSignal(notify, false)
+		}
+	}
+}
+
+//不在任何通话中、最近没有拒绝过这通呼叫的坐席，没有时返回0
+func (sm *SessionManager) idleAgent(q *CallQueue, c *queuedCall, now time.Time) int64 {
+	for _, agent := range q.agents {
+		if agent == c.caller {
+			continue
+		}
+		if t, ok := c.declined[agent]; ok && now.Sub(t) < QueueRetryDelay {
+			continue
+		}
+		if sm.activeCalls(agent, 0) == 0 {
+			return agent
+		}
+	}
+	return 0
+}
+
+type QueuedCallInfo struct {
+	Sid      int64     `json:"sid"`
+	Caller   int64     `json:"caller"`
+	Agent    int64     `json:"agent,omitempty"` //正在邀请的坐席
+	Enqueued time.Time `json:"enqueued"`
+}
+
+type QueueInfo struct {
+	Target int64             `json:"target"`
+	Agents []int64           `json:"agents"`
+	Calls  []*QueuedCallInfo `json:"calls"`
+}
+
+func newQueueInfo(q *CallQueue) *QueueInfo {
+	info := &QueueInfo{Target: q.target, Agents: q.agents}
+	for _, c := range q.calls {
+		info.Calls = append(info.Calls, &QueuedCallInfo{Sid: c.sid, Caller: c.caller, Agent: c.agent, Enqueued: c.enqueued})
+	}
+	return info
+}
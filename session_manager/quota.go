@@ -0,0 +1,149 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+计费用量和配额，用量的统计和存储见relay/usage.go：
+1. session结束时按CDR把每个参与者的通话秒数累计到uid和所在租户；relay转发的字节由relay累计，
+   relay和session manager配置同一个store时在store里汇总
+2. 每个housekeeping周期把增量写入store，并发usage事件，Usage为key -> 这次flush的增量，
+   计费系统可以累加事件，也可以直接读store
+3. 请求sid时依次询问sm.quotaCheckers，任一返回非0的reason就给发起方回PolicyReject，不创建session
+   内置UsageQuota按config的quota_seconds、quota_bytes和租户的配额检查本计费周期的累计用量；
+   其他实现（如查计费系统的余额）在Start之前用AddQuotaChecker加入，在主循环里调用，不能阻塞
+4. 只在请求sid时检查，进行中的通话超额了也不中断
+*/
+
+type QuotaChecker interface {
+	CheckQuota(uid int64, now time.Time) uint16 //返回0放行，否则为PolicyReject的reason，见YCKPolicyReject*
+}
+
+func (sm *SessionManager) AddQuotaChecker(checker QuotaChecker) {
+	sm.quotaCheckers = append(sm.quotaCheckers, checker)
+}
+
+//超额时给发起方回PolicyReject并返回false，系统id不受限制
+func (sm *SessionManager) checkQuota(signal *Signal) bool {
+	if signal.From <= 0 {
+		return true
+	}
+	now := time.Now()
+	for _, checker := range sm.quotaCheckers {
+		if reason := checker.CheckQuota(signal.From, now); reason != 0 {
+			sm.log().Info("policy reject sid request from ", signal.From, ": over quota, reason:", reason)
+			sm.sendPolicyReject(signal.From, 0, map[string]interface{}{
+				"reason": reason,
+				"uid":    signal.From,
+			})
+			return false
+		}
+	}
+	return true
+}
+
+//session结束时累计每个接通过的参与者的通话秒数，在参与者都结束之后调用
+func (sm *SessionManager) countCallSeconds(session *Session) {
+	for _, p := range session.Participants {
+		if p.Uid <= 0 || p.JoinTime.IsZero() || p.LeaveTime.Before(p.JoinTime) {
+			continue
+		}
+		sm.usage.Add(p.Uid, relay.Usage{CallSeconds: int64(p.LeaveTime.Sub(p.JoinTime) / time.Second)})
+	}
+}
+
+func (sm *SessionManager) flushUsage() {
+	period, deltas := sm.usage.Flush(time.Now())
+	if deltas == nil {
+		return
+	}
+	if sm.quota != nil {
+		sm.quota.Flushed()
+	}
+	event := NewEvent(EventUsage, 0)
+	event.Period = period
+	event.Usage = deltas
+	sm.emitEvent(event)
+}
+
+//config里没有配置任何配额时返回nil
+func newUsageQuota(usage *relay.UsageAggregator, config *Config) *UsageQuota {
+	user := relay.Usage{CallSeconds: config.QuotaSeconds, RelayedBytes: config.QuotaBytes}
+	tenants := make(map[uint16]relay.Usage)
+	for id, t := range config.Tenants {
+		if t.QuotaSeconds > 0 || t.QuotaBytes > 0 {
+			tenants[id] = relay.Usage{CallSeconds: t.QuotaSeconds, RelayedBytes: t.QuotaBytes}
+		}
+	}
+	if user == (relay.Usage{}) && len(tenants) == 0 {
+		return nil
+	}
+	return NewUsageQuota(usage, user, tenants)
+}
+
+//按本计费周期的累计用量检查配额，上限的字段为0时不限制
+type UsageQuota struct {
+	usage   *relay.UsageAggregator
+	user    relay.Usage            //每个uid的上限
+	tenants map[uint16]relay.Usage //租户所有uid合计的上限，没有配置的租户不限制
+	stored  utils.Cache            //周期/key -> store里已入账的用量，flush后清空
+}
+
+func NewUsageQuota(usage *relay.UsageAggregator, user relay.Usage, tenants map[uint16]relay.Usage) *UsageQuota {
+	return &UsageQuota{
+		usage:   usage,
+		user:    user,
+		tenants: tenants,
+		stored:  utils.NewLRUWithTTL(100000, relay.UsageFlushPeriod, nil),
+	}
+}
+
+func (q *UsageQuota) CheckQuota(uid int64, now time.Time) uint16 {
+	if q.over(relay.UserUsageKey(uid), q.user, now) {
+		return YCKPolicyRejectOverQuota
+	}
+	tenant := relay.TenantOf(uid)
+	if limit, ok := q.tenants[tenant]; ok && q.over(relay.TenantUsageKey(tenant), limit, now) {
+		return YCKPolicyRejectOverQuota
+	}
+	return 0
+}
+
+//flush之后store里的用量变了，缓存作废
+func (q *UsageQuota) Flushed() {
+	q.stored.Purge()
+}
+
+func (q *UsageQuota) over(key string, limit relay.Usage, now time.Time) bool {
+	if limit == (relay.Usage{}) {
+		return false
+	}
+	cacheKey := relay.UsagePeriod(now) + "/" + key
+	var stored relay.Usage
+	if value, ok := q.stored.Get(cacheKey); ok {
+		stored = value.(relay.Usage)
+	} else {
+		var err error
+		if stored, err = q.usage.Stored(now, key); err != nil {
+			logging.Logger.Warn("load usage of ", key, " from store error:", err)
+			return false //查不到时放行
+		}
+		q.stored.Add(cacheKey, stored)
+	}
+	total := q.usage.Pending(key)
+	total.Add(&stored)
+	return (limit.CallSeconds > 0 && total.CallSeconds >= limit.CallSeconds) ||
+		(limit.RelayedBytes > 0 && total.RelayedBytes >= limit.RelayedBytes)
+}
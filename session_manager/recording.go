@@ -0,0 +1,96 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"net"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+录制：
+1. 参与者发RecordStart/RecordStop给session manager
+2. session manager通过UdpMessageTypeRecordControl通知该session使用的relay开始/停止tee媒体，
+   并给所有参与者发RecordState，客户端据此展示录制提示
+3. 任何参与者回RecordConsent且consent=false，即停止录制(全员同意原则)
+*/
+
+func (sm *SessionManager) handleRecordSignal(signal *Signal, session *Session) {
+	if session.Participants[signal.From] == nil {
+		sm.log().Warn("record signal from ", signal.From, " not in session ", session.Sid)
+		return
+	}
+
+	switch signal.Signal {
+	case YCKCallSignalTypeRecordStart:
+		if session.Recording {
+			return
+		}
+		session.Recording = true
+		session.RecordBy = signal.From
+	case YCKCallSignalTypeRecordStop:
+		if !session.Recording {
+			return
+		}
+		session.Recording = false
+	case YCKCallSignalTypeRecordConsent:
+		consent, _ := signal.Info["consent"].(bool)
+		if consent || !session.Recording {
+			return
+		}
+		sm.log().Info("participant ", signal.From, " refused recording of session ", session.Sid)
+		session.Recording = false
+	default:
+		return
+	}
+
+	sm.log().Info("session ", session.Sid, " recording:", session.Recording, " by ", signal.From)
+	sm.sendRecordControl(session)
+	sm.notifyRecordState(session)
+}
+
+func (sm *SessionManager) sendRecordControl(session *Session) {
+	control := byte(relay.RecordControlStop)
+	if session.Recording {
+		control = relay.RecordControlStart
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeRecordControl, SessionManagerUserId, session.Sid, 0, []byte{control}, nil)
+	sm.sendMessageToSessionRelays(msg, session)
+}
+
+func (sm *SessionManager) notifyRecordState(session *Session) {
+	for _, p := range session.Participants {
+		if p.InState(YCKParticipantStateIncall) || p.InState(YCKParticipantStateCalled) {
+			state := NewSignal(YCKCallSignalTypeRecordState, SessionManagerUserId, p.Uid, session.Sid)
+			state.Info = make(map[string]interface{})
+			state.Info["recording"] = session.Recording
+			state.Info["by"] = session.RecordBy
+			sm.sendSignal(state, false)
+		}
+	}
+}
+
+//媒体只经过session自己的relay，控制消息也只发给它们
+func (sm *SessionManager) sendMessageToSessionRelays(msg *relay.Message, session *Session) {
+	if len(session.Relays) == 0 {
+		sm.sendSignalMessageByRelays(msg)
+		return
+	}
+
+	data := msg.ObfuscatedDataOfMessage()
+	for _, r := range session.Relays {
+		udpAddr, err := net.ResolveUDPAddr("udp4", r)
+		if err != nil {
+			sm.log().Error("incorrect addr ", err)
+			continue
+		}
+
+		sm.writeToRelay(data, udpAddr)
+	}
+}
@@ -0,0 +1,34 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+/*
+振铃组：客服热线一类的场景，同时呼叫一组人，谁先接听就由谁接，其他人不再响铃。
+在现有的member_op上实现，发起方把op从"invite"换成"ring"：
+1. 成员的邀请、超时和普通多方邀请一样，session标记为振铃组
+2. 第一个Accept的成员进入通话，其他还在响铃的成员收到Cancel，reason为YCKCallEndReasonAnsweredElsewhere，
+   不算未接来电
+3. 有人接听后振铃组标记清除，之后的member_op按普通多方处理
+*/
+
+func (sm *SessionManager) startRingGroup(session *Session) {
+	session.RingGroup = true
+}
+
+//winner已经接听，取消其他成员的振铃
+func (sm *SessionManager) answerRingGroup(session *Session, winner int64) {
+	if !session.RingGroup {
+		return
+	}
+	session.RingGroup = false
+	for _, p := range session.CancelRinging(winner, YCKCallEndReasonAnsweredElsewhere) {
+		cancel := NewSignal(YCKCallSignalTypeCancel, SessionManagerUserId, p.Uid, session.Sid)
+		cancel.Info = map[string]interface{}{"reason": YCKCallEndReasonAnsweredElsewhere}
+		sm.sendSignal(cancel, true)
+	}
+}
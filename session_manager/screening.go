@@ -0,0 +1,96 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"time"
+)
+
+/*
+来电过滤：给被叫发Invite之前（1-1的Invite和多方的member invite），依次询问sm.callPolicies。
+1. 任一CallPolicy返回非0的reason，就不发Invite，被叫不会被打扰；给主叫回PolicyReject，Info带reason和被叫uid
+   1-1时session里不创建参与者；多方时跳过这个成员，其他成员照常邀请
+2. 内置DoNotDisturb，由管理接口POST /users/dnd?uid=x&seconds=n设置，seconds为0时取消
+3. 其他实现（如查外部的免打扰服务、按被叫的黑名单过滤主叫）在Start之前用AddCallPolicy加入，
+   CheckCall在主循环里调用，不能阻塞，需要查外部存储的应自己缓存
+*/
+
+type CallRequest struct {
+	Sid      int64
+	Caller   int64
+	Callee   int64
+	CallType string //"audio"、"video"或空，见invite.go
+	Group    bool   //多方通话
+}
+
+type CallPolicy interface {
+	CheckCall(req *CallRequest) uint16 //返回0放行，否则为PolicyReject的reason，见YCKPolicyReject*
+}
+
+func (sm *SessionManager) AddCallPolicy(policy CallPolicy) {
+	sm.callPolicies = append(sm.callPolicies, policy)
+}
+
+//被拒绝时给主叫回PolicyReject并返回false
+func (sm *SessionManager) screenCall(session *Session, caller int64, callee int64, callType string) bool {
+	req := &CallRequest{
+		Sid:      session.Sid,
+		Caller:   caller,
+		Callee:   callee,
+		CallType: callType,
+		Group:    session.Mode == YCKCallModeMultiple,
+	}
+	if reason := sm.checkCall(req); reason != 0 {
+		sm.log().Info("call from ", caller, " to ", callee, " in session ", session.Sid, " screened, reason:", reason)
+		sm.sendPolicyReject(caller, session.Sid, map[string]interface{}{
+			"reason": reason,
+			"uid":    callee,
+		})
+		return false
+	}
+	return true
+}
+
+//依次询问callPolicies，返回第一个拒绝的reason，都放行时返回0
+func (sm *SessionManager) checkCall(req *CallRequest) uint16 {
+	for _, policy := range sm.callPolicies {
+		if reason := policy.CheckCall(req); reason != 0 {
+			return reason
+		}
+	}
+	return 0
+}
+
+type DoNotDisturb struct {
+	until map[int64]time.Time
+}
+
+func NewDoNotDisturb() *DoNotDisturb {
+	return &DoNotDisturb{until: make(map[int64]time.Time)}
+}
+
+//until为零值时取消
+func (d *DoNotDisturb) Set(uid int64, until time.Time) {
+	if until.IsZero() {
+		delete(d.until, uid)
+		return
+	}
+	d.until[uid] = until
+}
+
+func (d *DoNotDisturb) CheckCall(req *CallRequest) uint16 {
+	until, ok := d.until[req.Callee]
+	if !ok {
+		return 0
+	}
+	if time.Now().Before(until) {
+		return YCKPolicyRejectDoNotDisturb
+	}
+	delete(d.until, req.Callee)
+	return 0
+}
@@ -0,0 +1,126 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"sort"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils"
+)
+
+/*
+信令的顺序：UDP会乱序，同一个人先后发的信令（如invite之后马上cancel，member_op之后马上end）可能反着到达，
+状态机按到达的顺序处理就会出错。
+1. 客户端在信令的Seq里带上自己在这个session内的序号，从1开始每发一个加1，重发的信令用原来的序号。
+   Seq为0的（老客户端、sid请求等session之外的信令）不排序，到了就处理
+2. session按发送方记录下一个要处理的序号，提前到达的先缓存，缺的到了以后按序号依次处理
+3. 缺的等SequenceTimeout还没到，或者新到的序号超出了SequenceWindow，就跳过缺的，把缓存的按序号处理掉
+4. 序号小于下一个要处理的（已处理过或已被跳过）的信令丢弃，原因为SignalDropLate
+只能保证同一发送方的信令按顺序，不同发送方之间的先后仍以session manager收到的为准。
+*/
+
+const (
+	SequenceWindow  = 16          //比下一个要处理的序号大这么多以上时不再等
+	SequenceTimeout = time.Second //缺的信令最多等这么久，受WheelTick的精度限制
+)
+
+//session内各发送方的信令序号
+type SignalSequences struct {
+	senders map[int64]*signalSequence
+}
+
+type signalSequence struct {
+	next    uint32             //下一个要处理的序号
+	pending map[uint32]*Signal //提前到达的信令
+	timeout *utils.Timeout     //有缓存时等缺的信令的定时器
+}
+
+func (q *signalSequence) add(signal *Signal) (ready []*Signal, late bool) {
+	if signal.Seq < q.next || q.pending[signal.Seq] != nil {
+		return nil, true
+	}
+	if signal.Seq-q.next >= SequenceWindow {
+		ready = q.skip()
+		q.next = signal.Seq
+	}
+	if signal.Seq > q.next {
+		q.pending[signal.Seq] = signal
+		return ready, false
+	}
+	ready = append(ready, signal)
+	q.next++
+	for s := q.pending[q.next]; s != nil; s = q.pending[q.next] {
+		delete(q.pending, q.next)
+		ready = append(ready, s)
+		q.next++
+	}
+	return ready, false
+}
+
+//跳过缺的，按序号返回所有缓存的信令
+func (q *signalSequence) skip() []*Signal {
+	seqs := make([]int, 0, len(q.pending))
+	for seq := range q.pending {
+		seqs = append(seqs, int(seq))
+	}
+	sort.Ints(seqs)
+	ready := make([]*Signal, 0, len(seqs))
+	for _, seq := range seqs {
+		ready = append(ready, q.pending[uint32(seq)])
+		q.next = uint32(seq) + 1
+	}
+	q.pending = make(map[uint32]*Signal)
+	return ready
+}
+
+//返回现在可以按顺序处理的信令，可能为空
+func (sm *SessionManager) sequenceSignal(session *Session, signal *Signal) []*Signal {
+	if signal.Seq == 0 {
+		return []*Signal{signal}
+	}
+	if session.Sequences == nil {
+		session.Sequences = &SignalSequences{senders: make(map[int64]*signalSequence)}
+	}
+	q := session.Sequences.senders[signal.From]
+	if q == nil {
+		q = &signalSequence{next: 1, pending: make(map[uint32]*Signal)}
+		session.Sequences.senders[signal.From] = q
+	}
+	ready, late := q.add(signal)
+	if late {
+		sm.log().Warn("drop late signal ", signal.Signal, " seq ", signal.Seq, " from ", signal.From, " in session ", session.Sid, ", expecting ", q.next)
+		sm.dropSignal(signal, SignalDropLate)
+		return nil
+	}
+	if len(q.pending) == 0 && q.timeout != nil {
+		sm.wheel.Cancel(q.timeout)
+		q.timeout = nil
+	} else if len(q.pending) > 0 && q.timeout == nil {
+		from := signal.From
+		q.timeout = sm.wheel.Schedule(SequenceTimeout, func() {
+			q.timeout = nil
+			if sm.sessions[session.Sid] != session || len(q.pending) == 0 {
+				return
+			}
+			sm.log().Warn("signal seq ", q.next, " from ", from, " in session ", session.Sid, " not arrived, skipped")
+			sm.handleSequenced(session, q.skip())
+		})
+	}
+	return ready
+}
+
+//依次处理，中途session结束了就不再处理
+func (sm *SessionManager) handleSequenced(session *Session, signals []*Signal) {
+	for _, signal := range signals {
+		if sm.sessions[session.Sid] != session {
+			return
+		}
+		sm.handleSessionSignal(signal, session)
+	}
+}
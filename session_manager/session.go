@@ -18,6 +18,7 @@ const (
 	YCKParticipantStateCalling  = 1
 	YCKParticipantStateCalled   = 2
 	YCKParticipantStateIncall   = 4
+	YCKParticipantStateLobby    = 8 //在锁定的多方通话的等候室里，等主持人准入，见lobby.go
 
 	YCKParticipantEventInvite     = 1
 	YCKParticipantEventRecvInvite = 2
@@ -32,6 +33,9 @@ const (
 	YCKParticipantEventEnd        = 11
 	YCKParticipantEventRecvEnd    = 12
 	YCKParticipantEventTimout     = 13
+	YCKParticipantEventWait       = 14 //进了等候室
+	YCKParticipantEventAdmitted   = 15 //被准入
+	YCKParticipantEventDenied     = 16 //被拒绝加入
 )
 
 type Participant struct {
@@ -41,6 +45,20 @@ type Participant struct {
 	LastStateTime time.Time
 	Timeout      *time.Timer
 	HasChange     bool
+	PunchAddr     string     //p2p打洞用的外网地址，由客户端在PunchRequest中上报
+	EndReason     uint16     //最近一次回到idle的原因，见YCKCallEndReason*
+	JoinTime      time.Time  //第一次进入incall的时间
+	LeaveTime     time.Time  //最近一次从incall离开的时间
+	Held          bool       //incall时被保持，离开incall即清除
+	Joined        bool       //进入incall后已记为加入，离开时发participant.left并调用OnEnded，见events.go
+	Device        string     //发起或接听所用的设备，发给他的信令只送到这个设备，回到idle即清除，见relay/devices.go
+	Caller        int64      //最近一次呼叫他的uid，见missed.go
+	MediaCaps     *MediaCaps //Invite/Accept里带的媒体能力，老客户端为nil，见media_caps.go
+	Restrict      uint8      //被限制的媒体权限，relay.MemberNo*位，由member_op的permit设置，见permissions.go
+	Room          uint8      //所在的分组讨论房间，0为主会场，见breakout.go
+	Quality       *Quality   //relay最近上报的通话质量，见quality.go
+	DeviceType    uint8      //注册时上报的设备类型，relay.DeviceType*，见participant_meta.go
+	NetworkType   uint8      //注册时上报的网络类型，relay.NetworkType*
 	//option,info,device info之类信息需要补充
 }
 
@@ -55,7 +73,25 @@ func NewParticipant(uid int64) *Participant {
 }
 
 func (p *Participant) SetState(state uint16) {
+	now := time.Now()
+	if state == YCKParticipantStateIncall && p.JoinTime.IsZero() {
+		p.JoinTime = now
+	}
+	if state == YCKParticipantStateIdle && p.State == YCKParticipantStateIncall {
+		p.LeaveTime = now
+	}
+	if state != YCKParticipantStateIdle {
+		p.EndReason = YCKCallEndReasonUnknown
+	}
+	if state != YCKParticipantStateIncall {
+		p.Held = false
+	}
+	if state == YCKParticipantStateIdle {
+		p.Device = ""
+		p.Room = 0
+	}
 	p.State = state
+	p.LastStateTime = now
 	p.HasChange = true
 	if p.Timeout != nil {
 		p.Timeout.Stop()
@@ -70,6 +106,12 @@ func (p *Participant) SetEvent(event uint16) {
 	p.Event = event
 }
 
+//回到idle并记录原因
+func (p *Participant) End(reason uint16) {
+	p.SetState(YCKParticipantStateIdle)
+	p.EndReason = reason
+}
+
 func (p *Participant) setCallingTimeout(duration time.Duration, f func()) {
 	p.Timeout = time.AfterFunc(duration, f)
 }
@@ -80,7 +122,31 @@ type Session struct {
 	Participants   map[int64]*Participant
 	Relays         []string
 	LastActiveTime time.Time
-	Nickname       string   //这个多方通话的昵称，在invite其他member的信令消息中应该需要用到
+	Nickname       string      //这个多方通话的昵称，在invite其他member的信令消息中应该需要用到
+	CallType       string      //"audio"或"video"，见invite.go
+	Punch          *PunchState //1-1通话的p2p打洞协调状态
+	Recording      bool
+	RecordBy       int64     //发起录制的uid
+	ActiveSpeaker  int64     //relay上报的当前主讲人
+	RelayControl   string    //最近一次发给relay的setup，没变化就不重发，见session_control.go
+	Blackbox       *Blackbox //最近收到的信令，见blackbox.go
+	MediaCaps      string    //最近一次下发的公共媒体能力，没变化就不重发，见media_caps.go
+	Topology       string    //最近一次下发的媒体拓扑，见topology.go
+	Key            string    //base64的session key，客户端用来加密Info里的个人数据，见relay/sealed.go
+	RingGroup      bool      //振铃组还没有人接听，见ringgroup.go
+	ClickToCall    bool      //由管理接口代为发起，不到两方时结束，见click_to_call.go
+	CreateTime     time.Time
+	MaxDuration    time.Duration          //从创建起超过这个时长由session manager强制结束，0为不限，见max_duration.go
+	Voicemail      *Voicemail             //被叫拒接或无应答后主叫的留言，见voicemail.go
+	Rooms          []string               //分组讨论房间的名字，下标+1为房间号，见breakout.go
+	Migration      *RelaySwitch           //正在进行的relay迁移，见migration.go
+	MemberOps      *MemberOps             //最近处理过的带op_id的member_op，用于去重，见member_op.go
+	Sequences      *SignalSequences       //各发送方信令的序号和提前到达的信令，见sequence.go
+	Publishers     map[int64]bool         //广播模式的发布者，nil为普通通话，见broadcast.go
+	Owner          int64                  //请求sid的人，是主持人，见lock.go
+	Locked         bool                   //锁定的多方通话，只有主持人能邀请，新加入的人先进等候室，见lock.go
+	Moderators     map[int64]bool         //owner以外的主持人
+	RelayStats     map[string]*RelayStats //relay地址 -> 最近一次上报的转发统计，见session_stats.go
 }
 
 func NewSession(sid int64) *Session {
@@ -89,6 +155,210 @@ func NewSession(sid int64) *Session {
 		Mode:           YCKCallModeUndecided,
 		Participants:   make(map[int64]*Participant),
 		LastActiveTime: time.Now(),
+		CreateTime:     time.Now(),
 	}
 	return s
 }
+
+/*
+参与者的状态机，只改状态，不收发信令，由主循环调用：
+  1-1模式下每个操作同时改对方（另一个参与者）的状态；多方模式下只改操作者自己，其他人由member_op邀请或踢出
+  返回false表示当前状态下不接受这个操作，状态不变
+发信令、missed call、事件和relay同步由SessionManager根据返回值处理。
+*/
+
+//没有时返回nil
+func (s *Session) Participant(uid int64) *Participant {
+	return s.Participants[uid]
+}
+
+//没有时创建一个idle的参与者
+func (s *Session) participant(uid int64) *Participant {
+	p := s.Participants[uid]
+	if p == nil {
+		p = NewParticipant(uid)
+		if s.subscriber(uid) {
+			p.Restrict = subscriberRestrict
+		}
+		s.Participants[uid] = p
+	}
+	return p
+}
+
+//1-1模式下from的对方，没有时返回nil
+func (s *Session) peerOf(from int64) *Participant {
+	if s.Mode != YCKCallModeOneToOne {
+		return nil
+	}
+	for uid, p := range s.Participants {
+		if uid != from {
+			return p
+		}
+	}
+	return nil
+}
+
+//from发起呼叫：1-1时to进入called，多方时to为session manager，from直接进入incall
+func (s *Session) Invite(from int64, to int64, device string) bool {
+	pf := s.participant(from)
+	if s.Mode == YCKCallModeOneToOne {
+		pt := s.participant(to)
+		if !pf.InState(YCKParticipantStateIdle) {
+			return false
+		}
+		pf.SetState(YCKParticipantStateCalling)
+		pt.SetState(YCKParticipantStateCalled)
+		pf.SetEvent(YCKParticipantEventInvite)
+		pt.SetEvent(YCKParticipantEventRecvInvite)
+		pf.Device = device
+		pt.Caller = from
+		return true
+	}
+	if !pf.InState(YCKParticipantStateIdle) {
+		return false
+	}
+	pf.SetState(YCKParticipantStateCalling)
+	pf.SetEvent(YCKParticipantEventInvite)
+	pf.Device = device
+	//session manager代为ring和accept
+	pf.SetState(YCKParticipantStateIncall)
+	pf.SetEvent(YCKParticipantEventRecvAccept)
+	return true
+}
+
+//多方通话中by邀请uid，uid进入called，uid已在通话或呼叫中时返回nil
+func (s *Session) InviteMember(by int64, uid int64) *Participant {
+	p := s.participant(uid)
+	if !p.InState(YCKParticipantStateIdle) {
+		return nil
+	}
+	p.SetState(YCKParticipantStateCalled)
+	p.SetEvent(YCKParticipantEventRecvInvite)
+	p.Caller = by
+	return p
+}
+
+//被叫from接听，设备由调用方在接听后设置，见devices.go
+func (s *Session) Accept(from int64) bool {
+	pf := s.Participants[from]
+	if pf == nil || !pf.InState(YCKParticipantStateCalled) {
+		return false
+	}
+	pf.SetState(YCKParticipantStateIncall)
+	pf.SetEvent(YCKParticipantEventAccept)
+	if pt := s.peerOf(from); pt != nil {
+		pt.SetState(YCKParticipantStateIncall)
+		pt.SetEvent(YCKParticipantEventRecvAccept)
+	}
+	return true
+}
+
+//主叫from取消呼叫或挂断，返回1-1时还在响铃、要记未接来电的对方
+func (s *Session) Cancel(from int64, reason uint16) (ok bool, missed *Participant) {
+	pf := s.Participants[from]
+	if pf == nil || !(pf.InState(YCKParticipantStateCalling) || pf.InState(YCKParticipantStateIncall) || pf.InState(YCKParticipantStateLobby)) {
+		return false, nil
+	}
+	pf.End(reason)
+	pf.SetEvent(YCKParticipantEventCancel)
+	if pt := s.peerOf(from); pt != nil {
+		if pt.InState(YCKParticipantStateCalled) {
+			missed = pt
+		}
+		pt.End(reason)
+		pt.SetEvent(YCKParticipantEventRecvCancel)
+	}
+	return true, missed
+}
+
+//被叫from拒接
+func (s *Session) Reject(from int64, reason uint16) bool {
+	return s.decline(from, reason, YCKParticipantEventReject, YCKParticipantEventRecvReject)
+}
+
+//被叫from忙
+func (s *Session) Busy(from int64, reason uint16) bool {
+	return s.decline(from, reason, YCKParticipantEventBusy, YCKParticipantEventRecvBusy)
+}
+
+func (s *Session) decline(from int64, reason uint16, event uint16, peerEvent uint16) bool {
+	pf := s.Participants[from]
+	if pf == nil || !pf.InState(YCKParticipantStateCalled) {
+		return false
+	}
+	pf.End(reason)
+	pf.SetEvent(event)
+	if pt := s.peerOf(from); pt != nil {
+		pt.End(reason)
+		pt.SetEvent(peerEvent)
+	}
+	return true
+}
+
+//from结束通话，任何状态都接受，返回1-1时还在响铃、要记未接来电的对方
+func (s *Session) End(from int64, reason uint16) (ok bool, missed *Participant) {
+	pf := s.Participants[from]
+	if pf == nil {
+		return false, nil
+	}
+	pf.End(reason)
+	pf.SetEvent(YCKParticipantEventEnd)
+	if pt := s.peerOf(from); pt != nil {
+		if pt.InState(YCKParticipantStateCalled) {
+			missed = pt
+		}
+		pt.End(reason)
+		pt.SetEvent(YCKParticipantEventRecvEnd)
+	}
+	return true, missed
+}
+
+//by把通话中的target踢出，target不在通话中时返回false
+func (s *Session) Kick(by int64, target int64) bool {
+	p := s.participant(target)
+	if !p.InState(YCKParticipantStateIncall) {
+		return false
+	}
+	p.End(YCKCallEndReasonKicked)
+	p.SetEvent(YCKParticipantEventRecvEnd)
+	return true
+}
+
+//uid响铃超时没有接听
+func (s *Session) Timeout(uid int64) bool {
+	p := s.Participants[uid]
+	if p == nil || !p.InState(YCKParticipantStateCalled) {
+		return false
+	}
+	p.End(YCKCallEndReasonTimeout)
+	p.SetEvent(YCKParticipantEventTimout)
+	return true
+}
+
+//振铃组有人接听：其他还在响铃的成员结束，返回这些成员
+func (s *Session) CancelRinging(winner int64, reason uint16) []*Participant {
+	var cancelled []*Participant
+	for uid, p := range s.Participants {
+		if uid == winner || !p.InState(YCKParticipantStateCalled) {
+			continue
+		}
+		p.End(reason)
+		p.SetEvent(YCKParticipantEventRecvCancel)
+		cancelled = append(cancelled, p)
+	}
+	return cancelled
+}
+
+//Session的只读副本，可以交给主循环之外使用，也用于停服交接，见handoff.go
+func (s *Session) Snapshot() *SessionSnapshot {
+	return NewSessionSnapshot(s)
+}
+
+func (s *Session) hasParticipantInCall() bool {
+	for _, p := range s.Participants {
+		if p.InState(YCKParticipantStateIncall) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+relay session控制：
+1. 每次参与者状态变化后，把非idle的参与者和允许的媒体通过UdpMessageTypeSessionControl(setup)发给session的relay，
+   relay据此只让成员TurnReg、只转发成员发的媒体。呼叫中(called)的人也算成员，接听前relay就要接受他的注册；
+   等候室里的人不算，准入后才是成员（见lobby.go）
+2. 语音通话只允许音频和数据，其他情况(视频或未声明call_type)全部允许
+3. 成员、媒体、成员的权限（见permissions.go）和所在房间（见breakout.go）没变化不重发；成员全部离开或session删除时发teardown
+*/
+
+func (sm *SessionManager) syncRelaySession(session *Session) {
+	members := make([]int64, 0, len(session.Participants))
+	for _, p := range session.Participants {
+		if !(p.InState(YCKParticipantStateIdle) || p.InState(YCKParticipantStateLobby)) || session.Voicemail.recording(p.Uid) {
+			members = append(members, p.Uid)
+		}
+	}
+	if len(members) == 0 {
+		sm.teardownRelaySession(session)
+		return
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+
+	media := uint8(relay.MediaAll)
+	if session.CallType == YCKCallTypeAudio {
+		media = relay.MediaAudio | relay.MediaData
+	}
+	restricts := make([]uint8, len(members))
+	rooms := make([]uint8, len(members))
+	for i, uid := range members {
+		restricts[i] = session.Participants[uid].Restrict
+		rooms[i] = session.Participants[uid].Room
+	}
+	control := &relay.SessionControl{Op: relay.SessionControlSetup, Media: media, Members: members, Restricts: restricts, Rooms: rooms}
+	signature := fmt.Sprint(media, members, restricts, rooms)
+	if signature == session.RelayControl {
+		return
+	}
+	session.RelayControl = signature
+	sm.log().Info("setup relay session ", session.Sid, " members:", members, " media:", media)
+	sm.sendSessionControl(session, control)
+}
+
+func (sm *SessionManager) teardownRelaySession(session *Session) {
+	if session.RelayControl == "" {
+		return
+	}
+	session.RelayControl = ""
+	sm.log().Info("teardown relay session ", session.Sid)
+	sm.sendSessionControl(session, &relay.SessionControl{Op: relay.SessionControlTeardown})
+}
+
+func (sm *SessionManager) sendSessionControl(session *Session, control *relay.SessionControl) {
+	msg := relay.NewMessage(relay.UdpMessageTypeSessionControl, SessionManagerUserId, session.Sid, 0, control.Marshal(), nil)
+	sm.sendMessageToSessionRelays(msg, session)
+}
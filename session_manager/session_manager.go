@@ -15,47 +15,277 @@ import (
 	"syscall"
 	"time"
 
-	"encoding/json"
+	"fmt"
 	"math/rand"
+	"strconv"
 
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xujiajundd/ycng/loadtest"
 	"github.com/xujiajundd/ycng/relay"
 	"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/errs"
 	"github.com/xujiajundd/ycng/utils/logging"
+	"github.com/xujiajundd/ycng/utils/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	SessionManagerUserId = -2
+
+	WheelTick          = time.Second
+	HousekeepingPeriod = 60 * time.Second
+	SessionIdleTimeout = 30 * time.Minute //session无信令往来超过这个时间即清理
+	SessionMaxIdle     = 12 * time.Hour   //有人仍在通话中的session最多保留这么久
 )
 
 type SessionManager struct {
 	sessions     map[int64]*Session
 	relays       []string
 	pushkit      *Pushkit
-	userTokens   map[int64]*PushToken
+	pushTokens   *PushTokens //uid -> 推送token，见token.go
 	saddr        string
-	conn         *net.UDPConn
-	subscriberCh chan *relay.ReceivedPacket
-	dedup        *utils.LRU
+	conn         Transport
+	pacer        *Pacer //发往relay的包都经过它限速，见pacer.go
+	breakers     *RelayBreakers //写失败的relay熔断，见breaker.go
+	inbox        *Inbox //收包队列，见inbox.go
+	dedup        *SignalDedup
 	isRunning    bool
 	lock         sync.RWMutex
 	stop         chan struct{}
 	wg           sync.WaitGroup
 	ticker       *time.Ticker
+	wheel        *utils.TimeWheel //所有定时任务都挂在时间轮上，由ticker驱动
+
+	punchAttempts  int
+	punchSuccesses int
+
+	accessSecret string //与relay共享，用于签发access token
+
+	maxCallsPerUser int                      //见Config.MaxCallsPerUser
+	maxDuration     time.Duration            //见Config.MaxDuration
+	tenants         map[uint16]*TenantConfig //租户单独的配置，见tenant.go
+
+	stateFile string //停服交接session的文件，见handoff.go
+
+	store relay.Store //relay列表和用户路由的存储，未配置时为nil，见store.go
+
+	publishers []EventPublisher //通话事件的webhook和消息总线，见events.go
+
+	dnd          *DoNotDisturb //内置的免打扰，由管理接口设置
+	callPolicies []CallPolicy  //发Invite给被叫前依次检查，见screening.go
+
+	stateHooks []*StateHooks //参与者状态变化的回调，见hooks.go
+
+	usage         *relay.UsageAggregator //计费用量，见quota.go
+	quota         *UsageQuota            //内置的用量配额，没有配置配额时为nil
+	quotaCheckers []QuotaChecker         //请求sid时依次检查
+
+	blackboxSize    int         //见Config.BlackboxSize
+	meshMax         int         //见Config.MeshMax
+	mixerMin        int         //见Config.MixerMin
+	endedBlackboxes utils.Cache //sid -> 已删除session的*Blackbox
+
+	guests map[int64]*Guest //临时uid -> 访客，见guest.go
+
+	presence map[int64]map[string]time.Time //uid -> relay地址 -> 最近一次上报在线的时间，见presence.go
+
+	hotlines  map[int64][]int64    //热线uid -> 坐席，见Config.Hotlines
+	adminUids map[int64]bool       //见Config.AdminUids
+	queues    map[int64]*CallQueue //排队的目标uid -> 队列，见queue.go
+
+	canaryInterval time.Duration                     //见Config.CanaryInterval，0为不拨测
+	canaryMaxSetup time.Duration                     //见Config.CanaryMaxSetup
+	canaryMaxLoss  float64                           //见Config.CanaryMaxLoss
+	canaryResults  map[string]*loadtest.CanaryResult //relay地址 -> 最近一次拨测结果，见canary.go
+
+	maxVoicemail time.Duration //见Config.MaxVoicemail，0为不开启
+	maxDatagram  int           //见Config.MaxDatagram，0为不限制
+	signalMaxAge time.Duration //见Config.SignalMaxAge，0为不检查
+
+	alerts      *AlertEngine     //按relay统计的质量告警，没有配置规则时为nil，见alerts.go
+	signalDrops map[uint16]int64 //丢弃信令的原因 -> 累计次数，见drops.go
+
+	replay *relay.ReplayFilter
+
+	capabilities utils.Cache //uid -> 能力位图
+	ingress      utils.Cache //uid -> 最近一次信令经过的relay地址
+	regions      utils.Cache //uid -> 客户端上报的区域
+	networks     utils.Cache //uid -> relay附带的设备和网络类型，见participant_meta.go
+	mtus         utils.Cache //uid -> relay附带的路径MTU，见mtu.go
+	relayRegions map[string]string
+
+	geo            GeoLocator           //为nil时不做GeoIP
+	clientIps      utils.Cache          //uid -> relay附带的公网ip
+	relayLocations map[string]*Location //relay地址 -> 位置，查不到为nil
+	reassembler  *relay.Reassembler
+
+	admin       *AdminServer
+	adminCh     chan func()                 //管理接口投递到主循环执行的操作
+	audit       *relay.AuditLog             //管理操作的审计日志，见relay/audit.go
+	relayAcks   map[string]time.Time        //relay地址 -> 最近一次收到UserRegReceived的时间
+	relayDrains map[string]time.Time        //relay地址 -> 最近一次收到排空通知的时间，见drain.go
+	relayClocks map[string]*relay.ClockSkew //relay地址 -> 与本机的时钟偏差，由注册的回复估算，见relay/clock.go
+
+	trace     *logging.Trace  //正在处理的包的日志字段，见utils/logging/trace.go
+	traceCtx  context.Context //正在处理的信令的trace上下文，不在处理信令时为nil
+	hopSource *relay.Message  //正在处理的信令带了逐跳时间戳时为这个信令，处理中发出的信令都带上它的各跳，见relay/hoptrace.go
+
+	capture *relay.PacketCapture //调试抓包，未开启时为nil
+
+	errorCounts errs.Counter //按类别的错误数，见errors.go
+
+	watchdog   *utils.Watchdog  //检查主循环和收包goroutine是否卡住，未开启时为nil
+	loopBeat   *utils.Heartbeat //主循环处理一项时为busy
+	clientBeat *utils.Heartbeat //收包goroutine收到包到放入收包队列之间为busy
+}
+
+func NewSessionManager(config *Config) *SessionManager {
+	if err := relay.SetupObfuscationKeys(config.ObfuscationKeys, time.Duration(config.ObfuscationGrace)*time.Second); err != nil {
+		logging.Logger.Error("obfuscation keys error:", err)
+	}
+	var store relay.Store
+	if config.Store != "" {
+		var err error
+		store, err = relay.OpenStore(config.Store)
+		if err != nil {
+			logging.Logger.Error("open store ", config.Store, " error:", err)
+			store = nil
+		}
+	}
+	sm := newSessionManager(config, store)
+	sm.ticker = time.NewTicker(WheelTick)
+	if sm.store != nil {
+		sm.loadRelays()
+	}
+	if len(config.Webhooks) > 0 {
+		sm.publishers = append(sm.publishers, NewWebhookDispatcher(config.Webhooks, config.WebhookSecret))
+	}
+	for _, url := range config.EventBus {
+		publisher, err := OpenEventPublisher(url)
+		if err != nil {
+			logging.Logger.Error("open event bus ", url, " error:", err)
+			continue
+		}
+		sm.publishers = append(sm.publishers, publisher)
+	}
+	if config.AdminAddr != "" {
+		sm.admin = NewAdminServer(config.AdminAddr, sm)
+	}
+	if config.GeoipFile != "" {
+		locator, err := NewMaxMindLocator(config.GeoipFile)
+		if err != nil {
+			logging.Logger.Error("open geoip database error:", err)
+		} else {
+			sm.SetGeoLocator(locator)
+		}
+	}
+	if config.CaptureFile != "" {
+		capture, err := relay.NewPacketCapture(config.CaptureFile)
+		if err != nil {
+			logging.Logger.Error("open capture file error:", err)
+		} else {
+			logging.Logger.Warn("capturing received packets to ", config.CaptureFile)
+			sm.capture = capture
+		}
+	}
+	if config.WatchdogTimeout > 0 {
+		var onStall func(string, time.Duration)
+		if config.WatchdogExit {
+			onStall = utils.ExitOnStall
+		}
+		sm.watchdog = utils.NewWatchdog(time.Duration(config.WatchdogTimeout)*time.Second, onStall)
+		sm.loopBeat = sm.watchdog.Watch("session manager main loop")
+		sm.clientBeat = sm.watchdog.Watch("session manager udp receiver")
+	}
+	sm.pushkit = NewPushkit()
+	return sm
 }
 
-func NewSessionManager() *SessionManager {
+//只有内存状态的部分，不改进程全局的设置，不连外部服务，也不启动定时器；黑匣子重放也用它，见blackbox.go
+func newSessionManager(config *Config, store relay.Store) *SessionManager {
 	sm := &SessionManager{
 		sessions:     make(map[int64]*Session),
-		saddr:        ":20001",
-		subscriberCh: make(chan *relay.ReceivedPacket),
-		dedup:        utils.NewLRU(100, nil),
+		saddr:        config.UdpAddr,
+		inbox:        NewInbox(config.InboxSize),
+		breakers:     NewRelayBreakers(),
+		dedup:        NewSignalDedup(config.DedupSize, config.DedupKey),
+		replay:       relay.NewReplayFilter(relay.ReplayWindow),
+		trace:        logging.NewTrace(logging.Logger),
+		capabilities: utils.NewLRUWithTTL(100000, 24*time.Hour, nil),
+		ingress:      utils.NewLRUWithTTL(100000, 24*time.Hour, nil),
+		regions:      utils.NewLRUWithTTL(100000, 24*time.Hour, nil),
+		networks:     utils.NewLRUWithTTL(100000, 24*time.Hour, nil),
+		mtus:         utils.NewLRUWithTTL(100000, 24*time.Hour, nil),
+		clientIps:    utils.NewLRUWithTTL(100000, 24*time.Hour, nil),
+		relayRegions: config.RelayRegions,
+		reassembler:  relay.NewReassembler(relay.FragmentTimeout),
+		accessSecret: config.AccessSecret,
+		adminCh:      make(chan func()),
+		relayAcks:    make(map[string]time.Time),
+		relayDrains:  make(map[string]time.Time),
+		relayClocks:  make(map[string]*relay.ClockSkew),
+		guests:       make(map[int64]*Guest),
+		presence:     make(map[int64]map[string]time.Time),
+		hotlines:     config.Hotlines,
+		queues:       make(map[int64]*CallQueue),
+		signalDrops:  make(map[uint16]int64),
 		isRunning:    false,
 		stop:         make(chan struct{}),
-		ticker:       time.NewTicker(60 * time.Second),
+		wheel:        utils.NewTimeWheel(WheelTick, 512),
+		store:        store,
 	}
 	sm.GetRelays()
-	sm.pushkit = NewPushkit()
-	sm.userTokens = make(map[int64]*PushToken)
+	sm.pacer = NewPacer(config.PaceRate, config.PaceGlobalRate, sm.recordRelayWrite)
+	sm.maxCallsPerUser = config.MaxCallsPerUser
+	sm.maxDuration = time.Duration(config.MaxDuration) * time.Second
+	sm.canaryInterval = time.Duration(config.CanaryInterval) * time.Second
+	sm.canaryMaxSetup = time.Duration(config.CanaryMaxSetup) * time.Millisecond
+	sm.canaryMaxLoss = config.CanaryMaxLoss
+	sm.canaryResults = make(map[string]*loadtest.CanaryResult)
+	sm.maxVoicemail = time.Duration(config.MaxVoicemail) * time.Second
+	sm.maxDatagram = config.MaxDatagram
+	sm.signalMaxAge = time.Duration(config.SignalMaxAge) * time.Second
+	sm.adminUids = make(map[int64]bool)
+	for _, uid := range config.AdminUids {
+		sm.adminUids[uid] = true
+	}
+	sm.tenants = config.Tenants
+	sm.stateFile = config.StateFile
+	sm.blackboxSize = config.BlackboxSize
+	sm.meshMax = config.MeshMax
+	sm.mixerMin = config.MixerMin
+	sm.audit = relay.OpenAuditLogOrMemory(config.AuditFile)
+	sm.dnd = NewDoNotDisturb()
+	sm.callPolicies = []CallPolicy{sm.dnd}
+	sm.endedBlackboxes = utils.NewLRUWithTTL(BlackboxEndedSessions, BlackboxRetention, nil)
+	if len(config.Relays) > 0 {
+		sm.relays = config.Relays
+	}
+	if sm.store != nil {
+		sm.usage = relay.NewUsageAggregator(sm.store)
+	} else {
+		sm.usage = relay.NewUsageAggregator(relay.NewMemoryStore()) //用量只在内存里保留
+	}
+	if quota := newUsageQuota(sm.usage, config); quota != nil {
+		sm.quota = quota
+		sm.AddQuotaChecker(quota)
+	}
+	var rules []*AlertRule
+	for _, text := range config.AlertRules {
+		rule, err := ParseAlertRule(text)
+		if err != nil {
+			logging.Logger.Error("alert rule error:", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > 0 {
+		sm.alerts = NewAlertEngine(rules)
+	}
+	sm.pushTokens = NewPushTokens(sm.store, time.Duration(config.PushTokenTtl)*time.Second)
 	return sm
 }
 
@@ -65,31 +295,72 @@ func (sm *SessionManager) Start() {
 	if !sm.isRunning {
 		sm.isRunning = true
 		sm.wg.Add(1)
-		addr, err := net.ResolveUDPAddr("udp4", sm.saddr)
-		if err != nil {
-			logging.Logger.Error("error ResolveUDPAddr")
-		}
+		if sm.conn == nil {
+			addr, err := net.ResolveUDPAddr("udp4", sm.saddr)
+			if err != nil {
+				sm.log().Error("error ResolveUDPAddr")
+			}
 
-		conn, err := net.ListenUDP("udp", addr)
-		if err != nil {
-			logging.Logger.Error("error ListenUDP", err)
-			return
-		}
-		logging.Logger.Info("listen on port:", sm.saddr)
+			conn, err := net.ListenUDP("udp", addr)
+			if err != nil {
+				sm.log().Error("error ListenUDP", err)
+				return
+			}
+			sm.log().Info("listen on port:", sm.saddr)
 
-		sm.conn = conn
+			sm.conn = conn
+		}
 
-		sm.registerUserToRelays()
+		if sm.stateFile != "" {
+			sm.restoreSessions(sm.stateFile)
+		}
+		for _, publisher := range sm.publishers {
+			publisher.Start()
+		}
+		sm.keepalive()
+		sm.dedup.cache.StartSweeper(10 * time.Second)
+		sm.wheel.Schedule(HousekeepingPeriod, sm.housekeeping)
+		if sm.alerts != nil {
+			sm.wheel.Schedule(AlertCheckPeriod, sm.checkAlerts)
+		}
 
+		sm.watchdog.Start()
 		go sm.loop()
 		go sm.handleClient()
+		sm.startCanary()
+
+		if sm.admin != nil {
+			sm.admin.Start()
+		}
 	}
 }
 
+//在Start之前调用，用指定的Transport代替监听udp端口
+func (sm *SessionManager) SetTransport(t Transport) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.conn = t
+}
+
 func (sm *SessionManager) Stop() {
 	sm.lock.Lock()
 	defer sm.lock.Unlock()
 	if sm.isRunning {
+		if sm.admin != nil {
+			sm.admin.Stop()
+		}
+		//停服前交接session或通知所有通话中的用户结束，见handoff.go
+		sm.runInLoop(sm.shutdownSessions)
+		sm.runInLoop(sm.flushUsage)
+		for _, publisher := range sm.publishers {
+			publisher.Stop()
+		}
+		sm.dedup.cache.StopSweeper()
+		sm.watchdog.Stop()
+		if sm.store != nil {
+			sm.store.Close()
+		}
+		sm.audit.Close()
 		sm.isRunning = false
 	}
 	close(sm.stop)
@@ -114,12 +385,23 @@ func (sm *SessionManager) loop() {
 	for {
 		select {
 		case <-sm.stop:
+			if sm.capture != nil {
+				sm.capture.Close()
+			}
 			return
-		case packet := <-sm.subscriberCh:
-			sm.handlePacket(packet)
+		case <-sm.inbox.Ready():
+			sm.loopBeat.Busy()
+			if packet := sm.inbox.Pop(); packet != nil {
+				sm.handlePacket(packet)
+			}
+		case fn := <-sm.adminCh:
+			sm.loopBeat.Busy()
+			fn()
 		case time := <-sm.ticker.C:
+			sm.loopBeat.Busy()
 			sm.handleTicker(time)
 		}
+		sm.loopBeat.Idle()
 	}
 }
 
@@ -127,13 +409,19 @@ func (sm *SessionManager) handleClient() {
 	var buf [2048]byte
 
 	for {
+		sm.clientBeat.Idle()
 		size, addr, err := sm.conn.ReadFromUDP(buf[0:])
+		sm.clientBeat.Busy()
+		if err == errTransportClosed {
+			sm.clientBeat.Idle()
+			return
+		}
 		if err != nil {
-			logging.Logger.Error("error ReadFromUDP ", err)
+			sm.reportError(errs.Wrap(errs.Mark(errs.Transport, err), "read udp"))
 			continue
 		}
 
-		data := make([]byte, size)
+		data := utils.GetPacketBuffer(size)
 		copy(data, buf[0:size])
 		packet := &relay.ReceivedPacket{
 			Body:        data,
@@ -141,32 +429,118 @@ func (sm *SessionManager) handleClient() {
 			Time:        time.Now().UnixNano(),
 		}
 
-		sm.subscriberCh <- packet
+		sm.inbox.Push(packet, isCriticalPacket(data))
 	}
 }
 
+//带着当前包的trace字段的日志，见utils/logging/trace.go
+func (sm *SessionManager) log() *logrus.Entry {
+	return sm.trace.Logger()
+}
+
 func (sm *SessionManager) handlePacket(packet *relay.ReceivedPacket) {
+	defer utils.PutPacketBuffer(packet.Body)
+	if sm.capture != nil {
+		if err := sm.capture.Write(packet); err != nil {
+			sm.log().Warn("capture packet error:", err)
+		}
+	}
+	if sm.maxDatagram > 0 && len(packet.Body) > sm.maxDatagram {
+		sm.log().Warn("drop packet of ", len(packet.Body), " bytes from ", packet.FromUdpAddr, " over max datagram")
+		return
+	}
 	msg, err := relay.NewMessageFromObfuscatedData(packet.Body)
 	if err != nil {
-		logging.Logger.Warn("error:", err)
+		sm.reportError(errs.Wrap(err, "parse packet").From(packet.FromUdpAddr.String()))
 		return
 	}
 
+	sm.trace.Set(logrus.Fields{"from": msg.From, "to": msg.To, "type": msg.MsgType})
+	defer sm.trace.Clear()
+
 	switch msg.MsgType {
 	case relay.UdpMessageTypeUserRegReceived:
-		logging.Logger.Info("user reg received from ", packet.FromUdpAddr)
+		sm.log().Info("user reg received from ", packet.FromUdpAddr)
+		sm.relayAcks[packet.FromUdpAddr.String()] = time.Now()
+		sm.updateRelayClock(packet.FromUdpAddr.String(), msg, time.Unix(0, packet.Time))
 	case relay.UdpMessageTypeUserSignal:
+		msg, err = sm.reassembler.Restore(msg, time.Now())
+		if err != nil {
+			sm.reportError(errs.Wrap(err, "restore signal").From(packet.FromUdpAddr.String()).OfType(relay.UdpMessageTypeUserSignal))
+			return
+		}
+		if msg == nil {
+			return //分片还没收齐
+		}
+		sm.updateIngress(msg.From, packet.FromUdpAddr)
+		relay.AppendHop(msg, relay.HopSessionIn, time.Unix(0, packet.Time))
 		sm.handleMessageUserSignal(msg)
+		sm.dispatchQueues()
+	case relay.UdpMessageTypeRelayDrain:
+		sm.handleRelayDrain(msg, packet.FromUdpAddr)
+	case relay.UdpMessageTypeVoicemailDone:
+		sm.handleVoicemailDone(msg, packet.FromUdpAddr)
+	case relay.UdpMessageTypeQualityReport:
+		sm.handleQualityReport(msg, packet.FromUdpAddr)
+	case relay.UdpMessageTypePresence:
+		sm.handlePresence(msg, packet.FromUdpAddr)
+	case relay.UdpMessageTypeSessionStats:
+		sm.handleSessionStats(msg, packet.FromUdpAddr)
 	default:
-		logging.Logger.Warn("unrecognized message type")
+		sm.log().Warn("unrecognized message type")
 	}
 }
 
 func (sm *SessionManager) handleTicker(now time.Time) {
-	//每隔200秒重新注册一次
+	sm.wheel.Advance(now)
+	sm.reassembler.Expire(now)
+	if sm.capture != nil {
+		sm.capture.Flush()
+	}
+}
+
+//周期性任务，执行完后重新挂到时间轮上
+func (sm *SessionManager) housekeeping() {
+	sm.loadRelays()
+
+	sm.replay.Expire(time.Now())
+	sm.expirePresence(time.Now())
+	sm.reportMetrics()
+	sm.flushUsage()
+	sm.dispatchQueues()
+
+	if sm.punchAttempts > 0 {
+		sm.log().Info("<<< p2p punch attempts:", sm.punchAttempts, " succeeded:", sm.punchSuccesses, " >>>")
+	}
+
+	sm.wheel.Schedule(HousekeepingPeriod, sm.housekeeping)
+}
+
+//session manager是服务器，地址固定，不探测NAT映射，按relay.ServerRegInterval重新注册
+func (sm *SessionManager) keepalive() {
 	sm.registerUserToRelays()
+	sm.checkSessionRelays(time.Now())
+	sm.wheel.Schedule(relay.ServerRegInterval, sm.keepalive)
+}
 
-	//清理已经结束的session，1-1有收到过end，多方发出或收到所有的end。或者sm主动轮询参与者？
+//session的空闲超时，到期时若期间有过信令则按剩余时间重新挂上，否则清理
+func (sm *SessionManager) scheduleSessionExpiry(session *Session, delay time.Duration) {
+	sm.wheel.Schedule(delay, func() {
+		if sm.sessions[session.Sid] != session {
+			return
+		}
+		idle := time.Since(session.LastActiveTime)
+		if idle < SessionIdleTimeout {
+			sm.scheduleSessionExpiry(session, SessionIdleTimeout-idle)
+			return
+		}
+		if idle < SessionMaxIdle && session.hasParticipantInCall() {
+			sm.scheduleSessionExpiry(session, SessionIdleTimeout)
+			return
+		}
+		sm.log().Info("session ", session.Sid, " expired after idle ", idle)
+		sm.removeSession(session, YCKCallEndReasonTimeout)
+	})
 }
 
 //func (sm *SessionManager) handleMessageUserToken(msg *relay.Message) {
@@ -175,25 +549,79 @@ func (sm *SessionManager) handleTicker(now time.Time) {
 //}
 
 func (sm *SessionManager) handleMessageUserSignal(msg *relay.Message) {
+	parent, _ := relay.ContextFromMessage(msg)
+	ctx, span := tracing.Tracer().Start(parent, "sm.receive", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.Int64("from", msg.From), attribute.Int64("to", msg.To)))
+	defer span.End()
+
 	//去重
-	if sm.dedup.Contains(string(msg.Payload)) {
+	_, dedupSpan := tracing.Tracer().Start(ctx, "sm.dedup")
+	if sm.dedup.Seen(msg.Payload) {
+		dedupSpan.SetAttributes(attribute.Bool("duplicate", true))
+		dedupSpan.End()
 		return
-	} else {
-		sm.dedup.Add(string(msg.Payload), true)
 	}
+	dedupSpan.End()
 
 	//Unmarshal
 	signal := NewSignalTemp()
-	err := signal.Unmarshal(msg.Payload)
+	err := signal.UnmarshalMessage(msg)
 	if err != nil {
-		logging.Logger.Warn("signal unmarshal error:", err)
+		sm.reportError(errs.Wrap(err, "unmarshal signal").OfType(msg.MsgType))
+		sm.dropSignal(nil, SignalDropUnmarshal)
 		return
 	}
 
+	sm.trace.Add("sid", signal.SessionId)
+	sm.trace.Add("signal", signal.Signal)
+	if logging.IsTraced(signal.SessionId) {
+		logging.TraceLogger.Info("signal ", signal.String())
+	}
+
+	//之后对session的修改和发出的信令都挂在这个span下
+	ctx, sessionSpan := tracing.Tracer().Start(ctx, "sm.session",
+		trace.WithAttributes(attribute.Int64("sid", signal.SessionId), attribute.Int("signal", int(signal.Signal))))
+	defer sessionSpan.End()
+	sm.traceCtx = ctx
+	defer func() { sm.traceCtx = nil }()
+	if msg.HasFlag(relay.UdpMessageFlagHopTrace) {
+		sm.hopSource = msg
+		defer func() { sm.hopSource = nil }()
+	}
+
+	//dedup只能挡住近期经多个relay到达的重复，防重放要靠按发送方的时间窗口
+	if !sm.replay.Check(signal.From, signal, time.Now()) {
+		sm.log().Warn("drop replayed or stale signal ", signal.Signal, " from ", signal.From, " ts ", signal.Timestamp)
+		sm.dropSignal(signal, SignalDropReplayed)
+		return
+	}
+	if !sm.checkSignalAge(signal, time.Now()) {
+		sm.dropSignal(signal, SignalDropExpired)
+		return
+	}
+	sm.updateCapabilities(signal.From, msg)
+	sm.updateClientIp(signal.From, msg)
+	sm.updateNetwork(signal.From, msg)
+	sm.updateMtu(signal.From, msg)
+
+	if !sm.checkGuest(signal) || !sm.checkTenant(signal) {
+		sm.dropSignal(signal, SignalDropForbidden)
+		return
+	}
+	sm.updateRegion(signal)
+
 	if signal.Signal == YCKCallSignalTypeVoipTokenReg {
-		ptoken := NewPushToken(signal.From, signal.Info["token"].(string), signal.Info["platform"].(string))
-		sm.userTokens[signal.From] = ptoken
-		logging.Logger.Info("voip token:", signal.Info["token"].(string), " registered for user:", signal.From)
+		sm.handleVoipTokenReg(signal)
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypeAccessTokenRequest {
+		sm.handleAccessTokenRequest(signal)
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypePresence {
+		sm.handlePresenceQuery(signal)
 		return
 	}
 
@@ -208,38 +636,87 @@ func (sm *SessionManager) handleMessageUserSignal(msg *relay.Message) {
 	*/
 
 	if signal.Signal == YCKCallSignalTypeSidRequest {
-		//生成一个与现存不重复的sid
-		var sid int64
-		for {
-			sid = rand.Int63()
-			if sm.sessions[sid] == nil {
-				break
-			}
+		if !sm.checkQuota(signal) || !sm.checkCallPolicy(signal, 0) {
+			return
 		}
-		//创建session
-		session := NewSession(sid)
-		sm.sessions[sid] = session
+		session := sm.newSession(signal)
 
 		//回复信令
-		sid_created := NewSignal(YCKCallSignalTypeSidCreated, SessionManagerUserId, signal.From, sid)
+		sid_created := NewSignal(YCKCallSignalTypeSidCreated, SessionManagerUserId, signal.From, session.Sid)
+		sid_created.Info = withMaxDuration(withSessionKey(nil, session), session)
 		payload, err := sid_created.Marshal()
 		if err == nil {
 			msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, signal.From, 0, payload, nil)
 			sm.sendSignalMessage(msg, false)
 		} else {
-			logging.Logger.Warn("signal marshal error:", err)
+			sm.log().Warn("signal marshal error:", err)
 		}
 		return
 	}
 
 	if signal.SessionId == 0 {
-		logging.Logger.Warn("error signal:", signal.Signal, " with sid=0 ", signal.From, signal.To)
+		sm.log().Warn("error signal:", signal.Signal, " with sid=0 ", signal.From, signal.To)
+		sm.dropSignal(signal, SignalDropNoSid)
 		return
 	}
 
 	session := sm.sessions[signal.SessionId]
 	if session == nil {
-		logging.Logger.Warn("session not existed for id:", signal.SessionId)
+		sm.log().Warn("session not existed for id:", signal.SessionId)
+		sm.dropSignal(signal, SignalDropNoSession)
+		return
+	}
+	session.LastActiveTime = time.Now()
+	sm.recordSignal(session, signal)
+	sm.handleSequenced(session, sm.sequenceSignal(session, signal))
+}
+
+//session内的信令，按发送方的序号排好后调用，见sequence.go
+func (sm *SessionManager) handleSessionSignal(signal *Signal, session *Session) {
+	if signal.Signal == YCKCallSignalTypeInvite && !sm.checkCallPolicy(signal, session.Sid) {
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypeInvite && signal.To != SessionManagerUserId && !sm.screenCall(session, signal.From, signal.To, callTypeOf(signal)) {
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypePunchRequest || signal.Signal == YCKCallSignalTypePunchResult {
+		sm.handlePunchSignal(signal, session)
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypeRecordStart || signal.Signal == YCKCallSignalTypeRecordStop || signal.Signal == YCKCallSignalTypeRecordConsent {
+		sm.handleRecordSignal(signal, session)
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypeActiveSpeaker {
+		sm.handleActiveSpeaker(signal, session)
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypeHold || signal.Signal == YCKCallSignalTypeResume {
+		sm.handleHoldSignal(signal, session)
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypeHandover {
+		sm.handleHandover(signal, session)
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypeTerminate {
+		sm.handleTerminate(signal, session)
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypeRelaySwitch {
+		sm.handleRelaySwitch(signal, session)
+		return
+	}
+
+	if signal.Signal == YCKCallSignalTypeEnd && sm.endVoicemail(signal, session) {
 		return
 	}
 
@@ -248,12 +725,19 @@ func (sm *SessionManager) handleMessageUserSignal(msg *relay.Message) {
 		if session.Mode == YCKCallModeMultiple {
 			//进入多方模式后，不能再接受1-1信令
 			//todo：但是，如果有member还没收到state切换到多方状态时，有挂断等单方信令。还是需要处理？
-			logging.Logger.Warn("receive 1-1 signal when in multipart mode")
+			sm.log().Warn("receive 1-1 signal when in multipart mode")
+			sm.dropSignal(signal, SignalDropModeMismatch)
 			return
 		} else {
 			session.Mode = YCKCallModeOneToOne
 		}
 
+		if signal.Signal == YCKCallSignalTypeInvite || signal.Signal == YCKCallSignalTypeAccept {
+			signal.Info = sm.withRelayCandidates(signal.Info, signal.To)
+		}
+		if signal.Signal == YCKCallSignalTypeInvite {
+			signal.Info = withSessionKey(signal.Info, session)
+		}
 		payload, err := signal.Marshal()
 		if err == nil {
 			msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, signal.To, 0, payload, nil)
@@ -263,13 +747,10 @@ func (sm *SessionManager) handleMessageUserSignal(msg *relay.Message) {
 				sm.sendSignalMessage(msg, false)
 			}
 		} else {
-			logging.Logger.Warn("signal marshal error:", err)
+			sm.log().Warn("signal marshal error:", err)
 			return
 		}
 
-		pf := session.Participants[signal.From]
-		pt := session.Participants[signal.To]
-
 		switch signal.Signal {
 		case YCKCallSignalTypeInvite:
 			rs, ok := signal.Info["relays"].([]interface{})
@@ -280,65 +761,44 @@ func (sm *SessionManager) handleMessageUserSignal(msg *relay.Message) {
 				}
 			}
 
-			//logging.Logger.Info("Relays in signal invite:", session.Relays)
-
-			if pf == nil {
-				pf = NewParticipant(signal.From)
-				session.Participants[signal.From] = pf
-			}
-			if pt == nil {
-				pt = NewParticipant(signal.To)
-				session.Participants[signal.To] = pt
-			}
-			if pf.InState(YCKParticipantStateIdle) {
-				pf.SetState(YCKParticipantStateCalling)
-				pt.SetState(YCKParticipantStateCalled)
-				pf.SetEvent(YCKParticipantEventInvite)
-				pt.SetEvent(YCKParticipantEventRecvInvite)
-			}
+			//sm.log().Info("Relays in signal invite:", session.Relays)
+			updateCallType(signal, session)
+			session.Invite(signal.From, signal.To, signal.Device)
 		case YCKCallSignalTypeCancel:
-			if pf != nil && (pf.InState(YCKParticipantStateCalling) || pf.InState(YCKParticipantStateIncall)) {
-				pf.SetState(YCKParticipantStateIdle)
-				pt.SetState(YCKParticipantStateIdle)
-				pf.SetEvent(YCKParticipantEventCancel)
-				pt.SetEvent(YCKParticipantEventRecvCancel)
+			if _, missed := session.Cancel(signal.From, endReasonOf(signal)); missed != nil {
+				sm.reportMissedCall(session, missed)
+				if endReasonOf(signal) == YCKCallEndReasonTimeout {
+					sm.startVoicemail(session, signal.From, signal.To)
+				}
 			}
 		case YCKCallSignalTypeAccept:
-			if pf != nil && pf.InState(YCKParticipantStateCalled) {
-				pf.SetState(YCKParticipantStateIncall)
-				pt.SetState(YCKParticipantStateIncall)
-				pf.SetEvent(YCKParticipantEventAccept)
-				pt.SetEvent(YCKParticipantEventRecvAccept)
+			if session.Accept(signal.From) {
+				sm.acceptOnDevice(session, session.Participant(signal.From), signal.Device)
 			}
 		case YCKCallSignalTypeReject:
-			if pf != nil && pf.InState(YCKParticipantStateCalled) {
-				pf.SetState(YCKParticipantStateIdle)
-				pt.SetState(YCKParticipantStateIdle)
-				pf.SetEvent(YCKParticipantEventReject)
-				pt.SetEvent(YCKParticipantEventRecvReject)
+			if session.Reject(signal.From, endReasonOf(signal)) {
+				sm.startVoicemail(session, signal.To, signal.From)
 			}
 		case YCKCallSignalTypeBusy:
-			if pf != nil && pf.InState(YCKParticipantStateCalled) {
-				pf.SetState(YCKParticipantStateIdle)
-				pt.SetState(YCKParticipantStateIdle)
-				pf.SetEvent(YCKParticipantEventBusy)
-				pt.SetEvent(YCKParticipantEventRecvBusy)
-			}
+			session.Busy(signal.From, endReasonOf(signal))
 		case YCKCallSignalTypeEnd:
-			if pf != nil {
-				pf.SetState(YCKParticipantStateIdle)
-				pt.SetState(YCKParticipantStateIdle)
-				pf.SetEvent(YCKParticipantEventEnd)
-				pt.SetEvent(YCKParticipantEventRecvEnd)
+			if _, missed := session.End(signal.From, endReasonOf(signal)); missed != nil {
+				sm.reportMissedCall(session, missed)
 			}
 		default:
 
 		}
+		sm.updateMediaCaps(session, signal)
+		sm.reportParticipants(session)
+		sm.syncRelaySession(session)
+		sm.syncMediaCaps(session)
+		sm.syncTopology(session)
 	} else {
 		//管理session，member状态
 		if session.Mode == YCKCallModeOneToOne {
 			if signal.Signal != YCKCallSignalTypeMemberOp {
-				logging.Logger.Warn("multipart signal ignored in 1-1 mode ", signal.From, signal.To, signal.Signal)
+				sm.log().Warn("multipart signal ignored in 1-1 mode ", signal.From, signal.To, signal.Signal)
+				sm.dropSignal(signal, SignalDropModeMismatch)
 				return
 			} else {
 				session.Mode = YCKCallModeMultiple
@@ -349,14 +809,12 @@ func (sm *SessionManager) handleMessageUserSignal(msg *relay.Message) {
 			session.Mode = YCKCallModeMultiple
 		}
 
-		pf := session.Participants[signal.From]
-
 		switch signal.Signal {
 		case YCKCallSignalTypeInvite:
 			//回复ring，accept，设置状态为incall
 			if signal.Info["relays"] != nil {
 				if session.Relays != nil {
-					logging.Logger.Warn("session已经有relays情况下，invite又带了relays")
+					sm.log().Warn("session已经有relays情况下，invite又带了relays")
 				}
 				rs, ok := signal.Info["relays"].([]interface{})
 				if ok {
@@ -367,26 +825,23 @@ func (sm *SessionManager) handleMessageUserSignal(msg *relay.Message) {
 				}
 			}
 
-			if pf == nil {
-				pf = NewParticipant(signal.From)
-				session.Participants[signal.From] = pf
-			}
-			if pf.InState(YCKParticipantStateIdle) {
-				pf.SetState(YCKParticipantStateCalling)
-				pf.SetEvent(YCKParticipantEventInvite)
-
+			if sm.holdInLobby(session, signal) {
+				//等owner准入，见lobby.go
+			} else if !session.Invite(signal.From, SessionManagerUserId, signal.Device) {
+				sm.dropSignal(signal, SignalDropState)
+			} else {
 				ring := NewSignal(YCKCallSignalTypeRing, SessionManagerUserId, signal.From, session.Sid)
 				payload, err := ring.Marshal()
 				if err == nil {
 					msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, signal.From, 0, payload, nil)
 					sm.sendSignalMessage(msg, false)
 				} else {
-					logging.Logger.Warn("signal marshal error:", err)
+					sm.log().Warn("signal marshal error:", err)
 				}
 
 				accept := NewSignal(YCKCallSignalTypeAccept, SessionManagerUserId, signal.From, session.Sid)
+				accept.Info = sm.withRelayCandidates(nil, signal.From)
 				if signal.Info["relays"] == nil {
-					accept.Info = make(map[string]interface{})
 					accept.Info["relays"] = session.Relays
 				}
 
@@ -395,138 +850,207 @@ func (sm *SessionManager) handleMessageUserSignal(msg *relay.Message) {
 					msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, signal.From, 0, payload, nil)
 					sm.sendSignalMessage(msg, false)
 				} else {
-					logging.Logger.Warn("signal marshal error:", err)
+					sm.log().Warn("signal marshal error:", err)
 				}
-				pf.SetState(YCKParticipantStateIncall)
-				pf.SetEvent(YCKParticipantEventRecvAccept)
 
-				if signal.Info["op"] != nil && signal.Info["members"] != nil {
+				if hasMemberOp(signal) {
 					sm.processSignalOp(signal, session)
 				}
 			}
 		case YCKCallSignalTypeCancel: //calling这个状态其实并不存在
-			if pf != nil && (pf.InState(YCKParticipantStateCalling) || pf.InState(YCKParticipantStateIncall)) {
-				pf.SetState(YCKParticipantStateIdle)
-				pf.SetEvent(YCKParticipantEventCancel)
+			if ok, _ := session.Cancel(signal.From, endReasonOf(signal)); !ok {
+				sm.dropSignal(signal, SignalDropState)
 			}
 		case YCKCallSignalTypeEnd:
-			if pf != nil {
-				pf.SetState(YCKParticipantStateIdle)
-				pf.SetEvent(YCKParticipantEventEnd)
+			if ok, _ := session.End(signal.From, endReasonOf(signal)); !ok {
+				sm.dropSignal(signal, SignalDropState)
 			}
 		case YCKCallSignalTypeAccept:
-			if pf != nil && pf.InState(YCKParticipantStateCalled) {
-				pf.SetState(YCKParticipantStateIncall)
-				pf.SetEvent(YCKParticipantEventAccept)
+			if session.Accept(signal.From) {
+				sm.acceptOnDevice(session, session.Participant(signal.From), signal.Device)
+				sm.answerRingGroup(session, signal.From)
+			} else {
+				sm.dropSignal(signal, SignalDropState)
 			}
 		case YCKCallSignalTypeReject:
-			if pf != nil && pf.InState(YCKParticipantStateCalled) {
-				pf.SetState(YCKParticipantStateIdle)
-				pf.SetEvent(YCKParticipantEventReject)
+			if !session.Reject(signal.From, endReasonOf(signal)) {
+				sm.dropSignal(signal, SignalDropState)
 			}
 		case YCKCallSignalTypeBusy:
-			if pf != nil && pf.InState(YCKParticipantStateCalled) {
-				pf.SetState(YCKParticipantStateIdle)
-				pf.SetEvent(YCKParticipantEventBusy)
+			if !session.Busy(signal.From, endReasonOf(signal)) {
+				sm.dropSignal(signal, SignalDropState)
 			}
 		case YCKCallSignalTypeMemberOp:
 			if session.Mode == YCKCallModeOneToOne { //1-1模式时收到多方信令则转入多方模式，并且要通知所有参与方改模式
 				session.Mode = YCKCallModeMultiple
-				logging.Logger.Info("change to multipart mode")
+				sm.log().Info("change to multipart mode")
 			}
-			if signal.Info["op"] != nil && signal.Info["members"] != nil {
+			if hasMemberOp(signal) {
 				sm.processSignalOp(signal, session)
 			}
 		default:
+			sm.dropSignal(signal, SignalDropUnsupported)
 			return
 		}
 
+		sm.updateMediaCaps(session, signal)
 		sm.notifyMemberStateChange(session)
+		sm.checkClickToCall(session)
 	}
 }
 
+//为sid请求创建session，租户和最长时长按请求方
+func (sm *SessionManager) newSession(signal *Signal) *Session {
+	//生成一个与现存不重复的sid
+	var sid int64
+	for {
+		sid = relay.TenantId(relay.TenantOf(signal.From), rand.Int63())
+		if sm.sessions[sid] == nil {
+			break
+		}
+	}
+	session := NewSession(sid)
+	var err error
+	if session.Key, err = relay.NewSessionKey(); err != nil {
+		sm.reportError(errs.Wrap(errs.Mark(errs.Crypto, err), "generate session key").InSession(sid))
+	}
+	sm.sessions[sid] = session
+	sm.scheduleSessionExpiry(session, SessionIdleTimeout)
+	session.MaxDuration = sm.maxDurationOf(signal)
+	sm.scheduleMaxDuration(session)
+	session.Owner = signal.From
+	session.Locked, _ = signal.Info["locked"].(bool)
+	setupModerators(session, signal)
+	setupBroadcast(session, signal)
+	sm.emitEvent(NewEvent(EventSessionCreated, sid))
+	return session
+}
+
 func (sm *SessionManager) processSignalOp(signal *Signal, session *Session) {
 	op, okOp := signal.Info["op"].(string)
 	members, okMem := signal.Info["members"].([]interface{})
-	if okOp && okMem {
-		if op == "invite" {
+	opId, _ := signal.Info["op_id"].(string)
+	if sm.resendMemberOpResult(signal, session, opId) {
+		return
+	}
+	result := &MemberOpResult{By: signal.From, OpId: opId, Op: op}
+	if op == MemberOpBulk {
+		sm.processBulkOp(signal, session, result)
+	} else if okOp && okMem {
+		if op == "invite" || op == "ring" {
+			if op == "ring" {
+				sm.startRingGroup(session)
+			}
+			inviteInfo := newInviteInfo(signal, session)
 			for _, value := range members {
-				//mem, err := strconv.ParseUint(value.(json.Number).String(), 10, 64)
-				mem, err := value.(json.Number).Int64()
-				if err == nil {
-					p := session.Participants[mem]
-					if p == nil {
-						p = NewParticipant(mem)
-						session.Participants[mem] = p
-					}
-					if p.InState(YCKParticipantStateIdle) {
-						p.SetState(YCKParticipantStateCalled)
-						p.SetEvent(YCKParticipantEventRecvInvite)
-
-						invite := NewSignal(YCKCallSignalTypeInvite, SessionManagerUserId, mem, session.Sid)
-						//TODO:invite将来要加更多内容，比如relays，device info等等
-						invite.Info = make(map[string]interface{})
-						invite.Info["relays"] = session.Relays
-
-						payload, err := invite.Marshal()
-						if err == nil {
-							msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, mem, 0, payload, nil)
-							sm.sendSignalMessage(msg, true)
-						} else {
-							logging.Logger.Warn("signal marshal error:", err)
-						}
-
-						//60秒后timeout, 这个搞法需要测试下是否可行。。。
-						p.setCallingTimeout(60*time.Second, func() {
-							if p.InState(YCKParticipantStateCalled) {
-								p.SetState(YCKParticipantStateIdle)
-								p.SetEvent(YCKParticipantEventTimout)
-								sm.notifyMemberStateChange(session)
-							}
-						})
-
+				mem, err := memberUid(value)
+				if err == nil && relay.TenantOf(mem) != relay.TenantOf(session.Sid) {
+					sm.log().Warn("member ", mem, " is not in the tenant of session ", session.Sid, ", cannot invite")
+					result.add(mem, MemberOpSkipped, MemberSkipTenant)
+				} else if err == nil && session.inviteLocked(signal.From) {
+					sm.log().Warn("session ", session.Sid, " locked, ", signal.From, " cannot invite ", mem)
+					result.add(mem, MemberOpSkipped, MemberSkipLocked)
+				} else if err == nil {
+					if p := session.Participant(mem); p != nil && !p.InState(YCKParticipantStateIdle) {
+						sm.log().Warn("member ", mem, " not in idle state, cannot invite")
+						result.add(mem, MemberOpSkipped, MemberSkipNotIdle)
+					} else if sm.inviteMember(session, signal.From, mem, inviteInfo) {
+						result.add(mem, MemberOpInvited, "")
 					} else {
-						logging.Logger.Warn("member ", p.Uid, " not in idle state, cannot invite")
+						result.add(mem, MemberOpSkipped, MemberSkipScreened)
 					}
 				} else {
-					logging.Logger.Warn("parseUint error ", err)
+					sm.log().Warn("parseUint error ", err)
+					result.add(0, MemberOpSkipped, MemberSkipInvalid)
 				}
 			}
+		} else if op == "queue" {
+			sm.processQueueOp(signal, session, members)
+		} else if op == "permit" {
+			sm.processPermitOp(signal, session, members)
+		} else if op == "breakout" {
+			sm.processBreakoutOp(signal, session, members)
+		} else if op == "publish" || op == "unpublish" {
+			sm.processPublishOp(signal, session, members, op == "publish")
+		} else if op == "admit" || op == "deny" {
+			sm.processAdmitOp(signal, session, members, op == "admit", result)
+		} else if op == "lock" || op == "unlock" {
+			sm.processLockOp(signal, session, op == "lock")
 		} else if op == "kick" {
 			for _, value := range members {
-				//mem, err := strconv.ParseUint(value.(json.Number).String(), 10, 64)
-				mem, err := value.(json.Number).Int64()
+				mem, err := memberUid(value)
 				if err == nil {
-					p := session.Participants[mem]
-					if p == nil {
-						p = NewParticipant(mem)
-						session.Participants[mem] = p
-					}
-					if p.InState(YCKParticipantStateIncall) {
-						p.SetState(YCKParticipantStateIdle)
-						p.SetEvent(YCKParticipantEventRecvEnd)
-
-						end := NewSignal(YCKCallSignalTypeEnd, SessionManagerUserId, mem, session.Sid)
-						payload, err := end.Marshal()
-						if err == nil {
-							msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, mem, 0, payload, nil)
-							sm.sendSignalMessage(msg, false)
-						} else {
-							logging.Logger.Warn("signal marshal error:", err)
-						}
+					if sm.kickMember(session, signal.From, mem) {
+						result.add(mem, MemberOpKicked, "")
 					} else {
-						logging.Logger.Warn("member ", p, " not in incall state, cannot kick")
+						result.add(mem, MemberOpSkipped, MemberSkipNotInCall)
 					}
 				} else {
-					logging.Logger.Warn("parseUint error ", err)
+					sm.log().Warn("parseUint error ", err)
+					result.add(0, MemberOpSkipped, MemberSkipInvalid)
 				}
 			}
 		} else {
-			logging.Logger.Warn("unrecognized member op cmd ", op)
+			sm.log().Warn("unrecognized member op cmd ", op)
 		}
 	} else {
-		logging.Logger.Warn("member op cmd error ", op, members)
+		sm.log().Warn("member op cmd error ", op, members)
 	}
+	sm.finishMemberOp(session, result)
+}
+
+//by把mem移出多方通话，mem不在incall时返回false
+func (sm *SessionManager) kickMember(session *Session, by int64, mem int64) bool {
+	if !session.Kick(by, mem) {
+		sm.log().Warn("member ", mem, " not in incall state, cannot kick")
+		return false
+	}
+	sm.audit.Record(fmt.Sprintf("uid:%d", by), relay.AuditSessionKick, strconv.FormatInt(session.Sid, 10), fmt.Sprintf("uid:%d", mem))
+	sm.hookKicked(session, by, mem)
+
+	end := newEndSignal(mem, session.Sid, YCKCallEndReasonKicked)
+	payload, err := end.Marshal()
+	if err == nil {
+		msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, mem, 0, payload, nil)
+		sm.sendSignalMessage(msg, false)
+	} else {
+		sm.log().Warn("signal marshal error:", err)
+	}
+	return true
+}
+
+//by邀请mem加入多方通话，被来电过滤拦下或mem不在idle时返回false
+func (sm *SessionManager) inviteMember(session *Session, by int64, mem int64, inviteInfo map[string]interface{}) bool {
+	if p := session.Participant(mem); (p == nil || p.InState(YCKParticipantStateIdle)) && !sm.screenCall(session, by, mem, session.CallType) {
+		return false
+	}
+	p := session.InviteMember(by, mem)
+	if p == nil {
+		sm.log().Warn("member ", mem, " not in idle state, cannot invite")
+		return false
+	}
+
+	invite := NewSignal(YCKCallSignalTypeInvite, SessionManagerUserId, mem, session.Sid)
+	invite.Info = sm.withRelayCandidates(inviteInfo, mem)
+
+	payload, err := invite.Marshal()
+	if err == nil {
+		msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, mem, 0, payload, nil)
+		sm.sendSignalMessage(msg, true)
+	} else {
+		sm.log().Warn("signal marshal error:", err)
+	}
+
+	//60秒后timeout, 这个搞法需要测试下是否可行。。。
+	p.setCallingTimeout(60*time.Second, func() {
+		if session.Participant(mem) == p && p.InState(YCKParticipantStateCalled) {
+			sm.reportMissedCall(session, p)
+			session.Timeout(mem)
+			sm.notifyMemberStateChange(session)
+			sm.checkClickToCall(session)
+		}
+	})
+	return true
 }
 
 func (sm *SessionManager) notifyMemberStateChange(session *Session) {
@@ -534,7 +1058,11 @@ func (sm *SessionManager) notifyMemberStateChange(session *Session) {
 	//把状态通知所有参与方, 这个消息需要push么？
 	info := make(map[string]interface{})
 	pState := make(map[int64]map[string]uint16)
+	pMeta := make(map[int64]map[string]interface{})
 	for _, p := range session.Participants {
+		if session.subscriber(p.Uid) {
+			continue //订阅者只计数，见broadcast.go
+		}
 		key := p.Uid //strconv.FormatUint(p.Uid, 10)
 		value := make(map[string]uint16)
 		value["state"] = p.State
@@ -543,9 +1071,35 @@ func (sm *SessionManager) notifyMemberStateChange(session *Session) {
 			value["change"] = 1
 			p.HasChange = false
 		}
+		if p.InState(YCKParticipantStateIdle) && p.EndReason != YCKCallEndReasonUnknown {
+			value["reason"] = p.EndReason
+		}
+		if p.Held {
+			value["held"] = 1
+		}
+		if p.Room != 0 {
+			value["room"] = uint16(p.Room)
+		}
+		if session.moderator(p.Uid) {
+			value["moderator"] = 1
+		}
+		addRestrictState(value, p)
 		pState[key] = value
+		if meta := sm.participantMeta(p); meta != nil {
+			pMeta[key] = meta
+		}
 	}
 	info["states"] = pState
+	info["meta"] = pMeta
+	if len(session.Rooms) > 0 {
+		info["rooms"] = session.Rooms
+	}
+	if session.broadcasting() {
+		info["subscribers"] = session.subscriberCount()
+	}
+	if session.Locked {
+		info["locked"] = 1
+	}
 
 	//是不是只需要发给incall的人？如果有人需要查询怎么办？
 	for _, p := range session.Participants {
@@ -557,16 +1111,31 @@ func (sm *SessionManager) notifyMemberStateChange(session *Session) {
 				msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, p.Uid, 0, payload, nil)
 				sm.sendSignalMessage(msg, false)
 			} else {
-				logging.Logger.Warn("signal marshal error:", err)
+				sm.log().Warn("signal marshal error:", err)
 			}
 		}
 	}
+
+	sm.reportParticipants(session)
+	sm.syncRelaySession(session)
+	sm.syncMediaCaps(session)
+	sm.syncTopology(session)
 }
 
 func (sm *SessionManager) registerUserToRelays() {
+	sm.sendSignalMessageByRelays(sm.registrationMessage())
+}
+
+func (sm *SessionManager) registrationMessage() *relay.Message {
+	var token []byte
+	if sm.accessSecret != "" {
+		token = relay.IssueAccessToken(sm.accessSecret, SessionManagerUserId, time.Now().Add(relay.AccessTokenTTL))
+	}
 	msg := relay.NewMessage(relay.UdpMessageTypeUserReg,
-		SessionManagerUserId, 0, 0, nil, nil)
-	sm.sendSignalMessageByRelays(msg)
+		SessionManagerUserId, 0, 0, token, nil)
+	relay.SetCapabilities(msg, SessionManagerCapabilities)
+	relay.SetClockExtra(msg, time.Now())
+	return msg
 }
 
 func (sm *SessionManager) sendSignalMessageByRelays(msg *relay.Message) {
@@ -575,35 +1144,90 @@ func (sm *SessionManager) sendSignalMessageByRelays(msg *relay.Message) {
 	for _, relay := range sm.relays {
 		udpAddr, err := net.ResolveUDPAddr("udp4", relay)
 		if err != nil {
-			logging.Logger.Error("incorrect addr ", err)
+			sm.log().Error("incorrect addr ", err)
 		}
 
-		_, err = sm.conn.WriteToUDP(data, udpAddr)
-		if err != nil {
-			logging.Logger.Error("udp write error", err)
-		}
+		sm.writeToRelay(data, udpAddr)
 	}
 }
 
 func (sm *SessionManager) sendSignalMessageByPushkit(msg *relay.Message) {
 	//通过msg.to，得到其token
-	token := sm.userTokens[msg.To]
+	tokens := sm.pushTokens.Lookup(msg.To, time.Now())
 
 	//msg.payload直接发送，本来就是json串。但这样push只能接收signal了。。。不大利于将来扩展
 	payload := msg.Payload
 
-	if token != nil && len(token.Token) > 0 && payload != nil {
-		if token.Platform == "ios" {
-			sm.pushkit.Push(token.Token, payload)
-			logging.Logger.Info("push to:", msg.To, " with token:", token)
+	if len(tokens) == 0 || payload == nil {
+		sm.log().Warn("no push token or payload for:", msg.To, payload)
+		return
+	}
+	for _, token := range tokens {
+		if token.Platform != "ios" {
+			continue
 		}
-	} else {
-		logging.Logger.Warn("incorrect token or payload:", token, payload)
+		if sm.pushkit.Push(token.Token, payload) {
+			sm.log().Info("push to:", msg.To, " with token:", token.Token)
+		} else if sm.pushTokens.Unregister(msg.To, token.Token, time.Now()) {
+			sm.log().Info("invalid voip token:", token.Token, " unregistered for user:", msg.To)
+		}
+	}
+}
+
+func (sm *SessionManager) sendSignal(signal *Signal, needPush bool) {
+	payload, err := signal.Marshal()
+	if err != nil {
+		sm.log().Warn("signal marshal error:", err)
+		return
 	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, SessionManagerUserId, signal.To, 0, payload, nil)
+	sm.sendSignalMessage(msg, needPush)
 }
 
 func (sm *SessionManager) sendSignalMessage(msg *relay.Message, needPush bool) {
-	sm.sendSignalMessageByRelays(msg)
+	sm.sendSignalMessageToDevice(msg, sm.deviceOf(msg), needPush)
+}
+
+//device为""时relay送到msg.To的所有设备
+func (sm *SessionManager) sendSignalMessageToDevice(msg *relay.Message, device string, needPush bool) {
+	if sm.traceCtx != nil {
+		ctx, span := tracing.Tracer().Start(sm.traceCtx, "sm.send", trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(attribute.Int64("to", msg.To)))
+		if sm.supports(msg.To, relay.CapabilityTraceContext) {
+			relay.InjectTraceContext(ctx, msg)
+		}
+		defer span.End()
+	}
+	//push的payload必须是JSON，所以只在走relay的那份上换编码、压缩和分片
+	relayMsg := msg
+	capabilities := sm.capabilitiesOf(msg.To)
+	if capabilities&relay.CapabilityProtoSignal != 0 {
+		pb := *msg
+		if err := relay.TranscodeSignal(&pb, true); err == nil {
+			relayMsg = &pb
+		} else {
+			sm.reportError(errs.Wrap(err, "transcode signal to proto").OfType(msg.MsgType))
+		}
+	}
+	if device != "" {
+		targeted := *relayMsg
+		relay.SetDevice(&targeted, device)
+		relayMsg = &targeted
+	}
+	if sm.hopSource != nil {
+		hopped := *relayMsg
+		relay.CopyHops(&hopped, sm.hopSource)
+		relay.AppendHop(&hopped, relay.HopSessionOut, time.Now())
+		relayMsg = &hopped
+	}
+	messages, err := relay.PrepareSignal(relayMsg, capabilities, sm.datagramLimit(msg.To))
+	if err != nil {
+		sm.reportError(errs.Wrap(err, "prepare signal to "+strconv.FormatInt(msg.To, 10)).OfType(msg.MsgType))
+		return
+	}
+	for _, m := range messages {
+		sm.sendSignalMessageByRelays(m)
+	}
 	//todo：通过push平台再发
 	if needPush {
 		go sm.sendSignalMessageByPushkit(msg)
@@ -0,0 +1,3719 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils"
+)
+
+const (
+	alice = int64(1001)
+	bob   = int64(1002)
+	carol = int64(1003)
+	dave  = int64(1004)
+)
+
+var testRelayAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 19001}
+
+//不起goroutine，直接同步调用handlePacket，发出的信令从MemTransport里取，整个过程是确定的
+type simulator struct {
+	t         *testing.T
+	sm        *SessionManager
+	transport *MemTransport
+	clock     int64 //信令时间戳，每发一个加1，避免被防重放过滤
+}
+
+func newSimulator(t *testing.T) *simulator {
+	config := GetDefaultConfig()
+	config.Relays = []string{testRelayAddr.String()}
+	sm := NewSessionManager(config)
+	transport := NewMemTransport()
+	sm.SetTransport(transport)
+	s := &simulator{
+		t:         t,
+		sm:        sm,
+		transport: transport,
+		clock:     time.Now().UnixNano() / int64(100*time.Microsecond),
+	}
+	return s
+}
+
+type sentSignal struct {
+	to     int64
+	signal uint16
+}
+
+//把信令经relay投递给session manager，返回它因此发出的信令
+func (s *simulator) send(signal *Signal) []sentSignal {
+	s.deliver(signal)
+	return s.collect()
+}
+
+//同send，但发出的信令留在transport里
+func (s *simulator) deliver(signal *Signal) {
+	s.clock++
+	signal.Timestamp = s.clock
+	payload, err := signal.Marshal()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.deliverPayload(signal.From, payload)
+}
+
+//原样投递已经序列化的信令，用于同一信令经多个relay到达的情况
+func (s *simulator) deliverPayload(from int64, payload []byte) {
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, from, SessionManagerUserId, 0, payload, nil)
+	data := msg.ObfuscatedDataOfMessage()
+	body := utils.GetPacketBuffer(len(data))
+	copy(body, data)
+	s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+}
+
+func (s *simulator) collect() []sentSignal {
+	var out []sentSignal
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		if msg.MsgType != relay.UdpMessageTypeUserSignal {
+			continue //发给relay的控制消息
+		}
+		signal := NewSignalTemp()
+		if err := signal.UnmarshalMessage(msg); err != nil {
+			s.t.Fatal(err)
+		}
+		out = append(out, sentSignal{to: msg.To, signal: signal.Signal})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].to != out[j].to {
+			return out[i].to < out[j].to
+		}
+		return out[i].signal < out[j].signal
+	})
+	return out
+}
+
+//请求一个新的session，返回sid
+func (s *simulator) createSession(from int64) int64 {
+	s.send(NewSignal(YCKCallSignalTypeSidRequest, from, SessionManagerUserId, 0))
+	if len(s.sm.sessions) != 1 {
+		s.t.Fatalf("expected 1 session, got %d", len(s.sm.sessions))
+	}
+	for sid := range s.sm.sessions {
+		return sid
+	}
+	return 0
+}
+
+type step struct {
+	signal uint16
+	from   int64
+	to     int64
+	info   map[string]interface{}
+}
+
+func members(op string, uids ...int64) map[string]interface{} {
+	list := make([]interface{}, len(uids))
+	for i, uid := range uids {
+		list[i] = uid
+	}
+	return map[string]interface{}{"op": op, "members": list}
+}
+
+var (
+	oneToOneInvite   = step{YCKCallSignalTypeInvite, alice, bob, nil}
+	oneToOneAccept   = step{YCKCallSignalTypeAccept, bob, alice, nil}
+	multipartyInvite = step{YCKCallSignalTypeInvite, alice, SessionManagerUserId, nil}
+)
+
+func TestSessionStateMachine(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []step
+		mode   int
+		states map[int64]uint16
+		events map[int64]uint16
+		sent   []sentSignal //最后一步发出的信令
+	}{
+		{
+			name:   "1-1 invite",
+			steps:  []step{oneToOneInvite},
+			mode:   YCKCallModeOneToOne,
+			states: map[int64]uint16{alice: YCKParticipantStateCalling, bob: YCKParticipantStateCalled},
+			events: map[int64]uint16{alice: YCKParticipantEventInvite, bob: YCKParticipantEventRecvInvite},
+			sent:   []sentSignal{{bob, YCKCallSignalTypeInvite}},
+		},
+		{
+			name:   "1-1 cancel",
+			steps:  []step{oneToOneInvite, {YCKCallSignalTypeCancel, alice, bob, nil}},
+			mode:   YCKCallModeOneToOne,
+			states: map[int64]uint16{alice: YCKParticipantStateIdle, bob: YCKParticipantStateIdle},
+			events: map[int64]uint16{alice: YCKParticipantEventCancel, bob: YCKParticipantEventRecvCancel},
+			sent:   []sentSignal{{bob, YCKCallSignalTypeCancel}, {bob, YCKCallSignalTypeMissedCall}},
+		},
+		{
+			name:   "1-1 accept",
+			steps:  []step{oneToOneInvite, oneToOneAccept},
+			mode:   YCKCallModeOneToOne,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, bob: YCKParticipantStateIncall},
+			events: map[int64]uint16{alice: YCKParticipantEventRecvAccept, bob: YCKParticipantEventAccept},
+			sent:   []sentSignal{{alice, YCKCallSignalTypeAccept}, {alice, YCKCallSignalTypeTopology}, {bob, YCKCallSignalTypeTopology}},
+		},
+		{
+			name:   "1-1 reject",
+			steps:  []step{oneToOneInvite, {YCKCallSignalTypeReject, bob, alice, nil}},
+			mode:   YCKCallModeOneToOne,
+			states: map[int64]uint16{alice: YCKParticipantStateIdle, bob: YCKParticipantStateIdle},
+			events: map[int64]uint16{alice: YCKParticipantEventRecvReject, bob: YCKParticipantEventReject},
+			sent:   []sentSignal{{alice, YCKCallSignalTypeReject}},
+		},
+		{
+			name:   "1-1 busy",
+			steps:  []step{oneToOneInvite, {YCKCallSignalTypeBusy, bob, alice, nil}},
+			mode:   YCKCallModeOneToOne,
+			states: map[int64]uint16{alice: YCKParticipantStateIdle, bob: YCKParticipantStateIdle},
+			events: map[int64]uint16{alice: YCKParticipantEventRecvBusy, bob: YCKParticipantEventBusy},
+			sent:   []sentSignal{{alice, YCKCallSignalTypeBusy}},
+		},
+		{
+			name:   "1-1 end",
+			steps:  []step{oneToOneInvite, oneToOneAccept, {YCKCallSignalTypeEnd, alice, bob, nil}},
+			mode:   YCKCallModeOneToOne,
+			states: map[int64]uint16{alice: YCKParticipantStateIdle, bob: YCKParticipantStateIdle},
+			events: map[int64]uint16{alice: YCKParticipantEventEnd, bob: YCKParticipantEventRecvEnd},
+			sent:   []sentSignal{{bob, YCKCallSignalTypeEnd}},
+		},
+		{
+			name:   "1-1 accept by caller ignored",
+			steps:  []step{oneToOneInvite, {YCKCallSignalTypeAccept, alice, bob, nil}},
+			mode:   YCKCallModeOneToOne,
+			states: map[int64]uint16{alice: YCKParticipantStateCalling, bob: YCKParticipantStateCalled},
+			events: map[int64]uint16{alice: YCKParticipantEventInvite, bob: YCKParticipantEventRecvInvite},
+			sent:   []sentSignal{{bob, YCKCallSignalTypeAccept}}, //照样转发，只是不改状态
+		},
+		{
+			name:   "multipart signal ignored in 1-1 mode",
+			steps:  []step{oneToOneInvite, oneToOneAccept, {YCKCallSignalTypeEnd, alice, SessionManagerUserId, nil}},
+			mode:   YCKCallModeOneToOne,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, bob: YCKParticipantStateIncall},
+			sent:   nil,
+		},
+		{
+			name:   "multiparty invite",
+			steps:  []step{multipartyInvite},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall},
+			events: map[int64]uint16{alice: YCKParticipantEventRecvAccept},
+			sent: []sentSignal{
+				{alice, YCKCallSignalTypeRing},
+				{alice, YCKCallSignalTypeAccept},
+				{alice, YCKCallSignalTypeTopology},
+				{alice, YCKCallSignalTypeMemberState},
+			},
+		},
+		{
+			name:   "multiparty invite with members",
+			steps:  []step{{YCKCallSignalTypeInvite, alice, SessionManagerUserId, members("invite", bob, carol)}},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, bob: YCKParticipantStateCalled, carol: YCKParticipantStateCalled},
+			sent: []sentSignal{
+				{alice, YCKCallSignalTypeRing},
+				{alice, YCKCallSignalTypeAccept},
+				{alice, YCKCallSignalTypeTopology},
+				{alice, YCKCallSignalTypeMemberState},
+				{bob, YCKCallSignalTypeInvite},
+				{bob, YCKCallSignalTypeMemberState},
+				{carol, YCKCallSignalTypeInvite},
+				{carol, YCKCallSignalTypeMemberState},
+			},
+		},
+		{
+			name: "multiparty member accept",
+			steps: []step{
+				{YCKCallSignalTypeInvite, alice, SessionManagerUserId, members("invite", bob)},
+				{YCKCallSignalTypeAccept, bob, SessionManagerUserId, nil},
+			},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, bob: YCKParticipantStateIncall},
+			events: map[int64]uint16{bob: YCKParticipantEventAccept},
+			sent:   []sentSignal{{alice, YCKCallSignalTypeMemberState}, {bob, YCKCallSignalTypeMemberState}},
+		},
+		{
+			name: "multiparty member reject",
+			steps: []step{
+				{YCKCallSignalTypeInvite, alice, SessionManagerUserId, members("invite", bob)},
+				{YCKCallSignalTypeReject, bob, SessionManagerUserId, nil},
+			},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, bob: YCKParticipantStateIdle},
+			events: map[int64]uint16{bob: YCKParticipantEventReject},
+			sent:   []sentSignal{{alice, YCKCallSignalTypeMemberState}},
+		},
+		{
+			name: "multiparty member busy",
+			steps: []step{
+				{YCKCallSignalTypeInvite, alice, SessionManagerUserId, members("invite", bob)},
+				{YCKCallSignalTypeBusy, bob, SessionManagerUserId, nil},
+			},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, bob: YCKParticipantStateIdle},
+			events: map[int64]uint16{bob: YCKParticipantEventBusy},
+			sent:   []sentSignal{{alice, YCKCallSignalTypeMemberState}},
+		},
+		{
+			name:   "multiparty cancel",
+			steps:  []step{multipartyInvite, {YCKCallSignalTypeCancel, alice, SessionManagerUserId, nil}},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIdle},
+			events: map[int64]uint16{alice: YCKParticipantEventCancel},
+			sent:   nil,
+		},
+		{
+			name: "multiparty end",
+			steps: []step{
+				{YCKCallSignalTypeInvite, alice, SessionManagerUserId, members("invite", bob)},
+				{YCKCallSignalTypeAccept, bob, SessionManagerUserId, nil},
+				{YCKCallSignalTypeEnd, alice, SessionManagerUserId, nil},
+			},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIdle, bob: YCKParticipantStateIncall},
+			events: map[int64]uint16{alice: YCKParticipantEventEnd},
+			sent:   []sentSignal{{bob, YCKCallSignalTypeMemberState}},
+		},
+		{
+			name:   "member op invite",
+			steps:  []step{multipartyInvite, {YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, members("invite", dave)}},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, dave: YCKParticipantStateCalled},
+			events: map[int64]uint16{dave: YCKParticipantEventRecvInvite},
+			sent: []sentSignal{
+				{alice, YCKCallSignalTypeMemberState},
+				{dave, YCKCallSignalTypeInvite},
+				{dave, YCKCallSignalTypeMemberState},
+			},
+		},
+		{
+			name: "member op kick",
+			steps: []step{
+				{YCKCallSignalTypeInvite, alice, SessionManagerUserId, members("invite", bob)},
+				{YCKCallSignalTypeAccept, bob, SessionManagerUserId, nil},
+				{YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, members("kick", bob)},
+			},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, bob: YCKParticipantStateIdle},
+			events: map[int64]uint16{bob: YCKParticipantEventRecvEnd},
+			sent:   []sentSignal{{alice, YCKCallSignalTypeMemberState}, {bob, YCKCallSignalTypeEnd}},
+		},
+		{
+			name: "member op kick of non incall member ignored",
+			steps: []step{
+				{YCKCallSignalTypeInvite, alice, SessionManagerUserId, members("invite", bob)},
+				{YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, members("kick", bob)},
+			},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, bob: YCKParticipantStateCalled},
+			sent:   []sentSignal{{alice, YCKCallSignalTypeMemberState}, {bob, YCKCallSignalTypeMemberState}},
+		},
+		{
+			name:   "member op switches 1-1 to multiparty",
+			steps:  []step{oneToOneInvite, oneToOneAccept, {YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, members("invite", carol)}},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall, bob: YCKParticipantStateIncall, carol: YCKParticipantStateCalled},
+			sent: []sentSignal{
+				{alice, YCKCallSignalTypeTopology},
+				{alice, YCKCallSignalTypeMemberState},
+				{bob, YCKCallSignalTypeTopology},
+				{bob, YCKCallSignalTypeMemberState},
+				{carol, YCKCallSignalTypeInvite},
+				{carol, YCKCallSignalTypeMemberState},
+			},
+		},
+		{
+			name:   "1-1 signal ignored in multiparty mode",
+			steps:  []step{multipartyInvite, {YCKCallSignalTypeInvite, alice, bob, nil}},
+			mode:   YCKCallModeMultiple,
+			states: map[int64]uint16{alice: YCKParticipantStateIncall},
+			sent:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSimulator(t)
+			sid := s.createSession(alice)
+			session := s.sm.sessions[sid]
+
+			var sent []sentSignal
+			for _, st := range tt.steps {
+				signal := NewSignal(st.signal, st.from, st.to, sid)
+				signal.Info = st.info
+				sent = s.send(signal)
+			}
+
+			if session.Mode != tt.mode {
+				t.Errorf("mode = %d, want %d", session.Mode, tt.mode)
+			}
+			for uid, state := range tt.states {
+				p := session.Participants[uid]
+				if p == nil {
+					t.Errorf("participant %d missing", uid)
+					continue
+				}
+				if p.State != state {
+					t.Errorf("participant %d state = %d, want %d", uid, p.State, state)
+				}
+			}
+			for uid, event := range tt.events {
+				if p := session.Participants[uid]; p != nil && p.Event != event {
+					t.Errorf("participant %d event = %d, want %d", uid, p.Event, event)
+				}
+			}
+			if len(sent) != len(tt.sent) {
+				t.Fatalf("sent %v, want %v", sent, tt.sent)
+			}
+			for i := range sent {
+				if sent[i] != tt.sent[i] {
+					t.Errorf("sent %v, want %v", sent, tt.sent)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestSessionManagerRejectsInvalidSignals(t *testing.T) {
+	tests := []struct {
+		name   string
+		signal func(sid int64) *Signal
+	}{
+		{"zero sid", func(sid int64) *Signal { return NewSignal(YCKCallSignalTypeInvite, alice, bob, 0) }},
+		{"unknown sid", func(sid int64) *Signal { return NewSignal(YCKCallSignalTypeInvite, alice, bob, sid+1) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSimulator(t)
+			sid := s.createSession(alice)
+			if sent := s.send(tt.signal(sid)); len(sent) != 0 {
+				t.Errorf("unexpected signals sent: %v", sent)
+			}
+			if n := len(s.sm.sessions[sid].Participants); n != 0 {
+				t.Errorf("session has %d participants, want 0", n)
+			}
+		})
+	}
+}
+
+func TestSessionManagerDropsReplayedSignal(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid))
+	end := NewSignal(YCKCallSignalTypeEnd, alice, bob, sid)
+	s.send(end)
+
+	//同一个end换个uuid绕过去重，时间戳不变，仍应被防重放挡住
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	end.Uuid = "replayed"
+	payload, _ := end.Marshal()
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, alice, SessionManagerUserId, 0, payload, nil)
+	s.sm.handleMessageUserSignal(msg)
+	if sent := s.collect(); len(sent) != 0 {
+		t.Errorf("replayed end forwarded: %v", sent)
+	}
+	if p := s.sm.sessions[sid].Participants[alice]; p.State != YCKParticipantStateCalling {
+		t.Errorf("alice state = %d, want calling", p.State)
+	}
+}
+
+func TestSessionManagerSidRequest(t *testing.T) {
+	s := newSimulator(t)
+	sent := s.send(NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0))
+	want := []sentSignal{{alice, YCKCallSignalTypeSidCreated}}
+	if len(sent) != 1 || sent[0] != want[0] {
+		t.Fatalf("sent %v, want %v", sent, want)
+	}
+	if len(s.sm.sessions) != 1 {
+		t.Errorf("sessions = %d, want 1", len(s.sm.sessions))
+	}
+}
+
+func TestSessionManagerEndReason(t *testing.T) {
+	tests := []struct {
+		name string
+		info map[string]interface{}
+		want uint16
+	}{
+		{"default hangup", nil, YCKCallEndReasonHangup},
+		{"network failure", map[string]interface{}{"reason": YCKCallEndReasonNetworkFailure}, YCKCallEndReasonNetworkFailure},
+		{"invalid reason", map[string]interface{}{"reason": "x"}, YCKCallEndReasonHangup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSimulator(t)
+			sid := s.createSession(alice)
+			session := s.sm.sessions[sid]
+			s.send(NewSignal(oneToOneInvite.signal, alice, bob, sid))
+			s.send(NewSignal(oneToOneAccept.signal, bob, alice, sid))
+
+			end := NewSignal(YCKCallSignalTypeEnd, alice, bob, sid)
+			end.Info = tt.info
+			s.send(end)
+			for _, uid := range []int64{alice, bob} {
+				p := session.Participants[uid]
+				if p.EndReason != tt.want {
+					t.Errorf("participant %d reason = %d, want %d", uid, p.EndReason, tt.want)
+				}
+				if p.JoinTime.IsZero() || p.LeaveTime.IsZero() {
+					t.Errorf("participant %d join/leave time not recorded", uid)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionManagerKillSessionReason(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	session := s.sm.sessions[sid]
+	s.send(NewSignal(oneToOneInvite.signal, alice, bob, sid))
+	s.send(NewSignal(oneToOneAccept.signal, bob, alice, sid))
+
+	if !s.sm.killSession(sid, "admin", "") {
+		t.Fatal("killSession returned false")
+	}
+	want := []sentSignal{{alice, YCKCallSignalTypeEnd}, {bob, YCKCallSignalTypeEnd}}
+	if sent := s.collect(); len(sent) != 2 || sent[0] != want[0] || sent[1] != want[1] {
+		t.Fatalf("sent %v, want %v", sent, want)
+	}
+	for uid, p := range session.Participants {
+		if p.EndReason != YCKCallEndReasonAdmin {
+			t.Errorf("participant %d reason = %d, want %d", uid, p.EndReason, YCKCallEndReasonAdmin)
+		}
+	}
+	if len(s.sm.sessions) != 0 {
+		t.Errorf("sessions = %d, want 0", len(s.sm.sessions))
+	}
+}
+
+func TestSessionManagerTerminateSignal(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.adminUids = map[int64]bool{carol: true}
+	sid := s.createSession(alice)
+	s.send(NewSignal(oneToOneInvite.signal, alice, bob, sid))
+	s.send(NewSignal(oneToOneAccept.signal, bob, alice, sid))
+
+	//参与者自己不能强制结束
+	if sent := s.send(NewSignal(YCKCallSignalTypeTerminate, alice, SessionManagerUserId, sid)); len(sent) != 0 || s.sm.sessions[sid] == nil {
+		t.Fatalf("terminate from a participant: sent %v", sent)
+	}
+
+	terminate := NewSignal(YCKCallSignalTypeTerminate, carol, SessionManagerUserId, sid)
+	terminate.Info = map[string]interface{}{"note": "abuse report 17"}
+	want := []sentSignal{{alice, YCKCallSignalTypeEnd}, {bob, YCKCallSignalTypeEnd}}
+	if sent := s.send(terminate); len(sent) != 2 || sent[0] != want[0] || sent[1] != want[1] {
+		t.Fatalf("sent %v, want %v", sent, want)
+	}
+	if s.sm.sessions[sid] != nil {
+		t.Error("session not removed")
+	}
+	entries := s.sm.audit.Query(0, relay.AuditSessionKill, 0)
+	if len(entries) != 1 || entries[0].Who != fmt.Sprintf("uid:%d", carol) ||
+		entries[0].Target != fmt.Sprint(sid) || entries[0].Detail != "abuse report 17" {
+		t.Errorf("kill audit entries %+v", entries)
+	}
+}
+
+func TestSessionManagerCallPolicy(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.maxCallsPerUser = 1
+	sid := s.createSession(alice)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+
+	//alice已在通话中，不能再请求sid
+	sent := s.send(NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0))
+	want := sentSignal{alice, YCKCallSignalTypePolicyReject}
+	if len(sent) != 1 || sent[0] != want {
+		t.Fatalf("sent %v, want %v", sent, want)
+	}
+	if len(s.sm.sessions) != 1 {
+		t.Errorf("sessions = %d, want 1", len(s.sm.sessions))
+	}
+
+	//同一session里重发Invite不受限制
+	sent = s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	if len(sent) != 1 || sent[0] != (sentSignal{bob, YCKCallSignalTypeInvite}) {
+		t.Fatalf("resent invite: sent %v", sent)
+	}
+
+	//carol呼叫正在通话的bob，被拒绝且bob收不到Invite
+	s.send(NewSignal(YCKCallSignalTypeSidRequest, carol, SessionManagerUserId, 0))
+	var sid2 int64
+	for id := range s.sm.sessions {
+		if id != sid {
+			sid2 = id
+		}
+	}
+	sent = s.send(NewSignal(YCKCallSignalTypeInvite, carol, bob, sid2))
+	want = sentSignal{carol, YCKCallSignalTypePolicyReject}
+	if len(sent) != 1 || sent[0] != want {
+		t.Fatalf("sent %v, want %v", sent, want)
+	}
+	if s.sm.sessions[sid2].Participants[bob] != nil {
+		t.Error("bob added to second session")
+	}
+
+	//结束后可以再呼叫
+	s.send(NewSignal(YCKCallSignalTypeCancel, alice, bob, sid))
+	sent = s.send(NewSignal(YCKCallSignalTypeInvite, carol, bob, sid2))
+	if len(sent) != 1 || sent[0] != (sentSignal{bob, YCKCallSignalTypeInvite}) {
+		t.Fatalf("invite after cancel: sent %v", sent)
+	}
+}
+
+func TestSessionManagerHold(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	session := s.sm.sessions[sid]
+	s.send(NewSignal(oneToOneInvite.signal, alice, bob, sid))
+	s.send(NewSignal(oneToOneAccept.signal, bob, alice, sid))
+
+	sent := s.send(NewSignal(YCKCallSignalTypeHold, alice, bob, sid))
+	if len(sent) != 1 || sent[0] != (sentSignal{bob, YCKCallSignalTypeHold}) {
+		t.Fatalf("hold: sent %v", sent)
+	}
+	if !session.Participants[alice].Held {
+		t.Fatal("alice not held")
+	}
+
+	s.send(NewSignal(YCKCallSignalTypeResume, alice, bob, sid))
+	if session.Participants[alice].Held {
+		t.Error("alice still held after resume")
+	}
+
+	s.send(NewSignal(YCKCallSignalTypeHold, alice, bob, sid))
+	s.send(NewSignal(YCKCallSignalTypeEnd, bob, alice, sid))
+	if session.Participants[alice].Held {
+		t.Error("held not cleared after end")
+	}
+
+	//不在通话中不能保持
+	if sent := s.send(NewSignal(YCKCallSignalTypeHold, alice, bob, sid)); len(sent) != 0 {
+		t.Errorf("hold after end: sent %v", sent)
+	}
+}
+
+//发给relay的session控制消息
+func (s *simulator) sessionControls() []*relay.SessionControl {
+	var out []*relay.SessionControl
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		if msg.MsgType != relay.UdpMessageTypeSessionControl {
+			continue
+		}
+		control, err := relay.UnmarshalSessionControl(msg.Payload)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		out = append(out, control)
+	}
+	return out
+}
+
+func TestSessionManagerRelaySessionControl(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+
+	invite := NewSignal(oneToOneInvite.signal, alice, bob, sid)
+	invite.Info = map[string]interface{}{"call_type": YCKCallTypeAudio}
+	s.deliver(invite)
+	controls := s.sessionControls()
+	if len(controls) != 1 || controls[0].Op != relay.SessionControlSetup || len(controls[0].Members) != 2 ||
+		controls[0].Media != relay.MediaAudio|relay.MediaData {
+		t.Fatalf("invite: controls %+v", controls)
+	}
+
+	//成员没变化不重发
+	s.deliver(NewSignal(oneToOneAccept.signal, bob, alice, sid))
+	if controls := s.sessionControls(); len(controls) != 0 {
+		t.Errorf("accept: controls %+v", controls)
+	}
+
+	s.deliver(NewSignal(YCKCallSignalTypeEnd, alice, bob, sid))
+	controls = s.sessionControls()
+	if len(controls) != 1 || controls[0].Op != relay.SessionControlTeardown {
+		t.Fatalf("end: controls %+v", controls)
+	}
+
+	//多方：邀请的人加入成员，session删除时teardown
+	s = newSimulator(t)
+	sid = s.createSession(alice)
+	s.deliver(NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid))
+	s.transport.Sent()
+	op := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+	op.Info = members("invite", bob, carol)
+	s.deliver(op)
+	controls = s.sessionControls()
+	if len(controls) != 1 || len(controls[0].Members) != 3 || controls[0].Media != relay.MediaAll {
+		t.Fatalf("member op: controls %+v", controls)
+	}
+
+	s.sm.killSession(sid, "admin", "")
+	controls = s.sessionControls()
+	if len(controls) != 1 || controls[0].Op != relay.SessionControlTeardown {
+		t.Errorf("kill: controls %+v", controls)
+	}
+}
+
+func TestSessionManagerHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "sessions.json")
+
+	s := newSimulator(t)
+	s.sm.stateFile = stateFile
+	sid := s.createSession(alice)
+	invite := NewSignal(oneToOneInvite.signal, alice, bob, sid)
+	invite.Info = map[string]interface{}{"call_type": YCKCallTypeAudio}
+	s.send(invite)
+	s.send(NewSignal(oneToOneAccept.signal, bob, alice, sid))
+	s.send(NewSignal(YCKCallSignalTypeHold, alice, bob, sid))
+	guest, _ := s.sm.createGuest(sid)
+
+	s.sm.shutdownSessions()
+	sent := s.collect()
+	want := []sentSignal{{alice, YCKCallSignalTypeServerMaintenance}, {bob, YCKCallSignalTypeServerMaintenance}}
+	if len(sent) != 2 || sent[0] != want[0] || sent[1] != want[1] {
+		t.Fatalf("shutdown: sent %v, want %v", sent, want)
+	}
+	if p := s.sm.sessions[sid].Participants[bob]; !p.InState(YCKParticipantStateIncall) {
+		t.Error("call ended on handoff")
+	}
+
+	//接替的实例
+	next := newSimulator(t)
+	if n := next.sm.restoreSessions(stateFile); n != 1 {
+		t.Fatalf("restored %d sessions, want 1", n)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Error("state file not removed after restore")
+	}
+	session := next.sm.sessions[sid]
+	if session.Mode != YCKCallModeOneToOne || session.CallType != YCKCallTypeAudio {
+		t.Errorf("restored session = %+v", session)
+	}
+	if p := session.Participants[alice]; p == nil || !p.InState(YCKParticipantStateIncall) || !p.Held || p.JoinTime.IsZero() {
+		t.Errorf("restored alice = %+v", p)
+	}
+	if next.sm.guests[guest.Uid] == nil {
+		t.Error("guest not restored")
+	}
+
+	//恢复后通话照常继续
+	sent = next.send(NewSignal(YCKCallSignalTypeEnd, bob, alice, sid))
+	if len(sent) != 1 || sent[0] != (sentSignal{alice, YCKCallSignalTypeEnd}) {
+		t.Errorf("end after restore: sent %v", sent)
+	}
+
+	//过期的交接不恢复
+	s.sm.saveSessions(stateFile)
+	data, _ := ioutil.ReadFile(stateFile)
+	var state handoffState
+	json.Unmarshal(data, &state)
+	state.SavedAt = state.SavedAt.Add(-MaxHandoffAge - time.Second)
+	data, _ = json.Marshal(state)
+	ioutil.WriteFile(stateFile, data, 0600)
+	if n := newSimulator(t).sm.restoreSessions(stateFile); n != 0 {
+		t.Errorf("restored %d sessions from stale state", n)
+	}
+}
+
+func TestSessionManagerShutdownWithoutStateFile(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	s.send(NewSignal(oneToOneInvite.signal, alice, bob, sid))
+	s.send(NewSignal(oneToOneAccept.signal, bob, alice, sid))
+
+	s.sm.shutdownSessions()
+	sent := s.collect()
+	if len(sent) != 2 || sent[0].signal != YCKCallSignalTypeEnd || sent[1].signal != YCKCallSignalTypeEnd {
+		t.Errorf("shutdown: sent %v", sent)
+	}
+	if len(s.sm.sessions) != 0 {
+		t.Errorf("%d sessions left after shutdown", len(s.sm.sessions))
+	}
+}
+
+func TestSessionManagerGuest(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid))
+
+	if guest, _ := s.sm.createGuest(sid + 1); guest != nil {
+		t.Fatal("guest created for missing session")
+	}
+	guest, token := s.sm.createGuest(sid)
+	if guest == nil || !IsGuestUid(guest.Uid) || guest.Sid != sid {
+		t.Fatalf("guest = %+v", guest)
+	}
+	if token != nil {
+		t.Error("token issued without access secret")
+	}
+
+	//访客不能请求sid，只能加入自己的session
+	if sent := s.send(NewSignal(YCKCallSignalTypeSidRequest, guest.Uid, SessionManagerUserId, 0)); len(sent) != 0 {
+		t.Errorf("guest sid request: sent %v", sent)
+	}
+	s.send(NewSignal(YCKCallSignalTypeInvite, guest.Uid, SessionManagerUserId, sid))
+	if p := s.sm.sessions[sid].Participants[guest.Uid]; p == nil || !p.InState(YCKParticipantStateIncall) {
+		t.Fatalf("guest not in call: %+v", p)
+	}
+
+	s.sm.killSession(sid, "admin", "")
+	s.collect()
+	if len(s.sm.guests) != 0 {
+		t.Errorf("guests = %d after session end, want 0", len(s.sm.guests))
+	}
+	//session结束后临时uid失效，也不能进别的session
+	sid2 := s.createSession(alice)
+	if sent := s.send(NewSignal(YCKCallSignalTypeInvite, guest.Uid, SessionManagerUserId, sid2)); len(sent) != 0 {
+		t.Errorf("expired guest: sent %v", sent)
+	}
+}
+
+func TestSessionManagerInviteInfo(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", bob)
+	invite.Info["relays"] = []interface{}{testRelayAddr.String()}
+	invite.Info["name"] = "Alice"
+	invite.Info["avatar"] = "https://example.com/a.png"
+	invite.Info["call_type"] = YCKCallTypeVideo
+	invite.Info["payload"] = "opaque"
+	s.deliver(invite)
+
+	var info map[string]interface{}
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signal := NewSignalTemp()
+		if msg.To != bob || signal.UnmarshalMessage(msg) != nil || signal.Signal != YCKCallSignalTypeInvite {
+			continue
+		}
+		info = signal.Info
+	}
+	if info == nil {
+		t.Fatal("no invite sent to bob")
+	}
+	want := map[string]string{"name": "Alice", "avatar": "https://example.com/a.png", "call_type": YCKCallTypeVideo, "payload": "opaque"}
+	for k, v := range want {
+		if info[k] != v {
+			t.Errorf("info[%s] = %v, want %s", k, info[k], v)
+		}
+	}
+	if caller, _ := info["caller"].(json.Number).Int64(); caller != alice {
+		t.Errorf("caller = %v, want %d", info["caller"], alice)
+	}
+	if relays, _ := info["relays"].([]interface{}); len(relays) != 1 {
+		t.Errorf("relays = %v", info["relays"])
+	}
+
+	//后续邀请不带call_type时沿用session上的
+	op := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+	op.Info = members("invite", carol)
+	s.deliver(op)
+	if got := s.sm.sessions[sid].CallType; got != YCKCallTypeVideo {
+		t.Errorf("session call type = %q, want %q", got, YCKCallTypeVideo)
+	}
+	s.collect()
+}
+
+//取出transport里发给to的最后一个signal类型的信令，其他的丢弃
+func (s *simulator) lastSent(to int64, signalType uint16) *Signal {
+	var last *Signal
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		signal := NewSignalTemp()
+		if msg.To != to || signal.UnmarshalMessage(msg) != nil || signal.Signal != signalType {
+			continue
+		}
+		last = signal
+	}
+	return last
+}
+
+func TestSessionManagerSealedInfo(t *testing.T) {
+	s := newSimulator(t)
+	s.deliver(NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0))
+	created := s.lastSent(alice, YCKCallSignalTypeSidCreated)
+	if created == nil {
+		t.Fatal("no sid created")
+	}
+	key, _ := created.Info[relay.InfoSessionKey].(string)
+	if key == "" || key != s.sm.sessions[created.SessionId].Key {
+		t.Fatalf("session key %q", key)
+	}
+	sid := created.SessionId
+
+	//1-1的Invite原样转发sealed，并加上session key
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+	invite.Info = map[string]interface{}{"name": "Alice", "call_type": YCKCallTypeAudio}
+	if err := invite.SealInfo(key); err != nil {
+		t.Fatal(err)
+	}
+	s.deliver(invite)
+	got := s.lastSent(bob, YCKCallSignalTypeInvite)
+	if got == nil || got.Info["name"] != nil || got.Info[relay.InfoSessionKey] != key {
+		t.Fatalf("invite to bob %+v", got)
+	}
+	if err := got.OpenInfo(got.Info[relay.InfoSessionKey].(string)); err != nil || got.Info["name"] != "Alice" {
+		t.Errorf("open invite info %v %v", got.Info, err)
+	}
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid))
+
+	//多方代发的Invite也带上发起方的sealed
+	op := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+	op.Info = members("invite", carol)
+	op.Info["nickname"] = "team"
+	if err := op.SealInfo(key, "nickname"); err != nil {
+		t.Fatal(err)
+	}
+	s.deliver(op)
+	got = s.lastSent(carol, YCKCallSignalTypeInvite)
+	if got == nil || got.Info[relay.InfoSessionKey] != key {
+		t.Fatalf("invite to carol %+v", got)
+	}
+	if err := got.OpenInfo(key); err != nil || got.Info["nickname"] != "team" {
+		t.Errorf("open member invite info %v %v", got.Info, err)
+	}
+}
+
+func TestRelayCandidates(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.relays = []string{"10.0.0.1:19001", "10.0.1.1:19001", "10.0.1.2:19001", "10.0.2.1:19001"}
+	s.sm.relayRegions = map[string]string{
+		"10.0.0.1:19001": "cn",
+		"10.0.1.1:19001": "eu",
+		"10.0.1.2:19001": "eu",
+		"10.0.2.1:19001": "us",
+	}
+	now := time.Now()
+	for _, r := range []string{"10.0.0.1:19001", "10.0.1.2:19001", "10.0.2.1:19001"} {
+		s.sm.relayAcks[r] = now
+	}
+
+	//没有区域信息时只按健康排序
+	want := []string{"10.0.0.1:19001", "10.0.1.2:19001", "10.0.2.1:19001", "10.0.1.1:19001"}
+	if got := s.sm.relayCandidates(alice); !equalStrings(got, want) {
+		t.Errorf("candidates = %v, want %v", got, want)
+	}
+
+	//信令经eu的relay到达，推断为eu
+	s.sm.updateIngress(alice, &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 19001})
+	want = []string{"10.0.1.2:19001", "10.0.0.1:19001", "10.0.2.1:19001", "10.0.1.1:19001"}
+	if got := s.sm.relayCandidates(alice); !equalStrings(got, want) {
+		t.Errorf("candidates = %v, want %v", got, want)
+	}
+
+	//客户端上报的区域优先
+	signal := NewSignal(YCKCallSignalTypeInvite, alice, bob, 1)
+	signal.Info = map[string]interface{}{"region": "us"}
+	s.sm.updateRegion(signal)
+	if got := s.sm.relayCandidates(alice); got[0] != "10.0.2.1:19001" {
+		t.Errorf("candidates = %v, want us relay first", got)
+	}
+}
+
+type fakeLocator map[string]Location
+
+func (f fakeLocator) Locate(ip net.IP) (Location, bool) {
+	l, ok := f[ip.String()]
+	return l, ok
+}
+
+func TestRelayCandidatesGeoIp(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.relays = []string{"10.0.0.1:19001", "10.0.1.1:19001", "10.0.2.1:19001"}
+	for _, r := range s.sm.relays {
+		s.sm.relayAcks[r] = time.Now()
+	}
+	s.sm.SetGeoLocator(fakeLocator{
+		"10.0.0.1":    {Latitude: 39.9, Longitude: 116.4}, //北京
+		"10.0.1.1":    {Latitude: 50.1, Longitude: 8.7},   //法兰克福
+		"10.0.2.1":    {Latitude: 1.35, Longitude: 103.8}, //新加坡
+		"203.0.113.7": {Latitude: 48.9, Longitude: 2.35},  //巴黎
+	})
+
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, alice, SessionManagerUserId, 0, nil, nil)
+	relay.SetClientIp(msg, net.IPv4(203, 0, 113, 7))
+	s.sm.updateClientIp(alice, msg)
+
+	want := []string{"10.0.1.1:19001", "10.0.0.1:19001", "10.0.2.1:19001"}
+	if got := s.sm.relayCandidates(alice); !equalStrings(got, want) {
+		t.Errorf("candidates = %v, want %v", got, want)
+	}
+	//不知道位置的参与者按原顺序
+	if got := s.sm.relayCandidates(bob); !equalStrings(got, s.sm.relays) {
+		t.Errorf("candidates = %v, want %v", got, s.sm.relays)
+	}
+}
+
+func TestLocationDistance(t *testing.T) {
+	paris := Location{Latitude: 48.8566, Longitude: 2.3522}
+	london := Location{Latitude: 51.5074, Longitude: -0.1278}
+	if d := paris.Distance(london); d < 330 || d > 360 {
+		t.Errorf("paris-london = %.0fkm, want about 344km", d)
+	}
+	if d := paris.Distance(paris); d != 0 {
+		t.Errorf("distance to self = %v", d)
+	}
+}
+
+func TestRelayDrain(t *testing.T) {
+	s := newSimulator(t)
+	draining := testRelayAddr.String()
+	s.sm.relays = []string{"10.0.0.1:19001", draining}
+
+	drain := func(state byte) {
+		msg := relay.NewMessage(relay.UdpMessageTypeRelayDrain, SessionManagerUserId, 0, 0, []byte{state}, nil)
+		data := msg.ObfuscatedDataOfMessage()
+		body := utils.GetPacketBuffer(len(data))
+		copy(body, data)
+		s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+	}
+
+	drain(relay.RelayDrainOn)
+	if got := s.sm.relayCandidates(alice); !equalStrings(got, []string{"10.0.0.1:19001"}) {
+		t.Errorf("candidates when draining = %v", got)
+	}
+
+	//所有relay都在排空时照常下发
+	s.sm.relayDrains["10.0.0.1:19001"] = time.Now()
+	if got := s.sm.relayCandidates(alice); len(got) != 2 {
+		t.Errorf("candidates when all draining = %v", got)
+	}
+	delete(s.sm.relayDrains, "10.0.0.1:19001")
+
+	//排空通知过期(relay重启后不再发)，重新下发
+	s.sm.relayDrains[draining] = time.Now().Add(-3 * relay.ServerRegInterval)
+	if got := s.sm.relayCandidates(alice); len(got) != 2 {
+		t.Errorf("candidates after drain expired = %v", got)
+	}
+
+	drain(relay.RelayDrainOn)
+	drain(relay.RelayDrainOff)
+	if got := s.sm.relayCandidates(alice); len(got) != 2 {
+		t.Errorf("candidates after drain off = %v", got)
+	}
+}
+
+func TestSessionManagerStore(t *testing.T) {
+	store := relay.NewMemoryStore()
+	store.SetRelays([]string{"10.0.0.1:19001", "10.0.0.2:19001"})
+
+	s := newSimulator(t)
+	s.sm.store = store
+	s.sm.loadRelays()
+	if !equalStrings(s.sm.relays, []string{"10.0.0.1:19001", "10.0.0.2:19001"}) {
+		t.Errorf("relays from store = %v", s.sm.relays)
+	}
+
+	//存储里没有relay列表时保留原来的
+	s2 := newSimulator(t)
+	s2.sm.store = relay.NewMemoryStore()
+	s2.sm.loadRelays()
+	if !equalStrings(s2.sm.relays, []string{testRelayAddr.String()}) {
+		t.Errorf("relays without store list = %v", s2.sm.relays)
+	}
+
+	s.createSession(alice)
+	if got, _ := store.GetUserRelay(alice); got != testRelayAddr.String() {
+		t.Errorf("user relay in store = %q", got)
+	}
+
+	//另一个实例本地没见过alice，从存储里查到
+	s2.sm.store = store
+	s2.sm.relayRegions[testRelayAddr.String()] = "cn"
+	if got := s2.sm.regionOf(alice); got != "cn" {
+		t.Errorf("region from stored relay = %q", got)
+	}
+}
+
+//dispatcher不启动，事件留在队列里
+func webhookEvents(t *testing.T, d *WebhookDispatcher) []*Event {
+	var events []*Event
+	for {
+		select {
+		case body := <-d.targets[0].queue:
+			event := &Event{}
+			if err := json.Unmarshal(body, event); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestSessionManagerEvents(t *testing.T) {
+	s := newSimulator(t)
+	webhooks := NewWebhookDispatcher([]string{"http://127.0.0.1:1/hook"}, "")
+	s.sm.publishers = []EventPublisher{webhooks}
+	sid := s.createSession(alice)
+	for _, st := range []step{oneToOneInvite, oneToOneAccept, {YCKCallSignalTypeEnd, alice, bob, nil}} {
+		s.send(NewSignal(st.signal, st.from, st.to, sid))
+	}
+	s.sm.removeSession(s.sm.sessions[sid], YCKCallEndReasonHangup)
+
+	var got []string
+	var ended *Event
+	for _, e := range webhookEvents(t, webhooks) {
+		if e.Sid != sid {
+			t.Errorf("event %s sid = %d", e.Type, e.Sid)
+		}
+		desc := e.Type
+		if e.Uid != 0 {
+			desc += " " + strconv.FormatInt(e.Uid, 10)
+		}
+		got = append(got, desc)
+		if e.Type == EventSessionEnded {
+			ended = e
+		}
+	}
+	sort.Strings(got[1:3])
+	sort.Strings(got[3:5])
+	want := []string{
+		EventSessionCreated,
+		EventParticipantJoined + " 1001", EventParticipantJoined + " 1002",
+		EventParticipantLeft + " 1001", EventParticipantLeft + " 1002",
+		EventSessionEnded,
+	}
+	if !equalStrings(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if ended.Record == nil || len(ended.Record.Legs) != 2 {
+		t.Errorf("session.ended cdr = %+v", ended.Record)
+	}
+}
+
+func TestWebhookDispatcherRetryAndSign(t *testing.T) {
+	var lock sync.Mutex
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, r.URL.Path)
+		if r.Header.Get("X-Ycng-Signature") != SignWebhook("secret", r.Header.Get("X-Ycng-Timestamp"), body) {
+			t.Error("bad signature")
+		}
+		switch {
+		case r.URL.Path == "/flaky" && len(calls) == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/reject":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	d := NewWebhookDispatcher([]string{server.URL + "/flaky"}, "secret")
+	d.retryDelay = time.Millisecond
+	d.Start()
+	d.Publish(NewEvent(EventSessionCreated, 42))
+	d.Stop()
+	if len(calls) != 2 {
+		t.Errorf("flaky calls = %v, want a retry", calls)
+	}
+
+	calls = nil
+	d = NewWebhookDispatcher([]string{server.URL + "/reject"}, "secret")
+	d.retryDelay = time.Millisecond
+	d.Start()
+	d.Publish(NewEvent(EventSessionCreated, 42))
+	d.Stop()
+	if len(calls) != 1 {
+		t.Errorf("rejected calls = %v, want no retry", calls)
+	}
+
+	//停止后丢弃
+	d.Publish(NewEvent(EventSessionCreated, 42))
+}
+
+//只实现natsSink用到的协议，收到的PUB按subject记下
+func fakeNats(t *testing.T, published chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("INFO {\"server_id\":\"fake\"}\r\n"))
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					switch {
+					case len(fields) == 0:
+					case fields[0] == "PING":
+						conn.Write([]byte("PONG\r\n"))
+					case fields[0] == "PUB" && len(fields) == 3:
+						n, _ := strconv.Atoi(fields[2])
+						body := make([]byte, n+2)
+						if _, err := io.ReadFull(reader, body); err != nil {
+							return
+						}
+						published <- fields[1] + " " + string(body[:n])
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestNatsPublisher(t *testing.T) {
+	published := make(chan string, 10)
+	l := fakeNats(t, published)
+	defer l.Close()
+
+	p, err := OpenEventPublisher("nats://" + l.Addr().String() + "/calls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	event := NewEvent(EventSessionCreated, 42)
+	p.Publish(event)
+	p.Stop()
+
+	select {
+	case got := <-published:
+		if !strings.HasPrefix(got, "calls.session.created {") || !strings.Contains(got, event.Id) {
+			t.Errorf("published %q", got)
+		}
+	default:
+		t.Error("nothing published")
+	}
+}
+
+//单broker、两个分区的kafka，记下每个分区收到的record的key
+type fakeKafka struct {
+	t        *testing.T
+	listener net.Listener
+	lock     sync.Mutex
+	keys     map[int32][]string
+	values   []string
+}
+
+func newFakeKafka(t *testing.T) *fakeKafka {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &fakeKafka{t: t, listener: l, keys: make(map[int32][]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go k.serve(conn)
+		}
+	}()
+	return k
+}
+
+func (k *fakeKafka) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		d := &kafkaDecoder{data: req}
+		apiKey := d.int16()
+		d.int16()
+		correlation := d.int32()
+		d.string()
+
+		e := &kafkaEncoder{}
+		e.int32(0)
+		e.int32(correlation)
+		switch apiKey {
+		case kafkaApiMetadata:
+			host, port, _ := net.SplitHostPort(k.listener.Addr().String())
+			n, _ := strconv.Atoi(port)
+			e.int32(0)
+			e.int32(1)
+			e.int32(7)
+			e.string(host)
+			e.int32(int32(n))
+			e.int16(-1)
+			e.int16(-1)
+			e.int32(7)
+			e.int32(1)
+			e.int16(0)
+			e.string("events")
+			e.int8(0)
+			e.int32(2)
+			for partition := int32(0); partition < 2; partition++ {
+				e.int16(0)
+				e.int32(partition)
+				e.int32(7)
+				e.int32(1)
+				e.int32(7)
+				e.int32(1)
+				e.int32(7)
+			}
+		case kafkaApiProduce:
+			d.int16()
+			d.int16()
+			d.int32()
+			d.int32()
+			topic := d.string()
+			e.int32(1)
+			e.string(topic)
+			n := d.int32()
+			e.int32(n)
+			for ; n > 0; n-- {
+				partition := d.int32()
+				batch := d.next(int(d.int32()))
+				k.readBatch(partition, batch)
+				e.int32(partition)
+				e.int16(0)
+				e.int64(0)
+				e.int64(-1)
+			}
+			e.int32(0)
+		}
+		resp := e.Bytes()
+		binary.BigEndian.PutUint32(resp, uint32(len(resp)-4))
+		conn.Write(resp)
+	}
+}
+
+func (k *fakeKafka) readBatch(partition int32, batch []byte) {
+	d := &kafkaDecoder{data: batch}
+	d.int64()
+	if int(d.int32()) != len(d.data) {
+		k.t.Error("batch length mismatch")
+	}
+	d.int32()
+	if d.int8() != 2 {
+		k.t.Error("batch magic")
+	}
+	if uint32(d.int32()) != crc32.Checksum(d.data, crc32c) {
+		k.t.Error("batch crc mismatch")
+	}
+	d.next(2 + 4 + 8 + 8 + 8 + 2 + 4)
+	count := d.int32()
+	reader := bytes.NewReader(d.data)
+	for i := int32(0); i < count; i++ {
+		binary.ReadVarint(reader) //length
+		reader.ReadByte()
+		binary.ReadVarint(reader)
+		binary.ReadVarint(reader)
+		keyLen, _ := binary.ReadVarint(reader)
+		key := make([]byte, keyLen)
+		reader.Read(key)
+		valueLen, _ := binary.ReadVarint(reader)
+		value := make([]byte, valueLen)
+		reader.Read(value)
+		binary.ReadVarint(reader)
+		k.lock.Lock()
+		k.keys[partition] = append(k.keys[partition], string(key))
+		k.values = append(k.values, string(value))
+		k.lock.Unlock()
+	}
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	k := newFakeKafka(t)
+	defer k.listener.Close()
+
+	p, err := OpenEventPublisher("kafka://127.0.0.1:1," + k.listener.Addr().String() + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	for _, sid := range []int64{2, 3, 4} {
+		p.Publish(NewEvent(EventSessionCreated, sid))
+	}
+	p.Stop()
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if !equalStrings(k.keys[0], []string{"2", "4"}) || !equalStrings(k.keys[1], []string{"3"}) {
+		t.Errorf("partition keys = %v", k.keys)
+	}
+	if len(k.values) != 3 || !strings.Contains(k.values[0], EventSessionCreated) {
+		t.Errorf("values = %v", k.values)
+	}
+
+	if _, err := OpenEventPublisher("kafka://host/"); err == nil {
+		t.Error("kafka url without topic accepted")
+	}
+	if _, err := OpenEventPublisher("amqp://host/x"); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+}
+
+func TestBlackboxRing(t *testing.T) {
+	b := NewBlackbox(2)
+	for i := uint16(1); i <= 3; i++ {
+		b.Add(BlackboxEntry{Signal: i})
+	}
+	entries := b.Entries()
+	if len(entries) != 2 || entries[0].Signal != 2 || entries[1].Signal != 3 {
+		t.Errorf("entries = %v", entries)
+	}
+}
+
+func TestSessionManagerBlackboxReplay(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	var live [][]sentSignal
+	for _, st := range []step{oneToOneInvite, oneToOneAccept, {YCKCallSignalTypeEnd, alice, bob, nil}} {
+		live = append(live, s.send(NewSignal(st.signal, st.from, st.to, sid)))
+	}
+	s.sm.removeSession(s.sm.sessions[sid], YCKCallEndReasonHangup)
+
+	//session删除后仍可导出
+	entries := s.sm.blackboxOf(sid)
+	if len(entries) != 3 || entries[0].Signal != YCKCallSignalTypeInvite || entries[1].From != bob {
+		t.Fatalf("blackbox = %v", entries)
+	}
+
+	result := replayBlackbox(s.sm.replayConfig(), sid, entries)
+	if len(result.Steps) != len(live) {
+		t.Fatalf("replay steps = %v", result.Steps)
+	}
+	for i, step := range result.Steps {
+		var sent []sentSignal
+		for _, ss := range step.Sent {
+			sent = append(sent, sentSignal{to: ss.To, signal: ss.Signal})
+		}
+		if len(sent) != len(live[i]) {
+			t.Errorf("step %d sent %v, live %v", i, sent, live[i])
+			continue
+		}
+		for j := range sent {
+			if sent[j] != live[i][j] {
+				t.Errorf("step %d sent %v, live %v", i, sent, live[i])
+			}
+		}
+	}
+	if result.Session == nil || result.Session.Mode != YCKCallModeOneToOne {
+		t.Fatalf("replayed session = %+v", result.Session)
+	}
+	for _, p := range result.Session.Participants {
+		if p.State != YCKParticipantStateIdle {
+			t.Errorf("replayed participant %d state %d", p.Uid, p.State)
+		}
+	}
+
+	s.sm.blackboxSize = 0
+	sid = s.createSession(alice)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	if s.sm.blackboxOf(sid) != nil {
+		t.Error("blackbox recorded when disabled")
+	}
+}
+
+type deviceSignal struct {
+	to     int64
+	signal uint16
+	device string
+}
+
+//同send，但信令extra带发送方设备，返回发出的信令及其目标设备
+func (s *simulator) sendFromDevice(signal *Signal, device string) []deviceSignal {
+	s.deliverFromDevice(signal, device)
+	return s.collectDevices(s.transport.Sent())
+}
+
+func (s *simulator) deliverFromDevice(signal *Signal, device string) {
+	s.clock++
+	signal.Timestamp = s.clock
+	payload, err := signal.Marshal()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, signal.From, SessionManagerUserId, 0, payload, nil)
+	relay.SetDevice(msg, device)
+	data := msg.ObfuscatedDataOfMessage()
+	body := utils.GetPacketBuffer(len(data))
+	copy(body, data)
+	s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+}
+
+func (s *simulator) collectDevices(sent []MemPacket) []deviceSignal {
+	var out []deviceSignal
+	for _, p := range sent {
+		sent, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil || sent.MsgType != relay.UdpMessageTypeUserSignal {
+			continue
+		}
+		signal := NewSignalTemp()
+		if err := signal.UnmarshalMessage(sent); err != nil {
+			s.t.Fatal(err)
+		}
+		out = append(out, deviceSignal{sent.To, signal.Signal, signal.Device})
+	}
+	return out
+}
+
+func TestSessionManagerMultiDevice(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	send := s.sendFromDevice
+
+	//被叫还没接听，Invite不指定设备，送到bob的所有设备
+	got := send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid), "alice-phone")
+	if len(got) != 1 || got[0] != (deviceSignal{bob, YCKCallSignalTypeInvite, ""}) {
+		t.Fatalf("invite sent %v", got)
+	}
+
+	//bob在电脑上接听，Accept只送到alice发起呼叫的设备，bob的其他设备收到CancelOtherDevices
+	got = send(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid), "bob-desktop")
+	want := []deviceSignal{
+		{alice, YCKCallSignalTypeAccept, "alice-phone"},
+		{bob, YCKCallSignalTypeCancelOtherDevices, ""},
+		{alice, YCKCallSignalTypeTopology, "alice-phone"},
+		{bob, YCKCallSignalTypeTopology, "bob-desktop"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("accept sent %v, want %v", got, want)
+	}
+	if p := s.sm.sessions[sid].Participants[bob]; p.Device != "bob-desktop" {
+		t.Errorf("bob in call on %q", p.Device)
+	}
+
+	//之后发给bob的信令只送到接听的设备
+	got = send(NewSignal(YCKCallSignalTypeEnd, alice, bob, sid), "alice-phone")
+	if len(got) != 1 || got[0] != (deviceSignal{bob, YCKCallSignalTypeEnd, "bob-desktop"}) {
+		t.Fatalf("end sent %v", got)
+	}
+	if p := s.sm.sessions[sid].Participants[bob]; p.Device != "" {
+		t.Errorf("device %q kept after end", p.Device)
+	}
+}
+
+func TestSessionManagerHandover(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	s.sendFromDevice(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid), "alice-phone")
+	s.sendFromDevice(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid), "bob-phone")
+
+	//bob把通话切到电脑上：回复送到电脑，旧设备收到End
+	s.deliverFromDevice(NewSignal(YCKCallSignalTypeHandover, bob, SessionManagerUserId, sid), "bob-desktop")
+	sent := s.transport.Sent()
+	got := s.collectDevices(sent)
+	want := []deviceSignal{
+		{bob, YCKCallSignalTypeEnd, "bob-phone"},
+		{bob, YCKCallSignalTypeHandover, "bob-desktop"},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("handover sent %v, want %v", got, want)
+	}
+	p := s.sm.sessions[sid].Participants[bob]
+	if !p.InState(YCKParticipantStateIncall) || p.Device != "bob-desktop" {
+		t.Errorf("bob state %d on %q after handover", p.State, p.Device)
+	}
+
+	var handover []byte
+	for _, p := range sent {
+		if msg, err := relay.NewMessageFromObfuscatedData(p.Data); err == nil && msg.MsgType == relay.UdpMessageTypeHandoverControl {
+			handover = msg.Payload
+		}
+	}
+	if string(handover) != string(relay.NewHandoverControlPayload(bob, "bob-desktop")) {
+		t.Errorf("handover control %v", handover)
+	}
+	got = s.sendFromDevice(NewSignal(YCKCallSignalTypeEnd, alice, bob, sid), "alice-phone")
+	if len(got) != 1 || got[0] != (deviceSignal{bob, YCKCallSignalTypeEnd, "bob-desktop"}) {
+		t.Errorf("end sent %v", got)
+	}
+
+	//不在通话中的不能切换
+	got = s.sendFromDevice(NewSignal(YCKCallSignalTypeHandover, bob, SessionManagerUserId, sid), "bob-phone")
+	if len(got) != 0 {
+		t.Errorf("handover when idle sent %v", got)
+	}
+}
+
+func TestSessionManagerMissedCall(t *testing.T) {
+	s := newSimulator(t)
+	webhooks := NewWebhookDispatcher([]string{"http://127.0.0.1:1/hook"}, "")
+	s.sm.publishers = []EventPublisher{webhooks}
+	sid := s.createSession(alice)
+
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+	invite.Info = map[string]interface{}{"call_type": YCKCallTypeVideo}
+	s.send(invite)
+	s.send(NewSignal(YCKCallSignalTypeCancel, alice, bob, sid))
+
+	var missed []*Event
+	for _, e := range webhookEvents(t, webhooks) {
+		if e.Type == EventMissedCall {
+			missed = append(missed, e)
+		}
+	}
+	if len(missed) != 1 || missed[0].Uid != bob || missed[0].Caller != alice || missed[0].CallType != YCKCallTypeVideo || missed[0].Group {
+		t.Fatalf("missed call events %+v", missed)
+	}
+
+	//拒接不算未接
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	if got := s.send(NewSignal(YCKCallSignalTypeReject, bob, alice, sid)); fmt.Sprint(got) != fmt.Sprint([]sentSignal{{alice, YCKCallSignalTypeReject}}) {
+		t.Errorf("reject sent %v", got)
+	}
+
+	//多方通话中还在响铃的成员，session删除时算未接
+	delete(s.sm.sessions, sid)
+	sid = s.createSession(alice)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid))
+	op := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+	op.Info = members("invite", carol)
+	s.send(op)
+	webhookEvents(t, webhooks)
+	s.sm.removeSession(s.sm.sessions[sid], YCKCallEndReasonTimeout)
+	got := s.collect()
+	want := []sentSignal{{alice, YCKCallSignalTypeEnd}, {carol, YCKCallSignalTypeEnd}, {carol, YCKCallSignalTypeMissedCall}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("remove session sent %v", got)
+	}
+	missed = nil
+	for _, e := range webhookEvents(t, webhooks) {
+		if e.Type == EventMissedCall {
+			missed = append(missed, e)
+		}
+	}
+	if len(missed) != 1 || missed[0].Uid != carol || missed[0].Caller != alice || !missed[0].Group {
+		t.Errorf("group missed call events %+v", missed)
+	}
+}
+
+type screenByCaller struct {
+	caller int64
+}
+
+func (p screenByCaller) CheckCall(req *CallRequest) uint16 {
+	if req.Caller == p.caller && req.Group {
+		return YCKPolicyRejectScreened
+	}
+	return 0
+}
+
+func TestSessionManagerCallScreening(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.dnd.Set(bob, time.Now().Add(time.Minute))
+	s.sm.AddCallPolicy(screenByCaller{alice})
+
+	//免打扰：被叫收不到Invite，主叫收到PolicyReject
+	sid := s.createSession(alice)
+	got := s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	if fmt.Sprint(got) != fmt.Sprint([]sentSignal{{alice, YCKCallSignalTypePolicyReject}}) {
+		t.Fatalf("invite to dnd callee sent %v", got)
+	}
+	if len(s.sm.sessions[sid].Participants) != 0 {
+		t.Errorf("participants created for screened call")
+	}
+
+	s.sm.dnd.Set(bob, time.Time{})
+	got = s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	if fmt.Sprint(got) != fmt.Sprint([]sentSignal{{bob, YCKCallSignalTypeInvite}}) {
+		t.Fatalf("invite after dnd cleared sent %v", got)
+	}
+
+	//多方：被过滤的成员跳过，其他成员照常邀请
+	delete(s.sm.sessions, sid)
+	sid = s.createSession(carol)
+	s.send(NewSignal(YCKCallSignalTypeInvite, carol, SessionManagerUserId, sid))
+	op := NewSignal(YCKCallSignalTypeMemberOp, carol, SessionManagerUserId, sid)
+	op.Info = members("invite", dave)
+	s.send(op)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid))
+	op = NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+	op.Info = members("invite", bob)
+	s.deliver(op)
+	var rejected bool
+	for _, sent := range s.collect() {
+		if sent.to == bob {
+			t.Errorf("screened member got %d", sent.signal)
+		}
+		if sent == (sentSignal{alice, YCKCallSignalTypePolicyReject}) {
+			rejected = true
+		}
+	}
+	if !rejected || s.sm.sessions[sid].Participants[bob] != nil {
+		t.Errorf("screened member invited")
+	}
+	if p := s.sm.sessions[sid].Participants[dave]; p == nil || !p.InState(YCKParticipantStateCalled) {
+		t.Errorf("member not screened was not invited")
+	}
+}
+
+func TestSessionManagerMediaCaps(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	withCaps := func(signal *Signal, codecs []interface{}, width int, fec bool) *Signal {
+		signal.Info = map[string]interface{}{
+			"media_caps": map[string]interface{}{"codecs": codecs, "max_width": width, "max_height": width * 9 / 16, "fec": fec},
+		}
+		return signal
+	}
+
+	got := s.send(withCaps(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid), []interface{}{"opus", "h264", "vp8"}, 1280, true))
+	if fmt.Sprint(got) != fmt.Sprint([]sentSignal{{bob, YCKCallSignalTypeInvite}}) {
+		t.Fatalf("invite sent %v", got)
+	}
+	s.deliver(withCaps(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid), []interface{}{"vp8", "opus"}, 640, false))
+
+	want := &MediaCaps{Codecs: []string{"opus", "vp8"}, MaxWidth: 640, MaxHeight: 360, Fec: false}
+	var receivers []int64
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil || msg.MsgType != relay.UdpMessageTypeUserSignal {
+			continue
+		}
+		signal := NewSignalTemp()
+		if err := signal.UnmarshalMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		if signal.Signal != YCKCallSignalTypeMediaCaps {
+			continue
+		}
+		receivers = append(receivers, msg.To)
+		if caps := mediaCapsOf(signal); fmt.Sprint(caps) != fmt.Sprint(want) {
+			t.Errorf("media caps to %d = %+v, want %+v", msg.To, caps, want)
+		}
+	}
+	if len(receivers) != 2 {
+		t.Errorf("media caps sent to %v", receivers)
+	}
+
+	//没有变化不重发
+	got = s.send(withCaps(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid), []interface{}{"vp8", "opus"}, 640, false))
+	for _, sent := range got {
+		if sent.signal == YCKCallSignalTypeMediaCaps {
+			t.Errorf("unchanged media caps sent again")
+		}
+	}
+}
+
+func TestSessionManagerTopology(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.mixerMin = 4
+	sid := s.createSession(alice)
+	topologyOf := func(sent []sentSignal) []int64 {
+		var to []int64
+		for _, ss := range sent {
+			if ss.signal == YCKCallSignalTypeTopology {
+				to = append(to, ss.to)
+			}
+		}
+		return to
+	}
+
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid))
+	session := s.sm.sessions[sid]
+	if session.Topology != TopologyMesh {
+		t.Fatalf("1-1 topology = %q", session.Topology)
+	}
+
+	//双方打洞都失败，退回sfu
+	for _, uid := range []int64{alice, bob} {
+		punch := NewSignal(YCKCallSignalTypePunchRequest, uid, SessionManagerUserId, sid)
+		punch.Info = map[string]interface{}{"addr": "10.0.0.1:5000"}
+		s.send(punch)
+	}
+	result := NewSignal(YCKCallSignalTypePunchResult, alice, SessionManagerUserId, sid)
+	result.Info = map[string]interface{}{"ok": false}
+	if to := topologyOf(s.send(result)); len(to) != 0 {
+		t.Errorf("topology changed after one punch result, sent to %v", to)
+	}
+	result = NewSignal(YCKCallSignalTypePunchResult, bob, SessionManagerUserId, sid)
+	result.Info = map[string]interface{}{"ok": false}
+	if to := topologyOf(s.send(result)); len(to) != 2 || session.Topology != TopologySfu {
+		t.Errorf("topology %q after punch failed, sent to %v", session.Topology, to)
+	}
+
+	//多方：人数达到mixer_min时改为mixer，有人离开后回到sfu
+	for _, uid := range []int64{carol, dave} {
+		op := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+		op.Info = members("invite", uid)
+		s.send(op)
+		s.send(NewSignal(YCKCallSignalTypeAccept, uid, SessionManagerUserId, sid))
+	}
+	if session.Topology != TopologyMixer {
+		t.Errorf("topology with 4 in call = %q", session.Topology)
+	}
+	if to := topologyOf(s.send(NewSignal(YCKCallSignalTypeEnd, dave, SessionManagerUserId, sid))); len(to) != 3 || session.Topology != TopologySfu {
+		t.Errorf("topology %q after leave, sent to %v", session.Topology, to)
+	}
+}
+
+func TestSessionManagerKickAudited(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", bob)
+	s.send(invite)
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid))
+	kick := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+	kick.Info = members("kick", bob)
+	s.send(kick)
+
+	entries := s.sm.audit.Query(0, relay.AuditSessionKick, 0)
+	if len(entries) != 1 || entries[0].Who != fmt.Sprintf("uid:%d", alice) ||
+		entries[0].Target != fmt.Sprint(sid) || entries[0].Detail != fmt.Sprintf("uid:%d", bob) {
+		t.Errorf("kick audit entries %+v", entries)
+	}
+}
+
+func TestSessionManagerTenants(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.tenants = map[uint16]*TenantConfig{
+		2: {MaxCallsPerUser: 1, Relays: []string{"10.0.0.2:19001"}},
+	}
+	alice2, bob2, carol2 := relay.TenantId(2, alice), relay.TenantId(2, bob), relay.TenantId(2, carol)
+
+	sid := s.createSession(alice2)
+	if relay.TenantOf(sid) != 2 {
+		t.Fatalf("sid %x not in tenant 2", sid)
+	}
+	//同一应用内的uid可以呼叫，其他租户的同号uid不行
+	if sent := s.send(NewSignal(YCKCallSignalTypeInvite, alice2, bob, sid)); len(sent) != 0 {
+		t.Errorf("cross tenant invite sent %v", sent)
+	}
+	if sent := s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)); len(sent) != 0 {
+		t.Errorf("invite into other tenant's session sent %v", sent)
+	}
+	if sent := s.send(NewSignal(YCKCallSignalTypeInvite, alice2, bob2, sid)); len(sent) != 1 || sent[0].to != bob2 {
+		t.Fatalf("same tenant invite sent %v", sent)
+	}
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob2, alice2, sid))
+	op := NewSignal(YCKCallSignalTypeMemberOp, alice2, SessionManagerUserId, sid)
+	op.Info = members("invite", carol, carol2)
+	s.send(op)
+	if s.sm.sessions[sid].Participants[carol] != nil || s.sm.sessions[sid].Participants[carol2] == nil {
+		t.Error("member op invited uid of other tenant")
+	}
+
+	//租户2的上限是1，租户0沿用全局的2
+	if sent := s.send(NewSignal(YCKCallSignalTypeSidRequest, alice2, SessionManagerUserId, 0)); len(sent) != 1 || sent[0].signal != YCKCallSignalTypePolicyReject {
+		t.Errorf("tenant call limit: sent %v", sent)
+	}
+	if sent := s.send(NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0)); len(sent) != 1 || sent[0].signal != YCKCallSignalTypeSidCreated {
+		t.Errorf("default tenant sid request: sent %v", sent)
+	}
+
+	s.sm.relays = []string{"10.0.0.1:19001", "10.0.0.2:19001"}
+	if got := s.sm.relayCandidates(alice2); !equalStrings(got, []string{"10.0.0.2:19001"}) {
+		t.Errorf("tenant relay candidates %v", got)
+	}
+	if got := s.sm.relayCandidates(alice); len(got) != 2 {
+		t.Errorf("default relay candidates %v", got)
+	}
+
+	metrics := s.sm.tenantMetrics()
+	if metrics[2].Sessions != 1 || metrics[2].InCall != 2 || metrics[0].Sessions != 1 {
+		t.Errorf("tenant metrics %+v %+v", metrics[0], metrics[2])
+	}
+}
+
+func TestSessionManagerQuota(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.quota = NewUsageQuota(s.sm.usage, relay.Usage{CallSeconds: 60}, map[uint16]relay.Usage{3: {RelayedBytes: 1000}})
+	s.sm.AddQuotaChecker(s.sm.quota)
+	webhooks := NewWebhookDispatcher([]string{"http://127.0.0.1:1/hook"}, "")
+	s.sm.publishers = []EventPublisher{webhooks}
+
+	sid := s.createSession(alice)
+	for _, st := range []step{oneToOneInvite, oneToOneAccept} {
+		s.send(NewSignal(st.signal, st.from, st.to, sid))
+	}
+	s.sm.sessions[sid].Participants[alice].JoinTime = time.Now().Add(-2 * time.Minute)
+	s.sm.removeSession(s.sm.sessions[sid], YCKCallEndReasonHangup)
+	s.collect() //发给双方的End
+	if u := s.sm.usage.Pending(relay.UserUsageKey(alice)); u.CallSeconds < 120 {
+		t.Errorf("alice call seconds %v", u)
+	}
+
+	if sent := s.send(NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0)); len(sent) != 1 || sent[0].signal != YCKCallSignalTypePolicyReject {
+		t.Errorf("over quota sid request: sent %v", sent)
+	}
+	if sent := s.send(NewSignal(YCKCallSignalTypeSidRequest, carol, SessionManagerUserId, 0)); len(sent) != 1 || sent[0].signal != YCKCallSignalTypeSidCreated {
+		t.Errorf("sid request within quota: sent %v", sent)
+	}
+
+	//租户合计超额时租户里的uid都不能再发起
+	s.sm.usage.Add(relay.TenantId(3, bob), relay.Usage{RelayedBytes: 1000})
+	if sent := s.send(NewSignal(YCKCallSignalTypeSidRequest, relay.TenantId(3, carol), SessionManagerUserId, 0)); len(sent) != 1 || sent[0].signal != YCKCallSignalTypePolicyReject {
+		t.Errorf("tenant over quota sid request: sent %v", sent)
+	}
+
+	webhookEvents(t, webhooks)
+	s.sm.flushUsage()
+	events := webhookEvents(t, webhooks)
+	if len(events) != 1 || events[0].Type != EventUsage || events[0].Period != relay.UsagePeriod(time.Now()) ||
+		events[0].Usage[relay.TenantUsageKey(3)].RelayedBytes != 1000 {
+		t.Fatalf("usage events %+v", events)
+	}
+	//flush后已入账的用量仍然计入
+	if sent := s.send(NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0)); len(sent) != 1 || sent[0].signal != YCKCallSignalTypePolicyReject {
+		t.Errorf("over quota sid request after flush: sent %v", sent)
+	}
+}
+
+func TestConfigTenantFlags(t *testing.T) {
+	config := GetDefaultConfig()
+	config.SetTenantFlags([]string{"3=5", "x=1", "4=y"}, []string{"3=10.0.0.1:19001", "3=10.0.0.2:19001", "70000=10.0.0.3:19001"})
+	if len(config.Tenants) != 1 || config.Tenants[3].MaxCallsPerUser != 5 || len(config.Tenants[3].Relays) != 2 {
+		t.Errorf("tenants %+v", config.Tenants)
+	}
+	config.SetTenantFlags(nil, []string{"5=10.0.0.1:19001"})
+	if config.Tenants[5].MaxCallsPerUser != -1 {
+		t.Errorf("tenant without limit flag has limit %d", config.Tenants[5].MaxCallsPerUser)
+	}
+	if errs := config.Check(); len(errs) != 0 {
+		t.Errorf("config errors %v", errs)
+	}
+}
+
+func signalPacket(t *testing.T, signal *Signal) *relay.ReceivedPacket {
+	payload, err := signal.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, signal.From, SessionManagerUserId, 0, payload, nil)
+	return &relay.ReceivedPacket{Body: msg.ObfuscatedDataOfMessage(), FromUdpAddr: testRelayAddr}
+}
+
+func TestInboxDropsOldestNormal(t *testing.T) {
+	q := NewInbox(3)
+	packets := make([]*relay.ReceivedPacket, 5)
+	for i := range packets {
+		packets[i] = &relay.ReceivedPacket{Time: int64(i)}
+	}
+	q.Push(packets[0], false)
+	q.Push(packets[1], true)
+	q.Push(packets[2], false)
+	q.Push(packets[3], false) //丢packets[0]
+	q.Push(packets[4], true)  //丢packets[2]
+
+	var got []int64
+	for p := q.Pop(); p != nil; p = q.Pop() {
+		got = append(got, p.Time)
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 3 || got[2] != 4 {
+		t.Errorf("popped %v, want [1 3 4]", got)
+	}
+	if stats := q.Stats(); stats.Dropped != 2 || stats.DroppedCritical != 0 || stats.MaxLength != 3 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestInboxCriticalOverflow(t *testing.T) {
+	q := NewInbox(2)
+	for i := 0; i < 4; i++ {
+		q.Push(&relay.ReceivedPacket{}, true)
+	}
+	q.Push(&relay.ReceivedPacket{}, false) //满了且没有普通包可丢
+	q.Push(&relay.ReceivedPacket{}, true)  //超过两倍容量
+	if stats := q.Stats(); stats.Length != 4 || stats.Dropped != 2 || stats.DroppedCritical != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+	select {
+	case <-q.Ready():
+	default:
+		t.Error("inbox not ready with packets queued")
+	}
+}
+
+func TestIsCriticalPacket(t *testing.T) {
+	for _, c := range []struct {
+		signal   uint16
+		critical bool
+	}{
+		{YCKCallSignalTypeEnd, true},
+		{YCKCallSignalTypeAccept, true},
+		{YCKCallSignalTypeCancel, true},
+		{YCKCallSignalTypeInvite, false},
+		{YCKCallSignalTypeMemberStateRequest, false},
+	} {
+		packet := signalPacket(t, NewSignal(c.signal, alice, bob, 42))
+		if got := isCriticalPacket(packet.Body); got != c.critical {
+			t.Errorf("signal %d critical = %v, want %v", c.signal, got, c.critical)
+		}
+	}
+	ack := relay.NewMessage(relay.UdpMessageTypeUserRegReceived, SessionManagerUserId, 0, 0, nil, nil)
+	if !isCriticalPacket(ack.ObfuscatedDataOfMessage()) {
+		t.Error("user reg received not critical")
+	}
+	if isCriticalPacket([]byte{1, 2, 3}) {
+		t.Error("garbage critical")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemTransport(t *testing.T) {
+	transport := NewMemTransport()
+	transport.Deliver([]byte("ping"), testRelayAddr)
+	buf := make([]byte, 16)
+	n, addr, err := transport.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "ping" || addr != testRelayAddr {
+		t.Fatalf("read %q from %v, err %v", buf[:n], addr, err)
+	}
+
+	transport.WriteToUDP([]byte("pong"), testRelayAddr)
+	sent := transport.Sent()
+	if len(sent) != 1 || string(sent[0].Data) != "pong" {
+		t.Fatalf("sent %v", sent)
+	}
+	if len(transport.Sent()) != 0 {
+		t.Error("Sent should drain written packets")
+	}
+
+	transport.Close()
+	if _, _, err := transport.ReadFromUDP(buf); err != errTransportClosed {
+		t.Errorf("read after close err = %v", err)
+	}
+}
+
+func TestPacerSmoothsBursts(t *testing.T) {
+	transport := NewMemTransport()
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 19002}
+	pacer := NewPacer(100, 150, nil) //桶容量10和15
+	for i := 0; i < 30; i++ {
+		pacer.Send(transport, []byte{byte(i)}, testRelayAddr)
+	}
+	pacer.Send(transport, []byte{100}, other)
+
+	sent := transport.Sent()
+	if len(sent) != 11 {
+		t.Fatalf("sent %d packets immediately, want 11", len(sent))
+	}
+	if sent[10].Addr != other {
+		t.Error("packet to idle destination not sent immediately")
+	}
+	if stats := pacer.Stats(); stats.Queued != 20 {
+		t.Errorf("queued = %d, want 20", stats.Queued)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pacer.Stats().Queued > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sent = append(sent, transport.Sent()...)
+	if len(sent) != 31 {
+		t.Fatalf("sent %d packets, want 31", len(sent))
+	}
+	next := byte(0)
+	for _, p := range sent {
+		if p.Addr == testRelayAddr {
+			if p.Data[0] != next {
+				t.Fatalf("packet %d sent out of order, want %d", p.Data[0], next)
+			}
+			next++
+		}
+	}
+
+	unlimited := NewPacer(0, 0, nil)
+	for i := 0; i < 1000; i++ {
+		unlimited.Send(transport, []byte{0}, testRelayAddr)
+	}
+	if n := len(transport.Sent()); n != 1000 {
+		t.Errorf("unlimited pacer sent %d packets immediately", n)
+	}
+}
+
+func TestRelayBreakers(t *testing.T) {
+	b := NewRelayBreakers()
+	addr := testRelayAddr.String()
+	failed := errors.New("network is unreachable")
+
+	for i := 1; i < BreakerFailures; i++ {
+		if state := b.Record(addr, failed); state != breakerUnchanged {
+			t.Fatalf("failure %d: state %d", i, state)
+		}
+	}
+	b.Record(addr, nil) //成功一次清零
+	for i := 1; i < BreakerFailures; i++ {
+		b.Record(addr, failed)
+	}
+	if !b.Allow(addr) {
+		t.Fatal("breaker opened before consecutive failures reached the limit")
+	}
+	if state := b.Record(addr, failed); state != breakerOpened || b.Allow(addr) {
+		t.Fatalf("breaker not opened, state %d", state)
+	}
+	if open := b.Open(); len(open) != 1 || open[0] != addr {
+		t.Errorf("open breakers %v", open)
+	}
+
+	//熔断前排队的包失败不影响，探测失败继续熔断
+	if state := b.Record(addr, failed); state != breakerUnchanged {
+		t.Errorf("queued write failure state %d", state)
+	}
+	if !b.StartProbe(addr) || b.StartProbe(addr) {
+		t.Fatal("probe should start exactly once")
+	}
+	if state := b.Record(addr, failed); state != breakerReopened || b.Allow(addr) {
+		t.Fatalf("failed probe state %d", state)
+	}
+	if !b.StartProbe(addr) {
+		t.Fatal("probe not restarted after failure")
+	}
+	if state := b.Record(addr, nil); state != breakerClosed || !b.Allow(addr) {
+		t.Fatalf("successful probe state %d", state)
+	}
+	if b.StartProbe(addr) {
+		t.Error("probe started on closed breaker")
+	}
+}
+
+func TestSessionOneToOneStateMachine(t *testing.T) {
+	session := NewSession(42)
+	session.Mode = YCKCallModeOneToOne
+
+	if session.Accept(bob) {
+		t.Fatal("accept before invite")
+	}
+	if !session.Invite(alice, bob, "phone") {
+		t.Fatal("invite rejected")
+	}
+	if session.Invite(alice, bob, "phone") {
+		t.Error("second invite while calling accepted")
+	}
+	a, b := session.Participant(alice), session.Participant(bob)
+	if !a.InState(YCKParticipantStateCalling) || !b.InState(YCKParticipantStateCalled) || a.Device != "phone" || b.Caller != alice {
+		t.Fatalf("after invite alice %+v bob %+v", a, b)
+	}
+
+	if session.Accept(alice) {
+		t.Error("caller accepted own call")
+	}
+	if !session.Accept(bob) || !a.InState(YCKParticipantStateIncall) || !b.InState(YCKParticipantStateIncall) {
+		t.Fatalf("after accept alice %d bob %d", a.State, b.State)
+	}
+	if b.Event != YCKParticipantEventAccept || a.Event != YCKParticipantEventRecvAccept {
+		t.Errorf("accept events alice %d bob %d", a.Event, b.Event)
+	}
+
+	if ok, missed := session.End(bob, YCKCallEndReasonHangup); !ok || missed != nil {
+		t.Fatalf("end ok %v missed %v", ok, missed)
+	}
+	if !a.InState(YCKParticipantStateIdle) || a.EndReason != YCKCallEndReasonHangup || a.Event != YCKParticipantEventRecvEnd {
+		t.Errorf("after end alice %+v", a)
+	}
+
+	//取消还在响铃的呼叫，对方记未接来电
+	session.Invite(alice, bob, "")
+	if ok, missed := session.Cancel(alice, YCKCallEndReasonHangup); !ok || missed != b {
+		t.Fatalf("cancel ok %v missed %v", ok, missed)
+	}
+	if !b.InState(YCKParticipantStateIdle) || b.Event != YCKParticipantEventRecvCancel {
+		t.Errorf("after cancel bob %+v", b)
+	}
+
+	session.Invite(alice, bob, "")
+	if session.Reject(alice, YCKCallEndReasonHangup) {
+		t.Error("caller rejected own call")
+	}
+	if !session.Busy(bob, YCKCallEndReasonHangup) || a.Event != YCKParticipantEventRecvBusy || !a.InState(YCKParticipantStateIdle) {
+		t.Errorf("after busy alice %+v", a)
+	}
+}
+
+func TestSessionMultipleStateMachine(t *testing.T) {
+	session := NewSession(43)
+	session.Mode = YCKCallModeMultiple
+
+	if !session.Invite(alice, SessionManagerUserId, "") || !session.Participant(alice).InState(YCKParticipantStateIncall) {
+		t.Fatal("initiator not in call after invite")
+	}
+	if session.Participant(SessionManagerUserId) != nil {
+		t.Error("session manager added as participant")
+	}
+
+	b := session.InviteMember(alice, bob)
+	c := session.InviteMember(alice, carol)
+	if b == nil || c == nil || !b.InState(YCKParticipantStateCalled) || b.Caller != alice {
+		t.Fatalf("invited bob %+v", b)
+	}
+	if session.InviteMember(alice, bob) != nil {
+		t.Error("member invited twice")
+	}
+	if !session.Accept(bob) || !b.InState(YCKParticipantStateIncall) || !session.Participant(alice).InState(YCKParticipantStateIncall) {
+		t.Fatal("accept in multiple mode")
+	}
+	if !session.Timeout(carol) || c.EndReason != YCKCallEndReasonTimeout || session.Timeout(carol) {
+		t.Errorf("timeout carol %+v", c)
+	}
+
+	if session.Kick(alice, carol) {
+		t.Error("kicked member not in call")
+	}
+	if !session.Kick(alice, bob) || b.EndReason != YCKCallEndReasonKicked || b.Event != YCKParticipantEventRecvEnd {
+		t.Errorf("kick bob %+v", b)
+	}
+	if ok, _ := session.Cancel(alice, YCKCallEndReasonHangup); !ok || !session.Participant(alice).InState(YCKParticipantStateIdle) {
+		t.Error("initiator cancel")
+	}
+
+	snapshot := session.Snapshot()
+	if snapshot.Sid != 43 || len(snapshot.Participants) != 3 {
+		t.Fatalf("snapshot %+v", snapshot)
+	}
+	for i, uid := range []int64{alice, bob, carol} {
+		if snapshot.Participants[i].Uid != uid || snapshot.Participants[i].State != YCKParticipantStateIdle {
+			t.Errorf("snapshot participant %d = %+v", i, snapshot.Participants[i])
+		}
+	}
+	session.Participant(alice).SetState(YCKParticipantStateIncall)
+	if snapshot.Participants[0].State != YCKParticipantStateIdle {
+		t.Error("snapshot changed with session")
+	}
+}
+
+func TestSessionManagerStateHooks(t *testing.T) {
+	s := newSimulator(t)
+	var calls []string
+	s.sm.AddStateHooks(&StateHooks{
+		OnAccepted: func(session *Session, uid int64) { calls = append(calls, fmt.Sprint("accepted ", uid)) },
+		OnEnded: func(session *Session, uid int64, reason uint16) {
+			calls = append(calls, fmt.Sprint("ended ", uid, " ", reason))
+		},
+		OnKicked: func(session *Session, by int64, uid int64) {
+			calls = append(calls, fmt.Sprint("kicked ", uid, " by ", by))
+		},
+	})
+	s.sm.AddStateHooks(&StateHooks{}) //没设置的回调跳过
+
+	sid := s.createSession(alice)
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", bob)
+	s.send(invite)
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid))
+	kick := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+	kick.Info = members("kick", bob)
+	s.send(kick)
+
+	want := []string{
+		fmt.Sprint("accepted ", alice),
+		fmt.Sprint("accepted ", bob),
+		fmt.Sprint("kicked ", bob, " by ", alice),
+		fmt.Sprint("ended ", bob, " ", YCKCallEndReasonKicked),
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("hook calls:\n%s\nwant:\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+//没有订阅者和回调时加入的参与者，之后注册的回调仍能收到他们的离开
+func TestSessionManagerStateHooksAddedLater(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid))
+
+	ended := map[int64]uint16{}
+	s.sm.AddStateHooks(&StateHooks{OnEnded: func(session *Session, uid int64, reason uint16) { ended[uid] = reason }})
+	s.sm.removeSession(s.sm.sessions[sid], YCKCallEndReasonMaxDuration)
+	for _, uid := range []int64{alice, bob} {
+		if ended[uid] != YCKCallEndReasonMaxDuration {
+			t.Errorf("participant %d end reason = %d, want %d", uid, ended[uid], YCKCallEndReasonMaxDuration)
+		}
+	}
+}
+
+func TestSessionManagerRingGroup(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	session := s.sm.sessions[sid]
+
+	ring := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	ring.Info = members("ring", bob, carol, dave)
+	s.send(ring)
+	if !session.RingGroup {
+		t.Fatal("session not marked as ring group")
+	}
+
+	sent := s.send(NewSignal(YCKCallSignalTypeAccept, carol, SessionManagerUserId, sid))
+	cancelled := map[int64]bool{}
+	for _, signal := range sent {
+		if signal.signal == YCKCallSignalTypeCancel {
+			cancelled[signal.to] = true
+		}
+	}
+	if !cancelled[bob] || !cancelled[dave] || cancelled[carol] || len(cancelled) != 2 {
+		t.Errorf("cancel sent to %v, want bob and dave", cancelled)
+	}
+	for _, uid := range []int64{bob, dave} {
+		p := session.Participant(uid)
+		if !p.InState(YCKParticipantStateIdle) || p.EndReason != YCKCallEndReasonAnsweredElsewhere {
+			t.Errorf("participant %d state = %d reason = %d", uid, p.State, p.EndReason)
+		}
+	}
+	if !session.Participant(carol).InState(YCKParticipantStateIncall) {
+		t.Error("winner not in call")
+	}
+	if session.RingGroup {
+		t.Error("ring group not cleared after answer")
+	}
+
+	//来晚的接听不再生效
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid))
+	if !session.Participant(bob).InState(YCKParticipantStateIdle) {
+		t.Error("late accept joined the call")
+	}
+}
+
+func TestSessionManagerCallQueue(t *testing.T) {
+	const hotline = 1900
+	s := newSimulator(t)
+	s.sm.hotlines = map[int64][]int64{hotline: {bob}}
+	position := func(to int64) string {
+		signal := s.lastSent(to, YCKCallSignalTypeQueuePosition)
+		if signal == nil {
+			return ""
+		}
+		return fmt.Sprint(signal.Info["position"])
+	}
+
+	//bob空闲，alice直接接通
+	sid := s.createSession(alice)
+	queue := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	queue.Info = members("queue", hotline)
+	s.deliver(queue)
+	if invite := s.lastSent(bob, YCKCallSignalTypeInvite); invite == nil || invite.SessionId != sid {
+		t.Fatal("agent not invited")
+	}
+
+	//bob在响铃，carol排到第1位
+	s.send(NewSignal(YCKCallSignalTypeSidRequest, carol, SessionManagerUserId, 0))
+	var sid2 int64
+	for id := range s.sm.sessions {
+		if id != sid {
+			sid2 = id
+		}
+	}
+	queue = NewSignal(YCKCallSignalTypeInvite, carol, SessionManagerUserId, sid2)
+	queue.Info = members("queue", hotline)
+	s.deliver(queue)
+	if got := position(carol); got != "1" {
+		t.Fatalf("carol position = %q, want 1", got)
+	}
+
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid))
+	if calls := s.sm.queues[hotline].calls; len(calls) != 1 || calls[0].sid != sid2 {
+		t.Fatalf("answered call still queued: %v", calls)
+	}
+
+	//bob挂断后接着邀请carol的呼叫
+	s.deliver(NewSignal(YCKCallSignalTypeEnd, bob, SessionManagerUserId, sid))
+	if invite := s.lastSent(bob, YCKCallSignalTypeInvite); invite == nil || invite.SessionId != sid2 {
+		t.Fatal("agent not invited to next call in queue")
+	}
+
+	//bob拒绝，carol回到队列，QueueRetryDelay内不再邀请bob
+	s.deliver(NewSignal(YCKCallSignalTypeReject, bob, SessionManagerUserId, sid2))
+	if got := position(carol); got != "1" {
+		t.Errorf("carol position after reject = %q, want 1", got)
+	}
+	if s.sm.sessions[sid2].Participant(bob).InState(YCKParticipantStateCalled) {
+		t.Error("declined agent invited again")
+	}
+
+	s.send(NewSignal(YCKCallSignalTypeEnd, carol, SessionManagerUserId, sid2))
+	if len(s.sm.queues) != 0 {
+		t.Errorf("queues not removed after caller hung up: %v", s.sm.queues)
+	}
+}
+
+func TestSessionManagerMaxDuration(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.maxDuration = time.Hour
+	//回调在通话开始前注册，参与者进入incall时才会被记为已加入
+	ended := map[int64]uint16{}
+	s.sm.AddStateHooks(&StateHooks{OnEnded: func(session *Session, uid int64, reason uint16) { ended[uid] = reason }})
+	request := NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0)
+	request.Info = map[string]interface{}{"max_duration": 1}
+	s.deliver(request)
+	created := s.lastSent(alice, YCKCallSignalTypeSidCreated)
+	if created == nil || fmt.Sprint(created.Info["max_duration"]) != "1" {
+		t.Fatalf("sid created without max_duration: %v", created)
+	}
+	sid := created.SessionId
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid))
+
+	s.sm.handleTicker(time.Now().Add(3 * time.Second))
+	if s.sm.sessions[sid] != nil {
+		t.Fatal("session not removed after max duration")
+	}
+	sent := s.collect()
+	for _, uid := range []int64{alice, bob} {
+		if ended[uid] != YCKCallEndReasonMaxDuration {
+			t.Errorf("participant %d end reason = %d, want %d", uid, ended[uid], YCKCallEndReasonMaxDuration)
+		}
+		found := false
+		for _, signal := range sent {
+			found = found || signal == (sentSignal{uid, YCKCallSignalTypeEnd})
+		}
+		if !found {
+			t.Errorf("no end sent to %d: %v", uid, sent)
+		}
+	}
+
+	//sid请求不能超过config的上限
+	request = NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0)
+	request.Info = map[string]interface{}{"max_duration": 7200}
+	if got := s.sm.maxDurationOf(request); got != time.Hour {
+		t.Errorf("max duration = %v, want 1h", got)
+	}
+}
+
+func TestSessionManagerHopTrace(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+
+	signal := NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+	s.clock++
+	signal.Timestamp = s.clock
+	payload, err := signal.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, alice, SessionManagerUserId, 0, payload, nil)
+	relay.SetHopTrace(msg, time.Now())
+	data := msg.ObfuscatedDataOfMessage()
+	body := utils.GetPacketBuffer(len(data))
+	copy(body, data)
+	s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+
+	traced := 0
+	for _, p := range s.transport.Sent() {
+		sent, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil || sent.MsgType != relay.UdpMessageTypeUserSignal {
+			continue
+		}
+		var kinds []uint8
+		for _, hop := range relay.HopsFromMessage(sent) {
+			kinds = append(kinds, hop.Kind)
+		}
+		if fmt.Sprint(kinds) != fmt.Sprint([]uint8{relay.HopClientSend, relay.HopSessionIn, relay.HopSessionOut}) {
+			t.Errorf("signal to %d hops %v", sent.To, kinds)
+		}
+		traced++
+	}
+	if traced == 0 {
+		t.Fatal("no signal sent")
+	}
+
+	//之后不带标志的信令不再带各跳
+	s.deliver(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid))
+	for _, p := range s.transport.Sent() {
+		if sent, err := relay.NewMessageFromObfuscatedData(p.Data); err == nil && sent.HasFlag(relay.UdpMessageFlagHopTrace) {
+			t.Errorf("untraced signal to %d carries hops", sent.To)
+		}
+	}
+}
+
+func TestSessionManagerClickToCall(t *testing.T) {
+	s := newSimulator(t)
+	if _, err := s.sm.originateCall(&ClickToCallRequest{Caller: alice, Callee: alice}); err == nil {
+		t.Error("call to self originated")
+	}
+	s.sm.dnd.Set(carol, time.Now().Add(time.Hour))
+	if _, err := s.sm.originateCall(&ClickToCallRequest{Caller: alice, Callee: carol}); err == nil || len(s.sm.sessions) != 0 {
+		t.Errorf("call to dnd callee originated, err %v", err)
+	}
+
+	session, err := s.sm.originateCall(&ClickToCallRequest{Caller: alice, Callee: bob, CallType: YCKCallTypeAudio, Name: "shop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invites := map[int64]*Signal{}
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signal := NewSignalTemp()
+		if signal.UnmarshalMessage(msg) == nil && signal.Signal == YCKCallSignalTypeInvite {
+			invites[msg.To] = signal
+		}
+	}
+	for uid, peer := range map[int64]int64{alice: bob, bob: alice} {
+		invite := invites[uid]
+		if invite == nil || invite.SessionId != session.Sid {
+			t.Fatalf("no invite sent to %d", uid)
+		}
+		if fmt.Sprint(invite.Info["peer"]) != fmt.Sprint(peer) || invite.Info["name"] != "shop" || invite.Info["call_type"] != YCKCallTypeAudio {
+			t.Errorf("invite to %d info %v", uid, invite.Info)
+		}
+	}
+
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, session.Sid))
+	if !session.Participant(bob).InState(YCKParticipantStateIncall) || s.sm.sessions[session.Sid] == nil {
+		t.Fatal("callee not in call")
+	}
+
+	//主叫拒接，剩下的一方收到End，session结束
+	sent := s.send(NewSignal(YCKCallSignalTypeReject, alice, SessionManagerUserId, session.Sid))
+	found := false
+	for _, signal := range sent {
+		found = found || signal == (sentSignal{bob, YCKCallSignalTypeEnd})
+	}
+	if !found || s.sm.sessions[session.Sid] != nil {
+		t.Errorf("session not ended after reject, sent %v", sent)
+	}
+}
+
+func TestSessionManagerAttachBot(t *testing.T) {
+	const bot = -4
+	s := newSimulator(t)
+	if err := s.sm.attachBot(12345, bot, ""); err != errSessionNotFound {
+		t.Errorf("attach to unknown session err %v", err)
+	}
+
+	sid := s.createSession(alice)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid))
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid))
+
+	if err := s.sm.attachBot(sid, bot, "assistant"); err != nil {
+		t.Fatal(err)
+	}
+	session := s.sm.sessions[sid]
+	if session.Mode != YCKCallModeMultiple {
+		t.Errorf("session mode %d after attaching bot, want multiple", session.Mode)
+	}
+	invite := s.lastSent(bot, YCKCallSignalTypeInvite)
+	if invite == nil || invite.SessionId != sid {
+		t.Fatal("no invite sent to bot")
+	}
+	if invite.Info["bot"] != true || invite.Info["name"] != "assistant" {
+		t.Errorf("bot invite info %v", invite.Info)
+	}
+	if err := s.sm.attachBot(sid, bot, ""); err == nil {
+		t.Error("bot attached twice")
+	}
+
+	s.send(NewSignal(YCKCallSignalTypeAccept, bot, SessionManagerUserId, sid))
+	if !session.Participant(bot).InState(YCKParticipantStateIncall) {
+		t.Fatal("bot not in call")
+	}
+	s.send(NewSignal(YCKCallSignalTypeEnd, bot, SessionManagerUserId, sid))
+	if s.sm.sessions[sid] == nil || !session.Participant(alice).InState(YCKParticipantStateIncall) {
+		t.Error("session ended when the bot left")
+	}
+}
+
+func TestSessionManagerVoicemail(t *testing.T) {
+	s := newSimulator(t)
+	s.sm.maxVoicemail = 30 * time.Second
+	webhooks := NewWebhookDispatcher([]string{"http://127.0.0.1:1/hook"}, "")
+	s.sm.publishers = []EventPublisher{webhooks}
+	sid := s.createSession(alice)
+	s.send(NewSignal(oneToOneInvite.signal, alice, bob, sid))
+
+	s.deliver(NewSignal(YCKCallSignalTypeReject, bob, alice, sid))
+	var offer *Signal
+	var control []byte
+	var members []int64
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.MsgType {
+		case relay.UdpMessageTypeRecordControl:
+			control = msg.Payload
+		case relay.UdpMessageTypeSessionControl:
+			c, err := relay.UnmarshalSessionControl(msg.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			members = c.Members
+		case relay.UdpMessageTypeUserSignal:
+			signal := NewSignalTemp()
+			if signal.UnmarshalMessage(msg) == nil && signal.Signal == YCKCallSignalTypeVoicemail && msg.To == alice {
+				offer = signal
+			}
+		}
+	}
+	if offer == nil || fmt.Sprint(offer.Info["duration"]) != "30" || fmt.Sprint(offer.Info["callee"]) != fmt.Sprint(bob) {
+		t.Fatalf("voicemail offer %v", offer)
+	}
+	if len(control) != 11 || control[0] != relay.RecordControlVoicemail || int64(binary.BigEndian.Uint64(control[1:9])) != alice {
+		t.Errorf("record control %v", control)
+	}
+	if len(members) != 1 || members[0] != alice {
+		t.Errorf("relay session members %v during voicemail, want the caller", members)
+	}
+
+	//主叫挂断结束留言，不再转给被叫
+	if sent := s.send(NewSignal(YCKCallSignalTypeEnd, alice, bob, sid)); len(sent) != 0 {
+		t.Errorf("end during voicemail sent %v", sent)
+	}
+	if v := s.sm.sessions[sid].Voicemail; v == nil || !v.Done {
+		t.Fatalf("voicemail not stopped: %+v", v)
+	}
+
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(alice))
+	binary.BigEndian.PutUint32(payload[8:12], 4200)
+	payload = append(payload, "/var/ycng/record/42/1001.pcap"...)
+	data := relay.NewMessage(relay.UdpMessageTypeVoicemailDone, SessionManagerUserId, sid, 0, payload, nil).ObfuscatedDataOfMessage()
+	body := utils.GetPacketBuffer(len(data))
+	copy(body, data)
+	s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+
+	var recorded *Event
+	for _, e := range webhookEvents(t, webhooks) {
+		if e.Type == EventVoicemailRecorded {
+			recorded = e
+		}
+	}
+	if recorded == nil || recorded.Uid != bob || recorded.Caller != alice || recorded.Duration != 4200 ||
+		recorded.File != "/var/ycng/record/42/1001.pcap" || recorded.Relay != testRelayAddr.String() {
+		t.Errorf("voicemail event %+v", recorded)
+	}
+}
+
+func TestSessionManagerPermit(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", bob)
+	s.send(invite)
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid))
+
+	permit := func(by int64, info map[string]interface{}) {
+		signal := NewSignal(YCKCallSignalTypeMemberOp, by, SessionManagerUserId, sid)
+		signal.Info = members("permit", bob)
+		for k, v := range info {
+			signal.Info[k] = v
+		}
+		s.deliver(signal)
+	}
+	permit(alice, map[string]interface{}{"send_audio": false, "send_video": false})
+	var control *relay.SessionControl
+	var states map[string]interface{}
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.MsgType {
+		case relay.UdpMessageTypeSessionControl:
+			if control, err = relay.UnmarshalSessionControl(msg.Payload); err != nil {
+				t.Fatal(err)
+			}
+		case relay.UdpMessageTypeUserSignal:
+			signal := NewSignalTemp()
+			if signal.UnmarshalMessage(msg) == nil && signal.Signal == YCKCallSignalTypeMemberState && msg.To == alice {
+				states, _ = signal.Info["states"].(map[string]interface{})
+			}
+		}
+	}
+	const listenOnly = relay.MemberNoSendAudio | relay.MemberNoSendVideo
+	if control == nil || len(control.Restricts) != 2 || control.Members[1] != bob || control.Restricts[1] != listenOnly {
+		t.Fatalf("session control %+v", control)
+	}
+	bobState, _ := states[strconv.FormatInt(bob, 10)].(map[string]interface{})
+	if fmt.Sprint(bobState["no_send_audio"]) != "1" || fmt.Sprint(bobState["no_send_video"]) != "1" || bobState["no_receive"] != nil {
+		t.Errorf("bob member state %v", bobState)
+	}
+
+	//受限的成员不能给自己解除限制
+	permit(bob, map[string]interface{}{"send_audio": true})
+	if p := s.sm.sessions[sid].Participant(bob); p.Restrict != listenOnly {
+		t.Errorf("restricted member changed permissions to %d", p.Restrict)
+	}
+	permit(alice, map[string]interface{}{"send_audio": true})
+	if p := s.sm.sessions[sid].Participant(bob); p.Restrict != relay.MemberNoSendVideo {
+		t.Errorf("bob restrict %d after allowing audio", p.Restrict)
+	}
+	s.collect()
+}
+
+func TestSessionManagerBroadcast(t *testing.T) {
+	s := newSimulator(t)
+	request := NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0)
+	request.Info = map[string]interface{}{"mode": SessionModeBroadcast, "publishers": []int64{bob}}
+	s.send(request)
+	var session *Session
+	for _, created := range s.sm.sessions {
+		session = created
+	}
+	if session == nil || session.Mode != YCKCallModeMultiple || !session.Publishers[alice] || !session.Publishers[bob] {
+		t.Fatalf("broadcast session %+v", session)
+	}
+	sid := session.Sid
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", bob, carol, dave)
+	s.send(invite)
+	for _, uid := range []int64{bob, carol, dave} {
+		s.send(NewSignal(YCKCallSignalTypeAccept, uid, SessionManagerUserId, sid))
+	}
+	if session.Participant(bob).Restrict != 0 || session.Participant(carol).Restrict != subscriberRestrict {
+		t.Fatalf("restricts bob %d carol %d", session.Participant(bob).Restrict, session.Participant(carol).Restrict)
+	}
+
+	publish := func(by int64, op string, uids ...int64) {
+		signal := NewSignal(YCKCallSignalTypeMemberOp, by, SessionManagerUserId, sid)
+		signal.Info = members(op, uids...)
+		s.deliver(signal)
+	}
+	//订阅者不能自己上台
+	publish(carol, "publish", carol)
+	if !session.subscriber(carol) {
+		t.Fatal("subscriber published itself")
+	}
+	s.collect()
+	publish(alice, "publish", carol)
+	publish(alice, "unpublish", bob)
+	var control *relay.SessionControl
+	var info map[string]interface{}
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.MsgType {
+		case relay.UdpMessageTypeSessionControl:
+			if control, err = relay.UnmarshalSessionControl(msg.Payload); err != nil {
+				t.Fatal(err)
+			}
+		case relay.UdpMessageTypeUserSignal:
+			signal := NewSignalTemp()
+			if signal.UnmarshalMessage(msg) == nil && signal.Signal == YCKCallSignalTypeMemberState && msg.To == alice {
+				info = signal.Info
+			}
+		}
+	}
+	if session.Participant(carol).Restrict != 0 || session.Participant(bob).Restrict != subscriberRestrict {
+		t.Errorf("restricts bob %d carol %d after publish", session.Participant(bob).Restrict, session.Participant(carol).Restrict)
+	}
+	want := []uint8{0, subscriberRestrict, 0, subscriberRestrict} //alice、bob、carol、dave
+	if control == nil || fmt.Sprint(control.Restricts) != fmt.Sprint(want) {
+		t.Errorf("session control %+v", control)
+	}
+	//MemberState只列发布者
+	states, _ := info["states"].(map[string]interface{})
+	if len(states) != 2 || states[strconv.FormatInt(carol, 10)] == nil || fmt.Sprint(info["subscribers"]) != "2" {
+		t.Errorf("member state %v", info)
+	}
+}
+
+func TestSessionManagerLobby(t *testing.T) {
+	s := newSimulator(t)
+	request := NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0)
+	request.Info = map[string]interface{}{"locked": true}
+	s.send(request)
+	var session *Session
+	for _, created := range s.sm.sessions {
+		session = created
+	}
+	sid := session.Sid
+	has := func(sent []sentSignal, want sentSignal) bool {
+		for _, signal := range sent {
+			if signal == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	//owner自己不用等
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid))
+	if !session.Participant(alice).InState(YCKParticipantStateIncall) {
+		t.Fatal("owner held in lobby")
+	}
+
+	sent := s.send(NewSignal(YCKCallSignalTypeInvite, bob, SessionManagerUserId, sid))
+	if !session.Participant(bob).InState(YCKParticipantStateLobby) {
+		t.Fatalf("bob in state %d", session.Participant(bob).State)
+	}
+	if !has(sent, sentSignal{alice, YCKCallSignalTypeAdmitRequest}) || !has(sent, sentSignal{bob, YCKCallSignalTypeRing}) ||
+		has(sent, sentSignal{bob, YCKCallSignalTypeAccept}) {
+		t.Errorf("sent %v when bob entered the lobby", sent)
+	}
+	s.send(NewSignal(YCKCallSignalTypeInvite, carol, SessionManagerUserId, sid))
+	if strings.Contains(session.RelayControl, strconv.FormatInt(bob, 10)) {
+		t.Errorf("lobby member in relay session %s", session.RelayControl)
+	}
+
+	admit := func(by int64, op string, uids ...int64) []sentSignal {
+		signal := NewSignal(YCKCallSignalTypeMemberOp, by, SessionManagerUserId, sid)
+		signal.Info = members(op, uids...)
+		return s.send(signal)
+	}
+	//只有owner能准入
+	admit(bob, "admit", bob)
+	if !session.Participant(bob).InState(YCKParticipantStateLobby) {
+		t.Fatal("bob admitted himself")
+	}
+	sent = admit(alice, "admit", bob)
+	if !session.Participant(bob).InState(YCKParticipantStateIncall) || !has(sent, sentSignal{bob, YCKCallSignalTypeAccept}) {
+		t.Errorf("bob not admitted: state %d, sent %v", session.Participant(bob).State, sent)
+	}
+	sent = admit(alice, "deny", carol)
+	if p := session.Participant(carol); !p.InState(YCKParticipantStateIdle) || p.EndReason != YCKCallEndReasonDenied || !has(sent, sentSignal{carol, YCKCallSignalTypeEnd}) {
+		t.Errorf("carol not denied: state %d reason %d, sent %v", p.State, p.EndReason, sent)
+	}
+
+	//没人处理的超时
+	s.send(NewSignal(YCKCallSignalTypeInvite, dave, SessionManagerUserId, sid))
+	s.sm.wheel.Advance(time.Now().Add(LobbyTimeout + WheelTick))
+	if p := session.Participant(dave); !p.InState(YCKParticipantStateIdle) || p.EndReason != YCKCallEndReasonDenied {
+		t.Errorf("dave state %d reason %d after lobby timeout", p.State, p.EndReason)
+	}
+}
+
+func TestSessionManagerLock(t *testing.T) {
+	s := newSimulator(t)
+	request := NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0)
+	request.Info = map[string]interface{}{"moderators": []int64{bob}}
+	s.send(request)
+	var session *Session
+	for _, created := range s.sm.sessions {
+		session = created
+	}
+	sid := session.Sid
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", carol)
+	s.send(invite)
+	s.send(NewSignal(YCKCallSignalTypeAccept, carol, SessionManagerUserId, sid))
+	s.send(NewSignal(YCKCallSignalTypeInvite, bob, SessionManagerUserId, sid))
+
+	op := func(by int64, op string, uids ...int64) {
+		signal := NewSignal(YCKCallSignalTypeMemberOp, by, SessionManagerUserId, sid)
+		signal.Info = members(op, uids...)
+		s.send(signal)
+	}
+	op(carol, "lock")
+	if session.Locked {
+		t.Fatal("locked by a member who is not a moderator")
+	}
+	op(bob, "lock")
+	if !session.Locked {
+		t.Fatal("not locked by a moderator")
+	}
+
+	//锁定后只有主持人能邀请
+	op(carol, "invite", dave)
+	if p := session.Participant(dave); p != nil && !p.InState(YCKParticipantStateIdle) {
+		t.Fatal("member invited into a locked session")
+	}
+	op(alice, "invite", dave)
+	if p := session.Participant(dave); p == nil || !p.InState(YCKParticipantStateCalled) {
+		t.Fatal("moderator could not invite into a locked session")
+	}
+
+	//离开后重新加入要进等候室
+	s.send(NewSignal(YCKCallSignalTypeEnd, carol, SessionManagerUserId, sid))
+	s.deliver(NewSignal(YCKCallSignalTypeInvite, carol, SessionManagerUserId, sid))
+	if !session.Participant(carol).InState(YCKParticipantStateLobby) {
+		t.Fatalf("carol rejoined in state %d", session.Participant(carol).State)
+	}
+	var info map[string]interface{}
+	for _, p := range s.transport.Sent() {
+		msg, _ := relay.NewMessageFromObfuscatedData(p.Data)
+		signal := NewSignalTemp()
+		if signal.UnmarshalMessage(msg) == nil && signal.Signal == YCKCallSignalTypeMemberState && msg.To == alice {
+			info = signal.Info
+		}
+	}
+	states, _ := info["states"].(map[string]interface{})
+	bobState, _ := states[strconv.FormatInt(bob, 10)].(map[string]interface{})
+	if fmt.Sprint(info["locked"]) != "1" || fmt.Sprint(bobState["moderator"]) != "1" {
+		t.Errorf("member state %v", info)
+	}
+
+	//解锁时等候室里的人都准入
+	op(bob, "unlock")
+	if session.Locked || !session.Participant(carol).InState(YCKParticipantStateIncall) {
+		t.Errorf("locked %v, carol in state %d after unlock", session.Locked, session.Participant(carol).State)
+	}
+}
+
+func TestSessionManagerBreakout(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", bob, carol, dave)
+	s.send(invite)
+	for _, uid := range []int64{bob, carol, dave} {
+		s.send(NewSignal(YCKCallSignalTypeAccept, uid, SessionManagerUserId, sid))
+	}
+
+	breakout := func(by int64, room string, uids ...int64) {
+		signal := NewSignal(YCKCallSignalTypeMemberOp, by, SessionManagerUserId, sid)
+		signal.Info = members("breakout", uids...)
+		signal.Info["room"] = room
+		s.deliver(signal)
+	}
+	breakout(alice, "design", bob, carol)
+	var control *relay.SessionControl
+	var moved *Signal
+	var states, rooms interface{}
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.MsgType {
+		case relay.UdpMessageTypeSessionControl:
+			if control, err = relay.UnmarshalSessionControl(msg.Payload); err != nil {
+				t.Fatal(err)
+			}
+		case relay.UdpMessageTypeUserSignal:
+			signal := NewSignalTemp()
+			if signal.UnmarshalMessage(msg) != nil {
+				continue
+			}
+			if signal.Signal == YCKCallSignalTypeBreakout && msg.To == carol {
+				moved = signal
+			}
+			if signal.Signal == YCKCallSignalTypeMemberState && msg.To == dave {
+				states, rooms = signal.Info["states"], signal.Info["rooms"]
+			}
+		}
+	}
+	if moved == nil || moved.Info["room"] != "design" || fmt.Sprint(moved.Info["room_id"]) != "1" || fmt.Sprint(moved.Info["members"]) != "[1002 1003]" {
+		t.Fatalf("breakout signal to carol %+v", moved)
+	}
+	if control == nil || fmt.Sprint(control.Rooms) != fmt.Sprint([]uint8{0, 1, 1, 0}) {
+		t.Fatalf("session control %+v", control)
+	}
+	all, _ := states.(map[string]interface{})
+	bobState, _ := all[strconv.FormatInt(bob, 10)].(map[string]interface{})
+	if fmt.Sprint(bobState["room"]) != "1" || fmt.Sprint(rooms) != "[design]" {
+		t.Errorf("member state %v rooms %v", states, rooms)
+	}
+	if got := s.sm.sessions[sid].Topology; got != TopologySfu {
+		t.Errorf("topology %q in breakout", got)
+	}
+
+	//房间号不变，回到主会场后再移入同一房间
+	breakout(alice, "review", dave)
+	breakout(alice, "", bob)
+	s.collect()
+	session := s.sm.sessions[sid]
+	if session.Participant(bob).Room != 0 || session.Participant(dave).Room != 2 {
+		t.Errorf("rooms of bob %d dave %d", session.Participant(bob).Room, session.Participant(dave).Room)
+	}
+	breakout(alice, "design", bob)
+	s.collect()
+	if session.Participant(bob).Room != 1 {
+		t.Errorf("bob moved to room %d, want 1", session.Participant(bob).Room)
+	}
+
+	//离开通话即回到主会场
+	s.send(NewSignal(YCKCallSignalTypeEnd, dave, SessionManagerUserId, sid))
+	if session.Participant(dave).Room != 0 {
+		t.Errorf("dave still in room %d after leaving", session.Participant(dave).Room)
+	}
+}
+
+func TestSessionManagerRelaySwitch(t *testing.T) {
+	s := newSimulator(t)
+	const old, next = "127.0.0.1:19001", "127.0.0.1:19002"
+	s.sm.relays = []string{old, next}
+	sid := s.createSession(alice)
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+	invite.Info = map[string]interface{}{"relays": []interface{}{old}}
+	s.send(invite)
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, alice, sid))
+
+	now := time.Now()
+	s.sm.relayAcks[old] = now
+	s.sm.relayAcks[next] = now
+	s.sm.checkSessionRelays(now)
+	if s.sm.sessions[sid].Migration != nil {
+		t.Fatal("switched away from a healthy relay")
+	}
+
+	s.sm.relayAcks[old] = now.Add(-10 * relay.ServerRegInterval)
+	s.sm.checkSessionRelays(now)
+	var setupTo []string
+	var switches []*Signal
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.MsgType {
+		case relay.UdpMessageTypeSessionControl:
+			setupTo = append(setupTo, p.Addr.String())
+		case relay.UdpMessageTypeUserSignal:
+			signal := NewSignalTemp()
+			if signal.UnmarshalMessage(msg) == nil && signal.Signal == YCKCallSignalTypeRelaySwitch {
+				switches = append(switches, signal)
+			}
+		}
+	}
+	if !equalStrings(setupTo, []string{next}) {
+		t.Errorf("session setup sent to %v, want the new relay only", setupTo)
+	}
+	if len(switches) != 4 || switches[0].Info["from"] != old || switches[0].Info["to"] != next { //每个信令经两个relay发出
+		t.Fatalf("relay switch signals %v", switches)
+	}
+	if got := s.sm.sessions[sid].Relays; !equalStrings(got, []string{next}) {
+		t.Errorf("session relays %v after switch", got)
+	}
+
+	//两方都确认后才断开旧relay
+	done := func(uid int64) {
+		signal := NewSignal(YCKCallSignalTypeRelaySwitch, uid, SessionManagerUserId, sid)
+		signal.Info = map[string]interface{}{"to": next}
+		s.deliver(signal)
+	}
+	done(alice)
+	if s.sm.sessions[sid].Migration == nil || len(s.sessionControls()) != 0 {
+		t.Fatal("old relay released before every participant switched")
+	}
+	done(bob)
+	if s.sm.sessions[sid].Migration != nil {
+		t.Fatal("switch not finished after every participant confirmed")
+	}
+	var teardownTo []string
+	for _, p := range s.transport.Sent() {
+		msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+		if err == nil && msg.MsgType == relay.UdpMessageTypeSessionControl && msg.Payload[0] == relay.SessionControlTeardown {
+			teardownTo = append(teardownTo, p.Addr.String())
+		}
+	}
+	if !equalStrings(teardownTo, []string{old}) {
+		t.Errorf("teardown sent to %v, want the old relay", teardownTo)
+	}
+}
+
+func TestSessionManagerPresence(t *testing.T) {
+	s := newSimulator(t)
+	webhooks := NewWebhookDispatcher([]string{"http://127.0.0.1:1/hook"}, "")
+	s.sm.publishers = []EventPublisher{webhooks}
+	otherRelay := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 19001}
+	report := func(from *net.UDPAddr, entries ...relay.PresenceEntry) {
+		data := relay.NewMessage(relay.UdpMessageTypePresence, SessionManagerUserId, 0, 0, relay.MarshalPresence(entries), nil).ObfuscatedDataOfMessage()
+		body := utils.GetPacketBuffer(len(data))
+		copy(body, data)
+		s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: from, Time: time.Now().UnixNano()})
+	}
+	report(testRelayAddr, relay.PresenceEntry{Uid: bob, Online: true}, relay.PresenceEntry{Uid: carol, Online: true})
+	report(otherRelay, relay.PresenceEntry{Uid: bob, Online: true})
+	report(testRelayAddr, relay.PresenceEntry{Uid: carol, Online: false}, relay.PresenceEntry{Uid: dave, Online: false})
+
+	if info := s.sm.presenceOf(bob); !info.Online || len(info.Relays) != 2 {
+		t.Errorf("presence of bob %+v", info)
+	}
+	query := NewSignal(YCKCallSignalTypePresence, alice, SessionManagerUserId, 0)
+	query.Info = map[string]interface{}{"uids": []int64{bob, carol, dave}}
+	s.deliver(query)
+	var online []int64
+	for _, p := range s.transport.Sent() {
+		msg, _ := relay.NewMessageFromObfuscatedData(p.Data)
+		reply := NewSignalTemp()
+		if err := reply.UnmarshalMessage(msg); err != nil || reply.Signal != YCKCallSignalTypePresence || msg.To != alice {
+			t.Fatalf("reply %v %v", reply, err)
+		}
+		for _, uid := range reply.Info["online"].([]interface{}) {
+			n, _ := uid.(json.Number).Int64()
+			online = append(online, n)
+		}
+	}
+	if fmt.Sprint(online) != fmt.Sprint([]int64{bob}) {
+		t.Errorf("online %v, want [bob]", online)
+	}
+
+	//一个relay失联后只剩另一个，都过期才离线
+	s.sm.presence[bob][otherRelay.String()] = time.Now().Add(-2 * PresenceTtl)
+	s.sm.expirePresence(time.Now())
+	if info := s.sm.presenceOf(bob); !info.Online || len(info.Relays) != 1 {
+		t.Errorf("presence of bob %+v after a relay expired", info)
+	}
+	s.sm.expirePresence(time.Now().Add(2 * PresenceTtl))
+	if s.sm.presenceOf(bob).Online {
+		t.Error("bob online after all relays expired")
+	}
+
+	var events []string
+	for _, e := range webhookEvents(t, webhooks) {
+		if e.Type == EventPresenceOnline || e.Type == EventPresenceOffline {
+			events = append(events, fmt.Sprint(e.Type, " ", e.Uid))
+		}
+	}
+	want := []string{
+		fmt.Sprint(EventPresenceOnline, " ", bob), fmt.Sprint(EventPresenceOnline, " ", carol),
+		fmt.Sprint(EventPresenceOffline, " ", carol), fmt.Sprint(EventPresenceOffline, " ", bob),
+	}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("presence events %v, want %v", events, want)
+	}
+}
+
+func TestSessionManagerSignalAge(t *testing.T) {
+	s := newSimulator(t)
+	unit := int64(100 * time.Microsecond)
+	sid := s.createSession(alice)
+
+	//在防重放窗口内但超过了SignalMaxAge
+	s.clock -= int64(2*time.Minute) / unit
+	if sent := s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)); len(sent) != 0 {
+		t.Fatalf("stale invite forwarded: %v", sent)
+	}
+	//信令自己的Ttl更短
+	s.clock += int64(2*time.Minute-5*time.Second) / unit
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+	invite.Ttl = 1000
+	if sent := s.send(invite); len(sent) != 0 {
+		t.Fatalf("invite older than its ttl forwarded: %v", sent)
+	}
+	if n := s.sm.signalDrops[SignalDropExpired]; n != 2 {
+		t.Errorf("expired drops %d, want 2", n)
+	}
+
+	//为0时不检查
+	s.sm.signalMaxAge = 0
+	s.clock -= int64(time.Minute) / unit
+	if sent := s.send(NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)); len(sent) != 1 || sent[0].to != bob {
+		t.Errorf("invite not forwarded with age check off: %v", sent)
+	}
+}
+
+func TestSessionManagerDedup(t *testing.T) {
+	for _, key := range []string{DedupKeyPayload, DedupKeyDigest} {
+		s := newSimulator(t)
+		s.sm.dedup = NewSignalDedup(2, key)
+		sid := s.createSession(alice)
+
+		s.clock++
+		invite := NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+		invite.Timestamp = s.clock
+		payload, err := invite.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.deliverPayload(alice, payload)
+		if sent := s.collect(); len(sent) != 1 || sent[0].to != bob {
+			t.Fatalf("%s: invite not forwarded: %v", key, sent)
+		}
+		s.deliverPayload(alice, payload)
+		if sent := s.collect(); len(sent) != 0 {
+			t.Fatalf("%s: duplicate invite forwarded: %v", key, sent)
+		}
+
+		//缓存只有2条，sid请求和第一个invite被挤出
+		s.send(NewSignal(YCKCallSignalTypeInvite, alice, carol, sid))
+		s.send(NewSignal(YCKCallSignalTypeInvite, alice, dave, sid))
+		stats := s.sm.dedup.Stats()
+		if stats.Key != key || stats.Len != 2 || stats.Hits != 1 || stats.Evictions != 2 {
+			t.Errorf("%s: stats %+v", key, stats)
+		}
+	}
+}
+
+func TestSessionManagerSignalSequence(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+
+	//cancel先到，等invite到了以后一起按顺序处理
+	cancel := NewSignal(YCKCallSignalTypeCancel, alice, bob, sid)
+	cancel.Seq = 2
+	if sent := s.send(cancel); len(sent) != 0 {
+		t.Fatalf("cancel handled before invite: %v", sent)
+	}
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+	invite.Seq = 1
+	sent := s.send(invite)
+	want := []sentSignal{{bob, YCKCallSignalTypeInvite}, {bob, YCKCallSignalTypeCancel}, {bob, YCKCallSignalTypeMissedCall}}
+	if fmt.Sprint(sent) != fmt.Sprint(want) {
+		t.Fatalf("sent %v, want %v", sent, want)
+	}
+	//collect按类型排了序，看状态才知道是不是先处理的invite
+	if p := s.sm.sessions[sid].Participant(bob); !p.InState(YCKParticipantStateIdle) {
+		t.Errorf("bob in state %d after invite and cancel", p.State)
+	}
+
+	//已处理过的序号由防重放挡住
+	invite = NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+	invite.Seq = 1
+	if sent := s.send(invite); len(sent) != 0 || s.sm.signalDrops[SignalDropReplayed] != 1 {
+		t.Errorf("replayed invite: sent %v, drops %v", sent, s.sm.signalDrops)
+	}
+
+	//缺的一直不到，超时后跳过
+	invite = NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+	invite.Seq = 4
+	if sent := s.send(invite); len(sent) != 0 {
+		t.Fatalf("invite handled before the gap: %v", sent)
+	}
+	s.sm.wheel.Advance(time.Now().Add(SequenceTimeout + WheelTick))
+	if sent := s.collect(); len(sent) != 1 || sent[0] != (sentSignal{bob, YCKCallSignalTypeInvite}) {
+		t.Errorf("sent %v after the gap timed out", sent)
+	}
+
+	//被跳过的序号之后才到
+	invite = NewSignal(YCKCallSignalTypeInvite, alice, bob, sid)
+	invite.Seq = 3
+	if sent := s.send(invite); len(sent) != 0 || s.sm.signalDrops[SignalDropLate] != 1 {
+		t.Errorf("late invite: sent %v, drops %v", sent, s.sm.signalDrops)
+	}
+}
+
+func TestSignalSequenceWindow(t *testing.T) {
+	q := &signalSequence{next: 1, pending: make(map[uint32]*Signal)}
+	signal := func(seq uint32) *Signal {
+		return &Signal{Seq: seq}
+	}
+	if ready, _ := q.add(signal(3)); len(ready) != 0 {
+		t.Fatalf("ready %v before seq 1", ready)
+	}
+	//超出窗口时不再等1、2
+	ready, late := q.add(signal(3 + SequenceWindow))
+	if late || len(ready) != 2 || ready[0].Seq != 3 || ready[1].Seq != 3+SequenceWindow || q.next != 4+SequenceWindow {
+		t.Fatalf("ready %v late %v next %d", ready, late, q.next)
+	}
+	if _, late := q.add(signal(2)); !late {
+		t.Error("skipped seq not late")
+	}
+}
+
+func TestSessionManagerQualityReport(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", bob)
+	s.send(invite)
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid))
+
+	report := func(entries ...relay.QualityEntry) {
+		data := relay.NewMessage(relay.UdpMessageTypeQualityReport, SessionManagerUserId, sid, 0, relay.MarshalQualityReport(entries), nil).ObfuscatedDataOfMessage()
+		body := utils.GetPacketBuffer(len(data))
+		copy(body, data)
+		s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+	}
+	report(relay.QualityEntry{Uid: bob, Mos: 4.2, Loss: 0.01, Jitter: 12, Rtt: 80}, relay.QualityEntry{Uid: carol, Mos: 3})
+	report(relay.QualityEntry{Uid: bob, Mos: 3.6, Loss: 0.05, Jitter: 30, Rtt: 150})
+
+	q := s.sm.sessions[sid].Participant(bob).Quality
+	if q == nil || q.Mos != 3.6 || q.Loss != 0.05 || q.Jitter != 30 || q.Rtt != 150 || q.Reports != 2 || math.Abs(q.AvgMos-3.9) > 1e-9 {
+		t.Fatalf("quality of bob %+v", q)
+	}
+	info := sessionInfoOf(s.sm.sessions[sid], time.Now())
+	for _, p := range info.Participants {
+		if (p.Uid == bob) != (p.Quality != nil) {
+			t.Errorf("admin info of %d with quality %+v", p.Uid, p.Quality)
+		}
+	}
+
+	for _, leg := range NewCallRecord(s.sm.sessions[sid]).Legs {
+		if leg.Uid == bob && math.Abs(leg.Mos-3.9) > 1e-9 || leg.Uid == alice && leg.Mos != 0 {
+			t.Errorf("cdr leg %+v", leg)
+		}
+	}
+}
+
+func TestSessionManagerSessionStats(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	otherRelay := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 30002}
+
+	report := func(from *net.UDPAddr, stats relay.SessionStats) {
+		data := relay.NewMessage(relay.UdpMessageTypeSessionStats, SessionManagerUserId, sid, 0, relay.MarshalSessionStats(stats), nil).ObfuscatedDataOfMessage()
+		body := utils.GetPacketBuffer(len(data))
+		copy(body, data)
+		s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: from, Time: time.Now().UnixNano()})
+	}
+	report(testRelayAddr, relay.SessionStats{Participants: 2, Packets: 100, Bytes: 10000, Seconds: 30})
+	report(otherRelay, relay.SessionStats{Participants: 1, Packets: 50, Bytes: 4000, Seconds: 8})
+	//累计值，覆盖前一次
+	report(testRelayAddr, relay.SessionStats{Participants: 3, Packets: 300, Bytes: 30000, Seconds: 60})
+
+	r := NewCallRecord(s.sm.sessions[sid])
+	if r.Packets != 350 || r.Bytes != 34000 || len(r.Relays) != 2 {
+		t.Fatalf("cdr %+v", r)
+	}
+	want := []RelayStats{
+		{Relay: testRelayAddr.String(), Participants: 3, Packets: 300, Bytes: 30000, Seconds: 60, Bandwidth: 4000},
+		{Relay: otherRelay.String(), Participants: 1, Packets: 50, Bytes: 4000, Seconds: 8, Bandwidth: 4000},
+	}
+	if want[0].Relay > want[1].Relay {
+		want[0], want[1] = want[1], want[0]
+	}
+	for i, st := range r.Relays {
+		if *st != want[i] {
+			t.Errorf("relay stats %+v, want %+v", st, want[i])
+		}
+	}
+
+	restored := NewSessionSnapshot(s.sm.sessions[sid]).Restore(time.Now())
+	if len(restored.RelayStats) != 2 || restored.RelayStats[otherRelay.String()].Bytes != 4000 {
+		t.Errorf("restored relay stats %+v", restored.RelayStats)
+	}
+}
+
+func TestAlertRules(t *testing.T) {
+	for _, text := range []string{"loss>0.05", "loss>>0.05/1m", "latency>100/1m", "mos<3.5/0s", "mos<x/1m"} {
+		if _, err := ParseAlertRule(text); err == nil {
+			t.Errorf("rule %q accepted", text)
+		}
+	}
+	var rules []*AlertRule
+	for _, text := range []string{"loss > 0.05 / 1m", "setup_failures>2/1m"} {
+		rule, err := ParseAlertRule(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	e := NewAlertEngine(rules)
+	now := time.Now()
+	const good, bad = "10.0.0.1:19001", "10.0.0.2:19001"
+
+	//样本不够时不告警
+	e.Add(AlertMetricLoss, bad, 0.2, now)
+	e.Add(AlertMetricLoss, bad, 0.2, now)
+	e.Add(AlertMetricMos, bad, 1, now) //没有规则用到
+	if changes := e.Evaluate(now); len(changes) != 0 {
+		t.Fatalf("alerts with too few samples %+v", changes)
+	}
+	for i := 0; i < 3; i++ {
+		e.Add(AlertMetricLoss, bad, 0.1, now)
+		e.Add(AlertMetricLoss, good, 0.01, now)
+		e.Add(AlertMetricSetupFailures, bad, 1, now)
+	}
+	changes := e.Evaluate(now.Add(time.Second))
+	if len(changes) != 2 {
+		t.Fatalf("alerts %+v", changes)
+	}
+	for _, c := range changes {
+		if c.Relay != bad || c.Resolved || c.Alert.Rule == rules[0].Text && (c.Alert.Samples != 5 || math.Abs(c.Alert.Value-0.14) > 1e-9) ||
+			c.Alert.Rule == rules[1].Text && c.Alert.Value != 3 {
+			t.Errorf("alert %s of %s: %+v", c.Alert.Rule, c.Relay, c.Alert)
+		}
+	}
+	if changes := e.Evaluate(now.Add(2 * time.Second)); len(changes) != 0 {
+		t.Errorf("alerts repeated %+v", changes)
+	}
+	if len(e.samples[AlertMetricMos]) != 0 {
+		t.Error("samples of an unused metric kept")
+	}
+
+	//样本移出窗口后恢复
+	changes = e.Evaluate(now.Add(2 * time.Minute))
+	if len(changes) != 2 || !changes[0].Resolved || !changes[1].Resolved {
+		t.Errorf("alerts not resolved %+v", changes)
+	}
+	if len(e.samples[AlertMetricLoss]) != 0 || len(e.firing) != 0 {
+		t.Error("expired samples kept")
+	}
+}
+
+func TestSessionManagerSignalNack(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid))
+
+	//带能力位图投递，返回发给发送方的Nack
+	deliver := func(signal *Signal, capabilities uint32) []*Signal {
+		s.clock++
+		signal.Timestamp = s.clock
+		payload, err := signal.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, signal.From, SessionManagerUserId, 0, payload, nil)
+		relay.SetCapabilities(msg, capabilities)
+		data := msg.ObfuscatedDataOfMessage()
+		body := utils.GetPacketBuffer(len(data))
+		copy(body, data)
+		s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+		var nacks []*Signal
+		for _, p := range s.transport.Sent() {
+			msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+			if err != nil || msg.MsgType != relay.UdpMessageTypeUserSignal || msg.To != signal.From {
+				continue
+			}
+			sent := NewSignalTemp()
+			if sent.UnmarshalMessage(msg) == nil && sent.Signal == YCKCallSignalTypeNack {
+				nacks = append(nacks, sent)
+			}
+		}
+		return nacks
+	}
+
+	nacks := deliver(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid), relay.CapabilitySignalNack)
+	if len(nacks) != 1 || nacks[0].SessionId != sid || fmt.Sprint(nacks[0].Info["signal"]) != fmt.Sprint(YCKCallSignalTypeAccept) ||
+		fmt.Sprint(nacks[0].Info["reason"]) != fmt.Sprint(SignalDropState) || fmt.Sprint(nacks[0].Info["ts"]) != fmt.Sprint(s.clock) {
+		t.Errorf("nack of accept without ringing %+v", nacks)
+	}
+	if nacks := deliver(NewSignal(YCKCallSignalTypeEnd, bob, alice, sid), relay.CapabilitySignalNack); len(nacks) != 1 ||
+		fmt.Sprint(nacks[0].Info["reason"]) != fmt.Sprint(SignalDropModeMismatch) {
+		t.Errorf("nack of 1-1 signal in multi-party session %+v", nacks)
+	}
+	if nacks := deliver(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, 0), 0); len(nacks) != 0 {
+		t.Errorf("nack sent to a client without the capability %+v", nacks)
+	}
+	deliver(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid+1), relay.CapabilitySignalNack)
+
+	want := map[string]int64{"state": 1, "mode_mismatch": 1, "no_sid": 1, "no_session": 1}
+	if got := s.sm.signalDropCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("signal drops %v, want %v", got, want)
+	}
+}
+
+func TestSessionManagerMemberOpResult(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	s.send(NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid))
+
+	op := func(info map[string]interface{}, opId string) ([]sentSignal, []interface{}) {
+		signal := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+		signal.Info = info
+		signal.Info["op_id"] = opId
+		s.deliver(signal)
+		var sent []sentSignal
+		var results []interface{}
+		for _, p := range s.transport.Sent() {
+			msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+			if err != nil || msg.MsgType != relay.UdpMessageTypeUserSignal {
+				continue
+			}
+			signal := NewSignalTemp()
+			if signal.UnmarshalMessage(msg) != nil {
+				continue
+			}
+			sent = append(sent, sentSignal{to: msg.To, signal: signal.Signal})
+			if signal.Signal == YCKCallSignalTypeMemberOpResult && msg.To == alice && signal.Info["op_id"] == opId {
+				results, _ = signal.Info["results"].([]interface{})
+			}
+		}
+		return sent, results
+	}
+	resultOf := func(results []interface{}) string {
+		var out []string
+		for _, r := range results {
+			m := r.(map[string]interface{})
+			out = append(out, fmt.Sprint(m["member"], ":", m["result"], ":", m["reason"]))
+		}
+		return strings.Join(out, ",")
+	}
+
+	sent, results := op(members("invite", bob, carol), "op1")
+	if got := resultOf(results); got != "1002:invited:<nil>,1003:invited:<nil>" {
+		t.Errorf("invite results %s", got)
+	}
+	invites := func(sent []sentSignal) int {
+		n := 0
+		for _, p := range sent {
+			if p.signal == YCKCallSignalTypeInvite {
+				n++
+			}
+		}
+		return n
+	}
+	if invites(sent) != 2 {
+		t.Errorf("sent %v", sent)
+	}
+
+	//重发同一op_id不再邀请，只重发结果
+	sent, results = op(members("invite", bob, carol), "op1")
+	if got := resultOf(results); got != "1002:invited:<nil>,1003:invited:<nil>" || invites(sent) != 0 {
+		t.Errorf("resent op: results %s, sent %v", got, sent)
+	}
+
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid))
+	if _, results = op(members("invite", bob), "op2"); resultOf(results) != "1002:skipped:not_idle" {
+		t.Errorf("invite of a member in call: %s", resultOf(results))
+	}
+	if _, results = op(members("kick", bob, dave), "op3"); resultOf(results) != "1002:kicked:<nil>,1004:skipped:not_in_call" {
+		t.Errorf("kick results %s", resultOf(results))
+	}
+	if _, results = op(members("kick", bob), ""); results != nil {
+		t.Error("result sent for member_op without op_id")
+	}
+}
+
+func TestSessionManagerBulkMemberOp(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+	invite := NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", bob)
+	s.send(invite)
+	s.send(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid))
+
+	bulk := func(ops ...map[string]interface{}) (map[int64]int, string) {
+		list := make([]interface{}, len(ops))
+		for i, op := range ops {
+			list[i] = op
+		}
+		signal := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+		signal.Info = map[string]interface{}{"op": "bulk", "ops": list}
+		s.deliver(signal)
+		states := make(map[int64]int)
+		var results []string
+		for _, p := range s.transport.Sent() {
+			msg, err := relay.NewMessageFromObfuscatedData(p.Data)
+			if err != nil || msg.MsgType != relay.UdpMessageTypeUserSignal {
+				continue
+			}
+			sent := NewSignalTemp()
+			if sent.UnmarshalMessage(msg) != nil {
+				continue
+			}
+			switch sent.Signal {
+			case YCKCallSignalTypeMemberState:
+				states[msg.To]++
+			case YCKCallSignalTypeMemberOpResult:
+				list, _ := sent.Info["results"].([]interface{})
+				for _, r := range list {
+					m := r.(map[string]interface{})
+					results = append(results, fmt.Sprint(m["member"], ":", m["result"], ":", m["reason"]))
+				}
+			}
+		}
+		return states, strings.Join(results, ",")
+	}
+	op := func(op string, uid int64) map[string]interface{} {
+		return map[string]interface{}{"op": op, "member": uid}
+	}
+
+	states, results := bulk(op("invite", carol), op("mute", bob))
+	if results != "1003:invited:<nil>,1002:permitted:<nil>" {
+		t.Errorf("bulk results %s", results)
+	}
+	if len(states) != 3 || states[alice] != 1 || states[bob] != 1 || states[carol] != 1 {
+		t.Errorf("member states sent %v, want one to each member", states)
+	}
+	if s.sm.sessions[sid].Participant(bob).Restrict != relay.MemberNoSendAudio {
+		t.Error("bob not muted")
+	}
+
+	//有一项不行就都不执行
+	_, results = bulk(op("kick", bob), op("invite", carol), op("dance", dave))
+	if results != "1002:skipped:aborted,1003:skipped:not_idle,1004:skipped:unknown_op" {
+		t.Errorf("aborted bulk results %s", results)
+	}
+	if !s.sm.sessions[sid].Participant(bob).InState(YCKParticipantStateIncall) {
+		t.Fatal("bob kicked by an aborted bulk op")
+	}
+	_, results = bulk(op("kick", bob), op("unmute", bob))
+	if results != "1002:skipped:aborted,1002:skipped:duplicate" {
+		t.Errorf("duplicate member results %s", results)
+	}
+
+	_, results = bulk(op("kick", bob), op("permit", carol))
+	if results != "1002:kicked:<nil>,1003:permitted:<nil>" || !s.sm.sessions[sid].Participant(bob).InState(YCKParticipantStateIdle) {
+		t.Errorf("kick results %s", results)
+	}
+}
+
+func TestSessionManagerParticipantMeta(t *testing.T) {
+	s := newSimulator(t)
+	sid := s.createSession(alice)
+
+	//relay附带发送方注册时上报的设备和网络类型
+	deliver := func(signal *Signal, n *relay.NetworkInfo) {
+		s.clock++
+		signal.Timestamp = s.clock
+		payload, err := signal.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, signal.From, SessionManagerUserId, 0, payload, nil)
+		if n != nil {
+			relay.SetNetwork(msg, *n)
+		}
+		data := msg.ObfuscatedDataOfMessage()
+		body := utils.GetPacketBuffer(len(data))
+		copy(body, data)
+		s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+	}
+
+	deliver(NewSignal(YCKCallSignalTypeInvite, alice, SessionManagerUserId, sid), &relay.NetworkInfo{DeviceType: relay.DeviceTypePhone, NetworkType: relay.NetworkTypeCellular})
+	invite := NewSignal(YCKCallSignalTypeMemberOp, alice, SessionManagerUserId, sid)
+	invite.Info = members("invite", bob, carol)
+	deliver(invite, nil)
+	deliver(NewSignal(YCKCallSignalTypeAccept, bob, SessionManagerUserId, sid), &relay.NetworkInfo{DeviceType: relay.DeviceTypeDesktop, NetworkType: relay.NetworkTypeWifi})
+
+	state := s.lastSent(alice, YCKCallSignalTypeMemberState)
+	if state == nil {
+		t.Fatal("no member state sent")
+	}
+	meta, _ := state.Info["meta"].(map[string]interface{})
+	session := s.sm.sessions[sid]
+	for uid, want := range map[int64]string{alice: "phone/cellular", bob: "desktop/wifi"} {
+		m, _ := meta[fmt.Sprint(uid)].(map[string]interface{})
+		joinedAt := session.Participant(uid).JoinTime.UnixNano() / 1e6
+		if got := fmt.Sprint(m["device"], "/", m["network"]); got != want || fmt.Sprint(m["joined_at"]) != fmt.Sprint(joinedAt) {
+			t.Errorf("meta of %d %v, want %s joined at %d", uid, m, want, joinedAt)
+		}
+	}
+	if _, ok := meta[fmt.Sprint(carol)]; ok {
+		t.Errorf("meta of ringing participant without registration info %v", meta)
+	}
+	if p := session.Participant(bob); p.DeviceType != relay.DeviceTypeDesktop || p.NetworkType != relay.NetworkTypeWifi {
+		t.Errorf("participant network %d/%d", p.DeviceType, p.NetworkType)
+	}
+}
+
+func TestSessionManagerPushTokens(t *testing.T) {
+	s := newSimulator(t)
+	store := relay.NewMemoryStore()
+	s.sm.pushTokens = NewPushTokens(store, time.Hour)
+
+	register := func(device string, info map[string]interface{}) *Signal {
+		reg := NewSignal(YCKCallSignalTypeVoipTokenReg, alice, SessionManagerUserId, 0)
+		reg.Info = info
+		s.deliverFromDevice(reg, device)
+		return s.lastSent(alice, YCKCallSignalTypeVoipTokenAck)
+	}
+	tokens := func() string {
+		var out []string
+		for _, token := range s.sm.pushTokens.Lookup(alice, time.Now()) {
+			out = append(out, token.Device+":"+token.Token)
+		}
+		return strings.Join(out, ",")
+	}
+
+	//客户端要求的ttl超过配置时按配置的过期
+	ack := register("phone", map[string]interface{}{"token": "t1", "platform": "ios", "ttl": 7200})
+	if ack == nil || ack.Info["token"] != "t1" {
+		t.Fatalf("voip token ack %+v", ack)
+	}
+	n, _ := ack.Info["expires"].(json.Number)
+	if expires, _ := n.Int64(); math.Abs(float64(expires-time.Now().Add(time.Hour).Unix())) > 5 {
+		t.Errorf("token expires at %d", expires)
+	}
+	register("pad", map[string]interface{}{"token": "t2", "platform": "ios"})
+	register("phone", map[string]interface{}{"token": "t3", "platform": "ios", "ttl": 60})
+	if got := tokens(); got != "phone:t3,pad:t2" {
+		t.Errorf("tokens after refresh %s", got)
+	}
+	if stored, _ := store.GetPushTokens(alice); len(stored) != 2 {
+		t.Errorf("tokens in store %v", stored)
+	}
+
+	//另一个实例从存储里查到
+	if got := NewPushTokens(store, time.Hour).Lookup(alice, time.Now()); len(got) != 2 || got[0].Token != "t3" {
+		t.Errorf("tokens from store %v", got)
+	}
+	if got := s.sm.pushTokens.Lookup(alice, time.Now().Add(2*time.Minute)); len(got) != 1 || got[0].Token != "t2" {
+		t.Errorf("tokens after expiry %v", got)
+	}
+
+	register("pad", map[string]interface{}{"token": "t2", "platform": "ios", "unregister": true})
+	if got := tokens(); got != "" {
+		t.Errorf("tokens after unregister %s", got)
+	}
+	if ack := register("pad", map[string]interface{}{"platform": "ios"}); ack != nil {
+		t.Errorf("ack of registration without token %+v", ack)
+	}
+}
+
+func TestSessionManagerPathMtu(t *testing.T) {
+	s := newSimulator(t)
+	if got := s.sm.datagramLimit(alice); got != relay.DefaultMaxDatagram {
+		t.Errorf("limit without probe %d", got)
+	}
+
+	//relay附带的路径MTU比max_datagram小时按路径MTU
+	signal := NewSignal(YCKCallSignalTypeSidRequest, alice, SessionManagerUserId, 0)
+	signal.Timestamp = s.clock + 1
+	payload, err := signal.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, alice, SessionManagerUserId, 0, payload, nil)
+	relay.SetMtu(msg, 1280)
+	data := msg.ObfuscatedDataOfMessage()
+	body := utils.GetPacketBuffer(len(data))
+	copy(body, data)
+	s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+	if got := s.sm.datagramLimit(alice); got != 1280 {
+		t.Errorf("limit with path mtu %d", got)
+	}
+
+	//超过max_datagram的包不处理
+	big := relay.NewMessage(relay.UdpMessageTypeUserSignal, bob, SessionManagerUserId, 0, make([]byte, relay.DefaultMaxDatagram), nil)
+	data = big.ObfuscatedDataOfMessage()
+	body = utils.GetPacketBuffer(len(data))
+	copy(body, data)
+	s.sm.handlePacket(&relay.ReceivedPacket{Body: body, FromUdpAddr: testRelayAddr, Time: time.Now().UnixNano()})
+	if got := s.sm.signalDropCounts(); len(got) != 0 {
+		t.Errorf("oversized packet handled, drops %v", got)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"net"
+	"sort"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+session的转发统计：各relay每个定时器周期上报session在它上面的累计转发量（见relay/session_stats.go）。
+1. Session.RelayStats按relay地址保留最近一次上报，报的是累计值，直接覆盖，丢了一次没有关系
+2. session结束时写进CDR：relays为每个relay服务的参与者数、转发的包数和字节、转发的秒数和平均带宽，
+   packets和bytes为各relay之和；同一参与者在几个relay上都有转发时每个relay各算一次
+3. 最后一次上报之后到session结束之间的转发不在CDR里，最多差一个relay的定时器周期
+*/
+
+type RelayStats struct {
+	Relay        string `json:"relay"`
+	Participants int    `json:"participants"`
+	Packets      int64  `json:"packets"`
+	Bytes        int64  `json:"bytes"`
+	Seconds      int    `json:"seconds"`
+	Bandwidth    int64  `json:"bandwidth_bps"` //平均带宽
+}
+
+func (sm *SessionManager) handleSessionStats(msg *relay.Message, addr *net.UDPAddr) {
+	stats, ok := relay.UnmarshalSessionStats(msg.Payload)
+	if !ok || addr == nil {
+		sm.log().Warn("incorrect session stats for session ", msg.To, " from ", addr)
+		return
+	}
+	session := sm.sessions[msg.To]
+	if session == nil {
+		return
+	}
+	if session.RelayStats == nil {
+		session.RelayStats = make(map[string]*RelayStats)
+	}
+	session.RelayStats[addr.String()] = &RelayStats{
+		Relay:        addr.String(),
+		Participants: stats.Participants,
+		Packets:      stats.Packets,
+		Bytes:        stats.Bytes,
+		Seconds:      stats.Seconds,
+		Bandwidth:    stats.Bandwidth(),
+	}
+}
+
+//按relay地址排序
+func (s *Session) relayStats() []*RelayStats {
+	stats := make([]*RelayStats, 0, len(s.RelayStats))
+	for _, st := range s.RelayStats {
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Relay < stats[j].Relay })
+	return stats
+}
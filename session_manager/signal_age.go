@@ -0,0 +1,48 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+信令的时效：防重放的时间窗口（relay.ReplayWindow）为了兼顾手机的时钟误差有10分钟，网络延迟或经别的relay迟到的
+重复信令（如通话已经结束后才到的Invite）在窗口内仍会被处理，造成幽灵响铃。
+1. 信令的年龄为收到时的时间减信令的Timestamp。客户端按relay的时钟校正时间戳（见relay/clock.go），
+   所以收到时的时间也按信令到达的relay的时钟偏差（见clock.go）校正
+2. 上限为config.SignalMaxAge，信令自己带了更短的Ttl（毫秒）时以Ttl为准，老客户端不带Ttl时只看SignalMaxAge
+3. 超过的丢弃，原因为SignalDropExpired，计入metrics事件的signal_drops
+SignalMaxAge为0时不检查。没有校正时钟的老客户端时钟慢了超过上限时信令都会被丢弃，有这种客户端时调大或设为0。
+*/
+
+const DefaultSignalMaxAge = 60 //秒
+
+//超过时效返回false
+func (sm *SessionManager) checkSignalAge(signal *Signal, now time.Time) bool {
+	if sm.signalMaxAge <= 0 {
+		return true
+	}
+	maxAge := sm.signalMaxAge
+	if ttl := time.Duration(signal.Ttl) * time.Millisecond; ttl > 0 && ttl < maxAge {
+		maxAge = ttl
+	}
+	if value, ok := sm.ingress.Get(signal.From); ok {
+		if skew, ok := sm.relayClockSkew(value.(string)); ok {
+			now = now.Add(skew)
+		}
+	}
+	age := now.Sub(relay.SignalTime(signal.Timestamp))
+	if age <= maxAge {
+		return true
+	}
+	sm.log().Warn("drop expired signal ", signal.Signal, " from ", signal.From, " in session ", signal.SessionId, " age ", age.Round(time.Millisecond), " over ", maxAge)
+	return false
+}
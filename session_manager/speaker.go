@@ -0,0 +1,45 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/json"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+relay检测到主讲人变化时发ActiveSpeaker给session manager，
+一个session可能同时走多个relay，所以这里只在主讲人确实变化时才通知参与者。
+*/
+
+func (sm *SessionManager) handleActiveSpeaker(signal *Signal, session *Session) {
+	number, ok := signal.Info["speaker"].(json.Number)
+	if !ok {
+		sm.log().Warn("active speaker signal without speaker for session ", session.Sid)
+		return
+	}
+	speaker, err := number.Int64()
+	if err != nil {
+		sm.log().Warn("active speaker signal with incorrect speaker ", number, " for session ", session.Sid)
+		return
+	}
+	if session.Participants[speaker] == nil || session.ActiveSpeaker == speaker {
+		return
+	}
+	session.ActiveSpeaker = speaker
+
+	for _, p := range session.Participants {
+		if p.InState(YCKParticipantStateIncall) && sm.supports(p.Uid, relay.CapabilityAudioLevel) {
+			notify := NewSignal(YCKCallSignalTypeActiveSpeaker, SessionManagerUserId, p.Uid, session.Sid)
+			notify.Info = make(map[string]interface{})
+			notify.Info["speaker"] = speaker
+			sm.sendSignal(notify, false)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+/*
+relay列表和用户路由放到可替换的存储里（见relay/storage.go），多个session manager可以共享：
+1. relay列表：存储里有就用存储里的，覆盖config.Relays和内置列表；每个housekeeping周期重新读一次，运维改了存储不用重启
+2. 用户路由：uid的信令换了经过的relay时写入存储；本地缓存里没有的uid（重启后、或信令到了别的实例）从存储里查
+存储可能是网络调用，只在变化或本地缓存未命中时访问，查到的结果也放进本地缓存
+*/
+
+func (sm *SessionManager) loadRelays() {
+	if sm.store == nil {
+		return
+	}
+	relays, err := sm.store.GetRelays()
+	if err != nil {
+		sm.log().Warn("load relays from store error:", err)
+		return
+	}
+	if len(relays) > 0 && !equalRelays(relays, sm.relays) {
+		sm.log().Info("relays from store:", relays)
+		sm.relays = relays
+	}
+}
+
+func equalRelays(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (sm *SessionManager) saveUserRelay(uid int64, relayAddr string) {
+	if sm.store == nil {
+		return
+	}
+	if err := sm.store.SetUserRelay(uid, relayAddr); err != nil {
+		sm.log().Warn("save user relay to store error:", err)
+	}
+}
+
+//uid的信令最近经过的relay，不知道时返回""
+func (sm *SessionManager) relayOf(uid int64) string {
+	if value, ok := sm.ingress.Get(uid); ok {
+		return value.(string)
+	}
+	if sm.store == nil {
+		return ""
+	}
+	relayAddr, err := sm.store.GetUserRelay(uid)
+	if err != nil {
+		sm.log().Warn("load user relay from store error:", err)
+		return ""
+	}
+	if relayAddr != "" {
+		sm.ingress.Add(uid, relayAddr)
+	}
+	return relayAddr
+}
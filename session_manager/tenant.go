@@ -0,0 +1,140 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+多租户的session manager部分，uid和sid里的租户见relay/tenant.go。
+1. 请求sid时按请求方的租户生成sid，访客uid也放在所属session的租户里
+2. 信令的发送方、接收方和sid必须同属一个租户，否则丢弃；多方邀请其他租户的uid时跳过
+3. 每个租户可以单独配置同时通话数上限和可用的relay，没有配置的租户用全局配置；
+   租户的relay也要出现在全局的relay列表里，session manager只向全局列表注册和探测
+4. 指标事件里按租户统计session和通话人数
+5. 每个租户可以配置计费周期的用量配额，见quota.go
+*/
+
+type TenantConfig struct {
+	MaxCallsPerUser int      `toml:"max_calls_per_user"` //-1为沿用全局配置
+	Relays          []string `toml:"relays"`             //为空时用全局的relay列表
+	QuotaSeconds    int64    `toml:"quota_seconds"`      //租户所有uid每个计费周期合计的通话秒数上限，0为不限制，见quota.go
+	QuotaBytes      int64    `toml:"quota_bytes"`        //租户所有uid每个计费周期合计的relay转发字节上限，0为不限制
+}
+
+type TenantMetrics struct {
+	Sessions int `json:"sessions"`
+	InCall   int `json:"in_call"`
+}
+
+func (c *Config) tenant(id uint16) *TenantConfig {
+	t := c.Tenants[id]
+	if t == nil {
+		t = &TenantConfig{MaxCallsPerUser: -1}
+		c.Tenants[id] = t
+	}
+	return t
+}
+
+//解析tenant_max_calls和tenant_relays命令行参数，格式为tenant=n和tenant=addr，格式不对的忽略
+func (c *Config) SetTenantFlags(maxCalls []string, relays []string) {
+	for _, s := range maxCalls {
+		id, value, ok := parseTenantFlag(s)
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err == nil {
+			c.tenant(id).MaxCallsPerUser = n
+		}
+	}
+	for _, s := range relays {
+		if id, value, ok := parseTenantFlag(s); ok {
+			c.tenant(id).Relays = append(c.tenant(id).Relays, value)
+		}
+	}
+}
+
+func parseTenantFlag(s string) (uint16, string, bool) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return 0, "", false
+	}
+	id, err := strconv.ParseUint(s[:i], 10, 16)
+	if err != nil || id > relay.MaxTenant {
+		return 0, "", false
+	}
+	return uint16(id), s[i+1:], true
+}
+
+//uid所在租户的同时通话数上限
+func (sm *SessionManager) callLimit(uid int64) int {
+	if t := sm.tenants[relay.TenantOf(uid)]; t != nil && t.MaxCallsPerUser >= 0 {
+		return t.MaxCallsPerUser
+	}
+	return sm.maxCallsPerUser
+}
+
+//从relays中挑出uid所在租户可用的，租户的relay都不在其中时直接用租户配置的
+func (sm *SessionManager) tenantRelays(uid int64, relays []string) []string {
+	t := sm.tenants[relay.TenantOf(uid)]
+	if t == nil || len(t.Relays) == 0 {
+		return relays
+	}
+	result := make([]string, 0, len(t.Relays))
+	for _, addr := range relays {
+		for _, r := range t.Relays {
+			if addr == r {
+				result = append(result, addr)
+				break
+			}
+		}
+	}
+	if len(result) == 0 {
+		return t.Relays
+	}
+	return result
+}
+
+//发送方、接收方和sid不在同一租户的信令丢弃，系统id不受限制
+func (sm *SessionManager) checkTenant(signal *Signal) bool {
+	if signal.From < 0 {
+		return true
+	}
+	tenant := relay.TenantOf(signal.From)
+	if signal.SessionId != 0 && relay.TenantOf(signal.SessionId) != tenant {
+		sm.log().Warn("drop signal ", signal.Signal, " from ", signal.From, " of tenant ", tenant, " for session ", signal.SessionId, " of tenant ", relay.TenantOf(signal.SessionId))
+		return false
+	}
+	if signal.To > 0 && relay.TenantOf(signal.To) != tenant {
+		sm.log().Warn("drop signal ", signal.Signal, " from ", signal.From, " of tenant ", tenant, " to ", signal.To, " of tenant ", relay.TenantOf(signal.To))
+		return false
+	}
+	return true
+}
+
+func (sm *SessionManager) tenantMetrics() map[uint16]*TenantMetrics {
+	tenants := make(map[uint16]*TenantMetrics)
+	for sid, session := range sm.sessions {
+		t := tenants[relay.TenantOf(sid)]
+		if t == nil {
+			t = &TenantMetrics{}
+			tenants[relay.TenantOf(sid)] = t
+		}
+		t.Sessions++
+		for _, p := range session.Participants {
+			if p.InState(YCKParticipantStateIncall) {
+				t.InCall++
+			}
+		}
+	}
+	return tenants
+}
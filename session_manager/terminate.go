@@ -0,0 +1,47 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+强制结束session，用于滥用处理等：
+1. 入口是管理接口POST /sessions/kill?sid=x&note=y，或config的admin_uids里的uid（如内容审核的后台账号）
+   发给session manager的terminate信令，Info可带note
+2. 给session里还没结束的参与者发End，reason为YCKCallEndReasonAdmin；session已经在relay上setup过的，
+   通知relay拆除转发状态（teardown，见session_control.go）；写CDR、发session结束事件后删除session，和其他结束方式一样
+3. 记入审计日志session.kill，操作者为管理接口的X-Ycng-Operator或"uid:x"，detail为note
+不在admin_uids里的uid发的terminate信令按SignalDropForbidden丢弃。
+*/
+
+//结束session并记入审计日志，session不存在时返回false
+func (sm *SessionManager) killSession(sid int64, operator string, note string) bool {
+	session := sm.sessions[sid]
+	if session == nil {
+		return false
+	}
+	sm.removeSession(session, YCKCallEndReasonAdmin)
+	sm.log().Info(operator, " terminated session ", sid, " note:", note)
+	sm.audit.Record(operator, relay.AuditSessionKill, strconv.FormatInt(sid, 10), note)
+	return true
+}
+
+func (sm *SessionManager) handleTerminate(signal *Signal, session *Session) {
+	if signal.To != SessionManagerUserId || !sm.adminUids[signal.From] {
+		sm.log().Warn("drop terminate of session ", session.Sid, " from ", signal.From, " not in admin_uids")
+		sm.dropSignal(signal, SignalDropForbidden)
+		return
+	}
+	note, _ := signal.Info["note"].(string)
+	sm.killSession(session.Sid, fmt.Sprintf("uid:%d", signal.From), note)
+}
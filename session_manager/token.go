@@ -7,18 +7,159 @@
 
 package session_manager
 
-type PushToken struct {
-    UserId      int64
-    Token       string
-    Platform    string
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+推送token登记：呼叫不在线的用户时要用推送唤醒，不需要每次呼叫都去问外部服务。
+1. 客户端发VoipTokenReg，Info带token和platform，可带ttl（秒）；每台设备（信令的device）一个token，同一设备重新登记即替换，
+   每个uid最多MaxPushTokens个，超出时去掉最久没有登记的。Info带unregister为true时注销这个token
+2. 登记后回VoipTokenAck，Info带token和expires（unix秒，0为不过期）。token在expires之前没有再登记就过期，
+   过期时间为ttl和config的push_token_ttl中较小的，客户端应在过期前重新登记（刷新）
+3. 配置了store（见store.go）时token写入存储，重启或多个session manager实例都能查到；没有配置时存在进程内。本地缓存未命中时才读存储
+4. 推送在单独的goroutine里做，所以登记表自带锁。APNs回复token已失效时注销这个token
+*/
+
+const MaxPushTokens = 5
+
+type PushTokens struct {
+	lock  sync.Mutex
+	store relay.Store
+	ttl   time.Duration //0为不过期
+	cache utils.Cache   //uid -> []*relay.PushToken，过期的token在读时去掉
+}
+
+//store为nil时只存在进程内
+func NewPushTokens(store relay.Store, ttl time.Duration) *PushTokens {
+	if store == nil {
+		store = relay.NewMemoryStore()
+	}
+	return &PushTokens{
+		store: store,
+		ttl:   ttl,
+		cache: utils.NewLRUWithTTL(100000, 24*time.Hour, nil),
+	}
+}
+
+//登记或刷新token，ttl为0时用默认的过期时间，返回登记后的token
+func (pt *PushTokens) Register(uid int64, token string, platform string, device string, ttl time.Duration, now time.Time) *relay.PushToken {
+	if pt.ttl > 0 && (ttl <= 0 || ttl > pt.ttl) {
+		ttl = pt.ttl
+	}
+	t := &relay.PushToken{Token: token, Platform: platform, Device: device}
+	if ttl > 0 {
+		t.Expires = now.Add(ttl)
+	}
+
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	tokens := []*relay.PushToken{t}
+	for _, old := range pt.load(uid, now) {
+		if old.Token != token && (device == "" || old.Device != device) && len(tokens) < MaxPushTokens {
+			tokens = append(tokens, old)
+		}
+	}
+	pt.save(uid, tokens)
+	return t
+}
+
+//注销token，返回是否登记过
+func (pt *PushTokens) Unregister(uid int64, token string, now time.Time) bool {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	tokens := pt.load(uid, now)
+	kept := make([]*relay.PushToken, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Token != token {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == len(tokens) {
+		return false
+	}
+	pt.save(uid, kept)
+	return true
 }
 
-func NewPushToken(uid int64, token string, platform string) *PushToken {
-	pt := &PushToken{
-		UserId: uid,
-		Token: token,
-		Platform: platform,
+//uid没有过期的token，最近登记的在前
+func (pt *PushTokens) Lookup(uid int64, now time.Time) []*relay.PushToken {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	return pt.load(uid, now)
+}
+
+//调用方需持有锁。有过期的token时顺便从存储里去掉
+func (pt *PushTokens) load(uid int64, now time.Time) []*relay.PushToken {
+	var tokens []*relay.PushToken
+	if value, ok := pt.cache.Get(uid); ok {
+		tokens = value.([]*relay.PushToken)
+	} else {
+		stored, err := pt.store.GetPushTokens(uid)
+		if err != nil {
+			logging.Logger.Warn("load push tokens of ", uid, " from store error:", err)
+			return nil
+		}
+		tokens = stored
+		pt.cache.Add(uid, tokens)
+	}
+	valid := make([]*relay.PushToken, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Expires.IsZero() || now.Before(t.Expires) {
+			valid = append(valid, t)
+		}
 	}
+	if len(valid) != len(tokens) {
+		logging.Logger.Info("push tokens of ", uid, " expired:", len(tokens)-len(valid))
+		pt.save(uid, valid)
+	}
+	return valid
+}
 
-	return pt
-}
\ No newline at end of file
+//调用方需持有锁。缓存里的列表不再修改，每次保存换一个新的
+func (pt *PushTokens) save(uid int64, tokens []*relay.PushToken) {
+	pt.cache.Add(uid, tokens)
+	if err := pt.store.SetPushTokens(uid, tokens); err != nil {
+		logging.Logger.Warn("save push tokens of ", uid, " to store error:", err)
+	}
+}
+
+func (sm *SessionManager) handleVoipTokenReg(signal *Signal) {
+	token, okToken := signal.Info["token"].(string)
+	platform, okPlatform := signal.Info["platform"].(string)
+	if !okToken || !okPlatform || token == "" {
+		sm.log().Warn("incorrect voip token reg from ", signal.From)
+		sm.dropSignal(signal, SignalDropIncorrect)
+		return
+	}
+	now := time.Now()
+	if unregister, _ := signal.Info["unregister"].(bool); unregister {
+		if sm.pushTokens.Unregister(signal.From, token, now) {
+			sm.log().Info("voip token:", token, " unregistered for user:", signal.From)
+		}
+		return
+	}
+
+	var ttl time.Duration
+	if n, ok := signal.Info["ttl"].(json.Number); ok {
+		if seconds, err := n.Int64(); err == nil && seconds > 0 {
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+	t := sm.pushTokens.Register(signal.From, token, platform, signal.Device, ttl, now)
+	sm.log().Info("voip token:", token, " registered for user:", signal.From)
+
+	var expires int64
+	if !t.Expires.IsZero() {
+		expires = t.Expires.Unix()
+	}
+	ack := NewSignal(YCKCallSignalTypeVoipTokenAck, SessionManagerUserId, signal.From, 0)
+	ack.Info = map[string]interface{}{"token": token, "expires": expires}
+	sm.sendSignal(ack, false)
+}
@@ -0,0 +1,82 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"sort"
+)
+
+/*
+媒体拓扑：session manager决定session的媒体怎么走，并通知参与者，客户端不再各自判断。
+  mesh   参与者之间p2p直连，目前只有1-1通话能打洞（见punch.go）
+  sfu    经relay逐路转发
+  mixer  relay把音频混成一路再发（见relay/mixer.go），relay的mix_threshold应与mixer_min一致
+1. 按incall的人数n决定：n <= config.MeshMax且可以p2p时用mesh，n >= config.MixerMin时用mixer，其余sfu；
+   有人在分组讨论房间时用sfu，relay只在房间内转发（见breakout.go）
+2. 可以p2p：1-1模式，没有访客（网页客户端不能打洞），而且打洞没有失败（双方都报了结果且都不通）
+3. 拓扑变化时给incall的参与者发Topology信令，Info为topology和participants(n)；人数跨过阈值或打洞失败时重新下发。
+   没人incall时清掉，下次有人incall时重新下发
+*/
+
+const (
+	TopologyMesh  = "mesh"
+	TopologySfu   = "sfu"
+	TopologyMixer = "mixer"
+)
+
+func (sm *SessionManager) decideTopology(session *Session, n int) string {
+	if session.inBreakout() {
+		return TopologySfu
+	}
+	if sm.mixerMin > 0 && n >= sm.mixerMin {
+		return TopologyMixer
+	}
+	if n <= sm.meshMax && sm.canMesh(session) {
+		return TopologyMesh
+	}
+	return TopologySfu
+}
+
+func (sm *SessionManager) canMesh(session *Session) bool {
+	if session.Mode != YCKCallModeOneToOne {
+		return false
+	}
+	for _, p := range session.Participants {
+		if IsGuestUid(p.Uid) {
+			return false
+		}
+	}
+	punch := session.Punch
+	return punch == nil || punch.Succeeded || len(punch.Results) < 2
+}
+
+//拓扑有变化时下发，在参与者状态或打洞结果变化之后调用
+func (sm *SessionManager) syncTopology(session *Session) {
+	var incall []int64
+	for _, p := range session.Participants {
+		if p.InState(YCKParticipantStateIncall) {
+			incall = append(incall, p.Uid)
+		}
+	}
+	if len(incall) == 0 {
+		session.Topology = ""
+		return
+	}
+	sort.Slice(incall, func(i, j int) bool { return incall[i] < incall[j] })
+	topology := sm.decideTopology(session, len(incall))
+	if topology == session.Topology {
+		return
+	}
+	sm.log().Info("topology of session ", session.Sid, " changed from ", session.Topology, " to ", topology, " with ", len(incall), " in call")
+	session.Topology = topology
+	for _, uid := range incall {
+		signal := NewSignal(YCKCallSignalTypeTopology, SessionManagerUserId, uid, session.Sid)
+		signal.Info = map[string]interface{}{"topology": topology, "participants": len(incall)}
+		sm.sendSignal(signal, false)
+	}
+}
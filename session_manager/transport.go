@@ -0,0 +1,93 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+//session manager收发udp包的接口，*net.UDPConn直接满足。
+//换成MemTransport后不需要socket，测试可以同步地喂包、取包，确定性地驱动整个信令状态机
+type Transport interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	Close() error
+}
+
+var errTransportClosed = errors.New("transport closed")
+
+type MemPacket struct {
+	Data []byte
+	Addr *net.UDPAddr //收到的包是来源地址，发出的包是目的地址
+}
+
+//内存中的Transport，Deliver进来的包由ReadFromUDP读出，WriteToUDP写出的包留着给Sent取走
+type MemTransport struct {
+	inbound chan MemPacket
+	lock    sync.Mutex
+	sent    []MemPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func NewMemTransport() *MemTransport {
+	t := &MemTransport{
+		inbound: make(chan MemPacket, 1024),
+		closed:  make(chan struct{}),
+	}
+	return t
+}
+
+func (t *MemTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case p := <-t.inbound:
+		return copy(b, p.Data), p.Addr, nil
+	case <-t.closed:
+		return 0, nil, errTransportClosed
+	}
+}
+
+func (t *MemTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, errTransportClosed
+	default:
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	t.lock.Lock()
+	t.sent = append(t.sent, MemPacket{Data: data, Addr: addr})
+	t.lock.Unlock()
+	return len(b), nil
+}
+
+func (t *MemTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+//模拟从addr收到一个包
+func (t *MemTransport) Deliver(data []byte, from *net.UDPAddr) {
+	p := MemPacket{Data: make([]byte, len(data)), Addr: from}
+	copy(p.Data, data)
+	select {
+	case t.inbound <- p:
+	case <-t.closed:
+	}
+}
+
+//取走目前为止写出的所有包
+func (t *MemTransport) Sent() []MemPacket {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sent := t.sent
+	t.sent = nil
+	return sent
+}
@@ -0,0 +1,105 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+)
+
+/*
+语音信箱：1-1呼叫被叫拒接或无应答时，让主叫给被叫留言。
+1. config的max_voicemail（秒）不为0时开启。被叫拒接，或主叫因无应答取消（Cancel的reason为YCKCallEndReasonTimeout）后，
+   session manager给主叫发Voicemail，Info带callee和duration；支持留言的客户端收到后播放提示音并继续向relay发音频，
+   不支持的客户端已经挂断，不受影响
+2. session manager用RecordControlVoicemail通知session的relay只录主叫的音频，留言期间主叫仍是relay session的成员，见relay/voicemail.go
+3. 主叫发End或到时后（到时还给主叫发End），session manager通知relay停止录制，relay回VoicemailDone，
+   session manager发voicemail.recorded事件：Uid为被叫，Caller为主叫，File为relay上的文件位置，Duration为留言的毫秒数
+*/
+
+type Voicemail struct {
+	Caller int64
+	Callee int64
+	Start  time.Time
+	Done   bool //已通知relay停止录制
+}
+
+//留言期间主叫仍要留在relay session里
+func (v *Voicemail) recording(uid int64) bool {
+	return v != nil && !v.Done && v.Caller == uid
+}
+
+func (sm *SessionManager) startVoicemail(session *Session, caller int64, callee int64) {
+	if sm.maxVoicemail == 0 || session.Voicemail != nil {
+		return
+	}
+	v := &Voicemail{Caller: caller, Callee: callee, Start: time.Now()}
+	session.Voicemail = v
+
+	offer := NewSignal(YCKCallSignalTypeVoicemail, SessionManagerUserId, caller, session.Sid)
+	offer.Info = map[string]interface{}{
+		"callee":   callee,
+		"duration": int64(sm.maxVoicemail / time.Second),
+	}
+	sm.sendSignal(offer, false)
+
+	payload := make([]byte, 11)
+	payload[0] = relay.RecordControlVoicemail
+	binary.BigEndian.PutUint64(payload[1:9], uint64(caller))
+	binary.BigEndian.PutUint16(payload[9:11], uint16(sm.maxVoicemail/time.Second))
+	msg := relay.NewMessage(relay.UdpMessageTypeRecordControl, SessionManagerUserId, session.Sid, 0, payload, nil)
+	sm.sendMessageToSessionRelays(msg, session)
+	sm.log().Info("voicemail from ", caller, " to ", callee, " in session ", session.Sid)
+
+	sm.wheel.Schedule(sm.maxVoicemail, func() {
+		if sm.sessions[session.Sid] != session || session.Voicemail != v || v.Done {
+			return
+		}
+		sm.sendSignal(newEndSignal(caller, session.Sid, YCKCallEndReasonMaxDuration), false)
+		sm.stopVoicemail(session)
+	})
+}
+
+//留言中的主叫挂断，返回true表示已处理，不再转发给被叫
+func (sm *SessionManager) endVoicemail(signal *Signal, session *Session) bool {
+	if !session.Voicemail.recording(signal.From) {
+		return false
+	}
+	sm.stopVoicemail(session)
+	return true
+}
+
+func (sm *SessionManager) stopVoicemail(session *Session) {
+	session.Voicemail.Done = true
+	msg := relay.NewMessage(relay.UdpMessageTypeRecordControl, SessionManagerUserId, session.Sid, 0, []byte{relay.RecordControlStop}, nil)
+	sm.sendMessageToSessionRelays(msg, session)
+	sm.syncRelaySession(session)
+}
+
+//relay录完留言：uid(8)+毫秒(4)+文件位置
+func (sm *SessionManager) handleVoicemailDone(msg *relay.Message, addr *net.UDPAddr) {
+	if len(msg.Payload) <= 12 {
+		sm.log().Warn("incorrect voicemail done for session ", msg.To)
+		return
+	}
+	event := NewEvent(EventVoicemailRecorded, msg.To)
+	event.Caller = int64(binary.BigEndian.Uint64(msg.Payload[0:8]))
+	event.Duration = int64(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	event.File = string(msg.Payload[12:])
+	if addr != nil {
+		event.Relay = addr.String()
+	}
+	if session := sm.sessions[msg.To]; session != nil && session.Voicemail != nil {
+		event.Uid = session.Voicemail.Callee
+	}
+	sm.log().Info("voicemail of session ", msg.To, " recorded to ", event.File, " on relay ", event.Relay)
+	sm.emitEvent(event)
+}
@@ -0,0 +1,197 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package session_manager
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+session事件webhook：把事件（见events.go）POST给config.Webhooks里的url，供CRM等外部系统使用，量大时改用events.go里的消息总线。
+1. 不发metrics事件
+2. body为Event的json，头部带X-Ycng-Timestamp和X-Ycng-Signature，
+   签名为"sha256=" + hex(HMAC-SHA256(webhook_secret, timestamp + "." + body))，接收方用SignWebhook校验，并拒绝时间戳太旧的请求
+3. 每个url一个队列和一个goroutine，慢的url不影响其他url和主循环；队列满时丢弃新事件
+4. 网络错误、5xx、408、429按WebhookRetryDelay指数退避重试，最多WebhookRetries次；其他4xx不重试。
+   重试可能导致重复投递，接收方按事件id去重
+5. 停服时最多等WebhookStopTimeout把队列里的事件发完
+*/
+
+const (
+	WebhookQueueSize   = 1024
+	WebhookTimeout     = 5 * time.Second
+	WebhookRetries     = 3
+	WebhookRetryDelay  = time.Second
+	WebhookStopTimeout = 5 * time.Second
+)
+
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookTarget struct {
+	url   string
+	queue chan []byte
+}
+
+type WebhookDispatcher struct {
+	secret     string
+	client     *http.Client
+	targets    []*webhookTarget
+	retryDelay time.Duration
+
+	lock    sync.Mutex
+	closed  bool
+	dropped uint64
+
+	stop chan struct{} //停服超时后中止重试
+	wg   sync.WaitGroup
+}
+
+func NewWebhookDispatcher(urls []string, secret string) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		secret:     secret,
+		client:     &http.Client{Timeout: WebhookTimeout},
+		retryDelay: WebhookRetryDelay,
+		stop:       make(chan struct{}),
+	}
+	for _, url := range urls {
+		d.targets = append(d.targets, &webhookTarget{url: url, queue: make(chan []byte, WebhookQueueSize)})
+	}
+	return d
+}
+
+func (d *WebhookDispatcher) Start() {
+	for _, target := range d.targets {
+		d.wg.Add(1)
+		go d.run(target)
+	}
+}
+
+func (d *WebhookDispatcher) Stop() {
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return
+	}
+	d.closed = true
+	for _, target := range d.targets {
+		close(target.queue)
+	}
+	d.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(WebhookStopTimeout):
+		logging.Logger.Warn("webhook queues not drained in ", WebhookStopTimeout)
+		close(d.stop)
+		<-done
+	}
+}
+
+//不阻塞，队列满或已停止时丢弃
+func (d *WebhookDispatcher) Publish(event *Event) {
+	if event.Type == EventMetrics {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logging.Logger.Warn("webhook event marshal error:", err)
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return
+	}
+	for _, target := range d.targets {
+		select {
+		case target.queue <- body:
+		default:
+			d.dropped++
+			logging.Logger.Warn("webhook queue full, drop ", event.Type, " of session ", event.Sid, " to ", target.url)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) Dropped() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.dropped
+}
+
+func (d *WebhookDispatcher) run(target *webhookTarget) {
+	defer d.wg.Done()
+	for body := range target.queue {
+		d.deliver(target.url, body)
+	}
+}
+
+func (d *WebhookDispatcher) deliver(url string, body []byte) {
+	delay := d.retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := d.post(url, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= WebhookRetries {
+			logging.Logger.Warn("webhook to ", url, " failed after ", attempt+1, " attempts:", err)
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-d.stop:
+			return
+		}
+		delay *= 2
+	}
+}
+
+//返回值retry表示失败是否值得重试
+func (d *WebhookDispatcher) post(url string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Ycng-Timestamp", timestamp)
+	if d.secret != "" {
+		req.Header.Set("X-Ycng-Signature", SignWebhook(d.secret, timestamp, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("status %d", resp.StatusCode)
+}
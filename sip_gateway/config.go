@@ -0,0 +1,56 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package sip_gateway
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+type Config struct {
+	Uid          int64    `toml:"uid"`           //网关在YCK侧的用户id，呼叫这个uid即呼出到SIP
+	Relays       []string `toml:"relays"`        //注册信令用的relay
+	SipAddr      string   `toml:"sip_addr"`      //本地SIP监听地址
+	TrunkAddr    string   `toml:"trunk_addr"`    //SIP trunk/软交换地址
+	Domain       string   `toml:"domain"`        //SIP URI中的domain
+	MediaIp      string   `toml:"media_ip"`      //SDP中告诉对端的RTP地址
+	AccessSecret string   `toml:"access_secret"` //relay开启接入控制时，用于给网关自己签发access token
+}
+
+func GetConfig(ctx *cli.Context) *Config {
+	config := GetDefaultConfig()
+	if ctx.GlobalIsSet("sip_port") {
+		config.SipAddr = fmt.Sprintf(":%d", ctx.GlobalInt("sip_port"))
+	}
+	if ctx.GlobalIsSet("trunk") {
+		config.TrunkAddr = ctx.GlobalString("trunk")
+	}
+	if ctx.GlobalIsSet("relays") {
+		config.Relays = strings.Split(ctx.GlobalString("relays"), ",")
+	}
+	if ctx.GlobalIsSet("access_secret") {
+		config.AccessSecret = ctx.GlobalString("access_secret")
+	}
+	return config
+}
+
+func GetDefaultConfig() *Config {
+	var config *Config
+
+	config = &Config{
+		Uid:       -3,
+		Relays:    []string{"127.0.0.1:19001"},
+		SipAddr:   ":5060",
+		TrunkAddr: "127.0.0.1:5070",
+		Domain:    "ycng.local",
+		MediaIp:   "127.0.0.1",
+	}
+	return config
+}
@@ -0,0 +1,562 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package sip_gateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/session_manager"
+	"github.com/xujiajundd/ycng/utils"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+SIP网关：
+1. 网关在YCK侧是一个普通用户(config.Uid)，通过relay注册并收发信令
+2. 呼叫网关uid的Invite(Info中带number)被翻译为向trunk发INVITE
+3. SIP侧的180/200/486/BYE翻译为Ring/Accept/Busy/End，YCK侧的Cancel/End翻译为CANCEL/BYE
+4. 媒体：网关向invite中的relay做turn reg加入session，relay的音频包转为RTP发给对端，反之亦然
+   YCK音频包和RTP载荷的转换由MediaCodec完成，默认是透传
+*/
+
+const (
+	CallStateCalling = 1
+	CallStateIncall  = 2
+
+	rtpHeaderSize = 12
+)
+
+type MediaCodec interface {
+	FromRtp(payload []byte) []byte //RTP载荷 -> YCK音频payload
+	ToRtp(payload []byte) []byte   //YCK音频payload -> RTP载荷
+}
+
+type passthroughCodec struct{}
+
+func (c passthroughCodec) FromRtp(payload []byte) []byte { return payload }
+func (c passthroughCodec) ToRtp(payload []byte) []byte   { return payload }
+
+type Call struct {
+	Sid       int64
+	Caller    int64
+	Number    string
+	CallId    string
+	FromTag   string
+	ToTag     string
+	State     int
+	Invite    *SipMessage
+	Relay     *net.UDPAddr
+	RtpConn   *net.UDPConn
+	RemoteRtp *net.UDPAddr
+	rtpSeq    uint16
+	rtpTs     uint32
+	ssrc      uint32
+	cseq      int
+}
+
+type Gateway struct {
+	config    *Config
+	relayConn *net.UDPConn
+	sipConn   *net.UDPConn
+	trunkAddr *net.UDPAddr
+	relayCh   chan *relay.ReceivedPacket
+	sipCh     chan *relay.ReceivedPacket
+	calls     map[int64]*Call
+	callIds   map[string]*Call
+	codec     MediaCodec
+	dedup     *utils.LRU
+	isRunning bool
+	lock      sync.RWMutex
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	ticker    *time.Ticker
+}
+
+func NewGateway(config *Config) *Gateway {
+	gw := &Gateway{
+		config:    config,
+		relayCh:   make(chan *relay.ReceivedPacket, 100),
+		sipCh:     make(chan *relay.ReceivedPacket, 100),
+		calls:     make(map[int64]*Call),
+		callIds:   make(map[string]*Call),
+		codec:     passthroughCodec{},
+		dedup:     utils.NewLRU(1000, nil),
+		isRunning: false,
+		stop:      make(chan struct{}),
+		ticker:    time.NewTicker(relay.ServerRegInterval),
+	}
+	return gw
+}
+
+func (gw *Gateway) SetMediaCodec(codec MediaCodec) {
+	gw.codec = codec
+}
+
+func (gw *Gateway) Start() error {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+	if gw.isRunning {
+		return nil
+	}
+
+	trunkAddr, err := net.ResolveUDPAddr("udp4", gw.config.TrunkAddr)
+	if err != nil {
+		return err
+	}
+	gw.trunkAddr = trunkAddr
+
+	gw.relayConn, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+
+	sipAddr, err := net.ResolveUDPAddr("udp4", gw.config.SipAddr)
+	if err != nil {
+		return err
+	}
+	gw.sipConn, err = net.ListenUDP("udp", sipAddr)
+	if err != nil {
+		return err
+	}
+	logging.Logger.Info("sip gateway listen on:", gw.config.SipAddr, " trunk:", gw.config.TrunkAddr)
+
+	gw.isRunning = true
+	gw.registerUserToRelays()
+
+	gw.wg.Add(1)
+	go gw.loop()
+	go gw.readConn(gw.relayConn, gw.relayCh)
+	go gw.readConn(gw.sipConn, gw.sipCh)
+	return nil
+}
+
+func (gw *Gateway) Stop() {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+	if gw.isRunning {
+		gw.isRunning = false
+		close(gw.stop)
+	}
+}
+
+func (gw *Gateway) WaitForShutdown() {
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigc)
+		<-sigc
+		gw.Stop()
+	}()
+
+	gw.wg.Wait()
+}
+
+func (gw *Gateway) loop() {
+	defer gw.wg.Done()
+
+	for {
+		select {
+		case <-gw.stop:
+			for _, call := range gw.calls {
+				gw.hangupSip(call)
+				gw.releaseCall(call)
+			}
+			gw.relayConn.Close()
+			gw.sipConn.Close()
+			return
+		case packet := <-gw.relayCh:
+			gw.handleRelayPacket(packet)
+		case packet := <-gw.sipCh:
+			gw.handleSipPacket(packet)
+		case <-gw.ticker.C:
+			gw.registerUserToRelays()
+		}
+	}
+}
+
+func (gw *Gateway) readConn(conn *net.UDPConn, ch chan *relay.ReceivedPacket) {
+	var buf [65536]byte
+
+	for {
+		size, addr, err := conn.ReadFromUDP(buf[0:])
+		if err != nil {
+			if !gw.isRunning {
+				return
+			}
+			logging.Logger.Error("error ReadFromUDP ", err)
+			continue
+		}
+
+		data := make([]byte, size)
+		copy(data, buf[0:size])
+		ch <- &relay.ReceivedPacket{
+			Body:        data,
+			FromUdpAddr: addr,
+			Time:        time.Now().UnixNano(),
+		}
+	}
+}
+
+func (gw *Gateway) handleRelayPacket(packet *relay.ReceivedPacket) {
+	msg, err := relay.NewMessageFromObfuscatedData(packet.Body)
+	if err != nil {
+		logging.Logger.Warn("error:", err, " for packet received from <", packet.FromUdpAddr.String(), ">")
+		return
+	}
+
+	switch msg.MsgType {
+	case relay.UdpMessageTypeUserRegReceived:
+		if relay.LearnObfuscationKey(msg) {
+			logging.Logger.Info("obfuscation key ", relay.CurrentObfuscationKey().Id, " learned from relay ", packet.FromUdpAddr.String())
+		}
+	case relay.UdpMessageTypeTurnRegReceived:
+	case relay.UdpMessageTypeUserSignal:
+		gw.handleUserSignal(msg)
+	case relay.UdpMessageTypeAudioStream:
+		gw.handleRelayAudio(msg)
+	case relay.UdpMessageTypeTurnRegNoExist:
+		call := gw.calls[msg.To]
+		if call != nil && call.Relay != nil {
+			gw.turnReg(call)
+		}
+	default:
+	}
+}
+
+func (gw *Gateway) handleUserSignal(msg *relay.Message) {
+	if gw.dedup.Contains(string(msg.Payload)) {
+		return
+	}
+	gw.dedup.Add(string(msg.Payload), true)
+
+	s := relay.NewSignalTemp()
+	err := s.Unmarshal(msg.Payload)
+	if err != nil {
+		logging.Logger.Warn("signal unmarshal error:", err)
+		return
+	}
+
+	call := gw.calls[s.SessionId]
+	switch s.Signal {
+	case relay.YCKCallSignalTypeInvite:
+		if call != nil {
+			return
+		}
+		number, ok := s.Info["number"].(string)
+		if !ok || len(number) == 0 {
+			logging.Logger.Warn("sip gateway invite without number from ", s.From)
+			gw.sendSignal(relay.YCKCallSignalTypeReject, s.From, s.SessionId)
+			return
+		}
+		call, err = gw.newCall(s, number)
+		if err != nil {
+			logging.Logger.Warn("sip gateway create call error:", err)
+			gw.sendSignal(relay.YCKCallSignalTypeBusy, s.From, s.SessionId)
+			return
+		}
+		gw.sendSipInvite(call)
+	case relay.YCKCallSignalTypeCancel, relay.YCKCallSignalTypeEnd:
+		if call != nil {
+			gw.hangupSip(call)
+			gw.releaseCall(call)
+		}
+	default:
+	}
+}
+
+func (gw *Gateway) newCall(s *relay.Signal, number string) (*Call, error) {
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+
+	call := &Call{
+		Sid:     s.SessionId,
+		Caller:  s.From,
+		Number:  number,
+		CallId:  fmt.Sprintf("%d@%s", s.SessionId, gw.config.Domain),
+		FromTag: fmt.Sprintf("%x", rand.Uint32()),
+		State:   CallStateCalling,
+		RtpConn: rtpConn,
+		ssrc:    rand.Uint32(),
+	}
+
+	//媒体走invite中带的第一个relay
+	if rs, ok := s.Info["relays"].([]interface{}); ok && len(rs) > 0 {
+		if r, ok := rs[0].(string); ok {
+			call.Relay, err = net.ResolveUDPAddr("udp4", r)
+			if err != nil {
+				logging.Logger.Warn("incorrect relay addr in invite ", r)
+			}
+		}
+	}
+
+	gw.calls[call.Sid] = call
+	gw.callIds[call.CallId] = call
+	go gw.readRtp(call)
+	return call, nil
+}
+
+func (gw *Gateway) releaseCall(call *Call) {
+	if call.Relay != nil {
+		msg := relay.NewMessage(relay.UdpMessageTypeTurnUnReg, gw.config.Uid, call.Sid, 0, nil, nil)
+		gw.relayConn.WriteToUDP(msg.ObfuscatedDataOfMessage(), call.Relay)
+	}
+	call.RtpConn.Close()
+	delete(gw.calls, call.Sid)
+	delete(gw.callIds, call.CallId)
+	logging.Logger.Info("sip gateway release call ", call.Sid, " number ", call.Number)
+}
+
+func (gw *Gateway) sipUri(user string, host string) string {
+	return fmt.Sprintf("sip:%s@%s", user, host)
+}
+
+func (gw *Gateway) sendSipInvite(call *Call) {
+	uri := gw.sipUri(call.Number, gw.config.TrunkAddr)
+	invite := NewSipRequest(SipMethodInvite, uri)
+	call.cseq++
+	gw.fillRequestHeaders(invite, call, uri)
+	invite.AddHeader("Contact", fmt.Sprintf("<%s>", gw.sipUri(fmt.Sprint(call.Caller), gw.sipConn.LocalAddr().String())))
+	invite.AddHeader("Content-Type", "application/sdp")
+	port := call.RtpConn.LocalAddr().(*net.UDPAddr).Port
+	invite.Body = buildSdp(call.Sid, gw.config.MediaIp, port)
+	call.Invite = invite
+
+	gw.sendSip(invite)
+	logging.Logger.Info("sip gateway invite ", uri, " for session ", call.Sid, " from ", call.Caller)
+}
+
+func (gw *Gateway) fillRequestHeaders(req *SipMessage, call *Call, uri string) {
+	req.AddHeader("Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=z9hG4bK%x", gw.sipConn.LocalAddr().String(), rand.Uint32()))
+	req.AddHeader("Max-Forwards", "70")
+	req.AddHeader("From", fmt.Sprintf("<%s>;tag=%s", gw.sipUri(fmt.Sprint(call.Caller), gw.config.Domain), call.FromTag))
+	to := fmt.Sprintf("<%s>", uri)
+	if len(call.ToTag) > 0 {
+		to += ";tag=" + call.ToTag
+	}
+	req.AddHeader("To", to)
+	req.AddHeader("Call-ID", call.CallId)
+	req.AddHeader("CSeq", fmt.Sprintf("%d %s", call.cseq, req.Method))
+}
+
+func (gw *Gateway) hangupSip(call *Call) {
+	if call.State == CallStateCalling && call.Invite != nil {
+		//CANCEL要和INVITE使用同样的Via和CSeq序号
+		cancel := NewSipRequest(SipMethodCancel, call.Invite.RequestURI)
+		for _, name := range []string{"Via", "From", "To", "Call-ID"} {
+			cancel.AddHeader(name, call.Invite.Get(name))
+		}
+		cancel.AddHeader("Max-Forwards", "70")
+		cancel.AddHeader("CSeq", fmt.Sprintf("%d %s", call.cseq, SipMethodCancel))
+		gw.sendSip(cancel)
+	} else if call.State == CallStateIncall {
+		uri := gw.sipUri(call.Number, gw.config.TrunkAddr)
+		bye := NewSipRequest(SipMethodBye, uri)
+		call.cseq++
+		gw.fillRequestHeaders(bye, call, uri)
+		gw.sendSip(bye)
+	}
+}
+
+func (gw *Gateway) sendSip(m *SipMessage) {
+	_, err := gw.sipConn.WriteToUDP(m.Marshal(), gw.trunkAddr)
+	if err != nil {
+		logging.Logger.Error("sip write error ", err)
+	}
+}
+
+func (gw *Gateway) handleSipPacket(packet *relay.ReceivedPacket) {
+	m, err := ParseSipMessage(packet.Body)
+	if err != nil {
+		logging.Logger.Warn("sip parse error:", err, " from <", packet.FromUdpAddr.String(), ">")
+		return
+	}
+
+	call := gw.callIds[m.CallId()]
+	if m.IsRequest() {
+		switch m.Method {
+		case SipMethodBye:
+			gw.sendSip(NewSipResponse(m, 200, "OK"))
+			if call != nil {
+				gw.sendSignal(relay.YCKCallSignalTypeEnd, call.Caller, call.Sid)
+				call.State = 0
+				gw.releaseCall(call)
+			}
+		case SipMethodAck:
+		default:
+			gw.sendSip(NewSipResponse(m, 501, "Not Implemented"))
+		}
+		return
+	}
+
+	if call == nil || m.CSeqMethod() != SipMethodInvite {
+		return
+	}
+
+	switch {
+	case m.StatusCode == 180 || m.StatusCode == 183:
+		gw.sendSignal(relay.YCKCallSignalTypeRing, call.Caller, call.Sid)
+	case m.StatusCode >= 200 && m.StatusCode < 300:
+		if call.State == CallStateIncall {
+			gw.sendAck(call, m) //200 OK重传，ACK也要重发
+			return
+		}
+		call.ToTag = tagOf(m.Get("To"))
+		addr, err := parseSdpAudioAddr(m.Body)
+		if err == nil {
+			call.RemoteRtp, err = net.ResolveUDPAddr("udp4", addr)
+		}
+		if err != nil {
+			logging.Logger.Warn("sip gateway 200 OK without usable sdp for session ", call.Sid, " err:", err)
+		}
+		gw.sendAck(call, m)
+		call.State = CallStateIncall
+		gw.turnReg(call)
+		gw.sendSignal(relay.YCKCallSignalTypeAccept, call.Caller, call.Sid)
+	case m.StatusCode >= 300:
+		gw.sendAck(call, m)
+		if m.StatusCode == 486 || m.StatusCode == 600 {
+			gw.sendSignal(relay.YCKCallSignalTypeBusy, call.Caller, call.Sid)
+		} else {
+			gw.sendSignal(relay.YCKCallSignalTypeReject, call.Caller, call.Sid)
+		}
+		call.State = 0
+		gw.releaseCall(call)
+	}
+}
+
+func (gw *Gateway) sendAck(call *Call, resp *SipMessage) {
+	ack := NewSipRequest(SipMethodAck, call.Invite.RequestURI)
+	ack.AddHeader("Via", call.Invite.Get("Via"))
+	ack.AddHeader("Max-Forwards", "70")
+	ack.AddHeader("From", call.Invite.Get("From"))
+	ack.AddHeader("To", resp.Get("To"))
+	ack.AddHeader("Call-ID", call.CallId)
+	ack.AddHeader("CSeq", fmt.Sprintf("%d %s", call.cseq, SipMethodAck))
+	gw.sendSip(ack)
+}
+
+func tagOf(header string) string {
+	idx := strings.Index(header, ";tag=")
+	if idx < 0 {
+		return ""
+	}
+	tag := header[idx+len(";tag="):]
+	if end := strings.Index(tag, ";"); end >= 0 {
+		tag = tag[:end]
+	}
+	return tag
+}
+
+func (gw *Gateway) sendSignal(signalType uint16, to int64, sid int64) {
+	s := relay.NewSignal(signalType, gw.config.Uid, to, sid)
+	payload, err := s.Marshal()
+	if err != nil {
+		logging.Logger.Warn("signal marshal error:", err)
+		return
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserSignal, gw.config.Uid, session_manager.SessionManagerUserId, 0, payload, nil)
+	gw.sendByRelays(msg)
+}
+
+func (gw *Gateway) registerUserToRelays() {
+	var token []byte
+	if gw.config.AccessSecret != "" {
+		token = relay.IssueAccessToken(gw.config.AccessSecret, gw.config.Uid, time.Now().Add(relay.AccessTokenTTL))
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeUserReg, gw.config.Uid, 0, 0, token, nil)
+	gw.sendByRelays(msg)
+}
+
+func (gw *Gateway) sendByRelays(msg *relay.Message) {
+	data := msg.ObfuscatedDataOfMessage()
+
+	for _, r := range gw.config.Relays {
+		udpAddr, err := net.ResolveUDPAddr("udp4", r)
+		if err != nil {
+			logging.Logger.Error("incorrect addr ", err)
+			continue
+		}
+
+		_, err = gw.relayConn.WriteToUDP(data, udpAddr)
+		if err != nil {
+			logging.Logger.Error("udp write error", err)
+		}
+	}
+}
+
+func (gw *Gateway) turnReg(call *Call) {
+	if call.Relay == nil {
+		logging.Logger.Warn("sip gateway no relay for media of session ", call.Sid)
+		return
+	}
+	msg := relay.NewMessage(relay.UdpMessageTypeTurnReg, gw.config.Uid, call.Sid, 0, nil, nil)
+	gw.relayConn.WriteToUDP(msg.ObfuscatedDataOfMessage(), call.Relay)
+}
+
+// relay -> SIP
+func (gw *Gateway) handleRelayAudio(msg *relay.Message) {
+	call := gw.calls[msg.To]
+	if call == nil || call.RemoteRtp == nil || msg.From == gw.config.Uid {
+		return
+	}
+
+	payload := gw.codec.ToRtp(msg.Payload)
+	if len(payload) == 0 {
+		return
+	}
+	packet := make([]byte, rtpHeaderSize+len(payload))
+	packet[0] = 0x80 //V=2
+	packet[1] = 0    //PT=PCMU
+	binary.BigEndian.PutUint16(packet[2:4], call.rtpSeq)
+	binary.BigEndian.PutUint32(packet[4:8], call.rtpTs)
+	binary.BigEndian.PutUint32(packet[8:12], call.ssrc)
+	copy(packet[rtpHeaderSize:], payload)
+	call.rtpSeq++
+	call.rtpTs += 160 //20ms@8kHz
+
+	call.RtpConn.WriteToUDP(packet, call.RemoteRtp)
+}
+
+// SIP -> relay，每个call一个goroutine
+func (gw *Gateway) readRtp(call *Call) {
+	var buf [2048]byte
+
+	for {
+		size, _, err := call.RtpConn.ReadFromUDP(buf[0:])
+		if err != nil {
+			return
+		}
+		if size <= rtpHeaderSize || call.Relay == nil {
+			continue
+		}
+		cc := int(buf[0] & 0x0f)
+		start := rtpHeaderSize + 4*cc
+		if start >= size {
+			continue
+		}
+
+		payload := gw.codec.FromRtp(append([]byte(nil), buf[start:size]...))
+		if len(payload) == 0 {
+			continue
+		}
+		msg := relay.NewMessage(relay.UdpMessageTypeAudioStream, gw.config.Uid, call.Sid, 0, payload, nil)
+		gw.relayConn.WriteToUDP(msg.ObfuscatedDataOfMessage(), call.Relay)
+	}
+}
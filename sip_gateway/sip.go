@@ -0,0 +1,214 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package sip_gateway
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+最小化的SIP消息实现，只覆盖网关需要的INVITE/ACK/BYE/CANCEL及其应答，走UDP。
+*/
+
+const (
+	SipMethodInvite = "INVITE"
+	SipMethodAck    = "ACK"
+	SipMethodBye    = "BYE"
+	SipMethodCancel = "CANCEL"
+
+	sipVersion = "SIP/2.0"
+)
+
+type SipHeader struct {
+	Name  string
+	Value string
+}
+
+type SipMessage struct {
+	Method     string //请求时有值
+	RequestURI string
+	StatusCode int //应答时有值
+	Reason     string
+	Headers    []SipHeader
+	Body       []byte
+}
+
+func NewSipRequest(method string, uri string) *SipMessage {
+	m := &SipMessage{
+		Method:     method,
+		RequestURI: uri,
+	}
+	return m
+}
+
+func NewSipResponse(req *SipMessage, code int, reason string) *SipMessage {
+	m := &SipMessage{
+		StatusCode: code,
+		Reason:     reason,
+	}
+	//应答需要原样带回这些头
+	for _, name := range []string{"Via", "From", "To", "Call-ID", "CSeq"} {
+		for _, v := range req.GetAll(name) {
+			m.AddHeader(name, v)
+		}
+	}
+	return m
+}
+
+func (m *SipMessage) IsRequest() bool {
+	return len(m.Method) > 0
+}
+
+func (m *SipMessage) AddHeader(name string, value string) {
+	m.Headers = append(m.Headers, SipHeader{Name: name, Value: value})
+}
+
+func (m *SipMessage) SetHeader(name string, value string) {
+	for i := range m.Headers {
+		if strings.EqualFold(m.Headers[i].Name, name) {
+			m.Headers[i].Value = value
+			return
+		}
+	}
+	m.AddHeader(name, value)
+}
+
+func (m *SipMessage) Get(name string) string {
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func (m *SipMessage) GetAll(name string) []string {
+	values := make([]string, 0)
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			values = append(values, h.Value)
+		}
+	}
+	return values
+}
+
+func (m *SipMessage) CallId() string {
+	return m.Get("Call-ID")
+}
+
+// CSeq头形如 "1 INVITE"，返回其中的method
+func (m *SipMessage) CSeqMethod() string {
+	fields := strings.Fields(m.Get("CSeq"))
+	if len(fields) == 2 {
+		return fields[1]
+	}
+	return ""
+}
+
+func (m *SipMessage) Marshal() []byte {
+	var buf bytes.Buffer
+	if m.IsRequest() {
+		fmt.Fprintf(&buf, "%s %s %s\r\n", m.Method, m.RequestURI, sipVersion)
+	} else {
+		fmt.Fprintf(&buf, "%s %d %s\r\n", sipVersion, m.StatusCode, m.Reason)
+	}
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, "Content-Length") {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %s\r\n", h.Name, h.Value)
+	}
+	fmt.Fprintf(&buf, "Content-Length: %d\r\n\r\n", len(m.Body))
+	buf.Write(m.Body)
+	return buf.Bytes()
+}
+
+func ParseSipMessage(data []byte) (*SipMessage, error) {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, errors.New("incorrect sip message, no header end")
+	}
+	lines := strings.Split(string(data[:headerEnd]), "\r\n")
+	m := &SipMessage{}
+
+	start := strings.SplitN(lines[0], " ", 3)
+	if len(start) != 3 {
+		return nil, errors.New("incorrect sip start line")
+	}
+	if start[0] == sipVersion {
+		code, err := strconv.Atoi(start[1])
+		if err != nil {
+			return nil, errors.New("incorrect sip status code")
+		}
+		m.StatusCode = code
+		m.Reason = start[2]
+	} else {
+		if start[2] != sipVersion {
+			return nil, errors.New("unsupported sip version")
+		}
+		m.Method = start[0]
+		m.RequestURI = start[1]
+	}
+
+	for _, line := range lines[1:] {
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			continue
+		}
+		m.AddHeader(strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:]))
+	}
+
+	body := data[headerEnd+4:]
+	if cl := m.Get("Content-Length"); len(cl) > 0 {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > len(body) {
+			return nil, errors.New("incorrect sip content length")
+		}
+		body = body[:n]
+	}
+	m.Body = body
+
+	return m, nil
+}
+
+// 只生成/解析网关用得到的最简SDP：一路音频，PCMU/PCMA
+func buildSdp(sessionId int64, ip string, port int) []byte {
+	sdp := fmt.Sprintf("v=0\r\n"+
+		"o=ycng %d %d IN IP4 %s\r\n"+
+		"s=ycng\r\n"+
+		"c=IN IP4 %s\r\n"+
+		"t=0 0\r\n"+
+		"m=audio %d RTP/AVP 0 8\r\n"+
+		"a=rtpmap:0 PCMU/8000\r\n"+
+		"a=rtpmap:8 PCMA/8000\r\n", sessionId, sessionId, ip, ip, port)
+	return []byte(sdp)
+}
+
+func parseSdpAudioAddr(sdp []byte) (string, error) {
+	ip := ""
+	port := ""
+	for _, line := range strings.Split(string(sdp), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "c=IN IP4 ") {
+			ip = strings.TrimSpace(strings.TrimPrefix(line, "c=IN IP4 "))
+		} else if strings.HasPrefix(line, "m=audio ") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				port = fields[1]
+			}
+		}
+	}
+	if len(ip) == 0 || len(port) == 0 {
+		return "", errors.New("no audio address in sdp")
+	}
+	return ip + ":" + port, nil
+}
@@ -0,0 +1,38 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package utils
+
+import "sync"
+
+//收发包用的缓冲区大小，覆盖绝大多数UDP包，更大的包直接分配
+const PacketBufferSize = 2048
+
+//池里放数组指针而不是slice，Put时不会再产生一次分配
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return new([PacketBufferSize]byte)
+	},
+}
+
+// GetPacketBuffer returns a buffer of len size, from the pool if it fits
+func GetPacketBuffer(size int) []byte {
+	if size > PacketBufferSize {
+		return make([]byte, size)
+	}
+	buf := packetPool.Get().(*[PacketBufferSize]byte)
+	return buf[:size]
+}
+
+// PutPacketBuffer returns a buffer obtained from GetPacketBuffer to the pool.
+// The caller must not touch the buffer afterwards.
+func PutPacketBuffer(buf []byte) {
+	if cap(buf) != PacketBufferSize {
+		return
+	}
+	packetPool.Put((*[PacketBufferSize]byte)(buf[:PacketBufferSize]))
+}
@@ -0,0 +1,161 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package errs
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Kind is the category of a failure. Callers and tests assert on the kind
+// instead of matching error strings, and metrics count errors by kind.
+type Kind uint8
+
+const (
+	Unknown   Kind = iota // not categorized, e.g. an error from the standard library
+	Malformed             // a packet or message could not be parsed
+	Signal                // a signal payload is invalid
+	TooLarge              // a size limit was exceeded
+	Crypto                // key exchange, encryption or decryption failed
+	Rejected              // refused by obfuscation keys, access control or limits
+	Transport             // socket or network I/O failed
+	Storage               // the persistent store failed
+	numKinds
+)
+
+var kindNames = [numKinds]string{"unknown", "malformed", "signal", "too_large", "crypto", "rejected", "transport", "storage"}
+
+func (k Kind) String() string {
+	if k >= numKinds {
+		return "kind(" + strconv.Itoa(int(k)) + ")"
+	}
+	return kindNames[k]
+}
+
+// Error is a categorized error with the context it happened in. Context
+// fields left at their zero value (MsgType -1) are not printed.
+type Error struct {
+	Kind    Kind
+	Op      string // what was being done, e.g. "parse packet"
+	Source  string // address the packet came from
+	MsgType int    // message type, -1 when unknown
+	Sid     int64  // session id, 0 when unknown
+	Err     error
+}
+
+// New returns an error of kind with text, usually kept in a package level
+// variable so that errors.Is matches it
+func New(kind Kind, text string) error {
+	return &Error{Kind: kind, MsgType: -1, Err: errors.New(text)}
+}
+
+// Mark categorizes err, which came from elsewhere (e.g. encoding/json), as
+// kind without adding context. It returns nil when err is nil.
+func Mark(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, MsgType: -1, Err: err}
+}
+
+// Wrap adds op as context to err, which must not be nil. The kind is taken
+// from err. Use the From, OfType and InSession methods to add more context.
+func Wrap(err error, op string) *Error {
+	return &Error{Kind: KindOf(err), Op: op, MsgType: -1, Err: err}
+}
+
+// From sets the address the failed packet came from
+func (e *Error) From(source string) *Error {
+	e.Source = source
+	return e
+}
+
+// OfType sets the type of the failed message
+func (e *Error) OfType(msgType uint8) *Error {
+	e.MsgType = int(msgType)
+	return e
+}
+
+// InSession sets the session the failure belongs to
+func (e *Error) InSession(sid int64) *Error {
+	e.Sid = sid
+	return e
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	if e.Source != "" {
+		b.WriteString(" from <" + e.Source + ">")
+	}
+	if e.MsgType >= 0 {
+		b.WriteString(" type " + strconv.Itoa(e.MsgType))
+	}
+	if e.Sid != 0 {
+		b.WriteString(" sid " + strconv.FormatInt(e.Sid, 10))
+	}
+	if b.Len() == 0 {
+		return e.Err.Error()
+	}
+	return strings.TrimPrefix(b.String(), " ") + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the kind of the outermost *Error in the chain of err,
+// Unknown when there is none
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Unknown
+}
+
+// Is reports whether err is of kind
+func Is(err error, kind Kind) bool {
+	return err != nil && KindOf(err) == kind
+}
+
+// Counter counts errors by kind. It is safe for concurrent use, the zero
+// value is ready to use.
+type Counter struct {
+	counts [numKinds]uint64
+}
+
+// Add counts err and returns its kind
+func (c *Counter) Add(err error) Kind {
+	kind := KindOf(err)
+	if kind < numKinds {
+		atomic.AddUint64(&c.counts[kind], 1)
+	}
+	return kind
+}
+
+// Count returns the number of errors of kind counted so far
+func (c *Counter) Count(kind Kind) uint64 {
+	if kind >= numKinds {
+		return 0
+	}
+	return atomic.LoadUint64(&c.counts[kind])
+}
+
+// Snapshot returns the non-zero counts by kind name
+func (c *Counter) Snapshot() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for kind := Kind(0); kind < numKinds; kind++ {
+		if n := c.Count(kind); n > 0 {
+			counts[kind.String()] = n
+		}
+	}
+	return counts
+}
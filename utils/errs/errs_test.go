@@ -0,0 +1,50 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package errs
+
+import (
+	"errors"
+	"testing"
+)
+
+var errShort = New(Malformed, "packet too short")
+
+func TestWrap(t *testing.T) {
+	err := Wrap(errShort, "parse packet").From("127.0.0.1:20001").OfType(18).InSession(42)
+	if got := err.Error(); got != "parse packet from <127.0.0.1:20001> type 18 sid 42: packet too short" {
+		t.Errorf("error %q", got)
+	}
+	if !errors.Is(err, errShort) || !Is(err, Malformed) || Is(err, Signal) {
+		t.Errorf("kind %v", KindOf(err))
+	}
+
+	outer := Wrap(err, "handle")
+	if KindOf(outer) != Malformed || !errors.Is(outer, errShort) {
+		t.Errorf("kind %v lost when wrapped again", KindOf(outer))
+	}
+	if got := Wrap(errors.New("eof"), "").From("x").Error(); got != "from <x>: eof" {
+		t.Errorf("error %q", got)
+	}
+	if KindOf(errors.New("plain")) != Unknown || Is(nil, Unknown) {
+		t.Error("plain error has a kind")
+	}
+	if Mark(Signal, nil) != nil || KindOf(Mark(Signal, errors.New("json"))) != Signal {
+		t.Error("mark")
+	}
+}
+
+func TestCounter(t *testing.T) {
+	var c Counter
+	c.Add(Wrap(errShort, "parse packet"))
+	c.Add(errShort)
+	c.Add(errors.New("plain"))
+	counts := c.Snapshot()
+	if len(counts) != 2 || counts["malformed"] != 2 || counts["unknown"] != 1 {
+		t.Errorf("counts %v", counts)
+	}
+}
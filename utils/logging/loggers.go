@@ -16,21 +16,46 @@ import (
 	"time"
 )
 
-var Logger *logrus.Logger
+var Logger = newLogger()
 
-func init() {
-	Logger = logrus.New()
-	Logger.Out = os.Stdout
-	Logger.Formatter = &logrus.TextFormatter{FullTimestamp: true}
-	Logger.Level = logrus.InfoLevel
+//文件hook用的formatter要和Logger保持一致，切换格式时一起改
+var fileHook *lfshook.LfsHook
+
+//不放在init里，因为其他包级变量（模块logger）初始化时就要用到Logger
+func newLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = os.Stdout
+	logger.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	logger.Level = logrus.InfoLevel
+	return logger
+}
+
+//format为"json"时输出json，否则为key=value的text格式
+func SetFormat(format string) {
+	var formatter logrus.Formatter
+	if format == "json" {
+		formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	} else {
+		formatter = &logrus.TextFormatter{FullTimestamp: true}
+	}
+	Logger.Formatter = formatter
+	setModulesFormatter(formatter)
+	if fileHook != nil {
+		fileHook.SetFormatter(formatter)
+	}
 }
 
 func SetFileRotationHooker(path string, count uint) {
-	frHook := newFileRotateHooker(path, count)
-	Logger.Hooks.Add(frHook)
+	SetFileRotation(path, "relay", count, 24*time.Hour, 0)
 }
 
-func newFileRotateHooker(path string, count uint) logrus.Hook {
+//按时间rotationTime和大小rotationSize(字节，0为不按大小)切分日志文件，保留count个
+func SetFileRotation(path string, name string, count uint, rotationTime time.Duration, rotationSize int64) {
+	fileHook = newFileRotateHooker(path, name, count, rotationTime, rotationSize)
+	Logger.Hooks.Add(fileHook)
+}
+
+func newFileRotateHooker(path string, name string, count uint, rotationTime time.Duration, rotationSize int64) *lfshook.LfsHook {
 	if len(path) == 0 {
 		panic("Failed to parse logger folder:" + path + ".")
 	}
@@ -40,14 +65,17 @@ func newFileRotateHooker(path string, count uint) logrus.Hook {
 	if err := os.MkdirAll(path, 0700); err != nil {
 		panic("Failed to create logger folder:" + path + ". err:" + err.Error())
 	}
-	filePath := path + "/relay-%Y%m%d-%H.log"
-	linkPath := path + "/relay.log"
-	writer, err := rotatelogs.New(
-		filePath,
+	filePath := path + "/" + name + "-%Y%m%d-%H.log"
+	linkPath := path + "/" + name + ".log"
+	options := []rotatelogs.Option{
 		rotatelogs.WithLinkName(linkPath),
-		rotatelogs.WithRotationTime(time.Duration(24)*time.Hour),
+		rotatelogs.WithRotationTime(rotationTime),
 		rotatelogs.WithRotationCount(count),
-	)
+	}
+	if rotationSize > 0 {
+		options = append(options, rotatelogs.WithRotationSize(rotationSize))
+	}
+	writer, err := rotatelogs.New(filePath, options...)
 
 	if err != nil {
 		panic("Failed to create rotate logs. err:" + err.Error())
@@ -59,6 +87,6 @@ func newFileRotateHooker(path string, count uint) logrus.Hook {
 		logrus.WarnLevel:  writer,
 		logrus.ErrorLevel: writer,
 		logrus.FatalLevel: writer,
-	}, nil)
+	}, Logger.Formatter)
 	return hook
 }
@@ -0,0 +1,94 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package logging
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+按模块设置日志级别：
+Module返回的logger与Logger共用输出、格式和文件hook，但有自己的级别，可以在运行时单独调成debug。
+模块名""表示Logger本身。
+*/
+
+var (
+	modules     = make(map[string]*logrus.Logger)
+	modulesLock sync.Mutex
+)
+
+func Module(name string) *logrus.Logger {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	if name == "" {
+		return Logger
+	}
+	l := modules[name]
+	if l == nil {
+		l = &logrus.Logger{
+			Out:       Logger.Out,
+			Formatter: Logger.Formatter,
+			Hooks:     Logger.Hooks, //同一个map，之后加的hook也能生效
+			Level:     Logger.Level,
+		}
+		modules[name] = l
+	}
+	return l
+}
+
+func SetLevel(module string, level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	if module == "" {
+		Logger.Level = lvl
+		return nil
+	}
+	l := modules[module]
+	if l == nil {
+		return errors.New("unknown log module " + module)
+	}
+	l.Level = lvl
+	return nil
+}
+
+func Levels() map[string]string {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	levels := make(map[string]string)
+	levels[""] = Logger.Level.String()
+	for name, l := range modules {
+		levels[name] = l.Level.String()
+	}
+	return levels
+}
+
+//替换所有logger的输出，不要直接改Logger.Out，否则模块logger不会跟着变
+func SetOutput(out io.Writer) {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	Logger.Out = out
+	for _, l := range modules {
+		l.Out = out
+	}
+}
+
+func setModulesFormatter(formatter logrus.Formatter) {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	for _, l := range modules {
+		l.Formatter = formatter
+	}
+}
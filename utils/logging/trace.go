@@ -0,0 +1,103 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package logging
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+按包的trace：
+relay和session manager都是单goroutine处理收到的包，每个处理循环有自己的Trace。处理前Set设置sid/from/to/type等字段，
+处理完Clear，期间这个循环经Trace.Logger()打出的日志都带上这些字段。
+字段跟着各自的Trace而不是进程全局的，ycng all模式下relay和session manager在同一个进程里也不会互相覆盖。
+别的goroutine（admin）调用到这个循环的方法时打的日志也会带上当时的字段，排查时注意区分。
+
+另外可以对单个sid开启详细trace（EnableTrace），调用方据此把该session的每个包都打到"trace"模块。
+*/
+
+var (
+	tracedSids     = make(map[int64]time.Time)
+	tracedSidsLock sync.RWMutex
+
+	TraceLogger = Module("trace")
+)
+
+type Trace struct {
+	logger *logrus.Logger
+	entry  atomic.Value //*logrus.Entry
+}
+
+func NewTrace(logger *logrus.Logger) *Trace {
+	t := &Trace{logger: logger}
+	t.Clear()
+	return t
+}
+
+//带着当前字段的日志，可以在任意goroutine调用
+func (t *Trace) Logger() *logrus.Entry {
+	return t.entry.Load().(*logrus.Entry)
+}
+
+func (t *Trace) Set(fields logrus.Fields) {
+	t.entry.Store(t.logger.WithFields(fields))
+}
+
+//在当前trace上追加字段，比如解析出信令之后补上sid和信令类型
+func (t *Trace) Add(key string, value interface{}) {
+	t.entry.Store(t.Logger().WithField(key, value))
+}
+
+func (t *Trace) Clear() {
+	t.entry.Store(logrus.NewEntry(t.logger))
+}
+
+//duration为0时一直开启，直到DisableTrace
+func EnableTrace(sid int64, duration time.Duration) {
+	tracedSidsLock.Lock()
+	defer tracedSidsLock.Unlock()
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	tracedSids[sid] = until
+}
+
+func DisableTrace(sid int64) {
+	tracedSidsLock.Lock()
+	defer tracedSidsLock.Unlock()
+	delete(tracedSids, sid)
+}
+
+func IsTraced(sid int64) bool {
+	tracedSidsLock.RLock()
+	until, ok := tracedSids[sid]
+	tracedSidsLock.RUnlock()
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		DisableTrace(sid)
+		return false
+	}
+	return true
+}
+
+func TracedSids() []int64 {
+	tracedSidsLock.RLock()
+	defer tracedSidsLock.RUnlock()
+	sids := make([]int64, 0, len(tracedSids))
+	for sid := range tracedSids {
+		sids = append(sids, sid)
+	}
+	return sids
+}
@@ -10,24 +10,55 @@ package utils
 import (
 	"container/list"
 	"sync"
+	"time"
 )
 
 // EvictCallback is used to get a callback when a cache entry is evicted
 type EvictCallback func(key interface{}, value interface{})
 
-// LRU implements a thread safe fixed size LRU cache
+// EvictReason tells why an entry left the cache
+type EvictReason int
+
+const (
+	EvictReasonCapacity EvictReason = iota // pushed out by a newer entry
+	EvictReasonExpired                     // ttl passed
+	EvictReasonRemoved                     // Remove/RemoveOldest
+	EvictReasonPurged                      // Purge
+)
+
+// EvictReasonCallback is like EvictCallback but also receives the reason
+type EvictReasonCallback func(key interface{}, value interface{}, reason EvictReason)
+
+// LRUStats holds counters since the cache was created
+type LRUStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64 // capacity based
+	Expirations uint64
+}
+
+// LRU implements a thread safe fixed size LRU cache, optionally with per-entry ttl
 type LRU struct {
 	size      int
+	ttl       time.Duration
 	evictList *list.List
 	items     map[interface{}]*list.Element
 	onEvict   EvictCallback
+	onReason  EvictReasonCallback
+	stats     LRUStats
+	stopSweep chan struct{}
 	lock      sync.RWMutex
 }
 
 // entry is used to hold a value in the evictList
 type entry struct {
-	key   interface{}
-	value interface{}
+	key    interface{}
+	value  interface{}
+	expire time.Time // zero means never
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expire.IsZero() && now.After(e.expire)
 }
 
 // NewLRU constructs an LRU of the given size
@@ -41,32 +72,115 @@ func NewLRU(size int, onEvict EvictCallback) *LRU {
 	return c
 }
 
+// NewLRUWithTTL constructs an LRU whose entries expire ttl after they are added
+func NewLRUWithTTL(size int, ttl time.Duration, onEvict EvictCallback) *LRU {
+	c := NewLRU(size, onEvict)
+	c.ttl = ttl
+	return c
+}
+
+// SetEvictReasonCallback sets a callback that also receives the eviction reason.
+// It is called in addition to the EvictCallback given at construction.
+func (c *LRU) SetEvictReasonCallback(cb EvictReasonCallback) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onReason = cb
+}
+
+// StartSweeper starts a goroutine removing expired entries every interval,
+// so that expired entries do not linger until they are touched.
+func (c *LRU) StartSweeper(interval time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stopSweep != nil {
+		return
+	}
+	c.stopSweep = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.RemoveExpired()
+			}
+		}
+	}(c.stopSweep)
+}
+
+// StopSweeper stops the goroutine started by StartSweeper
+func (c *LRU) StopSweeper() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stopSweep != nil {
+		close(c.stopSweep)
+		c.stopSweep = nil
+	}
+}
+
+// RemoveExpired removes all expired entries, returning how many were removed
+func (c *LRU) RemoveExpired() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	n := 0
+	for ent := c.evictList.Back(); ent != nil; {
+		prev := ent.Prev()
+		if ent.Value.(*entry).expired(now) {
+			c.removeElement(ent, EvictReasonExpired)
+			n++
+		}
+		ent = prev
+	}
+	return n
+}
+
+// Stats returns a copy of the cache counters
+func (c *LRU) Stats() LRUStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.stats
+}
+
 // Purge is used to completely clear the cache
 func (c *LRU) Purge() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	for k, v := range c.items {
-		if c.onEvict != nil {
-			c.onEvict(k, v.Value.(*entry).value)
-		}
+		c.notifyEvict(k, v.Value.(*entry).value, EvictReasonPurged)
 		delete(c.items, k)
 	}
 	c.evictList.Init()
 }
 
-// Add adds a value to the cache.  Returns true if an eviction occurred.
+// Add adds a value to the cache, using the cache ttl if any.
+// Returns true if an eviction occurred.
 func (c *LRU) Add(key, value interface{}) bool {
+	return c.AddWithTTL(key, value, c.ttl)
+}
+
+// AddWithTTL adds a value that expires after ttl, 0 means never.
+// Returns true if an eviction occurred.
+func (c *LRU) AddWithTTL(key, value interface{}, ttl time.Duration) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	var expire time.Time
+	if ttl > 0 {
+		expire = time.Now().Add(ttl)
+	}
+
 	// Check for existing item
 	if ent, ok := c.items[key]; ok {
 		c.evictList.MoveToFront(ent)
 		ent.Value.(*entry).value = value
+		ent.Value.(*entry).expire = expire
 		return false
 	}
 
 	// Add new item
-	ent := &entry{key, value}
+	ent := &entry{key, value, expire}
 	entry := c.evictList.PushFront(ent)
 	c.items[key] = entry
 
@@ -83,9 +197,16 @@ func (c *LRU) Get(key interface{}) (value interface{}, ok bool) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	if ent, ok := c.items[key]; ok {
+		if ent.Value.(*entry).expired(time.Now()) {
+			c.removeElement(ent, EvictReasonExpired)
+			c.stats.Misses++
+			return nil, false
+		}
 		c.evictList.MoveToFront(ent)
+		c.stats.Hits++
 		return ent.Value.(*entry).value, true
 	}
+	c.stats.Misses++
 	return
 }
 
@@ -94,8 +215,8 @@ func (c *LRU) Get(key interface{}) (value interface{}, ok bool) {
 func (c *LRU) Contains(key interface{}) (ok bool) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
-	_, ok = c.items[key]
-	return ok
+	ent, ok := c.items[key]
+	return ok && !ent.Value.(*entry).expired(time.Now())
 }
 
 // Returns the key value (or undefined if not found) without updating
@@ -103,10 +224,10 @@ func (c *LRU) Contains(key interface{}) (ok bool) {
 func (c *LRU) Peek(key interface{}) (value interface{}, ok bool) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
-	if ent, ok := c.items[key]; ok {
+	if ent, ok := c.items[key]; ok && !ent.Value.(*entry).expired(time.Now()) {
 		return ent.Value.(*entry).value, true
 	}
-	return nil, ok
+	return nil, false
 }
 
 // Remove removes the provided key from the cache, returning if the
@@ -115,7 +236,7 @@ func (c *LRU) Remove(key interface{}) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	if ent, ok := c.items[key]; ok {
-		c.removeElement(ent)
+		c.removeElement(ent, EvictReasonRemoved)
 		return true
 	}
 	return false
@@ -127,7 +248,7 @@ func (c *LRU) RemoveOldest() (interface{}, interface{}, bool) {
 	defer c.lock.Unlock()
 	ent := c.evictList.Back()
 	if ent != nil {
-		c.removeElement(ent)
+		c.removeElement(ent, EvictReasonRemoved)
 		kv := ent.Value.(*entry)
 		return kv.key, kv.value, true
 	}
@@ -159,7 +280,8 @@ func (c *LRU) Keys() []interface{} {
 	return keys
 }
 
-// Len returns the number of items in the cache.
+// Len returns the number of items in the cache, including expired ones
+// not swept yet.
 func (c *LRU) Len() int {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
@@ -170,16 +292,29 @@ func (c *LRU) Len() int {
 func (c *LRU) removeOldest() {
 	ent := c.evictList.Back()
 	if ent != nil {
-		c.removeElement(ent)
+		c.removeElement(ent, EvictReasonCapacity)
 	}
 }
 
 // removeElement is used to remove a given list element from the cache
-func (c *LRU) removeElement(e *list.Element) {
+func (c *LRU) removeElement(e *list.Element, reason EvictReason) {
 	c.evictList.Remove(e)
 	kv := e.Value.(*entry)
 	delete(c.items, kv.key)
+	switch reason {
+	case EvictReasonCapacity:
+		c.stats.Evictions++
+	case EvictReasonExpired:
+		c.stats.Expirations++
+	}
+	c.notifyEvict(kv.key, kv.value, reason)
+}
+
+func (c *LRU) notifyEvict(key, value interface{}, reason EvictReason) {
 	if c.onEvict != nil {
-		c.onEvict(kv.key, kv.value)
+		c.onEvict(key, value)
+	}
+	if c.onReason != nil {
+		c.onReason(key, value, reason)
 	}
-}
\ No newline at end of file
+}
@@ -7,7 +7,10 @@
 
 package utils
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestLRU(t *testing.T) {
 	evictCounter := 0
@@ -157,4 +160,81 @@ func TestLRU_Peek(t *testing.T) {
 	if l.Contains(1) {
 		t.Errorf("should not have updated recent-ness of 1")
 	}
-}
\ No newline at end of file
+}
+
+// Test that expired entries are not returned and are counted
+func TestLRU_TTL(t *testing.T) {
+	reasons := make(map[EvictReason]int)
+	l := NewLRUWithTTL(10, 20*time.Millisecond, nil)
+	l.SetEvictReasonCallback(func(k interface{}, v interface{}, reason EvictReason) {
+		reasons[reason]++
+	})
+
+	l.Add(1, 1)
+	l.AddWithTTL(2, 2, 0)
+	if v, ok := l.Get(1); !ok || v != 1 {
+		t.Fatalf("1 should be set to 1: %v, %v", v, ok)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if l.Contains(1) {
+		t.Errorf("1 should be expired")
+	}
+	if _, ok := l.Peek(1); ok {
+		t.Errorf("1 should be expired")
+	}
+	if _, ok := l.Get(1); ok {
+		t.Errorf("1 should be expired")
+	}
+	if v, ok := l.Get(2); !ok || v != 2 {
+		t.Errorf("2 should never expire: %v, %v", v, ok)
+	}
+
+	stats := l.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Expirations != 1 || reasons[EvictReasonExpired] != 1 {
+		t.Errorf("bad stats: %+v %v", stats, reasons)
+	}
+}
+
+// Test that the sweeper removes expired entries without them being touched
+func TestLRU_Sweeper(t *testing.T) {
+	evictCounter := 0
+	l := NewLRUWithTTL(10, 10*time.Millisecond, func(k interface{}, v interface{}) {
+		evictCounter++
+	})
+	for i := 0; i < 5; i++ {
+		l.Add(i, i)
+	}
+
+	l.StartSweeper(5 * time.Millisecond)
+	defer l.StopSweeper()
+	time.Sleep(50 * time.Millisecond)
+
+	if l.Len() != 0 {
+		t.Errorf("bad len: %v", l.Len())
+	}
+	if l.Stats().Expirations != 5 {
+		t.Errorf("bad expirations: %v", l.Stats().Expirations)
+	}
+}
+
+// Test that capacity evictions report their reason
+func TestLRU_EvictReason(t *testing.T) {
+	reasons := make(map[EvictReason]int)
+	l := NewLRU(1, nil)
+	l.SetEvictReasonCallback(func(k interface{}, v interface{}, reason EvictReason) {
+		reasons[reason]++
+	})
+
+	l.Add(1, 1)
+	l.Add(2, 2)
+	l.Remove(2)
+	l.Add(3, 3)
+	l.Purge()
+	if reasons[EvictReasonCapacity] != 1 || reasons[EvictReasonRemoved] != 1 || reasons[EvictReasonPurged] != 1 {
+		t.Errorf("bad reasons: %v", reasons)
+	}
+	if l.Stats().Evictions != 1 {
+		t.Errorf("bad evictions: %v", l.Stats().Evictions)
+	}
+}
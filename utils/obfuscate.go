@@ -8,6 +8,7 @@
 package utils
 
 import (
+	"crypto/sha256"
 	"math/rand"
 	"encoding/binary"
 	"time"
@@ -23,29 +24,61 @@ func init() {
 }
 
 func ObfuscateData(data []byte) []byte {
-	l := len(data)
+	buf := make([]byte, len(data) + 2)
+	copy(buf[2:], data)
+	ObfuscateInPlace(buf)
+
+	return buf
+}
+
+//buf[2:]为原始数据，就地混淆并填上前2字节的混淆头，用于发送时复用缓冲区
+func ObfuscateInPlace(buf []byte) {
+	ObfuscateInPlaceWithDict(buf, obfDict)
+}
+
+//同ObfuscateInPlace，但用dict代替内置的字典
+func ObfuscateInPlaceWithDict(buf []byte, dict []byte) {
+	l := len(buf) - 2
 	r := rand.Intn(65536) + l
 
-	buf := make([]byte, l + 2)
 	binary.BigEndian.PutUint16(buf[0:2], uint16(r))
 	for i:=0; i<l; i++ {
-		buf[i+2] = obfDict[(i+r)%len(obfDict)] ^ data[i]
+		buf[i+2] = dict[(i+r)%len(dict)] ^ buf[i+2]
 	}
-
-	return buf
 }
 
 func DataFromObfuscated(obf []byte) []byte {
+	return DataFromObfuscatedWithDict(obf, obfDict)
+}
+
+func DataFromObfuscatedWithDict(obf []byte, dict []byte) []byte {
+	if len(obf) < 2 {
+		return nil
+	}
 	r := binary.BigEndian.Uint16(obf[0:2])
 
 	buf := make([]byte, len(obf) - 2)
 	for i:=0; i<len(buf); i++ {
-		buf[i] = obfDict[(i+int(r))%len(obfDict)] ^ obf[i+2]
+		buf[i] = dict[(i+int(r))%len(dict)] ^ obf[i+2]
 	}
 
 	return buf
 }
 
+//由secret派生出和内置字典一样长的混淆字典，用于可轮换的混淆密钥，见relay/obfkey.go
+func ObfuscationDict(secret string) []byte {
+	dict := make([]byte, 0, len(obfDict)+sha256.Size)
+	var counter [4]byte
+	for i := uint32(0); len(dict) < len(obfDict); i++ {
+		binary.BigEndian.PutUint32(counter[:], i)
+		h := sha256.New()
+		h.Write([]byte(secret))
+		h.Write(counter[:])
+		dict = h.Sum(dict)
+	}
+	return dict[:len(obfDict)]
+}
+
 
 var obfDict = []byte{
 	0x34, 0x88, 0x7d, 0xd9, 0xa6, 0x27, 0xcc, 0x5c, 0x18, 0xec, 0x09, 0x56, 0x4c, 0x47, 0xdd, 0x9c,
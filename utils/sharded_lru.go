@@ -0,0 +1,166 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// Cache is the interface shared by LRU and ShardedLRU
+type Cache interface {
+	Add(key, value interface{}) bool
+	AddWithTTL(key, value interface{}, ttl time.Duration) bool
+	Get(key interface{}) (value interface{}, ok bool)
+	Contains(key interface{}) (ok bool)
+	Peek(key interface{}) (value interface{}, ok bool)
+	Remove(key interface{}) bool
+	RemoveExpired() int
+	Purge()
+	Len() int
+	Stats() LRUStats
+	StartSweeper(interval time.Duration)
+	StopSweeper()
+}
+
+var _ Cache = (*LRU)(nil)
+var _ Cache = (*ShardedLRU)(nil)
+
+// ShardedLRU spreads keys over independent LRUs, each with its own lock,
+// so that parallel packet handlers do not all contend on one mutex.
+// Recency and capacity are per shard, so eviction order is only approximately LRU.
+type ShardedLRU struct {
+	shards []*LRU
+}
+
+// NewShardedLRU constructs a cache of about size entries split into shards
+func NewShardedLRU(shards int, size int, ttl time.Duration, onEvict EvictCallback) *ShardedLRU {
+	if shards < 1 {
+		shards = 1
+	}
+	shardSize := (size + shards - 1) / shards
+	c := &ShardedLRU{
+		shards: make([]*LRU, shards),
+	}
+	for i := range c.shards {
+		c.shards[i] = NewLRUWithTTL(shardSize, ttl, onEvict)
+	}
+	return c
+}
+
+func (c *ShardedLRU) shard(key interface{}) *LRU {
+	var h uint64
+	switch k := key.(type) {
+	case string:
+		f := fnv.New64a()
+		f.Write([]byte(k))
+		h = f.Sum64()
+	case int:
+		h = uint64(k)
+	case int64:
+		h = uint64(k)
+	case uint64:
+		h = k
+	case int32:
+		h = uint64(k)
+	case uint32:
+		h = uint64(k)
+	default:
+		f := fnv.New64a()
+		f.Write([]byte(fmt.Sprint(k)))
+		h = f.Sum64()
+	}
+	// mix the bits so that sequential integer keys spread evenly
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return c.shards[h%uint64(len(c.shards))]
+}
+
+// Add adds a value to the cache. Returns true if an eviction occurred.
+func (c *ShardedLRU) Add(key, value interface{}) bool {
+	return c.shard(key).Add(key, value)
+}
+
+// AddWithTTL adds a value that expires after ttl, 0 means never.
+func (c *ShardedLRU) AddWithTTL(key, value interface{}, ttl time.Duration) bool {
+	return c.shard(key).AddWithTTL(key, value, ttl)
+}
+
+// Get looks up a key's value from the cache.
+func (c *ShardedLRU) Get(key interface{}) (value interface{}, ok bool) {
+	return c.shard(key).Get(key)
+}
+
+// Contains checks if a key is in the cache without updating recent-ness.
+func (c *ShardedLRU) Contains(key interface{}) (ok bool) {
+	return c.shard(key).Contains(key)
+}
+
+// Peek returns the key value without updating recent-ness.
+func (c *ShardedLRU) Peek(key interface{}) (value interface{}, ok bool) {
+	return c.shard(key).Peek(key)
+}
+
+// Remove removes the provided key from the cache.
+func (c *ShardedLRU) Remove(key interface{}) bool {
+	return c.shard(key).Remove(key)
+}
+
+// RemoveExpired removes expired entries from all shards.
+func (c *ShardedLRU) RemoveExpired() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.RemoveExpired()
+	}
+	return n
+}
+
+// Purge clears all shards.
+func (c *ShardedLRU) Purge() {
+	for _, s := range c.shards {
+		s.Purge()
+	}
+}
+
+// Len returns the number of items in all shards.
+func (c *ShardedLRU) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// Stats returns the sum of the shard counters.
+func (c *ShardedLRU) Stats() LRUStats {
+	var stats LRUStats
+	for _, s := range c.shards {
+		ss := s.Stats()
+		stats.Hits += ss.Hits
+		stats.Misses += ss.Misses
+		stats.Evictions += ss.Evictions
+		stats.Expirations += ss.Expirations
+	}
+	return stats
+}
+
+// StartSweeper starts a sweeper for every shard.
+func (c *ShardedLRU) StartSweeper(interval time.Duration) {
+	for _, s := range c.shards {
+		s.StartSweeper(interval)
+	}
+}
+
+// StopSweeper stops the sweepers started by StartSweeper.
+func (c *ShardedLRU) StopSweeper() {
+	for _, s := range c.shards {
+		s.StopSweeper()
+	}
+}
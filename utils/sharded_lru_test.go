@@ -0,0 +1,85 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package utils
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedLRU(t *testing.T) {
+	l := NewShardedLRU(8, 4096, 0, nil)
+
+	for i := 0; i < 512; i++ {
+		l.Add(i, i)
+		l.Add("k"+strconv.Itoa(i), i)
+	}
+	if l.Len() != 1024 {
+		t.Fatalf("bad len: %v", l.Len())
+	}
+	for i := 0; i < 512; i++ {
+		if v, ok := l.Get(i); !ok || v != i {
+			t.Fatalf("bad key: %v", i)
+		}
+		if v, ok := l.Peek("k" + strconv.Itoa(i)); !ok || v != i {
+			t.Fatalf("bad key: k%v", i)
+		}
+	}
+	if !l.Remove(7) || l.Contains(7) {
+		t.Fatalf("7 should be removed")
+	}
+	if l.Stats().Hits != 512 {
+		t.Fatalf("bad hits: %v", l.Stats().Hits)
+	}
+
+	l.Purge()
+	if l.Len() != 0 {
+		t.Fatalf("bad len: %v", l.Len())
+	}
+}
+
+// Test that keys are spread over the shards and capacity holds overall
+func TestShardedLRU_Capacity(t *testing.T) {
+	l := NewShardedLRU(16, 1600, 0, nil)
+	for i := 0; i < 10000; i++ {
+		l.Add(i, i)
+	}
+	if l.Len() != 1600 {
+		t.Fatalf("bad len: %v", l.Len())
+	}
+	for i, s := range l.shards {
+		if s.Len() != 100 {
+			t.Fatalf("shard %v not full: %v", i, s.Len())
+		}
+	}
+}
+
+// dedup style load: mostly new keys, each checked then added
+func benchmarkCacheParallel(b *testing.B, c Cache) {
+	var worker int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddInt64(&worker, 1) << 32
+		for pb.Next() {
+			i++
+			key := strconv.FormatInt(i, 10)
+			if !c.Contains(key) {
+				c.Add(key, true)
+			}
+		}
+	})
+}
+
+func BenchmarkLRU_Parallel(b *testing.B) {
+	benchmarkCacheParallel(b, NewLRU(10000, nil))
+}
+
+func BenchmarkShardedLRU_Parallel(b *testing.B) {
+	benchmarkCacheParallel(b, NewShardedLRU(32, 10000, 0, nil))
+}
@@ -0,0 +1,119 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// TimeWheel is a hashed wheel timer. Schedule and Cancel are O(1), and each
+// tick only visits one slot, so it stays cheap with many pending timeouts.
+// It has no goroutine of its own: the owner calls Advance from its loop and
+// the callbacks run there, which keeps single-goroutine services lock free.
+type TimeWheel struct {
+	tick    time.Duration
+	slots   []map[*Timeout]struct{}
+	current int
+	last    time.Time // time of the last processed tick
+	lock    sync.Mutex
+}
+
+// Timeout is a handle returned by Schedule
+type Timeout struct {
+	rounds    int // full turns of the wheel left before it fires
+	slot      int
+	fn        func()
+	cancelled bool
+}
+
+// NewTimeWheel constructs a wheel with the given tick and number of slots.
+// Delays are rounded up to a whole tick.
+func NewTimeWheel(tick time.Duration, slots int) *TimeWheel {
+	w := &TimeWheel{
+		tick:  tick,
+		slots: make([]map[*Timeout]struct{}, slots),
+		last:  time.Now(),
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[*Timeout]struct{})
+	}
+	return w
+}
+
+// Schedule runs fn once after delay
+func (w *TimeWheel) Schedule(delay time.Duration, fn func()) *Timeout {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	ticks := int((delay + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t := &Timeout{
+		rounds: (ticks - 1) / len(w.slots),
+		slot:   (w.current + ticks) % len(w.slots),
+		fn:     fn,
+	}
+	w.slots[t.slot][t] = struct{}{}
+	return t
+}
+
+// Cancel stops t from firing, returning false if it already fired or was cancelled
+func (w *TimeWheel) Cancel(t *Timeout) bool {
+	if t == nil {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.slots[t.slot][t]; !ok {
+		return false
+	}
+	delete(w.slots[t.slot], t)
+	t.cancelled = true
+	return true
+}
+
+// Len returns the number of pending timeouts
+func (w *TimeWheel) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n := 0
+	for _, slot := range w.slots {
+		n += len(slot)
+	}
+	return n
+}
+
+// Advance processes every tick that elapsed up to now and runs the due callbacks
+func (w *TimeWheel) Advance(now time.Time) {
+	for {
+		w.lock.Lock()
+		if now.Sub(w.last) < w.tick {
+			w.lock.Unlock()
+			return
+		}
+		w.last = w.last.Add(w.tick)
+		w.current = (w.current + 1) % len(w.slots)
+		var due []*Timeout
+		for t := range w.slots[w.current] {
+			if t.rounds > 0 {
+				t.rounds--
+				continue
+			}
+			delete(w.slots[w.current], t)
+			due = append(due, t)
+		}
+		w.lock.Unlock()
+
+		// callbacks may Schedule or Cancel, so run them without the lock
+		for _, t := range due {
+			t.fn()
+		}
+	}
+}
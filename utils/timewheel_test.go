@@ -0,0 +1,76 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWheel(t *testing.T) {
+	w := NewTimeWheel(10*time.Millisecond, 8)
+	start := w.last
+	fired := make(map[int]time.Duration)
+	for _, d := range []int{5, 10, 30, 80, 250} {
+		d := d
+		w.Schedule(time.Duration(d)*time.Millisecond, func() {
+			fired[d] = w.last.Sub(start)
+		})
+	}
+	cancelled := w.Schedule(40*time.Millisecond, func() {
+		t.Errorf("cancelled timeout fired")
+	})
+	if !w.Cancel(cancelled) || w.Cancel(cancelled) {
+		t.Errorf("cancel should succeed exactly once")
+	}
+	if w.Len() != 5 {
+		t.Fatalf("bad len: %v", w.Len())
+	}
+
+	w.Advance(start.Add(100 * time.Millisecond))
+	if len(fired) != 4 {
+		t.Fatalf("bad fired: %v", fired)
+	}
+	for d, at := range fired {
+		want := time.Duration(d) * time.Millisecond
+		if want < 10*time.Millisecond {
+			want = 10 * time.Millisecond
+		}
+		if at != want {
+			t.Errorf("timeout %vms fired at %v", d, at)
+		}
+	}
+
+	// 250ms needs more than one turn of the 80ms wheel
+	w.Advance(start.Add(240 * time.Millisecond))
+	if len(fired) != 4 {
+		t.Fatalf("250ms fired too early")
+	}
+	w.Advance(start.Add(250 * time.Millisecond))
+	if len(fired) != 5 || w.Len() != 0 {
+		t.Fatalf("bad fired: %v", fired)
+	}
+}
+
+// Test that a callback can reschedule itself
+func TestTimeWheel_Reschedule(t *testing.T) {
+	w := NewTimeWheel(10*time.Millisecond, 4)
+	start := w.last
+	count := 0
+	var fn func()
+	fn = func() {
+		count++
+		w.Schedule(20*time.Millisecond, fn)
+	}
+	w.Schedule(20*time.Millisecond, fn)
+
+	w.Advance(start.Add(100 * time.Millisecond))
+	if count != 5 {
+		t.Fatalf("bad count: %v", count)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package utils
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+// maxStackDump bounds the buffer used to dump all goroutine stacks
+const maxStackDump = 64 << 20
+
+// Watchdog notices goroutines that stopped making progress, so that a
+// deadlocked or spinning loop shows up in the log instead of as a silent
+// outage. A watched goroutine brackets each unit of work with Busy and Idle.
+// Blocking while idle (waiting for the next packet) is normal; staying busy
+// longer than the threshold is a stall. On the first check that sees a stall
+// the watchdog logs the stacks of all goroutines and calls onStall, once per
+// stall; the heartbeat is reported again only after it has gone idle.
+type Watchdog struct {
+	threshold time.Duration
+	onStall   func(name string, busy time.Duration)
+	lock      sync.Mutex
+	beats     []*Heartbeat
+	stop      chan struct{}
+}
+
+// Heartbeat is the handle of one watched goroutine. A nil Heartbeat is valid
+// and does nothing, for services running without a watchdog.
+type Heartbeat struct {
+	name    string
+	busy    int64 // unix nanoseconds the current work started, 0 when idle
+	stalled bool  // reported already, only touched under the watchdog lock
+}
+
+// NewWatchdog constructs a watchdog, onStall may be nil
+func NewWatchdog(threshold time.Duration, onStall func(name string, busy time.Duration)) *Watchdog {
+	return &Watchdog{
+		threshold: threshold,
+		onStall:   onStall,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Watch registers a goroutine under name and returns its heartbeat, nil
+// when w is nil
+func (w *Watchdog) Watch(name string) *Heartbeat {
+	if w == nil {
+		return nil
+	}
+	h := &Heartbeat{name: name}
+	w.lock.Lock()
+	w.beats = append(w.beats, h)
+	w.lock.Unlock()
+	return h
+}
+
+// Busy marks the start of a unit of work
+func (h *Heartbeat) Busy() {
+	if h != nil {
+		atomic.StoreInt64(&h.busy, time.Now().UnixNano())
+	}
+}
+
+// Idle marks the end of a unit of work
+func (h *Heartbeat) Idle() {
+	if h != nil {
+		atomic.StoreInt64(&h.busy, 0)
+	}
+}
+
+// Check reports heartbeats that have been busy longer than the threshold at
+// now and returns their names. Start calls it periodically.
+func (w *Watchdog) Check(now time.Time) []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var stalled []string
+	var durations []time.Duration
+	for _, h := range w.beats {
+		busy := atomic.LoadInt64(&h.busy)
+		if busy == 0 {
+			h.stalled = false
+			continue
+		}
+		d := now.Sub(time.Unix(0, busy))
+		if d <= w.threshold || h.stalled {
+			continue
+		}
+		h.stalled = true
+		stalled = append(stalled, h.name)
+		durations = append(durations, d)
+	}
+	if len(stalled) == 0 {
+		return nil
+	}
+
+	for i, name := range stalled {
+		logging.Logger.Error("watchdog: ", name, " busy for ", durations[i], " without progress")
+	}
+	logging.Logger.Error("watchdog: goroutine stacks:\n", string(goroutineStacks()))
+	if w.onStall != nil {
+		for i, name := range stalled {
+			w.onStall(name, durations[i])
+		}
+	}
+	return stalled
+}
+
+// Start checks every quarter of the threshold until Stop
+func (w *Watchdog) Start() {
+	if w == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(w.threshold / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case now := <-ticker.C:
+				w.Check(now)
+			}
+		}
+	}()
+}
+
+func (w *Watchdog) Stop() {
+	if w != nil {
+		close(w.stop)
+	}
+}
+
+// ExitOnStall is an onStall that exits the process, so that the supervisor
+// (systemd, kubernetes) restarts it. A stuck goroutine cannot be stopped from
+// the outside, so restarting the process is the only way to recover.
+func ExitOnStall(name string, busy time.Duration) {
+	logging.Logger.Error("watchdog: exit for restart, ", name, " stalled for ", busy)
+	os.Exit(2)
+}
+
+func goroutineStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStackDump {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	var reported []string
+	w := NewWatchdog(time.Second, func(name string, busy time.Duration) {
+		reported = append(reported, name)
+	})
+	loop := w.Watch("loop")
+	reader := w.Watch("reader")
+
+	loop.Busy()
+	reader.Idle()
+	now := time.Now()
+	if stalled := w.Check(now); stalled != nil {
+		t.Fatalf("stalled %v right after busy", stalled)
+	}
+	if stalled := w.Check(now.Add(2 * time.Second)); len(stalled) != 1 || stalled[0] != "loop" {
+		t.Fatalf("stalled %v, want [loop]", stalled)
+	}
+	if stalled := w.Check(now.Add(3 * time.Second)); stalled != nil {
+		t.Errorf("stall reported again: %v", stalled)
+	}
+
+	//空闲后再卡住要重新报告
+	loop.Idle()
+	w.Check(now.Add(4 * time.Second))
+	loop.Busy()
+	if stalled := w.Check(time.Now().Add(2 * time.Second)); len(stalled) != 1 {
+		t.Errorf("second stall not reported: %v", stalled)
+	}
+	if len(reported) != 2 {
+		t.Errorf("onStall called for %v", reported)
+	}
+}
+
+func TestWatchdogNil(t *testing.T) {
+	var w *Watchdog
+	beat := w.Watch("loop")
+	beat.Busy()
+	beat.Idle()
+	w.Start()
+	w.Stop()
+}
@@ -0,0 +1,243 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package webrtc_bridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+/*
+WebRTC bridge：
+1. 浏览器通过 POST /join?sid=xx&uid=xx 提交offer sdp，bridge回复answer sdp (类WHIP)
+2. bridge为每个浏览器用户在relay上注册为同uid的participant，并向session manager发invite加入多方通话
+3. 浏览器的RTP载荷重新打包成relay的Message，relay来的音视频包打包成RTP发给浏览器
+   两者载荷格式的转换由PayloadConverter完成，默认透传
+*/
+
+type PayloadConverter interface {
+	FromRtp(kind webrtc.RTPCodecType, pkt *rtp.Packet) (msgType uint8, payload []byte)
+	ToRtp(msg *relay.Message) []byte
+}
+
+type passthroughConverter struct{}
+
+func (c passthroughConverter) FromRtp(kind webrtc.RTPCodecType, pkt *rtp.Packet) (uint8, []byte) {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return relay.UdpMessageTypeAudioStream, pkt.Payload
+	}
+	return relay.UdpMessageTypeVideoStream, pkt.Payload
+}
+
+func (c passthroughConverter) ToRtp(msg *relay.Message) []byte {
+	return msg.Payload
+}
+
+type Bridge struct {
+	config    *Config
+	api       *webrtc.API
+	converter PayloadConverter
+	peers     map[string]*Peer
+	server    *http.Server
+	isRunning bool
+	lock      sync.RWMutex
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	ticker    *time.Ticker
+}
+
+func NewBridge(config *Config) (*Bridge, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	b := &Bridge{
+		config:    config,
+		api:       webrtc.NewAPI(webrtc.WithMediaEngine(m)),
+		converter: passthroughConverter{},
+		peers:     make(map[string]*Peer),
+		stop:      make(chan struct{}),
+		ticker:    time.NewTicker(relay.ServerRegInterval),
+	}
+	return b, nil
+}
+
+func (b *Bridge) SetPayloadConverter(converter PayloadConverter) {
+	b.converter = converter
+}
+
+func (b *Bridge) Start() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.isRunning {
+		return
+	}
+	b.isRunning = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/join", b.handleJoin)
+	mux.HandleFunc("/leave", b.handleLeave)
+	b.server = &http.Server{Addr: b.config.HttpAddr, Handler: mux}
+	go func() {
+		logging.Logger.Info("webrtc bridge listen on:", b.config.HttpAddr)
+		if err := b.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logging.Logger.Error("webrtc bridge http error ", err)
+		}
+	}()
+
+	b.wg.Add(1)
+	go b.loop()
+}
+
+func (b *Bridge) Stop() {
+	b.lock.Lock()
+	if !b.isRunning {
+		b.lock.Unlock()
+		return
+	}
+	b.isRunning = false
+	peers := b.peers
+	b.peers = make(map[string]*Peer)
+	b.lock.Unlock()
+
+	b.server.Close()
+	for _, p := range peers {
+		p.close()
+	}
+	close(b.stop)
+}
+
+func (b *Bridge) WaitForShutdown() {
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigc)
+		<-sigc
+		b.Stop()
+	}()
+
+	b.wg.Wait()
+}
+
+func (b *Bridge) loop() {
+	defer b.wg.Done()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-b.ticker.C:
+			//relay上的user注册10分钟过期，需要定期刷新
+			b.lock.RLock()
+			for _, p := range b.peers {
+				p.register()
+			}
+			b.lock.RUnlock()
+		}
+	}
+}
+
+func peerKey(uid int64, sid int64) string {
+	return fmt.Sprintf("%d/%d", uid, sid)
+}
+
+func parseIds(r *http.Request) (uid int64, sid int64, err error) {
+	uid, err = strconv.ParseInt(r.URL.Query().Get("uid"), 10, 64)
+	if err != nil {
+		return
+	}
+	sid, err = strconv.ParseInt(r.URL.Query().Get("sid"), 10, 64)
+	return
+}
+
+func (b *Bridge) handleJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uid, sid, err := parseIds(r)
+	if err != nil || sid == 0 {
+		http.Error(w, "incorrect uid or sid", http.StatusBadRequest)
+		return
+	}
+	offer, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "incorrect offer", http.StatusBadRequest)
+		return
+	}
+
+	b.lock.RLock()
+	_, existed := b.peers[peerKey(uid, sid)]
+	b.lock.RUnlock()
+	if existed {
+		http.Error(w, "already joined", http.StatusConflict)
+		return
+	}
+
+	p, err := newPeer(b, uid, sid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	answer, err := p.negotiate(string(offer))
+	if err != nil {
+		logging.Logger.Warn("webrtc negotiate error for ", uid, " of session ", sid, ":", err)
+		p.close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.lock.Lock()
+	b.peers[peerKey(uid, sid)] = p
+	b.lock.Unlock()
+	p.join()
+	logging.Logger.Info("webrtc peer ", uid, " joined session ", sid)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+func (b *Bridge) handleLeave(w http.ResponseWriter, r *http.Request) {
+	uid, sid, err := parseIds(r)
+	if err != nil {
+		http.Error(w, "incorrect uid or sid", http.StatusBadRequest)
+		return
+	}
+	b.lock.RLock()
+	p := b.peers[peerKey(uid, sid)]
+	b.lock.RUnlock()
+	if p == nil {
+		http.Error(w, "not joined", http.StatusNotFound)
+		return
+	}
+	b.removePeer(p)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (b *Bridge) removePeer(p *Peer) {
+	b.lock.Lock()
+	if b.peers[peerKey(p.Uid, p.Sid)] == p {
+		delete(b.peers, peerKey(p.Uid, p.Sid))
+	}
+	b.lock.Unlock()
+	p.close()
+}
@@ -0,0 +1,46 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package webrtc_bridge
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+)
+
+type Config struct {
+	HttpAddr     string   `toml:"http_addr"`     //浏览器提交offer的http地址
+	Relay        string   `toml:"relay"`         //默认媒体和信令relay
+	IceServers   []string `toml:"ice_servers"`   //stun/turn
+	AccessSecret string   `toml:"access_secret"` //relay开启接入控制时，用于给bridge上的peer签发access token
+}
+
+func GetConfig(ctx *cli.Context) *Config {
+	config := GetDefaultConfig()
+	if ctx.GlobalIsSet("http_port") {
+		config.HttpAddr = fmt.Sprintf(":%d", ctx.GlobalInt("http_port"))
+	}
+	if ctx.GlobalIsSet("relay") {
+		config.Relay = ctx.GlobalString("relay")
+	}
+	if ctx.GlobalIsSet("access_secret") {
+		config.AccessSecret = ctx.GlobalString("access_secret")
+	}
+	return config
+}
+
+func GetDefaultConfig() *Config {
+	var config *Config
+
+	config = &Config{
+		HttpAddr:   ":18080",
+		Relay:      "127.0.0.1:19001",
+		IceServers: []string{"stun:stun.l.google.com:19302"},
+	}
+	return config
+}
@@ -0,0 +1,224 @@
+/*
+ * // Copyright (C) 2017 Yeecall authors
+ * //
+ * // This file is part of the Yecall library.
+ *
+ */
+
+package webrtc_bridge
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/xujiajundd/ycng/relay"
+	"github.com/xujiajundd/ycng/session_manager"
+	"github.com/xujiajundd/ycng/utils/logging"
+)
+
+// 一个浏览器用户在bridge上的代理：WebRTC侧是一个PeerConnection，relay侧是一个普通的session participant
+type Peer struct {
+	Uid       int64
+	Sid       int64
+	bridge    *Bridge
+	pc        *webrtc.PeerConnection
+	conn      *net.UDPConn //每个peer单独一个socket，relay按地址区分participant
+	relayAddr *net.UDPAddr
+	audioOut  *webrtc.TrackLocalStaticRTP
+	videoOut  *webrtc.TrackLocalStaticRTP
+	audioSeq  uint16
+	videoSeq  uint16
+	closeOnce sync.Once
+}
+
+func newPeer(b *Bridge, uid int64, sid int64) (*Peer, error) {
+	relayAddr, err := net.ResolveUDPAddr("udp4", b.config.Relay)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Peer{
+		Uid:       uid,
+		Sid:       sid,
+		bridge:    b,
+		conn:      conn,
+		relayAddr: relayAddr,
+	}
+	return p, nil
+}
+
+// 处理浏览器的offer，返回answer sdp
+func (p *Peer) negotiate(offer string) (string, error) {
+	iceServers := []webrtc.ICEServer{}
+	if len(p.bridge.config.IceServers) > 0 {
+		iceServers = append(iceServers, webrtc.ICEServer{URLs: p.bridge.config.IceServers})
+	}
+	pc, err := p.bridge.api.NewPeerConnection(webrtc.Configuration{ICEServers: iceServers})
+	if err != nil {
+		return "", err
+	}
+	p.pc = pc
+
+	p.audioOut, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "ycng")
+	if err != nil {
+		return "", err
+	}
+	if _, err = pc.AddTrack(p.audioOut); err != nil {
+		return "", err
+	}
+	p.videoOut, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "ycng")
+	if err != nil {
+		return "", err
+	}
+	if _, err = pc.AddTrack(p.videoOut); err != nil {
+		return "", err
+	}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		go p.forwardTrack(track)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		logging.Logger.Info("webrtc peer ", p.Uid, " of session ", p.Sid, " state ", state.String())
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			go p.bridge.removePeer(p) //不能在pion的回调里同步Close
+		}
+	})
+
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gatherComplete
+
+	return pc.LocalDescription().SDP, nil
+}
+
+// 加入relay上的session并通过session manager进入多方通话
+func (p *Peer) join() {
+	p.register()
+	p.sendToRelay(relay.NewMessage(relay.UdpMessageTypeTurnReg, p.Uid, p.Sid, 0, nil, nil))
+	p.sendSignal(relay.YCKCallSignalTypeInvite)
+	go p.readRelay()
+}
+
+func (p *Peer) register() {
+	var token []byte
+	if p.bridge.config.AccessSecret != "" {
+		token = relay.IssueAccessToken(p.bridge.config.AccessSecret, p.Uid, time.Now().Add(relay.AccessTokenTTL))
+	}
+	p.sendToRelay(relay.NewMessage(relay.UdpMessageTypeUserReg, p.Uid, 0, 0, token, nil))
+}
+
+func (p *Peer) close() {
+	p.closeOnce.Do(func() {
+		p.sendSignal(relay.YCKCallSignalTypeEnd)
+		p.sendToRelay(relay.NewMessage(relay.UdpMessageTypeTurnUnReg, p.Uid, p.Sid, 0, nil, nil))
+		if p.pc != nil {
+			p.pc.Close()
+		}
+		p.conn.Close()
+	})
+}
+
+func (p *Peer) sendSignal(signalType uint16) {
+	s := relay.NewSignal(signalType, p.Uid, session_manager.SessionManagerUserId, p.Sid)
+	payload, err := s.Marshal()
+	if err != nil {
+		logging.Logger.Warn("signal marshal error:", err)
+		return
+	}
+	p.sendToRelay(relay.NewMessage(relay.UdpMessageTypeUserSignal, p.Uid, session_manager.SessionManagerUserId, 0, payload, nil))
+}
+
+func (p *Peer) sendToRelay(msg *relay.Message) {
+	_, err := p.conn.WriteToUDP(msg.ObfuscatedDataOfMessage(), p.relayAddr)
+	if err != nil {
+		logging.Logger.Error("udp write error", err)
+	}
+}
+
+// 浏览器 -> relay
+func (p *Peer) forwardTrack(track *webrtc.TrackRemote) {
+	logging.Logger.Info("webrtc peer ", p.Uid, " track ", track.Kind().String(), " codec ", track.Codec().MimeType)
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		msgType, payload := p.bridge.converter.FromRtp(track.Kind(), pkt)
+		if len(payload) == 0 {
+			continue
+		}
+		msg := relay.NewMessage(msgType, p.Uid, p.Sid, 0, payload, nil)
+		msg.Timestamp = uint16(time.Now().UnixNano() / int64(time.Millisecond))
+		p.sendToRelay(msg)
+	}
+}
+
+// relay -> 浏览器
+func (p *Peer) readRelay() {
+	var buf [65536]byte
+
+	for {
+		size, _, err := p.conn.ReadFromUDP(buf[0:])
+		if err != nil {
+			return
+		}
+		msg, err := relay.NewMessageFromObfuscatedData(buf[0:size])
+		if err != nil {
+			continue
+		}
+
+		switch msg.MsgType {
+		case relay.UdpMessageTypeAudioStream:
+			p.writeTrack(p.audioOut, &p.audioSeq, 48, msg)
+		case relay.UdpMessageTypeVideoStream, relay.UdpMessageTypeVideoStreamIFrame:
+			p.writeTrack(p.videoOut, &p.videoSeq, 90, msg)
+		case relay.UdpMessageTypeTurnRegNoExist:
+			p.sendToRelay(relay.NewMessage(relay.UdpMessageTypeTurnReg, p.Uid, p.Sid, 0, nil, nil))
+		case relay.UdpMessageTypeUserSignal:
+			s := relay.NewSignalTemp()
+			if s.Unmarshal(msg.Payload) == nil && s.SessionId == p.Sid && s.To == p.Uid && s.Signal == relay.YCKCallSignalTypeEnd {
+				logging.Logger.Info("webrtc peer ", p.Uid, " ended by session manager for session ", p.Sid)
+				go p.bridge.removePeer(p)
+			}
+		default:
+		}
+	}
+}
+
+// clockPerMs为该媒体的RTP时钟频率(每毫秒)，opus为48，视频为90
+func (p *Peer) writeTrack(track *webrtc.TrackLocalStaticRTP, seq *uint16, clockPerMs int64, msg *relay.Message) {
+	if track == nil {
+		return
+	}
+	payload := p.bridge.converter.ToRtp(msg)
+	if len(payload) == 0 {
+		return
+	}
+	*seq++
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: *seq,
+			Timestamp:      uint32(time.Now().UnixNano() / int64(time.Millisecond) * clockPerMs),
+		},
+		Payload: payload,
+	}
+	track.WriteRTP(pkt)
+}